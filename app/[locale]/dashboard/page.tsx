@@ -69,6 +69,7 @@ interface EventInvite {
     disabledSlots: string[]
     inviterId: string
     inviterUsername: string
+    message?: string
     createdAt: string
 }
 
@@ -709,6 +710,9 @@ export default function Dashboard() {
                                                 <p className="text-sm text-muted-foreground">
                                                     {tDashboard("invites.invitedBy", { name: invite.inviterUsername })}
                                                 </p>
+                                                {invite.message && (
+                                                    <p className="text-sm italic whitespace-pre-line mt-2">{invite.message}</p>
+                                                )}
                                                 {invite.dateRange && (
                                                     <p className="text-sm text-muted-foreground flex items-center gap-3 mt-2">
                                                         <span>
@@ -13,7 +13,7 @@ import * as zxcvbnCommonPackage from "@zxcvbn-ts/language-common"
 import * as zxcvbnEnPackage from "@zxcvbn-ts/language-en"
 import { setTokens } from "@/lib/api"
 import { ThemeToggle } from "@/components/theme-toggle"
-import { useTranslations } from "next-intl"
+import { useTranslations, useLocale } from "next-intl"
 import { PrivacyTermsNote } from "@/components/privacy-terms-note"
 
 const API_BASE = process.env.NEXT_PUBLIC_API_BASE_URL ?? "http://localhost:8080"
@@ -34,6 +34,7 @@ const options = {
 zxcvbnOptions.setOptions(options)
 
 export default function LoginPage() {
+    const locale = useLocale()
     const [isRegister, setIsRegister] = useState(false)
     const [username, setUsername] = useState("")
     const [email, setEmail] = useState("")
@@ -135,6 +136,7 @@ export default function LoginPage() {
                         username,
                         email,
                         password,
+                        locale,
                         recaptchaToken: recaptchaToken ?? undefined,
                     }),
                 })
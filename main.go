@@ -1,39 +1,76 @@
 package main
 
 import (
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"container/list"
 	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"database/sql"
+	"database/sql/driver"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/csv"
 	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
 	"errors"
+	"flag"
 	"fmt"
+	"html"
 	"io"
 	"log"
+	mathrand "math/rand/v2"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
 	"net"
 	"net/http"
 	_ "net/http/pprof" // pprof handlers
+	"net/mail"
 	"net/smtp"
+	"net/textproto"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	recaptcha "cloud.google.com/go/recaptchaenterprise/v2/apiv1"
 	recaptchapb "cloud.google.com/go/recaptchaenterprise/v2/apiv1/recaptchaenterprisepb"
+	"github.com/emersion/go-msgauth/dkim"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 	"github.com/joho/godotenv"
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/skip2/go-qrcode"
 	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/sync/errgroup"
 	"golang.org/x/time/rate"
-	_ "modernc.org/sqlite"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
 )
 
 /*
@@ -48,6 +85,7 @@ Security & Architecture Notes (updated)
 
 var (
 	db                 *sql.DB
+	geoReader          *maxminddb.Reader
 	jwtSecret          []byte
 	recaptchaClient    *recaptcha.Client
 	recaptchaProjectID string
@@ -61,14 +99,20 @@ const (
 	refreshTTLShort         = 24 * time.Hour
 	lockoutThreshold        = 5
 	lockoutWindow           = 15 * time.Minute
-	schemaVersion           = 5
+	schemaVersion           = 63
 	refreshCookieName       = "rt"
 	recaptchaActionRegister = "register"
 	verifyResendCooldown    = 15 * time.Minute
+	eventAccessTTL          = 12 * time.Hour
+	eventAccessHeader       = "X-Event-Access"
+	recoveryCodeCount       = 10
+	recoverySessionTTL      = 15 * time.Minute
+	reactivateTTL           = 7 * 24 * time.Hour
 )
 
 var (
 	reqTimeout       = 5 * time.Second
+	adminUserIDs     = map[string]struct{}{}
 	cookieSecure     = true
 	brevoAPIKey      string
 	brevoSenderEmail string
@@ -77,8 +121,14 @@ var (
 	verifyTTL        = 24 * time.Hour
 )
 
-// SSE broadcaster
-type subscriber struct{ ch chan []byte }
+// SSE broadcaster. ch carries persisted changes and a subscriber that can't keep up is
+// dropped so it reconnects and refetches. preview carries ephemeral messages (live grid
+// selections): they are never stored, invalidate nothing and are simply skipped for a
+// slow subscriber.
+type subscriber struct {
+	ch      chan []byte
+	preview chan []byte
+}
 
 var (
 	sseMu        sync.Mutex
@@ -89,11 +139,17 @@ var (
 func sseSubscribe(eventID string) *subscriber {
 	sseMu.Lock()
 	defer sseMu.Unlock()
-	sub := &subscriber{ch: make(chan []byte, 8)}
+	sub := &subscriber{ch: make(chan []byte, 8), preview: make(chan []byte, 16)}
 	if sseSubs[eventID] == nil {
 		sseSubs[eventID] = make(map[*subscriber]struct{})
 	}
 	sseSubs[eventID][sub] = struct{}{}
+	n := 0
+	for _, m := range sseSubs {
+		n += len(m)
+	}
+	statInc("sse_connections")
+	statPeak("sse_peak", int64(n))
 	return sub
 }
 
@@ -107,11 +163,41 @@ func sseUnsubscribe(eventID string, sub *subscriber) {
 		}
 		if len(m) == 0 {
 			delete(sseSubs, eventID)
+			sseSharedMu.Lock()
+			delete(sseSharedViews, eventID)
+			sseSharedMu.Unlock()
+		}
+	}
+}
+
+// sseCloseAll ends every open stream so http.Server.Shutdown isn't held up by
+// connections that never go idle. Clients reconnect to the next instance.
+func sseCloseAll() {
+	sseMu.Lock()
+	defer sseMu.Unlock()
+	for eventID, m := range sseSubs {
+		for sub := range m {
+			close(sub.ch)
 		}
+		delete(sseSubs, eventID)
 	}
 }
 
 func ssePublish(eventID string, payload []byte) {
+	sseDeliver(eventID, payload)
+	realtimeForward(eventID, payload, false)
+	cdnPurge(eventSurrogateKey(eventID))
+}
+
+// ssePreview broadcasts an ephemeral message to every viewer of eventID.
+func ssePreview(eventID string, payload []byte) {
+	sseDeliverPreview(eventID, payload)
+	realtimeForward(eventID, payload, true)
+}
+
+// sseDeliver hands payload to this process's subscribers of eventID.
+func sseDeliver(eventID string, payload []byte) {
+	eventCacheInvalidate(eventID)
 	sseMu.Lock()
 	defer sseMu.Unlock()
 	for sub := range sseSubs[eventID] {
@@ -124,8 +210,110 @@ func ssePublish(eventID string, payload []byte) {
 	}
 }
 
+// sseDeliverPreview hands an ephemeral payload to this process's subscribers of eventID.
+func sseDeliverPreview(eventID string, payload []byte) {
+	sseMu.Lock()
+	defer sseMu.Unlock()
+	for sub := range sseSubs[eventID] {
+		select {
+		case sub.preview <- payload:
+		default:
+			metricInc("plannie_sse_previews_dropped_total")
+		}
+	}
+}
+
+// Metrics: minimal Prometheus text exposition without an external client library.
+var (
+	metricsMu       sync.Mutex
+	metricsCounters = map[string]map[string]float64{}
+	metricsGauges   = map[string]func() float64{}
+)
+
+// metricLabels renders k,v pairs as a Prometheus label set.
+func metricLabels(kv ...string) string {
+	if len(kv) < 2 {
+		return ""
+	}
+	parts := make([]string, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=%q", kv[i], kv[i+1]))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func metricAdd(name string, delta float64, labels ...string) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	if metricsCounters[name] == nil {
+		metricsCounters[name] = map[string]float64{}
+	}
+	metricsCounters[name][metricLabels(labels...)] += delta
+}
+
+func metricInc(name string, labels ...string) { metricAdd(name, 1, labels...) }
+
+func registerGauge(name string, fn func() float64) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	metricsGauges[name] = fn
+}
+
+func metricsHandler(c *gin.Context) {
+	metricsMu.Lock()
+	var b strings.Builder
+	names := make([]string, 0, len(metricsCounters))
+	for n := range metricsCounters {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		fmt.Fprintf(&b, "# TYPE %s counter\n", n)
+		series := make([]string, 0, len(metricsCounters[n]))
+		for l := range metricsCounters[n] {
+			series = append(series, l)
+		}
+		sort.Strings(series)
+		for _, l := range series {
+			fmt.Fprintf(&b, "%s%s %g\n", n, l, metricsCounters[n][l])
+		}
+	}
+	gauges := make([]string, 0, len(metricsGauges))
+	for n := range metricsGauges {
+		gauges = append(gauges, n)
+	}
+	sort.Strings(gauges)
+	fns := make([]func() float64, len(gauges))
+	for i, n := range gauges {
+		fns[i] = metricsGauges[n]
+	}
+	metricsMu.Unlock()
+
+	for i, n := range gauges {
+		fmt.Fprintf(&b, "# TYPE %s gauge\n%s %g\n", n, n, fns[i]())
+	}
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(b.String()))
+}
+
+func sseSubscriberCount() float64 {
+	sseMu.Lock()
+	defer sseMu.Unlock()
+	n := 0
+	for _, m := range sseSubs {
+		n += len(m)
+	}
+	return float64(n)
+}
+
 type Claims struct {
-	UserID string `json:"uid"`
+	UserID   string `json:"uid"`
+	TenantID string `json:"tnt,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// EventAccessClaims scope a token to viewing and joining a single passphrase-protected event.
+type EventAccessClaims struct {
+	EventID string `json:"eid"`
 	jwt.RegisteredClaims
 }
 
@@ -148,6 +336,7 @@ type Event struct {
 	Duration      float64
 	Timezone      string
 	DisabledSlots string
+	Recurrence    string
 	CreatedAt     time.Time
 	UpdatedAt     time.Time
 }
@@ -184,6 +373,14 @@ type EventUpdate struct {
 	Timezone      string                   `json:"timezone"`
 	Participants  []map[string]interface{} `json:"participants"`
 	DisabledSlots []string                 `json:"disabledSlots,omitempty"`
+	Public        *bool                    `json:"public,omitempty"`
+	Tags          []string                 `json:"tags,omitempty"`
+	Passphrase    *string                  `json:"passphrase,omitempty"`
+	HolidayRegion *string                  `json:"holidayRegion,omitempty"`
+	AutoFinalize  *bool                    `json:"autoFinalize,omitempty"`
+	Deadline      *string                  `json:"responseDeadline,omitempty"`
+	GuestMode     *bool                    `json:"guestMode,omitempty"`
+	BookingMode   *bool                    `json:"bookingMode,omitempty"`
 }
 
 var (
@@ -191,6 +388,8 @@ var (
 	passDigit  = regexp.MustCompile(`[0-9]`)
 	passSpec   = regexp.MustCompile(`[!@#\$%\^&\*\(\)\-\_\+\=\{\}\[\]:;\"'<>,\\.\?/\\\|]`)
 	emailRe    = regexp.MustCompile(`^[^\s@]+@[^\s@]+\.[^\s@]+$`)
+
+	likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
 )
 
 func validateUsername(u string) bool { return usernameRe.MatchString(u) }
@@ -202,2593 +401,22810 @@ func validatePassword(p string) bool {
 }
 func validateEmail(e string) bool { return e != "" && emailRe.MatchString(e) }
 
-func hashToken(token string) (string, error) {
-	sum := sha256.Sum256([]byte(token))
-	b, err := bcrypt.GenerateFromPassword([]byte(hex.EncodeToString(sum[:])), 12)
-	if err != nil {
-		return "", err
-	}
-	return string(b), nil
-}
-
-func verifyTokenHash(hash string, token string) error {
-	sum := sha256.Sum256([]byte(token))
-	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(hex.EncodeToString(sum[:])))
-}
+const (
+	maxEventTags   = 10
+	maxEventTagLen = 30
+)
 
-func sendEmailSMTP(to, subject, htmlBody string) error {
-	host := os.Getenv("SMTP_HOST")
-	portStr := os.Getenv("SMTP_PORT")
-	user := os.Getenv("SMTP_USER")
-	pass := os.Getenv("SMTP_PASS")
-	from := os.Getenv("EMAIL_FROM")
-	if host == "" || portStr == "" || from == "" {
-		return fmt.Errorf("SMTP not configured")
+// normalizeTags lowercases, trims and de-duplicates directory tags.
+func normalizeTags(raw []string) []string {
+	out := []string{}
+	seen := map[string]bool{}
+	for _, t := range raw {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || len(t) > maxEventTagLen || seen[t] {
+			continue
+		}
+		seen[t] = true
+		out = append(out, t)
+		if len(out) == maxEventTags {
+			break
+		}
 	}
-	port, _ := strconv.Atoi(portStr)
-	auth := smtp.PlainAuth("", user, pass, host)
-
-	msg := "MIME-Version: 1.0\r\n" +
-		"Content-Type: text/html; charset=\"utf-8\"\r\n" +
-		fmt.Sprintf("From: %s\r\n", from) +
-		fmt.Sprintf("To: %s\r\n", to) +
-		fmt.Sprintf("Subject: %s\r\n\r\n", subject) +
-		htmlBody
-
-	addr := fmt.Sprintf("%s:%d", host, port)
-	return smtp.SendMail(addr, auth, from, []string{to}, []byte(msg))
+	return out
 }
 
-func createEmailToken(userID, kind string, ttl time.Duration) (rawToken, tokenID string, err error) {
-	raw := uuid.NewString()
-	tokenID = uuid.NewString()
-	expires := time.Now().UTC().Add(ttl)
+// Registration spam defenses: disposable domain blocklist, MX validation and a honeypot field.
+var (
+	disposableMu      sync.RWMutex
+	disposableDomains = map[string]struct{}{}
+	defaultDisposable = []string{
+		"10minutemail.com", "discard.email", "dispostable.com", "getnada.com", "guerrillamail.com",
+		"guerrillamail.net", "mailinator.com", "maildrop.cc", "sharklasers.com", "temp-mail.org",
+		"tempmail.com", "throwawaymail.com", "trashmail.com", "yopmail.com",
+	}
+	registrationDomains = map[string]struct{}{}
+	disposableListURL   string
+	disposableRefresh   = 24 * time.Hour
+)
 
-	hashed, err := hashToken(raw)
-	if err != nil {
-		return "", "", err
+func emailDomain(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return ""
 	}
+	return strings.ToLower(strings.TrimSpace(email[at+1:]))
+}
 
-	_, err = db.Exec(`INSERT INTO email_tokens(id, user_id, kind, token_hash, expires_at, created_at, used) VALUES (?,?,?,?,?,?,0)`,
-		tokenID, userID, kind, hashed, expires, time.Now().UTC())
-	if err != nil {
-		return "", "", err
+// emailDomainAllowed enforces REGISTRATION_EMAIL_DOMAINS; an empty list allows every domain.
+func emailDomainAllowed(email string) bool {
+	if len(registrationDomains) == 0 {
+		return true
 	}
-	return raw, tokenID, nil
+	_, ok := registrationDomains[emailDomain(email)]
+	return ok
 }
 
-func verifyEmailTokenByID(tokenID, rawToken, kind string) (userID string, err error) {
-	var id, uid, thash string
-	var expires time.Time
-	var used int
-	err = db.QueryRow(`SELECT id, user_id, token_hash, expires_at, used FROM email_tokens WHERE id = ? AND kind = ?`, tokenID, kind).
-		Scan(&id, &uid, &thash, &expires, &used)
-	if err == sql.ErrNoRows {
-		return "", fmt.Errorf("invalid token")
-	} else if err != nil {
-		return "", err
+// setDisposableDomains replaces the blocklist with defaults, DISPOSABLE_EMAIL_DOMAINS and any fetched entries.
+func setDisposableDomains(fetched []string) {
+	m := map[string]struct{}{}
+	add := func(d string) {
+		d = strings.ToLower(strings.TrimSpace(d))
+		if d != "" && !strings.HasPrefix(d, "#") {
+			m[d] = struct{}{}
+		}
 	}
-	if used == 1 || time.Now().After(expires) {
-		return "", fmt.Errorf("expired or used")
+	for _, d := range defaultDisposable {
+		add(d)
 	}
-	if err := verifyTokenHash(thash, rawToken); err != nil {
-		return "", fmt.Errorf("invalid token")
+	for _, d := range strings.Split(os.Getenv("DISPOSABLE_EMAIL_DOMAINS"), ",") {
+		add(d)
 	}
-	if _, err := db.Exec(`UPDATE email_tokens SET used = 1 WHERE id = ?`, id); err != nil {
+	for _, d := range fetched {
+		add(d)
 	}
-	return uid, nil
+	disposableMu.Lock()
+	disposableDomains = m
+	disposableMu.Unlock()
 }
 
-type brevoEmailReq struct {
-	Sender      map[string]string   `json:"sender"`
-	To          []map[string]string `json:"to"`
-	Subject     string              `json:"subject"`
-	HTMLContent string              `json:"htmlContent"`
+// isDisposableDomain matches the domain and each parent domain against the blocklist.
+func isDisposableDomain(domain string) bool {
+	disposableMu.RLock()
+	defer disposableMu.RUnlock()
+	for d := domain; d != ""; {
+		if _, ok := disposableDomains[d]; ok {
+			return true
+		}
+		i := strings.Index(d, ".")
+		if i < 0 {
+			break
+		}
+		d = d[i+1:]
+	}
+	return false
 }
 
-func sendEmailBrevo(toEmail, subject, html string) error {
-	if brevoAPIKey == "" || brevoSenderEmail == "" {
-		return errors.New("brevo not configured")
-	}
-	payload := brevoEmailReq{
-		Sender: map[string]string{
-			"email": brevoSenderEmail,
-			"name":  brevoSenderName,
-		},
-		To: []map[string]string{{
-			"email": toEmail,
-			"name":  toEmail,
-		}},
-		Subject:     subject,
-		HTMLContent: html,
-	}
-	b, _ := json.Marshal(payload)
-	req, _ := http.NewRequest("POST", "https://api.brevo.com/v3/smtp/email", bytes.NewReader(b))
-	req.Header.Set("api-key", brevoAPIKey)
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := http.DefaultClient.Do(req)
+func fetchDisposableList(ctx context.Context, url string) ([]string, error) {
+	resp, err := outboundDo(ctx, func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "GET", url, nil)
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode >= 300 {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("brevo send failed: %s", string(body))
+		return nil, fmt.Errorf("disposable list fetch: status %d", resp.StatusCode)
 	}
-	return nil
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 10<<20))
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(string(body), "\n"), nil
 }
 
-func verifyRecaptchaEnterprise(ctx context.Context, token, action, remoteIP string) error {
-	if recaptchaClient == nil || recaptchaProjectID == "" || recaptchaSiteKey == "" {
-		return nil
-	}
-	if token == "" {
-		return fmt.Errorf("missing recaptcha token")
+func refreshDisposableDomainsLoop(ctx context.Context) error {
+	refresh := func(ctx context.Context) {
+		ctx, cancel := context.WithTimeout(ctx, time.Minute)
+		list, err := fetchDisposableList(ctx, disposableListURL)
+		cancel()
+		if err != nil {
+			log.Printf("disposable list refresh error: %v", err)
+		} else {
+			setDisposableDomains(list)
+			log.Printf("disposable list refreshed: %d entries", len(list))
+		}
 	}
+	refresh(ctx)
+	return runEvery(ctx, disposableRefresh, refresh)
+}
 
-	event := &recaptchapb.Event{
-		Token:   token,
-		SiteKey: recaptchaSiteKey,
+// domainAcceptsMail reports false only when DNS definitively says the domain has no MX or address records.
+func domainAcceptsMail(ctx context.Context, domain string) bool {
+	mx, err := net.DefaultResolver.LookupMX(ctx, domain)
+	if err == nil && len(mx) > 0 {
+		return !(len(mx) == 1 && mx[0].Host == ".")
 	}
-	assessment := &recaptchapb.Assessment{Event: event}
-	req := &recaptchapb.CreateAssessmentRequest{
-		Parent:     fmt.Sprintf("projects/%s", recaptchaProjectID),
-		Assessment: assessment,
+	var dnsErr *net.DNSError
+	if err != nil && (!errors.As(err, &dnsErr) || !dnsErr.IsNotFound) {
+		log.Printf("mx lookup %s: %v", domain, err)
+		return true
+	}
+	if addrs, err := net.DefaultResolver.LookupHost(ctx, domain); err == nil && len(addrs) > 0 {
+		return true
 	}
+	return false
+}
 
-	resp, err := recaptchaClient.CreateAssessment(ctx, req)
+// Slot keys are UTC instants formatted like JavaScript's Date.toISOString().
+const slotKeyLayout = "2006-01-02T15:04:05.000Z"
+
+func parseSlotKey(k string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339Nano, k)
 	if err != nil {
-		return fmt.Errorf("recaptcha assessment failed: %w", err)
+		return time.Time{}, err
 	}
+	return t.UTC(), nil
+}
 
-	if resp.TokenProperties == nil || !resp.TokenProperties.Valid {
-		return fmt.Errorf("invalid recaptcha token: %v", resp.GetTokenProperties().GetInvalidReason())
+func formatSlotKey(t time.Time) string { return t.UTC().Format(slotKeyLayout) }
+
+// Weekly polls (recurrence "weekly") ask about a generic Monday to Sunday week instead of
+// concrete dates, for finding a standing meeting. Their availability keys are a weekday
+// plus a local time in the event timezone, e.g. "mon-09:00", so answers hold for every
+// week. Finalizing picks a weekly key; it is stored as its next concrete occurrence so
+// invitations, attendance and confirmations work as for dated events.
+const recurrenceWeekly = "weekly"
+
+var (
+	weekdayKeys     = [...]string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+	weeklySlotKeyRe = regexp.MustCompile(`^(sun|mon|tue|wed|thu|fri|sat)-([01]\d|2[0-3]):([0-5]\d)$`)
+)
+
+func formatWeeklySlotKey(day time.Weekday, minutes int) string {
+	return fmt.Sprintf("%s-%02d:%02d", weekdayKeys[day], minutes/60, minutes%60)
+}
+
+// parseWeeklySlotKey returns the weekday and minutes after local midnight of a weekly key.
+func parseWeeklySlotKey(k string) (time.Weekday, int, error) {
+	m := weeklySlotKeyRe.FindStringSubmatch(k)
+	if m == nil {
+		return 0, 0, fmt.Errorf("invalid weekly slot %q", k)
 	}
+	var day time.Weekday
+	for i, name := range weekdayKeys {
+		if name == m[1] {
+			day = time.Weekday(i)
+		}
+	}
+	h, _ := strconv.Atoi(m[2])
+	mins, _ := strconv.Atoi(m[3])
+	return day, h*60 + mins, nil
+}
 
-	if action != "" && resp.TokenProperties.Action != "" && resp.TokenProperties.Action != action {
-		return fmt.Errorf("recaptcha action mismatch")
+// weeklySlotGrid lists every key of a weekly poll, Monday first, on the same step as
+// dated events.
+func weeklySlotGrid(duration float64) []string {
+	step := int(slotStep(duration) / time.Minute)
+	var out []string
+	for i := 1; i <= 7; i++ {
+		for mins := 0; mins < 24*60; mins += step {
+			out = append(out, formatWeeklySlotKey(time.Weekday(i%7), mins))
+		}
 	}
+	return out
+}
 
-	if resp.RiskAnalysis != nil && recaptchaMinScore > 0 {
-		if float64(resp.RiskAnalysis.Score) < recaptchaMinScore {
-			return fmt.Errorf("recaptcha score too low")
+func validWeeklySlot(k string, duration float64) bool {
+	_, mins, err := parseWeeklySlotKey(k)
+	return err == nil && mins%int(slotStep(duration)/time.Minute) == 0
+}
+
+// nextWeeklyOccurrence returns the first start of a weekly key after now, in loc.
+func nextWeeklyOccurrence(k string, loc *time.Location, now time.Time) (time.Time, error) {
+	day, mins, err := parseWeeklySlotKey(k)
+	if err != nil {
+		return time.Time{}, err
+	}
+	local := now.In(loc)
+	d := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+	for i := 0; i < 8; i, d = i+1, d.AddDate(0, 0, 1) {
+		t := time.Date(d.Year(), d.Month(), d.Day(), mins/60, mins%60, 0, 0, loc)
+		if d.Weekday() == day && t.After(now) {
+			return t, nil
 		}
 	}
+	return time.Time{}, fmt.Errorf("no occurrence of %q", k)
+}
 
-	return nil
+// weeklySlotKeyFor maps a concrete start back to its weekly key in loc.
+func weeklySlotKeyFor(t time.Time, loc *time.Location) string {
+	l := t.In(loc)
+	return formatWeeklySlotKey(l.Weekday(), l.Hour()*60+l.Minute())
 }
 
-func signAccessToken(userID string) (string, error) {
-	claims := &Claims{
-		UserID: userID,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(accessTTL)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-		},
+// validSlotKeySyntax accepts dated and weekly keys; callers that know the event check
+// the grid themselves.
+func validSlotKeySyntax(k string) bool {
+	if _, err := parseSlotKey(k); err == nil {
+		return true
 	}
-	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtSecret)
+	return weeklySlotKeyRe.MatchString(k)
 }
 
-func signRefreshToken(userID, family string, version int, expiresAt time.Time) (string, string, error) {
-	rc := jwt.RegisteredClaims{
-		ExpiresAt: jwt.NewNumericDate(expiresAt),
-		IssuedAt:  jwt.NewNumericDate(time.Now()),
-		Subject:   userID,
-		ID:        fmt.Sprintf("%s:%d", family, version),
+// validTimezone checks an IANA timezone name and returns its canonical spelling. "Local"
+// is refused because it means whatever zone the server runs in.
+func validTimezone(tz string) (string, bool) {
+	if tz == "" || tz == "Local" {
+		return "", false
 	}
-	t := jwt.NewWithClaims(jwt.SigningMethodHS256, rc)
-	signed, err := t.SignedString(jwtSecret)
-	return signed, rc.ID, err
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return "", false
+	}
+	return loc.String(), true
 }
 
-func parseAccessToken(tok string) (*Claims, error) {
-	parsed, err := jwt.ParseWithClaims(tok, &Claims{}, func(t *jwt.Token) (interface{}, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method")
+// repairTimezone maps a stored timezone that validTimezone refuses to a valid one: a
+// miscased IANA name such as "europe/prague" is fixed, anything else becomes UTC, which
+// eventLocation already used for it.
+func repairTimezone(tz string) string {
+	if canonical, ok := validTimezone(tz); ok {
+		return canonical
+	}
+	b := []byte(strings.ToLower(strings.TrimSpace(tz)))
+	for i := range b {
+		if i == 0 || b[i-1] == '/' || b[i-1] == '_' || b[i-1] == '-' {
+			b[i] = byte(unicode.ToUpper(rune(b[i])))
 		}
-		return jwtSecret, nil
-	})
-	if err != nil {
-		return nil, err
 	}
-	if claims, ok := parsed.Claims.(*Claims); ok && parsed.Valid {
-		return claims, nil
+	if canonical, ok := validTimezone(string(b)); ok {
+		return canonical
 	}
-	return nil, errors.New("invalid token")
+	return "UTC"
 }
 
-func openDB(path string) (*sql.DB, error) {
-	d, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_foreign_keys=on&_journal_mode=WAL", path))
-	if err != nil {
-		return nil, err
+// normalizeSlotKey rewrites a dated key sent with another offset or precision, e.g.
+// "2026-11-02T10:00:00+01:00", to the stored UTC form, so the same instant always has one
+// key. Weekly and unparseable keys are returned unchanged.
+func normalizeSlotKey(k string) string {
+	if t, err := parseSlotKey(k); err == nil {
+		return formatSlotKey(t)
 	}
-	d.SetMaxOpenConns(25)
-	d.SetMaxIdleConns(25)
-	d.SetConnMaxIdleTime(5 * time.Minute)
-	d.SetConnMaxLifetime(60 * time.Minute)
-	return d, nil
+	return k
 }
 
-func migrate(ctx context.Context, d *sql.DB) error {
-	if _, err := d.ExecContext(ctx, `
-		CREATE TABLE IF NOT EXISTS schema_versions (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			version INTEGER NOT NULL,
-			applied_at TIMESTAMP NOT NULL
-		);
-	`); err != nil {
-		return err
+func normalizeSlotList(keys []string) []string {
+	out := make([]string, 0, len(keys))
+	seen := map[string]bool{}
+	for _, k := range keys {
+		if k = normalizeSlotKey(k); !seen[k] {
+			seen[k] = true
+			out = append(out, k)
+		}
 	}
-	var current int
-	if err := d.QueryRowContext(ctx, `SELECT COALESCE(MAX(version),0) FROM schema_versions`).Scan(&current); err != nil {
-		return err
+	return out
+}
+
+// localSlotKey renders a stored dated key in loc, keeping the offset so the key still
+// names the same instant and can be sent back as is. Weekly keys are already local to
+// the event timezone and are returned unchanged.
+func localSlotKey(k string, loc *time.Location) string {
+	if t, err := parseSlotKey(k); err == nil {
+		return t.In(loc).Format("2006-01-02T15:04:05.000Z07:00")
 	}
-	if current >= schemaVersion {
-		return nil
+	return k
+}
+
+func localSlotMap(m map[string]bool, loc *time.Location) map[string]bool {
+	out := make(map[string]bool, len(m))
+	for k, v := range m {
+		out[localSlotKey(k, loc)] = v
 	}
+	return out
+}
 
-	tx, err := d.BeginTx(ctx, nil)
-	if err != nil {
-		return err
+func localSlotList(keys []string, loc *time.Location) []string {
+	out := make([]string, len(keys))
+	for i, k := range keys {
+		out[i] = localSlotKey(k, loc)
 	}
-	defer tx.Rollback()
+	return out
+}
 
-	createStmts := []string{
-		`CREATE TABLE IF NOT EXISTS users (
-			id TEXT PRIMARY KEY,
-			username TEXT NOT NULL UNIQUE,
-			email TEXT NOT NULL UNIQUE,
-			email_verified INTEGER NOT NULL DEFAULT 0,
-			password_hash TEXT NOT NULL,
-			created_at TIMESTAMP NOT NULL,
-			updated_at TIMESTAMP NOT NULL
-		);`,
-		`CREATE TABLE IF NOT EXISTS events (
-			id TEXT PRIMARY KEY,
-			creator_id TEXT NOT NULL,
-			name TEXT NOT NULL,
-			date_from TEXT NOT NULL,
-			date_to TEXT NOT NULL,
-			duration REAL NOT NULL,
-			timezone TEXT NOT NULL,
-			disabled_slots TEXT NOT NULL DEFAULT '[]',
-			created_at TIMESTAMP NOT NULL,
-			updated_at TIMESTAMP NOT NULL,
-			FOREIGN KEY (creator_id) REFERENCES users(id) ON DELETE CASCADE
-		);`,
-		`CREATE TABLE IF NOT EXISTS event_participants (
-			id TEXT PRIMARY KEY,
-			event_id TEXT NOT NULL,
-			user_id TEXT NOT NULL,
-			availability TEXT NOT NULL DEFAULT '{}',
-			draft_availability TEXT NOT NULL DEFAULT '{}',
-			draft_disabled_slots TEXT NOT NULL DEFAULT '[]',
-			draft_updated_at TIMESTAMP NULL,
-			created_at TIMESTAMP NOT NULL,
-			updated_at TIMESTAMP NOT NULL,
-			UNIQUE(event_id, user_id),
-			FOREIGN KEY (event_id) REFERENCES events(id) ON DELETE CASCADE,
-			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
-		);`,
-		`CREATE TABLE IF NOT EXISTS refresh_tokens (
-			id TEXT PRIMARY KEY,
-			user_id TEXT NOT NULL,
-			family_id TEXT NOT NULL,
-			version INTEGER NOT NULL,
-			token_hash TEXT NOT NULL,
-			expires_at TIMESTAMP NOT NULL,
-			created_at TIMESTAMP NOT NULL,
-			revoked INTEGER NOT NULL DEFAULT 0,
-			remember INTEGER NOT NULL DEFAULT 1,
-			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
-		);`,
-		`CREATE TABLE IF NOT EXISTS login_attempts (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			user_id TEXT,
-			username TEXT,
-			ip TEXT,
-			created_at TIMESTAMP NOT NULL
-		);`,
-		`CREATE TABLE IF NOT EXISTS email_tokens (
-			id TEXT PRIMARY KEY,
-			user_id TEXT NOT NULL,
-			kind TEXT NOT NULL,
-			token_hash TEXT NOT NULL,
-			expires_at TIMESTAMP NOT NULL,
-			created_at TIMESTAMP NOT NULL,
-			used INTEGER NOT NULL DEFAULT 0,
-			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
-		);`,
-		`CREATE INDEX IF NOT EXISTS idx_users_username ON users(username);`,
-		`CREATE INDEX IF NOT EXISTS idx_users_email ON users(email);`,
-		`CREATE INDEX IF NOT EXISTS idx_events_creator ON events(creator_id);`,
-		`CREATE INDEX IF NOT EXISTS idx_participants_event ON event_participants(event_id);`,
-		`CREATE INDEX IF NOT EXISTS idx_login_attempts_user ON login_attempts(user_id);`,
-		`CREATE INDEX IF NOT EXISTS idx_email_tokens_user ON email_tokens(user_id);`,
-		`CREATE INDEX IF NOT EXISTS idx_email_tokens_kind_expires ON email_tokens(kind, expires_at);`,
-		`CREATE TABLE IF NOT EXISTS friend_requests (
-			id TEXT PRIMARY KEY,
-			sender_id TEXT NOT NULL,
-			receiver_id TEXT NOT NULL,
-			status TEXT NOT NULL DEFAULT 'pending',
-			created_at TIMESTAMP NOT NULL,
-			updated_at TIMESTAMP NOT NULL,
-			UNIQUE(sender_id, receiver_id),
-			FOREIGN KEY (sender_id) REFERENCES users(id) ON DELETE CASCADE,
-			FOREIGN KEY (receiver_id) REFERENCES users(id) ON DELETE CASCADE
-		);`,
-		`CREATE TABLE IF NOT EXISTS event_invites (
-			id TEXT PRIMARY KEY,
-			event_id TEXT NOT NULL,
-			inviter_id TEXT NOT NULL,
-			invitee_id TEXT NOT NULL,
-			status TEXT NOT NULL DEFAULT 'pending',
-			created_at TIMESTAMP NOT NULL,
-			updated_at TIMESTAMP NOT NULL,
-			UNIQUE(event_id, invitee_id),
-			FOREIGN KEY (event_id) REFERENCES events(id) ON DELETE CASCADE,
-			FOREIGN KEY (inviter_id) REFERENCES users(id) ON DELETE CASCADE,
-			FOREIGN KEY (invitee_id) REFERENCES users(id) ON DELETE CASCADE
-		);`,
-		`CREATE INDEX IF NOT EXISTS idx_friend_requests_sender ON friend_requests(sender_id);`,
-		`CREATE INDEX IF NOT EXISTS idx_friend_requests_receiver ON friend_requests(receiver_id);`,
-		`CREATE INDEX IF NOT EXISTS idx_friend_requests_status ON friend_requests(status);`,
-		`CREATE INDEX IF NOT EXISTS idx_event_invites_event ON event_invites(event_id);`,
-		`CREATE INDEX IF NOT EXISTS idx_event_invites_invitee ON event_invites(invitee_id);`,
-		`CREATE INDEX IF NOT EXISTS idx_event_invites_status ON event_invites(status);`,
-	}
-	for _, s := range createStmts {
-		if _, err := tx.ExecContext(ctx, s); err != nil {
-			return err
-		}
-	}
-
-	// Only run ALTERs when upgrading an existing DB (<3 and >0).
-	if current < 3 && current > 0 {
-		alterStmts := []string{
-			`ALTER TABLE event_participants ADD COLUMN draft_availability TEXT NOT NULL DEFAULT '{}'`,
-			`ALTER TABLE event_participants ADD COLUMN draft_disabled_slots TEXT NOT NULL DEFAULT '[]'`,
-			`ALTER TABLE event_participants ADD COLUMN draft_updated_at TIMESTAMP NULL`,
-		}
-		for _, s := range alterStmts {
-			if _, err := tx.ExecContext(ctx, s); err != nil {
-				return err
-			}
-		}
+// eventLocation resolves an event timezone, falling back to UTC for unknown names.
+func eventLocation(tz string) *time.Location {
+	if loc, err := time.LoadLocation(tz); err == nil {
+		return loc
 	}
+	return time.UTC
+}
 
-	// Migration for version 4: add friend_requests and event_invites tables
-	if current < 4 {
-		// Tables are created via CREATE TABLE IF NOT EXISTS above, but we ensure indexes exist
-		// No ALTER statements needed as these are new tables
+// eventDateBound converts an event date bound to local midnight in the event timezone.
+func eventDateBound(s string, loc *time.Location) (time.Time, bool) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		l := t.In(loc)
+		return time.Date(l.Year(), l.Month(), l.Day(), 0, 0, 0, 0, loc), true
 	}
-
-	// Migration for version 5: add remember column to refresh_tokens
-	if current < 5 && current > 0 {
-		if _, err := tx.ExecContext(ctx, `ALTER TABLE refresh_tokens ADD COLUMN remember INTEGER NOT NULL DEFAULT 1`); err != nil {
-			return err
-		}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc), true
 	}
+	return time.Time{}, false
+}
 
-	if _, err := tx.ExecContext(ctx, `INSERT INTO schema_versions(version, applied_at) VALUES (?,?)`, schemaVersion, time.Now().UTC()); err != nil {
-		return err
+// slotStep mirrors the frontend grid: rows every max(30, duration) minutes.
+func slotStep(duration float64) time.Duration {
+	mins := int(duration)
+	if mins < 30 {
+		mins = 30
 	}
-	return tx.Commit()
+	return time.Duration(mins) * time.Minute
 }
 
-type visitor struct {
-	limiter  *rate.Limiter
-	lastSeen time.Time
-}
+const maxGridDays = 366
 
-var (
-	muVisitors sync.Mutex
-	visitors   = map[string]*visitor{}
-)
+// eventSlotGrid returns the start of every slot in the event grid, in the event timezone.
+func eventSlotGrid(ev Event) []time.Time {
+	return slotGrid(ev.DateFrom, ev.DateTo, eventLocation(ev.Timezone), slotStep(ev.Duration))
+}
 
-func getVisitor(ip string, rps rate.Limit, burst int) *rate.Limiter {
-	muVisitors.Lock()
-	defer muVisitors.Unlock()
-	v, ok := visitors[ip]
-	if !ok {
-		lim := rate.NewLimiter(rps, burst)
-		visitors[ip] = &visitor{limiter: lim, lastSeen: time.Now()}
-		return lim
-	}
-	v.lastSeen = time.Now()
-	return v.limiter
+// gridSlot is one slot of an event grid: its availability key and the start it stands
+// for. A weekly key starts at its next occurrence.
+type gridSlot struct {
+	key   string
+	start time.Time
 }
 
-func cleanupVisitorsLoop() {
-	for {
-		time.Sleep(time.Minute)
-		muVisitors.Lock()
-		for ip, v := range visitors {
-			if time.Since(v.lastSeen) > 3*time.Minute {
-				delete(visitors, ip)
+// eventGridSlots lists the event's grid for dated and weekly polls alike, in grid order.
+// Weekly polls have no date range, so their starts are taken relative to now.
+func eventGridSlots(ev Event, now time.Time) []gridSlot {
+	var out []gridSlot
+	if ev.Recurrence == recurrenceWeekly {
+		loc := eventLocation(ev.Timezone)
+		for _, k := range weeklySlotGrid(ev.Duration) {
+			if t, err := nextWeeklyOccurrence(k, loc, now); err == nil {
+				out = append(out, gridSlot{key: k, start: t})
 			}
 		}
-		muVisitors.Unlock()
+		return out
 	}
+	for _, t := range eventSlotGrid(ev) {
+		out = append(out, gridSlot{key: formatSlotKey(t), start: t})
+	}
+	return out
 }
 
-func cleanupLoginAttemptsLoop() {
-	for {
-		time.Sleep(1 * time.Hour)
-		cutoff := time.Now().Add(-24 * time.Hour)
-		if _, err := db.Exec(`DELETE FROM login_attempts WHERE created_at < ?`, cutoff.UTC()); err != nil {
-			log.Printf("login_attempts cleanup error: %v", err)
+// slotGrid lays slots every stepDur from local midnight of each day between the bounds.
+func slotGrid(dateFrom, dateTo string, loc *time.Location, stepDur time.Duration) []time.Time {
+	from, ok1 := eventDateBound(dateFrom, loc)
+	to, ok2 := eventDateBound(dateTo, loc)
+	if !ok1 || !ok2 || to.Before(from) || stepDur <= 0 {
+		return nil
+	}
+	step := int(stepDur / time.Minute)
+	var out []time.Time
+	for d, n := from, 0; !d.After(to) && n < maxGridDays; d, n = d.AddDate(0, 0, 1), n+1 {
+		for mins := 0; mins < 24*60; mins += step {
+			out = append(out, time.Date(d.Year(), d.Month(), d.Day(), mins/60, mins%60, 0, 0, loc))
 		}
 	}
+	return out
 }
 
-func cleanupUnverifiedUsersLoop() {
-	for {
-		time.Sleep(time.Hour)
-		cutoff := time.Now().Add(-verifyTTL)
-		if res, err := db.Exec(`DELETE FROM users WHERE email_verified = 0 AND created_at < ?`, cutoff.UTC()); err != nil {
-			log.Printf("cleanup unverified error: %v", err)
-		} else if rows, _ := res.RowsAffected(); rows > 0 {
-			log.Printf("cleanup unverified: deleted %d users", rows)
-		}
-	}
+// slotIsPast reports whether a slot has already started. Keys are absolute instants on the
+// event-timezone grid, so "today" in the event's zone needs no extra conversion.
+func slotIsPast(key string, now time.Time) bool {
+	t, err := parseSlotKey(key)
+	return err == nil && t.Before(now)
 }
 
-func rateLimit(rps rate.Limit, burst int) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		ip := clientIP(c)
-		lim := getVisitor(ip, rps, burst)
-		if !lim.Allow() {
-			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests"})
-			return
+// freezePastSlots merges an incoming availability map over the stored one for future slots
+// only; past slots keep their stored value. Incoming keys are normalized to UTC first. It
+// returns the merged map and the number of past-slot changes that were ignored.
+func freezePastSlots(prev, next map[string]bool, now time.Time) (map[string]bool, int) {
+	incoming := map[string]bool{}
+	for k, v := range next {
+		if v {
+			incoming[normalizeSlotKey(k)] = true
 		}
-		c.Next()
 	}
+	out := map[string]bool{}
+	ignored := 0
+	for k := range incoming {
+		if slotIsPast(k, now) {
+			if !prev[k] {
+				ignored++
+			}
+			continue
+		}
+		out[k] = true
+	}
+	for k, v := range prev {
+		if !v || !slotIsPast(k, now) {
+			continue
+		}
+		if !incoming[k] {
+			ignored++
+		}
+		out[k] = true
+	}
+	return out, ignored
 }
 
-func securityHeaders() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		c.Header("X-Frame-Options", "DENY")
-		c.Header("X-Content-Type-Options", "nosniff")
-		c.Header("X-XSS-Protection", "1; mode=block")
-		c.Header("Referrer-Policy", "no-referrer")
-		c.Header("Content-Security-Policy", "default-src 'self'; frame-ancestors 'none'; form-action 'self';")
-		c.Next()
+// shiftDateString moves an event date bound (ISO timestamp or YYYY-MM-DD) by whole days.
+func shiftDateString(s string, days int, loc *time.Location) string {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return formatSlotKey(t.In(loc).AddDate(0, 0, days))
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t.AddDate(0, 0, days).Format("2006-01-02")
 	}
+	return s
 }
 
-func clientIP(c *gin.Context) string {
-	ip := c.ClientIP()
-	if ip == "" {
-		ip = "unknown"
+func hashToken(token string) (string, error) {
+	sum := sha256.Sum256([]byte(token))
+	b, err := bcrypt.GenerateFromPassword([]byte(hex.EncodeToString(sum[:])), 12)
+	if err != nil {
+		return "", err
 	}
-	return ip
+	return string(b), nil
 }
 
-func logIfTimeout(err error, where string) {
-	if errors.Is(err, context.DeadlineExceeded) {
-		log.Printf("timeout: %s: %v", where, err)
-	}
+func verifyTokenHash(hash string, token string) error {
+	sum := sha256.Sum256([]byte(token))
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(hex.EncodeToString(sum[:])))
 }
 
-func serverError(c *gin.Context, where string, err error) {
-	if err != nil {
-		logIfTimeout(err, where)
-		log.Printf("%s error: %v", where, err)
+// Recovery codes carry 80 random bits, so an unsalted SHA-256 is enough and lets us
+// look a code up directly instead of bcrypt-comparing every stored code.
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+func newRecoveryCode() (string, error) {
+	buf := make([]byte, 10)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
 	}
-	c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+	enc := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(buf)
+	return enc[:4] + "-" + enc[4:8] + "-" + enc[8:12] + "-" + enc[12:], nil
 }
 
-func getEnvInt(key string, def int) int {
-	if v := os.Getenv(key); v != "" {
-		if n, err := strconv.Atoi(v); err == nil {
-			return n
+// replaceRecoveryCodes discards a user's existing codes and issues a fresh set.
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userID string) ([]string, error) {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
 		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO recovery_codes(id, user_id, code_hash, used_at, created_at) VALUES (?,?,?,NULL,?)`,
+			uuid.NewString(), userID, hashRecoveryCode(code), now); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
 	}
-	return def
+	return codes, nil
 }
 
-func apiBaseURL() string {
-	if v := os.Getenv("NEXT_PUBLIC_API_BASE_URL"); v != "" {
-		return v
+// outgoingEmail is one message handed to a provider. Category is empty for strictly
+// transactional mail (verification, password reset, security notices); anything else is
+// non-essential and honours the recipient's suppression list.
+type outgoingEmail struct {
+	UserID   string // account that caused the message; used for per-user quotas
+	To       string
+	Subject  string
+	HTML     string
+	Category string
+	Headers  map[string]string
+
+	Attachments []emailAttachment
+}
+
+type emailAttachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// Non-essential email categories users can unsubscribe from. "all" suppresses every one.
+const (
+	emailCategoryAll       = "all"
+	emailCategoryReminders = "reminders"
+	emailCategoryDigest    = "digest"
+	emailCategoryInvites   = "invites"
+	emailCategoryProgress  = "progress"
+)
+
+var emailCategories = []string{emailCategoryReminders, emailCategoryDigest, emailCategoryInvites, emailCategoryProgress}
+
+func validEmailCategory(category string) bool {
+	if category == emailCategoryAll {
+		return true
 	}
-	if v := os.Getenv("API_BASE_URL"); v != "" {
-		return v
+	for _, c := range emailCategories {
+		if c == category {
+			return true
+		}
 	}
-	return "http://localhost:8080"
+	return false
 }
 
-func recordLoginAttempt(ctx context.Context, username, userID, ip string) {
-	_, err := db.ExecContext(ctx, `INSERT INTO login_attempts(user_id, username, ip, created_at) VALUES (?,?,?,?)`,
-		userID, username, ip, time.Now().UTC())
-	if err != nil {
-		logIfTimeout(err, "recordLoginAttempt")
+// Email localization. Locales mirror the frontend's messages/*.json; users without a stored
+// locale get defaultLocale (DEFAULT_LOCALE, "en" unless configured).
+var (
+	supportedLocales = []string{"en", "de"}
+	defaultLocale    = "en"
+)
+
+// normalizeLocale maps "de-AT" or an Accept-Language header to a supported locale, or "".
+func normalizeLocale(raw string) string {
+	for _, part := range strings.Split(raw, ",") {
+		tag, _, _ := strings.Cut(strings.TrimSpace(part), ";")
+		base, _, _ := strings.Cut(strings.ToLower(tag), "-")
+		for _, l := range supportedLocales {
+			if base == l {
+				return l
+			}
+		}
 	}
+	return ""
 }
 
-func isLockedOut(ctx context.Context, userID string) (bool, error) {
-	var count int
-	cutoff := time.Now().Add(-lockoutWindow)
-	err := db.QueryRowContext(ctx, `
-		SELECT COUNT(*) FROM login_attempts
-		WHERE user_id = ? AND created_at >= ?
-	`, userID, cutoff.UTC()).Scan(&count)
-	if err != nil {
-		logIfTimeout(err, "isLockedOut")
-		return false, err
+func resolveLocale(stored string) string {
+	if l := normalizeLocale(stored); l != "" {
+		return l
 	}
-	return count >= lockoutThreshold, nil
+	return defaultLocale
 }
 
-func buildCORS() cors.Config {
-	cfg := cors.DefaultConfig()
-	origins := os.Getenv("CORS_ORIGINS")
-	if origins == "" {
-		cfg.AllowAllOrigins = true
-	} else {
-		parts := strings.Split(origins, ",")
-		for i := range parts {
-			parts[i] = strings.TrimSpace(parts[i])
-		}
-		cfg.AllowOrigins = parts
+func userLocale(ctx context.Context, userID string) string {
+	var stored string
+	if err := db.QueryRowContext(ctx, `SELECT locale FROM users WHERE id = ?`, userID).Scan(&stored); err != nil {
+		logIfTimeout(err, "userLocale")
 	}
-	cfg.AllowHeaders = []string{"Origin", "Content-Type", "Authorization"}
-	cfg.AllowMethods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}
-	cfg.AllowCredentials = true
-	return cfg
+	return resolveLocale(stored)
 }
 
-func setRefreshCookie(c *gin.Context, token string, expiresAt time.Time, remember bool) {
-	c.SetSameSite(http.SameSiteLaxMode)
-	maxAge := 0
-	if remember {
-		remaining := int(time.Until(expiresAt) / time.Second)
-		if remaining > 0 {
-			maxAge = remaining
-		}
-	}
-	c.SetCookie(refreshCookieName, token, maxAge, "/", "", cookieSecure, true)
+type emailTemplate struct {
+	Subject string
+	Body    string
 }
 
-func clearRefreshCookie(c *gin.Context) {
-	c.SetSameSite(http.SameSiteLaxMode)
-	c.SetCookie(refreshCookieName, "", -1, "/", "", cookieSecure, true)
+// emailTemplates are fmt formats; every locale of a key takes the same arguments.
+var emailTemplates = map[string]map[string]emailTemplate{
+	"en": {
+		// username, verify URL
+		"verify": {"Verify your account", `<p>Welcome %s,</p><p>Please verify your email by clicking <a href="%s">this link</a>. The link expires in 24 hours.</p>`},
+		// username, verify URL
+		"verify_change": {"Verify your email", `<p>Hello %s,</p><p>Please verify your new email by clicking <a href="%s">this link</a>. The link expires in 24 hours.</p>`},
+		// reset URL, minutes valid
+		"reset": {"Reset your password", `<p>To reset your password, click <a href="%s">this link</a>. The link expires in %d minutes.</p>`},
+		// username, device, time
+		"new_device": {"New sign-in to your account", `<p>Hello %s,</p><p>Your account was just signed in from a new device: <strong>%s</strong> on %s.</p><p>If this wasn't you, reset your password and sign out your other sessions.</p>`},
+		// event name, slot time, event URL
+		"finalized": {"Scheduled: %[1]s", `<p><strong>%s</strong> is scheduled for <strong>%s</strong>.</p><p>The attached invitation adds it to your calendar. <a href="%s">View the event</a>.</p>`},
+		// event name, slot time
+		"finalize_cancelled": {"Cancelled: %[1]s", `<p>The time <strong>%[2]s</strong> for <strong>%[1]s</strong> is no longer planned.</p>`},
+		// guest name, username, event name, event URL
+		"guest_claimed": {"%[1]s now has an account", `<p>The guest response <strong>%[1]s</strong> in <strong>%[3]s</strong> now belongs to the account <strong>%[2]s</strong>. Their availability was kept.</p><p><a href="%[4]s">View the event</a></p>`},
+		// organizer name, event name, event URL, note paragraph (may be empty)
+		"proxy_availability": {"Your availability for %[2]s was updated", `<p><strong>%[1]s</strong> entered your availability for <strong>%[2]s</strong> on your behalf.</p>%[4]s<p>Please <a href="%[3]s">check it</a> and correct anything that's wrong.</p>`},
+		// username, reactivate URL
+		"deactivated": {"Your account is deactivated", `<p>Hello %s,</p><p>Your account is deactivated. Your events and responses are kept, but you won't get notifications and can't sign in.</p><p>To come back, <a href="%s">reactivate your account</a>. The link expires in 7 days; signing in sends a new one.</p>`},
+		// inviter name, event name, event URL, message paragraph (may be empty), date range, invites URL
+		"event_invite": {"%[1]s invited you to %[2]s", `<p><strong>%[1]s</strong> invited you to <strong>%[2]s</strong> (%[5]s).</p>%[4]s<p><a href="%[3]s">View the event</a>, then accept or decline in <a href="%[6]s">your invites</a>.</p>`},
+		// organizer name, event name, event URL, respond links list
+		"reminder": {"Reminder: %[2]s is waiting for your availability", `<p><strong>%[1]s</strong> is still waiting for your availability for <strong>%[2]s</strong>. Answer in one click:</p>%[4]s<p>Or <a href="%[3]s">pick exact times</a>.</p>`},
+		// event name, responded count, participant count, event URL
+		"milestone_half": {"Half of the participants answered %[1]s", `<p>%[2]d of %[3]d participants have entered their availability for <strong>%[1]s</strong>.</p><p><a href="%[4]s">See the results so far</a>.</p>`},
+		// event name, responded count, participant count, event URL
+		"milestone_all": {"Everyone answered %[1]s", `<p>All %[3]d participants have entered their availability for <strong>%[1]s</strong>. It's a good time to <a href="%[4]s">pick the final slot</a>.</p>`},
+		// participant names, event name, event URL
+		"watch_update": {"%[1]s updated availability for %[2]s", `<p><strong>%[1]s</strong> entered or changed their availability for <strong>%[2]s</strong>.</p><p><a href="%[3]s">See the results</a>.</p>`},
+		// event name, slot time, event URL
+		"booking_promoted": {"You got the slot for %[1]s", `<p>A booking for <strong>%[1]s</strong> was cancelled and you were next on the waitlist. <strong>%[2]s</strong> is now booked for you.</p><p><a href="%[3]s">View your bookings</a></p>`},
+		// event name, slot time, confirmation deadline, event URL
+		"confirm_request": {"Please confirm: %[1]s", `<p><strong>%[1]s</strong> is scheduled for <strong>%[2]s</strong>. Please confirm whether you'll attend by <strong>%[3]s</strong>.</p><p><a href="%[4]s">Confirm or decline</a></p>`},
+		// event name, slot time, confirmation deadline, event URL
+		"confirm_promoted": {"A place opened up: %[1]s", `<p>A place opened up for <strong>%[1]s</strong> on <strong>%[2]s</strong> and you were next on the waitlist. Please confirm whether you'll attend by <strong>%[3]s</strong>.</p><p><a href="%[4]s">Confirm or decline</a></p>`},
+		// event name, missing count, names list, event URL
+		"confirm_missing": {"Missing confirmations for %[1]s", `<p>The confirmation deadline for <strong>%[1]s</strong> has passed. These participants didn't confirm:</p>%[3]s<p><a href="%[4]s">View the event</a></p>`},
+		// organizer name, event name, deadline, event URL, respond links list
+		"deadline_reminder": {"Answer %[2]s by %[3]s", `<p><strong>%[1]s</strong> is collecting availability for <strong>%[2]s</strong> until <strong>%[3]s</strong> and you haven't answered yet. Answer in one click:</p>%[5]s<p>Or <a href="%[4]s">pick exact times</a>.</p>`},
+		// event name, start time, event URL
+		"event_reminder": {"Coming up: %[1]s", `<p><strong>%[1]s</strong> starts <strong>%[2]s</strong>.</p><p><a href="%[3]s">View the event</a></p>`},
+		// source username, target username, confirm URL
+		"merge_confirm": {"Merge %[1]s into %[2]s?", `<p>Hello %[1]s,</p><p>The account <strong>%[2]s</strong> asked to take over this account. Confirming moves your events, responses and friends to <strong>%[2]s</strong> and closes <strong>%[1]s</strong> for good.</p><p><a href="%[3]s">Merge the accounts</a>. The link expires in 24 hours. If you didn't ask for this, ignore this email.</p>`},
+	},
+	"de": {
+		"verify":             {"Bestätige dein Konto", `<p>Willkommen %s,</p><p>bitte bestätige deine E-Mail-Adresse über <a href="%s">diesen Link</a>. Der Link ist 24 Stunden gültig.</p>`},
+		"verify_change":      {"Bestätige deine E-Mail-Adresse", `<p>Hallo %s,</p><p>bitte bestätige deine neue E-Mail-Adresse über <a href="%s">diesen Link</a>. Der Link ist 24 Stunden gültig.</p>`},
+		"reset":              {"Passwort zurücksetzen", `<p>Um dein Passwort zurückzusetzen, klicke auf <a href="%s">diesen Link</a>. Der Link ist %d Minuten gültig.</p>`},
+		"new_device":         {"Neue Anmeldung bei deinem Konto", `<p>Hallo %s,</p><p>bei deinem Konto hat sich gerade ein neues Gerät angemeldet: <strong>%s</strong> am %s.</p><p>Warst du das nicht, setze dein Passwort zurück und melde deine anderen Sitzungen ab.</p>`},
+		"finalized":          {"Termin steht: %[1]s", `<p><strong>%s</strong> findet am <strong>%s</strong> statt.</p><p>Mit der angehängten Einladung kannst du den Termin in deinen Kalender übernehmen. <a href="%s">Zum Termin</a>.</p>`},
+		"finalize_cancelled": {"Abgesagt: %[1]s", `<p>Der Termin <strong>%[2]s</strong> für <strong>%[1]s</strong> findet nicht mehr statt.</p>`},
+		"guest_claimed":      {"%[1]s hat jetzt ein Konto", `<p>Die Gast-Antwort <strong>%[1]s</strong> in <strong>%[3]s</strong> gehört jetzt zum Konto <strong>%[2]s</strong>. Die Verfügbarkeit wurde übernommen.</p><p><a href="%[4]s">Zum Termin</a></p>`},
+		"proxy_availability": {"Deine Verfügbarkeit für %[2]s wurde geändert", `<p><strong>%[1]s</strong> hat deine Verfügbarkeit für <strong>%[2]s</strong> in deinem Namen eingetragen.</p>%[4]s<p>Bitte <a href="%[3]s">prüfe sie</a> und korrigiere, was nicht stimmt.</p>`},
+		"deactivated":        {"Dein Konto ist deaktiviert", `<p>Hallo %s,</p><p>dein Konto ist deaktiviert. Deine Termine und Antworten bleiben erhalten, du bekommst aber keine Benachrichtigungen und kannst dich nicht anmelden.</p><p>Um zurückzukommen, <a href="%s">reaktiviere dein Konto</a>. Der Link ist 7 Tage gültig; bei einer Anmeldung schicken wir einen neuen.</p>`},
+		"event_invite":       {"%[1]s hat dich zu %[2]s eingeladen", `<p><strong>%[1]s</strong> hat dich zu <strong>%[2]s</strong> eingeladen (%[5]s).</p>%[4]s<p><a href="%[3]s">Sieh dir den Termin an</a> und sage in <a href="%[6]s">deinen Einladungen</a> zu oder ab.</p>`},
+		"reminder":           {"Erinnerung: %[2]s wartet auf deine Verfügbarkeit", `<p><strong>%[1]s</strong> wartet noch auf deine Verfügbarkeit für <strong>%[2]s</strong>. Antworte mit einem Klick:</p>%[4]s<p>Oder <a href="%[3]s">wähle genaue Zeiten</a>.</p>`},
+		"milestone_half":     {"Die Hälfte hat für %[1]s abgestimmt", `<p>%[2]d von %[3]d Teilnehmenden haben ihre Verfügbarkeit für <strong>%[1]s</strong> eingetragen.</p><p><a href="%[4]s">Zwischenstand ansehen</a>.</p>`},
+		"milestone_all":      {"Alle haben für %[1]s abgestimmt", `<p>Alle %[3]d Teilnehmenden haben ihre Verfügbarkeit für <strong>%[1]s</strong> eingetragen. Jetzt ist ein guter Zeitpunkt, <a href="%[4]s">den Termin festzulegen</a>.</p>`},
+		"watch_update":       {"%[1]s hat die Verfügbarkeit für %[2]s aktualisiert", `<p><strong>%[1]s</strong> hat die Verfügbarkeit für <strong>%[2]s</strong> eingetragen oder geändert.</p><p><a href="%[3]s">Ergebnisse ansehen</a>.</p>`},
+		"booking_promoted":   {"Du hast den Termin für %[1]s", `<p>Eine Buchung für <strong>%[1]s</strong> wurde storniert und du warst als Nächste*r auf der Warteliste. <strong>%[2]s</strong> ist jetzt für dich gebucht.</p><p><a href="%[3]s">Deine Buchungen ansehen</a></p>`},
+		"confirm_request":    {"Bitte bestätigen: %[1]s", `<p><strong>%[1]s</strong> findet am <strong>%[2]s</strong> statt. Bitte bestätige bis <strong>%[3]s</strong>, ob du teilnimmst.</p><p><a href="%[4]s">Zusagen oder absagen</a></p>`},
+		"confirm_promoted":   {"Ein Platz ist frei geworden: %[1]s", `<p>Für <strong>%[1]s</strong> am <strong>%[2]s</strong> ist ein Platz frei geworden und du warst als Nächste*r auf der Warteliste. Bitte bestätige bis <strong>%[3]s</strong>, ob du teilnimmst.</p><p><a href="%[4]s">Zusagen oder absagen</a></p>`},
+		"confirm_missing":    {"Fehlende Bestätigungen für %[1]s", `<p>Die Frist zur Bestätigung für <strong>%[1]s</strong> ist abgelaufen. Diese Teilnehmenden haben nicht bestätigt:</p>%[3]s<p><a href="%[4]s">Zum Termin</a></p>`},
+		"deadline_reminder":  {"Antworte bis %[3]s: %[2]s", `<p><strong>%[1]s</strong> sammelt bis <strong>%[3]s</strong> Verfügbarkeiten für <strong>%[2]s</strong> und du hast noch nicht geantwortet. Antworte mit einem Klick:</p>%[5]s<p>Oder <a href="%[4]s">wähle genaue Zeiten</a>.</p>`},
+		"event_reminder":     {"Bald ist es so weit: %[1]s", `<p><strong>%[1]s</strong> beginnt am <strong>%[2]s</strong>.</p><p><a href="%[3]s">Zum Termin</a></p>`},
+		"merge_confirm":      {"%[1]s mit %[2]s zusammenführen?", `<p>Hallo %[1]s,</p><p>das Konto <strong>%[2]s</strong> möchte dieses Konto übernehmen. Wenn du bestätigst, werden deine Termine, Antworten und Freunde auf <strong>%[2]s</strong> übertragen und <strong>%[1]s</strong> wird endgültig geschlossen.</p><p><a href="%[3]s">Konten zusammenführen</a>. Der Link ist 24 Stunden gültig. Hast du das nicht angefordert, ignoriere diese E-Mail.</p>`},
+	},
 }
 
-func authnMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		h := c.GetHeader("Authorization")
-		var token string
-		if strings.HasPrefix(h, "Bearer ") {
-			token = strings.TrimPrefix(h, "Bearer ")
-		} else {
-			token = c.Query("token")
-		}
-		if token == "" {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
-			return
-		}
-		claims, err := parseAccessToken(token)
-		if err != nil {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
-			return
+// localizedEmail renders a template in locale, falling back to the default locale and then English.
+func localizedEmail(locale, key string, args ...interface{}) (subject, body string) {
+	for _, l := range []string{locale, defaultLocale, "en"} {
+		if t, ok := emailTemplates[l][key]; ok {
+			subject = t.Subject
+			if strings.Contains(subject, "%") {
+				subject = fmt.Sprintf(subject, args...)
+			}
+			return subject, fmt.Sprintf(t.Body, args...)
 		}
-		c.Set("userID", claims.UserID)
-		c.Next()
 	}
+	return key, ""
 }
 
-func ctxUserID(c *gin.Context) string {
-	if v, ok := c.Get("userID"); ok {
-		if s, ok := v.(string); ok {
-			return s
-		}
+var (
+	germanWeekdays = [...]string{"Sonntag", "Montag", "Dienstag", "Mittwoch", "Donnerstag", "Freitag", "Samstag"}
+	germanMonths   = [...]string{"Januar", "Februar", "März", "April", "Mai", "Juni", "Juli", "August", "September", "Oktober", "November", "Dezember"}
+)
+
+// formatLocalTime formats t (already in the wanted location) for people, e.g.
+// "Monday, November 2, 2026 at 2:00 PM CET" or "Montag, 2. November 2026, 14:00 CET".
+func formatLocalTime(t time.Time, locale string) string {
+	if resolveLocale(locale) == "de" {
+		return fmt.Sprintf("%s, %d. %s %d, %s", germanWeekdays[t.Weekday()], t.Day(), germanMonths[t.Month()-1], t.Year(), t.Format("15:04 MST"))
 	}
-	return ""
+	return t.Format("Monday, January 2, 2006 at 3:04 PM MST")
 }
 
-// optionalAuth extracts userID if bearer is present; otherwise returns empty.
-func optionalAuth(c *gin.Context) string {
-	h := c.GetHeader("Authorization")
-	if strings.HasPrefix(h, "Bearer ") {
-		tok := strings.TrimPrefix(h, "Bearer ")
-		if claims, err := parseAccessToken(tok); err == nil {
-			return claims.UserID
-		}
+// formatWeeklyTime describes a standing weekly meeting by its first occurrence, e.g.
+// "every Monday at 9:00 AM CET, starting November 2, 2026".
+func formatWeeklyTime(t time.Time, locale string) string {
+	if resolveLocale(locale) == "de" {
+		return fmt.Sprintf("jeden %s um %s, ab %d. %s %d", germanWeekdays[t.Weekday()], t.Format("15:04 MST"), t.Day(), germanMonths[t.Month()-1], t.Year())
 	}
-	return ""
+	return t.Format("every Monday at 3:04 PM MST, starting January 2, 2006")
 }
 
-func main() {
-	_ = godotenv.Load()
-	secret := os.Getenv("JWT_SECRET")
-	if secret == "" {
-		log.Fatal("JWT_SECRET not set")
+// formatLocalDateRange formats an event's date bounds for people, e.g.
+// "November 2, 2026 – November 6, 2026" or "2. November 2026 – 6. November 2026".
+func formatLocalDateRange(dateFrom, dateTo, tz, locale string) string {
+	loc := eventLocation(tz)
+	from, ok1 := eventDateBound(dateFrom, loc)
+	to, ok2 := eventDateBound(dateTo, loc)
+	if !ok1 || !ok2 {
+		return ""
 	}
-	jwtSecret = []byte(secret)
-
-	if cs := os.Getenv("COOKIE_SECURE"); strings.ToLower(cs) == "false" {
-		cookieSecure = false
+	day := func(t time.Time) string {
+		if resolveLocale(locale) == "de" {
+			return fmt.Sprintf("%d. %s %d", t.Day(), germanMonths[t.Month()-1], t.Year())
+		}
+		return t.Format("January 2, 2006")
 	}
-
-	dbPath := os.Getenv("DATABASE_PATH")
-	if dbPath == "" {
-		dbPath = "app.db"
+	if !to.After(from) {
+		return day(from)
 	}
+	return day(from) + " – " + day(to)
+}
 
-	if rt := os.Getenv("REQUEST_TIMEOUT_MS"); rt != "" {
-		if ms, err := strconv.Atoi(rt); err == nil && ms > 0 {
-			reqTimeout = time.Duration(ms) * time.Millisecond
-		}
+// formatWeeklyPoll stands in for the date range of a weekly poll, which has none.
+func formatWeeklyPoll(locale string) string {
+	if resolveLocale(locale) == "de" {
+		return "jede Woche"
 	}
+	return "every week"
+}
 
-	brevoAPIKey = os.Getenv("BREVO_API_KEY")
-	brevoSenderEmail = os.Getenv("BREVO_SENDER_EMAIL")
-	brevoSenderName = os.Getenv("BREVO_SENDER_NAME")
-	resetCodeTTL = time.Duration(getEnvInt("RESET_CODE_TTL_MINUTES", 15)) * time.Minute
+// sendEmail queues a transactional message, which bypasses the suppression list.
+func sendEmail(userID, toEmail, subject, html string) error {
+	return enqueueEmail(outgoingEmail{UserID: userID, To: toEmail, Subject: subject, HTML: html})
+}
 
-	recaptchaProjectID = os.Getenv("RECAPTCHA_ENTERPRISE_PROJECT_ID")
-	recaptchaSiteKey = os.Getenv("RECAPTCHA_ENTERPRISE_SITE_KEY")
-	if v := os.Getenv("RECAPTCHA_ENTERPRISE_MIN_SCORE"); v != "" {
-		if f, err := strconv.ParseFloat(v, 64); err == nil && f >= 0 && f <= 1 {
-			recaptchaMinScore = f
-		}
+// sendNonEssentialEmail sends reminder/digest style mail with one-click unsubscribe
+// headers and a footer link. Suppressed recipients are skipped silently. Categories in
+// pushCategories also go to the user's registered mobile devices.
+func sendNonEssentialEmail(ctx context.Context, category, userID, toEmail, subject, html string) error {
+	if accountDeactivated(ctx, userID) || notificationsSnoozed(ctx, userID) {
+		metricInc("plannie_email_suppressed_total", "category", category)
+		return nil
 	}
-
-	var err error
-	db, err = openDB(dbPath)
+	if pushCategories[category] {
+		queuePush(userID, subject, html)
+	}
+	suppressed, err := emailSuppressed(ctx, toEmail, category)
 	if err != nil {
-		log.Fatalf("open db: %v", err)
+		return err
 	}
-
-	ctx := context.Background()
-	if err := migrate(ctx, db); err != nil {
-		log.Fatalf("migrate: %v", err)
+	if suppressed {
+		metricInc("plannie_email_suppressed_total", "category", category)
+		return nil
 	}
+	unsubURL := unsubscribeURL(toEmail, category)
+	html += fmt.Sprintf(`<p style="font-size:12px;color:#888">Don't want these emails? <a href="%s">Unsubscribe</a>.</p>`, unsubURL)
+	return enqueueEmail(outgoingEmail{
+		UserID:   userID,
+		To:       toEmail,
+		Subject:  subject,
+		HTML:     html,
+		Category: category,
+		Headers: map[string]string{
+			"List-Unsubscribe":      "<" + unsubURL + ">",
+			"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+		},
+	})
+}
 
-	if recaptchaProjectID != "" && recaptchaSiteKey != "" {
-		recaptchaClient, err = recaptcha.NewClient(ctx)
-		if err != nil {
-			log.Fatalf("init recaptcha enterprise client: %v", err)
-		}
-	}
+// emailProvider is EMAIL_PROVIDER: "smtp", "brevo" or "memory". When unset, SMTP is used if
+// SMTP_HOST is configured and Brevo otherwise.
+var emailProvider string
+
+// Captured mail for EMAIL_PROVIDER=memory, newest last, capped at devMailboxMax.
+type capturedEmail struct {
+	ID       string            `json:"id"`
+	To       string            `json:"to"`
+	Subject  string            `json:"subject"`
+	HTML     string            `json:"html"`
+	Category string            `json:"category,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	SentAt   time.Time         `json:"sentAt"`
+
+	Attachments []capturedAttachment `json:"attachments,omitempty"`
+}
 
-	// Start pprof server on :6060 (default mux). Endpoints: /debug/pprof/
-	go func() {
-		log.Println("pprof listening on :6060")
-		if err := http.ListenAndServe(":6060", nil); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			log.Printf("pprof server error: %v", err)
-		}
-	}()
+type capturedAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType"`
+	Content     string `json:"content"`
+}
 
-	go cleanupVisitorsLoop()
-	go cleanupLoginAttemptsLoop()
-	go cleanupUnverifiedUsersLoop()
+var (
+	devMailboxMu  sync.Mutex
+	devMailbox    []capturedEmail
+	devMailboxMax = 500
+)
 
-	r := gin.Default()
-	r.Use(securityHeaders())
-	r.Use(cors.New(buildCORS()))
+func captureEmail(m outgoingEmail) error {
+	var attachments []capturedAttachment
+	for _, a := range m.Attachments {
+		attachments = append(attachments, capturedAttachment{Filename: a.Filename, ContentType: a.ContentType, Content: string(a.Data)})
+	}
+	devMailboxMu.Lock()
+	defer devMailboxMu.Unlock()
+	devMailbox = append(devMailbox, capturedEmail{
+		ID:          uuid.NewString(),
+		To:          m.To,
+		Subject:     m.Subject,
+		HTML:        m.HTML,
+		Category:    m.Category,
+		Headers:     m.Headers,
+		SentAt:      time.Now().UTC(),
+		Attachments: attachments,
+	})
+	if len(devMailbox) > devMailboxMax {
+		devMailbox = devMailbox[len(devMailbox)-devMailboxMax:]
+	}
+	return nil
+}
 
-	r.GET("/healthz", func(c *gin.Context) {
-		if err := db.PingContext(c.Request.Context()); err != nil {
-			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unhealthy"})
-			return
+// deliverEmail hands a message to the configured provider.
+func deliverEmail(ctx context.Context, m outgoingEmail) error {
+	if m.Headers == nil {
+		m.Headers = map[string]string{}
+	}
+	if _, ok := m.Headers["List-Unsubscribe"]; !ok {
+		if unsub := listUnsubscribeHeader(); unsub != "" {
+			m.Headers["List-Unsubscribe"] = unsub
+			if strings.HasPrefix(emailListUnsubscribe, "https://") {
+				m.Headers["List-Unsubscribe-Post"] = "List-Unsubscribe=One-Click"
+			}
 		}
-		c.JSON(http.StatusOK, gin.H{"status": "ok"})
-	})
+	}
+	m.HTML = brandEmailHTML(ctx, m.UserID, m.HTML)
+	switch emailProvider {
+	case "memory":
+		return captureEmail(m)
+	case "smtp":
+		return sendEmailSMTP(ctx, m)
+	default:
+		return sendEmailBrevo(ctx, m)
+	}
+}
 
-	r.POST("/register", rateLimit(10, 10), registerHandler)
-	r.POST("/login", rateLimit(10, 10), loginHandler)
-	r.POST("/refresh", rateLimit(10, 10), refreshHandler)
-	r.POST("/logout", rateLimit(10, 10), logoutHandler)
+// Outgoing mail goes through an in-memory queue drained by emailQueueLoop. A global
+// limiter caps provider throughput and each user gets emailUserQuota messages per
+// emailUserWindow; over-quota mail is deferred, not dropped.
+type queuedEmail struct {
+	msg      outgoingEmail
+	queuedAt time.Time
+	attempts int
+	notAfter time.Time
+	next     time.Time
+}
 
-	r.GET("/verify-email", rateLimit(10, 10), verifyEmailHandler)
-	r.POST("/forgot-password", rateLimit(5, 5), forgotPasswordHandler)
-	r.POST("/reset-password", rateLimit(5, 5), resetPasswordHandler)
+var (
+	emailQueueMu     sync.Mutex
+	emailQueue       []*queuedEmail
+	emailQueueWake   = make(chan struct{}, 1)
+	emailUserSends   = map[string][]time.Time{}
+	emailGlobalLimit = rate.NewLimiter(rate.Limit(5), 10)
+	emailUserQuota   = 20
+	emailUserWindow  = time.Hour
+	emailQueueMax    = 10000
+	emailMaxAttempts = 5
+	emailMaxAge      = 24 * time.Hour
+)
 
-	authProtected := r.Group("/")
-	authProtected.Use(authnMiddleware())
+var errEmailQueueFull = errors.New("email queue full")
 
-	authProtected.GET("/users/me", rateLimit(30, 30), currentUserHandler)
-	authProtected.PUT("/users/me", rateLimit(30, 30), updateUserHandler)
-	authProtected.DELETE("/users/me", rateLimit(5, 5), deleteUserHandler)
-	authProtected.POST("/verify-email/resend", rateLimit(5, 5), resendVerifyEmailHandler)
-	authProtected.GET("/events/:id/stream", rateLimit(60, 60), sseHandler)
+func enqueueEmail(m outgoingEmail) error {
+	now := time.Now()
+	emailQueueMu.Lock()
+	if len(emailQueue) >= emailQueueMax {
+		emailQueueMu.Unlock()
+		metricInc("plannie_email_dropped_total", "reason", "queue_full")
+		return errEmailQueueFull
+	}
+	emailQueue = append(emailQueue, &queuedEmail{msg: m, queuedAt: now, notAfter: now.Add(emailMaxAge), next: now})
+	emailQueueMu.Unlock()
+	select {
+	case emailQueueWake <- struct{}{}:
+	default:
+	}
+	return nil
+}
 
-	authProtected.POST("/events", rateLimit(20, 20), createEventHandler)
-	r.GET("/events/:id", rateLimit(60, 60), getEventHandler)
-	authProtected.PUT("/events/:id", rateLimit(30, 30), updateEventHandler)
-	authProtected.DELETE("/events/:id", rateLimit(20, 20), deleteEventHandler)
+// userQuotaAvailable trims the user's send history and reports when they may send again.
+// Must be called with emailQueueMu held.
+func userQuotaAvailable(userID string, now time.Time) (bool, time.Time) {
+	if userID == "" || emailUserQuota <= 0 {
+		return true, now
+	}
+	sends := emailUserSends[userID]
+	cutoff := now.Add(-emailUserWindow)
+	i := 0
+	for i < len(sends) && sends[i].Before(cutoff) {
+		i++
+	}
+	sends = sends[i:]
+	if len(sends) == 0 {
+		delete(emailUserSends, userID)
+	} else {
+		emailUserSends[userID] = sends
+	}
+	if len(sends) < emailUserQuota {
+		return true, now
+	}
+	return false, sends[0].Add(emailUserWindow)
+}
 
-	authProtected.POST("/events/:id/invite", rateLimit(10, 10), inviteHandler)
-	authProtected.POST("/events/:id/invite/accept", rateLimit(10, 10), acceptEventInviteHandler)
-	authProtected.POST("/events/:id/invite/decline", rateLimit(10, 10), declineEventInviteHandler)
-	authProtected.POST("/events/:id/join", rateLimit(20, 20), joinHandler)
-	authProtected.POST("/events/:id/leave", rateLimit(20, 20), leaveHandler)
+// nextDueEmail pops the oldest message that may be sent now, deferring over-quota ones.
+func nextDueEmail(now time.Time) *queuedEmail {
+	emailQueueMu.Lock()
+	defer emailQueueMu.Unlock()
+	kept := emailQueue[:0]
+	var due *queuedEmail
+	for _, q := range emailQueue {
+		if now.After(q.notAfter) {
+			metricInc("plannie_email_dropped_total", "reason", "expired")
+			log.Printf("email: dropping message to %s after %s in queue", q.msg.To, now.Sub(q.queuedAt).Round(time.Second))
+			continue
+		}
+		if due == nil && !q.next.After(now) {
+			if ok, at := userQuotaAvailable(q.msg.UserID, now); ok {
+				due = q
+				if q.msg.UserID != "" {
+					emailUserSends[q.msg.UserID] = append(emailUserSends[q.msg.UserID], now)
+				}
+				continue
+			} else if q.next.Before(at) {
+				q.next = at
+				metricInc("plannie_email_deferred_total")
+			}
+		}
+		kept = append(kept, q)
+	}
+	emailQueue = kept
+	return due
+}
 
-	authProtected.PUT("/events/:id/draft", rateLimit(30, 30), updateEventDraftHandler)
-	authProtected.DELETE("/events/:id/draft", rateLimit(30, 30), deleteEventDraftHandler)
+// emailQueueLoop delivers queued mail until ctx is cancelled, retrying failures with backoff.
+func emailQueueLoop(ctx context.Context) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		for {
+			q := nextDueEmail(time.Now())
+			if q == nil {
+				break
+			}
+			if err := emailGlobalLimit.Wait(ctx); err != nil {
+				return
+			}
+			q.attempts++
+			sendCtx, cancel := context.WithTimeout(ctx, time.Minute)
+			err := deliverEmail(sendCtx, q.msg)
+			cancel()
+			if err != nil {
+				metricInc("plannie_email_failures_total")
+				outcome := emailFailureOutcome(err)
+				if outcome == emailOutcomeBounced {
+					recordEmailDelivery(emailProvider, outcome)
+					log.Printf("email: %s rejected by the provider: %v", q.msg.To, err)
+					continue
+				}
+				if q.attempts >= emailMaxAttempts {
+					recordEmailDelivery(emailProvider, emailOutcomeFailed)
+					log.Printf("email: giving up on %s after %d attempts: %v", q.msg.To, q.attempts, err)
+					continue
+				}
+				recordEmailDelivery(emailProvider, emailOutcomeDeferred)
+				log.Printf("email: send to %s failed (attempt %d): %v", q.msg.To, q.attempts, err)
+				q.next = time.Now().Add(time.Duration(1<<q.attempts) * time.Minute)
+				emailQueueMu.Lock()
+				emailQueue = append(emailQueue, q)
+				emailQueueMu.Unlock()
+				continue
+			}
+			metricInc("plannie_emails_sent_total")
+			recordEmailDelivery(emailProvider, emailOutcomeSent)
+			statInc("emails_sent")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-emailQueueWake:
+		}
+	}
+}
 
-	authProtected.GET("/my-events", rateLimit(30, 30), myEventsHandler)
-	authProtected.GET("/events/invites", rateLimit(30, 30), getEventInvitesHandler)
+func emailQueueDepth() float64 {
+	emailQueueMu.Lock()
+	defer emailQueueMu.Unlock()
+	return float64(len(emailQueue))
+}
 
-	authProtected.POST("/friends/request", rateLimit(10, 10), sendFriendRequestHandler)
-	authProtected.GET("/friends", rateLimit(30, 30), getFriendsHandler)
-	authProtected.GET("/friends/requests", rateLimit(30, 30), getFriendRequestsHandler)
-	authProtected.POST("/friends/accept/:id", rateLimit(10, 10), acceptFriendRequestHandler)
-	authProtected.POST("/friends/decline/:id", rateLimit(10, 10), declineFriendRequestHandler)
-	authProtected.DELETE("/friends/:id", rateLimit(10, 10), removeFriendHandler)
+// Delivery outcomes per provider, counted on plannie_email_delivery_total and per day in
+// email_delivery_stats, so a provider that quietly stops delivering (and with it
+// verification mail) shows up. Our own attempts report sent, deferred (retried), bounced
+// (permanent rejection) and failed (gave up); provider webhooks add delivered, bounced
+// and complained.
+const (
+	emailOutcomeSent       = "sent"
+	emailOutcomeDelivered  = "delivered"
+	emailOutcomeDeferred   = "deferred"
+	emailOutcomeBounced    = "bounced"
+	emailOutcomeComplained = "complained"
+	emailOutcomeFailed     = "failed"
+)
 
-	srv := &http.Server{
-		Addr:    ":8080",
-		Handler: r,
-		BaseContext: func(l net.Listener) context.Context {
-			return context.Background()
-		},
-	}
+var emailOutcomes = []string{emailOutcomeSent, emailOutcomeDelivered, emailOutcomeDeferred, emailOutcomeBounced, emailOutcomeComplained, emailOutcomeFailed}
 
-	go func() {
-		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			log.Fatalf("listen: %v", err)
-		}
-	}()
-	log.Println("Server running on :8080")
+// Pending per-day counts keyed by day, provider and outcome, and the last send and
+// failure times; all guarded by statsMu and flushed with the daily rollups.
+var (
+	emailDeliveryPending = map[[3]string]int64{}
+	emailLastSent        time.Time
+	emailLastFailure     time.Time
+)
 
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
-	log.Println("Shutting down...")
-	ctxShutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	if err := srv.Shutdown(ctxShutdown); err != nil {
-		log.Printf("server shutdown error: %v", err)
+func recordEmailDelivery(provider, outcome string) {
+	metricInc("plannie_email_delivery_total", "provider", provider, "outcome", outcome)
+	now := time.Now()
+	statsMu.Lock()
+	emailDeliveryPending[[3]string{statDay(now), provider, outcome}]++
+	switch outcome {
+	case emailOutcomeSent, emailOutcomeDelivered:
+		emailLastSent = now
+	case emailOutcomeBounced, emailOutcomeFailed:
+		emailLastFailure = now
 	}
-	if recaptchaClient != nil {
-		_ = recaptchaClient.Close()
+	statsMu.Unlock()
+}
+
+// emailLastSentSeconds backs a gauge for alerting on mail that has stopped going out.
+func emailLastSentSeconds() float64 {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	if emailLastSent.IsZero() {
+		return 0
 	}
-	if err := db.Close(); err != nil {
-		log.Printf("db close error: %v", err)
+	return float64(emailLastSent.Unix())
+}
+
+// emailFailureOutcome treats a 5xx SMTP reply as a permanent bounce that retrying won't fix.
+func emailFailureOutcome(err error) string {
+	var te *textproto.Error
+	if errors.As(err, &te) && te.Code >= 500 {
+		return emailOutcomeBounced
 	}
+	return emailOutcomeDeferred
 }
 
-func registerHandler(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
-	defer cancel()
+// brevoWebhookOutcomes maps Brevo transactional webhook events to outcomes; others are ignored.
+var brevoWebhookOutcomes = map[string]string{
+	"delivered":     emailOutcomeDelivered,
+	"deferred":      emailOutcomeDeferred,
+	"soft_bounce":   emailOutcomeBounced,
+	"hard_bounce":   emailOutcomeBounced,
+	"blocked":       emailOutcomeBounced,
+	"invalid_email": emailOutcomeBounced,
+	"spam":          emailOutcomeComplained,
+}
 
-	var input struct {
-		Username        string `json:"username"`
-		Email           string `json:"email"`
-		Password        string `json:"password"`
-		RecaptchaToken  string `json:"recaptchaToken"`
-		RecaptchaAction string `json:"recaptchaAction"`
-	}
-	if err := c.BindJSON(&input); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+var webhookProviderRe = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// emailWebhookHandler records delivery reports pushed by a mail provider. The URL must
+// carry EMAIL_WEBHOOK_TOKEN as ?token=; the route is 404 when it is unset. brevo takes
+// Brevo's webhook events; any other provider name takes {"event": "<outcome>"} objects,
+// one or a list, for relays with their own hooks.
+func emailWebhookHandler(c *gin.Context) {
+	if emailWebhookToken == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
 		return
 	}
-	if !validateUsername(input.Username) {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid username"})
+	if !hmac.Equal([]byte(c.Query("token")), []byte(emailWebhookToken)) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
 		return
 	}
-	if !validateEmail(input.Email) {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email"})
+	provider := strings.ToLower(c.Param("provider"))
+	if !webhookProviderRe.MatchString(provider) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid provider"})
 		return
 	}
-	if !validatePassword(input.Password) {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Weak password (>=8 chars with number and special)"})
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, 1<<20))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid body"})
 		return
 	}
-
-	if recaptchaClient != nil {
-		if err := verifyRecaptchaEnterprise(ctx, input.RecaptchaToken, recaptchaActionRegister, clientIP(c)); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Recaptcha failed"})
+	var events []map[string]interface{}
+	if err := json.Unmarshal(body, &events); err != nil {
+		var one map[string]interface{}
+		if err := json.Unmarshal(body, &one); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid body"})
 			return
 		}
+		events = []map[string]interface{}{one}
 	}
-
-	var exists int
-	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM users WHERE username = ? OR email = ?`, input.Username, input.Email).Scan(&exists); err != nil {
-		serverError(c, "register: count user", err)
-		return
-	}
-	if exists > 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Username or email already taken"})
-		return
+	recorded := 0
+	for _, e := range events {
+		name, _ := e["event"].(string)
+		name = strings.ToLower(name)
+		outcome := ""
+		if provider == "brevo" {
+			outcome = brevoWebhookOutcomes[name]
+		} else {
+			for _, o := range emailOutcomes {
+				if o == name && o != emailOutcomeSent {
+					outcome = o
+				}
+			}
+		}
+		if outcome == "" {
+			continue
+		}
+		recordEmailDelivery(provider, outcome)
+		recorded++
 	}
+	c.JSON(http.StatusOK, gin.H{"recorded": recorded})
+}
 
-	hash, err := bcrypt.GenerateFromPassword([]byte(input.Password), 12)
-	if err != nil {
-		serverError(c, "register: hash", err)
-		return
-	}
-	now := time.Now().UTC()
-	id := uuid.NewString()
-	if _, err := db.ExecContext(ctx, `INSERT INTO users(id, username, email, email_verified, password_hash, created_at, updated_at) VALUES (?,?,?,?,?,?,?)`,
-		id, input.Username, input.Email, 0, string(hash), now, now); err != nil {
-		serverError(c, "register: insert user", err)
-		return
+// suppressionKey is how an address is stored in email_suppressions: lowercased, or its
+// blind index when field encryption is on.
+func suppressionKey(email string) string {
+	if idx := blindIndex(email); idx != "" {
+		return idx
 	}
+	return strings.ToLower(email)
+}
 
-	raw, tokenID, err := createEmailToken(id, "verify", verifyTTL)
-	if err == nil {
-		apiURL := apiBaseURL()
-		verifyURL := fmt.Sprintf("%s/verify-email?tid=%s&t=%s", apiURL, tokenID, raw)
-		html := fmt.Sprintf(`<p>Welcome %s,</p><p>Please verify your email by clicking <a href="%s">this link</a>. The link expires in 24 hours.</p>`, input.Username, verifyURL)
-		go func() {
-			if err := sendEmailBrevo(input.Email, "Verify your account", html); err != nil {
-				log.Printf("sendEmailBrevo verify: %v", err)
-			}
-		}()
-	}
+func emailSuppressed(ctx context.Context, email, category string) (bool, error) {
+	var n int
+	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM email_suppressions WHERE email = ? AND category IN (?, ?)`,
+		suppressionKey(email), category, emailCategoryAll).Scan(&n)
+	return n > 0, err
+}
 
-	c.JSON(http.StatusCreated, gin.H{"id": id, "username": input.Username})
+// unsubscribeToken is an HMAC over the address and category so links need no stored state.
+func unsubscribeToken(email, category string) string {
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte("unsubscribe:" + strings.ToLower(email) + ":" + category))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
 }
 
-func loginHandler(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
-	defer cancel()
+func unsubscribeURL(email, category string) string {
+	q := url.Values{}
+	q.Set("e", strings.ToLower(email))
+	q.Set("c", category)
+	q.Set("t", unsubscribeToken(email, category))
+	return apiBaseURL() + "/unsubscribe?" + q.Encode()
+}
 
-	var input struct {
-		Username   string `json:"username"`
-		Password   string `json:"password"`
-		RememberMe bool   `json:"rememberMe"`
-	}
-	if err := c.BindJSON(&input); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
-		return
-	}
-	if input.Username == "" || input.Password == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing fields"})
-		return
+// Optional mail headers shared by the SMTP and Brevo paths.
+var (
+	emailReplyTo         string
+	emailListUnsubscribe string
+	emailWebhookToken    string
+	dkimOptions          *dkim.SignOptions
+)
+
+// listUnsubscribeHeader returns the List-Unsubscribe value: EMAIL_LIST_UNSUBSCRIBE (URL or
+// mailto) when configured, otherwise a mailto to the Reply-To address.
+func listUnsubscribeHeader() string {
+	switch {
+	case emailListUnsubscribe != "":
+		return "<" + emailListUnsubscribe + ">"
+	case emailReplyTo != "":
+		return "<mailto:" + emailReplyTo + "?subject=unsubscribe>"
 	}
+	return ""
+}
 
-	var u struct {
-		ID            string
-		Username      string
-		PasswordHash  string
-		EmailVerified bool
-		CreatedAt     time.Time
+// loadDKIMKey parses a PEM encoded RSA or Ed25519 private key (PKCS#1 or PKCS#8).
+func loadDKIMKey(pemData []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
 	}
-	err := db.QueryRowContext(ctx, `SELECT id, username, password_hash, email_verified, created_at FROM users WHERE username = ?`, input.Username).
-		Scan(&u.ID, &u.Username, &u.PasswordHash, &u.EmailVerified, &u.CreatedAt)
-	if err == sql.ErrNoRows {
-		recordLoginAttempt(ctx, "", input.Username, clientIP(c))
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
-		return
-	} else if err != nil {
-		serverError(c, "login: select user", err)
-		return
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
 	}
-
-	locked, err := isLockedOut(ctx, u.ID)
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
-		return
+		return nil, err
 	}
-	if locked {
-		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Account locked. Try later."})
-		return
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported key type")
 	}
+	return signer, nil
+}
 
-	if !u.EmailVerified {
-		if time.Since(u.CreatedAt) > verifyTTL {
-			_, _ = db.ExecContext(ctx, `DELETE FROM users WHERE id = ?`, u.ID)
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Email verification expired. Please register again."})
-			return
+// configureDKIM enables DKIM signing of SMTP mail when DKIM_SELECTOR and a key
+// (DKIM_PRIVATE_KEY or DKIM_PRIVATE_KEY_FILE) are set. DKIM_DOMAIN defaults to the EMAIL_FROM domain.
+func configureDKIM() error {
+	selector := os.Getenv("DKIM_SELECTOR")
+	keyPEM := []byte(os.Getenv("DKIM_PRIVATE_KEY"))
+	if path := os.Getenv("DKIM_PRIVATE_KEY_FILE"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
 		}
+		keyPEM = b
 	}
-
-	if err := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(input.Password)); err != nil {
-		recordLoginAttempt(ctx, u.ID, input.Username, clientIP(c))
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
-		return
+	if selector == "" || len(keyPEM) == 0 {
+		return nil
 	}
-
-	access, err := signAccessToken(u.ID)
+	signer, err := loadDKIMKey(keyPEM)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
-		return
+		return err
 	}
-
-	family := uuid.NewString()
-	version := 1
-	now := time.Now().UTC()
-	refreshExpires := now.Add(refreshTTL)
-	remember := input.RememberMe
-	if !remember {
-		refreshExpires = now.Add(refreshTTLShort)
+	domain := os.Getenv("DKIM_DOMAIN")
+	if domain == "" {
+		domain = emailDomain(smtpFromAddress())
 	}
-
-	refresh, rtID, err := signRefreshToken(u.ID, family, version, refreshExpires)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
-		return
+	if domain == "" {
+		return errors.New("DKIM_DOMAIN or EMAIL_FROM required")
 	}
-	rtHash, err := hashToken(refresh)
-	if err != nil {
-		serverError(c, "login: hash refresh", err)
-		return
+	dkimOptions = &dkim.SignOptions{
+		Domain:                 domain,
+		Selector:               selector,
+		Signer:                 signer,
+		HeaderCanonicalization: dkim.CanonicalizationRelaxed,
+		BodyCanonicalization:   dkim.CanonicalizationRelaxed,
+		HeaderKeys:             []string{"From", "To", "Subject", "Date", "Message-ID", "Reply-To", "List-Unsubscribe", "List-Unsubscribe-Post", "MIME-Version", "Content-Type"},
 	}
+	return nil
+}
 
-	if _, err := db.ExecContext(ctx, `INSERT INTO refresh_tokens(id, user_id, family_id, version, token_hash, expires_at, created_at, revoked, remember)
-		VALUES (?,?,?,?,?,?,?,0,?)`,
-		rtID, u.ID, family, version, string(rtHash), refreshExpires, now, remember); err != nil {
-		serverError(c, "login: insert refresh", err)
-		return
+// smtpFromAddress returns the bare address of EMAIL_FROM, which may be "Name <addr>".
+func smtpFromAddress() string {
+	from := os.Getenv("EMAIL_FROM")
+	if addr, err := mail.ParseAddress(from); err == nil {
+		return addr.Address
 	}
-
-	setRefreshCookie(c, refresh, refreshExpires, remember)
-
-	c.JSON(http.StatusOK, gin.H{
-		"token":               access,
-		"refresh_token":       refresh,
-		"username":            u.Username,
-		"email_verified":      u.EmailVerified,
-		"verificationExpires": u.CreatedAt.Add(verifyTTL),
-	})
+	return from
 }
 
-func refreshHandler(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
-	defer cancel()
-
-	var input struct {
-		RefreshToken string `json:"refresh_token"`
+// buildSMTPMessage renders a quoted-printable HTML message with the headers mailbox
+// providers expect (Date, Message-ID, Reply-To, List-Unsubscribe).
+func buildSMTPMessage(from string, m outgoingEmail, now time.Time) ([]byte, error) {
+	var htmlPart bytes.Buffer
+	qp := quotedprintable.NewWriter(&htmlPart)
+	if _, err := qp.Write([]byte(m.HTML)); err != nil {
+		return nil, err
 	}
-	_ = c.BindJSON(&input)
-	if input.RefreshToken == "" {
-		if cookie, err := c.Cookie(refreshCookieName); err == nil {
-			input.RefreshToken = cookie
-		}
+	if err := qp.Close(); err != nil {
+		return nil, err
 	}
-	if input.RefreshToken == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing refresh token"})
-		return
+
+	body := htmlPart.Bytes()
+	contentType := `text/html; charset="utf-8"`
+	transferEncoding := "quoted-printable"
+	if len(m.Attachments) > 0 {
+		var mixed bytes.Buffer
+		mw := multipart.NewWriter(&mixed)
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {`text/html; charset="utf-8"`},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		pw.Write(htmlPart.Bytes())
+		for _, a := range m.Attachments {
+			pw, err := mw.CreatePart(textproto.MIMEHeader{
+				"Content-Type":              {a.ContentType + `; name="` + a.Filename + `"`},
+				"Content-Disposition":       {`attachment; filename="` + a.Filename + `"`},
+				"Content-Transfer-Encoding": {"base64"},
+			})
+			if err != nil {
+				return nil, err
+			}
+			enc := base64.StdEncoding.EncodeToString(a.Data)
+			for len(enc) > 76 {
+				pw.Write([]byte(enc[:76] + "\r\n"))
+				enc = enc[76:]
+			}
+			pw.Write([]byte(enc + "\r\n"))
+		}
+		if err := mw.Close(); err != nil {
+			return nil, err
+		}
+		body = mixed.Bytes()
+		contentType = "multipart/mixed; boundary=" + mw.Boundary()
+		transferEncoding = ""
 	}
 
-	parsed, err := jwt.ParseWithClaims(input.RefreshToken, &jwt.RegisteredClaims{}, func(t *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
-	if err != nil || !parsed.Valid {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
-		return
+	var msg bytes.Buffer
+	header := func(k, v string) {
+		if v != "" {
+			msg.WriteString(k + ": " + v + "\r\n")
+		}
 	}
-	claims, _ := parsed.Claims.(*jwt.RegisteredClaims)
-	if claims == nil || claims.ID == "" || claims.Subject == "" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
-		return
+	header("From", from)
+	header("To", m.To)
+	header("Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	header("Date", now.Format(time.RFC1123Z))
+	header("Message-ID", "<"+uuid.NewString()+"@"+emailDomain(smtpFromAddress())+">")
+	header("Reply-To", emailReplyTo)
+	header("List-Unsubscribe", m.Headers["List-Unsubscribe"])
+	header("List-Unsubscribe-Post", m.Headers["List-Unsubscribe-Post"])
+	header("MIME-Version", "1.0")
+	header("Content-Type", contentType)
+	header("Content-Transfer-Encoding", transferEncoding)
+	msg.WriteString("\r\n")
+	msg.Write(body)
+
+	if dkimOptions == nil {
+		return msg.Bytes(), nil
 	}
-
-	userID := claims.Subject
-	rtID := claims.ID
-	parts := strings.Split(rtID, ":")
-	if len(parts) != 2 {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
-		return
+	var signed bytes.Buffer
+	if err := dkim.Sign(&signed, &msg, dkimOptions); err != nil {
+		return nil, fmt.Errorf("dkim sign: %w", err)
 	}
-	family := parts[0]
-	version, _ := strconv.Atoi(parts[1])
+	return signed.Bytes(), nil
+}
 
-	var stored RefreshToken
-	err = db.QueryRowContext(ctx, `SELECT id, user_id, family_id, version, token_hash, expires_at, revoked, remember FROM refresh_tokens WHERE id = ?`, rtID).
-		Scan(&stored.ID, &stored.UserID, &stored.FamilyID, &stored.Version, &stored.TokenHash, &stored.ExpiresAt, &stored.Revoked, &stored.Remember)
-	if err == sql.ErrNoRows {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
-		return
-	} else if err != nil {
-		serverError(c, "refresh: select token", err)
-		return
+// configureEmail reads the provider settings shared by the server and `plannie doctor`.
+func configureEmail() error {
+	brevoAPIKey = os.Getenv("BREVO_API_KEY")
+	brevoSenderEmail = os.Getenv("BREVO_SENDER_EMAIL")
+	brevoSenderName = os.Getenv("BREVO_SENDER_NAME")
+	emailProvider = strings.ToLower(os.Getenv("EMAIL_PROVIDER"))
+	switch emailProvider {
+	case "":
+		emailProvider = "brevo"
+		if os.Getenv("SMTP_HOST") != "" {
+			emailProvider = "smtp"
+		}
+	case "smtp", "brevo", "memory":
+	default:
+		return fmt.Errorf("unknown EMAIL_PROVIDER %q", emailProvider)
 	}
-	if stored.Revoked || time.Now().After(stored.ExpiresAt) {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Expired or revoked"})
-		return
+	emailReplyTo = os.Getenv("EMAIL_REPLY_TO")
+	emailListUnsubscribe = os.Getenv("EMAIL_LIST_UNSUBSCRIBE")
+	emailWebhookToken = os.Getenv("EMAIL_WEBHOOK_TOKEN")
+	if err := configureDKIM(); err != nil {
+		return fmt.Errorf("dkim: %w", err)
 	}
-	if stored.UserID != userID || stored.FamilyID != family || stored.Version != version {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
-		return
+	return nil
+}
+
+func sendEmailSMTP(ctx context.Context, m outgoingEmail) error {
+	host := os.Getenv("SMTP_HOST")
+	portStr := os.Getenv("SMTP_PORT")
+	user := os.Getenv("SMTP_USER")
+	pass := os.Getenv("SMTP_PASS")
+	from := os.Getenv("EMAIL_FROM")
+	if host == "" || portStr == "" || from == "" {
+		return fmt.Errorf("SMTP not configured")
 	}
-	if err := verifyTokenHash(stored.TokenHash, input.RefreshToken); err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
-		return
+	port, _ := strconv.Atoi(portStr)
+	var auth smtp.Auth
+	if user != "" {
+		auth = smtp.PlainAuth("", user, pass, host)
 	}
 
-	expires := stored.ExpiresAt
-	newVersion := version + 1
-	newRefresh, newRtID, err := signRefreshToken(userID, family, newVersion, expires)
+	msg, err := buildSMTPMessage(from, m, time.Now())
 	if err != nil {
-		serverError(c, "refresh: sign new refresh", err)
-		return
+		return err
 	}
-	newHash, err := hashToken(newRefresh)
+
+	addr := fmt.Sprintf("%s:%d", host, port)
+	return smtpSend(ctx, addr, host, auth, smtpFromAddress(), m.To, msg)
+}
+
+// smtpSend is smtp.SendMail with a context-bound dial and connection deadline, so a stuck
+// server can't hold the email worker forever.
+func smtpSend(ctx context.Context, addr, host string, auth smtp.Auth, from, to string, msg []byte) error {
+	conn, err := (&net.Dialer{Timeout: 10 * time.Second}).DialContext(ctx, "tcp", addr)
 	if err != nil {
-		serverError(c, "refresh: hash new refresh", err)
-		return
+		return err
 	}
-	now := time.Now().UTC()
-
-	tx, err := db.BeginTx(ctx, nil)
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(outboundTimeout)
+	}
+	_ = conn.SetDeadline(deadline)
+	client, err := smtp.NewClient(conn, host)
 	if err != nil {
-		serverError(c, "refresh: begin tx", err)
-		return
+		conn.Close()
+		return err
 	}
-	if _, err := tx.ExecContext(ctx, `UPDATE refresh_tokens SET revoked = 1 WHERE id = ?`, rtID); err != nil {
-		tx.Rollback()
-		serverError(c, "refresh: revoke old token", err)
-		return
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
 	}
-	if _, err := tx.ExecContext(ctx, `
-		INSERT INTO refresh_tokens(id, user_id, family_id, version, token_hash, expires_at, created_at, revoked, remember)
-		VALUES (?,?,?,?,?,?,?,0,?)
-	`, newRtID, userID, family, newVersion, string(newHash), expires, now, stored.Remember); err != nil {
-		tx.Rollback()
-		if strings.Contains(err.Error(), "UNIQUE constraint failed: refresh_tokens.id") {
-			log.Printf("refresh: concurrent rotation detected for old=%s new=%s", rtID, newRtID)
+	if auth != nil {
+		if err := client.Auth(auth); err != nil {
+			return err
 		}
-		serverError(c, "refresh: insert new token", err)
-		return
 	}
-	if err := tx.Commit(); err != nil {
-		serverError(c, "refresh: commit tx", err)
-		return
+	if err := client.Mail(from); err != nil {
+		return err
 	}
-
-	access, err := signAccessToken(userID)
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := client.Data()
 	if err != nil {
-		serverError(c, "refresh: sign access", err)
-		return
+		return err
 	}
-
-	// Fetch username for the response so frontend can restore session state
-	var username string
-	if err := db.QueryRowContext(ctx, `SELECT username FROM users WHERE id = ?`, userID).Scan(&username); err != nil {
-		log.Printf("refresh: failed to fetch username for user %s: %v", userID, err)
-		// Continue without username - not a critical error
+	if _, err := w.Write(msg); err != nil {
+		return err
 	}
-
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// Outbound HTTP calls (Brevo, blocklist downloads) share one client with dial/TLS/header
+// timeouts. outboundDo adds retries with jittered backoff and a per-host circuit breaker.
+const (
+	outboundTimeout          = 30 * time.Second
+	outboundMaxAttempts      = 3
+	outboundBreakerThreshold = 5
+	outboundBreakerCooldown  = 30 * time.Second
+)
+
+var outboundClient = &http.Client{
+	Timeout: outboundTimeout,
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 15 * time.Second,
+		MaxIdleConns:          20,
+		IdleConnTimeout:       90 * time.Second,
+	},
+}
+
+var errCircuitOpen = errors.New("circuit open")
+
+type circuitBreaker struct {
+	failures  int
+	openUntil time.Time
+}
+
+var (
+	breakersMu sync.Mutex
+	breakers   = map[string]*circuitBreaker{}
+)
+
+func breakerAllow(host string) bool {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	b := breakers[host]
+	return b == nil || time.Now().After(b.openUntil)
+}
+
+func breakerRecord(host string, ok bool) {
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	b := breakers[host]
+	if b == nil {
+		b = &circuitBreaker{}
+		breakers[host] = b
+	}
+	if ok {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= outboundBreakerThreshold {
+		b.openUntil = time.Now().Add(outboundBreakerCooldown)
+		b.failures = 0
+		metricInc("plannie_outbound_circuit_open_total", "host", host)
+		log.Printf("outbound: circuit open for %s for %s", host, outboundBreakerCooldown)
+	}
+}
+
+func retryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= 500
+}
+
+// outboundDo sends the request built by newReq, retrying network errors, 429 and 5xx.
+// newReq is called per attempt so request bodies can be replayed.
+func outboundDo(ctx context.Context, newReq func(ctx context.Context) (*http.Request, error)) (*http.Response, error) {
+	var lastErr error
+	for attempt := 0; attempt < outboundMaxAttempts; attempt++ {
+		req, err := newReq(ctx)
+		if err != nil {
+			return nil, err
+		}
+		host := req.URL.Host
+		if !breakerAllow(host) {
+			metricInc("plannie_outbound_requests_total", "host", host, "outcome", "circuit_open")
+			return nil, fmt.Errorf("%s: %w", host, errCircuitOpen)
+		}
+		resp, err := outboundClient.Do(req)
+		wait := time.Duration(250<<attempt) * time.Millisecond
+		switch {
+		case err != nil:
+			lastErr = err
+			breakerRecord(host, false)
+			metricInc("plannie_outbound_requests_total", "host", host, "outcome", "error")
+		case retryableStatus(resp.StatusCode) && attempt < outboundMaxAttempts-1:
+			if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+				wait = min(time.Duration(secs)*time.Second, 10*time.Second)
+			}
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+			lastErr = fmt.Errorf("%s: status %d", host, resp.StatusCode)
+			breakerRecord(host, resp.StatusCode == http.StatusTooManyRequests)
+			metricInc("plannie_outbound_requests_total", "host", host, "outcome", "retry")
+		default:
+			breakerRecord(host, resp.StatusCode < 500)
+			metricInc("plannie_outbound_requests_total", "host", host, "outcome", strconv.Itoa(resp.StatusCode/100)+"xx")
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if attempt == outboundMaxAttempts-1 {
+			break
+		}
+		jitter := time.Duration(mathrand.Int64N(int64(wait)))
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait + jitter):
+		}
+	}
+	return nil, lastErr
+}
+
+func createEmailToken(userID, kind string, ttl time.Duration) (rawToken, tokenID string, err error) {
+	raw := uuid.NewString()
+	tokenID = uuid.NewString()
+	expires := time.Now().UTC().Add(ttl)
+
+	hashed, err := hashToken(raw)
+	if err != nil {
+		return "", "", err
+	}
+
+	_, err = db.Exec(`INSERT INTO email_tokens(id, user_id, kind, token_hash, expires_at, created_at, used) VALUES (?,?,?,?,?,?,0)`,
+		tokenID, userID, kind, hashed, expires, time.Now().UTC())
+	if err != nil {
+		return "", "", err
+	}
+	return raw, tokenID, nil
+}
+
+func verifyEmailTokenByID(tokenID, rawToken, kind string) (userID string, err error) {
+	var id, uid, thash string
+	var expires time.Time
+	var used int
+	err = db.QueryRow(`SELECT id, user_id, token_hash, expires_at, used FROM email_tokens WHERE id = ? AND kind = ?`, tokenID, kind).
+		Scan(&id, &uid, &thash, &expires, &used)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("invalid token")
+	} else if err != nil {
+		return "", err
+	}
+	if used == 1 || time.Now().After(expires) {
+		return "", fmt.Errorf("expired or used")
+	}
+	if err := verifyTokenHash(thash, rawToken); err != nil {
+		return "", fmt.Errorf("invalid token")
+	}
+	if _, err := db.Exec(`UPDATE email_tokens SET used = 1 WHERE id = ?`, id); err != nil {
+	}
+	return uid, nil
+}
+
+type brevoEmailReq struct {
+	Sender      map[string]string   `json:"sender"`
+	To          []map[string]string `json:"to"`
+	ReplyTo     map[string]string   `json:"replyTo,omitempty"`
+	Headers     map[string]string   `json:"headers,omitempty"`
+	Attachment  []map[string]string `json:"attachment,omitempty"`
+	Subject     string              `json:"subject"`
+	HTMLContent string              `json:"htmlContent"`
+}
+
+func sendEmailBrevo(ctx context.Context, m outgoingEmail) error {
+	if brevoAPIKey == "" || brevoSenderEmail == "" {
+		return errors.New("brevo not configured")
+	}
+	payload := brevoEmailReq{
+		Sender: map[string]string{
+			"email": brevoSenderEmail,
+			"name":  brevoSenderName,
+		},
+		To: []map[string]string{{
+			"email": m.To,
+			"name":  m.To,
+		}},
+		Subject:     m.Subject,
+		HTMLContent: m.HTML,
+	}
+	if emailReplyTo != "" {
+		payload.ReplyTo = map[string]string{"email": emailReplyTo}
+	}
+	if len(m.Headers) > 0 {
+		payload.Headers = m.Headers
+	}
+	for _, a := range m.Attachments {
+		payload.Attachment = append(payload.Attachment, map[string]string{
+			"name":    a.Filename,
+			"content": base64.StdEncoding.EncodeToString(a.Data),
+		})
+	}
+	b, _ := json.Marshal(payload)
+	resp, err := outboundDo(ctx, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", "https://api.brevo.com/v3/smtp/email", bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("api-key", brevoAPIKey)
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("brevo send failed: %s", string(body))
+	}
+	return nil
+}
+
+func verifyRecaptchaEnterprise(ctx context.Context, token, action, remoteIP string) error {
+	if recaptchaClient == nil || recaptchaProjectID == "" || recaptchaSiteKey == "" {
+		return nil
+	}
+	if token == "" {
+		return fmt.Errorf("missing recaptcha token")
+	}
+
+	event := &recaptchapb.Event{
+		Token:   token,
+		SiteKey: recaptchaSiteKey,
+	}
+	assessment := &recaptchapb.Assessment{Event: event}
+	req := &recaptchapb.CreateAssessmentRequest{
+		Parent:     fmt.Sprintf("projects/%s", recaptchaProjectID),
+		Assessment: assessment,
+	}
+
+	resp, err := recaptchaClient.CreateAssessment(ctx, req)
+	if err != nil {
+		return fmt.Errorf("recaptcha assessment failed: %w", err)
+	}
+
+	if resp.TokenProperties == nil || !resp.TokenProperties.Valid {
+		return fmt.Errorf("invalid recaptcha token: %v", resp.GetTokenProperties().GetInvalidReason())
+	}
+
+	if action != "" && resp.TokenProperties.Action != "" && resp.TokenProperties.Action != action {
+		return fmt.Errorf("recaptcha action mismatch")
+	}
+
+	if resp.RiskAnalysis != nil && recaptchaMinScore > 0 {
+		if float64(resp.RiskAnalysis.Score) < recaptchaMinScore {
+			return fmt.Errorf("recaptcha score too low")
+		}
+	}
+
+	return nil
+}
+
+func signAccessToken(userID, tenantID string) (string, error) {
+	claims := &Claims{
+		UserID:   userID,
+		TenantID: tenantID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(accessTTL)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtSecret)
+}
+
+func signRefreshToken(userID, family string, version int, expiresAt time.Time) (string, string, error) {
+	rc := jwt.RegisteredClaims{
+		ExpiresAt: jwt.NewNumericDate(expiresAt),
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+		Subject:   userID,
+		ID:        fmt.Sprintf("%s:%d", family, version),
+	}
+	t := jwt.NewWithClaims(jwt.SigningMethodHS256, rc)
+	signed, err := t.SignedString(jwtSecret)
+	return signed, rc.ID, err
+}
+
+func parseAccessToken(tok string) (*Claims, error) {
+	parsed, err := jwt.ParseWithClaims(tok, &Claims{}, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method")
+		}
+		return jwtSecret, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if claims, ok := parsed.Claims.(*Claims); ok && parsed.Valid && claims.UserID != "" {
+		return claims, nil
+	}
+	return nil, errors.New("invalid token")
+}
+
+func signEventAccessToken(eventID string) (string, time.Time, error) {
+	expires := time.Now().Add(eventAccessTTL)
+	claims := &EventAccessClaims{
+		EventID: eventID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(expires),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			Subject:   "event_access",
+		},
+	}
+	tok, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(jwtSecret)
+	return tok, expires, err
+}
+
+func parseEventAccessToken(tok string) (*EventAccessClaims, error) {
+	parsed, err := jwt.ParseWithClaims(tok, &EventAccessClaims{}, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method")
+		}
+		return jwtSecret, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if claims, ok := parsed.Claims.(*EventAccessClaims); ok && parsed.Valid && claims.Subject == "event_access" {
+		return claims, nil
+	}
+	return nil, errors.New("invalid token")
+}
+
+// eventAccessAllowed reports whether the request may view or join a passphrase-protected event.
+// Unprotected events, members, invitees and holders of a valid access token are allowed.
+func eventAccessAllowed(ctx context.Context, c *gin.Context, eventID string, passHash sql.NullString, userID string) bool {
+	if !passHash.Valid || passHash.String == "" {
+		return true
+	}
+	if userID != "" {
+		var n int
+		_ = db.QueryRowContext(ctx, `
+			SELECT (SELECT COUNT(*) FROM events WHERE id = ? AND creator_id = ?)
+				+ (SELECT COUNT(*) FROM event_participants WHERE event_id = ? AND user_id = ?)
+				+ (SELECT COUNT(*) FROM event_invites WHERE event_id = ? AND invitee_id = ? AND status = 'pending')
+		`, eventID, userID, eventID, userID, eventID, userID).Scan(&n)
+		if n > 0 {
+			return true
+		}
+	}
+	tok := c.GetHeader(eventAccessHeader)
+	if tok == "" {
+		tok = c.Query("access")
+	}
+	if tok == "" {
+		return false
+	}
+	claims, err := parseEventAccessToken(tok)
+	return err == nil && claims.EventID == eventID
+}
+
+func passphraseRequired(c *gin.Context) {
+	c.JSON(http.StatusUnauthorized, gin.H{"error": "Passphrase required", "passphraseRequired": true})
+}
+
+// checkDatabaseDriver validates DATABASE_DRIVER. Only SQLite is implemented: the queries,
+// migrations, maintenance and the seal()/unseal() SQL functions are all written against it,
+// so any other value is refused at startup instead of failing on the first request.
+func checkDatabaseDriver() error {
+	switch d := strings.ToLower(strings.TrimSpace(os.Getenv("DATABASE_DRIVER"))); d {
+	case "", "sqlite", "sqlite3":
+		return nil
+	default:
+		return fmt.Errorf("DATABASE_DRIVER=%q is not supported; this build stores data in SQLite only", d)
+	}
+}
+
+// openDB opens the SQLite database at path in WAL mode. New files use incremental
+// auto-vacuum; older ones are converted by the maintenance job. ":memory:" gives an
+// ephemeral database for tests: a plain :memory: DSN would hand every pooled connection
+// its own empty database, so it maps to a uniquely named memdb database that all
+// connections share, and one connection is pinned because memdb frees the data when
+// the last one closes.
+func openDB(path string) (*sql.DB, error) {
+	dsn := fmt.Sprintf("file:%s?_foreign_keys=on&_pragma=journal_mode(WAL)&_pragma=auto_vacuum(INCREMENTAL)", path)
+	memory := path == ":memory:"
+	if memory {
+		dsn = fmt.Sprintf("file:/plannie-%s?vfs=memdb&_foreign_keys=on", uuid.NewString())
+	}
+	d, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	d.SetMaxOpenConns(25)
+	d.SetMaxIdleConns(25)
+	if !memory {
+		d.SetConnMaxIdleTime(5 * time.Minute)
+		d.SetConnMaxLifetime(60 * time.Minute)
+		return d, nil
+	}
+	conn, err := d.Conn(context.Background())
+	if err != nil {
+		d.Close()
+		return nil, err
+	}
+	memoryAnchors = append(memoryAnchors, conn)
+	return d, nil
+}
+
+// memoryAnchors holds the pinned connections of in-memory databases for the process lifetime.
+var memoryAnchors []*sql.Conn
+
+// extraRoutes lets build-tagged files (see testreset.go) register additional routes.
+var extraRoutes []func(r *gin.Engine)
+
+// Field encryption. With FIELD_ENCRYPTION_KEY (or FIELD_ENCRYPTION_KEY_FILE, e.g. a secret
+// mounted from a KMS) set, email addresses and availability blobs are stored sealed with
+// AES-256-GCM. The pure-Go SQLite driver has no SQLCipher, so the data file itself stays
+// readable: this protects the personal columns of a copied file or backup, not event names,
+// slot counts or the schema. Queries go through the SQL functions registered below: seal()
+// on writes, unseal() on reads and blind_index() for equality lookups on emails, because a
+// sealed value is randomised. Empty strings and '{}' are left as they are so SQL checks like
+// availability <> '{}' keep working, and plaintext rows written before the key was set still
+// read back unchanged until sealPlaintextFields converts them at startup.
+var (
+	fieldAEAD     cipher.AEAD
+	fieldIndexKey []byte
+)
+
+const (
+	sealedPrefix     = "enc1:"
+	blindIndexPrefix = "bi1:"
+)
+
+func configureFieldEncryption() error {
+	raw := os.Getenv("FIELD_ENCRYPTION_KEY")
+	if path := os.Getenv("FIELD_ENCRYPTION_KEY_FILE"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("FIELD_ENCRYPTION_KEY_FILE: %w", err)
+		}
+		raw = strings.TrimSpace(string(b))
+	}
+	if raw == "" {
+		fieldAEAD, fieldIndexKey = nil, nil
+		return nil
+	}
+	key, err := base64.StdEncoding.DecodeString(raw)
+	if err != nil || len(key) != 32 {
+		return errors.New("FIELD_ENCRYPTION_KEY must be 32 random bytes, base64-encoded (openssl rand -base64 32)")
+	}
+	derive := func(label string) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(label))
+		return mac.Sum(nil)
+	}
+	block, err := aes.NewCipher(derive("plannie field encryption"))
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	fieldAEAD, fieldIndexKey = aead, derive("plannie blind index")
+	return nil
+}
+
+func sealField(s string) (string, error) {
+	if fieldAEAD == nil || s == "" || s == "{}" || strings.HasPrefix(s, sealedPrefix) {
+		return s, nil
+	}
+	nonce := make([]byte, fieldAEAD.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return sealedPrefix + base64.RawStdEncoding.EncodeToString(fieldAEAD.Seal(nonce, nonce, []byte(s), nil)), nil
+}
+
+func openField(s string) (string, error) {
+	if !strings.HasPrefix(s, sealedPrefix) {
+		return s, nil
+	}
+	if fieldAEAD == nil {
+		return "", errors.New("field is encrypted but FIELD_ENCRYPTION_KEY is not set")
+	}
+	b, err := base64.RawStdEncoding.DecodeString(s[len(sealedPrefix):])
+	n := fieldAEAD.NonceSize()
+	if err != nil || len(b) < n {
+		return "", errors.New("malformed encrypted field")
+	}
+	plain, err := fieldAEAD.Open(nil, b[:n], b[n:], nil)
+	if err != nil {
+		return "", errors.New("encrypted field does not open with FIELD_ENCRYPTION_KEY")
+	}
+	return string(plain), nil
+}
+
+// blindIndex is a keyed hash of a lowercased email address, or "" without a key.
+func blindIndex(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if fieldIndexKey == nil || email == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, fieldIndexKey)
+	mac.Write([]byte(email))
+	return blindIndexPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+func textArg(v driver.Value) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case []byte:
+		return string(v), true
+	}
+	return "", false
+}
+
+func init() {
+	sqlite.MustRegisterScalarFunction("seal", 1, func(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		s, ok := textArg(args[0])
+		if !ok {
+			return args[0], nil
+		}
+		return sealField(s)
+	})
+	sqlite.MustRegisterDeterministicScalarFunction("unseal", 1, func(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		s, ok := textArg(args[0])
+		if !ok {
+			return args[0], nil
+		}
+		return openField(s)
+	})
+	// blind_index is NULL without a key, so "col = blind_index(?)" then matches nothing.
+	sqlite.MustRegisterDeterministicScalarFunction("blind_index", 1, func(_ *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		s, _ := textArg(args[0])
+		if idx := blindIndex(s); idx != "" {
+			return idx, nil
+		}
+		return nil, nil
+	})
+}
+
+// sealPlaintextFields encrypts rows written before the key was configured and refuses to
+// start without the key (or with a different one) once anything has been sealed.
+func sealPlaintextFields(ctx context.Context) error {
+	var sample string
+	err := db.QueryRowContext(ctx, `
+		SELECT email FROM users WHERE email LIKE 'enc1:%'
+		UNION ALL SELECT availability FROM event_participants WHERE availability LIKE 'enc1:%'
+		LIMIT 1
+	`).Scan(&sample)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == nil {
+		if _, err := openField(sample); err != nil {
+			return err
+		}
+	}
+	if fieldAEAD == nil {
+		return nil
+	}
+
+	stmts := []string{
+		`UPDATE OR IGNORE users SET email = seal(email), email_index = blind_index(email) WHERE email <> '' AND email NOT LIKE 'enc1:%'`,
+		// Plaintext addresses that differ only in case collide on the unique index; those
+		// are sealed without one, like the duplicates cleared in migration 62.
+		`UPDATE users SET email = seal(email) WHERE email <> '' AND email NOT LIKE 'enc1:%'`,
+		`UPDATE user_email_history SET
+			old_email = seal(old_email), old_email_index = blind_index(old_email),
+			new_email = seal(new_email), new_email_index = blind_index(new_email)
+		WHERE new_email NOT LIKE 'enc1:%'`,
+		`UPDATE OR IGNORE event_participants SET guest_email = blind_index(guest_email) WHERE guest_email <> '' AND guest_email NOT LIKE 'bi1:%'`,
+		`UPDATE event_participants SET availability = seal(availability), draft_availability = seal(draft_availability)
+		WHERE (availability <> '{}' AND availability NOT LIKE 'enc1:%') OR (draft_availability <> '{}' AND draft_availability NOT LIKE 'enc1:%')`,
+		`UPDATE availability_history SET availability = seal(availability) WHERE availability <> '{}' AND availability NOT LIKE 'enc1:%'`,
+		// Addresses that differ only in case collapse to one suppression entry.
+		`UPDATE OR IGNORE email_suppressions SET email = blind_index(email) WHERE email NOT LIKE 'bi1:%'`,
+		`DELETE FROM email_suppressions WHERE email NOT LIKE 'bi1:%'`,
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var sealed int64
+	for _, stmt := range stmts {
+		res, err := tx.ExecContext(ctx, stmt)
+		if err != nil {
+			return err
+		}
+		n, _ := res.RowsAffected()
+		sealed += n
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	res, err := archiveStore().ExecContext(ctx, `UPDATE availability_history_archive SET availability = seal(availability) WHERE availability <> '{}' AND availability NOT LIKE 'enc1:%'`)
+	if err != nil {
+		return err
+	}
+	n, _ := res.RowsAffected()
+	sealed += n
+	if sealed > 0 {
+		log.Printf("field encryption: sealed %d existing rows", sealed)
+	}
+	return nil
+}
+
+func migrate(ctx context.Context, d *sql.DB) error {
+	if _, err := d.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_versions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			version INTEGER NOT NULL,
+			applied_at TIMESTAMP NOT NULL
+		);
+	`); err != nil {
+		return err
+	}
+	var current int
+	if err := d.QueryRowContext(ctx, `SELECT COALESCE(MAX(version),0) FROM schema_versions`).Scan(&current); err != nil {
+		return err
+	}
+	if current >= schemaVersion {
+		return nil
+	}
+
+	tx, err := d.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	createStmts := []string{
+		`CREATE TABLE IF NOT EXISTS users (
+			id TEXT PRIMARY KEY,
+			username TEXT NOT NULL UNIQUE,
+			email TEXT NOT NULL UNIQUE,
+			email_index TEXT NULL,
+			email_verified INTEGER NOT NULL DEFAULT 0,
+			password_hash TEXT NOT NULL,
+			is_admin INTEGER NOT NULL DEFAULT 0,
+			locale TEXT NOT NULL DEFAULT '',
+			merged_into TEXT NULL,
+			deactivated_at TIMESTAMP NULL,
+			tenant_id TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS events (
+			id TEXT PRIMARY KEY,
+			creator_id TEXT NULL,
+			name TEXT NOT NULL,
+			date_from TEXT NOT NULL,
+			date_to TEXT NOT NULL,
+			duration REAL NOT NULL,
+			timezone TEXT NOT NULL,
+			disabled_slots TEXT NOT NULL DEFAULT '[]',
+			series_id TEXT NULL,
+			is_public INTEGER NOT NULL DEFAULT 0,
+			tags TEXT NOT NULL DEFAULT '[]',
+			passphrase_hash TEXT NULL,
+			finalized_slot TEXT NULL,
+			finalized_at TIMESTAMP NULL,
+			ics_sequence INTEGER NOT NULL DEFAULT 0,
+			holiday_region TEXT NOT NULL DEFAULT '',
+			quick_admin_hash TEXT NOT NULL DEFAULT '',
+			expires_at TIMESTAMP NULL,
+			tenant_id TEXT NOT NULL DEFAULT '',
+			archived_at TIMESTAMP NULL,
+			reminded_at TIMESTAMP NULL,
+			auto_finalize INTEGER NOT NULL DEFAULT 0,
+			response_deadline TIMESTAMP NULL,
+			guest_mode INTEGER NOT NULL DEFAULT 0,
+			booking_mode INTEGER NOT NULL DEFAULT 0,
+			recurrence TEXT NOT NULL DEFAULT '',
+			confirm_deadline TIMESTAMP NULL,
+			confirm_capacity INTEGER NOT NULL DEFAULT 0,
+			confirm_promote INTEGER NOT NULL DEFAULT 0,
+			confirm_closed_at TIMESTAMP NULL,
+			reminder_schedule TEXT NULL,
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL,
+			FOREIGN KEY (creator_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS event_participants (
+			id TEXT PRIMARY KEY,
+			event_id TEXT NOT NULL,
+			user_id TEXT NULL,
+			guest_name TEXT NOT NULL DEFAULT '',
+			guest_email TEXT NOT NULL DEFAULT '',
+			availability TEXT NOT NULL DEFAULT '{}',
+			draft_availability TEXT NOT NULL DEFAULT '{}',
+			draft_disabled_slots TEXT NOT NULL DEFAULT '[]',
+			draft_updated_at TIMESTAMP NULL,
+			unavailable_at TIMESTAMP NULL,
+			role TEXT NOT NULL DEFAULT 'participant',
+			reminders_muted INTEGER NOT NULL DEFAULT 0,
+			join_channel TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL,
+			UNIQUE(event_id, user_id),
+			FOREIGN KEY (event_id) REFERENCES events(id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS refresh_tokens (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			family_id TEXT NOT NULL,
+			version INTEGER NOT NULL,
+			token_hash TEXT NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			revoked INTEGER NOT NULL DEFAULT 0,
+			remember INTEGER NOT NULL DEFAULT 1,
+			user_agent TEXT NOT NULL DEFAULT '',
+			ip TEXT NOT NULL DEFAULT '',
+			location TEXT NOT NULL DEFAULT '',
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS login_attempts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id TEXT,
+			username TEXT,
+			ip TEXT,
+			created_at TIMESTAMP NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS email_tokens (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			token_hash TEXT NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			used INTEGER NOT NULL DEFAULT 0,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_users_username ON users(username);`,
+		`CREATE INDEX IF NOT EXISTS idx_users_email ON users(email);`,
+		`CREATE INDEX IF NOT EXISTS idx_events_creator ON events(creator_id);`,
+		`CREATE INDEX IF NOT EXISTS idx_participants_event ON event_participants(event_id);`,
+		`CREATE INDEX IF NOT EXISTS idx_login_attempts_user ON login_attempts(user_id);`,
+		`CREATE INDEX IF NOT EXISTS idx_email_tokens_user ON email_tokens(user_id);`,
+		`CREATE INDEX IF NOT EXISTS idx_email_tokens_kind_expires ON email_tokens(kind, expires_at);`,
+		`CREATE TABLE IF NOT EXISTS friend_requests (
+			id TEXT PRIMARY KEY,
+			sender_id TEXT NOT NULL,
+			receiver_id TEXT NOT NULL,
+			status TEXT NOT NULL DEFAULT 'pending',
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL,
+			UNIQUE(sender_id, receiver_id),
+			FOREIGN KEY (sender_id) REFERENCES users(id) ON DELETE CASCADE,
+			FOREIGN KEY (receiver_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS event_invites (
+			id TEXT PRIMARY KEY,
+			event_id TEXT NOT NULL,
+			inviter_id TEXT NOT NULL,
+			invitee_id TEXT NOT NULL,
+			status TEXT NOT NULL DEFAULT 'pending',
+			message TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL,
+			UNIQUE(event_id, invitee_id),
+			FOREIGN KEY (event_id) REFERENCES events(id) ON DELETE CASCADE,
+			FOREIGN KEY (inviter_id) REFERENCES users(id) ON DELETE CASCADE,
+			FOREIGN KEY (invitee_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_friend_requests_sender ON friend_requests(sender_id);`,
+		`CREATE INDEX IF NOT EXISTS idx_friend_requests_receiver ON friend_requests(receiver_id);`,
+		`CREATE INDEX IF NOT EXISTS idx_friend_requests_status ON friend_requests(status);`,
+		`CREATE INDEX IF NOT EXISTS idx_event_invites_event ON event_invites(event_id);`,
+		`CREATE INDEX IF NOT EXISTS idx_event_invites_invitee ON event_invites(invitee_id);`,
+		`CREATE INDEX IF NOT EXISTS idx_event_invites_status ON event_invites(status);`,
+		`CREATE TABLE IF NOT EXISTS event_seen (
+			event_id TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			first_seen_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (event_id, user_id),
+			FOREIGN KEY (event_id) REFERENCES events(id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS user_email_history (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			old_email TEXT NOT NULL DEFAULT '',
+			new_email TEXT NOT NULL,
+			old_email_index TEXT NULL,
+			new_email_index TEXT NULL,
+			ip TEXT,
+			changed_at TIMESTAMP NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_email_history_user ON user_email_history(user_id);`,
+		`CREATE INDEX IF NOT EXISTS idx_email_history_old ON user_email_history(old_email);`,
+		`CREATE INDEX IF NOT EXISTS idx_email_history_new ON user_email_history(new_email);`,
+		`CREATE TABLE IF NOT EXISTS recovery_codes (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			code_hash TEXT NOT NULL UNIQUE,
+			used_at TIMESTAMP NULL,
+			created_at TIMESTAMP NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_recovery_codes_user ON recovery_codes(user_id);`,
+		`CREATE TABLE IF NOT EXISTS lockout_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id TEXT NOT NULL,
+			username TEXT,
+			ip TEXT,
+			created_at TIMESTAMP NOT NULL
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_lockout_events_created ON lockout_events(created_at);`,
+		`CREATE TABLE IF NOT EXISTS ip_rules (
+			id TEXT PRIMARY KEY,
+			route_group TEXT NOT NULL,
+			action TEXT NOT NULL,
+			cidr TEXT NOT NULL,
+			note TEXT NOT NULL DEFAULT '',
+			created_by TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			UNIQUE (route_group, action, cidr)
+		);`,
+		`CREATE TABLE IF NOT EXISTS ip_bans (
+			ip TEXT PRIMARY KEY,
+			reason TEXT NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			created_at TIMESTAMP NOT NULL
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_login_attempts_ip ON login_attempts(ip, created_at);`,
+		`CREATE TABLE IF NOT EXISTS policy_documents (
+			kind TEXT NOT NULL,
+			version INTEGER NOT NULL,
+			title TEXT NOT NULL,
+			content TEXT NOT NULL,
+			published_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (kind, version)
+		);`,
+		`CREATE TABLE IF NOT EXISTS policy_acceptances (
+			user_id TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			version INTEGER NOT NULL,
+			ip TEXT,
+			accepted_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (user_id, kind, version),
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS email_suppressions (
+			email TEXT NOT NULL,
+			category TEXT NOT NULL,
+			source TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (email, category)
+		);`,
+		`CREATE TABLE IF NOT EXISTS user_preferences (
+			user_id TEXT PRIMARY KEY,
+			working_hours TEXT NOT NULL DEFAULT '{}',
+			calendar_url TEXT NOT NULL DEFAULT '',
+			updated_at TIMESTAMP NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS notification_preferences (
+			user_id TEXT PRIMARY KEY,
+			invite_emails INTEGER NOT NULL DEFAULT 1,
+			snoozed_until TIMESTAMP NULL,
+			reminder_leads TEXT NOT NULL DEFAULT '[24]',
+			updated_at TIMESTAMP NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS availability_history (
+			id TEXT PRIMARY KEY,
+			event_id TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			actor_id TEXT NOT NULL,
+			proxy INTEGER NOT NULL DEFAULT 0,
+			note TEXT NOT NULL DEFAULT '',
+			availability TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			FOREIGN KEY (event_id) REFERENCES events(id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_availability_history_event ON availability_history(event_id, created_at);`,
+		`CREATE INDEX IF NOT EXISTS idx_availability_history_user ON availability_history(user_id, created_at);`,
+		archiveTableStmt,
+		archiveEventIndexStmt,
+		archiveUserIndexStmt,
+		`CREATE TABLE IF NOT EXISTS event_kiosk_tokens (
+			id TEXT PRIMARY KEY,
+			event_id TEXT NOT NULL,
+			label TEXT NOT NULL DEFAULT '',
+			token_hash TEXT NOT NULL UNIQUE,
+			created_at TIMESTAMP NOT NULL,
+			last_used_at TIMESTAMP NULL,
+			revoked_at TIMESTAMP NULL,
+			FOREIGN KEY (event_id) REFERENCES events(id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_kiosk_tokens_event ON event_kiosk_tokens(event_id);`,
+		`CREATE TABLE IF NOT EXISTS caldav_tokens (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			label TEXT NOT NULL DEFAULT '',
+			token_hash TEXT NOT NULL UNIQUE,
+			created_at TIMESTAMP NOT NULL,
+			last_used_at TIMESTAMP NULL,
+			revoked_at TIMESTAMP NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_caldav_tokens_user ON caldav_tokens(user_id);`,
+		`CREATE TABLE IF NOT EXISTS event_aggregates (
+			event_id TEXT PRIMARY KEY,
+			built_at TIMESTAMP NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS event_slot_counts (
+			event_id TEXT NOT NULL,
+			slot_key TEXT NOT NULL,
+			n INTEGER NOT NULL,
+			PRIMARY KEY (event_id, slot_key)
+		);`,
+		`CREATE TABLE IF NOT EXISTS runtime_settings (
+			key TEXT PRIMARY KEY,
+			value TEXT NOT NULL,
+			updated_by TEXT NOT NULL DEFAULT '',
+			updated_at TIMESTAMP NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS tenants (
+			id TEXT PRIMARY KEY,
+			slug TEXT NOT NULL UNIQUE,
+			name TEXT NOT NULL,
+			max_users INTEGER NOT NULL DEFAULT 0,
+			max_events INTEGER NOT NULL DEFAULT 0,
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS branding (
+			tenant_id TEXT PRIMARY KEY,
+			product_name TEXT NOT NULL,
+			logo_url TEXT NOT NULL DEFAULT '',
+			accent_color TEXT NOT NULL DEFAULT '',
+			support_email TEXT NOT NULL DEFAULT '',
+			updated_at TIMESTAMP NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS announcements (
+			id TEXT PRIMARY KEY,
+			tenant_id TEXT NOT NULL DEFAULT '',
+			title TEXT NOT NULL,
+			message TEXT NOT NULL DEFAULT '',
+			severity TEXT NOT NULL DEFAULT 'info',
+			starts_at TIMESTAMP NOT NULL,
+			ends_at TIMESTAMP NULL,
+			created_by TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_announcements_window ON announcements(starts_at, ends_at);`,
+		`CREATE TABLE IF NOT EXISTS daily_stats (
+			day TEXT NOT NULL,
+			metric TEXT NOT NULL,
+			value INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (day, metric)
+		);`,
+		`CREATE TABLE IF NOT EXISTS email_delivery_stats (
+			day TEXT NOT NULL,
+			provider TEXT NOT NULL,
+			outcome TEXT NOT NULL,
+			value INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (day, provider, outcome)
+		);`,
+		`CREATE TABLE IF NOT EXISTS event_series (
+			id TEXT PRIMARY KEY,
+			creator_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			interval_days INTEGER NOT NULL DEFAULT 7,
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL,
+			FOREIGN KEY (creator_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS event_short_links (
+			code TEXT PRIMARY KEY COLLATE NOCASE,
+			event_id TEXT NOT NULL,
+			vanity INTEGER NOT NULL DEFAULT 0,
+			created_by TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			FOREIGN KEY (event_id) REFERENCES events(id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_short_links_event ON event_short_links(event_id);`,
+		`CREATE TABLE IF NOT EXISTS event_milestones (
+			event_id TEXT NOT NULL,
+			milestone TEXT NOT NULL,
+			responded INTEGER NOT NULL,
+			total INTEGER NOT NULL,
+			reached_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (event_id, milestone),
+			FOREIGN KEY (event_id) REFERENCES events(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS event_invite_links (
+			id TEXT PRIMARY KEY,
+			event_id TEXT NOT NULL,
+			created_by TEXT NOT NULL,
+			token_hash TEXT NOT NULL,
+			max_uses INTEGER NOT NULL DEFAULT 0,
+			uses INTEGER NOT NULL DEFAULT 0,
+			expires_at TIMESTAMP NOT NULL,
+			revoked_at TIMESTAMP NULL,
+			created_at TIMESTAMP NOT NULL,
+			FOREIGN KEY (event_id) REFERENCES events(id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_event_invite_links_event ON event_invite_links(event_id);`,
+		`CREATE TABLE IF NOT EXISTS event_watches (
+			event_id TEXT NOT NULL,
+			watcher_id TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			pending_since TIMESTAMP NULL,
+			created_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (event_id, watcher_id, user_id),
+			FOREIGN KEY (event_id) REFERENCES events(id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_event_watches_user ON event_watches(event_id, user_id);`,
+		`CREATE INDEX IF NOT EXISTS idx_event_watches_pending ON event_watches(pending_since) WHERE pending_since IS NOT NULL;`,
+		`CREATE TABLE IF NOT EXISTS push_devices (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			platform TEXT NOT NULL,
+			token TEXT NOT NULL UNIQUE,
+			created_at TIMESTAMP NOT NULL,
+			last_seen_at TIMESTAMP NOT NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_push_devices_user ON push_devices(user_id);`,
+		`CREATE TABLE IF NOT EXISTS data_exports (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			format TEXT NOT NULL,
+			status TEXT NOT NULL DEFAULT 'pending',
+			data BLOB NULL,
+			created_at TIMESTAMP NOT NULL,
+			started_at TIMESTAMP NULL,
+			finished_at TIMESTAMP NULL,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_data_exports_user ON data_exports(user_id);`,
+		`CREATE TABLE IF NOT EXISTS calendar_syncs (
+			id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			series_uid TEXT NOT NULL,
+			series_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			timezone TEXT NOT NULL,
+			lead_days INTEGER NOT NULL,
+			spread_days INTEGER NOT NULL,
+			tenant_id TEXT NOT NULL DEFAULT '',
+			last_occurrence TIMESTAMP NULL,
+			last_event_id TEXT NOT NULL DEFAULT '',
+			last_error TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL,
+			updated_at TIMESTAMP NOT NULL,
+			UNIQUE(user_id, series_uid),
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS email_notifications_sent (
+			user_id TEXT NOT NULL,
+			event_id TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			slot TEXT NOT NULL,
+			lead_hours INTEGER NOT NULL,
+			sent_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (user_id, event_id, kind, slot, lead_hours)
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_notifications_sent_at ON email_notifications_sent(sent_at);`,
+		`CREATE TABLE IF NOT EXISTS event_edit_locks (
+			event_id TEXT PRIMARY KEY,
+			user_id TEXT NOT NULL,
+			acquired_at TIMESTAMP NOT NULL,
+			expires_at TIMESTAMP NOT NULL
+		);`,
+		`CREATE TABLE IF NOT EXISTS event_shortlist (
+			event_id TEXT NOT NULL,
+			slot TEXT NOT NULL,
+			hold INTEGER NOT NULL DEFAULT 0,
+			created_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (event_id, slot),
+			FOREIGN KEY (event_id) REFERENCES events(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS event_attendance (
+			event_id TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			status TEXT NOT NULL,
+			recorded_by TEXT NOT NULL,
+			recorded_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (event_id, user_id),
+			FOREIGN KEY (event_id) REFERENCES events(id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE INDEX IF NOT EXISTS idx_attendance_user ON event_attendance(user_id);`,
+		`CREATE TABLE IF NOT EXISTS event_shifts (
+			event_id TEXT NOT NULL,
+			slot TEXT NOT NULL,
+			capacity INTEGER NOT NULL,
+			PRIMARY KEY (event_id, slot),
+			FOREIGN KEY (event_id) REFERENCES events(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS event_shift_claims (
+			event_id TEXT NOT NULL,
+			slot TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			claimed_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (event_id, slot, user_id),
+			FOREIGN KEY (event_id) REFERENCES events(id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS event_bookings (
+			event_id TEXT NOT NULL,
+			slot TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			booked_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (event_id, slot),
+			FOREIGN KEY (event_id) REFERENCES events(id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS event_confirmations (
+			event_id TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			status TEXT NOT NULL,
+			position INTEGER NOT NULL,
+			updated_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (event_id, user_id),
+			FOREIGN KEY (event_id) REFERENCES events(id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+		`CREATE TABLE IF NOT EXISTS event_booking_waitlist (
+			event_id TEXT NOT NULL,
+			slot TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			queued_at TIMESTAMP NOT NULL,
+			PRIMARY KEY (event_id, slot, user_id),
+			FOREIGN KEY (event_id) REFERENCES events(id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+		);`,
+	}
+	for _, s := range createStmts {
+		if _, err := tx.ExecContext(ctx, s); err != nil {
+			return err
+		}
+	}
+
+	// Only run ALTERs when upgrading an existing DB (<3 and >0).
+	if current < 3 && current > 0 {
+		alterStmts := []string{
+			`ALTER TABLE event_participants ADD COLUMN draft_availability TEXT NOT NULL DEFAULT '{}'`,
+			`ALTER TABLE event_participants ADD COLUMN draft_disabled_slots TEXT NOT NULL DEFAULT '[]'`,
+			`ALTER TABLE event_participants ADD COLUMN draft_updated_at TIMESTAMP NULL`,
+		}
+		for _, s := range alterStmts {
+			if _, err := tx.ExecContext(ctx, s); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Migration for version 4: add friend_requests and event_invites tables
+	if current < 4 {
+		// Tables are created via CREATE TABLE IF NOT EXISTS above, but we ensure indexes exist
+		// No ALTER statements needed as these are new tables
+	}
+
+	// Migration for version 5: add remember column to refresh_tokens
+	if current < 5 && current > 0 {
+		if _, err := tx.ExecContext(ctx, `ALTER TABLE refresh_tokens ADD COLUMN remember INTEGER NOT NULL DEFAULT 1`); err != nil {
+			return err
+		}
+	}
+
+	// Migration for version 6: event_seen table is created above, nothing to alter
+
+	// Migration for version 7: add series_id to events
+	if current < 7 && current > 0 {
+		if _, err := tx.ExecContext(ctx, `ALTER TABLE events ADD COLUMN series_id TEXT NULL`); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS idx_events_series ON events(series_id)`); err != nil {
+		return err
+	}
+
+	// Migration for version 8: public directory flag and tags on events
+	if current < 8 && current > 0 {
+		alterStmts := []string{
+			`ALTER TABLE events ADD COLUMN is_public INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE events ADD COLUMN tags TEXT NOT NULL DEFAULT '[]'`,
+		}
+		for _, s := range alterStmts {
+			if _, err := tx.ExecContext(ctx, s); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS idx_events_public ON events(is_public)`); err != nil {
+		return err
+	}
+
+	// Migration for version 9: optional event passphrase
+	if current < 9 && current > 0 {
+		if _, err := tx.ExecContext(ctx, `ALTER TABLE events ADD COLUMN passphrase_hash TEXT NULL`); err != nil {
+			return err
+		}
+	}
+
+	// Migration for version 10: admin flag; user_email_history is created above
+	if current < 10 && current > 0 {
+		if _, err := tx.ExecContext(ctx, `ALTER TABLE users ADD COLUMN is_admin INTEGER NOT NULL DEFAULT 0`); err != nil {
+			return err
+		}
+	}
+
+	// Migration for version 13: device and location metadata on refresh tokens (sessions)
+	if current < 13 && current > 0 {
+		alterStmts := []string{
+			`ALTER TABLE refresh_tokens ADD COLUMN user_agent TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE refresh_tokens ADD COLUMN ip TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE refresh_tokens ADD COLUMN location TEXT NOT NULL DEFAULT ''`,
+		}
+		for _, s := range alterStmts {
+			if _, err := tx.ExecContext(ctx, s); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family ON refresh_tokens(family_id)`); err != nil {
+		return err
+	}
+
+	// Migration for version 16: preferred locale for emails
+	if current < 16 && current > 0 {
+		if _, err := tx.ExecContext(ctx, `ALTER TABLE users ADD COLUMN locale TEXT NOT NULL DEFAULT ''`); err != nil {
+			return err
+		}
+	}
+
+	// Migration for version 17: finalized slot and calendar invite sequence
+	if current < 17 && current > 0 {
+		alterStmts := []string{
+			`ALTER TABLE events ADD COLUMN finalized_slot TEXT NULL`,
+			`ALTER TABLE events ADD COLUMN finalized_at TIMESTAMP NULL`,
+			`ALTER TABLE events ADD COLUMN ics_sequence INTEGER NOT NULL DEFAULT 0`,
+		}
+		for _, s := range alterStmts {
+			if _, err := tx.ExecContext(ctx, s); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Migration for version 19: public holiday region per event
+	if current < 19 && current > 0 {
+		if _, err := tx.ExecContext(ctx, `ALTER TABLE events ADD COLUMN holiday_region TEXT NOT NULL DEFAULT ''`); err != nil {
+			return err
+		}
+	}
+
+	// Migration for version 21: guest participants without an account. SQLite can't relax
+	// NOT NULL in place, so event_participants is rebuilt.
+	if current < 21 && current > 0 {
+		rebuildStmts := []string{
+			`CREATE TABLE event_participants_v21 (
+				id TEXT PRIMARY KEY,
+				event_id TEXT NOT NULL,
+				user_id TEXT NULL,
+				guest_name TEXT NOT NULL DEFAULT '',
+				guest_email TEXT NOT NULL DEFAULT '',
+				availability TEXT NOT NULL DEFAULT '{}',
+				draft_availability TEXT NOT NULL DEFAULT '{}',
+				draft_disabled_slots TEXT NOT NULL DEFAULT '[]',
+				draft_updated_at TIMESTAMP NULL,
+				created_at TIMESTAMP NOT NULL,
+				updated_at TIMESTAMP NOT NULL,
+				UNIQUE(event_id, user_id),
+				FOREIGN KEY (event_id) REFERENCES events(id) ON DELETE CASCADE,
+				FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+			)`,
+			`INSERT INTO event_participants_v21(id, event_id, user_id, availability, draft_availability, draft_disabled_slots, draft_updated_at, created_at, updated_at)
+				SELECT id, event_id, user_id, availability, draft_availability, draft_disabled_slots, draft_updated_at, created_at, updated_at FROM event_participants`,
+			`DROP TABLE event_participants`,
+			`ALTER TABLE event_participants_v21 RENAME TO event_participants`,
+			`CREATE INDEX IF NOT EXISTS idx_participants_event ON event_participants(event_id)`,
+		}
+		for _, s := range rebuildStmts {
+			if _, err := tx.ExecContext(ctx, s); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `CREATE UNIQUE INDEX IF NOT EXISTS idx_participants_guest_email ON event_participants(event_id, guest_email) WHERE guest_email <> ''`); err != nil {
+		return err
+	}
+
+	// Migration for version 23: quick polls have no creator account, so events is rebuilt
+	// with a nullable creator_id plus the admin token hash and expiry.
+	if current < 23 && current > 0 {
+		rebuildStmts := []string{
+			`CREATE TABLE events_v23 (
+				id TEXT PRIMARY KEY,
+				creator_id TEXT NULL,
+				name TEXT NOT NULL,
+				date_from TEXT NOT NULL,
+				date_to TEXT NOT NULL,
+				duration REAL NOT NULL,
+				timezone TEXT NOT NULL,
+				disabled_slots TEXT NOT NULL DEFAULT '[]',
+				series_id TEXT NULL,
+				is_public INTEGER NOT NULL DEFAULT 0,
+				tags TEXT NOT NULL DEFAULT '[]',
+				passphrase_hash TEXT NULL,
+				finalized_slot TEXT NULL,
+				finalized_at TIMESTAMP NULL,
+				ics_sequence INTEGER NOT NULL DEFAULT 0,
+				holiday_region TEXT NOT NULL DEFAULT '',
+				quick_admin_hash TEXT NOT NULL DEFAULT '',
+				expires_at TIMESTAMP NULL,
+				created_at TIMESTAMP NOT NULL,
+				updated_at TIMESTAMP NOT NULL,
+				FOREIGN KEY (creator_id) REFERENCES users(id) ON DELETE CASCADE
+			)`,
+			`INSERT INTO events_v23(id, creator_id, name, date_from, date_to, duration, timezone, disabled_slots, series_id, is_public, tags,
+				passphrase_hash, finalized_slot, finalized_at, ics_sequence, holiday_region, created_at, updated_at)
+				SELECT id, creator_id, name, date_from, date_to, duration, timezone, disabled_slots, series_id, is_public, tags,
+				passphrase_hash, finalized_slot, finalized_at, ics_sequence, holiday_region, created_at, updated_at FROM events`,
+			`DROP TABLE events`,
+			`ALTER TABLE events_v23 RENAME TO events`,
+			`CREATE INDEX IF NOT EXISTS idx_events_creator ON events(creator_id)`,
+			`CREATE INDEX IF NOT EXISTS idx_events_series ON events(series_id)`,
+			`CREATE INDEX IF NOT EXISTS idx_events_public ON events(is_public)`,
+		}
+		for _, s := range rebuildStmts {
+			if _, err := tx.ExecContext(ctx, s); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `CREATE INDEX IF NOT EXISTS idx_events_expires ON events(expires_at) WHERE expires_at IS NOT NULL`); err != nil {
+		return err
+	}
+
+	// Migration for version 24: merged accounts stay behind as tombstones
+	if current < 24 && current > 0 {
+		if _, err := tx.ExecContext(ctx, `ALTER TABLE users ADD COLUMN merged_into TEXT NULL`); err != nil {
+			return err
+		}
+	}
+
+	// Migration for version 25: frozen accounts
+	if current < 25 && current > 0 {
+		if _, err := tx.ExecContext(ctx, `ALTER TABLE users ADD COLUMN deactivated_at TIMESTAMP NULL`); err != nil {
+			return err
+		}
+	}
+
+	// Migration for version 27: tenants
+	if current < 27 && current > 0 {
+		alterStmts := []string{
+			`ALTER TABLE users ADD COLUMN tenant_id TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE events ADD COLUMN tenant_id TEXT NOT NULL DEFAULT ''`,
+		}
+		for _, s := range alterStmts {
+			if _, err := tx.ExecContext(ctx, s); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Migration for version 30: connected calendar feeds (user_preferences exists since 18)
+	if current < 30 && current >= 18 {
+		if _, err := tx.ExecContext(ctx, `ALTER TABLE user_preferences ADD COLUMN calendar_url TEXT NOT NULL DEFAULT ''`); err != nil {
+			return err
+		}
+	}
+
+	// Migration for version 32: history archival
+	if current < 32 && current > 0 {
+		if _, err := tx.ExecContext(ctx, `ALTER TABLE events ADD COLUMN archived_at TIMESTAMP NULL`); err != nil {
+			return err
+		}
+	}
+
+	// Migration for version 35: blind indexes for encrypted email columns (user_email_history exists since 10)
+	if current < 35 && current > 0 {
+		if _, err := tx.ExecContext(ctx, `ALTER TABLE users ADD COLUMN email_index TEXT NULL`); err != nil {
+			return err
+		}
+	}
+	if current < 35 && current >= 10 {
+		alterStmts := []string{
+			`ALTER TABLE user_email_history ADD COLUMN old_email_index TEXT NULL`,
+			`ALTER TABLE user_email_history ADD COLUMN new_email_index TEXT NULL`,
+		}
+		for _, s := range alterStmts {
+			if _, err := tx.ExecContext(ctx, s); err != nil {
+				return err
+			}
+		}
+	}
+	// Migration for version 36: event_short_links is created above, nothing to alter
+	// Migration for version 37: personal message on invites (event_invites exists since 4)
+	if current < 37 && current >= 4 {
+		if _, err := tx.ExecContext(ctx, `ALTER TABLE event_invites ADD COLUMN message TEXT NOT NULL DEFAULT ''`); err != nil {
+			return err
+		}
+	}
+	// Migration for version 38: reminder bookkeeping and "none of these work" answers
+	if current < 38 && current > 0 {
+		alterStmts := []string{
+			`ALTER TABLE events ADD COLUMN reminded_at TIMESTAMP NULL`,
+			`ALTER TABLE event_participants ADD COLUMN unavailable_at TIMESTAMP NULL`,
+		}
+		for _, s := range alterStmts {
+			if _, err := tx.ExecContext(ctx, s); err != nil {
+				return err
+			}
+		}
+	}
+	// Migration for version 39: event_milestones is created above, nothing to alter
+	// Migration for version 40: auto-finalize option and response deadline
+	if current < 40 && current > 0 {
+		alterStmts := []string{
+			`ALTER TABLE events ADD COLUMN auto_finalize INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE events ADD COLUMN response_deadline TIMESTAMP NULL`,
+		}
+		for _, s := range alterStmts {
+			if _, err := tx.ExecContext(ctx, s); err != nil {
+				return err
+			}
+		}
+	}
+	// Migration for version 41: event_shortlist is created above, nothing to alter
+	// Migration for version 42: event_attendance is created above, nothing to alter
+	// Migration for version 43: guest responses on regular events
+	if current < 43 && current > 0 {
+		if _, err := tx.ExecContext(ctx, `ALTER TABLE events ADD COLUMN guest_mode INTEGER NOT NULL DEFAULT 0`); err != nil {
+			return err
+		}
+	}
+	// Migration for version 44: event_shifts and event_shift_claims are created above, nothing to alter
+	// Migration for version 45: resource booking mode
+	if current < 45 && current > 0 {
+		if _, err := tx.ExecContext(ctx, `ALTER TABLE events ADD COLUMN booking_mode INTEGER NOT NULL DEFAULT 0`); err != nil {
+			return err
+		}
+	}
+	// Migration for version 46: confirmation phase after finalization
+	if current < 46 && current > 0 {
+		alterStmts := []string{
+			`ALTER TABLE events ADD COLUMN confirm_deadline TIMESTAMP NULL`,
+			`ALTER TABLE events ADD COLUMN confirm_capacity INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE events ADD COLUMN confirm_promote INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE events ADD COLUMN confirm_closed_at TIMESTAMP NULL`,
+		}
+		for _, s := range alterStmts {
+			if _, err := tx.ExecContext(ctx, s); err != nil {
+				return err
+			}
+		}
+	}
+	// Migration for version 47: notification_preferences is created above, nothing to alter
+	// Migration for version 48: ip_rules is created above, nothing to alter
+	// Migration for version 49: weekly polls
+	if current < 49 && current > 0 {
+		if _, err := tx.ExecContext(ctx, `ALTER TABLE events ADD COLUMN recurrence TEXT NOT NULL DEFAULT ''`); err != nil {
+			return err
+		}
+	}
+	// Migration for version 50: email_delivery_stats is created above, nothing to alter
+	// Migration for version 51: event_watches is created above, nothing to alter
+	// Migration for version 52: per-event roles, creators become owners
+	if current < 52 && current > 0 {
+		alterStmts := []string{
+			`ALTER TABLE event_participants ADD COLUMN role TEXT NOT NULL DEFAULT 'participant'`,
+			`UPDATE event_participants SET role = 'owner' WHERE user_id IS NOT NULL AND user_id = (SELECT creator_id FROM events WHERE events.id = event_participants.event_id)`,
+		}
+		for _, stmt := range alterStmts {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				return err
+			}
+		}
+	}
+	// Migration for version 53: event_invite_links is created above, nothing to alter
+	// Migration for version 54: notification snooze. Older databases get the table, column
+	// included, from the CREATE above.
+	if current < 54 && current >= 47 {
+		if _, err := tx.ExecContext(ctx, `ALTER TABLE notification_preferences ADD COLUMN snoozed_until TIMESTAMP NULL`); err != nil {
+			return err
+		}
+	}
+	// Migration for version 55: push_devices is created above, nothing to alter
+	// Migration for version 56: data_exports is created above, nothing to alter
+	// Migration for version 57: calendar_syncs is created above, nothing to alter
+	// Migration for version 58: reminder lead times; email_notifications_sent is created
+	// above. Databases from before version 47 get the column from the CREATE.
+	if current < 58 && current >= 47 {
+		if _, err := tx.ExecContext(ctx, `ALTER TABLE notification_preferences ADD COLUMN reminder_leads TEXT NOT NULL DEFAULT '[24]'`); err != nil {
+			return err
+		}
+	}
+	// Migration for version 59: event_edit_locks is created above, nothing to alter
+	// Migration for version 60: per-event reminder schedules and muting
+	if current < 60 && current > 0 {
+		alterStmts := []string{
+			`ALTER TABLE events ADD COLUMN reminder_schedule TEXT NULL`,
+			`ALTER TABLE event_participants ADD COLUMN reminders_muted INTEGER NOT NULL DEFAULT 0`,
+		}
+		for _, s := range alterStmts {
+			if _, err := tx.ExecContext(ctx, s); err != nil {
+				return err
+			}
+		}
+	}
+	// Migration for version 61: participant join channels
+	if current < 61 && current > 0 {
+		if _, err := tx.ExecContext(ctx, `ALTER TABLE event_participants ADD COLUMN join_channel TEXT NOT NULL DEFAULT ''`); err != nil {
+			return err
+		}
+	}
+	// Migration for version 62: email_index becomes unique, because sealed emails defeat
+	// the UNIQUE on users.email. Accounts that already share an address keep it sealed, but
+	// only the oldest keeps the index (and with it login and lookup by email).
+	if current < 62 && current > 0 {
+		res, err := tx.ExecContext(ctx, `
+			UPDATE users SET email_index = NULL WHERE email_index IS NOT NULL AND EXISTS (
+				SELECT 1 FROM users o WHERE o.email_index = users.email_index
+					AND (o.created_at < users.created_at OR (o.created_at = users.created_at AND o.id < users.id)))
+		`)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			log.Printf("migrate: %d accounts share an email with an older account; their email index was cleared", n)
+		}
+		if _, err := tx.ExecContext(ctx, `DROP INDEX IF EXISTS idx_users_email_index`); err != nil {
+			return err
+		}
+	}
+	// Migration for version 63: timezones stored before they were validated are repaired
+	// (see repairTimezone), so saving such an event no longer fails.
+	if current < 63 && current > 0 {
+		for _, table := range []string{"events", "calendar_syncs"} {
+			rows, err := tx.QueryContext(ctx, `SELECT DISTINCT timezone FROM `+table)
+			if err != nil {
+				return err
+			}
+			var zones []string
+			for rows.Next() {
+				var tz string
+				if err := rows.Scan(&tz); err != nil {
+					rows.Close()
+					return err
+				}
+				zones = append(zones, tz)
+			}
+			rows.Close()
+			for _, tz := range zones {
+				canonical := repairTimezone(tz)
+				if canonical == tz {
+					continue
+				}
+				res, err := tx.ExecContext(ctx, `UPDATE `+table+` SET timezone = ? WHERE timezone = ?`, canonical, tz)
+				if err != nil {
+					return err
+				}
+				n, _ := res.RowsAffected()
+				log.Printf("migrate: %d %s had timezone %q, now %q", n, table, tz, canonical)
+			}
+		}
+	}
+
+	for _, s := range []string{
+		`CREATE INDEX IF NOT EXISTS idx_users_tenant ON users(tenant_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_events_tenant ON events(tenant_id)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email_unique ON users(email_index) WHERE email_index IS NOT NULL`,
+		`CREATE INDEX IF NOT EXISTS idx_email_history_old_index ON user_email_history(old_email_index) WHERE old_email_index IS NOT NULL`,
+		`CREATE INDEX IF NOT EXISTS idx_email_history_new_index ON user_email_history(new_email_index) WHERE new_email_index IS NOT NULL`,
+	} {
+		if _, err := tx.ExecContext(ctx, s); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `INSERT INTO schema_versions(version, applied_at) VALUES (?,?)`, schemaVersion, time.Now().UTC()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+type visitor struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+var (
+	muVisitors sync.Mutex
+	visitors   = map[string]*visitor{}
+)
+
+func getVisitor(ip string, rps rate.Limit, burst int) *rate.Limiter {
+	muVisitors.Lock()
+	defer muVisitors.Unlock()
+	v, ok := visitors[ip]
+	if !ok {
+		lim := rate.NewLimiter(rps, burst)
+		visitors[ip] = &visitor{limiter: lim, lastSeen: time.Now()}
+		return lim
+	}
+	v.lastSeen = time.Now()
+	return v.limiter
+}
+
+func cleanupVisitorsLoop(ctx context.Context) error {
+	return runEvery(ctx, time.Minute, func(context.Context) {
+		muVisitors.Lock()
+		for ip, v := range visitors {
+			if time.Since(v.lastSeen) > 3*time.Minute {
+				delete(visitors, ip)
+			}
+		}
+		muVisitors.Unlock()
+	})
+}
+
+func cleanupLoginAttemptsLoop(ctx context.Context) error {
+	return runEvery(ctx, time.Hour, func(ctx context.Context) {
+		cutoff := time.Now().Add(-24 * time.Hour)
+		if _, err := db.ExecContext(ctx, `DELETE FROM login_attempts WHERE created_at < ?`, cutoff.UTC()); err != nil {
+			log.Printf("login_attempts cleanup error: %v", err)
+		}
+		if _, err := db.ExecContext(ctx, `DELETE FROM lockout_events WHERE created_at < ?`, time.Now().Add(-7*24*time.Hour).UTC()); err != nil {
+			log.Printf("lockout_events cleanup error: %v", err)
+		}
+		if _, err := db.ExecContext(ctx, `DELETE FROM ip_bans WHERE expires_at < ?`, time.Now().UTC()); err != nil {
+			log.Printf("ip_bans cleanup error: %v", err)
+		}
+	})
+}
+
+func cleanupUnverifiedUsersLoop(ctx context.Context) error {
+	return runEvery(ctx, time.Hour, func(ctx context.Context) {
+		cutoff := time.Now().Add(-verifyTTL)
+		if res, err := db.ExecContext(ctx, `DELETE FROM users WHERE email_verified = 0 AND created_at < ?`, cutoff.UTC()); err != nil {
+			log.Printf("cleanup unverified error: %v", err)
+		} else if rows, _ := res.RowsAffected(); rows > 0 {
+			log.Printf("cleanup unverified: deleted %d users", rows)
+		}
+	})
+}
+
+// cleanupExpiredEventsLoop removes quick polls past their expiry together with all their
+// rows, one transaction per poll.
+func cleanupExpiredEventsLoop(ctx context.Context) error {
+	return runEvery(ctx, time.Hour, func(ctx context.Context) {
+		rows, err := db.QueryContext(ctx, `SELECT id FROM events WHERE expires_at < ?`, time.Now().UTC())
+		if err != nil {
+			log.Printf("cleanup expired events error: %v", err)
+			return
+		}
+		var ids []string
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err == nil {
+				ids = append(ids, id)
+			}
+		}
+		rows.Close()
+		deleted := 0
+		for _, id := range ids {
+			tx, err := db.BeginTx(ctx, nil)
+			if err != nil {
+				log.Printf("cleanup expired events error: %v", err)
+				return
+			}
+			if err := deleteEventRows(ctx, tx, id); err != nil {
+				tx.Rollback()
+				log.Printf("cleanup expired events error: %v", err)
+				continue
+			}
+			if err := tx.Commit(); err != nil {
+				log.Printf("cleanup expired events error: %v", err)
+				continue
+			}
+			deleteArchivedEventHistory(ctx, id)
+			deleted++
+		}
+		if deleted > 0 {
+			log.Printf("cleanup expired events: deleted %d", deleted)
+		}
+	})
+}
+
+// rateLimit limits requests per client IP. RATE_LIMIT_SCALE multiplies every route's
+// rate and burst; 0 turns rate limiting off.
+func rateLimit(rps rate.Limit, burst int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scale := currentSettings().RateLimitScale
+		if scale <= 0 {
+			c.Next()
+			return
+		}
+		b := int(float64(burst)*scale + 0.5)
+		if b < 1 {
+			b = 1
+		}
+		ip := clientIP(c)
+		lim := getVisitor(ip, rps*rate.Limit(scale), b)
+		if !lim.Allow() {
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// Security response headers. The defaults suit an API that is never framed; deployments
+// can widen them through the environment:
+//
+//	CSP_CONNECT_SRC          extra sources for connect-src, e.g. "https://app.example.com wss://rt.example.com"
+//	CSP_FRAME_ANCESTORS      who may frame responses, e.g. "'self' https://blog.example.com" (default 'none')
+//	CONTENT_SECURITY_POLICY  the whole policy, replacing the generated one
+//	REFERRER_POLICY          default no-referrer
+//	HSTS_MAX_AGE             seconds for Strict-Transport-Security; 0 (default) sends none
+var securityHeaderValues = map[string]string{}
+
+var (
+	cspKeywords      = map[string]bool{"'self'": true, "'none'": true}
+	cspSchemeRe      = regexp.MustCompile(`^(https?|wss?):$`)
+	cspHostSourceRe  = regexp.MustCompile(`^((https?|wss?)://)?(\*\.)?[a-zA-Z0-9.-]+(:(\d+|\*))?$`)
+	referrerPolicies = map[string]bool{
+		"no-referrer": true, "no-referrer-when-downgrade": true, "origin": true, "origin-when-cross-origin": true,
+		"same-origin": true, "strict-origin": true, "strict-origin-when-cross-origin": true, "unsafe-url": true,
+	}
+)
+
+// parseCSPSources splits a space or comma separated source list and rejects anything that
+// is not a keyword, scheme or host source, so a value cannot inject further directives.
+func parseCSPSources(name, raw string) ([]string, error) {
+	var out []string
+	for _, src := range strings.FieldsFunc(raw, func(r rune) bool { return r == ' ' || r == ',' }) {
+		if !cspKeywords[src] && !cspSchemeRe.MatchString(src) && !cspHostSourceRe.MatchString(src) {
+			return nil, fmt.Errorf("%s: %q is not a CSP source (use 'self', 'none', a scheme like wss: or an origin)", name, src)
+		}
+		out = append(out, src)
+	}
+	return out, nil
+}
+
+func configureSecurityHeaders() error {
+	h := map[string]string{
+		"X-Content-Type-Options": "nosniff",
+		"X-XSS-Protection":       "1; mode=block",
+		"Referrer-Policy":        "no-referrer",
+	}
+	if v := strings.TrimSpace(os.Getenv("REFERRER_POLICY")); v != "" {
+		if !referrerPolicies[v] {
+			return fmt.Errorf("REFERRER_POLICY: unknown policy %q", v)
+		}
+		h["Referrer-Policy"] = v
+	}
+	if n := getEnvInt("HSTS_MAX_AGE", 0); n > 0 {
+		h["Strict-Transport-Security"] = fmt.Sprintf("max-age=%d; includeSubDomains", n)
+	}
+
+	ancestors, err := parseCSPSources("CSP_FRAME_ANCESTORS", os.Getenv("CSP_FRAME_ANCESTORS"))
+	if err != nil {
+		return err
+	}
+	connect, err := parseCSPSources("CSP_CONNECT_SRC", os.Getenv("CSP_CONNECT_SRC"))
+	if err != nil {
+		return err
+	}
+	// X-Frame-Options cannot express an allow list; browsers that understand
+	// frame-ancestors ignore it anyway, so it is only kept for the two fixed cases.
+	switch strings.Join(ancestors, " ") {
+	case "", "'none'":
+		ancestors = []string{"'none'"}
+		h["X-Frame-Options"] = "DENY"
+	case "'self'":
+		h["X-Frame-Options"] = "SAMEORIGIN"
+	}
+
+	if custom := strings.TrimSpace(os.Getenv("CONTENT_SECURITY_POLICY")); custom != "" {
+		if strings.ContainsAny(custom, "\r\n") {
+			return errors.New("CONTENT_SECURITY_POLICY must be a single line")
+		}
+		h["Content-Security-Policy"] = custom
+	} else {
+		csp := "default-src 'self'; frame-ancestors " + strings.Join(ancestors, " ") + "; form-action 'self';"
+		if len(connect) > 0 {
+			csp += " connect-src 'self' " + strings.Join(connect, " ") + ";"
+		}
+		h["Content-Security-Policy"] = csp
+	}
+	securityHeaderValues = h
+	return nil
+}
+
+func securityHeaders() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for k, v := range securityHeaderValues {
+			c.Header(k, v)
+		}
+		c.Next()
+	}
+}
+
+func clientIP(c *gin.Context) string {
+	ip := c.ClientIP()
+	if ip == "" {
+		ip = "unknown"
+	}
+	return ip
+}
+
+// logIfTimeout logs deadline errors and counts SQLite lock contention; other errors are
+// left to the caller.
+func logIfTimeout(err error, where string) {
+	countSQLiteContention(err)
+	if errors.Is(err, context.DeadlineExceeded) {
+		log.Printf("timeout: %s: %v", where, err)
+	}
+}
+
+// uniqueViolation reports whether err is a UNIQUE constraint failure on one of the
+// columns, given as "table.column".
+func uniqueViolation(err error, columns ...string) bool {
+	if err == nil {
+		return false
+	}
+	for _, col := range columns {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed: "+col) {
+			return true
+		}
+	}
+	return false
+}
+
+func serverError(c *gin.Context, where string, err error) {
+	if err != nil {
+		logIfTimeout(err, where)
+		log.Printf("%s error: %v", where, err)
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+}
+
+// parseDBTime parses timestamps returned as text, e.g. from MAX() where SQLite drops the column type.
+func parseDBTime(v string) (time.Time, bool) {
+	for _, layout := range []string{"2006-01-02 15:04:05.999999999-07:00", "2006-01-02 15:04:05.999999999 -0700 MST", time.RFC3339Nano, "2006-01-02 15:04:05"} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func getEnvInt(key string, def int) int {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	}
+	return def
+}
+
+func apiBaseURL() string {
+	if v := os.Getenv("NEXT_PUBLIC_API_BASE_URL"); v != "" {
+		return v
+	}
+	if v := os.Getenv("API_BASE_URL"); v != "" {
+		return v
+	}
+	return "http://localhost:8080"
+}
+
+func appBaseURL() string {
+	if v := os.Getenv("APP_BASE_URL"); v != "" {
+		return v
+	}
+	return "http://localhost:3000"
+}
+
+func recordLoginAttempt(ctx context.Context, userID, username, ip string) {
+	_, err := db.ExecContext(ctx, `INSERT INTO login_attempts(user_id, username, ip, created_at) VALUES (?,?,?,?)`,
+		userID, username, ip, time.Now().UTC())
+	if err != nil {
+		logIfTimeout(err, "recordLoginAttempt")
+		return
+	}
+	metricInc("plannie_login_failures_total")
+	shipSecurityEvent("auth_failure", userID, ip, map[string]interface{}{"username": username, "reason": "bad_credentials"})
+
+	if userID != "" {
+		var count int
+		_ = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM login_attempts WHERE user_id = ? AND created_at >= ?`,
+			userID, time.Now().Add(-lockoutWindow).UTC()).Scan(&count)
+		if count == lockoutThreshold {
+			metricInc("plannie_lockouts_total")
+			shipSecurityEvent("account_locked", userID, ip, map[string]interface{}{"username": username})
+			if _, err := db.ExecContext(ctx, `INSERT INTO lockout_events(user_id, username, ip, created_at) VALUES (?,?,?,?)`,
+				userID, username, ip, time.Now().UTC()); err != nil {
+				logIfTimeout(err, "recordLoginAttempt: lockout event")
+			}
+		}
+	}
+	maybeBanIP(ctx, ip)
+}
+
+// Temporary IP bans for addresses that keep failing logins. Disabled when IP_BAN_THRESHOLD is 0.
+var (
+	ipBansMu      sync.RWMutex
+	ipBans        = map[string]time.Time{}
+	ipBanDuration = time.Hour
+)
+
+func loadIPBans(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx, `SELECT ip, expires_at FROM ip_bans WHERE expires_at > ?`, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	ipBansMu.Lock()
+	defer ipBansMu.Unlock()
+	for rows.Next() {
+		var ip string
+		var expires time.Time
+		if err := rows.Scan(&ip, &expires); err == nil {
+			ipBans[ip] = expires
+		}
+	}
+	return rows.Err()
+}
+
+func ipBanned(ip string) bool {
+	ipBansMu.RLock()
+	defer ipBansMu.RUnlock()
+	exp, ok := ipBans[ip]
+	return ok && time.Now().Before(exp)
+}
+
+func maybeBanIP(ctx context.Context, ip string) {
+	threshold := currentSettings().IPBanThreshold
+	if threshold <= 0 || ip == "" || ip == "unknown" || ipBanned(ip) {
+		return
+	}
+	var count int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM login_attempts WHERE ip = ? AND created_at >= ?`,
+		ip, time.Now().Add(-lockoutWindow).UTC()).Scan(&count); err != nil || count < threshold {
+		return
+	}
+	now := time.Now().UTC()
+	expires := now.Add(ipBanDuration)
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO ip_bans(ip, reason, expires_at, created_at) VALUES (?,?,?,?)
+		ON CONFLICT(ip) DO UPDATE SET reason = excluded.reason, expires_at = excluded.expires_at, created_at = excluded.created_at
+	`, ip, fmt.Sprintf("%d failed logins in %s", count, lockoutWindow), expires, now); err != nil {
+		logIfTimeout(err, "maybeBanIP")
+		return
+	}
+	ipBansMu.Lock()
+	ipBans[ip] = expires
+	ipBansMu.Unlock()
+	metricInc("plannie_ip_bans_total")
+	shipSecurityEvent("ip_banned", "", ip, map[string]interface{}{"failedLogins": count, "expiresAt": expires})
+	log.Printf("security: banned ip %s until %s (%d failed logins)", ip, expires.Format(time.RFC3339), count)
+}
+
+// Versioned policy documents (terms, privacy). Users must have accepted the current version
+// of every published kind; the latest versions are cached here and refreshed on publish.
+var (
+	policyMu       sync.RWMutex
+	policyVersions = map[string]int{}
+	policyKindRe   = regexp.MustCompile(`^[a-z][a-z0-9_-]{0,31}$`)
+)
+
+func loadPolicyVersions(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx, `SELECT kind, MAX(version) FROM policy_documents GROUP BY kind`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	latest := map[string]int{}
+	for rows.Next() {
+		var kind string
+		var version int
+		if err := rows.Scan(&kind, &version); err != nil {
+			return err
+		}
+		latest[kind] = version
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	policyMu.Lock()
+	policyVersions = latest
+	policyMu.Unlock()
+	return nil
+}
+
+func currentPolicyVersions() map[string]int {
+	policyMu.RLock()
+	defer policyMu.RUnlock()
+	out := make(map[string]int, len(policyVersions))
+	for k, v := range policyVersions {
+		out[k] = v
+	}
+	return out
+}
+
+// missingPolicies returns the current policies the given acceptances don't cover.
+func missingPolicies(accepted map[string]int) map[string]int {
+	missing := map[string]int{}
+	for kind, version := range currentPolicyVersions() {
+		if accepted[kind] < version {
+			missing[kind] = version
+		}
+	}
+	return missing
+}
+
+func userAcceptedPolicies(ctx context.Context, userID string) (map[string]int, error) {
+	rows, err := db.QueryContext(ctx, `SELECT kind, MAX(version) FROM policy_acceptances WHERE user_id = ? GROUP BY kind`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	accepted := map[string]int{}
+	for rows.Next() {
+		var kind string
+		var version int
+		if err := rows.Scan(&kind, &version); err != nil {
+			return nil, err
+		}
+		accepted[kind] = version
+	}
+	return accepted, rows.Err()
+}
+
+// sqlExecer is satisfied by both *sql.DB and *sql.Tx.
+type sqlExecer interface {
+	ExecContext(context.Context, string, ...interface{}) (sql.Result, error)
+}
+
+func recordPolicyAcceptance(ctx context.Context, exec sqlExecer, userID string, policies map[string]int, ip string) error {
+	now := time.Now().UTC()
+	for kind, version := range policies {
+		if _, err := exec.ExecContext(ctx, `
+			INSERT OR IGNORE INTO policy_acceptances(user_id, kind, version, ip, accepted_at)
+			VALUES (?,?,?,?,?)
+		`, userID, kind, version, ip, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// policyExemptRoutes stay reachable while a user still has to accept updated policies.
+var policyExemptRoutes = map[string]bool{
+	"GET /users/me":             true,
+	"DELETE /users/me":          true,
+	"POST /users/me/deactivate": true,
+	"POST /policies/accept":     true,
+}
+
+// policyAcceptanceMiddleware must run after authnMiddleware. It answers 451 with the
+// outstanding policy versions until the user accepts them via POST /policies/accept.
+func policyAcceptanceMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(currentPolicyVersions()) == 0 || policyExemptRoutes[c.Request.Method+" "+c.FullPath()] {
+			c.Next()
+			return
+		}
+		accepted, err := userAcceptedPolicies(c.Request.Context(), ctxUserID(c))
+		if err != nil {
+			logIfTimeout(err, "policyAcceptance: load")
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+			return
+		}
+		if missing := missingPolicies(accepted); len(missing) > 0 {
+			c.AbortWithStatusJSON(http.StatusUnavailableForLegalReasons, gin.H{
+				"error":    "Updated policies must be accepted",
+				"code":     "policy_acceptance_required",
+				"policies": missing,
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// Restrictions for young accounts, disabled when newAccountWindow is 0. Within the window
+// an account can create at most newAccountMaxEvents events and send newAccountMaxInvites invites.
+var (
+	newAccountWindow     time.Duration
+	newAccountMaxEvents  = 1
+	newAccountMaxInvites = 5
+)
+
+// newAccountAllowance returns how many more of the given action ("events" or "invites") a
+// young account may perform, or -1 when it is not limited (past the window, or the
+// restriction is off).
+func newAccountAllowance(ctx context.Context, userID, action string) (int, error) {
+	if newAccountWindow <= 0 {
+		return -1, nil
+	}
+	var createdAt time.Time
+	if err := db.QueryRowContext(ctx, `SELECT created_at FROM users WHERE id = ?`, userID).Scan(&createdAt); err != nil {
+		return 0, err
+	}
+	if time.Since(createdAt) >= newAccountWindow {
+		return -1, nil
+	}
+	var count, limit int
+	switch action {
+	case "events":
+		limit = newAccountMaxEvents
+		err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM events WHERE creator_id = ?`, userID).Scan(&count)
+		if err != nil {
+			return 0, err
+		}
+	case "invites":
+		limit = newAccountMaxInvites
+		err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM event_invites WHERE inviter_id = ?`, userID).Scan(&count)
+		if err != nil {
+			return 0, err
+		}
+	default:
+		return -1, nil
+	}
+	return max(0, limit-count), nil
+}
+
+// newAccountLimitExceeded reports whether a young account has used up its allowance for
+// the given action ("events" or "invites"). Accounts past the window are never limited.
+func newAccountLimitExceeded(ctx context.Context, userID, action string) (bool, error) {
+	left, err := newAccountAllowance(ctx, userID, action)
+	if err != nil {
+		return false, err
+	}
+	if left == 0 {
+		metricInc("plannie_new_account_limited_total", "action", action)
+		return true, nil
+	}
+	return false, nil
+}
+
+// enforceNewAccountLimit writes the 403 response and returns false when the action is blocked.
+func enforceNewAccountLimit(c *gin.Context, ctx context.Context, userID, action string) bool {
+	limited, err := newAccountLimitExceeded(ctx, userID, action)
+	if err != nil {
+		serverError(c, "newAccountLimit: "+action, err)
+		return false
+	}
+	if limited {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error":    "New accounts are limited for a while. Please try again later.",
+			"code":     "account_too_new",
+			"minHours": int(newAccountWindow.Hours()),
+		})
+		return false
+	}
+	return true
+}
+
+func ipBanMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if ipBanned(clientIP(c)) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Too many failed attempts from this address. Try later."})
+			return
+		}
+		c.Next()
+	}
+}
+
+func isLockedOut(ctx context.Context, userID string) (bool, error) {
+	var count int
+	cutoff := time.Now().Add(-lockoutWindow)
+	err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM login_attempts
+		WHERE user_id = ? AND created_at >= ?
+	`, userID, cutoff.UTC()).Scan(&count)
+	if err != nil {
+		logIfTimeout(err, "isLockedOut")
+		return false, err
+	}
+	return count >= lockoutThreshold, nil
+}
+
+// buildCORS is the credentialed policy for the web app. Without CORS_ORIGINS only the
+// APP_BASE_URL origin is allowed; a wildcard is never combined with credentials.
+func buildCORS(origins string) cors.Config {
+	cfg := cors.DefaultConfig()
+	cfg.AllowOrigins = corsOriginList(origins)
+	cfg.AllowHeaders = []string{"Origin", "Content-Type", "Authorization", eventAccessHeader}
+	cfg.AllowMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+	cfg.AllowCredentials = true
+	cfg.MaxAge = corsMaxAge()
+	return cfg
+}
+
+// buildPublicCORS is the relaxed policy for read-only endpoints meant to be embedded on
+// other sites (free/busy feeds, QR codes, the public event list): any origin, no cookies.
+func buildPublicCORS() cors.Config {
+	cfg := cors.DefaultConfig()
+	cfg.AllowAllOrigins = true
+	cfg.AllowHeaders = []string{"Origin", eventAccessHeader}
+	cfg.AllowMethods = []string{"GET", "HEAD", "OPTIONS"}
+	cfg.MaxAge = corsMaxAge()
+	return cfg
+}
+
+func corsOriginList(origins string) []string {
+	var out []string
+	for _, o := range strings.Split(origins, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			out = append(out, o)
+		}
+	}
+	if len(out) == 0 {
+		origin := "http://localhost:3000"
+		if u, err := url.Parse(appBaseURL()); err == nil && u.Scheme != "" && u.Host != "" {
+			origin = u.Scheme + "://" + u.Host
+		}
+		out = append(out, origin)
+	}
+	return out
+}
+
+// corsMaxAge is CORS_MAX_AGE in seconds (default 10 minutes), how long browsers may cache
+// a preflight. Browsers cap it themselves (Chromium at 2 hours).
+func corsMaxAge() time.Duration {
+	n := getEnvInt("CORS_MAX_AGE", 600)
+	if n < 0 || n > 86400 {
+		n = 600
+	}
+	return time.Duration(n) * time.Second
+}
+
+func publicCORSPath(p string) bool {
+	switch p {
+	case "/public-events", "/branding", "/announcements":
+		return true
+	}
+	return strings.HasPrefix(p, "/events/") && (strings.HasSuffix(p, "/freebusy.ics") || strings.HasSuffix(p, "/qr.png"))
+}
+
+// geoLocate returns a coarse "City, CC" for an IP using the optional GEOIP_DB_PATH database.
+func geoLocate(ipStr string) string {
+	if geoReader == nil {
+		return ""
+	}
+	ip := net.ParseIP(ipStr)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() {
+		return ""
+	}
+	var rec struct {
+		City struct {
+			Names map[string]string `maxminddb:"names"`
+		} `maxminddb:"city"`
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	if err := geoReader.Lookup(ip, &rec); err != nil {
+		return ""
+	}
+	city := rec.City.Names["en"]
+	switch {
+	case city != "" && rec.Country.ISOCode != "":
+		return city + ", " + rec.Country.ISOCode
+	default:
+		return rec.Country.ISOCode
+	}
+}
+
+// describeUserAgent reduces a User-Agent header to "Browser on OS".
+func describeUserAgent(ua string) string {
+	browser := "Unknown browser"
+	switch {
+	case strings.Contains(ua, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(ua, "OPR/") || strings.Contains(ua, "Opera"):
+		browser = "Opera"
+	case strings.Contains(ua, "Firefox/"):
+		browser = "Firefox"
+	case strings.Contains(ua, "Chrome/") || strings.Contains(ua, "CriOS/"):
+		browser = "Chrome"
+	case strings.Contains(ua, "Safari/"):
+		browser = "Safari"
+	case strings.HasPrefix(ua, "curl/"):
+		browser = "curl"
+	}
+	os := ""
+	switch {
+	case strings.Contains(ua, "Windows"):
+		os = "Windows"
+	case strings.Contains(ua, "iPhone") || strings.Contains(ua, "iPad"):
+		os = "iOS"
+	case strings.Contains(ua, "Android"):
+		os = "Android"
+	case strings.Contains(ua, "Mac OS X") || strings.Contains(ua, "Macintosh"):
+		os = "macOS"
+	case strings.Contains(ua, "Linux"):
+		os = "Linux"
+	}
+	if os == "" {
+		return browser
+	}
+	return browser + " on " + os
+}
+
+func describeSession(ua, location string) string {
+	if location == "" {
+		return describeUserAgent(ua)
+	}
+	return describeUserAgent(ua) + ", " + location
+}
+
+func setRefreshCookie(c *gin.Context, token string, expiresAt time.Time, remember bool) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	maxAge := 0
+	if remember {
+		remaining := int(time.Until(expiresAt) / time.Second)
+		if remaining > 0 {
+			maxAge = remaining
+		}
+	}
+	c.SetCookie(refreshCookieName, token, maxAge, "/", "", cookieSecure, true)
+}
+
+func clearRefreshCookie(c *gin.Context) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(refreshCookieName, "", -1, "/", "", cookieSecure, true)
+}
+
+func authnMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		h := c.GetHeader("Authorization")
+		var token string
+		if strings.HasPrefix(h, "Bearer ") {
+			token = strings.TrimPrefix(h, "Bearer ")
+		} else {
+			token = c.Query("token")
+		}
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+		claims, err := parseAccessToken(token)
+		if err != nil || claims.TenantID != requestTenant(c) {
+			shipSecurityEvent("auth_failure", "", clientIP(c), map[string]interface{}{"reason": "invalid_token", "path": c.FullPath()})
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+		c.Set("userID", claims.UserID)
+		c.Next()
+	}
+}
+
+func ctxUserID(c *gin.Context) string {
+	if v, ok := c.Get("userID"); ok {
+		if s, ok := v.(string); ok {
+			return s
+		}
+	}
+	return ""
+}
+
+// adminMiddleware must run after authnMiddleware. Admins are flagged in users.is_admin
+// or bootstrapped through ADMIN_USER_IDS. Admins of the default tenant and bootstrapped
+// ones administer the whole instance; the others only their own tenant.
+func adminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := ctxUserID(c)
+		if _, ok := adminUserIDs[userID]; ok {
+			c.Set("adminGlobal", true)
+			c.Next()
+			return
+		}
+		var isAdmin bool
+		var tenantID string
+		if err := db.QueryRowContext(c.Request.Context(), `SELECT is_admin, tenant_id FROM users WHERE id = ?`, userID).Scan(&isAdmin, &tenantID); err != nil || !isAdmin {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+			return
+		}
+		c.Set("adminGlobal", tenantID == "")
+		c.Next()
+	}
+}
+
+// globalAdminOnly must run after adminMiddleware and keeps tenant admins out of
+// instance-wide routes.
+func globalAdminOnly() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !c.GetBool("adminGlobal") {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Instance admins only"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// adminUserInScope reports whether the calling admin may manage userID.
+func adminUserInScope(c *gin.Context, ctx context.Context, userID string) bool {
+	if c.GetBool("adminGlobal") {
+		return true
+	}
+	var tenantID string
+	if err := db.QueryRowContext(ctx, `SELECT tenant_id FROM users WHERE id = ?`, userID).Scan(&tenantID); err != nil {
+		return false
+	}
+	return tenantID == requestTenant(c)
+}
+
+// recordEmailChange appends to the email history used by support lookups.
+func recordEmailChange(ctx context.Context, tx *sql.Tx, userID, oldEmail, newEmail, ip string) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO user_email_history(id, user_id, old_email, old_email_index, new_email, new_email_index, ip, changed_at)
+		VALUES (?,?,seal(?),blind_index(?),seal(?),blind_index(?),?,?)
+	`, uuid.NewString(), userID, oldEmail, oldEmail, newEmail, newEmail, ip, time.Now().UTC())
+	return err
+}
+
+// optionalAuth extracts userID if bearer is present; otherwise returns empty.
+func optionalAuth(c *gin.Context) string {
+	h := c.GetHeader("Authorization")
+	if strings.HasPrefix(h, "Bearer ") {
+		tok := strings.TrimPrefix(h, "Bearer ")
+		if claims, err := parseAccessToken(tok); err == nil && claims.TenantID == requestTenant(c) {
+			return claims.UserID
+		}
+	}
+	return ""
+}
+
+func main() {
+	for _, key := range runtimeSettingKeys {
+		_, pinnedEnv[key] = os.LookupEnv(key)
+	}
+	_ = godotenv.Load()
+	if len(os.Args) > 1 && os.Args[1] == "doctor" {
+		os.Exit(runDoctor(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "fsck" {
+		os.Exit(runFsck(os.Args[2:]))
+	}
+	secret := os.Getenv("JWT_SECRET")
+	if secret == "" {
+		log.Fatal("JWT_SECRET not set")
+	}
+	jwtSecret = []byte(secret)
+
+	if cs := os.Getenv("COOKIE_SECURE"); strings.ToLower(cs) == "false" {
+		cookieSecure = false
+	}
+	if err := (&runtimeSettings{}).set("CORS_ORIGINS", os.Getenv("CORS_ORIGINS")); err != nil {
+		log.Fatalf("CORS_ORIGINS: %v", err)
+	}
+
+	if err := checkDatabaseDriver(); err != nil {
+		log.Fatal(err)
+	}
+	dbPath := os.Getenv("DATABASE_PATH")
+	if dbPath == "" {
+		dbPath = "app.db"
+	}
+
+	if rt := os.Getenv("REQUEST_TIMEOUT_MS"); rt != "" {
+		if ms, err := strconv.Atoi(rt); err == nil && ms > 0 {
+			reqTimeout = time.Duration(ms) * time.Millisecond
+		}
+	}
+
+	if err := configureEmail(); err != nil {
+		log.Fatal(err)
+	}
+	if err := configureFieldEncryption(); err != nil {
+		log.Fatal(err)
+	}
+	if err := configureLogShipping(); err != nil {
+		log.Fatal(err)
+	}
+	if err := configureRealtime(); err != nil {
+		log.Fatal(err)
+	}
+	if err := configureTrustedProxies(); err != nil {
+		log.Fatal(err)
+	}
+	if err := configureSecurityHeaders(); err != nil {
+		log.Fatal(err)
+	}
+	if err := configureCDN(); err != nil {
+		log.Fatal(err)
+	}
+	if err := configurePush(); err != nil {
+		log.Fatal(err)
+	}
+	if redisURL != nil {
+		log.Printf("realtime: REALTIME_BACKEND=redis, fanning out on channel %q via %s", redisChannel, redisURL.Host)
+	}
+	devEndpoints := os.Getenv("ENABLE_DEV_ENDPOINTS") == "true"
+	if emailProvider == "memory" {
+		log.Println("email: EMAIL_PROVIDER=memory, outgoing mail is captured and never delivered")
+	}
+	if v, ok := os.LookupEnv("HOLIDAY_API_URL"); ok {
+		holidayAPIURL = strings.TrimRight(v, "/")
+	}
+	if l := normalizeLocale(os.Getenv("DEFAULT_LOCALE")); l != "" {
+		defaultLocale = l
+	}
+	emailGlobalLimit = rate.NewLimiter(rate.Limit(float64(getEnvInt("EMAIL_GLOBAL_PER_MINUTE", 300))/60), getEnvInt("EMAIL_GLOBAL_BURST", 10))
+	emailUserQuota = getEnvInt("EMAIL_USER_PER_HOUR", 20)
+	resetCodeTTL = time.Duration(getEnvInt("RESET_CODE_TTL_MINUTES", 15)) * time.Minute
+
+	recaptchaProjectID = os.Getenv("RECAPTCHA_ENTERPRISE_PROJECT_ID")
+	recaptchaSiteKey = os.Getenv("RECAPTCHA_ENTERPRISE_SITE_KEY")
+	if v := os.Getenv("RECAPTCHA_ENTERPRISE_MIN_SCORE"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil && f >= 0 && f <= 1 {
+			recaptchaMinScore = f
+		}
+	}
+
+	for _, id := range strings.Split(os.Getenv("ADMIN_USER_IDS"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			adminUserIDs[id] = struct{}{}
+		}
+	}
+
+	setDisposableDomains(nil)
+	for _, d := range strings.Split(os.Getenv("REGISTRATION_EMAIL_DOMAINS"), ",") {
+		if d = strings.ToLower(strings.TrimSpace(d)); d != "" {
+			registrationDomains[d] = struct{}{}
+		}
+	}
+	disposableListURL = os.Getenv("DISPOSABLE_EMAIL_LIST_URL")
+	disposableRefresh = time.Duration(getEnvInt("DISPOSABLE_EMAIL_REFRESH_HOURS", 24)) * time.Hour
+
+	newAccountWindow = time.Duration(getEnvInt("NEW_ACCOUNT_HOURS", 0)) * time.Hour
+	newAccountMaxEvents = getEnvInt("NEW_ACCOUNT_MAX_EVENTS", 1)
+	newAccountMaxInvites = getEnvInt("NEW_ACCOUNT_MAX_INVITES", 5)
+	ipBanDuration = time.Duration(getEnvInt("IP_BAN_DURATION_MINUTES", 60)) * time.Minute
+	eventCacheSize = getEnvInt("EVENT_CACHE_SIZE", 1000)
+	eventCacheTTL = time.Duration(getEnvInt("EVENT_CACHE_TTL_SECONDS", 30)) * time.Second
+	if v := os.Getenv("MAINTENANCE_WINDOW"); v != "" {
+		maintenanceWindow = strings.ToLower(v)
+	}
+	if _, _, err := parseMaintenanceWindow(maintenanceWindow); err != nil && maintenanceWindow != "off" {
+		log.Fatalf("MAINTENANCE_WINDOW: %v", err)
+	}
+	shedReadLimit = getEnvInt("SHED_READ_CONCURRENCY", 256)
+	shedWriteLimit = getEnvInt("SHED_WRITE_CONCURRENCY", 16)
+	shedQueueTimeout = time.Duration(getEnvInt("SHED_QUEUE_TIMEOUT_MS", 500)) * time.Millisecond
+	tenantMode = strings.ToLower(os.Getenv("TENANT_MODE"))
+	tenantBaseDomain = strings.ToLower(strings.TrimPrefix(os.Getenv("TENANT_BASE_DOMAIN"), "."))
+	switch tenantMode {
+	case "", "path":
+	case "subdomain":
+		if tenantBaseDomain == "" {
+			log.Fatal("TENANT_MODE=subdomain needs TENANT_BASE_DOMAIN")
+		}
+	default:
+		log.Fatalf("unknown TENANT_MODE %q", tenantMode)
+	}
+
+	var err error
+	db, err = openDB(dbPath)
+	if err != nil {
+		log.Fatalf("open db: %v", err)
+	}
+	dbFilePath = dbPath
+	if dbPath == ":memory:" {
+		log.Println("database: DATABASE_PATH=:memory:, all data is lost when the process exits")
+	}
+
+	ctx := context.Background()
+	if err := migrate(ctx, db); err != nil {
+		log.Fatalf("migrate: %v", err)
+	}
+
+	if err := configureArchive(ctx); err != nil {
+		log.Fatalf("archive: %v", err)
+	}
+	if err := sealPlaintextFields(ctx); err != nil {
+		log.Fatalf("field encryption: %v", err)
+	}
+	if fieldAEAD != nil {
+		log.Println("field encryption: emails and availability are stored encrypted")
+	}
+	if err := reloadSettings(ctx); err != nil {
+		log.Fatalf("settings: %v", err)
+	}
+
+	if path := os.Getenv("GEOIP_DB_PATH"); path != "" {
+		geoReader, err = maxminddb.Open(path)
+		if err != nil {
+			log.Fatalf("open geoip db: %v", err)
+		}
+	}
+
+	if err := loadPolicyVersions(ctx); err != nil {
+		log.Fatalf("load policies: %v", err)
+	}
+	if err := loadIPBans(ctx); err != nil {
+		log.Fatalf("load ip bans: %v", err)
+	}
+	if err := loadIPRules(ctx); err != nil {
+		log.Fatalf("load ip rules: %v", err)
+	}
+
+	if recaptchaProjectID != "" && recaptchaSiteKey != "" {
+		recaptchaClient, err = recaptcha.NewClient(ctx)
+		if err != nil {
+			log.Fatalf("init recaptcha enterprise client: %v", err)
+		}
+	}
+
+	lc := newLifecycle()
+	lc.OnClose("database", db.Close)
+	if archiveDB != nil {
+		lc.OnClose("archive database", archiveDB.Close)
+	}
+	if geoReader != nil {
+		lc.OnClose("geoip", geoReader.Close)
+	}
+	if recaptchaClient != nil {
+		lc.OnClose("recaptcha", recaptchaClient.Close)
+	}
+
+	// pprof on :6060 (default mux). Endpoints: /debug/pprof/
+	pprofSrv := &http.Server{Addr: ":6060"}
+	lc.Go("pprof", func(ctx context.Context) error {
+		log.Println("pprof listening on :6060")
+		if err := pprofSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("pprof server error: %v", err)
+		}
+		return nil
+	})
+	lc.OnStop("pprof", pprofSrv.Shutdown)
+
+	lc.Go("cleanup visitors", cleanupVisitorsLoop)
+	lc.Go("cleanup login attempts", cleanupLoginAttemptsLoop)
+	lc.Go("cleanup unverified users", cleanupUnverifiedUsersLoop)
+	lc.Go("cleanup expired events", cleanupExpiredEventsLoop)
+	lc.Go("auto finalize", autoFinalizeLoop)
+	lc.Go("confirmation deadlines", confirmationDeadlineLoop)
+	lc.Go("watch notifications", watchNotifyLoop)
+	lc.Go("event reminders", eventReminderLoop)
+	lc.Go("data exports", dataExportLoop)
+	lc.Go("calendar sync", calendarSyncLoop)
+	lc.Go("daily stats", dailyStatsLoop)
+	if archiveAfter > 0 {
+		lc.Go("archive history", archiveHistoryLoop)
+	}
+	if disposableListURL != "" {
+		lc.Go("disposable domains", refreshDisposableDomainsLoop)
+	}
+	if dbPath != ":memory:" && maintenanceWindow != "off" {
+		lc.Go("maintenance", maintenanceLoop)
+	}
+
+	registerGauge("plannie_sse_subscribers", sseSubscriberCount)
+	registerGauge("plannie_email_queue_depth", emailQueueDepth)
+	registerGauge("plannie_email_last_sent_timestamp_seconds", emailLastSentSeconds)
+	registerGauge("plannie_log_ship_queue_depth", func() float64 { return float64(len(logShipQueue)) })
+	registerGauge("plannie_event_cache_entries", eventCacheLen)
+	registerSQLiteMetrics()
+
+	r := gin.Default()
+	if trustedProxies != nil {
+		if err := r.SetTrustedProxies(trustedProxies); err != nil {
+			log.Fatalf("trusted proxies: %v", err)
+		}
+	}
+	r.Use(securityHeaders())
+	r.Use(reloadableCORS())
+	r.Use(ipBanMiddleware())
+	r.Use(ipRulesMiddleware(ipRuleGroupGlobal))
+	r.Use(loadShedding())
+	mergeLimit := concurrencyLimit("merge", 2)
+	r.Use(eventTenantMiddleware())
+
+	r.GET("/healthz", func(c *gin.Context) {
+		if err := db.PingContext(c.Request.Context()); err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unhealthy"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+	r.GET("/metrics", ipRulesMiddleware(ipRuleGroupMetrics), metricsHandler)
+
+	for _, add := range extraRoutes {
+		add(r)
+	}
+	if devEndpoints && emailProvider == "memory" {
+		r.GET("/dev/emails", devEmailsHandler)
+		r.DELETE("/dev/emails", clearDevEmailsHandler)
+	}
+
+	r.POST("/register", rateLimit(10, 10), registerHandler)
+	r.POST("/login", rateLimit(10, 10), loginHandler)
+	r.POST("/refresh", rateLimit(10, 10), refreshHandler)
+	r.POST("/logout", rateLimit(10, 10), logoutHandler)
+
+	r.POST("/account/recover", rateLimit(5, 5), recoverAccountHandler)
+	r.POST("/account/recover/complete", rateLimit(5, 5), completeRecoveryHandler)
+
+	r.GET("/verify-email", rateLimit(10, 10), verifyEmailHandler)
+	r.GET("/users/merge/confirm", rateLimit(10, 10), confirmAccountMergePageHandler)
+	r.POST("/users/merge/confirm", rateLimit(10, 10), mergeLimit, confirmAccountMergeHandler)
+	r.GET("/reactivate", rateLimit(10, 10), reactivateAccountHandler)
+	r.GET("/unsubscribe", rateLimit(20, 20), unsubscribePageHandler)
+	r.POST("/unsubscribe", rateLimit(20, 20), unsubscribeHandler)
+	r.POST("/webhooks/email/:provider", rateLimit(50, 100), emailWebhookHandler)
+	r.POST("/forgot-password", rateLimit(5, 5), forgotPasswordHandler)
+	r.POST("/reset-password", rateLimit(5, 5), resetPasswordHandler)
+
+	r.GET("/policies", rateLimit(30, 30), listPoliciesHandler)
+	r.GET("/policies/:kind", rateLimit(30, 30), getPolicyHandler)
+
+	authProtected := authGroup{r.Group("/")}
+	authProtected.Use(authnMiddleware(), policyAcceptanceMiddleware())
+
+	authProtected.POST("/policies/accept", rateLimit(10, 10), acceptPoliciesHandler)
+
+	authProtected.GET("/users/me", rateLimit(30, 30), currentUserHandler)
+	authProtected.PUT("/users/me", rateLimit(30, 30), updateUserHandler)
+	authProtected.DELETE("/users/me", rateLimit(5, 5), deleteUserHandler)
+	authProtected.POST("/users/me/deactivate", rateLimit(5, 5), deactivateUserHandler)
+	authProtected.POST("/verify-email/resend", rateLimit(5, 5), resendVerifyEmailHandler)
+	authProtected.GET("/users/me/email-suppressions", rateLimit(30, 30), getEmailSuppressionsHandler)
+	authProtected.PUT("/users/me/email-suppressions", rateLimit(10, 10), updateEmailSuppressionsHandler)
+	authProtected.GET("/users/me/notification-preferences", rateLimit(30, 30), getNotificationPreferencesHandler)
+	authProtected.PUT("/users/me/notification-preferences", rateLimit(10, 10), updateNotificationPreferencesHandler)
+	authProtected.POST("/users/me/snooze", rateLimit(10, 10), snoozeNotificationsHandler)
+	authProtected.DELETE("/users/me/snooze", rateLimit(10, 10), snoozeNotificationsHandler)
+	authProtected.GET("/users/me/push-devices", rateLimit(30, 30), listPushDevicesHandler)
+	authProtected.POST("/users/me/push-devices", rateLimit(10, 10), registerPushDeviceHandler)
+	authProtected.DELETE("/users/me/push-devices/:deviceId", rateLimit(10, 10), deletePushDeviceHandler)
+	authProtected.GET("/users/me/export", rateLimit(3, 3), concurrencyLimit("data-export", 4), exportUserDataHandler)
+	authProtected.GET("/users/me/export/:exportId", rateLimit(30, 30), getDataExportHandler)
+	authProtected.GET("/users/me/working-hours", rateLimit(30, 30), getWorkingHoursHandler)
+	authProtected.GET("/users/me/availability-history", rateLimit(10, 10), concurrencyLimit("availability-history", 4), myAvailabilityHistoryHandler)
+	authProtected.PUT("/users/me/working-hours", rateLimit(10, 10), updateWorkingHoursHandler)
+	authProtected.GET("/users/me/calendar", rateLimit(30, 30), getCalendarHandler)
+	authProtected.PUT("/users/me/calendar", rateLimit(5, 5), connectCalendarHandler)
+	authProtected.DELETE("/users/me/calendar", rateLimit(10, 10), disconnectCalendarHandler)
+	authProtected.GET("/users/me/calendar/series", rateLimit(10, 10), calendarSeriesHandler)
+	authProtected.GET("/users/me/caldav-tokens", rateLimit(30, 30), listCalDAVTokensHandler)
+	authProtected.POST("/users/me/caldav-tokens", rateLimit(10, 10), createCalDAVTokenHandler)
+	authProtected.DELETE("/users/me/caldav-tokens/:tokenId", rateLimit(10, 10), revokeCalDAVTokenHandler)
+	authProtected.GET("/users/me/sessions", rateLimit(30, 30), listSessionsHandler)
+	authProtected.DELETE("/users/me/sessions/:id", rateLimit(10, 10), revokeSessionHandler)
+	authProtected.GET("/users/me/recovery-codes", rateLimit(10, 10), recoveryCodesStatusHandler)
+	authProtected.POST("/users/me/recovery-codes", rateLimit(5, 5), regenerateRecoveryCodesHandler)
+	authProtected.POST("/users/me/merge", rateLimit(5, 5), requestAccountMergeHandler)
+	authProtected.GET("/events/:id/stream", rateLimit(60, 60), sseHandler)
+	authProtected.POST("/events/:id/preview", previewSelectionHandler)
+
+	authProtected.POST("/events", rateLimit(20, 20), createEventHandler)
+	authProtected.POST("/events/preview", rateLimit(30, 30), previewEventHandler)
+	r.GET("/events/:id", rateLimit(60, 60), getEventHandler)
+	r.GET("/events/:id/kiosk", rateLimit(60, 60), kioskAuthMiddleware(), kioskEventHandler)
+
+	r.POST("/quick-events", rateLimit(5, 5), createQuickEventHandler)
+	r.PUT("/quick-events/:id", rateLimit(20, 20), quickAdminMiddleware(), updateQuickEventHandler)
+	r.DELETE("/quick-events/:id", rateLimit(5, 5), quickAdminMiddleware(), deleteQuickEventHandler)
+	r.POST("/quick-events/:id/responses", rateLimit(10, 10), quickRespondHandler)
+	r.PUT("/quick-events/:id/responses/:participantId", rateLimit(20, 20), quickUpdateResponseHandler)
+	r.DELETE("/quick-events/:id/responses/:participantId", rateLimit(10, 10), quickDeleteResponseHandler)
+	r.GET("/events/:id/kiosk/stream", rateLimit(30, 30), kioskAuthMiddleware(), sseHandler)
+	authProtected.PUT("/events/:id", rateLimit(30, 30), updateEventHandler)
+	authProtected.DELETE("/events/:id", rateLimit(20, 20), deleteEventHandler)
+
+	authProtected.POST("/events/:id/invite", rateLimit(10, 10), inviteHandler)
+	authProtected.POST("/events/:id/invite/accept", rateLimit(10, 10), acceptEventInviteHandler)
+	authProtected.POST("/events/:id/invite/decline", rateLimit(10, 10), declineEventInviteHandler)
+	authProtected.POST("/events/:id/join", rateLimit(20, 20), joinHandler)
+	authProtected.POST("/events/join-by-code", rateLimit(5, 5), joinByCodeHandler)
+	authProtected.GET("/events/sync-from-calendar", rateLimit(30, 30), listCalendarSyncsHandler)
+	authProtected.POST("/events/sync-from-calendar", rateLimit(5, 5), createCalendarSyncHandler)
+	authProtected.DELETE("/events/sync-from-calendar/:syncId", rateLimit(10, 10), deleteCalendarSyncHandler)
+	authProtected.POST("/events/:id/invite-link", rateLimit(10, 10), createInviteLinkHandler)
+	authProtected.GET("/events/:id/invite-links", rateLimit(30, 30), listInviteLinksHandler)
+	authProtected.DELETE("/events/:id/invite-links/:linkId", rateLimit(10, 10), revokeInviteLinkHandler)
+	authProtected.POST("/events/:id/leave", rateLimit(20, 20), leaveHandler)
+	authProtected.POST("/events/:id/seen", rateLimit(30, 30), markEventSeenHandler)
+	authProtected.GET("/events/:id/receipts", rateLimit(30, 30), eventReceiptsHandler)
+	authProtected.GET("/events/:id/stats", rateLimit(30, 30), eventStatsHandler)
+	authProtected.PUT("/events/:id/participants/:userId/availability", rateLimit(30, 30), proxyAvailabilityHandler)
+	authProtected.PUT("/events/:id/participants/:userId/role", rateLimit(10, 10), setParticipantRoleHandler)
+	authProtected.GET("/events/:id/watches", rateLimit(30, 30), listEventWatchesHandler)
+	authProtected.PUT("/events/:id/watches/:userId", rateLimit(30, 30), watchParticipantHandler)
+	authProtected.DELETE("/events/:id/watches/:userId", rateLimit(30, 30), watchParticipantHandler)
+	authProtected.POST("/events/:id/participants/import", rateLimit(5, 5), concurrencyLimit("participants-import", 2), importParticipantsHandler)
+	authProtected.GET("/events/:id/kiosk-tokens", rateLimit(30, 30), listKioskTokensHandler)
+	authProtected.POST("/events/:id/kiosk-tokens", rateLimit(10, 10), createKioskTokenHandler)
+	authProtected.DELETE("/events/:id/kiosk-tokens/:tokenId", rateLimit(10, 10), revokeKioskTokenHandler)
+	authProtected.GET("/events/:id/availability-changes", rateLimit(30, 30), availabilityChangesHandler)
+	authProtected.PATCH("/events/:id/availability", rateLimit(20, 20), patchAvailabilityHandler)
+	authProtected.POST("/events/:id/availability/undo", rateLimit(10, 10), undoAvailabilityHandler)
+	authProtected.GET("/events/:id/lock", rateLimit(30, 30), getEventLockHandler)
+	authProtected.POST("/events/:id/lock", rateLimit(30, 30), acquireEventLockHandler)
+	authProtected.DELETE("/events/:id/lock", rateLimit(30, 30), releaseEventLockHandler)
+	authProtected.GET("/events/:id/reminders", rateLimit(30, 30), getReminderScheduleHandler)
+	authProtected.PUT("/events/:id/reminders", rateLimit(5, 10), updateReminderScheduleHandler)
+	authProtected.DELETE("/events/:id/reminders", rateLimit(5, 10), updateReminderScheduleHandler)
+	authProtected.PUT("/events/:id/reminders/me", rateLimit(5, 10), muteRemindersHandler)
+	authProtected.GET("/events/:id/snapshot", rateLimit(10, 10), eventSnapshotAtHandler)
+	authProtected.POST("/events/:id/finalize", rateLimit(10, 10), finalizeEventHandler)
+	authProtected.DELETE("/events/:id/finalize", rateLimit(10, 10), unfinalizeEventHandler)
+	authProtected.POST("/events/:id/next", rateLimit(10, 10), createNextInstanceHandler)
+	authProtected.GET("/series/:id", rateLimit(30, 30), getSeriesHandler)
+	authProtected.GET("/events/:id/overlay", rateLimit(30, 30), overlayAvailabilityHandler)
+	r.GET("/events/:id/freebusy.ics", rateLimit(30, 30), freeBusyICSHandler)
+	r.GET("/events/:id/qr.png", rateLimit(30, 30), eventQRHandler)
+	authProtected.POST("/events/:id/signed-urls", rateLimit(10, 10), createSignedURLHandler)
+	authProtected.POST("/events/:id/short-links", rateLimit(10, 10), createShortLinkHandler)
+	authProtected.DELETE("/events/:id/short-links/:code", rateLimit(10, 10), deleteShortLinkHandler)
+	r.GET("/short-links/:code", rateLimit(30, 30), resolveShortLinkHandler)
+	r.GET("/e/:code", rateLimit(30, 30), shortLinkRedirectHandler)
+	authProtected.POST("/events/:id/remind", rateLimit(5, 5), remindHandler)
+	r.GET("/respond", rateLimit(20, 20), respondPageHandler)
+	authProtected.PUT("/events/:id/shortlist", rateLimit(10, 10), updateShortlistHandler)
+	r.POST("/events/:id/guest", rateLimit(10, 10), guestRespondHandler)
+	r.PUT("/events/:id/guest/:participantId", rateLimit(20, 20), guestUpdateResponseHandler)
+	authProtected.GET("/events/:id/shifts", rateLimit(30, 30), getShiftsHandler)
+	authProtected.PUT("/events/:id/shifts", rateLimit(10, 10), updateShiftsHandler)
+	authProtected.POST("/events/:id/shifts/:slot/claim", rateLimit(20, 20), claimShiftHandler)
+	authProtected.DELETE("/events/:id/shifts/:slot/claim", rateLimit(20, 20), releaseShiftHandler)
+	authProtected.GET("/events/:id/bookings", rateLimit(30, 30), getBookingsHandler)
+	authProtected.POST("/events/:id/bookings/:slot", rateLimit(20, 20), bookSlotHandler)
+	authProtected.DELETE("/events/:id/bookings/:slot", rateLimit(20, 20), cancelBookingHandler)
+	authProtected.GET("/events/:id/confirmation", rateLimit(30, 30), getConfirmationHandler)
+	authProtected.POST("/events/:id/confirmation", rateLimit(5, 5), startConfirmationHandler)
+	authProtected.POST("/events/:id/confirm", rateLimit(10, 10), confirmAttendanceHandler)
+	authProtected.GET("/events/:id/attendance", rateLimit(30, 30), getAttendanceHandler)
+	authProtected.PUT("/events/:id/attendance", rateLimit(10, 10), updateAttendanceHandler)
+	r.POST("/respond", rateLimit(20, 20), respondHandler)
+	r.GET("/.well-known/caldav", caldavWellKnownHandler)
+	r.Handle("PROPFIND", "/.well-known/caldav", caldavWellKnownHandler)
+	for _, m := range []string{"OPTIONS", "GET", "HEAD", "PROPFIND", "REPORT"} {
+		r.Handle(m, "/caldav/*path", rateLimit(60, 60), caldavAuthMiddleware(), caldavHandler)
+	}
+	r.GET("/events/:id/suggestions", rateLimit(30, 30), eventSuggestionsHandler)
+	r.GET("/events/:id/participants", rateLimit(60, 60), eventParticipantsHandler)
+	r.GET("/public-events", rateLimit(30, 30), publicEventsHandler)
+	r.GET("/branding", rateLimit(60, 60), getBrandingHandler)
+	r.GET("/announcements", rateLimit(60, 60), listAnnouncementsHandler)
+	r.POST("/events/:id/access", rateLimit(5, 5), eventAccessHandler)
+
+	authProtected.PUT("/events/:id/draft", rateLimit(30, 30), updateEventDraftHandler)
+	authProtected.DELETE("/events/:id/draft", rateLimit(30, 30), deleteEventDraftHandler)
+
+	authProtected.GET("/my-events", rateLimit(30, 30), myEventsHandler)
+	authProtected.GET("/events/invites", rateLimit(30, 30), getEventInvitesHandler)
+
+	admin := authProtected.Group("/admin")
+	admin.Use(ipRulesMiddleware(ipRuleGroupAdmin), adminMiddleware(), auditAdminActions())
+	admin.GET("/users/lookup", rateLimit(10, 10), adminLookupUserHandler)
+	admin.GET("/users/:id/email-history", rateLimit(10, 10), adminEmailHistoryHandler)
+	admin.POST("/users/:id/merge", rateLimit(10, 10), mergeLimit, adminMergeUserHandler)
+	admin.GET("/tenant", rateLimit(10, 10), adminCurrentTenantHandler)
+	admin.PUT("/branding", rateLimit(10, 10), adminUpdateBrandingHandler)
+	admin.DELETE("/branding", rateLimit(10, 10), adminResetBrandingHandler)
+	admin.GET("/announcements", rateLimit(10, 10), adminListAnnouncementsHandler)
+	admin.POST("/announcements", rateLimit(10, 10), adminSaveAnnouncementHandler)
+	admin.PUT("/announcements/:id", rateLimit(10, 10), adminSaveAnnouncementHandler)
+	admin.DELETE("/announcements/:id", rateLimit(10, 10), adminDeleteAnnouncementHandler)
+	admin.PUT("/tenant/admins/:userId", rateLimit(10, 10), globalAdminOnly(), adminSetTenantAdminHandler)
+	admin.DELETE("/tenant/admins/:userId", rateLimit(10, 10), globalAdminOnly(), adminSetTenantAdminHandler)
+	admin.GET("/security/attempts", rateLimit(10, 10), globalAdminOnly(), adminSecurityAttemptsHandler)
+	admin.DELETE("/security/bans/:ip", rateLimit(10, 10), globalAdminOnly(), adminLiftBanHandler)
+	admin.GET("/security/ip-rules", rateLimit(10, 10), globalAdminOnly(), adminListIPRulesHandler)
+	admin.POST("/security/ip-rules", rateLimit(10, 10), globalAdminOnly(), adminCreateIPRuleHandler)
+	admin.DELETE("/security/ip-rules/:id", rateLimit(10, 10), globalAdminOnly(), adminDeleteIPRuleHandler)
+	admin.POST("/policies", rateLimit(10, 10), globalAdminOnly(), adminPublishPolicyHandler)
+	admin.GET("/email/queue", rateLimit(10, 10), globalAdminOnly(), adminEmailQueueHandler)
+	admin.GET("/email/deliverability", rateLimit(10, 10), globalAdminOnly(), adminEmailDeliverabilityHandler)
+	admin.GET("/stats", rateLimit(10, 10), globalAdminOnly(), adminStatsHandler)
+	admin.GET("/settings", rateLimit(10, 10), globalAdminOnly(), adminSettingsHandler)
+	admin.PUT("/settings/:key", rateLimit(10, 10), globalAdminOnly(), adminSetSettingHandler)
+	admin.DELETE("/settings/:key", rateLimit(10, 10), globalAdminOnly(), adminSetSettingHandler)
+	admin.POST("/settings/reload", rateLimit(5, 5), globalAdminOnly(), adminReloadSettingsHandler)
+	admin.GET("/tenants", rateLimit(10, 10), globalAdminOnly(), adminListTenantsHandler)
+	admin.POST("/tenants", rateLimit(10, 10), globalAdminOnly(), adminCreateTenantHandler)
+	admin.PUT("/tenants/:id", rateLimit(10, 10), globalAdminOnly(), adminUpdateTenantHandler)
+
+	authProtected.POST("/friends/request", rateLimit(10, 10), sendFriendRequestHandler)
+	authProtected.GET("/friends", rateLimit(30, 30), getFriendsHandler)
+	authProtected.GET("/friends/requests", rateLimit(30, 30), getFriendRequestsHandler)
+	authProtected.POST("/friends/accept/:id", rateLimit(10, 10), acceptFriendRequestHandler)
+	authProtected.POST("/friends/decline/:id", rateLimit(10, 10), declineFriendRequestHandler)
+	authProtected.DELETE("/friends/:id", rateLimit(10, 10), removeFriendHandler)
+
+	r.GET("/openapi.json", rateLimit(30, 30), openAPIHandler)
+	if os.Getenv("OPENAPI_DOCS_UI") == "true" {
+		r.GET("/docs", rateLimit(30, 30), swaggerUIHandler)
+	}
+	// Built last so the document lists every route registered above.
+	if err := buildOpenAPIDocument(r.Routes()); err != nil {
+		log.Fatalf("openapi: %v", err)
+	}
+
+	if logShipQueue != nil {
+		lc.Go("log shipping", logShipLoop)
+	}
+	if realtimeOut != nil {
+		lc.Go("realtime", realtimeLoop)
+	}
+	if cdnPurgeURL != "" {
+		lc.Go("cdn purge", cdnPurgeLoop)
+	}
+	if pushEnabled() {
+		lc.Go("push", pushLoop)
+	}
+	lc.Go("email queue", func(ctx context.Context) error {
+		emailQueueLoop(ctx)
+		if n := emailQueueDepth(); n > 0 {
+			log.Printf("email: %d queued messages not sent", int(n))
+		}
+		return nil
+	})
+
+	srv := &http.Server{
+		Addr:    ":8080",
+		Handler: tenantHandler(r),
+		BaseContext: func(l net.Listener) context.Context {
+			return context.Background()
+		},
+	}
+
+	lc.Go("http", func(ctx context.Context) error {
+		log.Println("Server running on :8080")
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return fmt.Errorf("listen: %w", err)
+		}
+		return nil
+	})
+	srv.RegisterOnShutdown(sseCloseAll)
+	lc.OnStop("http", srv.Shutdown)
+
+	lc.Go("settings reload", func(ctx context.Context) error {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-hup:
+				if err := reloadSettings(ctx); err != nil {
+					log.Printf("settings: reload on SIGHUP: %v", err)
+				}
+			}
+		}
+	})
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case <-quit:
+	case <-lc.Failed():
+	}
+	log.Println("Shutting down...")
+	if err := lc.Shutdown(time.Duration(getEnvInt("SHUTDOWN_TIMEOUT_SECONDS", 15)) * time.Second); err != nil {
+		log.Printf("shutdown: %v", err)
+		os.Exit(1)
+	}
+}
+
+func registerHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	var input registerRequest
+	if err := c.BindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	if currentSettings().RegistrationHoneypot && input.Website != "" {
+		// Bots fill every field; answer like a success so they don't adapt.
+		metricInc("plannie_registration_rejections_total", "reason", "honeypot")
+		c.JSON(http.StatusCreated, gin.H{"id": uuid.NewString(), "username": input.Username})
+		return
+	}
+	if !validateUsername(input.Username) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid username"})
+		return
+	}
+	if !validateEmail(input.Email) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email"})
+		return
+	}
+	if !validatePassword(input.Password) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Weak password (>=8 chars with number and special)"})
+		return
+	}
+	if missing := missingPolicies(input.AcceptedPolicies); len(missing) > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Current policies must be accepted", "code": "policy_acceptance_required", "policies": missing})
+		return
+	}
+	if !emailDomainAllowed(input.Email) {
+		metricInc("plannie_registration_rejections_total", "reason", "domain_not_allowed")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Email domain not allowed", "code": "email_domain_not_allowed"})
+		return
+	}
+	domain := emailDomain(input.Email)
+	if isDisposableDomain(domain) {
+		metricInc("plannie_registration_rejections_total", "reason", "disposable")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Disposable email addresses are not allowed"})
+		return
+	}
+	if currentSettings().EmailMXCheck && !domainAcceptsMail(ctx, domain) {
+		metricInc("plannie_registration_rejections_total", "reason", "mx")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Email domain cannot receive mail"})
+		return
+	}
+
+	if recaptchaClient != nil {
+		if err := verifyRecaptchaEnterprise(ctx, input.RecaptchaToken, recaptchaActionRegister, clientIP(c)); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Recaptcha failed"})
+			return
+		}
+	}
+
+	var exists int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM users WHERE username = ? OR email = ? OR email_index = blind_index(?)`, input.Username, input.Email, input.Email).Scan(&exists); err != nil {
+		serverError(c, "register: count user", err)
+		return
+	}
+	if exists > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Username or email already taken"})
+		return
+	}
+	if !enforceTenantQuota(c, ctx, "users") {
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(input.Password), 12)
+	if err != nil {
+		serverError(c, "register: hash", err)
+		return
+	}
+	now := time.Now().UTC()
+	id := uuid.NewString()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		serverError(c, "register: begin tx", err)
+		return
+	}
+	defer tx.Rollback()
+	locale := normalizeLocale(input.Locale)
+	if locale == "" {
+		locale = normalizeLocale(c.GetHeader("Accept-Language"))
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO users(id, username, email, email_index, email_verified, password_hash, locale, tenant_id, created_at, updated_at) VALUES (?,?,seal(?),blind_index(?),?,?,?,?,?,?)`,
+		id, input.Username, input.Email, input.Email, 0, string(hash), locale, requestTenant(c), now, now); err != nil {
+		// The count above doesn't hold a lock; a concurrent registration lands here.
+		if uniqueViolation(err, "users.username", "users.email") {
+			c.JSON(http.StatusConflict, gin.H{"error": "Username or email already taken"})
+			return
+		}
+		serverError(c, "register: insert user", err)
+		return
+	}
+	if err := recordEmailChange(ctx, tx, id, "", input.Email, clientIP(c)); err != nil {
+		serverError(c, "register: email history", err)
+		return
+	}
+	if err := recordPolicyAcceptance(ctx, tx, id, currentPolicyVersions(), clientIP(c)); err != nil {
+		serverError(c, "register: policy acceptance", err)
+		return
+	}
+	recoveryCodes, err := replaceRecoveryCodes(ctx, tx, id)
+	if err != nil {
+		serverError(c, "register: recovery codes", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		serverError(c, "register: commit", err)
+		return
+	}
+	statInc("signups")
+
+	raw, tokenID, err := createEmailToken(id, "verify", verifyTTL)
+	if err == nil {
+		apiURL := apiBaseURL()
+		verifyURL := fmt.Sprintf("%s/verify-email?tid=%s&t=%s", apiURL, tokenID, raw)
+		subject, html := localizedEmail(resolveLocale(locale), "verify", input.Username, verifyURL)
+		go func() {
+			if err := sendEmail(id, input.Email, subject, html); err != nil {
+				log.Printf("sendEmail verify: %v", err)
+			}
+		}()
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"id": id, "username": input.Username, "recoveryCodes": recoveryCodes})
+}
+
+func loginHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	var input loginRequest
+	if err := c.BindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	if input.Username == "" || input.Password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing fields"})
+		return
+	}
+
+	var u struct {
+		ID            string
+		Username      string
+		Email         string
+		PasswordHash  string
+		EmailVerified bool
+		Locale        string
+		MergedInto    sql.NullString
+		DeactivatedAt sql.NullTime
+		CreatedAt     time.Time
+	}
+	err := db.QueryRowContext(ctx, `SELECT id, username, unseal(email), password_hash, email_verified, locale, merged_into, deactivated_at, created_at FROM users WHERE username = ? AND tenant_id = ?`, input.Username, requestTenant(c)).
+		Scan(&u.ID, &u.Username, &u.Email, &u.PasswordHash, &u.EmailVerified, &u.Locale, &u.MergedInto, &u.DeactivatedAt, &u.CreatedAt)
+	if err == sql.ErrNoRows {
+		recordLoginAttempt(ctx, "", input.Username, clientIP(c))
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		return
+	} else if err != nil {
+		serverError(c, "login: select user", err)
+		return
+	}
+
+	locked, err := isLockedOut(ctx, u.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	if locked {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Account locked. Try later."})
+		return
+	}
+
+	if !u.EmailVerified {
+		if time.Since(u.CreatedAt) > verifyTTL {
+			_, _ = db.ExecContext(ctx, `DELETE FROM users WHERE id = ?`, u.ID)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Email verification expired. Please register again."})
+			return
+		}
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(input.Password)); err != nil {
+		recordLoginAttempt(ctx, u.ID, input.Username, clientIP(c))
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		return
+	}
+	if u.MergedInto.Valid {
+		c.JSON(http.StatusForbidden, gin.H{"error": "This account was merged into another account. Sign in with that one instead.", "code": "account_merged"})
+		return
+	}
+	if u.DeactivatedAt.Valid {
+		if err := sendReactivationEmail(ctx, u.ID, u.Username, u.Email, u.Locale); err != nil {
+			logIfTimeout(err, "login: reactivation email")
+		}
+		c.JSON(http.StatusForbidden, gin.H{"error": "This account is deactivated. We sent a reactivation link to your email.", "code": "account_deactivated"})
+		return
+	}
+
+	access, err := signAccessToken(u.ID, requestTenant(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	family := uuid.NewString()
+	version := 1
+	now := time.Now().UTC()
+	refreshExpires := now.Add(refreshTTL)
+	remember := input.RememberMe
+	if !remember {
+		refreshExpires = now.Add(refreshTTLShort)
+	}
+
+	refresh, rtID, err := signRefreshToken(u.ID, family, version, refreshExpires)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	rtHash, err := hashToken(refresh)
+	if err != nil {
+		serverError(c, "login: hash refresh", err)
+		return
+	}
+
+	ua := c.Request.UserAgent()
+	ip := clientIP(c)
+	location := geoLocate(ip)
+	newDevice := isNewDevice(ctx, u.ID, ua, location)
+
+	if _, err := db.ExecContext(ctx, `INSERT INTO refresh_tokens(id, user_id, family_id, version, token_hash, expires_at, created_at, revoked, remember, user_agent, ip, location)
+		VALUES (?,?,?,?,?,?,?,0,?,?,?,?)`,
+		rtID, u.ID, family, version, string(rtHash), refreshExpires, now, remember, ua, ip, location); err != nil {
+		serverError(c, "login: insert refresh", err)
+		return
+	}
+
+	if newDevice && u.EmailVerified {
+		subject, body := localizedEmail(resolveLocale(u.Locale), "new_device", u.Username, html.EscapeString(describeSession(ua, location)), formatLocalTime(now, u.Locale))
+		go func() {
+			if err := sendEmail(u.ID, u.Email, subject, body); err != nil {
+				log.Printf("sendEmail new-device: %v", err)
+			}
+		}()
+	}
+
+	setRefreshCookie(c, refresh, refreshExpires, remember)
+
+	c.JSON(http.StatusOK, gin.H{
+		"token":               access,
+		"refresh_token":       refresh,
+		"username":            u.Username,
+		"email_verified":      u.EmailVerified,
+		"verificationExpires": u.CreatedAt.Add(verifyTTL),
+	})
+}
+
+func refreshHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	var input refreshRequest
+	_ = c.BindJSON(&input)
+	if input.RefreshToken == "" {
+		if cookie, err := c.Cookie(refreshCookieName); err == nil {
+			input.RefreshToken = cookie
+		}
+	}
+	if input.RefreshToken == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing refresh token"})
+		return
+	}
+
+	parsed, err := jwt.ParseWithClaims(input.RefreshToken, &jwt.RegisteredClaims{}, func(t *jwt.Token) (interface{}, error) {
+		return jwtSecret, nil
+	})
+	if err != nil || !parsed.Valid {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		return
+	}
+	claims, _ := parsed.Claims.(*jwt.RegisteredClaims)
+	if claims == nil || claims.ID == "" || claims.Subject == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		return
+	}
+
+	userID := claims.Subject
+	rtID := claims.ID
+	parts := strings.Split(rtID, ":")
+	if len(parts) != 2 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		return
+	}
+	family := parts[0]
+	version, _ := strconv.Atoi(parts[1])
+
+	var stored RefreshToken
+	err = db.QueryRowContext(ctx, `SELECT id, user_id, family_id, version, token_hash, expires_at, revoked, remember FROM refresh_tokens WHERE id = ?`, rtID).
+		Scan(&stored.ID, &stored.UserID, &stored.FamilyID, &stored.Version, &stored.TokenHash, &stored.ExpiresAt, &stored.Revoked, &stored.Remember)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		return
+	} else if err != nil {
+		serverError(c, "refresh: select token", err)
+		return
+	}
+	if stored.Revoked || time.Now().After(stored.ExpiresAt) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Expired or revoked"})
+		return
+	}
+	if stored.UserID != userID || stored.FamilyID != family || stored.Version != version {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		return
+	}
+	if err := verifyTokenHash(stored.TokenHash, input.RefreshToken); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		return
+	}
+	var userTenant string
+	if err := db.QueryRowContext(ctx, `SELECT tenant_id FROM users WHERE id = ?`, userID).Scan(&userTenant); err != nil || userTenant != requestTenant(c) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		return
+	}
+
+	expires := stored.ExpiresAt
+	newVersion := version + 1
+	newRefresh, newRtID, err := signRefreshToken(userID, family, newVersion, expires)
+	if err != nil {
+		serverError(c, "refresh: sign new refresh", err)
+		return
+	}
+	newHash, err := hashToken(newRefresh)
+	if err != nil {
+		serverError(c, "refresh: hash new refresh", err)
+		return
+	}
+	now := time.Now().UTC()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		serverError(c, "refresh: begin tx", err)
+		return
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE refresh_tokens SET revoked = 1 WHERE id = ?`, rtID); err != nil {
+		tx.Rollback()
+		serverError(c, "refresh: revoke old token", err)
+		return
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO refresh_tokens(id, user_id, family_id, version, token_hash, expires_at, created_at, revoked, remember, user_agent, ip, location)
+		VALUES (?,?,?,?,?,?,?,0,?,?,?,?)
+	`, newRtID, userID, family, newVersion, string(newHash), expires, now, stored.Remember, c.Request.UserAgent(), clientIP(c), geoLocate(clientIP(c))); err != nil {
+		tx.Rollback()
+		if strings.Contains(err.Error(), "UNIQUE constraint failed: refresh_tokens.id") {
+			log.Printf("refresh: concurrent rotation detected for old=%s new=%s", rtID, newRtID)
+		}
+		serverError(c, "refresh: insert new token", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		serverError(c, "refresh: commit tx", err)
+		return
+	}
+
+	access, err := signAccessToken(userID, requestTenant(c))
+	if err != nil {
+		serverError(c, "refresh: sign access", err)
+		return
+	}
+
+	// Fetch username for the response so frontend can restore session state
+	var username string
+	if err := db.QueryRowContext(ctx, `SELECT username FROM users WHERE id = ?`, userID).Scan(&username); err != nil {
+		log.Printf("refresh: failed to fetch username for user %s: %v", userID, err)
+		// Continue without username - not a critical error
+	}
+
 	setRefreshCookie(c, newRefresh, expires, stored.Remember)
 
-	c.JSON(http.StatusOK, gin.H{
-		"token":         access,
-		"refresh_token": newRefresh,
-		"username":      username,
+	c.JSON(http.StatusOK, gin.H{
+		"token":         access,
+		"refresh_token": newRefresh,
+		"username":      username,
+	})
+}
+
+func logoutHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	var input refreshRequest
+	_ = c.BindJSON(&input)
+	if input.RefreshToken == "" {
+		if cookie, err := c.Cookie(refreshCookieName); err == nil {
+			input.RefreshToken = cookie
+		}
+	}
+	clearRefreshCookie(c)
+
+	if input.RefreshToken == "" {
+		c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+		return
+	}
+
+	parsed, err := jwt.ParseWithClaims(input.RefreshToken, &jwt.RegisteredClaims{}, func(t *jwt.Token) (interface{}, error) {
+		return jwtSecret, nil
+	})
+	if err != nil || !parsed.Valid {
+		c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+		return
+	}
+	claims, _ := parsed.Claims.(*jwt.RegisteredClaims)
+	if claims == nil || claims.ID == "" {
+		c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+		return
+	}
+
+	if _, err := db.ExecContext(ctx, `UPDATE refresh_tokens SET revoked = 1 WHERE id = ?`, claims.ID); err != nil {
+		logIfTimeout(err, "logout: revoke")
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+}
+
+func currentUserHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	userID := ctxUserID(c)
+	var u User
+	var locale string
+	if err := db.QueryRowContext(ctx, `SELECT id, username, unseal(email), email_verified, locale, created_at, updated_at FROM users WHERE id = ?`, userID).
+		Scan(&u.ID, &u.Username, &u.Email, &u.EmailVerified, &locale, &u.CreatedAt, &u.UpdatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		serverError(c, "currentUser: select", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":                 u.ID,
+		"username":           u.Username,
+		"email":              u.Email,
+		"emailVerified":      u.EmailVerified,
+		"locale":             resolveLocale(locale),
+		"createdAt":          u.CreatedAt,
+		"updatedAt":          u.UpdatedAt,
+		"verificationExpiry": u.CreatedAt.Add(verifyTTL),
+	})
+}
+
+func updateUserHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	userID := ctxUserID(c)
+	var input updateUserRequest
+	if err := c.BindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	locale := normalizeLocale(input.Locale)
+	if input.Locale != "" && locale == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported locale"})
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	defer tx.Rollback()
+
+	var current User
+	var currentLocale string
+	if err := tx.QueryRowContext(ctx, `SELECT id, username, password_hash, unseal(email), locale FROM users WHERE id = ?`, userID).
+		Scan(&current.ID, &current.Username, &current.PasswordHash, &current.Email, &currentLocale); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	updatedUsername := current.Username
+	if input.Username != "" && input.Username != current.Username {
+		if !validateUsername(input.Username) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid username"})
+			return
+		}
+		var count int
+		if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM users WHERE username = ? AND id <> ?`, input.Username, userID).Scan(&count); err != nil {
+			serverError(c, "updateUser: username count", err)
+			return
+		}
+		if count > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Username taken"})
+			return
+		}
+		updatedUsername = input.Username
+	}
+
+	updatedEmail := current.Email
+	if input.Email != "" && input.Email != current.Email {
+		if !validateEmail(input.Email) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email"})
+			return
+		}
+		if !emailDomainAllowed(input.Email) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Email domain not allowed", "code": "email_domain_not_allowed"})
+			return
+		}
+		if isDisposableDomain(emailDomain(input.Email)) {
+			metricInc("plannie_email_change_rejections_total", "reason", "disposable")
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Disposable email addresses are not allowed"})
+			return
+		}
+		var count int
+		if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM users WHERE (email = ? OR email_index = blind_index(?)) AND id <> ?`, input.Email, input.Email, userID).Scan(&count); err != nil {
+			serverError(c, "updateUser: email count", err)
+			return
+		}
+		if count > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Email taken"})
+			return
+		}
+		updatedEmail = input.Email
+	}
+
+	updatedHash := current.PasswordHash
+	changedPassword := false
+	if input.NewPassword != "" {
+		if !validatePassword(input.NewPassword) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Weak password"})
+			return
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(current.PasswordHash), []byte(input.OldPassword)); err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Current password incorrect"})
+			return
+		}
+		h, err := bcrypt.GenerateFromPassword([]byte(input.NewPassword), 12)
+		if err != nil {
+			serverError(c, "updateUser: hash new password", err)
+			return
+		}
+		updatedHash = string(h)
+		changedPassword = true
+	}
+
+	if locale == "" {
+		locale = currentLocale
+	}
+
+	now := time.Now().UTC()
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE users SET username = ?, email = seal(?), email_index = blind_index(?), password_hash = ?, locale = ?, updated_at = ? WHERE id = ?
+	`, updatedUsername, updatedEmail, updatedEmail, updatedHash, locale, now, userID); err != nil {
+		if uniqueViolation(err, "users.email") {
+			c.JSON(http.StatusConflict, gin.H{"error": "Email taken"})
+			return
+		}
+		if uniqueViolation(err, "users.username") {
+			c.JSON(http.StatusConflict, gin.H{"error": "Username taken"})
+			return
+		}
+		serverError(c, "updateUser: update user", err)
+		return
+	}
+
+	if input.Email != "" && input.Email != current.Email {
+		if _, err := tx.ExecContext(ctx, `UPDATE users SET email_verified = 0 WHERE id = ?`, userID); err != nil {
+			serverError(c, "updateUser: set unverified", err)
+			return
+		}
+		if err := recordEmailChange(ctx, tx, userID, current.Email, updatedEmail, clientIP(c)); err != nil {
+			serverError(c, "updateUser: email history", err)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+			return
+		}
+		raw, tokenID, err := createEmailToken(userID, "verify", verifyTTL)
+		if err == nil {
+			apiURL := apiBaseURL()
+			verifyURL := fmt.Sprintf("%s/verify-email?tid=%s&t=%s", apiURL, tokenID, raw)
+			subject, html := localizedEmail(resolveLocale(locale), "verify_change", updatedUsername, verifyURL)
+			go func() {
+				if err := sendEmail(userID, updatedEmail, subject, html); err != nil {
+					log.Printf("sendEmail verify-change: %v", err)
+				}
+			}()
+		}
+		c.JSON(http.StatusOK, gin.H{"username": updatedUsername})
+		return
+	}
+
+	if changedPassword {
+		if _, err := tx.ExecContext(ctx, `UPDATE refresh_tokens SET revoked = 1 WHERE user_id = ?`, userID); err != nil {
+			serverError(c, "updateUser: revoke refresh", err)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"username": updatedUsername})
+}
+
+func deleteUserHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	userID := ctxUserID(c)
+	var in struct {
+		Password    string `json:"password"`
+		OwnedEvents string `json:"ownedEvents"`
+	}
+	if err := c.BindJSON(&in); err != nil || in.Password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password is required"})
+		return
+	}
+	mode := in.OwnedEvents
+	if mode == "" {
+		mode = ownedEventsDefault()
+	}
+	if mode != ownedEventsDelete && mode != ownedEventsTransfer {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ownedEvents must be delete or transfer"})
+		return
+	}
+
+	var hash string
+	if err := db.QueryRowContext(ctx, `SELECT password_hash FROM users WHERE id = ?`, userID).Scan(&hash); err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		serverError(c, "deleteUser: select", err)
+		return
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(in.Password)); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid password"})
+		return
+	}
+
+	erased, err := eraseAccount(ctx, userID, mode)
+	if err != nil {
+		serverError(c, "deleteUser: erase", err)
+		return
+	}
+	for _, m := range erased.cancellations {
+		if err := enqueueEmail(m); err != nil {
+			log.Printf("deleteUser: queue cancellation: %v", err)
+		}
+	}
+	for _, id := range erased.deleted {
+		ssePublish(id, []byte(`{"type":"event_deleted","id":"`+id+`"}`))
+	}
+	for _, id := range append(erased.transferred, erased.left...) {
+		ssePublish(id, []byte(`{"type":"event_updated","id":"`+id+`"}`))
+	}
+	shipSecurityEvent("account_deleted", userID, clientIP(c), map[string]interface{}{
+		"eventsDeleted": len(erased.deleted), "eventsTransferred": len(erased.transferred), "eventsLeft": len(erased.left),
+	})
+
+	clearRefreshCookie(c)
+	c.JSON(http.StatusOK, gin.H{
+		"message":           "Account deleted",
+		"eventsDeleted":     len(erased.deleted),
+		"eventsTransferred": len(erased.transferred),
+	})
+}
+
+// What happens to a deleted account's own events: they are deleted, or handed to an
+// organizer (else the longest-standing registered participant) and deleted only when
+// nobody is left. The request's ownedEvents wins over ACCOUNT_DELETION_EVENTS, which
+// defaults to delete.
+const (
+	ownedEventsDelete   = "delete"
+	ownedEventsTransfer = "transfer"
+)
+
+func ownedEventsDefault() string {
+	if v := strings.ToLower(os.Getenv("ACCOUNT_DELETION_EVENTS")); v == ownedEventsTransfer {
+		return v
+	}
+	return ownedEventsDelete
+}
+
+type accountErasure struct {
+	deleted, transferred, left []string
+	cancellations              []outgoingEmail
+}
+
+// accountDataTables lists every per-user row removed on erasure, keyed by the user column
+// or an expression matching it.
+var accountDataTables = []string{
+	`DELETE FROM event_participants WHERE user_id = ?`,
+	`DELETE FROM refresh_tokens WHERE user_id = ?`,
+	`DELETE FROM email_tokens WHERE user_id = ?`,
+	`DELETE FROM recovery_codes WHERE user_id = ?`,
+	`DELETE FROM caldav_tokens WHERE user_id = ?`,
+	`DELETE FROM login_attempts WHERE user_id = ?`,
+	`DELETE FROM lockout_events WHERE user_id = ?`,
+	`DELETE FROM user_email_history WHERE user_id = ?`,
+	`DELETE FROM policy_acceptances WHERE user_id = ?`,
+	`DELETE FROM user_preferences WHERE user_id = ?`,
+	`DELETE FROM notification_preferences WHERE user_id = ?`,
+	`DELETE FROM event_seen WHERE user_id = ?`,
+	`DELETE FROM event_watches WHERE ? IN (watcher_id, user_id)`,
+	`DELETE FROM push_devices WHERE user_id = ?`,
+	`DELETE FROM data_exports WHERE user_id = ?`,
+	`DELETE FROM calendar_syncs WHERE user_id = ?`,
+	`DELETE FROM email_notifications_sent WHERE user_id = ?`,
+	`DELETE FROM event_edit_locks WHERE user_id = ?`,
+	`DELETE FROM friend_requests WHERE ? IN (sender_id, receiver_id)`,
+	`DELETE FROM event_invites WHERE ? IN (inviter_id, invitee_id)`,
+	`DELETE FROM availability_history WHERE user_id = ?`,
+	`DELETE FROM event_attendance WHERE user_id = ?`,
+	`DELETE FROM event_shift_claims WHERE user_id = ?`,
+	`DELETE FROM event_bookings WHERE user_id = ?`,
+	`DELETE FROM event_booking_waitlist WHERE user_id = ?`,
+	`DELETE FROM event_confirmations WHERE user_id = ?`,
+	`DELETE FROM event_series WHERE creator_id = ? AND id NOT IN (SELECT series_id FROM events WHERE series_id IS NOT NULL)`,
+	`DELETE FROM users WHERE id = ?`,
+}
+
+// eraseAccount removes a user and everything personal to them in one transaction. SQLite
+// foreign keys are not relied on; every table is cleared explicitly. Events the user took
+// part in lose their row and aggregate, and their bookings pass to the waitlist
+// (releaseParticipant). Owned events are transferred or deleted per mode; a deleted event
+// takes every other participant's rows with it (deleteEventRows). Calendar cancellations
+// for deleted events are built first, while participants still exist, and returned for
+// the caller to queue after commit.
+func eraseAccount(ctx context.Context, userID, mode string) (accountErasure, error) {
+	var out accountErasure
+	owned := map[string]string{}
+	rows, err := db.QueryContext(ctx, `SELECT id FROM events WHERE creator_id = ?`, userID)
+	if err != nil {
+		return out, err
+	}
+	var ownedIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return out, err
+		}
+		ownedIDs = append(ownedIDs, id)
+	}
+	rows.Close()
+	for _, id := range ownedIDs {
+		var successor string
+		if mode == ownedEventsTransfer {
+			err := db.QueryRowContext(ctx, `
+				SELECT user_id FROM event_participants
+				WHERE event_id = ? AND user_id IS NOT NULL AND user_id <> ?
+				ORDER BY CASE role WHEN 'organizer' THEN 0 ELSE 1 END, created_at LIMIT 1
+			`, id, userID).Scan(&successor)
+			if err != nil && err != sql.ErrNoRows {
+				return out, err
+			}
+		}
+		owned[id] = successor
+		if successor == "" {
+			cancellations, err := finalizationEmails(ctx, id, "CANCEL", 1)
+			if err != nil {
+				logIfTimeout(err, "eraseAccount: cancellations")
+			}
+			out.cancellations = append(out.cancellations, cancellations...)
+		}
+	}
+
+	rows, err = db.QueryContext(ctx, `SELECT event_id FROM event_participants WHERE user_id = ?`, userID)
+	if err != nil {
+		return out, err
+	}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return out, err
+		}
+		if _, ok := owned[id]; !ok {
+			out.left = append(out.left, id)
+		}
+	}
+	rows.Close()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return out, err
+	}
+	defer tx.Rollback()
+	now := time.Now().UTC()
+	for _, id := range ownedIDs {
+		successor := owned[id]
+		if successor == "" {
+			if err := deleteEventRows(ctx, tx, id); err != nil {
+				return out, err
+			}
+			out.deleted = append(out.deleted, id)
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE events SET creator_id = ?, updated_at = ? WHERE id = ?`, successor, now, id); err != nil {
+			return out, err
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE event_participants SET role = ? WHERE event_id = ? AND user_id = ?`, roleOwner, id, successor); err != nil {
+			return out, err
+		}
+		out.transferred = append(out.transferred, id)
+	}
+	var releases []participantRelease
+	for _, id := range append(append([]string{}, out.transferred...), out.left...) {
+		released, err := releaseParticipant(ctx, tx, id, userID)
+		if err != nil {
+			return out, err
+		}
+		releases = append(releases, released)
+	}
+	for _, q := range accountDataTables {
+		if _, err := tx.ExecContext(ctx, q, userID); err != nil {
+			return out, err
+		}
+	}
+	for _, id := range append(append([]string{}, ownedIDs...), out.left...) {
+		if err := dropAggregate(ctx, tx, id); err != nil {
+			return out, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return out, err
+	}
+	relinkArchivedHistory(ctx, `DELETE FROM availability_history_archive WHERE user_id = ?`, userID)
+	for _, id := range out.deleted {
+		deleteArchivedEventHistory(ctx, id)
+	}
+	for _, released := range releases {
+		released.notify(ctx)
+	}
+	metricInc("plannie_accounts_deleted_total", "owned_events", mode)
+	return out, nil
+}
+
+func resendVerifyEmailHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	userID := ctxUserID(c)
+	var u struct {
+		Email         string
+		Username      string
+		EmailVerified bool
+		CreatedAt     time.Time
+	}
+	if err := db.QueryRowContext(ctx, `SELECT unseal(email), username, email_verified, created_at FROM users WHERE id = ?`, userID).
+		Scan(&u.Email, &u.Username, &u.EmailVerified, &u.CreatedAt); err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		serverError(c, "resendVerify: select", err)
+		return
+	}
+
+	if u.EmailVerified {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Email already verified"})
+		return
+	}
+	if time.Since(u.CreatedAt) > verifyTTL {
+		_, _ = db.ExecContext(ctx, `DELETE FROM users WHERE id = ?`, userID)
+		c.JSON(http.StatusGone, gin.H{"error": "Verification window expired. Please register again."})
+		return
+	}
+
+	var lastSent time.Time
+	err := db.QueryRowContext(ctx, `
+		SELECT created_at FROM email_tokens
+		WHERE user_id = ? AND kind = 'verify'
+		ORDER BY created_at DESC
+		LIMIT 1
+	`, userID).Scan(&lastSent)
+	if err != nil && err != sql.ErrNoRows {
+		serverError(c, "resendVerify: last token", err)
+		return
+	}
+	if err == nil {
+		elapsed := time.Since(lastSent)
+		if elapsed < verifyResendCooldown {
+			remain := verifyResendCooldown - elapsed
+			c.JSON(http.StatusTooManyRequests, gin.H{
+				"error":            "Please wait before resending verification email",
+				"retry_after_s":    int(remain.Seconds()) + 1,
+				"cooldown_minutes": int(verifyResendCooldown.Minutes()),
+			})
+			return
+		}
+	}
+
+	raw, tokenID, err := createEmailToken(userID, "verify", verifyTTL)
+	if err != nil {
+		serverError(c, "resendVerify: token", err)
+		return
+	}
+	apiURL := apiBaseURL()
+	verifyURL := fmt.Sprintf("%s/verify-email?tid=%s&t=%s", apiURL, tokenID, raw)
+	subject, html := localizedEmail(userLocale(ctx, userID), "verify", u.Username, verifyURL)
+	go func() {
+		if err := sendEmail(userID, u.Email, subject, html); err != nil {
+			log.Printf("sendEmail resend: %v", err)
+		}
+	}()
+	c.JSON(http.StatusOK, gin.H{"message": "Verification email sent"})
+}
+
+// sseHandler streams an event's changes. The first message is a "snapshot" event with the
+// current state (the GET /events/:id body, or the kiosk view on kiosk streams) taken after
+// subscribing, so nothing published in between is lost and clients need no separate GET.
+func sseHandler(c *gin.Context) {
+	flusher, ok := c.Writer.(http.Flusher)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Streaming unsupported"})
+		return
+	}
+
+	eventID := c.Param("id")
+	sub := sseSubscribe(eventID)
+	defer sseUnsubscribe(eventID, sub)
+
+	caps := sseCapabilities(c)
+	snapshot, view, ok := sseSnapshot(c, eventID, caps)
+	if !ok {
+		return
+	}
+	var patches *ssePatchStream
+	if len(caps) > 0 {
+		patches = &ssePatchStream{eventID: eventID, caps: caps, last: view}
+	}
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+
+	fmt.Fprintf(c.Writer, "event: snapshot\ndata: %s\n\n", snapshot)
+	flusher.Flush()
+
+	ping := time.NewTicker(ssePingEvery)
+	defer ping.Stop()
+
+	notify := c.Writer.CloseNotify()
+	ctx := c.Request.Context()
+
+	for {
+		select {
+		case <-notify:
+			return
+		case <-ctx.Done():
+			return
+		case <-ping.C:
+			if tid := c.GetString("kioskTokenID"); tid != "" && !kioskTokenActive(ctx, tid) {
+				return
+			}
+			fmt.Fprintf(c.Writer, "event: ping\ndata: ok\n\n")
+			flusher.Flush()
+		case msg, ok := <-sub.ch:
+			if !ok {
+				return
+			}
+			if patches != nil {
+				if sseWritePatch(c, patches, msg) {
+					flusher.Flush()
+					continue
+				}
+			}
+			fmt.Fprintf(c.Writer, "data: %s\n\n", msg)
+			flusher.Flush()
+		case msg := <-sub.preview:
+			// Kiosk screens only show the anonymous aggregate; previews name participants.
+			if c.GetString("kioskTokenID") != "" {
+				continue
+			}
+			// A named event, so clients that refetch on every message ignore it.
+			fmt.Fprintf(c.Writer, "event: preview\ndata: %s\n\n", msg)
+			flusher.Flush()
+		}
+	}
+}
+
+// sseView builds what GET /events/:id returns to this stream's viewer (the kiosk view on
+// kiosk streams), normalized as by normalizeJSON. A non-zero status means the viewer may
+// not see the event (anymore).
+func sseView(c *gin.Context, eventID string) (interface{}, int, error) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	var view interface{}
+	var err error
+	if c.GetString("kioskTokenID") != "" {
+		var kiosk gin.H
+		if kiosk, err = kioskEventView(ctx, eventID); err == nil {
+			view = normalizeJSON(kiosk)
+		}
+	} else {
+		var snap *eventSnapshot
+		if snap, err = cachedEventSnapshot(ctx, eventID); err == nil {
+			requesterID := ctxUserID(c)
+			if snap.expiresAt.Valid && snap.expiresAt.Time.Before(time.Now()) {
+				return nil, http.StatusGone, nil
+			}
+			if !eventAccessAllowed(ctx, c, eventID, snap.passHash, requesterID) {
+				return nil, http.StatusUnauthorized, nil
+			}
+			view = sseEventView(ctx, c, snap, requesterID)
+		}
+	}
+	if err == sql.ErrNoRows {
+		return nil, http.StatusNotFound, nil
+	}
+	return view, 0, err
+}
+
+// Stream views. Every change is fanned out to all open streams of the event, and each
+// JSON-patch stream rebuilds its viewer's view to diff it. The part that is the same for
+// everyone is rendered and normalized once per snapshot (and ?tz=) and shared read-only;
+// a stream only adds its viewer's draft and conflicts. Entries are dropped when the
+// event's last stream closes.
+var (
+	sseSharedMu    sync.Mutex
+	sseSharedViews = map[string]*sseSharedEntry{}
+)
+
+type sseSharedEntry struct {
+	snap  *eventSnapshot
+	views map[string]map[string]interface{} // by ?tz=, "" for none
+}
+
+// sseSharedEventView returns eventSharedView for snap, localized to tz, normalized. The
+// result is shared between streams and must not be modified.
+func sseSharedEventView(ctx context.Context, snap *eventSnapshot, tz string) map[string]interface{} {
+	id := snap.ev.ID
+	sseSharedMu.Lock()
+	if e, ok := sseSharedViews[id]; ok && e.snap == snap {
+		if view, ok := e.views[tz]; ok {
+			sseSharedMu.Unlock()
+			return view
+		}
+	}
+	sseSharedMu.Unlock()
+
+	resp := eventSharedView(ctx, snap)
+	if tz != "" {
+		localizeEventView(resp, eventLocation(tz))
+	}
+	view, _ := normalizeJSON(resp).(map[string]interface{})
+
+	sseSharedMu.Lock()
+	defer sseSharedMu.Unlock()
+	e, ok := sseSharedViews[id]
+	if !ok || e.snap != snap {
+		e = &sseSharedEntry{snap: snap, views: map[string]map[string]interface{}{}}
+		sseSharedViews[id] = e
+	}
+	e.views[tz] = view
+	return view
+}
+
+// sseEventView is eventView for a stream, normalized: the shared view plus the viewer's
+// own fields, projected by ?fields=.
+func sseEventView(ctx context.Context, c *gin.Context, snap *eventSnapshot, requesterID string) map[string]interface{} {
+	tz, _ := validTimezone(c.Query("tz"))
+	shared := sseSharedEventView(ctx, snap, tz)
+	own := gin.H{}
+	addViewerFields(ctx, own, snap, requesterID)
+	if tz != "" && len(own) > 0 {
+		localizeEventView(own, eventLocation(tz))
+	}
+	view := make(map[string]interface{}, len(shared)+len(own))
+	for k, v := range shared {
+		view[k] = v
+	}
+	for k, v := range own {
+		view[k] = normalizeJSON(v)
+	}
+	if fields := c.Query("fields"); fields != "" {
+		view = projectFields(view, fields)
+	}
+	return view
+}
+
+// sseSnapshot builds the catch-up message for a new stream, applying the same checks as
+// GET /events/:id; on failure it has written the error response. It also returns the
+// view so JSON-patch streams can diff against it.
+func sseSnapshot(c *gin.Context, eventID string, caps []string) ([]byte, interface{}, bool) {
+	view, status, err := sseView(c, eventID)
+	switch {
+	case err != nil:
+		serverError(c, "sse: snapshot", err)
+		return nil, nil, false
+	case status == http.StatusNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return nil, nil, false
+	case status == http.StatusGone:
+		c.JSON(http.StatusGone, gin.H{"error": "Event expired"})
+		return nil, nil, false
+	case status == http.StatusUnauthorized:
+		passphraseRequired(c)
+		return nil, nil, false
+	}
+	msg := gin.H{"type": "snapshot", "id": eventID, "event": view}
+	if len(caps) > 0 {
+		msg["capabilities"] = caps
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		serverError(c, "sse: encode snapshot", err)
+		return nil, nil, false
+	}
+	// Opening the stream counts as opening the event; the refreshes that follow do not.
+	if userID := ctxUserID(c); userID != "" && c.GetString("kioskTokenID") == "" {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+		markEventSeen(ctx, eventID, userID)
+		cancel()
+	}
+	return payload, view, true
+}
+
+// JSON-patch streams. A client that opens the stream with ?capabilities=json-patch gets
+// each change as an RFC 6902 patch against the view it last received instead of a bare
+// "event_updated" notice it has to answer with a full refetch; for events with hundreds
+// of participants that is a few operations instead of the whole grid. The snapshot echoes
+// the accepted capabilities so a client can tell an older server apart. Every
+// ssePatchResyncEvery patches, or when a patch would be larger than the view itself, the
+// stream sends a fresh snapshot marked "resync" so a client that misapplied something
+// converges again. Patches and snapshots carry a sequence number.
+var ssePatchResyncEvery = 50
+
+const capJSONPatch = "json-patch"
+
+// sseCapabilities returns the capabilities the client asked for that this server supports.
+func sseCapabilities(c *gin.Context) []string {
+	var caps []string
+	for _, v := range strings.Split(c.Query("capabilities"), ",") {
+		if strings.TrimSpace(v) == capJSONPatch {
+			caps = append(caps, capJSONPatch)
+			break
+		}
+	}
+	return caps
+}
+
+// jsonPatchOp is one RFC 6902 operation. Value is omitted for "remove" only, so a null
+// value still serializes for "add" and "replace".
+type jsonPatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+func (o jsonPatchOp) MarshalJSON() ([]byte, error) {
+	if o.Op == "remove" {
+		return json.Marshal(struct {
+			Op   string `json:"op"`
+			Path string `json:"path"`
+		}{o.Op, o.Path})
+	}
+	type plain jsonPatchOp
+	return json.Marshal(plain(o))
+}
+
+var jsonPointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// normalizeJSON round-trips v through encoding/json so views compare as the client sees
+// them: maps, slices, float64, strings, bools and nil.
+func normalizeJSON(v interface{}) interface{} {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var out interface{}
+	if err := json.Unmarshal(b, &out); err != nil {
+		return nil
+	}
+	return out
+}
+
+// jsonDiff appends the operations that turn a into b. Arrays are compared index by
+// index with the tail added or removed, which suits participant lists that mostly grow
+// at the end; objects recurse per key in sorted order so patches are deterministic.
+func jsonDiff(ops []jsonPatchOp, path string, a, b interface{}) []jsonPatchOp {
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(av)+len(bv))
+		for k := range av {
+			keys = append(keys, k)
+		}
+		for k := range bv {
+			if _, ok := av[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			p := path + "/" + jsonPointerEscaper.Replace(k)
+			old, inA := av[k]
+			nv, inB := bv[k]
+			switch {
+			case !inB:
+				ops = append(ops, jsonPatchOp{Op: "remove", Path: p})
+			case !inA:
+				ops = append(ops, jsonPatchOp{Op: "add", Path: p, Value: nv})
+			default:
+				ops = jsonDiff(ops, p, old, nv)
+			}
+		}
+		return ops
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok {
+			break
+		}
+		n := min(len(av), len(bv))
+		for i := 0; i < n; i++ {
+			ops = jsonDiff(ops, path+"/"+strconv.Itoa(i), av[i], bv[i])
+		}
+		for i := len(av) - 1; i >= n; i-- {
+			ops = append(ops, jsonPatchOp{Op: "remove", Path: path + "/" + strconv.Itoa(i)})
+		}
+		for i := n; i < len(bv); i++ {
+			ops = append(ops, jsonPatchOp{Op: "add", Path: path + "/-", Value: bv[i]})
+		}
+		return ops
+	default:
+		if a == b {
+			return ops
+		}
+	}
+	return append(ops, jsonPatchOp{Op: "replace", Path: path, Value: b})
+}
+
+// ssePatchStream is the per-connection state of a JSON-patch stream: the view the client
+// holds and how many patches it has applied since the last snapshot.
+type ssePatchStream struct {
+	eventID string
+	caps    []string
+	last    interface{}
+	seq     int
+	patches int
+}
+
+// next answers a change notice with a "patch" against last or a resync snapshot; payload
+// is nil when the visible view did not change. ok is false when the viewer lost access or
+// the view could not be built, and the caller forwards the notice unchanged.
+func (s *ssePatchStream) next(c *gin.Context) (name string, payload []byte, ok bool) {
+	view, status, err := sseView(c, s.eventID)
+	if err != nil || status != 0 {
+		if err != nil {
+			logIfTimeout(err, "sse: patch view")
+		}
+		return "", nil, false
+	}
+	ops := jsonDiff(nil, "", s.last, view)
+	if len(ops) == 0 {
+		return "", nil, true
+	}
+	s.seq++
+	full, err := json.Marshal(gin.H{"type": "snapshot", "id": s.eventID, "event": view, "seq": s.seq, "resync": true, "capabilities": s.caps})
+	if err != nil {
+		return "", nil, false
+	}
+	s.last = view
+	if s.patches < ssePatchResyncEvery {
+		patch, err := json.Marshal(gin.H{"type": "patch", "id": s.eventID, "seq": s.seq, "ops": ops})
+		if err == nil && len(patch) < len(full) {
+			s.patches++
+			metricInc("plannie_sse_patches_total", "kind", "patch")
+			return "patch", patch, true
+		}
+	}
+	s.patches = 0
+	metricInc("plannie_sse_patches_total", "kind", "resync")
+	return "snapshot", full, true
+}
+
+// sseWritePatch handles msg on a JSON-patch stream. A bare "event_updated" is replaced by
+// its patch; "event_finalized" is forwarded and followed by one. Other messages describe
+// no state change and are left to the caller, as is anything when next fails. It
+// reports whether msg has been written.
+func sseWritePatch(c *gin.Context, s *ssePatchStream, msg []byte) bool {
+	var head struct {
+		Type string `json:"type"`
+	}
+	_ = json.Unmarshal(msg, &head)
+	if head.Type != "event_updated" && head.Type != "event_finalized" {
+		return false
+	}
+	name, payload, ok := s.next(c)
+	if !ok {
+		return false
+	}
+	if head.Type == "event_finalized" {
+		fmt.Fprintf(c.Writer, "data: %s\n\n", msg)
+	}
+	if payload != nil {
+		fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", name, payload)
+	}
+	return true
+}
+
+// Live selection previews: while a participant hovers or drags over the grid the client
+// posts the slots under the pointer and other viewers draw them as a ghost. Nothing is
+// stored; the limit is per user and separate from the per-IP request budget.
+const (
+	maxPreviewSlots = 500
+	previewRate     = 10 // per second
+	previewBurst    = 20
+)
+
+// previewSelectionHandler broadcasts {"mode":"hover"|"select"|"clear","slots":[...]}
+// from a member of the event as an SSE "preview" event.
+func previewSelectionHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	userID := ctxUserID(c)
+	if !getVisitor("preview:"+userID, previewRate, previewBurst).Allow() {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests"})
+		return
+	}
+	var input struct {
+		Mode  string   `json:"mode"`
+		Slots []string `json:"slots"`
+	}
+	if err := c.BindJSON(&input); err != nil {
+		return
+	}
+	switch input.Mode {
+	case "hover", "select":
+	case "clear":
+		input.Slots = nil
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "mode must be hover, select or clear"})
+		return
+	}
+	if len(input.Slots) > maxPreviewSlots {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d slots", maxPreviewSlots)})
+		return
+	}
+	for _, k := range input.Slots {
+		if !validSlotKeySyntax(k) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid slot " + k})
+			return
+		}
+	}
+	eventID := c.Param("id")
+	if _, ok := eventMemberOnly(c, ctx, eventID, "previewSelection"); !ok {
+		return
+	}
+	var username string
+	if err := db.QueryRowContext(ctx, `SELECT username FROM users WHERE id = ?`, userID).Scan(&username); err != nil {
+		serverError(c, "previewSelection: select user", err)
+		return
+	}
+	if input.Slots == nil {
+		input.Slots = []string{}
+	}
+	payload, _ := json.Marshal(gin.H{
+		"type":   "preview",
+		"id":     eventID,
+		"userId": userID,
+		"name":   username,
+		"mode":   input.Mode,
+		"slots":  input.Slots,
+		"at":     time.Now().UnixMilli(),
+	})
+	ssePreview(eventID, payload)
+	metricInc("plannie_sse_previews_total", "mode", input.Mode)
+	c.Status(http.StatusNoContent)
+}
+
+func createEventHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	userID := ctxUserID(c)
+	var input map[string]interface{}
+	if err := c.BindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+
+	id, _ := input["id"].(string)
+	if id == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing event id"})
+		return
+	}
+
+	name, _ := input["name"].(string)
+	drRaw, _ := input["dateRange"].(map[string]interface{})
+	from, _ := drRaw["from"].(string)
+	to, _ := drRaw["to"].(string)
+	dur, _ := input["duration"].(float64)
+	tz, _ := input["timezone"].(string)
+	if tz != "" {
+		var ok bool
+		if tz, ok = validTimezone(tz); !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid timezone"})
+			return
+		}
+	}
+	recurrence, _ := input["recurrence"].(string)
+	if recurrence != "" && recurrence != recurrenceWeekly {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recurrence"})
+		return
+	}
+	if recurrence == recurrenceWeekly {
+		// A weekly poll has no dates; its grid is the generic week.
+		from, to = "", ""
+	}
+	if name == "" || (recurrence == "" && (from == "" || to == "")) || dur <= 0 || tz == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing fields"})
+		return
+	}
+
+	isPublic, _ := input["public"].(bool)
+	var rawTags []string
+	if tagsRaw, ok := input["tags"].([]interface{}); ok {
+		for _, t := range tagsRaw {
+			if ts, ok := t.(string); ok {
+				rawTags = append(rawTags, ts)
+			}
+		}
+	}
+	tags := normalizeTags(rawTags)
+	tagsJSON, _ := json.Marshal(tags)
+
+	var passHash sql.NullString
+	if pass, _ := input["passphrase"].(string); pass != "" {
+		if len(pass) < 4 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Passphrase too short"})
+			return
+		}
+		h, err := bcrypt.GenerateFromPassword([]byte(pass), 12)
+		if err != nil {
+			serverError(c, "createEvent: hash passphrase", err)
+			return
+		}
+		passHash = sql.NullString{String: string(h), Valid: true}
+	}
+
+	holidayRegion, _ := input["holidayRegion"].(string)
+	holidayRegion = strings.ToUpper(strings.TrimSpace(holidayRegion))
+	if holidayRegion != "" && !holidayRegionRe.MatchString(holidayRegion) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid holiday region"})
+		return
+	}
+	autoFinalize, _ := input["autoFinalize"].(bool)
+	guestMode, _ := input["guestMode"].(bool)
+	bookingMode, _ := input["bookingMode"].(bool)
+	rawDeadline, _ := input["responseDeadline"].(string)
+	deadline, err := parseResponseDeadline(rawDeadline)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !enforceNewAccountLimit(c, ctx, userID, "events") || !enforceTenantQuota(c, ctx, "events") {
+		return
+	}
+
+	partsRaw, _ := input["participants"].([]interface{})
+	disabledRaw, _ := input["disabledSlots"].([]interface{})
+	disabled := []string{}
+	for _, d := range disabledRaw {
+		if k, ok := d.(string); ok {
+			disabled = append(disabled, k)
+		}
+	}
+	disabledJSON, err := json.Marshal(normalizeSlotList(disabled))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	availability := map[string]bool{}
+	availJSON, err := json.Marshal(availability)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	now := time.Now().UTC()
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO events(id, creator_id, name, date_from, date_to, duration, timezone, disabled_slots, is_public, tags, passphrase_hash, holiday_region, auto_finalize, response_deadline, guest_mode, booking_mode, recurrence, tenant_id, created_at, updated_at)
+		VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?,?)
+	`, id, userID, name, from, to, dur, tz, string(disabledJSON), isPublic, string(tagsJSON), passHash, holidayRegion, autoFinalize, deadline, guestMode, bookingMode, recurrence, requestTenant(c), now, now); err != nil {
+		tx.Rollback()
+		logIfTimeout(err, "createEvent: insert event")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create event"})
+		return
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO event_participants(id, event_id, user_id, availability, draft_availability, draft_disabled_slots, draft_updated_at, role, created_at, updated_at)
+		VALUES (?,?,?,seal(?),?,?,NULL,?,?,?)
+	`, uuid.NewString(), id, userID, string(availJSON), "{}", "[]", roleOwner, now, now); err != nil {
+		tx.Rollback()
+		logIfTimeout(err, "createEvent: insert self participant")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not add participant"})
+		return
+	}
+
+	for _, p := range partsRaw {
+		if m, ok := p.(map[string]interface{}); ok {
+			pid, _ := m["id"].(string)
+			if pid != "" && pid != userID {
+				if _, err := tx.ExecContext(ctx, `
+					INSERT OR IGNORE INTO event_participants(id, event_id, user_id, availability, draft_availability, draft_disabled_slots, draft_updated_at, created_at, updated_at)
+					VALUES (?,?,?,?,?,?,NULL,?,?)
+				`, uuid.NewString(), id, pid, "{}", "{}", "[]", now, now); err != nil {
+					tx.Rollback()
+					logIfTimeout(err, "createEvent: insert other participant")
+					c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not add participant"})
+					return
+				}
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	statInc("events_created")
+
+	ssePublish(id, []byte(`{"type":"event_updated","id":"`+id+`"}`))
+	if isPublic {
+		cdnPurge(publicEventsSurrogateKey)
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"id":            id,
+		"creatorId":     userID,
+		"name":          name,
+		"dateRange":     gin.H{"from": from, "to": to},
+		"duration":      dur,
+		"timezone":      tz,
+		"participants":  []interface{}{map[string]interface{}{"id": userID, "name": ""}},
+		"disabledSlots": disabledRaw,
+		"public":        isPublic,
+		"tags":          tags,
+		"protected":     passHash.Valid,
+		"autoFinalize":  autoFinalize,
+		"guestMode":     guestMode,
+		"bookingMode":   bookingMode,
+		"recurrence":    recurrence,
+	})
+}
+
+func getEventHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	id := c.Param("id")
+	requesterID := optionalAuth(c)
+
+	snap, err := cachedEventSnapshot(ctx, id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	} else if err != nil {
+		logIfTimeout(err, "getEvent: load")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	if snap.expiresAt.Valid && snap.expiresAt.Time.Before(time.Now()) {
+		c.JSON(http.StatusGone, gin.H{"error": "Event expired"})
+		return
+	}
+	if !eventAccessAllowed(ctx, c, id, snap.passHash, requesterID) {
+		passphraseRequired(c)
+		return
+	}
+	if tz := c.Query("tz"); tz != "" {
+		if _, ok := validTimezone(tz); !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid timezone"})
+			return
+		}
+	}
+	if requesterID != "" {
+		markEventSeen(ctx, id, requesterID)
+	}
+	c.JSON(http.StatusOK, eventView(ctx, c, snap, requesterID))
+}
+
+// eventView renders GET /events/:id for requesterID ("" when anonymous): the shared
+// snapshot plus their draft and calendar conflicts, projected by ?fields=. With ?tz=
+// dated slot keys are rendered in that timezone.
+func eventView(ctx context.Context, c *gin.Context, snap *eventSnapshot, requesterID string) gin.H {
+	resp := eventSharedView(ctx, snap)
+	addViewerFields(ctx, resp, snap, requesterID)
+	if tz, ok := validTimezone(c.Query("tz")); ok {
+		localizeEventView(resp, eventLocation(tz))
+	}
+	if fields := c.Query("fields"); fields != "" {
+		resp = projectFields(resp, fields)
+	}
+	return resp
+}
+
+// eventSharedView renders the part of GET /events/:id that is the same for every viewer.
+func eventSharedView(ctx context.Context, snap *eventSnapshot) gin.H {
+	id, ev := snap.ev.ID, snap.ev
+	resp := gin.H{
+		"id":            ev.ID,
+		"creatorId":     ev.CreatorID,
+		"name":          ev.Name,
+		"dateRange":     gin.H{"from": ev.DateFrom, "to": ev.DateTo},
+		"duration":      ev.Duration,
+		"timezone":      ev.Timezone,
+		"participants":  snap.parts,
+		"disabledSlots": snap.disabled,
+	}
+	resp["participantCount"] = len(snap.parts)
+	if snap.seriesID.Valid {
+		resp["seriesId"] = snap.seriesID.String
+	}
+	resp["public"] = snap.isPublic
+	resp["tags"] = snap.tags
+	resp["protected"] = snap.passHash.Valid
+	if snap.finalizedSlot.Valid {
+		resp["finalizedSlot"] = snap.finalizedSlot.String
+		resp["finalizedAt"] = snap.finalizedAt.Time
+		if t, err := parseSlotKey(snap.finalizedSlot.String); err == nil && ev.Recurrence == recurrenceWeekly {
+			resp["finalizedWeeklySlot"] = weeklySlotKeyFor(t, eventLocation(ev.Timezone))
+		}
+	}
+	if snap.expiresAt.Valid {
+		resp["quick"] = true
+		resp["expiresAt"] = snap.expiresAt.Time
+	}
+	if snap.holidayRegion != "" {
+		resp["holidayRegion"] = snap.holidayRegion
+		resp["holidays"] = snap.holidays
+	}
+	resp["autoFinalize"] = snap.autoFinalize
+	resp["guestMode"] = snap.guestMode
+	resp["bookingMode"] = snap.bookingMode
+	resp["recurrence"] = ev.Recurrence
+	if len(snap.shortlist) > 0 {
+		resp["shortlist"] = snap.shortlist
+	}
+	if snap.deadline.Valid {
+		resp["responseDeadline"] = snap.deadline.Time
+	}
+	if lock, err := activeEditLock(ctx, id, time.Now().UTC()); err != nil {
+		logIfTimeout(err, "getEvent: select edit lock")
+	} else if lock != nil {
+		resp["editLock"] = lock
+	}
+	return resp
+}
+
+// addViewerFields adds requesterID's draft and calendar conflicts to resp. Anonymous
+// viewers have neither.
+func addViewerFields(ctx context.Context, resp gin.H, snap *eventSnapshot, requesterID string) {
+	if requesterID == "" {
+		return
+	}
+	if conflicts := calendarConflicts(ctx, requesterID, snap.ev); conflicts != nil {
+		resp["conflicts"] = conflicts
+	}
+	// drafts are private to their author, so they are read per request and never cached
+	var draftAvail map[string]bool
+	var draftDisabled []string
+	var draftAvailJSON, draftDisabledJSON string
+	var draftAt sql.NullTime
+	err := db.QueryRowContext(ctx, `
+		SELECT unseal(draft_availability), draft_disabled_slots, draft_updated_at FROM event_participants WHERE event_id = ? AND user_id = ?
+	`, snap.ev.ID, requesterID).Scan(&draftAvailJSON, &draftDisabledJSON, &draftAt)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			logIfTimeout(err, "getEvent: select draft")
+		}
+		return
+	}
+	_ = json.Unmarshal([]byte(draftAvailJSON), &draftAvail)
+	_ = json.Unmarshal([]byte(draftDisabledJSON), &draftDisabled)
+	if len(draftAvail) > 0 || len(draftDisabled) > 0 {
+		var draftUpdatedAt *time.Time
+		if draftAt.Valid {
+			t := draftAt.Time
+			draftUpdatedAt = &t
+		}
+		resp["draft"] = gin.H{
+			"availability":  draftAvail,
+			"disabledSlots": draftDisabled,
+			"updatedAt":     draftUpdatedAt,
+		}
+	}
+}
+
+// localizeEventView rewrites the slot keys of a rendered event into loc. The participant
+// maps come from the shared snapshot, so they are copied rather than changed.
+func localizeEventView(resp gin.H, loc *time.Location) {
+	resp["slotTimezone"] = loc.String()
+	if parts, ok := resp["participants"].([]map[string]interface{}); ok {
+		local := make([]map[string]interface{}, len(parts))
+		for i, p := range parts {
+			cp := make(map[string]interface{}, len(p))
+			for k, v := range p {
+				cp[k] = v
+			}
+			if avail, ok := p["availability"].(map[string]bool); ok {
+				cp["availability"] = localSlotMap(avail, loc)
+			}
+			local[i] = cp
+		}
+		resp["participants"] = local
+	}
+	if disabled, ok := resp["disabledSlots"].([]string); ok {
+		resp["disabledSlots"] = localSlotList(disabled, loc)
+	}
+	if shortlist, ok := resp["shortlist"].([]string); ok {
+		resp["shortlist"] = localSlotList(shortlist, loc)
+	}
+	if slot, ok := resp["finalizedSlot"].(string); ok {
+		resp["finalizedSlot"] = localSlotKey(slot, loc)
+	}
+	if conflicts, ok := resp["conflicts"].(map[string]bool); ok {
+		resp["conflicts"] = localSlotMap(conflicts, loc)
+	}
+	if draft, ok := resp["draft"].(gin.H); ok {
+		if avail, ok := draft["availability"].(map[string]bool); ok {
+			draft["availability"] = localSlotMap(avail, loc)
+		}
+		if disabled, ok := draft["disabledSlots"].([]string); ok {
+			draft["disabledSlots"] = localSlotList(disabled, loc)
+		}
+	}
+}
+
+// projectFields keeps only the comma-separated top-level keys of ?fields= (plus "id"),
+// so clients can skip heavy parts such as participants. Unknown names are ignored.
+func projectFields(m map[string]interface{}, fields string) map[string]interface{} {
+	out := map[string]interface{}{}
+	if v, ok := m["id"]; ok {
+		out["id"] = v
+	}
+	for _, f := range strings.Split(fields, ",") {
+		if v, ok := m[strings.TrimSpace(f)]; ok {
+			out[strings.TrimSpace(f)] = v
+		}
+	}
+	return out
+}
+
+// eventSnapshot is the requester-independent part of GET /events/:id. Cached snapshots
+// are shared between requests and must be treated as read-only.
+type eventSnapshot struct {
+	ev            Event
+	seriesID      sql.NullString
+	isPublic      bool
+	tags          []string
+	passHash      sql.NullString
+	finalizedSlot sql.NullString
+	finalizedAt   sql.NullTime
+	holidayRegion string
+	holidays      []EventHoliday
+	expiresAt     sql.NullTime
+	autoFinalize  bool
+	guestMode     bool
+	bookingMode   bool
+	deadline      sql.NullTime
+	shortlist     []string
+	parts         []map[string]interface{}
+	disabled      []string
+}
+
+// participantPalette holds colors that stay legible on both themes of the grid and
+// next to each other in the legend.
+var participantPalette = []string{
+	"#2563eb", "#dc2626", "#16a34a", "#d97706", "#9333ea", "#0891b2", "#db2777", "#65a30d",
+	"#4f46e5", "#ea580c", "#0d9488", "#c026d3", "#ca8a04", "#0284c7", "#e11d48", "#7c3aed",
+}
+
+// participantIdentity returns the color and initials clients draw a participant with, so
+// every client shows the same person the same way. The color comes from a hash of the
+// user id, which keeps it across events, renames and devices.
+func participantIdentity(userID, name string) (color, initials string) {
+	sum := sha256.Sum256([]byte(userID))
+	return participantPalette[int(sum[0])%len(participantPalette)], participantInitials(name)
+}
+
+func setParticipantIdentity(part map[string]interface{}, userID, name string) {
+	part["color"], part["initials"] = participantIdentity(userID, name)
+}
+
+// participantInitials takes the first letter of the first two words of a display name
+// ("Jane Doe" is "JD"), or the first letter alone for a single word such as a username.
+func participantInitials(name string) string {
+	words := strings.FieldsFunc(name, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+	if len(words) == 0 {
+		return "?"
+	}
+	var b strings.Builder
+	for _, w := range words[:min(2, len(words))] {
+		r, _ := utf8.DecodeRuneInString(w)
+		b.WriteRune(unicode.ToUpper(r))
+	}
+	return b.String()
+}
+
+func loadEventSnapshot(ctx context.Context, id string) (*eventSnapshot, error) {
+	s := &eventSnapshot{}
+	var tagsJSON string
+	err := db.QueryRowContext(ctx, `
+		SELECT id, COALESCE(creator_id, ''), name, date_from, date_to, duration, timezone, disabled_slots, series_id, is_public, tags, passphrase_hash,
+			finalized_slot, finalized_at, holiday_region, expires_at, auto_finalize, response_deadline, guest_mode, booking_mode, recurrence
+		FROM events WHERE id = ?
+	`, id).Scan(&s.ev.ID, &s.ev.CreatorID, &s.ev.Name, &s.ev.DateFrom, &s.ev.DateTo, &s.ev.Duration, &s.ev.Timezone, &s.ev.DisabledSlots, &s.seriesID, &s.isPublic, &tagsJSON, &s.passHash,
+		&s.finalizedSlot, &s.finalizedAt, &s.holidayRegion, &s.expiresAt, &s.autoFinalize, &s.deadline, &s.guestMode, &s.bookingMode, &s.ev.Recurrence)
+	if err != nil {
+		return nil, err
+	}
+
+	s.parts = []map[string]interface{}{}
+	rows, err := db.QueryContext(ctx, `
+		SELECT COALESCE(ep.user_id, ep.id), COALESCE(u.username, ep.guest_name), ep.user_id IS NULL, unseal(ep.availability), ep.role
+		FROM event_participants ep
+		LEFT JOIN users u ON u.id = ep.user_id
+		WHERE ep.event_id = ?
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var uid, uname, availJSON, role string
+		var guest bool
+		if err := rows.Scan(&uid, &uname, &guest, &availJSON, &role); err == nil {
+			partAvail := map[string]bool{}
+			if err := json.Unmarshal([]byte(availJSON), &partAvail); err != nil {
+				return nil, err
+			}
+			part := map[string]interface{}{
+				"id":           uid,
+				"name":         uname,
+				"availability": partAvail,
+			}
+			setParticipantIdentity(part, uid, uname)
+			if guest {
+				part["guest"] = true
+			} else {
+				part["role"] = role
+			}
+			s.parts = append(s.parts, part)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	s.disabled = []string{}
+	if err := json.Unmarshal([]byte(s.ev.DisabledSlots), &s.disabled); err != nil {
+		return nil, err
+	}
+	s.tags = []string{}
+	_ = json.Unmarshal([]byte(tagsJSON), &s.tags)
+	if s.shortlist, err = eventShortlist(ctx, id); err != nil {
+		return nil, err
+	}
+	if s.holidayRegion != "" {
+		s.holidays = eventHolidays(ctx, s.ev, s.holidayRegion)
+	}
+	return s, nil
+}
+
+func updateEventHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	id := c.Param("id")
+	userID := ctxUserID(c)
+
+	var input EventUpdate
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+	if input.ID == "" || input.Name == "" || input.Duration <= 0 || input.Timezone == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required fields"})
+		return
+	}
+	tz, ok := validTimezone(input.Timezone)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid timezone"})
+		return
+	}
+	input.Timezone = tz
+
+	var creatorID, recurrence string
+	var finalized sql.NullString
+	err := db.QueryRowContext(ctx, `SELECT COALESCE(creator_id, ''), finalized_slot, recurrence FROM events WHERE id = ?`, id).Scan(&creatorID, &finalized, &recurrence)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	} else if err != nil {
+		logIfTimeout(err, "updateEvent: select creator")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	if recurrence == recurrenceWeekly {
+		input.DateRange = map[string]string{"from": "", "to": ""}
+	} else if input.DateRange == nil || input.DateRange["from"] == "" || input.DateRange["to"] == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required fields"})
+		return
+	}
+
+	role, err := eventRole(ctx, id, userID)
+	if err != nil {
+		serverError(c, "updateEvent: role", err)
+		return
+	}
+	if canManageEvent(role) {
+		disabledJSON, err := json.Marshal(normalizeSlotList(input.DisabledSlots))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+			return
+		}
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+			return
+		}
+		now := time.Now().UTC()
+
+		if _, err := tx.ExecContext(ctx, `
+			UPDATE events SET name = ?, date_from = ?, date_to = ?, duration = ?, timezone = ?, disabled_slots = ?, updated_at = ?
+			WHERE id = ?
+		`, input.Name, input.DateRange["from"], input.DateRange["to"], input.Duration, input.Timezone, string(disabledJSON), now, id); err != nil {
+			tx.Rollback()
+			logIfTimeout(err, "updateEvent: update event")
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+			return
+		}
+		if input.Public != nil {
+			if _, err := tx.ExecContext(ctx, `UPDATE events SET is_public = ? WHERE id = ?`, *input.Public, id); err != nil {
+				tx.Rollback()
+				logIfTimeout(err, "updateEvent: update public")
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+				return
+			}
+			cdnPurge(publicEventsSurrogateKey)
+		}
+		if input.Passphrase != nil {
+			var passHash sql.NullString
+			if *input.Passphrase != "" {
+				if len(*input.Passphrase) < 4 {
+					tx.Rollback()
+					c.JSON(http.StatusBadRequest, gin.H{"error": "Passphrase too short"})
+					return
+				}
+				h, err := bcrypt.GenerateFromPassword([]byte(*input.Passphrase), 12)
+				if err != nil {
+					tx.Rollback()
+					serverError(c, "updateEvent: hash passphrase", err)
+					return
+				}
+				passHash = sql.NullString{String: string(h), Valid: true}
+			}
+			if _, err := tx.ExecContext(ctx, `UPDATE events SET passphrase_hash = ? WHERE id = ?`, passHash, id); err != nil {
+				tx.Rollback()
+				logIfTimeout(err, "updateEvent: update passphrase")
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+				return
+			}
+		}
+		if input.HolidayRegion != nil {
+			region := strings.ToUpper(strings.TrimSpace(*input.HolidayRegion))
+			if region != "" && !holidayRegionRe.MatchString(region) {
+				tx.Rollback()
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid holiday region"})
+				return
+			}
+			if _, err := tx.ExecContext(ctx, `UPDATE events SET holiday_region = ? WHERE id = ?`, region, id); err != nil {
+				tx.Rollback()
+				logIfTimeout(err, "updateEvent: update holiday region")
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+				return
+			}
+		}
+		if input.AutoFinalize != nil {
+			if _, err := tx.ExecContext(ctx, `UPDATE events SET auto_finalize = ? WHERE id = ?`, *input.AutoFinalize, id); err != nil {
+				tx.Rollback()
+				serverError(c, "updateEvent: update auto finalize", err)
+				return
+			}
+		}
+		if input.GuestMode != nil {
+			if _, err := tx.ExecContext(ctx, `UPDATE events SET guest_mode = ? WHERE id = ?`, *input.GuestMode, id); err != nil {
+				tx.Rollback()
+				serverError(c, "updateEvent: update guest mode", err)
+				return
+			}
+		}
+		if input.BookingMode != nil {
+			if _, err := tx.ExecContext(ctx, `UPDATE events SET booking_mode = ? WHERE id = ?`, *input.BookingMode, id); err != nil {
+				tx.Rollback()
+				serverError(c, "updateEvent: update booking mode", err)
+				return
+			}
+		}
+		if input.Deadline != nil {
+			deadline, err := parseResponseDeadline(*input.Deadline)
+			if err != nil {
+				tx.Rollback()
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			if _, err := tx.ExecContext(ctx, `UPDATE events SET response_deadline = ? WHERE id = ?`, deadline, id); err != nil {
+				tx.Rollback()
+				serverError(c, "updateEvent: update deadline", err)
+				return
+			}
+		}
+		if input.Tags != nil {
+			tagsJSON, _ := json.Marshal(normalizeTags(input.Tags))
+			if _, err := tx.ExecContext(ctx, `UPDATE events SET tags = ? WHERE id = ?`, string(tagsJSON), id); err != nil {
+				tx.Rollback()
+				logIfTimeout(err, "updateEvent: update tags")
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+				return
+			}
+		}
+
+		var releases []participantRelease
+		if len(input.Participants) > 0 {
+			// Guests are keyed by their participant row ID, account participants by user ID.
+			// Rows that stay are updated in place so their join time, join channel, muted
+			// reminders and row ID survive the edit; accounts missing from the list are removed.
+			prevAvail := map[string]map[string]bool{}
+			guests := map[string]bool{}
+			roles := map[string]string{}
+			rows, err := tx.QueryContext(ctx, `SELECT COALESCE(user_id, id), user_id IS NULL, unseal(availability), role FROM event_participants WHERE event_id = ?`, id)
+			if err != nil {
+				tx.Rollback()
+				logIfTimeout(err, "updateEvent: select participants")
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+				return
+			}
+			for rows.Next() {
+				var pid, availJSON, prevRole string
+				var guest bool
+				if err := rows.Scan(&pid, &guest, &availJSON, &prevRole); err != nil {
+					continue
+				}
+				m := map[string]bool{}
+				_ = json.Unmarshal([]byte(availJSON), &m)
+				prevAvail[pid] = m
+				guests[pid] = guest
+				roles[pid] = prevRole
+			}
+			rows.Close()
+			kept := map[string]bool{}
+			for _, p := range input.Participants {
+				pid, _ := p["id"].(string)
+				if pid == "" {
+					continue
+				}
+				avail := map[string]bool{}
+				if raw, ok := p["availability"].(map[string]interface{}); ok {
+					for k, v := range raw {
+						if b, ok := v.(bool); ok && b {
+							avail[k] = true
+						}
+					}
+				}
+				avail, _ = freezePastSlots(prevAvail[pid], avail, now)
+				availJSON, err := json.Marshal(avail)
+				if err != nil {
+					tx.Rollback()
+					c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+					return
+				}
+				if prevJSON, _ := json.Marshal(prevAvail[pid]); prevAvail[pid] != nil && string(prevJSON) != string(availJSON) {
+					if finalized.Valid {
+						tx.Rollback()
+						finalizedConflict(c)
+						return
+					}
+					if err := recordAvailabilityChange(ctx, tx, id, pid, userID, string(availJSON), "", now); err != nil {
+						tx.Rollback()
+						serverError(c, "updateEvent: record history", err)
+						return
+					}
+				}
+				if guests[pid] {
+					if _, err := tx.ExecContext(ctx, `UPDATE event_participants SET availability = seal(?), updated_at = ? WHERE id = ? AND event_id = ?`, string(availJSON), now, pid, id); err != nil {
+						tx.Rollback()
+						logIfTimeout(err, "updateEvent: update guest")
+						c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+						return
+					}
+					continue
+				}
+				kept[pid] = true
+				pRole, existing := roles[pid]
+				if pid == creatorID {
+					pRole = roleOwner
+				} else if pRole == "" || pRole == roleOwner {
+					pRole = roleParticipant
+				}
+				if existing {
+					if _, err := tx.ExecContext(ctx, `
+						UPDATE event_participants SET availability = seal(?), role = ?, updated_at = ? WHERE event_id = ? AND user_id = ?
+					`, string(availJSON), pRole, now, id, pid); err != nil {
+						tx.Rollback()
+						logIfTimeout(err, "updateEvent: update participants")
+						c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+						return
+					}
+					continue
+				}
+				if _, err := tx.ExecContext(ctx, `
+					INSERT INTO event_participants(id, event_id, user_id, availability, draft_availability, draft_disabled_slots, draft_updated_at, role, created_at, updated_at)
+					VALUES (?,?,?,seal(?),?,?,NULL,?,?,?)
+				`, uuid.NewString(), id, pid, string(availJSON), "{}", "[]", pRole, now, now); err != nil {
+					tx.Rollback()
+					logIfTimeout(err, "updateEvent: insert participants")
+					c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+					return
+				}
+				roles[pid] = pRole
+			}
+			// Account participants missing from the list were removed.
+			for pid := range roles {
+				if guests[pid] || kept[pid] {
+					continue
+				}
+				if _, err := tx.ExecContext(ctx, `DELETE FROM event_participants WHERE event_id = ? AND user_id = ?`, id, pid); err != nil {
+					tx.Rollback()
+					logIfTimeout(err, "updateEvent: delete participants")
+					c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+					return
+				}
+				released, err := releaseParticipant(ctx, tx, id, pid)
+				if err != nil {
+					tx.Rollback()
+					serverError(c, "updateEvent: release removed participant", err)
+					return
+				}
+				releases = append(releases, released)
+			}
+			if err := dropAggregate(ctx, tx, id); err != nil {
+				tx.Rollback()
+				serverError(c, "updateEvent: drop aggregate", err)
+				return
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+			return
+		}
+		for _, released := range releases {
+			released.notify(ctx)
+		}
+
+		ssePublish(id, []byte(`{"type":"event_updated","id":"`+id+`"}`))
+		checkResponseMilestones(ctx, id)
+		c.JSON(http.StatusOK, gin.H{"status": "updated"})
+		return
+	}
+
+	var count int
+	_ = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM event_participants WHERE event_id = ? AND user_id = ?`, id, userID).Scan(&count)
+	if count == 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden: Not a participant"})
+		return
+	}
+
+	var incomingAvail map[string]bool
+	for _, p := range input.Participants {
+		if pid, ok := p["id"].(string); ok && pid == userID {
+			if raw, ok := p["availability"].(map[string]interface{}); ok {
+				incomingAvail = map[string]bool{}
+				for k, v := range raw {
+					if b, ok := v.(bool); ok && b {
+						incomingAvail[k] = true
+					}
+				}
+			}
+			break
+		}
+	}
+	if incomingAvail == nil {
+		c.JSON(http.StatusOK, gin.H{"status": "no changes"})
+		return
+	}
+	if finalized.Valid {
+		finalizedConflict(c)
+		return
+	}
+	for k := range incomingAvail {
+		valid := validSlotKeySyntax(k)
+		if recurrence == recurrenceWeekly {
+			valid = validWeeklySlot(k, input.Duration)
+		}
+		if !valid {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid slot " + k})
+			return
+		}
+	}
+	var prevJSON string
+	if err := db.QueryRowContext(ctx, `SELECT unseal(availability) FROM event_participants WHERE event_id = ? AND user_id = ?`, id, userID).Scan(&prevJSON); err != nil {
+		logIfTimeout(err, "updateEvent: select availability")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	prevAvail := map[string]bool{}
+	_ = json.Unmarshal([]byte(prevJSON), &prevAvail)
+	now := time.Now().UTC()
+	incomingAvail, ignored := freezePastSlots(prevAvail, incomingAvail, now)
+	availJSON, err := json.Marshal(incomingAvail)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	if _, err := db.ExecContext(ctx, `
+		UPDATE event_participants SET availability = seal(?), updated_at = ?, draft_availability = '{}', draft_disabled_slots = '[]', draft_updated_at = NULL WHERE event_id = ? AND user_id = ?
+	`, string(availJSON), now, id, userID); err != nil {
+		logIfTimeout(err, "updateEvent: update availability")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	if err := recordAvailabilityChange(ctx, db, id, userID, userID, string(availJSON), "", now); err != nil {
+		logIfTimeout(err, "updateEvent: record history")
+	}
+	if err := adjustAggregate(ctx, db, id, prevAvail, incomingAvail); err != nil {
+		logIfTimeout(err, "updateEvent: adjust aggregate")
+	}
+
+	ssePublish(id, []byte(`{"type":"event_updated","id":"`+id+`"}`))
+	checkResponseMilestones(ctx, id)
+	resp := gin.H{"status": "updated", "undoUntil": now.Add(availabilityUndoWindow)}
+	if ignored > 0 {
+		resp["pastSlotsIgnored"] = ignored
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// eventDataTables clears everything keyed by one event. Like accountDataTables it
+// doesn't rely on ON DELETE CASCADE: the driver doesn't enforce foreign keys, so every
+// child table is listed; a new table with an event_id column belongs here.
+var eventDataTables = []string{
+	`DELETE FROM event_participants WHERE event_id = ?`,
+	`DELETE FROM event_invites WHERE event_id = ?`,
+	`DELETE FROM event_invite_links WHERE event_id = ?`,
+	`DELETE FROM event_short_links WHERE event_id = ?`,
+	`DELETE FROM event_kiosk_tokens WHERE event_id = ?`,
+	`DELETE FROM event_seen WHERE event_id = ?`,
+	`DELETE FROM event_watches WHERE event_id = ?`,
+	`DELETE FROM event_milestones WHERE event_id = ?`,
+	`DELETE FROM event_shortlist WHERE event_id = ?`,
+	`DELETE FROM event_attendance WHERE event_id = ?`,
+	`DELETE FROM event_shift_claims WHERE event_id = ?`,
+	`DELETE FROM event_shifts WHERE event_id = ?`,
+	`DELETE FROM event_bookings WHERE event_id = ?`,
+	`DELETE FROM event_booking_waitlist WHERE event_id = ?`,
+	`DELETE FROM event_confirmations WHERE event_id = ?`,
+	`DELETE FROM event_edit_locks WHERE event_id = ?`,
+	`DELETE FROM email_notifications_sent WHERE event_id = ?`,
+	`DELETE FROM availability_history WHERE event_id = ?`,
+	`DELETE FROM event_slot_counts WHERE event_id = ?`,
+	`DELETE FROM event_aggregates WHERE event_id = ?`,
+	`DELETE FROM events WHERE id = ?`,
+}
+
+// deleteEventRows removes an event and all its rows; run it inside the caller's
+// transaction. Archived history lives in the archive store and is cleared with
+// deleteArchivedEventHistory after commit.
+func deleteEventRows(ctx context.Context, exec sqlExecer, eventID string) error {
+	for _, q := range eventDataTables {
+		if _, err := exec.ExecContext(ctx, q, eventID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteArchivedEventHistory(ctx context.Context, eventID string) {
+	relinkArchivedHistory(ctx, `DELETE FROM availability_history_archive WHERE event_id = ?`, eventID)
+}
+
+func deleteEventHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	id := c.Param("id")
+	userID := ctxUserID(c)
+
+	role, err := eventRole(ctx, id, userID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	} else if err != nil {
+		logIfTimeout(err, "deleteEvent: select creator")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	if role != roleOwner {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the owner can delete"})
+		return
+	}
+	// The delete removes the participants too, so build the calendar cancellations first.
+	cancellations, err := finalizationEmails(ctx, id, "CANCEL", 1)
+	if err != nil {
+		logIfTimeout(err, "deleteEvent: cancellations")
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		serverError(c, "deleteEvent: begin", err)
+		return
+	}
+	defer tx.Rollback()
+	if err := deleteEventRows(ctx, tx, id); err != nil {
+		serverError(c, "deleteEvent: delete", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		serverError(c, "deleteEvent: commit", err)
+		return
+	}
+	deleteArchivedEventHistory(ctx, id)
+
+	for _, m := range cancellations {
+		if err := enqueueEmail(m); err != nil {
+			log.Printf("deleteEvent: queue cancellation: %v", err)
+		}
+	}
+
+	ssePublish(id, []byte(`{"type":"event_deleted","id":"`+id+`"}`))
+	c.JSON(http.StatusOK, gin.H{"message": "Deleted"})
+}
+
+func updateEventDraftHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	eventID := c.Param("id")
+	userID := ctxUserID(c)
+
+	var creatorID string
+	err := db.QueryRowContext(ctx, `SELECT COALESCE(creator_id, '') FROM events WHERE id = ?`, eventID).Scan(&creatorID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	} else if err != nil {
+		serverError(c, "updateDraft: select event", err)
+		return
+	}
+
+	var exists int
+	_ = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM event_participants WHERE event_id = ? AND user_id = ?`, eventID, userID).Scan(&exists)
+	if exists == 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not a participant"})
+		return
+	}
+
+	var input struct {
+		Availability  map[string]bool `json:"availability"`
+		DisabledSlots []string        `json:"disabledSlots"`
+	}
+	if err := c.BindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+
+	availJSON, err := json.Marshal(input.Availability)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid availability"})
+		return
+	}
+	disabledJSON := "[]"
+	if userID == creatorID {
+		if input.DisabledSlots == nil {
+			input.DisabledSlots = []string{}
+		}
+		if b, err := json.Marshal(input.DisabledSlots); err == nil {
+			disabledJSON = string(b)
+		}
+	}
+
+	now := time.Now().UTC()
+	if _, err := db.ExecContext(ctx, `
+		UPDATE event_participants
+		SET draft_availability = seal(?), draft_disabled_slots = ?, draft_updated_at = ?
+		WHERE event_id = ? AND user_id = ?
+	`, string(availJSON), disabledJSON, now, eventID, userID); err != nil {
+		serverError(c, "updateDraft: update", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": "draft saved"})
+}
+
+func deleteEventDraftHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	eventID := c.Param("id")
+	userID := ctxUserID(c)
+
+	if _, err := db.ExecContext(ctx, `
+		UPDATE event_participants
+		SET draft_availability = '{}', draft_disabled_slots = '[]', draft_updated_at = NULL
+		WHERE event_id = ? AND user_id = ?
+	`, eventID, userID); err != nil {
+		serverError(c, "deleteDraft: update", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "draft cleared"})
+}
+
+func inviteHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	id := c.Param("id")
+	creatorID := ctxUserID(c)
+	var body struct {
+		Username string `json:"username"`
+		Message  string `json:"message"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	message, ok := sanitizeInviteMessage(body.Message)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Message too long"})
+		return
+	}
+
+	role, err := eventRole(ctx, id, creatorID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+			return
+		}
+		logIfTimeout(err, "invite: select creator")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	if !canManageEvent(role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only organizers can invite"})
+		return
+	}
+	if !enforceNewAccountLimit(c, ctx, creatorID, "invites") {
+		return
+	}
+
+	var targetID string
+	var emailVerified int
+	err = db.QueryRowContext(ctx, `SELECT id, email_verified FROM users WHERE username = ? AND merged_into IS NULL AND deactivated_at IS NULL AND tenant_id = ?`, body.Username, requestTenant(c)).Scan(&targetID, &emailVerified)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	} else if err != nil {
+		logIfTimeout(err, "invite: select user")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	if emailVerified == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User must verify their email first"})
+		return
+	}
+
+	if targetID == creatorID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot invite yourself"})
+		return
+	}
+
+	switch err := createEventInvite(ctx, id, creatorID, targetID, message); {
+	case errors.Is(err, errAlreadyParticipant):
+		c.JSON(http.StatusConflict, gin.H{"error": "User already in event"})
+		return
+	case errors.Is(err, errInviteExists):
+		c.JSON(http.StatusConflict, gin.H{"error": "Invite already sent"})
+		return
+	case err != nil:
+		logIfTimeout(err, "invite: insert invite")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Invite sent"})
+}
+
+var (
+	errAlreadyParticipant = errors.New("already a participant")
+	errInviteExists       = errors.New("invite already pending")
+)
+
+// maxInviteMessageLen caps the personal message on an invite, in characters.
+const maxInviteMessageLen = 500
+
+// sanitizeInviteMessage trims the message and drops control characters other than line
+// breaks. It reports false when the result is longer than maxInviteMessageLen. The text is
+// stored as given and escaped wherever it is rendered.
+func sanitizeInviteMessage(raw string) (string, bool) {
+	msg := strings.Map(func(r rune) rune {
+		if r == '\n' {
+			return r
+		}
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, strings.ReplaceAll(raw, "\r\n", "\n"))
+	msg = strings.TrimSpace(msg)
+	return msg, utf8.RuneCountInString(msg) <= maxInviteMessageLen
+}
+
+// createEventInvite records a pending invite unless the user is already in the event or
+// invited, then emails the invitee.
+func createEventInvite(ctx context.Context, eventID, inviterID, targetID, message string) error {
+	var exists int
+	_ = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM event_participants WHERE event_id = ? AND user_id = ?`, eventID, targetID).Scan(&exists)
+	if exists > 0 {
+		return errAlreadyParticipant
+	}
+	var inviteExists int
+	_ = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM event_invites WHERE event_id = ? AND invitee_id = ? AND status = 'pending'`, eventID, targetID).Scan(&inviteExists)
+	if inviteExists > 0 {
+		return errInviteExists
+	}
+	now := time.Now().UTC()
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO event_invites(id, event_id, inviter_id, invitee_id, status, message, created_at, updated_at)
+		VALUES (?,?,?,?,'pending',?,?,?)
+	`, uuid.NewString(), eventID, inviterID, targetID, message, now, now); err != nil {
+		return err
+	}
+	sendInviteEmail(ctx, eventID, inviterID, targetID, message)
+	return nil
+}
+
+// sendInviteEmail tells a verified invitee about a new invite, quoting the inviter's
+// message. Invitees who turned invite emails off in their notification preferences are
+// skipped. Failures are logged; the invite itself already exists.
+func sendInviteEmail(ctx context.Context, eventID, inviterID, targetID, message string) {
+	var inviter, eventName, dateFrom, dateTo, tz, recurrence, email, locale string
+	var verified bool
+	err := db.QueryRowContext(ctx, `
+		SELECT (SELECT username FROM users WHERE id = ?), e.name, e.date_from, e.date_to, e.timezone, e.recurrence, unseal(u.email), u.email_verified, u.locale
+		FROM users u, events e WHERE u.id = ? AND e.id = ?
+	`, inviterID, targetID, eventID).Scan(&inviter, &eventName, &dateFrom, &dateTo, &tz, &recurrence, &email, &verified, &locale)
+	if err != nil {
+		logIfTimeout(err, "inviteEmail: select")
+		return
+	}
+	if !verified || email == "" {
+		return
+	}
+	prefs, err := loadNotificationPreferences(ctx, targetID)
+	if err != nil {
+		logIfTimeout(err, "inviteEmail: preferences")
+		return
+	}
+	if !prefs.InviteEmails {
+		metricInc("plannie_email_suppressed_total", "category", emailCategoryInvites)
+		return
+	}
+	locale = resolveLocale(locale)
+	link := appBaseURL() + "/event/" + eventID + "?via=" + joinChannelEmail
+	dates := formatLocalDateRange(dateFrom, dateTo, tz, locale)
+	if recurrence == recurrenceWeekly {
+		dates = formatWeeklyPoll(locale)
+	}
+	messageHTML := ""
+	if message != "" {
+		messageHTML = "<p><em>" + strings.ReplaceAll(html.EscapeString(message), "\n", "<br>") + "</em></p>"
+	}
+	invitesLink := appBaseURL() + "/dashboard?via=" + joinChannelEmail
+	subject, _ := localizedEmail(locale, "event_invite", inviter, eventName, link, "", dates, invitesLink)
+	_, body := localizedEmail(locale, "event_invite", html.EscapeString(inviter), html.EscapeString(eventName), link, messageHTML, html.EscapeString(dates), invitesLink)
+	if err := sendNonEssentialEmail(ctx, emailCategoryInvites, targetID, email, subject, body); err != nil {
+		log.Printf("inviteEmail: queue: %v", err)
+	}
+}
+
+func joinHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	id := c.Param("id")
+	userID := ctxUserID(c)
+
+	var passHash sql.NullString
+	err := db.QueryRowContext(ctx, `SELECT passphrase_hash FROM events WHERE id = ?`, id).Scan(&passHash)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	} else if err != nil {
+		logIfTimeout(err, "join: select event")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	if !eventAccessAllowed(ctx, c, id, passHash, userID) {
+		passphraseRequired(c)
+		return
+	}
+	var exists int
+	_ = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM event_participants WHERE event_id = ? AND user_id = ?`, id, userID).Scan(&exists)
+	if exists > 0 {
+		c.JSON(http.StatusOK, gin.H{"message": "Already joined"})
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	now := time.Now().UTC()
+	if _, err := tx.ExecContext(ctx, `INSERT INTO event_participants(id, event_id, user_id, availability, draft_availability, draft_disabled_slots, draft_updated_at, join_channel, created_at, updated_at)
+		VALUES (?,?,?,?,?,?,NULL,?,?,?)`, uuid.NewString(), id, userID, "{}", "{}", "[]", joinChannel(c, joinChannelLink), now, now); err != nil {
+		tx.Rollback()
+		logIfTimeout(err, "join: insert participant")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	ssePublish(id, []byte(`{"type":"event_updated","id":"`+id+`"}`))
+	c.JSON(http.StatusOK, gin.H{"message": "Joined"})
+}
+
+// Invite links let organizers share one code instead of inviting people by name. A code is
+// "<link id>.<secret>"; like email_tokens only a hash of the secret is stored, so a
+// code can't be recovered after creation. Joining by code skips the event passphrase.
+const (
+	defaultInviteLinkTTL = 7 * 24 * time.Hour
+	maxInviteLinkTTL     = 30 * 24 * time.Hour
+	maxInviteLinksEvent  = 20
+)
+
+func createInviteLinkHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	eventID, userID := c.Param("id"), ctxUserID(c)
+	var input struct {
+		TTLHours int `json:"ttlHours"`
+		MaxUses  int `json:"maxUses"`
+	}
+	_ = c.ShouldBindJSON(&input)
+	ttl := defaultInviteLinkTTL
+	if input.TTLHours != 0 {
+		ttl = time.Duration(input.TTLHours) * time.Hour
+	}
+	if ttl <= 0 || ttl > maxInviteLinkTTL || input.MaxUses < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ttlHours must be between 1 and 720 and maxUses not negative"})
+		return
+	}
+	role, err := eventRole(ctx, eventID, userID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	} else if err != nil {
+		serverError(c, "createInviteLink: role", err)
+		return
+	}
+	if !canManageEvent(role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only organizers can invite"})
+		return
+	}
+	now := time.Now().UTC()
+	var active int
+	_ = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM event_invite_links WHERE event_id = ? AND revoked_at IS NULL AND expires_at > ?`, eventID, now).Scan(&active)
+	if active >= maxInviteLinksEvent {
+		c.JSON(http.StatusConflict, gin.H{"error": "Too many active invite links"})
+		return
+	}
+
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		serverError(c, "createInviteLink: random", err)
+		return
+	}
+	secret := base64.RawURLEncoding.EncodeToString(buf)
+	hashed, err := hashToken(secret)
+	if err != nil {
+		serverError(c, "createInviteLink: hash", err)
+		return
+	}
+	id := uuid.NewString()
+	expires := now.Add(ttl)
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO event_invite_links(id, event_id, created_by, token_hash, max_uses, uses, expires_at, created_at) VALUES (?,?,?,?,?,0,?,?)
+	`, id, eventID, userID, hashed, input.MaxUses, expires, now); err != nil {
+		serverError(c, "createInviteLink: insert", err)
+		return
+	}
+	code := id + "." + secret
+	c.JSON(http.StatusCreated, gin.H{
+		"id":        id,
+		"code":      code,
+		"url":       appBaseURL() + "/join?code=" + url.QueryEscape(code),
+		"maxUses":   input.MaxUses,
+		"expiresAt": expires,
+	})
+}
+
+// listInviteLinksHandler returns the event's links that can still be used.
+func listInviteLinksHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	eventID := c.Param("id")
+	role, err := eventRole(ctx, eventID, ctxUserID(c))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	} else if err != nil {
+		serverError(c, "listInviteLinks: role", err)
+		return
+	}
+	if !canManageEvent(role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only organizers can manage invite links"})
+		return
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT l.id, u.username, l.max_uses, l.uses, l.expires_at, l.created_at
+		FROM event_invite_links l LEFT JOIN users u ON u.id = l.created_by
+		WHERE l.event_id = ? AND l.revoked_at IS NULL AND l.expires_at > ? AND (l.max_uses = 0 OR l.uses < l.max_uses)
+		ORDER BY l.created_at DESC
+	`, eventID, time.Now().UTC())
+	if err != nil {
+		serverError(c, "listInviteLinks: query", err)
+		return
+	}
+	defer rows.Close()
+	out := []gin.H{}
+	for rows.Next() {
+		var id string
+		var createdBy sql.NullString
+		var maxUses, uses int
+		var expires, created time.Time
+		if err := rows.Scan(&id, &createdBy, &maxUses, &uses, &expires, &created); err != nil {
+			serverError(c, "listInviteLinks: scan", err)
+			return
+		}
+		out = append(out, gin.H{"id": id, "createdBy": createdBy.String, "maxUses": maxUses, "uses": uses, "expiresAt": expires, "createdAt": created})
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+func revokeInviteLinkHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	eventID := c.Param("id")
+	role, err := eventRole(ctx, eventID, ctxUserID(c))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	} else if err != nil {
+		serverError(c, "revokeInviteLink: role", err)
+		return
+	}
+	if !canManageEvent(role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only organizers can manage invite links"})
+		return
+	}
+	res, err := db.ExecContext(ctx, `
+		UPDATE event_invite_links SET revoked_at = ? WHERE id = ? AND event_id = ? AND revoked_at IS NULL
+	`, time.Now().UTC(), c.Param("linkId"), eventID)
+	if err != nil {
+		serverError(c, "revokeInviteLink: update", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Revoked"})
+}
+
+// joinByCodeHandler adds the caller to the event behind an invite link code.
+func joinByCodeHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	userID := ctxUserID(c)
+	var input struct {
+		Code string `json:"code"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+	linkID, secret, ok := strings.Cut(strings.TrimSpace(input.Code), ".")
+	if !ok || linkID == "" || secret == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid code"})
+		return
+	}
+	// The path carries no event ID, so eventTenantMiddleware doesn't see this route: the
+	// tenant and quick-poll expiry are checked here.
+	var eventID, tokenHash, tenantID string
+	var maxUses, uses int
+	var expires time.Time
+	var revoked, eventExpires sql.NullTime
+	err := db.QueryRowContext(ctx, `
+		SELECT l.event_id, l.token_hash, l.max_uses, l.uses, l.expires_at, l.revoked_at, e.tenant_id, e.expires_at
+		FROM event_invite_links l JOIN events e ON e.id = l.event_id WHERE l.id = ?
+	`, linkID).Scan(&eventID, &tokenHash, &maxUses, &uses, &expires, &revoked, &tenantID, &eventExpires)
+	if err == nil && tenantID != requestTenant(c) {
+		err = sql.ErrNoRows
+	}
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invalid code"})
+		return
+	} else if err != nil {
+		serverError(c, "joinByCode: select link", err)
+		return
+	}
+	if err := verifyTokenHash(tokenHash, secret); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invalid code"})
+		return
+	}
+	if revoked.Valid || time.Now().After(expires) || (maxUses > 0 && uses >= maxUses) {
+		c.JSON(http.StatusGone, gin.H{"error": "This invite link is no longer valid"})
+		return
+	}
+	if eventExpires.Valid && eventExpires.Time.Before(time.Now()) {
+		c.JSON(http.StatusGone, gin.H{"error": "Event expired"})
+		return
+	}
+	var exists int
+	_ = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM event_participants WHERE event_id = ? AND user_id = ?`, eventID, userID).Scan(&exists)
+	if exists > 0 {
+		c.JSON(http.StatusOK, gin.H{"message": "Already joined", "eventId": eventID})
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	defer tx.Rollback()
+	now := time.Now().UTC()
+	res, err := tx.ExecContext(ctx, `
+		UPDATE event_invite_links SET uses = uses + 1 WHERE id = ? AND revoked_at IS NULL AND (max_uses = 0 OR uses < max_uses)
+	`, linkID)
+	if err != nil {
+		serverError(c, "joinByCode: count use", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusGone, gin.H{"error": "This invite link is no longer valid"})
+		return
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO event_participants(id, event_id, user_id, availability, draft_availability, draft_disabled_slots, draft_updated_at, join_channel, created_at, updated_at)
+		VALUES (?,?,?,?,?,?,NULL,?,?,?)`, uuid.NewString(), eventID, userID, "{}", "{}", "[]", joinChannelLink, now, now); err != nil {
+		serverError(c, "joinByCode: insert participant", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		serverError(c, "joinByCode: commit", err)
+		return
+	}
+
+	metricInc("plannie_invite_link_joins_total")
+	ssePublish(eventID, []byte(`{"type":"event_updated","id":"`+eventID+`"}`))
+	c.JSON(http.StatusOK, gin.H{"message": "Joined", "eventId": eventID})
+}
+
+// Join channels record how each participant came to an event, so organizers can compare
+// response rates per invitation method: "email" when they followed an invite email (its
+// links carry ?via=email, which the client passes on to join or accept), "share_link"
+// for invite codes, shared event URLs and guest answers, and "in_app" for invites
+// accepted from the dashboard. Participants from before tracking, and those the
+// organizers added themselves, have no channel.
+const (
+	joinChannelEmail = "email"
+	joinChannelLink  = "share_link"
+	joinChannelInApp = "in_app"
+)
+
+var joinChannels = []string{joinChannelEmail, joinChannelLink, joinChannelInApp}
+
+// joinChannel returns the channel named by ?via=, or fallback when it names none.
+func joinChannel(c *gin.Context, fallback string) string {
+	via := c.Query("via")
+	for _, ch := range joinChannels {
+		if via == ch {
+			return ch
+		}
+	}
+	return fallback
+}
+
+type channelStats struct {
+	Channel      string  `json:"channel"`
+	Participants int     `json:"participants"`
+	Responded    int     `json:"responded"`
+	ResponseRate float64 `json:"responseRate"`
+}
+
+// eventStatsHandler reports response rates per join channel (organizers only). The owner
+// is not counted; participants without a channel are grouped as "unknown".
+func eventStatsHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	eventID := c.Param("id")
+	role, err := eventRole(ctx, eventID, ctxUserID(c))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	} else if err != nil {
+		serverError(c, "eventStats: role", err)
+		return
+	}
+	if !canManageEvent(role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only organizers can view stats"})
+		return
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT join_channel, unseal(availability), unavailable_at IS NOT NULL
+		FROM event_participants WHERE event_id = ? AND role <> ?
+	`, eventID, roleOwner)
+	if err != nil {
+		serverError(c, "eventStats: select participants", err)
+		return
+	}
+	defer rows.Close()
+	byChannel := map[string]*channelStats{}
+	for _, ch := range append(joinChannels, "unknown") {
+		byChannel[ch] = &channelStats{Channel: ch}
+	}
+	total := channelStats{Channel: "all"}
+	for rows.Next() {
+		var ch, availJSON string
+		var unavailable bool
+		if err := rows.Scan(&ch, &availJSON, &unavailable); err != nil {
+			serverError(c, "eventStats: scan", err)
+			return
+		}
+		s, ok := byChannel[ch]
+		if !ok {
+			s = byChannel["unknown"]
+		}
+		avail := map[string]bool{}
+		_ = json.Unmarshal([]byte(availJSON), &avail)
+		responded := len(avail) > 0 || unavailable
+		for _, agg := range []*channelStats{s, &total} {
+			agg.Participants++
+			if responded {
+				agg.Responded++
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		serverError(c, "eventStats: rows", err)
+		return
+	}
+
+	channels := []channelStats{}
+	for _, ch := range append(joinChannels, "unknown") {
+		s := byChannel[ch]
+		if s.Participants > 0 {
+			s.ResponseRate = float64(s.Responded) / float64(s.Participants)
+		}
+		channels = append(channels, *s)
+	}
+	if total.Participants > 0 {
+		total.ResponseRate = float64(total.Responded) / float64(total.Participants)
+	}
+	c.JSON(http.StatusOK, gin.H{"channels": channels, "total": total})
+}
+
+func leaveHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	id := c.Param("id")
+	userID := ctxUserID(c)
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		serverError(c, "leave: begin", err)
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, `DELETE FROM event_participants WHERE event_id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		logIfTimeout(err, "leave: delete")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	affected, _ := res.RowsAffected()
+	if affected == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Not in event"})
+		return
+	}
+	released, err := releaseParticipant(ctx, tx, id, userID)
+	if err != nil {
+		serverError(c, "leave: release", err)
+		return
+	}
+	if err := dropAggregate(ctx, tx, id); err != nil {
+		serverError(c, "leave: drop aggregate", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		serverError(c, "leave: commit", err)
+		return
+	}
+	released.notify(ctx)
+
+	ssePublish(id, []byte(`{"type":"event_updated","id":"`+id+`"}`))
+	c.JSON(http.StatusOK, gin.H{"message": "Left event"})
+}
+
+// /my-events paging. Without ?limit= the whole (filtered) list is returned as before, so
+// existing clients keep working; with it the body is one page and X-Total-Count plus a
+// Link rel="next" header describe the rest.
+const maxMyEventsPage = 200
+
+// myEventsSorts maps ?sort= values to ORDER BY columns; a leading "-" sorts descending.
+var myEventsSorts = map[string]string{
+	"updated_at": "e.updated_at",
+	"created_at": "e.created_at",
+	"date_from":  "e.date_from",
+	"name":       "e.name COLLATE NOCASE",
+}
+
+// myEventsHandler lists the caller's events, own and joined. Filters: ?role=owner|
+// organizer|participant, ?status=upcoming|past (by the last date of the range, in UTC;
+// weekly polls are always upcoming) and ?q= (name substring). ?sort= is one of
+// myEventsSorts, default date_from.
+func myEventsHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	userID := ctxUserID(c)
+	where := `(e.creator_id = ? OR ep.user_id = ?)`
+	args := []interface{}{userID, userID}
+	switch c.Query("role") {
+	case "":
+	case roleOwner:
+		where += ` AND e.creator_id = ?`
+		args = append(args, userID)
+	case roleOrganizer:
+		where += ` AND COALESCE(e.creator_id, '') <> ? AND ep.role = 'organizer'`
+		args = append(args, userID)
+	case roleParticipant:
+		where += ` AND COALESCE(e.creator_id, '') <> ? AND ep.role = 'participant'`
+		args = append(args, userID)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be owner, organizer or participant"})
+		return
+	}
+	today := time.Now().UTC().Format("2006-01-02")
+	switch c.Query("status") {
+	case "":
+	case "upcoming":
+		where += ` AND (e.recurrence = 'weekly' OR e.date_to >= ?)`
+		args = append(args, today)
+	case "past":
+		where += ` AND e.recurrence <> 'weekly' AND e.date_to < ?`
+		args = append(args, today)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be upcoming or past"})
+		return
+	}
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		where += ` AND e.name LIKE ? ESCAPE '\'`
+		args = append(args, "%"+likeEscaper.Replace(q)+"%")
+	}
+	sortKey, dir := strings.TrimPrefix(c.DefaultQuery("sort", "date_from"), "-"), "ASC"
+	if strings.HasPrefix(c.Query("sort"), "-") {
+		dir = "DESC"
+	}
+	orderBy, ok := myEventsSorts[sortKey]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sort must be one of updated_at, created_at, date_from, name"})
+		return
+	}
+	limit, offset := 0, 0
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxMyEventsPage {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxMyEventsPage)})
+			return
+		}
+		limit = n
+	}
+	if v := c.Query("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "offset must be a non-negative integer"})
+			return
+		}
+		offset = n
+	}
+
+	day := ""
+	if c.Query("status") != "" {
+		day = today
+	}
+	etag, lastMod, err := myEventsValidators(ctx, userID, c.Request.URL.RawQuery, day)
+	if err != nil {
+		serverError(c, "myEvents: validators", err)
+		return
+	}
+	c.Header("Cache-Control", "private, no-cache")
+	c.Header("ETag", etag)
+	if !lastMod.IsZero() {
+		c.Header("Last-Modified", lastMod.UTC().Format(http.TimeFormat))
+	}
+	if listNotModified(c, etag, lastMod) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	from := `
+		FROM events e
+		LEFT JOIN event_participants ep ON ep.event_id = e.id AND ep.user_id = ?
+		WHERE ` + where
+	fromArgs := append([]interface{}{userID}, args...)
+	query := `
+		SELECT e.id, COALESCE(e.creator_id, ''), e.name, e.date_from, e.date_to, e.duration, e.timezone, e.disabled_slots,
+			CASE WHEN e.creator_id = ? THEN 1 ELSE 0 END as is_owner, COALESCE(ep.role, ''), e.updated_at` + from + `
+		ORDER BY ` + orderBy + ` ` + dir + `, e.id`
+	queryArgs := append([]interface{}{userID}, fromArgs...)
+	if limit > 0 {
+		var total int
+		if err := db.QueryRowContext(ctx, `SELECT COUNT(*)`+from, fromArgs...).Scan(&total); err != nil {
+			serverError(c, "myEvents: count", err)
+			return
+		}
+		c.Header("X-Total-Count", strconv.Itoa(total))
+		if offset+limit < total {
+			next := c.Request.URL.Query()
+			next.Set("offset", strconv.Itoa(offset+limit))
+			c.Header("Link", `<`+c.Request.URL.Path+`?`+next.Encode()+`>; rel="next"`)
+		}
+		query += ` LIMIT ? OFFSET ?`
+		queryArgs = append(queryArgs, limit, offset)
+	}
+	rows, err := db.QueryContext(ctx, query, queryArgs...)
+	if err != nil {
+		logIfTimeout(err, "myEvents: query")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	defer rows.Close()
+	out := []map[string]interface{}{}
+	for rows.Next() {
+		var ev Event
+		var isOwner int
+		var role string
+		var updated time.Time
+		if err := rows.Scan(&ev.ID, &ev.CreatorID, &ev.Name, &ev.DateFrom, &ev.DateTo, &ev.Duration, &ev.Timezone, &ev.DisabledSlots, &isOwner, &role, &updated); err == nil {
+			disabled := []string{}
+			if err := json.Unmarshal([]byte(ev.DisabledSlots), &disabled); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+				return
+			}
+			if isOwner == 1 {
+				role = roleOwner
+			}
+			out = append(out, map[string]interface{}{
+				"id":            ev.ID,
+				"creatorId":     ev.CreatorID,
+				"name":          ev.Name,
+				"dateRange":     gin.H{"from": ev.DateFrom, "to": ev.DateTo},
+				"duration":      ev.Duration,
+				"timezone":      ev.Timezone,
+				"disabledSlots": disabled,
+				"isOwner":       isOwner == 1,
+				"role":          role,
+				"updatedAt":     updated,
+			})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		logIfTimeout(err, "myEvents: rows err")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// myEventsValidators derives the ETag and Last-Modified for a user's /my-events listing
+// without loading the rows. Every field in the listing bumps events.updated_at when it
+// changes and joining adds a participant row; the row and ownership counts catch events
+// that were deleted, left or handed over, which leave no newer timestamp behind. variant
+// (the query string) keeps pages and filtered views apart. Role changes only touch the
+// participant row, so its updated_at counts too. day is the UTC date a status filter was
+// evaluated against (empty without one): the upcoming/past split moves at midnight with no
+// write behind it, so the date goes into the tag and Last-Modified is at least its start.
+func myEventsValidators(ctx context.Context, userID, variant, day string) (string, time.Time, error) {
+	var total, owned int
+	var maxEvent, maxJoined, maxPart sql.NullString
+	err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*), COALESCE(SUM(CASE WHEN e.creator_id = ? THEN 1 ELSE 0 END), 0),
+			MAX(e.updated_at), MAX(ep.created_at), MAX(ep.updated_at)
+		FROM events e
+		LEFT JOIN event_participants ep ON ep.event_id = e.id AND ep.user_id = ?
+		WHERE e.creator_id = ? OR ep.user_id = ?
+	`, userID, userID, userID, userID).Scan(&total, &owned, &maxEvent, &maxJoined, &maxPart)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	var lastMod time.Time
+	for _, raw := range []sql.NullString{maxEvent, maxJoined, maxPart} {
+		if t, ok := parseDBTime(raw.String); raw.Valid && ok && t.After(lastMod) {
+			lastMod = t
+		}
+	}
+	if t, err := time.Parse("2006-01-02", day); err == nil && t.After(lastMod) {
+		lastMod = t
+	}
+	sum := hashOpaqueToken(fmt.Sprintf("%s|%d|%d|%d|%s|%s", userID, total, owned, lastMod.UnixNano(), variant, day))
+	return `W/"` + sum[:32] + `"`, lastMod, nil
+}
+
+// listNotModified evaluates the conditional request headers. If-None-Match wins when
+// present; If-Modified-Since is only consulted when the client sent no entity tag.
+func listNotModified(c *gin.Context, etag string, lastMod time.Time) bool {
+	if inm := c.GetHeader("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := c.GetHeader("If-Modified-Since"); ims != "" && !lastMod.IsZero() {
+		if t, err := http.ParseTime(ims); err == nil {
+			return !lastMod.Truncate(time.Second).After(t)
+		}
+	}
+	return false
+}
+
+func verifyEmailHandler(c *gin.Context) {
+	tid := c.Query("tid")
+	raw := c.Query("t")
+	if tid == "" || raw == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing token"})
+		return
+	}
+	userID, err := verifyEmailTokenByID(tid, raw, "verify")
+	if err != nil {
+		appURL := os.Getenv("APP_BASE_URL")
+		if appURL == "" {
+			appURL = "http://localhost:3000"
+		}
+		c.Redirect(http.StatusFound, fmt.Sprintf("%s/verified?success=0", appURL))
+		return
+	}
+	if _, err := db.Exec(`UPDATE users SET email_verified = 1, updated_at = ? WHERE id = ?`, time.Now().UTC(), userID); err != nil {
+		logIfTimeout(err, "verifyEmail: update user")
+	} else {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+		if err := claimGuestResponses(ctx, userID); err != nil {
+			logIfTimeout(err, "verifyEmail: claim guest responses")
+		}
+		cancel()
+	}
+	appURL := os.Getenv("APP_BASE_URL")
+	if appURL == "" {
+		appURL = "http://localhost:3000"
+	}
+	c.Redirect(http.StatusFound, fmt.Sprintf("%s/verified?success=1", appURL))
+}
+
+func forgotPasswordHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+	var in struct {
+		EmailOrUsername string `json:"email"`
+	}
+	_ = c.BindJSON(&in)
+	var userID, email string
+	err := db.QueryRowContext(ctx, `SELECT id, unseal(email) FROM users WHERE (email = ? OR email_index = blind_index(?) OR username = ?) AND merged_into IS NULL AND tenant_id = ?`, in.EmailOrUsername, in.EmailOrUsername, in.EmailOrUsername, requestTenant(c)).
+		Scan(&userID, &email)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusOK, gin.H{"message": "If an account exists, we sent a reset link"})
+		return
+	} else if err != nil {
+		serverError(c, "forgotPassword: select user", err)
+		return
+	}
+	raw, tokenID, err := createEmailToken(userID, "reset", resetCodeTTL)
+	if err == nil {
+		appURL := os.Getenv("APP_BASE_URL")
+		if appURL == "" {
+			appURL = "http://localhost:3000"
+		}
+		resetURL := fmt.Sprintf("%s/reset-password?tid=%s&t=%s", appURL, tokenID, raw)
+		subject, html := localizedEmail(userLocale(ctx, userID), "reset", resetURL, int(resetCodeTTL.Minutes()))
+		go func() {
+			if err := sendEmail(userID, email, subject, html); err != nil {
+				log.Printf("sendEmail reset: %v", err)
+			}
+		}()
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "If an account exists, we sent a reset link"})
+}
+
+func resetPasswordHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+	var in struct {
+		TokenID            string `json:"tokenId"`
+		Token              string `json:"token"`
+		NewPassword        string `json:"newPassword"`
+		ConfirmNewPassword string `json:"confirmNewPassword"`
+	}
+	if err := c.BindJSON(&in); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	if in.TokenID == "" || in.Token == "" || in.NewPassword == "" || in.ConfirmNewPassword == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing fields"})
+		return
+	}
+	if in.NewPassword != in.ConfirmNewPassword {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Passwords do not match"})
+		return
+	}
+	if !validatePassword(in.NewPassword) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Weak password"})
+		return
+	}
+	userID, err := verifyEmailTokenByID(in.TokenID, in.Token, "reset")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired token"})
+		return
+	}
+	h, err := bcrypt.GenerateFromPassword([]byte(in.NewPassword), 12)
+	if err != nil {
+		serverError(c, "resetPassword: hash", err)
+		return
+	}
+	if _, err := db.ExecContext(ctx, `UPDATE users SET password_hash = ?, updated_at = ? WHERE id = ?`, string(h), time.Now().UTC(), userID); err != nil {
+		serverError(c, "resetPassword: update", err)
+		return
+	}
+	if _, err := db.ExecContext(ctx, `UPDATE refresh_tokens SET revoked = 1 WHERE user_id = ?`, userID); err != nil {
+		logIfTimeout(err, "resetPassword: revoke")
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Password updated"})
+}
+
+func sendFriendRequestHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	userID := ctxUserID(c)
+	var body friendRequestInput
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+
+	var targetID string
+	var emailVerified int
+	err := db.QueryRowContext(ctx, `SELECT id, email_verified FROM users WHERE username = ? AND merged_into IS NULL AND deactivated_at IS NULL AND tenant_id = ?`, body.Username, requestTenant(c)).Scan(&targetID, &emailVerified)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	} else if err != nil {
+		logIfTimeout(err, "sendFriendRequest: select user")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	if emailVerified == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "User must verify their email first"})
+		return
+	}
+
+	if targetID == userID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot send friend request to yourself"})
+		return
+	}
+
+	// Check if already friends or request exists
+	var exists int
+	err = db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM friend_requests
+		WHERE (sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?)
+	`, userID, targetID, targetID, userID).Scan(&exists)
+	if err != nil {
+		logIfTimeout(err, "sendFriendRequest: check existing")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	if exists > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Friend request already exists"})
+		return
+	}
+
+	now := time.Now().UTC()
+	requestID := uuid.NewString()
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO friend_requests(id, sender_id, receiver_id, status, created_at, updated_at)
+		VALUES (?,?,?,'pending',?,?)
+	`, requestID, userID, targetID, now, now); err != nil {
+		logIfTimeout(err, "sendFriendRequest: insert")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Friend request sent"})
+}
+
+func getFriendsHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	userID := ctxUserID(c)
+	rows, err := db.QueryContext(ctx, `
+		SELECT u.id, u.username
+		FROM users u
+		INNER JOIN friend_requests fr ON (
+			(fr.sender_id = ? AND fr.receiver_id = u.id) OR
+			(fr.sender_id = u.id AND fr.receiver_id = ?)
+		)
+		WHERE fr.status = 'accepted'
+		ORDER BY u.username
+	`, userID, userID)
+	if err != nil {
+		logIfTimeout(err, "getFriends: query")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	defer rows.Close()
+
+	friends := []map[string]interface{}{}
+	for rows.Next() {
+		var id, username string
+		if err := rows.Scan(&id, &username); err != nil {
+			continue
+		}
+		friends = append(friends, map[string]interface{}{
+			"id":       id,
+			"username": username,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		logIfTimeout(err, "getFriends: rows err")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, friends)
+}
+
+func getFriendRequestsHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	userID := ctxUserID(c)
+	rows, err := db.QueryContext(ctx, `
+		SELECT fr.id, u.id, u.username, fr.created_at
+		FROM friend_requests fr
+		INNER JOIN users u ON u.id = fr.sender_id
+		WHERE fr.receiver_id = ? AND fr.status = 'pending'
+		ORDER BY fr.created_at DESC
+	`, userID)
+	if err != nil {
+		logIfTimeout(err, "getFriendRequests: query")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	defer rows.Close()
+
+	requests := []map[string]interface{}{}
+	for rows.Next() {
+		var reqID, senderID, username string
+		var createdAt time.Time
+		if err := rows.Scan(&reqID, &senderID, &username, &createdAt); err != nil {
+			continue
+		}
+		requests = append(requests, map[string]interface{}{
+			"id":        reqID,
+			"senderId":  senderID,
+			"username":  username,
+			"createdAt": createdAt,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		logIfTimeout(err, "getFriendRequests: rows err")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, requests)
+}
+
+func acceptFriendRequestHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	userID := ctxUserID(c)
+	requestID := c.Param("id")
+
+	var senderID string
+	err := db.QueryRowContext(ctx, `
+		SELECT sender_id FROM friend_requests
+		WHERE id = ? AND receiver_id = ? AND status = 'pending'
+	`, requestID, userID).Scan(&senderID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Friend request not found"})
+		return
+	} else if err != nil {
+		logIfTimeout(err, "acceptFriendRequest: select")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	now := time.Now().UTC()
+	if _, err := db.ExecContext(ctx, `
+		UPDATE friend_requests
+		SET status = 'accepted', updated_at = ?
+		WHERE id = ?
+	`, now, requestID); err != nil {
+		logIfTimeout(err, "acceptFriendRequest: update")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Friend request accepted"})
+}
+
+func declineFriendRequestHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	userID := ctxUserID(c)
+	requestID := c.Param("id")
+
+	var exists int
+	err := db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM friend_requests
+		WHERE id = ? AND receiver_id = ? AND status = 'pending'
+	`, requestID, userID).Scan(&exists)
+	if err != nil {
+		logIfTimeout(err, "declineFriendRequest: select")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	if exists == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Friend request not found"})
+		return
+	}
+
+	now := time.Now().UTC()
+	if _, err := db.ExecContext(ctx, `
+		UPDATE friend_requests
+		SET status = 'declined', updated_at = ?
+		WHERE id = ?
+	`, now, requestID); err != nil {
+		logIfTimeout(err, "declineFriendRequest: update")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Friend request declined"})
+}
+
+func removeFriendHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	userID := ctxUserID(c)
+	friendID := c.Param("id")
+
+	if friendID == userID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot remove yourself"})
+		return
+	}
+
+	// Delete both directions of the friendship
+	if _, err := db.ExecContext(ctx, `
+		DELETE FROM friend_requests
+		WHERE status = 'accepted' AND (
+			(sender_id = ? AND receiver_id = ?) OR
+			(sender_id = ? AND receiver_id = ?)
+		)
+	`, userID, friendID, friendID, userID); err != nil {
+		logIfTimeout(err, "removeFriend: delete")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Friend removed"})
+}
+
+func getEventInvitesHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	userID := ctxUserID(c)
+	rows, err := db.QueryContext(ctx, `
+		SELECT ei.id, ei.event_id, e.name, e.date_from, e.date_to, e.duration, e.timezone, e.disabled_slots,
+		       u.id as inviter_id, u.username as inviter_username, ei.message, ei.created_at
+		FROM event_invites ei
+		INNER JOIN events e ON e.id = ei.event_id
+		INNER JOIN users u ON u.id = ei.inviter_id
+		WHERE ei.invitee_id = ? AND ei.status = 'pending'
+		ORDER BY ei.created_at DESC
+	`, userID)
+	if err != nil {
+		logIfTimeout(err, "getEventInvites: query")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	defer rows.Close()
+
+	invites := []map[string]interface{}{}
+	for rows.Next() {
+		var inviteID, eventID, name, dateFrom, dateTo, timezone, disabledSlots, inviterID, inviterUsername, message string
+		var duration float64
+		var createdAt time.Time
+		if err := rows.Scan(&inviteID, &eventID, &name, &dateFrom, &dateTo, &duration, &timezone, &disabledSlots, &inviterID, &inviterUsername, &message, &createdAt); err != nil {
+			continue
+		}
+		disabled := []string{}
+		if disabledSlots != "" {
+			_ = json.Unmarshal([]byte(disabledSlots), &disabled)
+		}
+		invites = append(invites, map[string]interface{}{
+			"id":              inviteID,
+			"eventId":         eventID,
+			"name":            name,
+			"dateRange":       gin.H{"from": dateFrom, "to": dateTo},
+			"duration":        duration,
+			"timezone":        timezone,
+			"disabledSlots":   disabled,
+			"inviterId":       inviterID,
+			"inviterUsername": inviterUsername,
+			"message":         message,
+			"createdAt":       createdAt,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		logIfTimeout(err, "getEventInvites: rows err")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, invites)
+}
+
+func acceptEventInviteHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	eventID := c.Param("id")
+	userID := ctxUserID(c)
+
+	// Check if invite exists and is pending
+	var inviteID string
+	err := db.QueryRowContext(ctx, `
+		SELECT id FROM event_invites
+		WHERE event_id = ? AND invitee_id = ? AND status = 'pending'
+	`, eventID, userID).Scan(&inviteID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invite not found"})
+		return
+	} else if err != nil {
+		logIfTimeout(err, "acceptEventInvite: select")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	// Check if already a participant
+	var exists int
+	_ = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM event_participants WHERE event_id = ? AND user_id = ?`, eventID, userID).Scan(&exists)
+	if exists > 0 {
+		// Already a participant, just mark invite as accepted
+		now := time.Now().UTC()
+		if _, err := db.ExecContext(ctx, `UPDATE event_invites SET status = 'accepted', updated_at = ? WHERE id = ?`, now, inviteID); err != nil {
+			logIfTimeout(err, "acceptEventInvite: update invite")
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Already a participant"})
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	now := time.Now().UTC()
+
+	// Add as participant
+	availability := map[string]bool{}
+	availJSON, _ := json.Marshal(availability)
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO event_participants(id, event_id, user_id, availability, draft_availability, draft_disabled_slots, draft_updated_at, join_channel, created_at, updated_at)
+		VALUES (?,?,?,seal(?),?,?,NULL,?,?,?)
+	`, uuid.NewString(), eventID, userID, string(availJSON), "{}", "[]", joinChannel(c, joinChannelInApp), now, now); err != nil {
+		tx.Rollback()
+		logIfTimeout(err, "acceptEventInvite: insert participant")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	// Update invite status
+	if _, err := tx.ExecContext(ctx, `UPDATE event_invites SET status = 'accepted', updated_at = ? WHERE id = ?`, now, inviteID); err != nil {
+		tx.Rollback()
+		logIfTimeout(err, "acceptEventInvite: update invite")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	ssePublish(eventID, []byte(`{"type":"event_updated","id":"`+eventID+`"}`))
+	c.JSON(http.StatusOK, gin.H{"message": "Invite accepted"})
+}
+
+func declineEventInviteHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	eventID := c.Param("id")
+	userID := ctxUserID(c)
+
+	var inviteID string
+	err := db.QueryRowContext(ctx, `
+		SELECT id FROM event_invites
+		WHERE event_id = ? AND invitee_id = ? AND status = 'pending'
+	`, eventID, userID).Scan(&inviteID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invite not found"})
+		return
+	} else if err != nil {
+		logIfTimeout(err, "declineEventInvite: select")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	now := time.Now().UTC()
+	if _, err := db.ExecContext(ctx, `UPDATE event_invites SET status = 'declined', updated_at = ? WHERE id = ?`, now, inviteID); err != nil {
+		logIfTimeout(err, "declineEventInvite: update")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Invite declined"})
+}
+
+// markEventSeen records the first time a user opened an event. Later views are ignored.
+func markEventSeen(ctx context.Context, eventID, userID string) {
+	if _, err := db.ExecContext(ctx, `INSERT OR IGNORE INTO event_seen(event_id, user_id, first_seen_at) VALUES (?,?,?)`,
+		eventID, userID, time.Now().UTC()); err != nil {
+		logIfTimeout(err, "markEventSeen")
+	}
+}
+
+func markEventSeenHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	eventID := c.Param("id")
+	if _, ok := eventMemberOnly(c, ctx, eventID, "markSeen"); !ok {
+		return
+	}
+
+	markEventSeen(ctx, eventID, ctxUserID(c))
+	c.JSON(http.StatusOK, gin.H{"message": "Seen"})
+}
+
+// eventReceiptsHandler lists invitees and participants with their seen/responded state (organizers only).
+func eventReceiptsHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	eventID := c.Param("id")
+	userID := ctxUserID(c)
+
+	var creatorID string
+	err := db.QueryRowContext(ctx, `SELECT COALESCE(creator_id, '') FROM events WHERE id = ?`, eventID).Scan(&creatorID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	} else if err != nil {
+		serverError(c, "receipts: select event", err)
+		return
+	}
+	role, err := eventRole(ctx, eventID, userID)
+	if err != nil {
+		serverError(c, "receipts: role", err)
+		return
+	}
+	if !canManageEvent(role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only organizers can view receipts"})
+		return
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT u.id, u.username, COALESCE(ei.status, ''), unseal(ep.availability), COALESCE(ep.join_channel, ''), es.first_seen_at
+		FROM users u
+		LEFT JOIN event_invites ei ON ei.event_id = ? AND ei.invitee_id = u.id
+		LEFT JOIN event_participants ep ON ep.event_id = ? AND ep.user_id = u.id
+		LEFT JOIN event_seen es ON es.event_id = ? AND es.user_id = u.id
+		WHERE u.id <> ? AND (ei.id IS NOT NULL OR ep.id IS NOT NULL)
+		ORDER BY u.username
+	`, eventID, eventID, eventID, creatorID)
+	if err != nil {
+		serverError(c, "receipts: query", err)
+		return
+	}
+	defer rows.Close()
+
+	out := []map[string]interface{}{}
+	for rows.Next() {
+		var uid, uname, inviteStatus, channel string
+		var availJSON sql.NullString
+		var seenAt sql.NullTime
+		if err := rows.Scan(&uid, &uname, &inviteStatus, &availJSON, &channel, &seenAt); err != nil {
+			continue
+		}
+		responded := false
+		if availJSON.Valid {
+			avail := map[string]bool{}
+			_ = json.Unmarshal([]byte(availJSON.String), &avail)
+			responded = len(avail) > 0
+		}
+		status := "not_seen"
+		switch {
+		case inviteStatus == "declined":
+			status = "declined"
+		case responded:
+			status = "responded"
+		case seenAt.Valid:
+			status = "seen"
+		}
+		entry := map[string]interface{}{
+			"userId":       uid,
+			"username":     uname,
+			"inviteStatus": inviteStatus,
+			"participant":  availJSON.Valid,
+			"channel":      channel,
+			"responded":    responded,
+			"status":       status,
+			"seenAt":       nil,
+		}
+		if seenAt.Valid {
+			entry["seenAt"] = seenAt.Time
+		}
+		out = append(out, entry)
+	}
+	if err := rows.Err(); err != nil {
+		serverError(c, "receipts: rows err", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, out)
+}
+
+// createNextInstanceHandler clones an event into the next instance of its series,
+// creating the series on first use. Participants are copied with empty availability. Only
+// the newest instance of a series can be cloned; otherwise the existing next one is named.
+func createNextInstanceHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	eventID := c.Param("id")
+	userID := ctxUserID(c)
+
+	var input struct {
+		ID           string `json:"id"`
+		IntervalDays int    `json:"intervalDays"`
+	}
+	_ = c.ShouldBindJSON(&input)
+	if input.IntervalDays < 0 || input.IntervalDays > 366 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid interval"})
+		return
+	}
+
+	var ev Event
+	var seriesID sql.NullString
+	var holidayRegion string
+	err := db.QueryRowContext(ctx, `
+		SELECT id, COALESCE(creator_id, ''), name, date_from, date_to, duration, timezone, disabled_slots, series_id, holiday_region
+		FROM events WHERE id = ?
+	`, eventID).Scan(&ev.ID, &ev.CreatorID, &ev.Name, &ev.DateFrom, &ev.DateTo, &ev.Duration, &ev.Timezone, &ev.DisabledSlots, &seriesID, &holidayRegion)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	} else if err != nil {
+		serverError(c, "nextInstance: select event", err)
+		return
+	}
+	role, err := eventRole(ctx, eventID, userID)
+	if err != nil {
+		serverError(c, "nextInstance: role", err)
+		return
+	}
+	if !canManageEvent(role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only organizers can schedule the next instance"})
+		return
+	}
+	if !enforceNewAccountLimit(c, ctx, userID, "events") || !enforceTenantQuota(c, ctx, "events") {
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	defer tx.Rollback()
+	now := time.Now().UTC()
+
+	interval := input.IntervalDays
+	if !seriesID.Valid {
+		if interval == 0 {
+			interval = 7
+		}
+		seriesID = sql.NullString{String: uuid.NewString(), Valid: true}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO event_series(id, creator_id, name, interval_days, created_at, updated_at)
+			VALUES (?,?,?,?,?,?)
+		`, seriesID.String, ev.CreatorID, ev.Name, interval, now, now); err != nil {
+			serverError(c, "nextInstance: insert series", err)
+			return
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE events SET series_id = ?, updated_at = ? WHERE id = ?`, seriesID.String, now, ev.ID); err != nil {
+			serverError(c, "nextInstance: link event", err)
+			return
+		}
+	} else {
+		// Only the newest instance may be continued; cloning an older one again would
+		// duplicate an instance that already exists.
+		var newestID string
+		if err := tx.QueryRowContext(ctx, `
+			SELECT id FROM events WHERE series_id = ? ORDER BY date_from DESC, created_at DESC LIMIT 1
+		`, seriesID.String).Scan(&newestID); err != nil {
+			serverError(c, "nextInstance: select newest", err)
+			return
+		}
+		if newestID != ev.ID {
+			c.JSON(http.StatusConflict, gin.H{"error": "The next instance already exists", "code": "next_exists", "id": newestID})
+			return
+		}
+		if interval == 0 {
+			if err := tx.QueryRowContext(ctx, `SELECT interval_days FROM event_series WHERE id = ?`, seriesID.String).Scan(&interval); err != nil {
+				serverError(c, "nextInstance: select series", err)
+				return
+			}
+		}
+	}
+
+	loc := eventLocation(ev.Timezone)
+	disabled := []string{}
+	_ = json.Unmarshal([]byte(ev.DisabledSlots), &disabled)
+	shifted := make([]string, 0, len(disabled))
+	for _, k := range disabled {
+		if t, err := parseSlotKey(k); err == nil {
+			shifted = append(shifted, formatSlotKey(t.In(loc).AddDate(0, 0, interval)))
+		}
+	}
+	disabledJSON, _ := json.Marshal(shifted)
+
+	newID := input.ID
+	if newID == "" {
+		newID = uuid.NewString()
+	}
+	from := shiftDateString(ev.DateFrom, interval, loc)
+	to := shiftDateString(ev.DateTo, interval, loc)
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO events(id, creator_id, name, date_from, date_to, duration, timezone, disabled_slots, series_id, holiday_region, tenant_id, created_at, updated_at)
+		VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?)
+	`, newID, ev.CreatorID, ev.Name, from, to, ev.Duration, ev.Timezone, string(disabledJSON), seriesID.String, holidayRegion, requestTenant(c), now, now); err != nil {
+		logIfTimeout(err, "nextInstance: insert event")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create event"})
+		return
+	}
+	prow, err := tx.QueryContext(ctx, `SELECT user_id, role FROM event_participants WHERE event_id = ? AND user_id IS NOT NULL`, ev.ID)
+	if err != nil {
+		serverError(c, "nextInstance: select participants", err)
+		return
+	}
+	var participantIDs, participantRoles []string
+	for prow.Next() {
+		var pid, prole string
+		if err := prow.Scan(&pid, &prole); err == nil {
+			participantIDs = append(participantIDs, pid)
+			participantRoles = append(participantRoles, prole)
+		}
+	}
+	prow.Close()
+	for i, pid := range participantIDs {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO event_participants(id, event_id, user_id, role, availability, draft_availability, draft_disabled_slots, draft_updated_at, created_at, updated_at)
+			VALUES (?,?,?,?,?,?,?,NULL,?,?)
+		`, uuid.NewString(), newID, pid, participantRoles[i], "{}", "{}", "[]", now, now); err != nil {
+			serverError(c, "nextInstance: copy participants", err)
+			return
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE event_series SET updated_at = ? WHERE id = ?`, now, seriesID.String); err != nil {
+		serverError(c, "nextInstance: touch series", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	statInc("events_created")
+
+	ssePublish(ev.ID, []byte(`{"type":"event_updated","id":"`+ev.ID+`"}`))
+	c.JSON(http.StatusCreated, gin.H{
+		"id":            newID,
+		"creatorId":     ev.CreatorID,
+		"name":          ev.Name,
+		"dateRange":     gin.H{"from": from, "to": to},
+		"duration":      ev.Duration,
+		"timezone":      ev.Timezone,
+		"disabledSlots": shifted,
+		"seriesId":      seriesID.String,
+	})
+}
+
+// getSeriesHandler returns a series with its instances and the participants seen across them.
+func getSeriesHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	seriesID := c.Param("id")
+	userID := ctxUserID(c)
+
+	var name, creatorID string
+	var interval int
+	var createdAt time.Time
+	err := db.QueryRowContext(ctx, `SELECT name, creator_id, interval_days, created_at FROM event_series WHERE id = ?`, seriesID).
+		Scan(&name, &creatorID, &interval, &createdAt)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	} else if err != nil {
+		serverError(c, "getSeries: select", err)
+		return
+	}
+
+	if creatorID != userID {
+		var member int
+		if err := db.QueryRowContext(ctx, `
+			SELECT COUNT(*) FROM event_participants ep
+			JOIN events e ON e.id = ep.event_id
+			WHERE e.series_id = ? AND ep.user_id = ?
+		`, seriesID, userID).Scan(&member); err != nil {
+			serverError(c, "getSeries: membership", err)
+			return
+		}
+		if member == 0 {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+			return
+		}
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT e.id, e.name, e.date_from, e.date_to, e.duration, e.timezone,
+			COUNT(ep.id),
+			COALESCE(SUM(CASE WHEN ep.availability <> '{}' THEN 1 ELSE 0 END), 0)
+		FROM events e
+		LEFT JOIN event_participants ep ON ep.event_id = e.id
+		WHERE e.series_id = ?
+		GROUP BY e.id
+		ORDER BY e.date_from
+	`, seriesID)
+	if err != nil {
+		serverError(c, "getSeries: instances", err)
+		return
+	}
+	defer rows.Close()
+	instances := []map[string]interface{}{}
+	for rows.Next() {
+		var ev Event
+		var participants, responded int
+		if err := rows.Scan(&ev.ID, &ev.Name, &ev.DateFrom, &ev.DateTo, &ev.Duration, &ev.Timezone, &participants, &responded); err != nil {
+			continue
+		}
+		instances = append(instances, map[string]interface{}{
+			"id":               ev.ID,
+			"name":             ev.Name,
+			"dateRange":        gin.H{"from": ev.DateFrom, "to": ev.DateTo},
+			"duration":         ev.Duration,
+			"timezone":         ev.Timezone,
+			"participantCount": participants,
+			"respondedCount":   responded,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		serverError(c, "getSeries: instances rows", err)
+		return
+	}
+
+	prow, err := db.QueryContext(ctx, `
+		SELECT u.id, u.username, COUNT(*)
+		FROM event_participants ep
+		JOIN events e ON e.id = ep.event_id
+		JOIN users u ON u.id = ep.user_id
+		WHERE e.series_id = ?
+		GROUP BY u.id
+		ORDER BY u.username
+	`, seriesID)
+	if err != nil {
+		serverError(c, "getSeries: participants", err)
+		return
+	}
+	defer prow.Close()
+	participants := []map[string]interface{}{}
+	for prow.Next() {
+		var uid, uname string
+		var count int
+		if err := prow.Scan(&uid, &uname, &count); err != nil {
+			continue
+		}
+		part := map[string]interface{}{
+			"id":        uid,
+			"name":      uname,
+			"instances": count,
+		}
+		setParticipantIdentity(part, uid, uname)
+		participants = append(participants, part)
+	}
+	if err := prow.Err(); err != nil {
+		serverError(c, "getSeries: participants rows", err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":           seriesID,
+		"name":         name,
+		"creatorId":    creatorID,
+		"intervalDays": interval,
+		"createdAt":    createdAt,
+		"instances":    instances,
+		"participants": participants,
+	})
+}
+
+// overlayAvailabilityHandler projects the requester's availability from sourceEvent onto
+// this event's grid by matching weekday and wall-clock time. Nothing is written.
+func overlayAvailabilityHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	eventID := c.Param("id")
+	sourceID := c.Query("sourceEvent")
+	userID := ctxUserID(c)
+	if sourceID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing sourceEvent"})
+		return
+	}
+
+	var target Event
+	err := db.QueryRowContext(ctx, `
+		SELECT id, date_from, date_to, duration, timezone, disabled_slots FROM events WHERE id = ?
+	`, eventID).Scan(&target.ID, &target.DateFrom, &target.DateTo, &target.Duration, &target.Timezone, &target.DisabledSlots)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	} else if err != nil {
+		serverError(c, "overlay: select event", err)
+		return
+	}
+
+	var sourceTZ, availJSON string
+	err = db.QueryRowContext(ctx, `
+		SELECT e.timezone, unseal(ep.availability)
+		FROM event_participants ep
+		JOIN events e ON e.id = ep.event_id
+		WHERE ep.event_id = ? AND ep.user_id = ?
+	`, sourceID, userID).Scan(&sourceTZ, &availJSON)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not a participant of source event"})
+		return
+	} else if err != nil {
+		serverError(c, "overlay: select source", err)
+		return
+	}
+
+	sourceAvail := map[string]bool{}
+	if err := json.Unmarshal([]byte(availJSON), &sourceAvail); err != nil {
+		serverError(c, "overlay: parse source availability", err)
+		return
+	}
+
+	type weeklySlot struct {
+		day  time.Weekday
+		mins int
+	}
+	sourceLoc := eventLocation(sourceTZ)
+	pattern := map[weeklySlot]bool{}
+	for k, v := range sourceAvail {
+		if !v {
+			continue
+		}
+		if t, err := parseSlotKey(k); err == nil {
+			l := t.In(sourceLoc)
+			pattern[weeklySlot{l.Weekday(), l.Hour()*60 + l.Minute()}] = true
+		}
+	}
+
+	disabled := map[string]bool{}
+	var disabledList []string
+	_ = json.Unmarshal([]byte(target.DisabledSlots), &disabledList)
+	for _, k := range disabledList {
+		disabled[k] = true
+	}
+
+	overlay := map[string]bool{}
+	now := time.Now()
+	for _, t := range eventSlotGrid(target) {
+		if !pattern[weeklySlot{t.Weekday(), t.Hour()*60 + t.Minute()}] {
+			continue
+		}
+		key := formatSlotKey(t)
+		if !disabled[key] && !t.Before(now) {
+			overlay[key] = true
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"eventId":      eventID,
+		"sourceEvent":  sourceID,
+		"availability": overlay,
+		"matched":      len(overlay),
+	})
+}
+
+// tallyAvailability counts, per slot key, how many participants marked themselves available,
+// skipping disabled and past slots. Counts come from the event's aggregate.
+func tallyAvailability(ctx context.Context, eventID, disabledJSON string) (map[string]int, int, error) {
+	disabled := map[string]bool{}
+	var disabledList []string
+	_ = json.Unmarshal([]byte(disabledJSON), &disabledList)
+	for _, k := range disabledList {
+		disabled[k] = true
+	}
+
+	all, err := eventAggregate(ctx, eventID)
+	if err != nil {
+		return nil, 0, err
+	}
+	var total int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM event_participants WHERE event_id = ?`, eventID).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	counts := map[string]int{}
+	now := time.Now()
+	for k, n := range all {
+		if n > 0 && !disabled[k] && !slotIsPast(k, now) {
+			counts[k] = n
+		}
+	}
+	return counts, total, nil
+}
+
+const icsTimeLayout = "20060102T150405Z"
+
+var icsEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`, "\r", "")
+
+func icsEscape(s string) string { return icsEscaper.Replace(s) }
+
+// icsFold writes a content line folded at 75 octets as required by RFC 5545.
+func icsFold(b *strings.Builder, line string) {
+	for len(line) > 75 {
+		cut := 75
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+}
+
+// freeBusyICSHandler exports the slots where at least ?min= participants (default: everyone)
+// are available as tentative calendar blocks, merging adjacent slots.
+func freeBusyICSHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	id := c.Param("id")
+	var ev Event
+	var passHash sql.NullString
+	err := db.QueryRowContext(ctx, `SELECT id, name, duration, disabled_slots, passphrase_hash FROM events WHERE id = ?`, id).
+		Scan(&ev.ID, &ev.Name, &ev.Duration, &ev.DisabledSlots, &passHash)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	} else if err != nil {
+		serverError(c, "freebusy: select event", err)
+		return
+	}
+	signed := validSignedRequest(c)
+	if !signed && !eventAccessAllowed(ctx, c, id, passHash, optionalAuth(c)) {
+		passphraseRequired(c)
+		return
+	}
+
+	counts, total, err := tallyAvailability(ctx, id, ev.DisabledSlots)
+	if err != nil {
+		serverError(c, "freebusy: tally", err)
+		return
+	}
+	minCount := total
+	if v := c.Query("min"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid min"})
+			return
+		}
+		minCount = n
+	}
+	if minCount < 1 {
+		minCount = 1
+	}
+
+	var starts []time.Time
+	for k, n := range counts {
+		if n < minCount {
+			continue
+		}
+		if t, err := parseSlotKey(k); err == nil {
+			starts = append(starts, t)
+		}
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+
+	step := slotStep(ev.Duration)
+	type block struct {
+		start, end time.Time
+		least      int
+	}
+	var blocks []block
+	for _, t := range starts {
+		n := counts[formatSlotKey(t)]
+		if len(blocks) > 0 && blocks[len(blocks)-1].end.Equal(t) {
+			last := &blocks[len(blocks)-1]
+			last.end = t.Add(step)
+			if n < last.least {
+				last.least = n
+			}
+			continue
+		}
+		blocks = append(blocks, block{start: t, end: t.Add(step), least: n})
+	}
+
+	now := time.Now().UTC().Format(icsTimeLayout)
+	var b strings.Builder
+	icsFold(&b, "BEGIN:VCALENDAR")
+	icsFold(&b, "VERSION:2.0")
+	icsFold(&b, "PRODID:-//Plannie//Free Busy//EN")
+	icsFold(&b, "CALSCALE:GREGORIAN")
+	icsFold(&b, "X-WR-CALNAME:"+icsEscape(ev.Name+" (candidates)"))
+	for _, bl := range blocks {
+		icsFold(&b, "BEGIN:VEVENT")
+		icsFold(&b, fmt.Sprintf("UID:%s-%d@plannie", ev.ID, bl.start.Unix()))
+		icsFold(&b, "DTSTAMP:"+now)
+		icsFold(&b, "DTSTART:"+bl.start.Format(icsTimeLayout))
+		icsFold(&b, "DTEND:"+bl.end.Format(icsTimeLayout))
+		icsFold(&b, "SUMMARY:"+icsEscape(fmt.Sprintf("%s (%d/%d available)", ev.Name, bl.least, total)))
+		icsFold(&b, "STATUS:TENTATIVE")
+		icsFold(&b, "TRANSP:TRANSPARENT")
+		icsFold(&b, "END:VEVENT")
+	}
+	icsFold(&b, "END:VCALENDAR")
+
+	if signed {
+		c.Header("Cache-Control", signedCacheControl(c, 15*time.Minute))
+		setSurrogateKeys(c, eventSurrogateKey(id))
+	}
+	c.Header("Content-Disposition", `attachment; filename="freebusy.ics"`)
+	c.Data(http.StatusOK, "text/calendar; charset=utf-8", []byte(b.String()))
+}
+
+// publicEventsHandler lists events whose creators opted into the public directory.
+func publicEventsHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	limit := 50
+	if v, err := strconv.Atoi(c.Query("limit")); err == nil && v > 0 && v <= 100 {
+		limit = v
+	}
+	offset := 0
+	if v, err := strconv.Atoi(c.Query("offset")); err == nil && v > 0 {
+		offset = v
+	}
+
+	query := `
+		SELECT e.id, e.name, e.date_from, e.date_to, e.duration, e.timezone, e.tags, e.passphrase_hash IS NOT NULL, COUNT(ep.id)
+		FROM events e
+		LEFT JOIN event_participants ep ON ep.event_id = e.id
+		WHERE e.is_public = 1 AND e.tenant_id = ?`
+	args := []interface{}{requestTenant(c)}
+	if tag := strings.ToLower(strings.TrimSpace(c.Query("tag"))); tag != "" {
+		query += ` AND EXISTS (SELECT 1 FROM json_each(e.tags) WHERE json_each.value = ?)`
+		args = append(args, tag)
+	}
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		query += ` AND e.name LIKE ? ESCAPE '\'`
+		args = append(args, "%"+likeEscaper.Replace(q)+"%")
+	}
+	query += ` GROUP BY e.id ORDER BY e.date_from, e.id LIMIT ? OFFSET ?`
+	args = append(args, limit, offset)
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		serverError(c, "publicEvents: query", err)
+		return
+	}
+	defer rows.Close()
+
+	out := []map[string]interface{}{}
+	keys := []string{publicEventsSurrogateKey}
+	for rows.Next() {
+		var ev Event
+		var tagsJSON string
+		var protected bool
+		var count int
+		if err := rows.Scan(&ev.ID, &ev.Name, &ev.DateFrom, &ev.DateTo, &ev.Duration, &ev.Timezone, &tagsJSON, &protected, &count); err != nil {
+			continue
+		}
+		tags := []string{}
+		_ = json.Unmarshal([]byte(tagsJSON), &tags)
+		out = append(out, map[string]interface{}{
+			"id":               ev.ID,
+			"name":             ev.Name,
+			"dateRange":        gin.H{"from": ev.DateFrom, "to": ev.DateTo},
+			"duration":         ev.Duration,
+			"timezone":         ev.Timezone,
+			"tags":             tags,
+			"participantCount": count,
+			"joinable":         true,
+			"protected":        protected,
+		})
+		keys = append(keys, eventSurrogateKey(ev.ID))
+	}
+	if err := rows.Err(); err != nil {
+		serverError(c, "publicEvents: rows err", err)
+		return
+	}
+
+	publicCache(c, time.Minute, 5*time.Minute, keys...)
+	c.JSON(http.StatusOK, out)
+}
+
+// eventAccessHandler exchanges an event passphrase for a short-lived access token
+// that is presented via the X-Event-Access header (or ?access=) to view or join.
+func eventAccessHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	id := c.Param("id")
+	var in struct {
+		Passphrase string `json:"passphrase"`
+	}
+	if err := c.BindJSON(&in); err != nil || in.Passphrase == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Passphrase is required"})
+		return
+	}
+
+	var passHash sql.NullString
+	err := db.QueryRowContext(ctx, `SELECT passphrase_hash FROM events WHERE id = ?`, id).Scan(&passHash)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	} else if err != nil {
+		serverError(c, "eventAccess: select", err)
+		return
+	}
+	if !passHash.Valid {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Event is not protected"})
+		return
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(passHash.String), []byte(in.Passphrase)); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid passphrase"})
+		return
+	}
+
+	tok, expires, err := signEventAccessToken(id)
+	if err != nil {
+		serverError(c, "eventAccess: sign", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"accessToken": tok, "expiresAt": expires.UTC()})
+}
+
+func loadEmailHistory(ctx context.Context, userID string) ([]map[string]interface{}, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT unseal(old_email), unseal(new_email), COALESCE(ip, ''), changed_at
+		FROM user_email_history WHERE user_id = ?
+		ORDER BY changed_at
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []map[string]interface{}{}
+	for rows.Next() {
+		var oldEmail, newEmail, ip string
+		var changedAt time.Time
+		if err := rows.Scan(&oldEmail, &newEmail, &ip, &changedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, map[string]interface{}{
+			"oldEmail":  oldEmail,
+			"newEmail":  newEmail,
+			"ip":        ip,
+			"changedAt": changedAt,
+		})
+	}
+	return out, rows.Err()
+}
+
+// adminLookupUserHandler finds accounts whose current or any historical email matches ?email=.
+func adminLookupUserHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	email := strings.TrimSpace(c.Query("email"))
+	if email == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing email"})
+		return
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, username, unseal(email), email_verified, COALESCE(merged_into, ''), created_at, updated_at FROM users
+		WHERE (email = ? COLLATE NOCASE OR email_index = blind_index(?) OR id IN (
+			SELECT user_id FROM user_email_history
+			WHERE old_email = ? COLLATE NOCASE OR new_email = ? COLLATE NOCASE
+				OR old_email_index = blind_index(?) OR new_email_index = blind_index(?)
+		)) AND (? OR tenant_id = ?)
+	`, email, email, email, email, email, email, c.GetBool("adminGlobal"), requestTenant(c))
+	if err != nil {
+		serverError(c, "adminLookup: query", err)
+		return
+	}
+	var users []User
+	mergedInto := map[string]string{}
+	for rows.Next() {
+		var u User
+		var merged string
+		if err := rows.Scan(&u.ID, &u.Username, &u.Email, &u.EmailVerified, &merged, &u.CreatedAt, &u.UpdatedAt); err == nil {
+			users = append(users, u)
+			mergedInto[u.ID] = merged
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		serverError(c, "adminLookup: rows err", err)
+		return
+	}
+
+	out := []map[string]interface{}{}
+	for _, u := range users {
+		history, err := loadEmailHistory(ctx, u.ID)
+		if err != nil {
+			serverError(c, "adminLookup: history", err)
+			return
+		}
+		out = append(out, map[string]interface{}{
+			"id":            u.ID,
+			"username":      u.Username,
+			"email":         u.Email,
+			"emailVerified": u.EmailVerified,
+			"currentMatch":  strings.EqualFold(u.Email, email),
+			"mergedInto":    mergedInto[u.ID],
+			"createdAt":     u.CreatedAt,
+			"updatedAt":     u.UpdatedAt,
+			"emailHistory":  history,
+		})
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+func adminEmailHistoryHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	if !adminUserInScope(c, ctx, c.Param("id")) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	history, err := loadEmailHistory(ctx, c.Param("id"))
+	if err != nil {
+		serverError(c, "adminEmailHistory: query", err)
+		return
+	}
+	c.JSON(http.StatusOK, history)
+}
+
+func recoveryCodesStatusHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	var remaining int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM recovery_codes WHERE user_id = ? AND used_at IS NULL`, ctxUserID(c)).Scan(&remaining); err != nil {
+		serverError(c, "recoveryCodes: count", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"remaining": remaining})
+}
+
+// regenerateRecoveryCodesHandler issues a new set of codes after password re-entry.
+func regenerateRecoveryCodesHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	userID := ctxUserID(c)
+	var in struct {
+		Password string `json:"password"`
+	}
+	if err := c.BindJSON(&in); err != nil || in.Password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password is required"})
+		return
+	}
+	var hash string
+	if err := db.QueryRowContext(ctx, `SELECT password_hash FROM users WHERE id = ?`, userID).Scan(&hash); err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		serverError(c, "regenerateRecovery: select", err)
+		return
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(in.Password)); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid password"})
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	defer tx.Rollback()
+	codes, err := replaceRecoveryCodes(ctx, tx, userID)
+	if err != nil {
+		serverError(c, "regenerateRecovery: insert", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"recoveryCodes": codes})
+}
+
+// recoverAccountHandler burns a recovery code and opens a short reset session for users
+// who no longer control their mailbox.
+func recoverAccountHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	var in struct {
+		Username string `json:"username"`
+		Code     string `json:"code"`
+	}
+	if err := c.BindJSON(&in); err != nil || in.Username == "" || in.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing fields"})
+		return
+	}
+
+	var userID string
+	err := db.QueryRowContext(ctx, `SELECT id FROM users WHERE (username = ? OR email = ? OR email_index = blind_index(?)) AND merged_into IS NULL AND tenant_id = ?`, in.Username, in.Username, in.Username, requestTenant(c)).Scan(&userID)
+	if err == sql.ErrNoRows {
+		recordLoginAttempt(ctx, "", in.Username, clientIP(c))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recovery code"})
+		return
+	} else if err != nil {
+		serverError(c, "recover: select user", err)
+		return
+	}
+	locked, err := isLockedOut(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	if locked {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Account locked. Try later."})
+		return
+	}
+
+	res, err := db.ExecContext(ctx, `
+		UPDATE recovery_codes SET used_at = ?
+		WHERE user_id = ? AND code_hash = ? AND used_at IS NULL
+	`, time.Now().UTC(), userID, hashRecoveryCode(in.Code))
+	if err != nil {
+		serverError(c, "recover: burn code", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		recordLoginAttempt(ctx, userID, in.Username, clientIP(c))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recovery code"})
+		return
+	}
+
+	raw, tokenID, err := createEmailToken(userID, "recovery", recoverySessionTTL)
+	if err != nil {
+		serverError(c, "recover: session token", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"tokenId":   tokenID,
+		"token":     raw,
+		"expiresIn": int(recoverySessionTTL.Seconds()),
+	})
+}
+
+// completeRecoveryHandler sets a new password (and optionally a new email) using a recovery session.
+func completeRecoveryHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	var in struct {
+		TokenID     string `json:"tokenId"`
+		Token       string `json:"token"`
+		NewPassword string `json:"newPassword"`
+		NewEmail    string `json:"newEmail"`
+	}
+	if err := c.BindJSON(&in); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	if in.TokenID == "" || in.Token == "" || in.NewPassword == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing fields"})
+		return
+	}
+	if !validatePassword(in.NewPassword) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Weak password"})
+		return
+	}
+	if in.NewEmail != "" {
+		if !validateEmail(in.NewEmail) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email"})
+			return
+		}
+		if !emailDomainAllowed(in.NewEmail) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Email domain not allowed", "code": "email_domain_not_allowed"})
+			return
+		}
+		if isDisposableDomain(emailDomain(in.NewEmail)) {
+			metricInc("plannie_email_change_rejections_total", "reason", "disposable")
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Disposable email addresses are not allowed"})
+			return
+		}
+	}
+
+	userID, err := verifyEmailTokenByID(in.TokenID, in.Token, "recovery")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired token"})
+		return
+	}
+	h, err := bcrypt.GenerateFromPassword([]byte(in.NewPassword), 12)
+	if err != nil {
+		serverError(c, "completeRecovery: hash", err)
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+	defer tx.Rollback()
+	now := time.Now().UTC()
+	if _, err := tx.ExecContext(ctx, `UPDATE users SET password_hash = ?, updated_at = ? WHERE id = ?`, string(h), now, userID); err != nil {
+		serverError(c, "completeRecovery: update password", err)
+		return
+	}
+	var username, currentEmail string
+	if err := tx.QueryRowContext(ctx, `SELECT username, unseal(email) FROM users WHERE id = ?`, userID).Scan(&username, &currentEmail); err != nil {
+		serverError(c, "completeRecovery: select user", err)
+		return
+	}
+	emailChanged := in.NewEmail != "" && in.NewEmail != currentEmail
+	if emailChanged {
+		var taken int
+		if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM users WHERE (email = ? OR email_index = blind_index(?)) AND id <> ?`, in.NewEmail, in.NewEmail, userID).Scan(&taken); err != nil {
+			serverError(c, "completeRecovery: email count", err)
+			return
+		}
+		if taken > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Email taken"})
+			return
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE users SET email = seal(?), email_index = blind_index(?), email_verified = 0 WHERE id = ?`, in.NewEmail, in.NewEmail, userID); err != nil {
+			if uniqueViolation(err, "users.email") {
+				c.JSON(http.StatusConflict, gin.H{"error": "Email taken"})
+				return
+			}
+			serverError(c, "completeRecovery: update email", err)
+			return
+		}
+		if err := recordEmailChange(ctx, tx, userID, currentEmail, in.NewEmail, clientIP(c)); err != nil {
+			serverError(c, "completeRecovery: email history", err)
+			return
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE refresh_tokens SET revoked = 1 WHERE user_id = ?`, userID); err != nil {
+		serverError(c, "completeRecovery: revoke", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		return
+	}
+
+	if emailChanged {
+		if raw, tokenID, err := createEmailToken(userID, "verify", verifyTTL); err == nil {
+			verifyURL := fmt.Sprintf("%s/verify-email?tid=%s&t=%s", apiBaseURL(), tokenID, raw)
+			subject, html := localizedEmail(userLocale(ctx, userID), "verify_change", username, verifyURL)
+			go func() {
+				if err := sendEmail(userID, in.NewEmail, subject, html); err != nil {
+					log.Printf("sendEmail recovery verify: %v", err)
+				}
+			}()
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Account recovered", "emailChanged": emailChanged})
+}
+
+// adminSecurityAttemptsHandler summarizes failed logins over the last ?hours= (max 24, the retention window).
+func adminSecurityAttemptsHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	hours := 24
+	if v, err := strconv.Atoi(c.Query("hours")); err == nil && v > 0 && v < 24 {
+		hours = v
+	}
+	since := time.Now().Add(-time.Duration(hours) * time.Hour).UTC()
+
+	topCounts := func(query string, key string) ([]map[string]interface{}, error) {
+		rows, err := db.QueryContext(ctx, query, since)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		out := []map[string]interface{}{}
+		for rows.Next() {
+			var k, lastRaw string
+			var n int
+			if err := rows.Scan(&k, &n, &lastRaw); err != nil {
+				return nil, err
+			}
+			entry := map[string]interface{}{key: k, "attempts": n, "lastAttempt": nil}
+			if last, ok := parseDBTime(lastRaw); ok {
+				entry["lastAttempt"] = last
+			}
+			out = append(out, entry)
+		}
+		return out, rows.Err()
+	}
+
+	var total int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM login_attempts WHERE created_at >= ?`, since).Scan(&total); err != nil {
+		serverError(c, "securityAttempts: total", err)
+		return
+	}
+	ips, err := topCounts(`
+		SELECT COALESCE(ip, ''), COUNT(*), MAX(created_at) FROM login_attempts
+		WHERE created_at >= ? GROUP BY ip ORDER BY COUNT(*) DESC LIMIT 10
+	`, "ip")
+	if err != nil {
+		serverError(c, "securityAttempts: ips", err)
+		return
+	}
+	accounts, err := topCounts(`
+		SELECT COALESCE(username, ''), COUNT(*), MAX(created_at) FROM login_attempts
+		WHERE created_at >= ? GROUP BY username ORDER BY COUNT(*) DESC LIMIT 10
+	`, "username")
+	if err != nil {
+		serverError(c, "securityAttempts: accounts", err)
+		return
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT user_id, COALESCE(username, ''), COALESCE(ip, ''), created_at FROM lockout_events
+		WHERE created_at >= ? ORDER BY created_at DESC
+	`, since)
+	if err != nil {
+		serverError(c, "securityAttempts: lockouts", err)
+		return
+	}
+	defer rows.Close()
+	lockouts := []map[string]interface{}{}
+	for rows.Next() {
+		var uid, uname, ip string
+		var at time.Time
+		if err := rows.Scan(&uid, &uname, &ip, &at); err != nil {
+			continue
+		}
+		lockouts = append(lockouts, map[string]interface{}{"userId": uid, "username": uname, "ip": ip, "at": at})
+	}
+	if err := rows.Err(); err != nil {
+		serverError(c, "securityAttempts: lockouts rows", err)
+		return
+	}
+
+	bans := []map[string]interface{}{}
+	ipBansMu.RLock()
+	for ip, exp := range ipBans {
+		if time.Now().Before(exp) {
+			bans = append(bans, map[string]interface{}{"ip": ip, "expiresAt": exp})
+		}
+	}
+	ipBansMu.RUnlock()
+
+	c.JSON(http.StatusOK, gin.H{
+		"windowHours":      hours,
+		"totalFailures":    total,
+		"topIps":           ips,
+		"topAccounts":      accounts,
+		"lockouts":         lockouts,
+		"activeBans":       bans,
+		"banThreshold":     currentSettings().IPBanThreshold,
+		"lockoutsInWindow": len(lockouts),
+	})
+}
+
+func adminLiftBanHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	ip := c.Param("ip")
+	if _, err := db.ExecContext(ctx, `DELETE FROM ip_bans WHERE ip = ?`, ip); err != nil {
+		serverError(c, "liftBan: delete", err)
+		return
+	}
+	ipBansMu.Lock()
+	delete(ipBans, ip)
+	ipBansMu.Unlock()
+	c.JSON(http.StatusOK, gin.H{"message": "Ban lifted"})
+}
+
+// isNewDevice reports whether this browser/OS and location combination has not been seen
+// on the user's recent sessions. The very first login is never "new".
+func isNewDevice(ctx context.Context, userID, ua, location string) bool {
+	rows, err := db.QueryContext(ctx, `
+		SELECT user_agent, location FROM refresh_tokens
+		WHERE user_id = ? ORDER BY created_at DESC LIMIT 100
+	`, userID)
+	if err != nil {
+		logIfTimeout(err, "isNewDevice")
+		return false
+	}
+	defer rows.Close()
+	want := describeSession(ua, location)
+	seen := false
+	for rows.Next() {
+		var prevUA, prevLoc string
+		if err := rows.Scan(&prevUA, &prevLoc); err != nil {
+			continue
+		}
+		seen = true
+		if describeSession(prevUA, prevLoc) == want {
+			return false
+		}
+	}
+	return seen
+}
+
+// currentFamily extracts the refresh-token family of the caller from the refresh cookie, if any.
+func currentFamily(c *gin.Context) string {
+	cookie, err := c.Cookie(refreshCookieName)
+	if err != nil || cookie == "" {
+		return ""
+	}
+	claims := &jwt.RegisteredClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(cookie, claims); err != nil {
+		return ""
+	}
+	family, _, _ := strings.Cut(claims.ID, ":")
+	return family
+}
+
+// listSessionsHandler lists active sessions (refresh-token families) with device and location.
+func listSessionsHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	userID := ctxUserID(c)
+	rows, err := db.QueryContext(ctx, `
+		SELECT rt.family_id, rt.user_agent, rt.ip, rt.location, rt.created_at, rt.expires_at,
+			(SELECT MIN(f.created_at) FROM refresh_tokens f WHERE f.family_id = rt.family_id)
+		FROM refresh_tokens rt
+		WHERE rt.user_id = ? AND rt.revoked = 0 AND rt.expires_at > ?
+		ORDER BY rt.created_at DESC
+	`, userID, time.Now().UTC())
+	if err != nil {
+		serverError(c, "listSessions: query", err)
+		return
+	}
+	defer rows.Close()
+
+	current := currentFamily(c)
+	out := []map[string]interface{}{}
+	for rows.Next() {
+		var family, ua, ip, location, firstRaw string
+		var lastActive, expires time.Time
+		if err := rows.Scan(&family, &ua, &ip, &location, &lastActive, &expires, &firstRaw); err != nil {
+			continue
+		}
+		entry := map[string]interface{}{
+			"id":           family,
+			"device":       describeUserAgent(ua),
+			"location":     location,
+			"description":  describeSession(ua, location),
+			"ip":           ip,
+			"lastActiveAt": lastActive,
+			"expiresAt":    expires,
+			"current":      family == current,
+		}
+		if first, ok := parseDBTime(firstRaw); ok {
+			entry["createdAt"] = first
+		}
+		out = append(out, entry)
+	}
+	if err := rows.Err(); err != nil {
+		serverError(c, "listSessions: rows err", err)
+		return
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+func revokeSessionHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	res, err := db.ExecContext(ctx, `UPDATE refresh_tokens SET revoked = 1 WHERE user_id = ? AND family_id = ? AND revoked = 0`,
+		ctxUserID(c), c.Param("id"))
+	if err != nil {
+		serverError(c, "revokeSession: update", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Session revoked"})
+}
+
+// listPoliciesHandler returns the current version of every published policy.
+func listPoliciesHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT p.kind, p.version, p.title, p.published_at
+		FROM policy_documents p
+		WHERE p.version = (SELECT MAX(version) FROM policy_documents WHERE kind = p.kind)
+		ORDER BY p.kind
+	`)
+	if err != nil {
+		serverError(c, "listPolicies: query", err)
+		return
+	}
+	defer rows.Close()
+	out := []gin.H{}
+	for rows.Next() {
+		var kind, title string
+		var version int
+		var published time.Time
+		if err := rows.Scan(&kind, &version, &title, &published); err != nil {
+			continue
+		}
+		out = append(out, gin.H{"kind": kind, "version": version, "title": title, "publishedAt": published})
+	}
+	if err := rows.Err(); err != nil {
+		serverError(c, "listPolicies: rows err", err)
+		return
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// getPolicyHandler serves one policy document; ?version=N selects an older version.
+func getPolicyHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	kind := c.Param("kind")
+	version := currentPolicyVersions()[kind]
+	if v := c.Query("version"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid version"})
+			return
+		}
+		version = n
+	}
+	var title, content string
+	var published time.Time
+	err := db.QueryRowContext(ctx, `SELECT title, content, published_at FROM policy_documents WHERE kind = ? AND version = ?`, kind, version).
+		Scan(&title, &content, &published)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Policy not found"})
+		return
+	}
+	if err != nil {
+		serverError(c, "getPolicy: query", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"kind": kind, "version": version, "title": title, "content": content, "publishedAt": published})
+}
+
+// acceptPoliciesHandler records acceptance of the given policy versions. Only current
+// versions can be accepted so clients can't skip a document they never saw.
+func acceptPoliciesHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	var input struct {
+		Policies map[string]int `json:"policies"`
+	}
+	if err := c.BindJSON(&input); err != nil || len(input.Policies) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	current := currentPolicyVersions()
+	for kind, version := range input.Policies {
+		if current[kind] == 0 || current[kind] != version {
+			c.JSON(http.StatusConflict, gin.H{"error": "Policy version is not current", "code": "policy_version_mismatch", "policies": current})
+			return
+		}
+	}
+	userID := ctxUserID(c)
+	if err := recordPolicyAcceptance(ctx, db, userID, input.Policies, clientIP(c)); err != nil {
+		serverError(c, "acceptPolicies: insert", err)
+		return
+	}
+	accepted, err := userAcceptedPolicies(ctx, userID)
+	if err != nil {
+		serverError(c, "acceptPolicies: reload", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"accepted": accepted, "missing": missingPolicies(accepted)})
+}
+
+// adminPublishPolicyHandler publishes a new version of a policy. Every user has to
+// re-accept it before using authenticated endpoints again.
+func adminPublishPolicyHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	var input struct {
+		Kind    string `json:"kind"`
+		Title   string `json:"title"`
+		Content string `json:"content"`
+	}
+	if err := c.BindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	input.Title = strings.TrimSpace(input.Title)
+	if !policyKindRe.MatchString(input.Kind) || input.Title == "" || strings.TrimSpace(input.Content) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "kind, title and content are required"})
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		serverError(c, "publishPolicy: begin tx", err)
+		return
+	}
+	defer tx.Rollback()
+	var version int
+	if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) + 1 FROM policy_documents WHERE kind = ?`, input.Kind).Scan(&version); err != nil {
+		serverError(c, "publishPolicy: next version", err)
+		return
+	}
+	now := time.Now().UTC()
+	if _, err := tx.ExecContext(ctx, `INSERT INTO policy_documents(kind, version, title, content, published_at) VALUES (?,?,?,?,?)`,
+		input.Kind, version, input.Title, input.Content, now); err != nil {
+		serverError(c, "publishPolicy: insert", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		serverError(c, "publishPolicy: commit", err)
+		return
+	}
+	if err := loadPolicyVersions(ctx); err != nil {
+		log.Printf("publishPolicy: reload versions: %v", err)
+	}
+	log.Printf("policy: %s v%d published by %s", input.Kind, version, ctxUserID(c))
+	c.JSON(http.StatusCreated, gin.H{"kind": input.Kind, "version": version, "publishedAt": now})
+}
+
+// unsubscribePageHandler shows a confirmation form. GET never unsubscribes so that link
+// scanners in mail filters can't opt people out.
+func unsubscribePageHandler(c *gin.Context) {
+	email, category, token := c.Query("e"), c.Query("c"), c.Query("t")
+	if !validEmailCategory(category) || !hmac.Equal([]byte(token), []byte(unsubscribeToken(email, category))) {
+		c.Data(http.StatusBadRequest, "text/html; charset=utf-8", []byte("<p>This unsubscribe link is invalid.</p>"))
+		return
+	}
+	page := fmt.Sprintf(`<!doctype html><html><body style="font-family:sans-serif">
+<p>Stop sending %s emails to <strong>%s</strong>?</p>
+<form method="post"><button type="submit">Unsubscribe</button></form>
+</body></html>`, html.EscapeString(category), html.EscapeString(email))
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(page))
+}
+
+// unsubscribeHandler handles both the confirmation form and RFC 8058 one-click POSTs.
+func unsubscribeHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	email, category, token := strings.ToLower(c.Query("e")), c.Query("c"), c.Query("t")
+	if !validEmailCategory(category) || !hmac.Equal([]byte(token), []byte(unsubscribeToken(email, category))) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid unsubscribe link"})
+		return
+	}
+	source := "link"
+	if c.PostForm("List-Unsubscribe") == "One-Click" {
+		source = "one-click"
+	}
+	if _, err := db.ExecContext(ctx, `INSERT OR IGNORE INTO email_suppressions(email, category, source, created_at) VALUES (?,?,?,?)`,
+		suppressionKey(email), category, source, time.Now().UTC()); err != nil {
+		serverError(c, "unsubscribe: insert", err)
+		return
+	}
+	metricInc("plannie_email_unsubscribes_total", "category", category, "source", source)
+	if source == "one-click" {
+		c.Status(http.StatusOK)
+		return
+	}
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte("<p>You have been unsubscribed.</p>"))
+}
+
+func loadEmailSuppressions(ctx context.Context, email string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `SELECT category FROM email_suppressions WHERE email = ? ORDER BY category`, suppressionKey(email))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []string{}
+	for rows.Next() {
+		var category string
+		if err := rows.Scan(&category); err != nil {
+			return nil, err
+		}
+		out = append(out, category)
+	}
+	return out, rows.Err()
+}
+
+func getEmailSuppressionsHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	var email string
+	if err := db.QueryRowContext(ctx, `SELECT unseal(email) FROM users WHERE id = ?`, ctxUserID(c)).Scan(&email); err != nil {
+		serverError(c, "getEmailSuppressions: select user", err)
+		return
+	}
+	suppressed, err := loadEmailSuppressions(ctx, email)
+	if err != nil {
+		serverError(c, "getEmailSuppressions: query", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"categories": emailCategories, "suppressed": suppressed})
+}
+
+// updateEmailSuppressionsHandler toggles a category: {"category":"reminders","subscribed":false}.
+func updateEmailSuppressionsHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	var input struct {
+		Category   string `json:"category"`
+		Subscribed bool   `json:"subscribed"`
+	}
+	if err := c.BindJSON(&input); err != nil || !validEmailCategory(input.Category) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	var email string
+	if err := db.QueryRowContext(ctx, `SELECT unseal(email) FROM users WHERE id = ?`, ctxUserID(c)).Scan(&email); err != nil {
+		serverError(c, "updateEmailSuppressions: select user", err)
+		return
+	}
+	key := suppressionKey(email)
+	var err error
+	if input.Subscribed {
+		_, err = db.ExecContext(ctx, `DELETE FROM email_suppressions WHERE email = ? AND category = ?`, key, input.Category)
+	} else {
+		_, err = db.ExecContext(ctx, `INSERT OR IGNORE INTO email_suppressions(email, category, source, created_at) VALUES (?,?,?,?)`,
+			key, input.Category, "settings", time.Now().UTC())
+	}
+	if err != nil {
+		serverError(c, "updateEmailSuppressions: write", err)
+		return
+	}
+	suppressed, err := loadEmailSuppressions(ctx, email)
+	if err != nil {
+		serverError(c, "updateEmailSuppressions: reload", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"categories": emailCategories, "suppressed": suppressed})
+}
+
+// notificationPreferences are per-account switches, kept apart from email_suppressions so
+// they follow the user across email changes.
+type notificationPreferences struct {
+	InviteEmails bool       `json:"inviteEmails"`
+	SnoozedUntil *time.Time `json:"snoozedUntil,omitempty"`
+	// ReminderLeadHours says how many hours before a scheduled event to send a reminder,
+	// e.g. [24, 1]; empty turns event reminders off.
+	ReminderLeadHours []int `json:"reminderLeadHours"`
+}
+
+// loadNotificationPreferences returns the user's preferences, with everything enabled when
+// nothing was saved yet. SnoozedUntil is only set while a snooze is running.
+func loadNotificationPreferences(ctx context.Context, userID string) (notificationPreferences, error) {
+	prefs := notificationPreferences{InviteEmails: true, ReminderLeadHours: defaultReminderLeads}
+	var snoozed sql.NullTime
+	var leadsJSON string
+	err := db.QueryRowContext(ctx, `SELECT invite_emails, snoozed_until, reminder_leads FROM notification_preferences WHERE user_id = ?`, userID).Scan(&prefs.InviteEmails, &snoozed, &leadsJSON)
+	if err == sql.ErrNoRows {
+		return prefs, nil
+	}
+	if snoozed.Valid && snoozed.Time.After(time.Now()) {
+		prefs.SnoozedUntil = &snoozed.Time
+	}
+	prefs.ReminderLeadHours = parseReminderLeads(leadsJSON)
+	return prefs, err
+}
+
+// maxSnooze caps how far ahead notifications can be muted.
+const maxSnooze = 90 * 24 * time.Hour
+
+// notificationsSnoozed reports whether userID muted non-essential notifications for now.
+// Every non-essential channel checks it before sending; transactional mail ignores it.
+func notificationsSnoozed(ctx context.Context, userID string) bool {
+	if userID == "" {
+		return false
+	}
+	var n int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM notification_preferences WHERE user_id = ? AND snoozed_until > ?`, userID, time.Now().UTC()).Scan(&n); err != nil {
+		logIfTimeout(err, "notificationsSnoozed: select")
+		return false
+	}
+	return n > 0
+}
+
+// snoozeNotificationsHandler mutes non-essential notifications until ?until= (RFC 3339, in
+// the future and at most maxSnooze ahead). DELETE ends a running snooze.
+func snoozeNotificationsHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	userID := ctxUserID(c)
+	now := time.Now().UTC()
+	var until sql.NullTime
+	if c.Request.Method != http.MethodDelete {
+		t, err := time.Parse(time.RFC3339, c.Query("until"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "until must be an RFC 3339 time"})
+			return
+		}
+		if !t.After(now) || t.Sub(now) > maxSnooze {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "until must be in the future and within 90 days"})
+			return
+		}
+		until = sql.NullTime{Time: t.UTC(), Valid: true}
+	}
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO notification_preferences(user_id, invite_emails, snoozed_until, updated_at) VALUES (?,1,?,?)
+		ON CONFLICT(user_id) DO UPDATE SET snoozed_until = excluded.snoozed_until, updated_at = excluded.updated_at
+	`, userID, until, now); err != nil {
+		serverError(c, "snoozeNotifications: upsert", err)
+		return
+	}
+	if !until.Valid {
+		c.JSON(http.StatusOK, gin.H{"snoozed": false})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"snoozed": true, "snoozedUntil": until.Time})
+}
+
+func getNotificationPreferencesHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	prefs, err := loadNotificationPreferences(ctx, ctxUserID(c))
+	if err != nil {
+		serverError(c, "getNotificationPreferences: select", err)
+		return
+	}
+	c.JSON(http.StatusOK, prefs)
+}
+
+// updateNotificationPreferencesHandler changes the fields present in the body, e.g.
+// {"inviteEmails":false} or {"reminderLeadHours":[24,1]}.
+func updateNotificationPreferencesHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	var input struct {
+		InviteEmails      *bool  `json:"inviteEmails"`
+		ReminderLeadHours *[]int `json:"reminderLeadHours"`
+	}
+	if err := c.BindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	var leads []int
+	if input.ReminderLeadHours != nil {
+		var err error
+		if leads, err = validReminderLeads(*input.ReminderLeadHours); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	userID := ctxUserID(c)
+	prefs, err := loadNotificationPreferences(ctx, userID)
+	if err != nil {
+		serverError(c, "updateNotificationPreferences: select", err)
+		return
+	}
+	if input.InviteEmails != nil {
+		prefs.InviteEmails = *input.InviteEmails
+	}
+	if input.ReminderLeadHours != nil {
+		prefs.ReminderLeadHours = leads
+	}
+	leadsJSON, _ := json.Marshal(prefs.ReminderLeadHours)
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO notification_preferences(user_id, invite_emails, reminder_leads, updated_at) VALUES (?,?,?,?)
+		ON CONFLICT(user_id) DO UPDATE SET invite_emails = excluded.invite_emails, reminder_leads = excluded.reminder_leads, updated_at = excluded.updated_at
+	`, userID, prefs.InviteEmails, string(leadsJSON), time.Now().UTC()); err != nil {
+		serverError(c, "updateNotificationPreferences: upsert", err)
+		return
+	}
+	c.JSON(http.StatusOK, prefs)
+}
+
+// Event reminders. eventReminderLoop emails every participant of a scheduled event a
+// reminder at each of their lead times (notification_preferences.reminder_leads, hours,
+// default 24) before it starts; weekly events are reminded before every occurrence. Each
+// send is claimed in email_notifications_sent, keyed by user, event, occurrence and lead,
+// before the message is queued, so restarts and other replicas never send it twice; a
+// failed queue releases the claim for the next tick. Leads that had already passed when
+// the event was finalized are skipped, since the finalization email went out then, and
+// when several leads are due at once (the server was down) one reminder covers them. An
+// event's own reminder schedule replaces the lead times, and participants who muted the
+// event get nothing.
+const (
+	reminderKindEvent   = "event_reminder"
+	maxReminderLeads    = 3
+	maxReminderLeadHour = 7 * 24
+	reminderLedgerTTL   = 30 * 24 * time.Hour
+)
+
+var defaultReminderLeads = []int{24}
+
+// parseReminderLeads reads the stored JSON list, treating garbage as the default.
+func parseReminderLeads(raw string) []int {
+	var leads []int
+	if err := json.Unmarshal([]byte(raw), &leads); err != nil {
+		return defaultReminderLeads
+	}
+	if leads == nil {
+		leads = []int{}
+	}
+	return leads
+}
+
+// validReminderLeads checks a requested list and returns it sorted, largest first,
+// without duplicates.
+func validReminderLeads(leads []int) ([]int, error) {
+	seen := map[int]bool{}
+	out := []int{}
+	for _, h := range leads {
+		if h < 1 || h > maxReminderLeadHour {
+			return nil, fmt.Errorf("reminderLeadHours must be between 1 and %d", maxReminderLeadHour)
+		}
+		if !seen[h] {
+			seen[h] = true
+			out = append(out, h)
+		}
+	}
+	if len(out) > maxReminderLeads {
+		return nil, fmt.Errorf("at most %d reminder lead times", maxReminderLeads)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(out)))
+	return out, nil
+}
+
+func eventReminderLoop(ctx context.Context) error {
+	return runEvery(ctx, time.Minute, func(ctx context.Context) { sendEventReminders(ctx, time.Now().UTC()) })
+}
+
+// nextOccurrence returns the start to remind about: the finalized slot itself, or for a
+// weekly event the first weekly repeat that has not started yet.
+// Repeats keep their local time across daylight saving changes in the event timezone.
+func nextOccurrence(start time.Time, recurrence, tz string, now time.Time) time.Time {
+	if recurrence != recurrenceWeekly || !start.Before(now) {
+		return start
+	}
+	local := start.In(eventLocation(tz))
+	next := local.AddDate(0, 0, 7*int(now.Sub(start)/(7*24*time.Hour)))
+	for !next.After(now) {
+		next = next.AddDate(0, 0, 7)
+	}
+	return next.UTC()
+}
+
+func sendEventReminders(ctx context.Context, now time.Time) {
+	if _, err := db.ExecContext(ctx, `DELETE FROM email_notifications_sent WHERE sent_at < ?`, now.Add(-reminderLedgerTTL)); err != nil {
+		logIfTimeout(err, "reminders: prune ledger")
+	}
+
+	type scheduled struct {
+		id, name, tz, recurrence string
+		start, finalizedAt       time.Time
+		leads                    []int
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, name, timezone, recurrence, finalized_slot, finalized_at, reminder_schedule FROM events
+		WHERE finalized_slot IS NOT NULL AND finalized_at IS NOT NULL AND archived_at IS NULL
+			AND (recurrence = ? OR date_to >= ?)
+	`, recurrenceWeekly, now.AddDate(0, 0, -1).Format("2006-01-02"))
+	if err != nil {
+		logIfTimeout(err, "reminders: select events")
+		return
+	}
+	var due []scheduled
+	horizon := now.Add(maxReminderLeadHour * time.Hour)
+	for rows.Next() {
+		var ev scheduled
+		var slot string
+		var schedule sql.NullString
+		if err := rows.Scan(&ev.id, &ev.name, &ev.tz, &ev.recurrence, &slot, &ev.finalizedAt, &schedule); err != nil {
+			continue
+		}
+		if s := parseReminderSchedule(schedule); s != nil {
+			ev.leads = s.StartLeadHours
+		}
+		start, err := parseSlotKey(slot)
+		if err != nil {
+			continue
+		}
+		ev.start = nextOccurrence(start, ev.recurrence, ev.tz, now)
+		if ev.start.After(now) && !ev.start.After(horizon) {
+			due = append(due, ev)
+		}
+	}
+	rows.Close()
+
+	for _, ev := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		sendEventReminder(ctx, ev.id, ev.name, ev.tz, ev.start, ev.finalizedAt, ev.leads, now)
+	}
+	sendDeadlineReminders(ctx, now)
+}
+
+// sendEventReminder reminds the participants of one occurrence whose lead time has come.
+// leads is the event's own schedule, nil to use each participant's lead times.
+func sendEventReminder(ctx context.Context, eventID, name, tz string, start, finalizedAt time.Time, leads []int, now time.Time) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT u.id, unseal(u.email), u.locale, COALESCE(np.reminder_leads, '[24]')
+		FROM event_participants ep
+		JOIN users u ON u.id = ep.user_id
+		LEFT JOIN notification_preferences np ON np.user_id = u.id
+		WHERE ep.event_id = ? AND ep.reminders_muted = 0 AND u.email_verified = 1 AND u.deactivated_at IS NULL
+			AND NOT EXISTS (SELECT 1 FROM event_confirmations c WHERE c.event_id = ep.event_id AND c.user_id = ep.user_id AND c.status IN ('declined', 'waitlisted'))
+	`, eventID)
+	if err != nil {
+		logIfTimeout(err, "reminders: select participants")
+		return
+	}
+	type recipient struct {
+		userID, email, locale string
+		leads                 []int
+	}
+	var recipients []recipient
+	for rows.Next() {
+		var r recipient
+		var leadsJSON string
+		if err := rows.Scan(&r.userID, &r.email, &r.locale, &leadsJSON); err != nil {
+			continue
+		}
+		r.leads = parseReminderLeads(leadsJSON)
+		if leads != nil {
+			r.leads = leads
+		}
+		recipients = append(recipients, r)
+	}
+	rows.Close()
+
+	slot := formatSlotKey(start)
+	link := appBaseURL() + "/event/" + eventID
+	for _, r := range recipients {
+		var claimed []int
+		for _, lead := range r.leads {
+			remindAt := start.Add(-time.Duration(lead) * time.Hour)
+			if now.Before(remindAt) || finalizedAt.After(remindAt) {
+				continue
+			}
+			res, err := db.ExecContext(ctx, `
+				INSERT OR IGNORE INTO email_notifications_sent(user_id, event_id, kind, slot, lead_hours, sent_at) VALUES (?,?,?,?,?,?)
+			`, r.userID, eventID, reminderKindEvent, slot, lead, now)
+			if err != nil {
+				logIfTimeout(err, "reminders: claim")
+				continue
+			}
+			if n, _ := res.RowsAffected(); n == 1 {
+				claimed = append(claimed, lead)
+			}
+		}
+		if len(claimed) == 0 {
+			continue
+		}
+		locale := resolveLocale(r.locale)
+		when := formatLocalTime(start.In(eventLocation(tz)), locale)
+		subject, _ := localizedEmail(locale, reminderKindEvent, name, when, link)
+		_, body := localizedEmail(locale, reminderKindEvent, html.EscapeString(name), when, link)
+		if err := sendNonEssentialEmail(ctx, emailCategoryReminders, r.userID, r.email, subject, body); err != nil {
+			log.Printf("reminders: queue email: %v", err)
+			for _, lead := range claimed {
+				if _, err := db.ExecContext(ctx, `
+					DELETE FROM email_notifications_sent WHERE user_id = ? AND event_id = ? AND kind = ? AND slot = ? AND lead_hours = ?
+				`, r.userID, eventID, reminderKindEvent, slot, lead); err != nil {
+					logIfTimeout(err, "reminders: release claim")
+				}
+			}
+			continue
+		}
+		metricInc("plannie_event_reminders_total")
+	}
+}
+
+// Per-event reminder schedules. Organizers can replace the defaults for one event with
+// their own lead times, in hours: startLeadHours before the finalized slot, overriding
+// each participant's reminderLeadHours (an empty list turns them off for the event), and
+// deadlineLeadHours before the response deadline, which nudge participants who haven't
+// answered yet with the same one-click links as a manual reminder. Without a schedule
+// an event has no deadline reminders. Any participant can mute reminders for one event.
+const reminderKindDeadline = "deadline_reminder"
+
+type reminderSchedule struct {
+	DeadlineLeadHours []int `json:"deadlineLeadHours"`
+	// StartLeadHours is nil when participants' own lead times apply.
+	StartLeadHours []int `json:"startLeadHours"`
+}
+
+// parseReminderSchedule reads events.reminder_schedule; nil means the defaults.
+func parseReminderSchedule(raw sql.NullString) *reminderSchedule {
+	if !raw.Valid {
+		return nil
+	}
+	var s reminderSchedule
+	if err := json.Unmarshal([]byte(raw.String), &s); err != nil {
+		return nil
+	}
+	return &s
+}
+
+func reminderScheduleView(raw sql.NullString, muted bool) gin.H {
+	s := parseReminderSchedule(raw)
+	resp := gin.H{"custom": s != nil, "muted": muted, "deadlineLeadHours": []int{}, "startLeadHours": nil}
+	if s != nil {
+		if s.DeadlineLeadHours != nil {
+			resp["deadlineLeadHours"] = s.DeadlineLeadHours
+		}
+		resp["startLeadHours"] = s.StartLeadHours
+	}
+	return resp
+}
+
+func getReminderScheduleHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	eventID := c.Param("id")
+	if _, ok := eventMemberOnly(c, ctx, eventID, "getReminderSchedule"); !ok {
+		return
+	}
+	var raw sql.NullString
+	var muted bool
+	if err := db.QueryRowContext(ctx, `
+		SELECT e.reminder_schedule, COALESCE((SELECT reminders_muted FROM event_participants WHERE event_id = e.id AND user_id = ?), 0)
+		FROM events e WHERE e.id = ?
+	`, ctxUserID(c), eventID).Scan(&raw, &muted); err != nil {
+		serverError(c, "getReminderSchedule: select", err)
+		return
+	}
+	c.JSON(http.StatusOK, reminderScheduleView(raw, muted))
+}
+
+// updateReminderScheduleHandler sets the event's schedule (organizers only). PUT stores
+// the body, DELETE goes back to the defaults.
+func updateReminderScheduleHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	eventID := c.Param("id")
+	userID := ctxUserID(c)
+	role, err := eventRole(ctx, eventID, userID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	} else if err != nil {
+		serverError(c, "updateReminderSchedule: role", err)
+		return
+	}
+	if !canManageEvent(role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only organizers can change reminders"})
+		return
+	}
+
+	var stored sql.NullString
+	if c.Request.Method == http.MethodPut {
+		var input reminderSchedule
+		if err := c.ShouldBindJSON(&input); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid payload"})
+			return
+		}
+		deadline, err := validReminderLeads(input.DeadlineLeadHours)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "deadlineLeadHours: " + err.Error()})
+			return
+		}
+		schedule := reminderSchedule{DeadlineLeadHours: deadline}
+		if input.StartLeadHours != nil {
+			if schedule.StartLeadHours, err = validReminderLeads(input.StartLeadHours); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "startLeadHours: " + err.Error()})
+				return
+			}
+		}
+		b, _ := json.Marshal(schedule)
+		stored = sql.NullString{String: string(b), Valid: true}
+	}
+	if _, err := db.ExecContext(ctx, `UPDATE events SET reminder_schedule = ?, updated_at = ? WHERE id = ?`, stored, time.Now().UTC(), eventID); err != nil {
+		serverError(c, "updateReminderSchedule: update", err)
+		return
+	}
+	ssePublish(eventID, []byte(`{"type":"event_updated","id":"`+eventID+`"}`))
+	var muted bool
+	if err := db.QueryRowContext(ctx, `SELECT reminders_muted FROM event_participants WHERE event_id = ? AND user_id = ?`, eventID, userID).Scan(&muted); err != nil && err != sql.ErrNoRows {
+		serverError(c, "updateReminderSchedule: select muted", err)
+		return
+	}
+	c.JSON(http.StatusOK, reminderScheduleView(stored, muted))
+}
+
+// muteRemindersHandler turns the scheduled reminders of one event off or back on for the
+// caller. Body: {"muted": bool}.
+func muteRemindersHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	var input struct {
+		Muted *bool `json:"muted"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || input.Muted == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "muted is required"})
+		return
+	}
+	res, err := db.ExecContext(ctx, `
+		UPDATE event_participants SET reminders_muted = ?, updated_at = ? WHERE event_id = ? AND user_id = ?
+	`, *input.Muted, time.Now().UTC(), c.Param("id"), ctxUserID(c))
+	if err != nil {
+		serverError(c, "muteReminders: update", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"muted": *input.Muted})
+}
+
+// sendDeadlineReminders nudges participants who haven't answered before the response
+// deadline of events with deadline lead times. Claims work as for event reminders, with
+// the deadline as the occurrence; leads that fell before the event was created never fire.
+func sendDeadlineReminders(ctx context.Context, now time.Time) {
+	type pending struct {
+		ev        Event
+		organizer string
+		deadline  time.Time
+		createdAt time.Time
+		leads     []int
+		creatorID string
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT e.id, e.name, e.date_from, e.date_to, e.duration, e.timezone, e.disabled_slots, e.recurrence, e.reminder_schedule,
+			e.response_deadline, e.created_at, COALESCE(e.creator_id, ''), COALESCE(u.username, '')
+		FROM events e LEFT JOIN users u ON u.id = e.creator_id
+		WHERE e.reminder_schedule IS NOT NULL AND e.finalized_slot IS NULL AND e.archived_at IS NULL
+			AND e.response_deadline > ? AND e.response_deadline <= ?
+	`, now, now.Add(maxReminderLeadHour*time.Hour))
+	if err != nil {
+		logIfTimeout(err, "deadline reminders: select events")
+		return
+	}
+	var due []pending
+	for rows.Next() {
+		var p pending
+		var raw sql.NullString
+		if err := rows.Scan(&p.ev.ID, &p.ev.Name, &p.ev.DateFrom, &p.ev.DateTo, &p.ev.Duration, &p.ev.Timezone, &p.ev.DisabledSlots, &p.ev.Recurrence, &raw,
+			&p.deadline, &p.createdAt, &p.creatorID, &p.organizer); err != nil {
+			continue
+		}
+		if s := parseReminderSchedule(raw); s != nil && len(s.DeadlineLeadHours) > 0 {
+			p.leads = s.DeadlineLeadHours
+			due = append(due, p)
+		}
+	}
+	rows.Close()
+
+	for _, p := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		var leads []int
+		for _, lead := range p.leads {
+			remindAt := p.deadline.Add(-time.Duration(lead) * time.Hour)
+			if !now.Before(remindAt) && !p.createdAt.After(remindAt) {
+				leads = append(leads, lead)
+			}
+		}
+		if len(leads) == 0 {
+			continue
+		}
+		days, _ := openSlotsByDay(p.ev, now)
+		if len(days) == 0 {
+			continue
+		}
+		sendDeadlineReminder(ctx, p.ev, p.creatorID, p.organizer, p.deadline, leads, days, now)
+	}
+}
+
+// sendDeadlineReminder emails the participants of one event who haven't answered, once
+// per due lead.
+func sendDeadlineReminder(ctx context.Context, ev Event, creatorID, organizer string, deadline time.Time, leads []int, days []string, now time.Time) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT ep.id, u.id, unseal(u.email), u.locale
+		FROM event_participants ep JOIN users u ON u.id = ep.user_id
+		WHERE ep.event_id = ? AND ep.availability = '{}' AND ep.unavailable_at IS NULL AND ep.reminders_muted = 0 AND u.id <> ?
+			AND u.email_verified = 1 AND u.deactivated_at IS NULL
+	`, ev.ID, creatorID)
+	if err != nil {
+		logIfTimeout(err, "deadline reminders: select participants")
+		return
+	}
+	type recipient struct{ participantID, userID, email, locale string }
+	var recipients []recipient
+	for rows.Next() {
+		var r recipient
+		if err := rows.Scan(&r.participantID, &r.userID, &r.email, &r.locale); err != nil {
+			continue
+		}
+		recipients = append(recipients, r)
+	}
+	rows.Close()
+
+	slot := formatSlotKey(deadline)
+	loc := eventLocation(ev.Timezone)
+	link := appBaseURL() + "/event/" + ev.ID
+	exp := now.Add(respondLinkTTL).Unix()
+	for _, r := range recipients {
+		var claimed []int
+		for _, lead := range leads {
+			res, err := db.ExecContext(ctx, `
+				INSERT OR IGNORE INTO email_notifications_sent(user_id, event_id, kind, slot, lead_hours, sent_at) VALUES (?,?,?,?,?,?)
+			`, r.userID, ev.ID, reminderKindDeadline, slot, lead, now)
+			if err != nil {
+				logIfTimeout(err, "deadline reminders: claim")
+				continue
+			}
+			if n, _ := res.RowsAffected(); n == 1 {
+				claimed = append(claimed, lead)
+			}
+		}
+		if len(claimed) == 0 {
+			continue
+		}
+		locale := resolveLocale(r.locale)
+		when := formatLocalTime(deadline.In(loc), locale)
+		links := respondLinksHTML(r.participantID, locale, days, loc, exp)
+		subject, _ := localizedEmail(locale, reminderKindDeadline, organizer, ev.Name, when, link, "")
+		_, body := localizedEmail(locale, reminderKindDeadline, html.EscapeString(organizer), html.EscapeString(ev.Name), when, link, links)
+		if err := sendNonEssentialEmail(ctx, emailCategoryReminders, r.userID, r.email, subject, body); err != nil {
+			log.Printf("deadline reminders: queue email: %v", err)
+			for _, lead := range claimed {
+				if _, err := db.ExecContext(ctx, `
+					DELETE FROM email_notifications_sent WHERE user_id = ? AND event_id = ? AND kind = ? AND slot = ? AND lead_hours = ?
+				`, r.userID, ev.ID, reminderKindDeadline, slot, lead); err != nil {
+					logIfTimeout(err, "deadline reminders: release claim")
+				}
+			}
+			continue
+		}
+		metricInc("plannie_deadline_reminders_total")
+	}
+}
+
+// adminEmailQueueHandler reports queue depth, deferred messages and the busiest senders.
+func adminEmailQueueHandler(c *gin.Context) {
+	now := time.Now()
+	emailQueueMu.Lock()
+	depth := len(emailQueue)
+	deferred, retrying := 0, 0
+	var oldest time.Time
+	perUser := map[string]int{}
+	for _, q := range emailQueue {
+		if q.next.After(now) {
+			deferred++
+		}
+		if q.attempts > 0 {
+			retrying++
+		}
+		if oldest.IsZero() || q.queuedAt.Before(oldest) {
+			oldest = q.queuedAt
+		}
+		if q.msg.UserID != "" {
+			perUser[q.msg.UserID]++
+		}
+	}
+	recent := map[string]int{}
+	for userID, sends := range emailUserSends {
+		recent[userID] = len(sends)
+	}
+	emailQueueMu.Unlock()
+
+	type senderStat struct {
+		UserID string `json:"userId"`
+		Queued int    `json:"queued"`
+		Sent   int    `json:"sentInWindow"`
+	}
+	senders := []senderStat{}
+	for userID, n := range perUser {
+		senders = append(senders, senderStat{UserID: userID, Queued: n, Sent: recent[userID]})
+	}
+	sort.Slice(senders, func(i, j int) bool { return senders[i].Queued > senders[j].Queued })
+	if len(senders) > 20 {
+		senders = senders[:20]
+	}
+	resp := gin.H{
+		"depth":         depth,
+		"deferred":      deferred,
+		"retrying":      retrying,
+		"userQuota":     emailUserQuota,
+		"userWindowSec": int(emailUserWindow.Seconds()),
+		"topSenders":    senders,
+	}
+	if !oldest.IsZero() {
+		resp["oldestQueuedAt"] = oldest.UTC()
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// adminEmailDeliverabilityHandler reports delivery outcomes per provider over the last
+// ?days= days (default 30, max 366): a daily series per outcome, oldest first, totals,
+// and bounce and complaint rates relative to sent mail.
+func adminEmailDeliverabilityHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	days := 30
+	if v := c.Query("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxGridDays {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "days must be between 1 and 366"})
+			return
+		}
+		days = n
+	}
+	flushDailyStats()
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	from := today.AddDate(0, 0, -(days - 1))
+	index := map[string]int{}
+	labels := make([]string, days)
+	for i := 0; i < days; i++ {
+		labels[i] = statDay(from.AddDate(0, 0, i))
+		index[labels[i]] = i
+	}
+	rows, err := db.QueryContext(ctx, `SELECT day, provider, outcome, value FROM email_delivery_stats WHERE day >= ? AND day <= ?`, labels[0], labels[days-1])
+	if err != nil {
+		serverError(c, "emailDeliverability: query", err)
+		return
+	}
+	defer rows.Close()
+	series := map[string]map[string][]int64{}
+	totals := map[string]map[string]int64{}
+	for rows.Next() {
+		var day, provider, outcome string
+		var v int64
+		if err := rows.Scan(&day, &provider, &outcome, &v); err != nil {
+			serverError(c, "emailDeliverability: scan", err)
+			return
+		}
+		if series[provider] == nil {
+			series[provider] = map[string][]int64{}
+			totals[provider] = map[string]int64{}
+			for _, o := range emailOutcomes {
+				series[provider][o] = make([]int64, days)
+				totals[provider][o] = 0
+			}
+		}
+		if s, ok := series[provider][outcome]; ok {
+			s[index[day]] += v
+			totals[provider][outcome] += v
+		}
+	}
+	if err := rows.Err(); err != nil {
+		serverError(c, "emailDeliverability: rows", err)
+		return
+	}
+
+	providers := gin.H{}
+	for provider, t := range totals {
+		entry := gin.H{"series": series[provider], "totals": t}
+		if t[emailOutcomeSent] > 0 {
+			entry["bounceRate"] = float64(t[emailOutcomeBounced]) / float64(t[emailOutcomeSent])
+			entry["complaintRate"] = float64(t[emailOutcomeComplained]) / float64(t[emailOutcomeSent])
+		}
+		providers[provider] = entry
+	}
+	resp := gin.H{"days": labels, "provider": emailProvider, "providers": providers}
+	statsMu.Lock()
+	if !emailLastSent.IsZero() {
+		resp["lastSentAt"] = emailLastSent.UTC()
+	}
+	if !emailLastFailure.IsZero() {
+		resp["lastFailureAt"] = emailLastFailure.UTC()
+	}
+	statsMu.Unlock()
+	c.JSON(http.StatusOK, resp)
+}
+
+// devEmailsHandler lists captured mail, newest first. ?to= filters by recipient.
+// Only routed when EMAIL_PROVIDER=memory and ENABLE_DEV_ENDPOINTS=true.
+func devEmailsHandler(c *gin.Context) {
+	to := strings.ToLower(c.Query("to"))
+	devMailboxMu.Lock()
+	out := make([]capturedEmail, 0, len(devMailbox))
+	for i := len(devMailbox) - 1; i >= 0; i-- {
+		if to == "" || strings.ToLower(devMailbox[i].To) == to {
+			out = append(out, devMailbox[i])
+		}
+	}
+	devMailboxMu.Unlock()
+	c.JSON(http.StatusOK, out)
+}
+
+func clearDevEmailsHandler(c *gin.Context) {
+	devMailboxMu.Lock()
+	devMailbox = nil
+	devMailboxMu.Unlock()
+	c.Status(http.StatusNoContent)
+}
+
+// senderAddress is the From address calendar invites name as ORGANIZER.
+func senderAddress() string {
+	if emailProvider == "smtp" {
+		return smtpFromAddress()
+	}
+	return brevoSenderEmail
+}
+
+// buildInviteICS renders an iTIP (RFC 5546) REQUEST or CANCEL for the finalized slot,
+// addressed to a single attendee so participants don't see each other's addresses.
+func buildInviteICS(eventID, name, organizer string, start time.Time, duration time.Duration, method string, sequence int, attendeeName, attendeeEmail, recurrence, tz string) []byte {
+	status := "CONFIRMED"
+	if method == "CANCEL" {
+		status = "CANCELLED"
+	}
+	var b strings.Builder
+	icsFold(&b, "BEGIN:VCALENDAR")
+	icsFold(&b, "VERSION:2.0")
+	icsFold(&b, "PRODID:-//Plannie//Invite//EN")
+	icsFold(&b, "CALSCALE:GREGORIAN")
+	icsFold(&b, "METHOD:"+method)
+	icsFold(&b, "BEGIN:VEVENT")
+	icsFold(&b, "UID:"+eventID+"@plannie")
+	icsFold(&b, "SEQUENCE:"+strconv.Itoa(sequence))
+	icsFold(&b, "DTSTAMP:"+time.Now().UTC().Format(icsTimeLayout))
+	if loc := eventLocation(tz); recurrence == recurrenceWeekly && loc != time.UTC {
+		// Local wall-clock times keep the meeting at the same hour across DST changes.
+		icsFold(&b, "DTSTART;TZID="+loc.String()+":"+start.In(loc).Format("20060102T150405"))
+		icsFold(&b, "DTEND;TZID="+loc.String()+":"+start.Add(duration).In(loc).Format("20060102T150405"))
+	} else {
+		icsFold(&b, "DTSTART:"+start.UTC().Format(icsTimeLayout))
+		icsFold(&b, "DTEND:"+start.Add(duration).UTC().Format(icsTimeLayout))
+	}
+	if recurrence == recurrenceWeekly {
+		icsFold(&b, "RRULE:FREQ=WEEKLY")
+	}
+	icsFold(&b, "SUMMARY:"+icsEscape(name))
+	icsFold(&b, "URL:"+appBaseURL()+"/event/"+eventID)
+	icsFold(&b, "STATUS:"+status)
+	if addr := senderAddress(); addr != "" {
+		icsFold(&b, "ORGANIZER;CN="+icsEscape(organizer)+":mailto:"+addr)
+	}
+	icsFold(&b, "ATTENDEE;CN="+icsEscape(attendeeName)+";ROLE=REQ-PARTICIPANT;PARTSTAT=NEEDS-ACTION;RSVP=FALSE:mailto:"+attendeeEmail)
+	icsFold(&b, "END:VEVENT")
+	icsFold(&b, "END:VCALENDAR")
+	return []byte(b.String())
+}
+
+// finalizationEmails builds the per-participant REQUEST/CANCEL emails for an event's
+// current finalized slot. sequenceBump is added to the stored ics_sequence so the
+// message supersedes the one already in recipients' calendars. Returns nil when the
+// event isn't finalized.
+func finalizationEmails(ctx context.Context, eventID, method string, sequenceBump int) ([]outgoingEmail, error) {
+	var name, tz, creatorID, organizer, recurrence string
+	var duration float64
+	var slot sql.NullString
+	var sequence int
+	err := db.QueryRowContext(ctx, `
+		SELECT e.name, e.timezone, e.duration, e.finalized_slot, e.ics_sequence, e.creator_id, u.username, e.recurrence
+		FROM events e JOIN users u ON u.id = e.creator_id WHERE e.id = ?
+	`, eventID).Scan(&name, &tz, &duration, &slot, &sequence, &creatorID, &organizer, &recurrence)
+	if err != nil || !slot.Valid {
+		return nil, err
+	}
+	start, err := parseSlotKey(slot.String)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT u.username, unseal(u.email), u.locale
+		FROM event_participants ep JOIN users u ON u.id = ep.user_id
+		WHERE ep.event_id = ? AND u.email_verified = 1 AND u.deactivated_at IS NULL
+	`, eventID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	key, contentType := "finalized", "text/calendar; method=REQUEST; charset=utf-8"
+	if method == "CANCEL" {
+		key, contentType = "finalize_cancelled", "text/calendar; method=CANCEL; charset=utf-8"
+	}
+	local := start.In(eventLocation(tz))
+	var out []outgoingEmail
+	for rows.Next() {
+		var username, email, locale string
+		if err := rows.Scan(&username, &email, &locale); err != nil {
+			return nil, err
+		}
+		locale = resolveLocale(locale)
+		when, link := formatLocalTime(local, locale), appBaseURL()+"/event/"+eventID
+		if recurrence == recurrenceWeekly {
+			when = formatWeeklyTime(local, locale)
+		}
+		subject, _ := localizedEmail(locale, key, name, when, link)
+		_, body := localizedEmail(locale, key, html.EscapeString(name), when, link)
+		ics := buildInviteICS(eventID, name, organizer, start, time.Duration(duration)*time.Minute, method, sequence+sequenceBump, username, email, recurrence, tz)
+		out = append(out, outgoingEmail{
+			UserID:      creatorID,
+			To:          email,
+			Subject:     subject,
+			HTML:        body,
+			Attachments: []emailAttachment{{Filename: "invite.ics", ContentType: contentType, Data: ics}},
+		})
+	}
+	return out, rows.Err()
+}
+
+// finalizeEventHandler locks in one slot and emails participants a calendar invitation.
+// Finalizing again with another slot sends an updated REQUEST with a higher SEQUENCE.
+func finalizeEventHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	id := c.Param("id")
+	var input struct {
+		Slot string `json:"slot"`
+	}
+	if err := c.BindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+
+	var ev Event
+	err := db.QueryRowContext(ctx, `SELECT id, COALESCE(creator_id, ''), name, date_from, date_to, duration, timezone, disabled_slots, recurrence FROM events WHERE id = ?`, id).
+		Scan(&ev.ID, &ev.CreatorID, &ev.Name, &ev.DateFrom, &ev.DateTo, &ev.Duration, &ev.Timezone, &ev.DisabledSlots, &ev.Recurrence)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	} else if err != nil {
+		serverError(c, "finalize: select event", err)
+		return
+	}
+	role, err := eventRole(ctx, id, ctxUserID(c))
+	if err != nil {
+		serverError(c, "finalize: role", err)
+		return
+	}
+	if !canManageEvent(role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only organizers can finalize"})
+		return
+	}
+	var disabled []string
+	_ = json.Unmarshal([]byte(ev.DisabledSlots), &disabled)
+	var slot time.Time
+	valid := false
+	if ev.Recurrence == recurrenceWeekly {
+		// The weekly key starts the standing meeting at its next occurrence.
+		valid = validWeeklySlot(input.Slot, ev.Duration)
+		for _, d := range disabled {
+			valid = valid && d != input.Slot
+		}
+		if valid {
+			slot, err = nextWeeklyOccurrence(input.Slot, eventLocation(ev.Timezone), time.Now())
+			valid = err == nil
+		}
+	} else {
+		if slot, err = parseSlotKey(input.Slot); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid slot"})
+			return
+		}
+		for _, t := range eventSlotGrid(ev) {
+			if t.Equal(slot) {
+				valid = true
+				break
+			}
+		}
+		for _, d := range disabled {
+			if t, err := parseSlotKey(d); err == nil && t.Equal(slot) {
+				valid = false
+			}
+		}
+	}
+	if !valid {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Slot is not part of this event"})
+		return
+	}
+	if slot.Before(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Slot is in the past"})
+		return
+	}
+
+	now := time.Now().UTC()
+	key := formatSlotKey(slot)
+	if _, err := finalizeEvent(ctx, id, key, now, false); err != nil {
+		serverError(c, "finalize: update", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"finalizedSlot": key, "finalizedAt": now})
+}
+
+// finalizeEvent stores the finalized slot, emails participants a calendar invitation and
+// notifies subscribers. With onlyOpen it does nothing and reports false when the event
+// is already finalized, so racing auto-finalizations send one set of invitations.
+func finalizeEvent(ctx context.Context, id, key string, now time.Time, onlyOpen bool) (bool, error) {
+	query := `UPDATE events SET finalized_slot = ?, finalized_at = ?, ics_sequence = ics_sequence + 1, updated_at = ? WHERE id = ?`
+	if onlyOpen {
+		query += ` AND finalized_slot IS NULL`
+	}
+	res, err := db.ExecContext(ctx, query, key, now, now, id)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	if _, err := db.ExecContext(ctx, `DELETE FROM event_shortlist WHERE event_id = ? AND slot <> ?`, id, key); err != nil {
+		logIfTimeout(err, "finalize: drop shortlist")
+	}
+	resetConfirmation(ctx, id)
+
+	invites, err := finalizationEmails(ctx, id, "REQUEST", 0)
+	if err != nil {
+		logIfTimeout(err, "finalize: build invites")
+	}
+	for _, m := range invites {
+		if err := enqueueEmail(m); err != nil {
+			log.Printf("finalize: queue invite: %v", err)
+		}
+	}
+
+	payload, _ := json.Marshal(gin.H{"type": "event_finalized", "id": id, "slot": key, "finalizedAt": now})
+	ssePublish(id, payload)
+	return true, nil
+}
+
+// finalizedConflict rejects an availability edit on a finalized event; an organizer has to
+// reopen it first.
+func finalizedConflict(c *gin.Context) {
+	c.JSON(http.StatusConflict, gin.H{"error": "Event is finalized; availability can no longer be changed", "code": "event_finalized"})
+}
+
+// unfinalizeEventHandler reopens scheduling and sends CANCEL updates for the old slot.
+func unfinalizeEventHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	id := c.Param("id")
+	var creatorID string
+	var slot sql.NullString
+	err := db.QueryRowContext(ctx, `SELECT COALESCE(creator_id, ''), finalized_slot FROM events WHERE id = ?`, id).Scan(&creatorID, &slot)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	} else if err != nil {
+		serverError(c, "unfinalize: select event", err)
+		return
+	}
+	role, err := eventRole(ctx, id, ctxUserID(c))
+	if err != nil {
+		serverError(c, "unfinalize: role", err)
+		return
+	}
+	if !canManageEvent(role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only organizers can unfinalize"})
+		return
+	}
+	if !slot.Valid {
+		c.JSON(http.StatusConflict, gin.H{"error": "Event is not finalized"})
+		return
+	}
+
+	cancellations, err := finalizationEmails(ctx, id, "CANCEL", 1)
+	if err != nil {
+		logIfTimeout(err, "unfinalize: build cancellations")
+	}
+	if _, err := db.ExecContext(ctx, `
+		UPDATE events SET finalized_slot = NULL, finalized_at = NULL, ics_sequence = ics_sequence + 1, updated_at = ? WHERE id = ?
+	`, time.Now().UTC(), id); err != nil {
+		serverError(c, "unfinalize: update", err)
+		return
+	}
+	resetConfirmation(ctx, id)
+	for _, m := range cancellations {
+		if err := enqueueEmail(m); err != nil {
+			log.Printf("unfinalize: queue cancellation: %v", err)
+		}
+	}
+
+	ssePublish(id, []byte(`{"type":"event_updated","id":"`+id+`"}`))
+	c.JSON(http.StatusOK, gin.H{"message": "Event reopened"})
+}
+
+// WorkingHours are a user's scheduling constraints. Weekly lists the windows (in the
+// user's timezone) they can be scheduled in; an empty list means no weekly constraint.
+// Blackouts are absolute do-not-schedule ranges such as vacations.
+type WorkingHours struct {
+	Timezone  string              `json:"timezone"`
+	Weekly    []WorkingHoursRange `json:"weekly"`
+	Blackouts []BlackoutRange     `json:"blackouts"`
+}
+
+type WorkingHoursRange struct {
+	Days  []int  `json:"days"` // 0 = Sunday … 6 = Saturday
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+type BlackoutRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+const maxWorkingHoursEntries = 50
+
+// parseClock parses "HH:MM" into minutes after midnight; "24:00" is allowed as an end.
+func parseClock(s string) (int, bool) {
+	h, m, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, false
+	}
+	hh, err1 := strconv.Atoi(h)
+	mm, err2 := strconv.Atoi(m)
+	if err1 != nil || err2 != nil || hh < 0 || mm < 0 || mm > 59 || hh > 24 || (hh == 24 && mm != 0) {
+		return 0, false
+	}
+	return hh*60 + mm, true
+}
+
+func (w WorkingHours) validate() error {
+	if w.Timezone != "" {
+		if _, err := time.LoadLocation(w.Timezone); err != nil {
+			return errors.New("unknown timezone")
+		}
+	}
+	if len(w.Weekly) > maxWorkingHoursEntries || len(w.Blackouts) > maxWorkingHoursEntries {
+		return errors.New("too many entries")
+	}
+	for _, r := range w.Weekly {
+		start, ok1 := parseClock(r.Start)
+		end, ok2 := parseClock(r.End)
+		if !ok1 || !ok2 || end <= start || len(r.Days) == 0 {
+			return errors.New("invalid weekly range")
+		}
+		for _, d := range r.Days {
+			if d < 0 || d > 6 {
+				return errors.New("invalid weekday")
+			}
+		}
+	}
+	for _, b := range w.Blackouts {
+		if !b.To.After(b.From) {
+			return errors.New("invalid blackout")
+		}
+	}
+	return nil
+}
+
+// allows reports whether [start, start+d) fits the working hours.
+func (w WorkingHours) allows(start time.Time, d time.Duration) bool {
+	end := start.Add(d)
+	for _, b := range w.Blackouts {
+		if start.Before(b.To) && end.After(b.From) {
+			return false
+		}
+	}
+	if len(w.Weekly) == 0 {
+		return true
+	}
+	local := start.In(eventLocation(w.Timezone))
+	localEnd := end.In(local.Location())
+	startMin := local.Hour()*60 + local.Minute()
+	endMin := startMin + int(d.Minutes())
+	if localEnd.YearDay() != local.YearDay() && !(localEnd.Hour() == 0 && localEnd.Minute() == 0) {
+		return false // spans midnight
+	}
+	for _, r := range w.Weekly {
+		from, _ := parseClock(r.Start)
+		to, _ := parseClock(r.End)
+		for _, day := range r.Days {
+			if time.Weekday(day) == local.Weekday() && startMin >= from && endMin <= to {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func loadWorkingHours(ctx context.Context, userID string) (WorkingHours, error) {
+	var raw string
+	var wh WorkingHours
+	err := db.QueryRowContext(ctx, `SELECT working_hours FROM user_preferences WHERE user_id = ?`, userID).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return wh, nil
+	}
+	if err != nil {
+		return wh, err
+	}
+	_ = json.Unmarshal([]byte(raw), &wh)
+	return wh, nil
+}
+
+func getWorkingHoursHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	wh, err := loadWorkingHours(ctx, ctxUserID(c))
+	if err != nil {
+		serverError(c, "getWorkingHours: select", err)
+		return
+	}
+	if wh.Weekly == nil {
+		wh.Weekly = []WorkingHoursRange{}
+	}
+	if wh.Blackouts == nil {
+		wh.Blackouts = []BlackoutRange{}
+	}
+	c.JSON(http.StatusOK, wh)
+}
+
+func updateWorkingHoursHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	var input WorkingHours
+	if err := c.BindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	if err := input.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid working hours: " + err.Error()})
+		return
+	}
+	raw, _ := json.Marshal(input)
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO user_preferences(user_id, working_hours, updated_at) VALUES (?,?,?)
+		ON CONFLICT(user_id) DO UPDATE SET working_hours = excluded.working_hours, updated_at = excluded.updated_at
+	`, ctxUserID(c), string(raw), time.Now().UTC()); err != nil {
+		serverError(c, "updateWorkingHours: upsert", err)
+		return
+	}
+	c.JSON(http.StatusOK, input)
+}
+
+// workingHoursPenalty is subtracted from a slot's score per required participant the
+// slot falls outside of, when ?workingHours=penalize.
+const workingHoursPenalty = 0.5
+
+// eventSuggestionsHandler ranks the event's slots by how many participants are available.
+// ?workingHours=exclude drops slots outside any required participant's working hours,
+// =penalize lowers their score. ?required= lists user IDs (default: all participants).
+// Slots on public holidays of the event's region are flagged, or dropped with ?holidays=exclude.
+func eventSuggestionsHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	id := c.Param("id")
+	mode := c.DefaultQuery("workingHours", "ignore")
+	if mode != "ignore" && mode != "exclude" && mode != "penalize" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "workingHours must be ignore, exclude or penalize"})
+		return
+	}
+	limit := 10
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit"})
+			return
+		}
+		limit = n
+	}
+
+	holidayMode := c.DefaultQuery("holidays", "flag")
+	if holidayMode != "flag" && holidayMode != "exclude" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "holidays must be flag or exclude"})
+		return
+	}
+
+	var ev Event
+	var passHash sql.NullString
+	var holidayRegion string
+	err := db.QueryRowContext(ctx, `SELECT id, name, date_from, date_to, duration, timezone, disabled_slots, recurrence, passphrase_hash, holiday_region FROM events WHERE id = ?`, id).
+		Scan(&ev.ID, &ev.Name, &ev.DateFrom, &ev.DateTo, &ev.Duration, &ev.Timezone, &ev.DisabledSlots, &ev.Recurrence, &passHash, &holidayRegion)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	} else if err != nil {
+		serverError(c, "suggestions: select event", err)
+		return
+	}
+	if !eventAccessAllowed(ctx, c, id, passHash, optionalAuth(c)) {
+		passphraseRequired(c)
+		return
+	}
+
+	counts, total, err := tallyAvailability(ctx, id, ev.DisabledSlots)
+	if err != nil {
+		serverError(c, "suggestions: tally", err)
+		return
+	}
+
+	type constrained struct {
+		id, name string
+		hours    WorkingHours
+	}
+	var required []constrained
+	if mode != "ignore" {
+		wanted := map[string]bool{}
+		for _, uid := range strings.Split(c.Query("required"), ",") {
+			if uid = strings.TrimSpace(uid); uid != "" {
+				wanted[uid] = true
+			}
+		}
+		rows, err := db.QueryContext(ctx, `
+			SELECT ep.user_id, u.username, COALESCE(up.working_hours, '{}')
+			FROM event_participants ep
+			JOIN users u ON u.id = ep.user_id
+			LEFT JOIN user_preferences up ON up.user_id = ep.user_id
+			WHERE ep.event_id = ?
+		`, id)
+		if err != nil {
+			serverError(c, "suggestions: participants", err)
+			return
+		}
+		for rows.Next() {
+			var p constrained
+			var raw string
+			if err := rows.Scan(&p.id, &p.name, &raw); err != nil {
+				continue
+			}
+			if len(wanted) > 0 && !wanted[p.id] {
+				continue
+			}
+			_ = json.Unmarshal([]byte(raw), &p.hours)
+			required = append(required, p)
+		}
+		rows.Close()
+	}
+
+	disabled := map[string]bool{}
+	var disabledList []string
+	_ = json.Unmarshal([]byte(ev.DisabledSlots), &disabledList)
+	for _, k := range disabledList {
+		disabled[k] = true
+	}
+
+	holidaysByDate := map[string]string{}
+	if holidayRegion != "" {
+		for _, h := range eventHolidays(ctx, ev, holidayRegion) {
+			holidaysByDate[h.Date] = h.Name
+		}
+	}
+	loc := eventLocation(ev.Timezone)
+
+	type suggestion struct {
+		Slot    string   `json:"slot"`
+		Count   int      `json:"available"`
+		Total   int      `json:"total"`
+		Score   float64  `json:"score"`
+		Outside []string `json:"outsideWorkingHours,omitempty"`
+		Holiday string   `json:"holiday,omitempty"`
+		start   time.Time
+	}
+	duration := time.Duration(ev.Duration) * time.Minute
+	var out []suggestion
+	now := time.Now()
+	for _, g := range eventGridSlots(ev, now) {
+		key, t := g.key, g.start
+		if disabled[key] || t.Before(now) {
+			continue
+		}
+		s := suggestion{Slot: key, Count: counts[key], Total: total, start: t}
+		s.Holiday = holidaysByDate[t.In(loc).Format("2006-01-02")]
+		if s.Holiday != "" && holidayMode == "exclude" {
+			continue
+		}
+		for _, p := range required {
+			if !p.hours.allows(t, duration) {
+				s.Outside = append(s.Outside, p.name)
+			}
+		}
+		if mode == "exclude" && len(s.Outside) > 0 {
+			continue
+		}
+		s.Score = float64(s.Count)
+		if mode == "penalize" {
+			s.Score -= workingHoursPenalty * float64(len(s.Outside))
+		}
+		if s.Count == 0 {
+			continue
+		}
+		out = append(out, s)
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Score != out[j].Score {
+			return out[i].Score > out[j].Score
+		}
+		return out[i].start.Before(out[j].start)
+	})
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	if out == nil {
+		out = []suggestion{}
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// Public holidays come from a Nager.Date compatible API (HOLIDAY_API_URL, empty disables)
+// and are cached per country and year. Regions are ISO 3166 codes, optionally with a
+// subdivision such as "DE-BY"; national holidays apply to every subdivision.
+var (
+	holidayAPIURL   = "https://date.nager.at/api/v3/PublicHolidays"
+	holidayRegionRe = regexp.MustCompile(`^[A-Z]{2}(-[A-Z0-9]{1,3})?$`)
+	holidayCacheMu  sync.Mutex
+	holidayCache    = map[string]holidayCacheEntry{}
+	holidayCacheTTL = 24 * time.Hour
+)
+
+type publicHoliday struct {
+	Date      string   `json:"date"`
+	LocalName string   `json:"localName"`
+	Name      string   `json:"name"`
+	Global    bool     `json:"global"`
+	Counties  []string `json:"counties"`
+}
+
+type holidayCacheEntry struct {
+	holidays []publicHoliday
+	fetched  time.Time
+}
+
+// EventHoliday is a public holiday inside an event's date window.
+type EventHoliday struct {
+	Date string `json:"date"`
+	Name string `json:"name"`
+}
+
+func countryHolidays(ctx context.Context, country string, year int) ([]publicHoliday, error) {
+	key := fmt.Sprintf("%s/%d", country, year)
+	holidayCacheMu.Lock()
+	entry, ok := holidayCache[key]
+	holidayCacheMu.Unlock()
+	if ok && time.Since(entry.fetched) < holidayCacheTTL {
+		return entry.holidays, nil
+	}
+
+	resp, err := outboundDo(ctx, func(ctx context.Context) (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s/%d/%s", holidayAPIURL, year, country), nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var holidays []publicHoliday
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusNoContent:
+		// unknown country: cache the empty answer
+	case resp.StatusCode >= 300:
+		return nil, fmt.Errorf("holiday api: status %d", resp.StatusCode)
+	default:
+		if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&holidays); err != nil {
+			return nil, err
+		}
+	}
+	holidayCacheMu.Lock()
+	holidayCache[key] = holidayCacheEntry{holidays: holidays, fetched: time.Now()}
+	holidayCacheMu.Unlock()
+	return holidays, nil
+}
+
+// eventHolidays lists the region's public holidays between the event's dates. Lookup
+// failures are logged and treated as "no holidays" so events still load.
+func eventHolidays(ctx context.Context, ev Event, region string) []EventHoliday {
+	out := []EventHoliday{}
+	if holidayAPIURL == "" || region == "" {
+		return out
+	}
+	loc := eventLocation(ev.Timezone)
+	from, ok1 := eventDateBound(ev.DateFrom, loc)
+	to, ok2 := eventDateBound(ev.DateTo, loc)
+	if !ok1 || !ok2 || to.Before(from) {
+		return out
+	}
+	country, _, _ := strings.Cut(region, "-")
+	first, last := from.Format("2006-01-02"), to.Format("2006-01-02")
+	for year := from.Year(); year <= to.Year(); year++ {
+		holidays, err := countryHolidays(ctx, country, year)
+		if err != nil {
+			log.Printf("holidays %s/%d: %v", country, year, err)
+			continue
+		}
+		for _, h := range holidays {
+			if h.Date < first || h.Date > last {
+				continue
+			}
+			applies := h.Global || len(h.Counties) == 0
+			for _, county := range h.Counties {
+				if county == region {
+					applies = true
+				}
+			}
+			if !applies {
+				continue
+			}
+			name := h.LocalName
+			if name == "" {
+				name = h.Name
+			}
+			out = append(out, EventHoliday{Date: h.Date, Name: name})
+		}
+	}
+	return out
+}
+
+// previewEventHandler returns the slot grid an event with these settings would get, so
+// clients don't each re-implement grid generation. Granularity (minutes) defaults to the
+// grid step the event itself uses. Slots outside businessHours are dropped; with
+// useWorkingHours the caller's saved working hours apply as well.
+func previewEventHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	var input struct {
+		DateRange       map[string]string `json:"dateRange"`
+		Duration        float64           `json:"duration"`
+		Timezone        string            `json:"timezone"`
+		Granularity     int               `json:"granularity"`
+		BusinessHours   *WorkingHours     `json:"businessHours"`
+		UseWorkingHours bool              `json:"useWorkingHours"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+	if input.DateRange["from"] == "" || input.DateRange["to"] == "" || input.Duration <= 0 || input.Timezone == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing fields"})
+		return
+	}
+	loc, err := time.LoadLocation(input.Timezone)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown timezone"})
+		return
+	}
+	step := slotStep(input.Duration)
+	if input.Granularity != 0 {
+		if input.Granularity < 5 || input.Granularity > 24*60 || input.Granularity%5 != 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "granularity must be a multiple of 5 between 5 and 1440"})
+			return
+		}
+		step = time.Duration(input.Granularity) * time.Minute
+	}
+
+	var filters []WorkingHours
+	if input.BusinessHours != nil {
+		wh := *input.BusinessHours
+		if wh.Timezone == "" {
+			wh.Timezone = input.Timezone
+		}
+		if err := wh.validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid business hours: " + err.Error()})
+			return
+		}
+		filters = append(filters, wh)
+	}
+	if input.UseWorkingHours {
+		wh, err := loadWorkingHours(ctx, ctxUserID(c))
+		if err != nil {
+			serverError(c, "previewEvent: load working hours", err)
+			return
+		}
+		filters = append(filters, wh)
+	}
+
+	grid := slotGrid(input.DateRange["from"], input.DateRange["to"], loc, step)
+	if grid == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date range"})
+		return
+	}
+	duration := time.Duration(input.Duration) * time.Minute
+	slots := make([]string, 0, len(grid))
+	excluded := 0
+	for _, t := range grid {
+		ok := true
+		for _, wh := range filters {
+			if !wh.allows(t, duration) {
+				ok = false
+				break
+			}
+		}
+		if !ok {
+			excluded++
+			continue
+		}
+		slots = append(slots, formatSlotKey(t))
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"timezone":    input.Timezone,
+		"granularity": int(step / time.Minute),
+		"slots":       slots,
+		"excluded":    excluded,
+	})
+}
+
+// recordAvailabilityChange appends a snapshot to availability_history. Entries where the
+// actor isn't the participant are marked as entered by proxy.
+func recordAvailabilityChange(ctx context.Context, exec sqlExecer, eventID, userID, actorID, availJSON, note string, now time.Time) error {
+	_, err := exec.ExecContext(ctx, `
+		INSERT INTO availability_history(id, event_id, user_id, actor_id, proxy, note, availability, created_at)
+		VALUES (?,?,?,?,?,?,seal(?),?)
+	`, uuid.NewString(), eventID, userID, actorID, actorID != userID, note, availJSON, now)
+	if err == nil {
+		statInc("responses")
+		shipSecurityEvent("availability_changed", actorID, "", map[string]interface{}{"eventId": eventID, "userId": userID, "proxy": actorID != userID})
+		markWatchesPending(ctx, exec, eventID, userID, actorID, now)
+	}
+	return err
+}
+
+// Organizers can watch key participants of a busy event and get one email when those
+// people answer, instead of following every response. A change marks the matching
+// watches pending; watchNotifyLoop batches them per watcher and event once the oldest has
+// waited watchNotifyDelay, so a burst of edits sends a single message.
+const (
+	watchNotifyDelay = 5 * time.Minute
+	maxEventWatches  = 50
+)
+
+// markWatchesPending runs with the history write, inside its transaction when there is
+// one. Edits the watcher made themselves, e.g. by proxy, don't notify them.
+func markWatchesPending(ctx context.Context, exec sqlExecer, eventID, userID, actorID string, now time.Time) {
+	if _, err := exec.ExecContext(ctx, `
+		UPDATE event_watches SET pending_since = COALESCE(pending_since, ?) WHERE event_id = ? AND user_id = ? AND watcher_id <> ?
+	`, now, eventID, userID, actorID); err != nil {
+		logIfTimeout(err, "watches: mark pending")
+	}
+}
+
+// watchNotifyLoop sends the batched watch notifications.
+func watchNotifyLoop(ctx context.Context) error {
+	return runEvery(ctx, time.Minute, func(ctx context.Context) { sendWatchNotifications(ctx, time.Now().UTC()) })
+}
+
+func sendWatchNotifications(ctx context.Context, now time.Time) {
+	cutoff := now.Add(-watchNotifyDelay)
+	rows, err := db.QueryContext(ctx, `
+		SELECT w.event_id, w.watcher_id, u.username
+		FROM event_watches w JOIN users u ON u.id = w.user_id
+		WHERE w.pending_since IS NOT NULL AND w.pending_since <= ?
+		ORDER BY w.event_id, w.watcher_id, u.username
+	`, cutoff)
+	if err != nil {
+		log.Printf("watches: select pending: %v", err)
+		return
+	}
+	var keys [][2]string
+	names := map[[2]string][]string{}
+	for rows.Next() {
+		var key [2]string
+		var username string
+		if err := rows.Scan(&key[0], &key[1], &username); err != nil {
+			continue
+		}
+		if names[key] == nil {
+			keys = append(keys, key)
+		}
+		names[key] = append(names[key], username)
+	}
+	rows.Close()
+	for _, key := range keys {
+		eventID, watcherID := key[0], key[1]
+		if _, err := db.ExecContext(ctx, `
+			UPDATE event_watches SET pending_since = NULL WHERE event_id = ? AND watcher_id = ? AND pending_since <= ?
+		`, eventID, watcherID, cutoff); err != nil {
+			log.Printf("watches: clear pending: %v", err)
+			continue
+		}
+		var name, email, locale string
+		var verified bool
+		if err := db.QueryRowContext(ctx, `
+			SELECT e.name, unseal(u.email), u.email_verified, u.locale FROM events e, users u WHERE e.id = ? AND u.id = ?
+		`, eventID, watcherID).Scan(&name, &email, &verified, &locale); err != nil {
+			logIfTimeout(err, "watches: select watcher")
+			continue
+		}
+		if !verified {
+			continue
+		}
+		metricInc("plannie_watch_notifications_total")
+		who, link := strings.Join(names[key], ", "), appBaseURL()+"/event/"+eventID
+		subject, _ := localizedEmail(locale, "watch_update", who, name, link)
+		_, body := localizedEmail(locale, "watch_update", html.EscapeString(who), html.EscapeString(name), link)
+		if err := sendNonEssentialEmail(ctx, emailCategoryProgress, watcherID, email, subject, body); err != nil {
+			log.Printf("watches: queue email: %v", err)
+		}
+	}
+}
+
+// listEventWatchesHandler returns the participants the requesting organizer watches.
+func listEventWatchesHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	eventID := c.Param("id")
+	if !eventManagerOnly(c, ctx, eventID, "listWatches") {
+		return
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT w.user_id, u.username, w.created_at FROM event_watches w JOIN users u ON u.id = w.user_id
+		WHERE w.event_id = ? AND w.watcher_id = ? ORDER BY u.username
+	`, eventID, ctxUserID(c))
+	if err != nil {
+		serverError(c, "listWatches: query", err)
+		return
+	}
+	defer rows.Close()
+	out := []gin.H{}
+	for rows.Next() {
+		var userID, username string
+		var createdAt time.Time
+		if err := rows.Scan(&userID, &username, &createdAt); err != nil {
+			serverError(c, "listWatches: scan", err)
+			return
+		}
+		out = append(out, gin.H{"userId": userID, "username": username, "createdAt": createdAt})
+	}
+	c.JSON(http.StatusOK, gin.H{"watches": out})
+}
+
+// watchParticipantHandler starts (PUT) or stops (DELETE) watching a registered participant.
+func watchParticipantHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	eventID, targetID, userID := c.Param("id"), c.Param("userId"), ctxUserID(c)
+	if !eventManagerOnly(c, ctx, eventID, "watchParticipant") {
+		return
+	}
+	if c.Request.Method == http.MethodDelete {
+		if _, err := db.ExecContext(ctx, `DELETE FROM event_watches WHERE event_id = ? AND watcher_id = ? AND user_id = ?`, eventID, userID, targetID); err != nil {
+			serverError(c, "watchParticipant: delete", err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"watching": false})
+		return
+	}
+	if targetID == userID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You can't watch yourself"})
+		return
+	}
+	var participant, watches int
+	err := db.QueryRowContext(ctx, `
+		SELECT (SELECT COUNT(*) FROM event_participants WHERE event_id = ? AND user_id = ?),
+			(SELECT COUNT(*) FROM event_watches WHERE event_id = ? AND watcher_id = ?)
+	`, eventID, targetID, eventID, userID).Scan(&participant, &watches)
+	if err != nil {
+		serverError(c, "watchParticipant: count", err)
+		return
+	}
+	if participant == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Participant not found"})
+		return
+	}
+	if watches >= maxEventWatches {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("You can watch at most %d participants per event", maxEventWatches)})
+		return
+	}
+	if _, err := db.ExecContext(ctx, `
+		INSERT OR IGNORE INTO event_watches(event_id, watcher_id, user_id, pending_since, created_at) VALUES (?,?,?,NULL,?)
+	`, eventID, userID, targetID, time.Now().UTC()); err != nil {
+		serverError(c, "watchParticipant: insert", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"watching": true})
+}
+
+// Response milestones tell the organizer when an event is worth finalizing. Each fires at
+// most once per event, even if later joiners push the ratio back down.
+var responseMilestones = []struct {
+	name    string
+	reached func(responded, total int) bool
+}{
+	{"all", func(responded, total int) bool { return total > 0 && responded == total }},
+	{"half", func(responded, total int) bool { return total > 1 && responded*2 >= total }},
+}
+
+// checkResponseMilestones runs after availability writes. Participants other than the
+// creator count; an answer is any slot or a "none of these work" reply. A newly reached
+// milestone is broadcast over SSE and emailed to the creator. When several are reached at
+// once only the highest is announced. Quick polls and finalized events are skipped.
+func checkResponseMilestones(ctx context.Context, eventID string) {
+	var creatorID, name string
+	var finalized sql.NullString
+	var total, responded int
+	err := db.QueryRowContext(ctx, `
+		SELECT COALESCE(e.creator_id, ''), e.name, e.finalized_slot,
+			COUNT(ep.id),
+			COALESCE(SUM(CASE WHEN ep.availability <> '{}' OR ep.unavailable_at IS NOT NULL THEN 1 ELSE 0 END), 0)
+		FROM events e
+		LEFT JOIN event_participants ep ON ep.event_id = e.id AND (ep.user_id IS NULL OR ep.user_id <> e.creator_id)
+		WHERE e.id = ?
+		GROUP BY e.id
+	`, eventID).Scan(&creatorID, &name, &finalized, &total, &responded)
+	if err != nil {
+		logIfTimeout(err, "milestones: count")
+		return
+	}
+	if creatorID == "" || finalized.Valid {
+		return
+	}
+	now := time.Now().UTC()
+	announce := ""
+	for _, m := range responseMilestones {
+		if !m.reached(responded, total) {
+			continue
+		}
+		res, err := db.ExecContext(ctx, `
+			INSERT OR IGNORE INTO event_milestones(event_id, milestone, responded, total, reached_at) VALUES (?,?,?,?,?)
+		`, eventID, m.name, responded, total, now)
+		if err != nil {
+			logIfTimeout(err, "milestones: insert")
+			return
+		}
+		if n, _ := res.RowsAffected(); n > 0 && announce == "" {
+			announce = m.name
+		}
+	}
+	if announce != "" {
+		announceMilestone(ctx, eventID, creatorID, name, announce, responded, total)
+	}
+	if total > 0 && responded == total {
+		autoFinalizeEvent(ctx, eventID, "all_responded")
+	}
+}
+
+func announceMilestone(ctx context.Context, eventID, creatorID, name, milestone string, responded, total int) {
+	metricInc("plannie_response_milestones_total", "milestone", milestone)
+	payload, _ := json.Marshal(gin.H{"type": "milestone", "id": eventID, "milestone": milestone, "responded": responded, "total": total})
+	ssePublish(eventID, payload)
+
+	var email, locale string
+	var verified bool
+	if err := db.QueryRowContext(ctx, `SELECT unseal(email), email_verified, locale FROM users WHERE id = ?`, creatorID).Scan(&email, &verified, &locale); err != nil {
+		logIfTimeout(err, "milestones: select creator")
+		return
+	}
+	if !verified {
+		return
+	}
+	locale = resolveLocale(locale)
+	key, link := "milestone_"+milestone, appBaseURL()+"/event/"+eventID
+	subject, _ := localizedEmail(locale, key, name, responded, total, link)
+	_, body := localizedEmail(locale, key, html.EscapeString(name), responded, total, link)
+	if err := sendNonEssentialEmail(ctx, emailCategoryProgress, creatorID, email, subject, body); err != nil {
+		log.Printf("milestones: queue email: %v", err)
+	}
+}
+
+const maxProxyNoteLen = 500
+
+// proxyAvailabilityHandler lets the organizer enter availability for a participant who
+// answered out-of-band. The change is audited and the participant is notified.
+func proxyAvailabilityHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	eventID, targetID := c.Param("id"), c.Param("userId")
+	userID := ctxUserID(c)
+	var input struct {
+		Availability map[string]bool `json:"availability"`
+		Note         string          `json:"note"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || input.Availability == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	input.Note = strings.TrimSpace(input.Note)
+	if len(input.Note) > maxProxyNoteLen {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Note too long"})
+		return
+	}
+
+	var creatorID, eventName string
+	var finalized sql.NullString
+	err := db.QueryRowContext(ctx, `SELECT COALESCE(creator_id, ''), name, finalized_slot FROM events WHERE id = ?`, eventID).Scan(&creatorID, &eventName, &finalized)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	} else if err != nil {
+		serverError(c, "proxyAvailability: select event", err)
+		return
+	}
+	role, err := eventRole(ctx, eventID, userID)
+	if err != nil {
+		serverError(c, "proxyAvailability: role", err)
+		return
+	}
+	if !canManageEvent(role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only organizers can enter availability for others"})
+		return
+	}
+	if finalized.Valid {
+		finalizedConflict(c)
+		return
+	}
+	if targetID == userID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Use the regular update for your own availability"})
+		return
+	}
+	// Guests are addressed by their participant row ID.
+	var rowID, prevJSON string
+	var guest bool
+	err = db.QueryRowContext(ctx, `
+		SELECT id, unseal(availability), user_id IS NULL FROM event_participants
+		WHERE event_id = ? AND (user_id = ? OR (user_id IS NULL AND id = ?))
+	`, eventID, targetID, targetID).Scan(&rowID, &prevJSON, &guest)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not a participant"})
+		return
+	} else if err != nil {
+		serverError(c, "proxyAvailability: select participant", err)
+		return
+	}
+	prev := map[string]bool{}
+	_ = json.Unmarshal([]byte(prevJSON), &prev)
+	for k := range input.Availability {
+		if !validSlotKeySyntax(k) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid slot"})
+			return
+		}
+	}
+	now := time.Now().UTC()
+	avail, ignored := freezePastSlots(prev, input.Availability, now)
+	availJSON, _ := json.Marshal(avail)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		serverError(c, "proxyAvailability: begin", err)
+		return
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE event_participants SET availability = seal(?), updated_at = ?, draft_availability = '{}', draft_disabled_slots = '[]', draft_updated_at = NULL WHERE id = ?
+	`, string(availJSON), now, rowID); err != nil {
+		tx.Rollback()
+		serverError(c, "proxyAvailability: update", err)
+		return
+	}
+	if err := recordAvailabilityChange(ctx, tx, eventID, targetID, userID, string(availJSON), input.Note, now); err != nil {
+		tx.Rollback()
+		serverError(c, "proxyAvailability: record history", err)
+		return
+	}
+	if err := adjustAggregate(ctx, tx, eventID, prev, avail); err != nil {
+		tx.Rollback()
+		serverError(c, "proxyAvailability: adjust aggregate", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		serverError(c, "proxyAvailability: commit", err)
+		return
+	}
+
+	var organizer, email, locale string
+	var verified bool
+	_ = db.QueryRowContext(ctx, `SELECT username FROM users WHERE id = ?`, userID).Scan(&organizer)
+	if !guest {
+		if err := db.QueryRowContext(ctx, `SELECT unseal(email), email_verified, locale FROM users WHERE id = ?`, targetID).Scan(&email, &verified, &locale); err != nil {
+			logIfTimeout(err, "proxyAvailability: select participant email")
+		}
+	}
+	if verified && !accountDeactivated(ctx, targetID) {
+		locale = resolveLocale(locale)
+		link := appBaseURL() + "/event/" + eventID
+		noteHTML := ""
+		if input.Note != "" {
+			noteHTML = "<p><em>" + html.EscapeString(input.Note) + "</em></p>"
+		}
+		subject, _ := localizedEmail(locale, "proxy_availability", organizer, eventName, link, "")
+		_, body := localizedEmail(locale, "proxy_availability", html.EscapeString(organizer), html.EscapeString(eventName), link, noteHTML)
+		if err := sendEmail(targetID, email, subject, body); err != nil {
+			log.Printf("proxyAvailability: queue notification: %v", err)
+		}
+	}
+
+	ssePublish(eventID, []byte(`{"type":"event_updated","id":"`+eventID+`"}`))
+	checkResponseMilestones(ctx, eventID)
+	resp := gin.H{"status": "updated", "availability": avail}
+	if ignored > 0 {
+		resp["pastSlotsIgnored"] = ignored
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// Advisory edit locks. An organizer who opens the event details for editing takes the
+// lock with POST /events/:id/lock and repeats the call while the form stays open (every
+// eventLockTTL/3 is plenty); other organizers then see "being edited by ..." instead of
+// overwriting each other. Nothing is enforced: updates still go through. A lock nobody
+// renews lapses after eventLockTTL, so a closed tab frees it without a release; clients
+// drop a lock from their view at its expiresAt. Taking and releasing a lock are sent
+// over SSE as "event_locked" and "event_unlocked" and the event view carries the
+// current lock as editLock. The owner can take over with ?force=true.
+const eventLockTTL = 60 * time.Second
+
+type eventEditLock struct {
+	UserID     string    `json:"userId"`
+	Username   string    `json:"username"`
+	AcquiredAt time.Time `json:"acquiredAt"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+}
+
+// activeEditLock returns the unexpired lock on eventID, or nil.
+func activeEditLock(ctx context.Context, eventID string, now time.Time) (*eventEditLock, error) {
+	var l eventEditLock
+	err := db.QueryRowContext(ctx, `
+		SELECT l.user_id, COALESCE(u.username, ''), l.acquired_at, l.expires_at
+		FROM event_edit_locks l LEFT JOIN users u ON u.id = l.user_id
+		WHERE l.event_id = ? AND l.expires_at > ?
+	`, eventID, now).Scan(&l.UserID, &l.Username, &l.AcquiredAt, &l.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+func getEventLockHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	eventID := c.Param("id")
+	if _, ok := eventMemberOnly(c, ctx, eventID, "getEventLock"); !ok {
+		return
+	}
+	lock, err := activeEditLock(ctx, eventID, time.Now().UTC())
+	if err != nil {
+		serverError(c, "getEventLock: select", err)
+		return
+	}
+	if lock == nil {
+		c.JSON(http.StatusOK, gin.H{"locked": false})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"locked": true, "lock": lock})
+}
+
+// acquireEventLockHandler takes or renews the caller's edit lock. While another organizer
+// holds it the reply is 409 with the holder.
+func acquireEventLockHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	eventID := c.Param("id")
+	userID := ctxUserID(c)
+	role, err := eventRole(ctx, eventID, userID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	} else if err != nil {
+		serverError(c, "acquireEventLock: role", err)
+		return
+	}
+	if !canManageEvent(role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only organizers can edit this event"})
+		return
+	}
+	force := c.Query("force") == "true"
+	if force && role != roleOwner {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the owner can take over the lock"})
+		return
+	}
+
+	now := time.Now().UTC()
+	held, err := activeEditLock(ctx, eventID, now)
+	if err != nil {
+		serverError(c, "acquireEventLock: select", err)
+		return
+	}
+	renewal := held != nil && held.UserID == userID
+	acquiredAt := now
+	if renewal {
+		acquiredAt = held.AcquiredAt
+	}
+	// The conditional upsert is what decides between two organizers racing for a free
+	// lock; the read above only tells renewals apart.
+	cond := ` WHERE event_edit_locks.user_id = excluded.user_id OR event_edit_locks.expires_at <= ?`
+	args := []interface{}{eventID, userID, acquiredAt, now.Add(eventLockTTL), now}
+	if force {
+		cond, args = "", args[:4]
+	}
+	res, err := db.ExecContext(ctx, `
+		INSERT INTO event_edit_locks(event_id, user_id, acquired_at, expires_at) VALUES (?,?,?,?)
+		ON CONFLICT(event_id) DO UPDATE SET user_id = excluded.user_id, acquired_at = excluded.acquired_at, expires_at = excluded.expires_at`+cond,
+		args...)
+	if err != nil {
+		serverError(c, "acquireEventLock: upsert", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if held, err = activeEditLock(ctx, eventID, now); err != nil {
+			serverError(c, "acquireEventLock: select holder", err)
+			return
+		}
+		if held == nil {
+			// The holder released the lock in between; the caller can simply retry.
+			c.JSON(http.StatusConflict, gin.H{"error": "The lock changed hands, please try again", "code": "event_locked"})
+			return
+		}
+		c.JSON(http.StatusConflict, gin.H{"error": "Being edited by " + held.Username, "code": "event_locked", "lock": held})
+		return
+	}
+	lock, err := activeEditLock(ctx, eventID, now)
+	if err != nil || lock == nil {
+		serverError(c, "acquireEventLock: reload", err)
+		return
+	}
+	if !renewal {
+		payload, _ := json.Marshal(gin.H{"type": "event_locked", "id": eventID, "lock": lock})
+		ssePublish(eventID, payload)
+	}
+	c.JSON(http.StatusOK, gin.H{"locked": true, "lock": lock})
+}
+
+// releaseEventLockHandler drops the caller's lock; the owner may drop anyone's.
+func releaseEventLockHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	eventID := c.Param("id")
+	userID := ctxUserID(c)
+	role, err := eventRole(ctx, eventID, userID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	} else if err != nil {
+		serverError(c, "releaseEventLock: role", err)
+		return
+	}
+	query, args := `DELETE FROM event_edit_locks WHERE event_id = ? AND user_id = ?`, []interface{}{eventID, userID}
+	if role == roleOwner {
+		query, args = `DELETE FROM event_edit_locks WHERE event_id = ?`, args[:1]
+	}
+	res, err := db.ExecContext(ctx, query, args...)
+	if err != nil {
+		serverError(c, "releaseEventLock: delete", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		ssePublish(eventID, []byte(`{"type":"event_unlocked","id":"`+eventID+`"}`))
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// A participant can take back their own latest availability change for
+// availabilityUndoWindow, e.g. after clearing the whole grid by accident. The previous
+// value comes from availability_history, and the undo itself is recorded there with
+// availabilityUndoNote so it can't be undone in turn.
+const (
+	availabilityUndoWindow = 10 * time.Minute
+	availabilityUndoNote   = "undo"
+)
+
+// undoAvailabilityHandler restores the caller's availability to what it was before their
+// last change. Slots that have passed since keep their current answer.
+func undoAvailabilityHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	eventID := c.Param("id")
+	userID := ctxUserID(c)
+	var finalized sql.NullString
+	err := db.QueryRowContext(ctx, `SELECT finalized_slot FROM events WHERE id = ?`, eventID).Scan(&finalized)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	} else if err != nil {
+		serverError(c, "undoAvailability: select event", err)
+		return
+	}
+	if finalized.Valid {
+		finalizedConflict(c)
+		return
+	}
+	var curJSON string
+	err = db.QueryRowContext(ctx, `SELECT unseal(availability) FROM event_participants WHERE event_id = ? AND user_id = ?`, eventID, userID).Scan(&curJSON)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not a participant of this event"})
+		return
+	} else if err != nil {
+		serverError(c, "undoAvailability: select participant", err)
+		return
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT actor_id, note, unseal(availability), created_at FROM availability_history
+		WHERE event_id = ? AND user_id = ? ORDER BY created_at DESC LIMIT 2
+	`, eventID, userID)
+	if err != nil {
+		serverError(c, "undoAvailability: select history", err)
+		return
+	}
+	type change struct {
+		actorID, note, availJSON string
+		at                       time.Time
+	}
+	var changes []change
+	for rows.Next() {
+		var ch change
+		if err := rows.Scan(&ch.actorID, &ch.note, &ch.availJSON, &ch.at); err != nil {
+			rows.Close()
+			serverError(c, "undoAvailability: scan", err)
+			return
+		}
+		changes = append(changes, ch)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		serverError(c, "undoAvailability: rows", err)
+		return
+	}
+
+	now := time.Now().UTC()
+	switch {
+	case len(changes) == 0 || changes[0].note == availabilityUndoNote:
+		c.JSON(http.StatusConflict, gin.H{"error": "Nothing to undo", "code": "nothing_to_undo"})
+		return
+	case changes[0].actorID != userID:
+		c.JSON(http.StatusConflict, gin.H{"error": "Your last change was entered by an organizer; edit your availability instead", "code": "not_your_change"})
+		return
+	case now.Sub(changes[0].at) > availabilityUndoWindow:
+		c.JSON(http.StatusConflict, gin.H{"error": "The undo window has passed", "code": "undo_expired", "changedAt": changes[0].at})
+		return
+	}
+	previous := map[string]bool{}
+	if len(changes) > 1 {
+		_ = json.Unmarshal([]byte(changes[1].availJSON), &previous)
+	}
+	current := map[string]bool{}
+	_ = json.Unmarshal([]byte(curJSON), &current)
+	restored, ignored := freezePastSlots(current, previous, now)
+	availJSON, _ := json.Marshal(restored)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		serverError(c, "undoAvailability: begin", err)
+		return
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE event_participants SET availability = seal(?), updated_at = ? WHERE event_id = ? AND user_id = ?
+	`, string(availJSON), now, eventID, userID); err != nil {
+		tx.Rollback()
+		serverError(c, "undoAvailability: update", err)
+		return
+	}
+	if err := recordAvailabilityChange(ctx, tx, eventID, userID, userID, string(availJSON), availabilityUndoNote, now); err != nil {
+		tx.Rollback()
+		serverError(c, "undoAvailability: record history", err)
+		return
+	}
+	if err := adjustAggregate(ctx, tx, eventID, current, restored); err != nil {
+		tx.Rollback()
+		serverError(c, "undoAvailability: adjust aggregate", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		serverError(c, "undoAvailability: commit", err)
+		return
+	}
+
+	ssePublish(eventID, []byte(`{"type":"event_updated","id":"`+eventID+`"}`))
+	checkResponseMilestones(ctx, eventID)
+	resp := gin.H{"status": "restored", "availability": restored, "undoneChangeAt": changes[0].at}
+	if ignored > 0 {
+		resp["pastSlotsIgnored"] = ignored
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// patchAvailabilityHandler changes the caller's own availability by delta instead of the
+// whole participants array of PUT /events/:id: {"added": [...], "removed": [...]}. The
+// transaction writes the participant row before reading it, which takes SQLite's write
+// lock first, so a concurrent patch from the same user can't read the old answers and
+// overwrite this one; the answers of other participants are never part of the request.
+func patchAvailabilityHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	var input struct {
+		Added   []string `json:"added"`
+		Removed []string `json:"removed"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+	if len(input.Added)+len(input.Removed) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "added or removed is required"})
+		return
+	}
+	if len(input.Added)+len(input.Removed) > maxQuickAvailability {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d slots", maxQuickAvailability)})
+		return
+	}
+
+	eventID := c.Param("id")
+	userID := ctxUserID(c)
+	var duration float64
+	var recurrence string
+	var finalized sql.NullString
+	err := db.QueryRowContext(ctx, `SELECT duration, recurrence, finalized_slot FROM events WHERE id = ?`, eventID).Scan(&duration, &recurrence, &finalized)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	} else if err != nil {
+		serverError(c, "patchAvailability: select event", err)
+		return
+	}
+	if finalized.Valid {
+		finalizedConflict(c)
+		return
+	}
+	added, removed := map[string]bool{}, map[string]bool{}
+	for _, list := range []struct {
+		keys []string
+		into map[string]bool
+	}{{input.Added, added}, {input.Removed, removed}} {
+		for _, k := range list.keys {
+			valid := validSlotKeySyntax(k)
+			if recurrence == recurrenceWeekly {
+				valid = validWeeklySlot(k, duration)
+			}
+			if !valid {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid slot " + k})
+				return
+			}
+			list.into[normalizeSlotKey(k)] = true
+		}
+	}
+	for k := range added {
+		if removed[k] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Slot is both added and removed: " + k})
+			return
+		}
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		serverError(c, "patchAvailability: begin", err)
+		return
+	}
+	defer tx.Rollback()
+	now := time.Now().UTC()
+	res, err := tx.ExecContext(ctx, `UPDATE event_participants SET updated_at = ? WHERE event_id = ? AND user_id = ?`, now, eventID, userID)
+	if err != nil {
+		serverError(c, "patchAvailability: lock participant", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not a participant of this event"})
+		return
+	}
+	var prevJSON string
+	if err := tx.QueryRowContext(ctx, `SELECT unseal(availability) FROM event_participants WHERE event_id = ? AND user_id = ?`, eventID, userID).Scan(&prevJSON); err != nil {
+		serverError(c, "patchAvailability: select availability", err)
+		return
+	}
+	prev := map[string]bool{}
+	_ = json.Unmarshal([]byte(prevJSON), &prev)
+	merged := map[string]bool{}
+	for k, v := range prev {
+		if v && !removed[k] {
+			merged[k] = true
+		}
+	}
+	for k := range added {
+		merged[k] = true
+	}
+	next, ignored := freezePastSlots(prev, merged, now)
+	availJSON, _ := json.Marshal(next)
+	if prevCanon, _ := json.Marshal(prev); string(prevCanon) == string(availJSON) {
+		c.JSON(http.StatusOK, gin.H{"status": "no changes", "availability": next})
+		return
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE event_participants SET availability = seal(?), draft_availability = '{}', draft_disabled_slots = '[]', draft_updated_at = NULL WHERE event_id = ? AND user_id = ?
+	`, string(availJSON), eventID, userID); err != nil {
+		serverError(c, "patchAvailability: update", err)
+		return
+	}
+	if err := recordAvailabilityChange(ctx, tx, eventID, userID, userID, string(availJSON), "", now); err != nil {
+		serverError(c, "patchAvailability: record history", err)
+		return
+	}
+	if err := adjustAggregate(ctx, tx, eventID, prev, next); err != nil {
+		serverError(c, "patchAvailability: adjust aggregate", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		serverError(c, "patchAvailability: commit", err)
+		return
+	}
+
+	ssePublish(eventID, []byte(`{"type":"event_updated","id":"`+eventID+`"}`))
+	checkResponseMilestones(ctx, eventID)
+	resp := gin.H{"status": "updated", "availability": next, "undoUntil": now.Add(availabilityUndoWindow)}
+	if ignored > 0 {
+		resp["pastSlotsIgnored"] = ignored
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// availabilityChangesHandler lists the audit trail of availability edits for an event.
+// Organizers see every entry; participants see their own.
+func availabilityChangesHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	eventID := c.Param("id")
+	userID := ctxUserID(c)
+	var archived bool
+	err := db.QueryRowContext(ctx, `SELECT archived_at IS NOT NULL FROM events WHERE id = ?`, eventID).Scan(&archived)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	} else if err != nil {
+		serverError(c, "availabilityChanges: select event", err)
+		return
+	}
+	query := `
+		SELECT h.id, h.user_id, COALESCE(u.username, g.guest_name, ''), h.actor_id, COALESCE(a.username, ''), h.proxy, h.note, h.created_at
+		FROM availability_history h
+		LEFT JOIN users u ON u.id = h.user_id
+		LEFT JOIN event_participants g ON g.id = h.user_id AND g.user_id IS NULL
+		LEFT JOIN users a ON a.id = h.actor_id
+		WHERE h.event_id = ?`
+	args := []interface{}{eventID}
+	ownOnly := ""
+	role, err := eventRole(ctx, eventID, userID)
+	if err != nil {
+		serverError(c, "availabilityChanges: role", err)
+		return
+	}
+	if !canManageEvent(role) {
+		if role == "" {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden: Not a participant"})
+			return
+		}
+		ownOnly = ` AND user_id = ?`
+		query += ` AND h.user_id = ?`
+		args = append(args, userID)
+	}
+	rows, err := db.QueryContext(ctx, query+` ORDER BY h.created_at DESC LIMIT 200`, args...)
+	if err != nil {
+		serverError(c, "availabilityChanges: query", err)
+		return
+	}
+	defer rows.Close()
+	out := []gin.H{}
+	for rows.Next() {
+		var id, uid, uname, actorID, actorName, note string
+		var proxy bool
+		var at time.Time
+		if err := rows.Scan(&id, &uid, &uname, &actorID, &actorName, &proxy, &note, &at); err != nil {
+			serverError(c, "availabilityChanges: scan", err)
+			return
+		}
+		out = append(out, gin.H{
+			"id":        id,
+			"userId":    uid,
+			"username":  uname,
+			"actorId":   actorID,
+			"actorName": actorName,
+			"proxy":     proxy,
+			"note":      note,
+			"at":        at,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		serverError(c, "availabilityChanges: rows", err)
+		return
+	}
+	if archived {
+		older, err := archivedAvailabilityChanges(ctx, eventID, ownOnly, args)
+		if err != nil {
+			serverError(c, "availabilityChanges: archive", err)
+			return
+		}
+		out = append(out, older...)
+		sort.SliceStable(out, func(i, j int) bool { return out[i]["at"].(time.Time).After(out[j]["at"].(time.Time)) })
+		if len(out) > 200 {
+			out = out[:200]
+		}
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// archivedAvailabilityChanges reads an archived event's trail from the archive store,
+// resolving names against the main database since the two may not be joinable.
+func archivedAvailabilityChanges(ctx context.Context, eventID, ownOnly string, args []interface{}) ([]gin.H, error) {
+	rows, err := archiveStore().QueryContext(ctx, `
+		SELECT id, user_id, actor_id, proxy, note, created_at FROM availability_history_archive
+		WHERE event_id = ?`+ownOnly+` ORDER BY created_at DESC LIMIT 200`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []gin.H
+	names := map[string]string{}
+	nameOf := func(id string) string {
+		if n, ok := names[id]; ok {
+			return n
+		}
+		var n string
+		_ = db.QueryRowContext(ctx, `
+			SELECT COALESCE((SELECT username FROM users WHERE id = ?), (SELECT guest_name FROM event_participants WHERE id = ? AND user_id IS NULL), '')
+		`, id, id).Scan(&n)
+		names[id] = n
+		return n
+	}
+	for rows.Next() {
+		var id, uid, actorID, note string
+		var proxy bool
+		var at time.Time
+		if err := rows.Scan(&id, &uid, &actorID, &proxy, &note, &at); err != nil {
+			return nil, err
+		}
+		out = append(out, gin.H{
+			"id":        id,
+			"userId":    uid,
+			"username":  nameOf(uid),
+			"actorId":   actorID,
+			"actorName": nameOf(actorID),
+			"proxy":     proxy,
+			"note":      note,
+			"at":        at,
+		})
+	}
+	return out, rows.Err()
+}
+
+// historicalParticipant is one participant's state in an eventSnapshotAt reply.
+type historicalParticipant struct {
+	ID           string          `json:"id"`
+	Name         string          `json:"name"`
+	Guest        bool            `json:"guest,omitempty"`
+	Availability map[string]bool `json:"availability"`
+	// AnsweredAt is the time of the change that produced Availability; nil when the
+	// participant had joined but not answered yet.
+	AnsweredAt *time.Time `json:"answeredAt"`
+	Color      string     `json:"color"`
+	Initials   string     `json:"initials"`
+}
+
+// eventSnapshotAtHandler reconstructs who had answered what as of ?at= (RFC 3339) from
+// availability_history and its archive, for members settling what the grid showed at
+// some point. Each participant's state is their latest recorded change at or before that
+// time; people who had joined without answering are listed with an empty availability.
+// Event details (name, dates, disabled slots) are not versioned and are returned as they
+// are now. Someone who left the event still appears if they had answered by then.
+func eventSnapshotAtHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	eventID := c.Param("id")
+	at, err := time.Parse(time.RFC3339, c.Query("at"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "at must be an RFC 3339 timestamp"})
+		return
+	}
+	at = at.UTC()
+	if _, ok := eventMemberOnly(c, ctx, eventID, "eventSnapshotAt"); !ok {
+		return
+	}
+	var name, from, to, tz, disabledJSON string
+	var duration float64
+	var created time.Time
+	var archived bool
+	err = db.QueryRowContext(ctx, `
+		SELECT name, date_from, date_to, duration, timezone, disabled_slots, created_at, archived_at IS NOT NULL FROM events WHERE id = ?
+	`, eventID).Scan(&name, &from, &to, &duration, &tz, &disabledJSON, &created, &archived)
+	if err != nil {
+		serverError(c, "eventSnapshotAt: select event", err)
+		return
+	}
+	if at.Before(created) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The event did not exist at that time", "createdAt": created})
+		return
+	}
+
+	parts := map[string]*historicalParticipant{}
+	readHistory := func(store *sql.DB, table string) error {
+		rows, err := store.QueryContext(ctx, `
+			SELECT user_id, unseal(availability), created_at FROM `+table+`
+			WHERE event_id = ? AND created_at <= ? ORDER BY created_at ASC
+		`, eventID, at)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var uid, availJSON string
+			var changed time.Time
+			if err := rows.Scan(&uid, &availJSON, &changed); err != nil {
+				return err
+			}
+			p := parts[uid]
+			if p == nil {
+				p = &historicalParticipant{ID: uid}
+				parts[uid] = p
+			}
+			if p.AnsweredAt != nil && p.AnsweredAt.After(changed) {
+				continue
+			}
+			avail := map[string]bool{}
+			_ = json.Unmarshal([]byte(availJSON), &avail)
+			p.Availability, p.AnsweredAt = avail, &changed
+		}
+		return rows.Err()
+	}
+	if err := readHistory(db, "availability_history"); err != nil {
+		serverError(c, "eventSnapshotAt: history", err)
+		return
+	}
+	if archived {
+		if err := readHistory(archiveStore(), "availability_history_archive"); err != nil {
+			serverError(c, "eventSnapshotAt: archive", err)
+			return
+		}
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT COALESCE(ep.user_id, ep.id), COALESCE(u.username, ep.guest_name, ''), ep.user_id IS NULL, ep.created_at <= ?
+		FROM event_participants ep
+		LEFT JOIN users u ON u.id = ep.user_id
+		WHERE ep.event_id = ?
+	`, at, eventID)
+	if err != nil {
+		serverError(c, "eventSnapshotAt: participants", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var uid, uname string
+		var guest, joined bool
+		if err := rows.Scan(&uid, &uname, &guest, &joined); err != nil {
+			serverError(c, "eventSnapshotAt: scan", err)
+			return
+		}
+		p := parts[uid]
+		if p == nil {
+			if !joined {
+				continue
+			}
+			p = &historicalParticipant{ID: uid}
+			parts[uid] = p
+		}
+		p.Name, p.Guest = uname, guest
+	}
+	if err := rows.Err(); err != nil {
+		serverError(c, "eventSnapshotAt: rows", err)
+		return
+	}
+
+	out := make([]*historicalParticipant, 0, len(parts))
+	counts := map[string]int{}
+	for _, p := range parts {
+		if p.Name == "" {
+			// left the event since; resolve the name like the audit trail does
+			_ = db.QueryRowContext(ctx, `SELECT COALESCE((SELECT username FROM users WHERE id = ?), '')`, p.ID).Scan(&p.Name)
+		}
+		if p.Availability == nil {
+			p.Availability = map[string]bool{}
+		}
+		for slot, ok := range p.Availability {
+			if ok {
+				counts[slot]++
+			}
+		}
+		p.Color, p.Initials = participantIdentity(p.ID, p.Name)
+		out = append(out, p)
+	}
+	sort.Slice(out, func(i, j int) bool { return strings.ToLower(out[i].Name) < strings.ToLower(out[j].Name) })
+
+	var disabled []string
+	if err := json.Unmarshal([]byte(disabledJSON), &disabled); err != nil || disabled == nil {
+		disabled = []string{}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"id":            eventID,
+		"at":            at,
+		"name":          name,
+		"dateRange":     gin.H{"from": from, "to": to},
+		"duration":      duration,
+		"timezone":      tz,
+		"disabledSlots": disabled,
+		"participants":  out,
+		"counts":        counts,
+	})
+}
+
+const (
+	maxImportRows  = 500
+	maxImportBytes = 1 << 20
+)
+
+type importRowResult struct {
+	Row    int    `json:"row"`
+	Name   string `json:"name,omitempty"`
+	Email  string `json:"email,omitempty"`
+	Status string `json:"status"` // invited, guest or error
+	Error  string `json:"error,omitempty"`
+}
+
+// importParticipantsHandler takes a CSV of name,email rows (as a "file" form field or the
+// raw body). Emails of verified accounts get an invite; everyone else becomes a guest
+// participant. A header row is skipped when its second column is "email". An optional
+// "message" (form field or query parameter) goes with every invite.
+func importParticipantsHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	id := c.Param("id")
+	userID := ctxUserID(c)
+	if !eventManagerOnly(c, ctx, id, "importParticipants") {
+		return
+	}
+	if !enforceNewAccountLimit(c, ctx, userID, "invites") {
+		return
+	}
+	allowance, err := newAccountAllowance(ctx, userID, "invites")
+	if err != nil {
+		serverError(c, "importParticipants: allowance", err)
+		return
+	}
+
+	rawMessage := c.Query("message")
+	var src io.Reader = http.MaxBytesReader(c.Writer, c.Request.Body, maxImportBytes)
+	if strings.HasPrefix(c.ContentType(), "multipart/form-data") {
+		if m, ok := c.GetPostForm("message"); ok {
+			rawMessage = m
+		}
+		fh, err := c.FormFile("file")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Missing file"})
+			return
+		}
+		if fh.Size > maxImportBytes {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File too large"})
+			return
+		}
+		f, err := fh.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file"})
+			return
+		}
+		defer f.Close()
+		src = f
+	}
+	r := csv.NewReader(src)
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid CSV: " + err.Error()})
+		return
+	}
+	message, ok := sanitizeInviteMessage(rawMessage)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Message too long"})
+		return
+	}
+	if len(records) > 0 && len(records[0]) > 1 && strings.EqualFold(strings.TrimSpace(records[0][1]), "email") {
+		records = records[1:]
+	}
+	if len(records) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No rows"})
+		return
+	}
+	if len(records) > maxImportRows {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d rows", maxImportRows)})
+		return
+	}
+	// Every row may become an invite, so a young account can't import more rows than it
+	// has invites left.
+	if allowance >= 0 && len(records) > allowance {
+		metricInc("plannie_new_account_limited_total", "action", "invites")
+		c.JSON(http.StatusForbidden, gin.H{
+			"error":     fmt.Sprintf("New accounts are limited for a while. You can invite %d more people.", allowance),
+			"code":      "account_too_new",
+			"minHours":  int(newAccountWindow.Hours()),
+			"remaining": allowance,
+		})
+		return
+	}
+
+	results := make([]importRowResult, 0, len(records))
+	counts := map[string]int{}
+	added := false
+	for i, rec := range records {
+		res := importRowResult{Row: i + 1}
+		if len(rec) > 0 {
+			res.Name = strings.TrimSpace(rec[0])
+		}
+		if len(rec) > 1 {
+			res.Email = strings.ToLower(strings.TrimSpace(rec[1]))
+		}
+		res.Status, res.Error = importParticipant(ctx, id, userID, res.Name, res.Email, message)
+		if res.Status == "guest" {
+			added = true
+		}
+		counts[res.Status]++
+		results = append(results, res)
+	}
+
+	if added {
+		ssePublish(id, []byte(`{"type":"event_updated","id":"`+id+`"}`))
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"invited": counts["invited"],
+		"guests":  counts["guest"],
+		"errors":  counts["error"],
+		"rows":    results,
+	})
+}
+
+// importParticipant handles one CSV row and returns its status and error message. message
+// goes with the invite when the row matches an account.
+func importParticipant(ctx context.Context, eventID, inviterID, name, email, message string) (string, string) {
+	if email == "" || !emailRe.MatchString(email) {
+		return "error", "invalid email"
+	}
+	if len(name) > 100 {
+		return "error", "name too long"
+	}
+	var targetID string
+	var verified bool
+	err := db.QueryRowContext(ctx, `SELECT id, email_verified FROM users WHERE (email = ? OR email_index = blind_index(?)) AND deactivated_at IS NULL AND tenant_id = (SELECT tenant_id FROM events WHERE id = ?)`, email, email, eventID).Scan(&targetID, &verified)
+	if err != nil && err != sql.ErrNoRows {
+		logIfTimeout(err, "importParticipants: select user")
+		return "error", "server error"
+	}
+	if err == nil && verified {
+		if targetID == inviterID {
+			return "error", "cannot invite yourself"
+		}
+		switch err := createEventInvite(ctx, eventID, inviterID, targetID, message); {
+		case errors.Is(err, errAlreadyParticipant):
+			return "error", "already a participant"
+		case errors.Is(err, errInviteExists):
+			return "error", "invite already sent"
+		case err != nil:
+			logIfTimeout(err, "importParticipants: invite")
+			return "error", "server error"
+		}
+		return "invited", ""
+	}
+
+	if name == "" {
+		name, _, _ = strings.Cut(email, "@")
+	}
+	now := time.Now().UTC()
+	res, err := db.ExecContext(ctx, `
+		INSERT OR IGNORE INTO event_participants(id, event_id, user_id, guest_name, guest_email, availability, draft_availability, draft_disabled_slots, draft_updated_at, created_at, updated_at)
+		VALUES (?,?,NULL,?,COALESCE(blind_index(?), ?),'{}','{}','[]',NULL,?,?)
+	`, uuid.NewString(), eventID, name, email, email, now, now)
+	if err != nil {
+		logIfTimeout(err, "importParticipants: insert guest")
+		return "error", "server error"
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return "error", "already a participant"
+	}
+	return "guest", ""
+}
+
+// Kiosk tokens are long-lived, read-only credentials bound to one event, meant for lobby
+// displays showing the live heatmap.
+const (
+	kioskTokenPrefix    = "kiosk_"
+	kioskTokenHeader    = "X-Kiosk-Token"
+	maxKioskTokensEvent = 20
+)
+
+// hashOpaqueToken hashes random 256-bit bearer tokens. Like recovery codes they need no
+// salt or bcrypt, so they are stored as a plain SHA-256 and looked up directly.
+func hashOpaqueToken(tok string) string {
+	sum := sha256.Sum256([]byte(tok))
+	return hex.EncodeToString(sum[:])
+}
+
+func kioskTokenActive(ctx context.Context, tokenID string) bool {
+	var n int
+	_ = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM event_kiosk_tokens WHERE id = ? AND revoked_at IS NULL`, tokenID).Scan(&n)
+	return n > 0
+}
+
+// kioskAuthMiddleware accepts a kiosk token for the event in the path, from the
+// X-Kiosk-Token header or ?token= (EventSource can't set headers).
+func kioskAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tok := c.GetHeader(kioskTokenHeader)
+		if tok == "" {
+			tok = c.Query("token")
+		}
+		if !strings.HasPrefix(tok, kioskTokenPrefix) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Kiosk token required"})
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+		defer cancel()
+		var tokenID string
+		err := db.QueryRowContext(ctx, `
+			SELECT id FROM event_kiosk_tokens WHERE token_hash = ? AND event_id = ? AND revoked_at IS NULL
+		`, hashOpaqueToken(tok), c.Param("id")).Scan(&tokenID)
+		if err == sql.ErrNoRows {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid kiosk token"})
+			return
+		} else if err != nil {
+			logIfTimeout(err, "kioskAuth: select token")
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+			return
+		}
+		if _, err := db.ExecContext(ctx, `UPDATE event_kiosk_tokens SET last_used_at = ? WHERE id = ?`, time.Now().UTC(), tokenID); err != nil {
+			logIfTimeout(err, "kioskAuth: touch token")
+		}
+		c.Set("kioskTokenID", tokenID)
+		c.Next()
+	}
+}
+
+// kioskEventHandler returns the aggregated heatmap only: counts per slot, no names.
+func kioskEventHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	resp, err := kioskEventView(ctx, c.Param("id"))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	} else if err != nil {
+		serverError(c, "kioskEvent", err)
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// kioskEventView is the kiosk display of an event: per-slot counts, no names.
+func kioskEventView(ctx context.Context, id string) (gin.H, error) {
+	var ev Event
+	var finalizedSlot sql.NullString
+	err := db.QueryRowContext(ctx, `
+		SELECT id, name, date_from, date_to, duration, timezone, disabled_slots, finalized_slot FROM events WHERE id = ?
+	`, id).Scan(&ev.ID, &ev.Name, &ev.DateFrom, &ev.DateTo, &ev.Duration, &ev.Timezone, &ev.DisabledSlots, &finalizedSlot)
+	if err != nil {
+		return nil, err
+	}
+	counts, total, err := tallyAvailability(ctx, id, ev.DisabledSlots)
+	if err != nil {
+		return nil, err
+	}
+	disabled := []string{}
+	_ = json.Unmarshal([]byte(ev.DisabledSlots), &disabled)
+	resp := gin.H{
+		"id":            ev.ID,
+		"name":          ev.Name,
+		"dateRange":     gin.H{"from": ev.DateFrom, "to": ev.DateTo},
+		"duration":      ev.Duration,
+		"timezone":      ev.Timezone,
+		"disabledSlots": disabled,
+		"counts":        counts,
+		"total":         total,
+	}
+	if finalizedSlot.Valid {
+		resp["finalizedSlot"] = finalizedSlot.String
+	}
+	return resp, nil
+}
+
+// eventManagerOnly resolves the caller's role on the event and writes the error
+// response unless they're the owner or an organizer.
+func eventManagerOnly(c *gin.Context, ctx context.Context, eventID, where string) bool {
+	role, err := eventRole(ctx, eventID, ctxUserID(c))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return false
+	} else if err != nil {
+		serverError(c, where+": role", err)
+		return false
+	}
+	if !canManageEvent(role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only organizers can manage this event"})
+		return false
+	}
+	return true
+}
+
+// Per-event roles. The creator is the owner; creator_id stays authoritative for that. The
+// owner can make participants organizers, who may edit the event and invite people.
+// Deleting the event stays with the owner.
+const (
+	roleOwner       = "owner"
+	roleOrganizer   = "organizer"
+	roleParticipant = "participant"
+)
+
+// eventRole returns userID's role in the event, or "" when they don't take part in it.
+// sql.ErrNoRows means the event does not exist.
+func eventRole(ctx context.Context, eventID, userID string) (string, error) {
+	var creatorID, role string
+	err := db.QueryRowContext(ctx, `
+		SELECT COALESCE(e.creator_id, ''), COALESCE(ep.role, '')
+		FROM events e LEFT JOIN event_participants ep ON ep.event_id = e.id AND ep.user_id = ?
+		WHERE e.id = ?
+	`, userID, eventID).Scan(&creatorID, &role)
+	if err != nil {
+		return "", err
+	}
+	if creatorID != "" && creatorID == userID {
+		return roleOwner, nil
+	}
+	if role == roleOwner {
+		return roleParticipant, nil
+	}
+	return role, nil
+}
+
+func canManageEvent(role string) bool { return role == roleOwner || role == roleOrganizer }
+
+// setParticipantRoleHandler lets the owner promote a participant to organizer or demote
+// them again. Ownership can't be handed over this way.
+func setParticipantRoleHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	eventID, targetID := c.Param("id"), c.Param("userId")
+	var input struct {
+		Role string `json:"role"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+	if input.Role != roleOrganizer && input.Role != roleParticipant {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role must be organizer or participant"})
+		return
+	}
+	role, err := eventRole(ctx, eventID, ctxUserID(c))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	} else if err != nil {
+		serverError(c, "participantRole: role", err)
+		return
+	}
+	if role != roleOwner {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the owner can change roles"})
+		return
+	}
+	if targetID == ctxUserID(c) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The owner's role can't be changed"})
+		return
+	}
+	res, err := db.ExecContext(ctx, `
+		UPDATE event_participants SET role = ?, updated_at = ? WHERE event_id = ? AND user_id = ?
+	`, input.Role, time.Now().UTC(), eventID, targetID)
+	if err != nil {
+		serverError(c, "participantRole: update", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Participant not found"})
+		return
+	}
+	ssePublish(eventID, []byte(`{"type":"event_updated","id":"`+eventID+`"}`))
+	c.JSON(http.StatusOK, gin.H{"userId": targetID, "role": input.Role})
+}
+
+func createKioskTokenHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	eventID := c.Param("id")
+	var input struct {
+		Label string `json:"label"`
+	}
+	_ = c.ShouldBindJSON(&input)
+	input.Label = strings.TrimSpace(input.Label)
+	if len(input.Label) > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Label too long"})
+		return
+	}
+	if !eventManagerOnly(c, ctx, eventID, "createKioskToken") {
+		return
+	}
+	var active int
+	_ = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM event_kiosk_tokens WHERE event_id = ? AND revoked_at IS NULL`, eventID).Scan(&active)
+	if active >= maxKioskTokensEvent {
+		c.JSON(http.StatusConflict, gin.H{"error": "Too many active kiosk tokens"})
+		return
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		serverError(c, "createKioskToken: random", err)
+		return
+	}
+	tok := kioskTokenPrefix + base64.RawURLEncoding.EncodeToString(buf)
+	id := uuid.NewString()
+	now := time.Now().UTC()
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO event_kiosk_tokens(id, event_id, label, token_hash, created_at) VALUES (?,?,?,?,?)
+	`, id, eventID, input.Label, hashOpaqueToken(tok), now); err != nil {
+		serverError(c, "createKioskToken: insert", err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"id":        id,
+		"label":     input.Label,
+		"token":     tok,
+		"createdAt": now,
+	})
+}
+
+func listKioskTokensHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	eventID := c.Param("id")
+	if !eventManagerOnly(c, ctx, eventID, "listKioskTokens") {
+		return
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, label, created_at, last_used_at, revoked_at FROM event_kiosk_tokens
+		WHERE event_id = ? ORDER BY created_at DESC
+	`, eventID)
+	if err != nil {
+		serverError(c, "listKioskTokens: query", err)
+		return
+	}
+	defer rows.Close()
+	out := []gin.H{}
+	for rows.Next() {
+		var id, label string
+		var created time.Time
+		var lastUsed, revoked sql.NullTime
+		if err := rows.Scan(&id, &label, &created, &lastUsed, &revoked); err != nil {
+			serverError(c, "listKioskTokens: scan", err)
+			return
+		}
+		t := gin.H{"id": id, "label": label, "createdAt": created}
+		if lastUsed.Valid {
+			t["lastUsedAt"] = lastUsed.Time
+		}
+		if revoked.Valid {
+			t["revokedAt"] = revoked.Time
+		}
+		out = append(out, t)
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+func revokeKioskTokenHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	eventID := c.Param("id")
+	if !eventManagerOnly(c, ctx, eventID, "revokeKioskToken") {
+		return
+	}
+	res, err := db.ExecContext(ctx, `
+		UPDATE event_kiosk_tokens SET revoked_at = ? WHERE id = ? AND event_id = ? AND revoked_at IS NULL
+	`, time.Now().UTC(), c.Param("tokenId"), eventID)
+	if err != nil {
+		serverError(c, "revokeKioskToken: update", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Revoked"})
+}
+
+// Quick polls are created without an account. The creator manages the poll with an admin
+// token returned once at creation; respondents answer with just a name and get a guest
+// token for later edits. Quick polls expire after quickEventTTL.
+const (
+	quickEventTTL        = 30 * 24 * time.Hour
+	quickAdminHeader     = "X-Admin-Token"
+	guestTokenHeader     = "X-Guest-Token"
+	maxQuickAvailability = 5000
+)
+
+// guestToken is an HMAC binding a guest participant row to its event; nothing is stored.
+func guestToken(eventID, participantID string) string {
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte("guest:" + eventID + ":" + participantID))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func guestTokenValid(c *gin.Context, eventID, participantID string) bool {
+	tok := c.GetHeader(guestTokenHeader)
+	return tok != "" && hmac.Equal([]byte(tok), []byte(guestToken(eventID, participantID)))
+}
+
+// quickAdminMiddleware checks the admin token of a live quick poll.
+func quickAdminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tok := c.GetHeader(quickAdminHeader)
+		if tok == "" {
+			tok = c.Query("admin")
+		}
+		if tok == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Admin token required"})
+			return
+		}
+		var n int
+		_ = db.QueryRowContext(c.Request.Context(), `
+			SELECT COUNT(*) FROM events WHERE id = ? AND quick_admin_hash = ? AND expires_at > ?
+		`, c.Param("id"), hashOpaqueToken(tok), time.Now().UTC()).Scan(&n)
+		if n == 0 {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Invalid admin token"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// quickEventLive reports whether id is an unexpired quick poll, writing 404/410 otherwise.
+func quickEventLive(c *gin.Context, ctx context.Context, id string) bool {
+	var expiresAt sql.NullTime
+	err := db.QueryRowContext(ctx, `SELECT expires_at FROM events WHERE id = ?`, id).Scan(&expiresAt)
+	if err == sql.ErrNoRows || (err == nil && !expiresAt.Valid) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return false
+	} else if err != nil {
+		serverError(c, "quickEvent: select", err)
+		return false
+	}
+	if expiresAt.Time.Before(time.Now()) {
+		c.JSON(http.StatusGone, gin.H{"error": "Event expired"})
+		return false
+	}
+	return true
+}
+
+// cleanAvailability keeps true values with valid slot keys.
+func cleanAvailability(in map[string]bool) (map[string]bool, bool) {
+	if len(in) > maxQuickAvailability {
+		return nil, false
+	}
+	out := map[string]bool{}
+	for k, v := range in {
+		if !validSlotKeySyntax(k) {
+			return nil, false
+		}
+		if v {
+			out[k] = true
+		}
+	}
+	return out, true
+}
+
+func createQuickEventHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	var input struct {
+		Name          string            `json:"name"`
+		DateRange     map[string]string `json:"dateRange"`
+		Duration      float64           `json:"duration"`
+		Timezone      string            `json:"timezone"`
+		DisabledSlots []string          `json:"disabledSlots"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+	input.Name = strings.TrimSpace(input.Name)
+	if input.Name == "" || input.DateRange["from"] == "" || input.DateRange["to"] == "" || input.Duration <= 0 || input.Timezone == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing fields"})
+		return
+	}
+	tz, ok := validTimezone(input.Timezone)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid timezone"})
+		return
+	}
+	input.Timezone = tz
+	if len(input.Name) > 200 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Name too long"})
+		return
+	}
+	if eventSlotGrid(Event{DateFrom: input.DateRange["from"], DateTo: input.DateRange["to"], Duration: input.Duration, Timezone: input.Timezone}) == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date range"})
+		return
+	}
+	disabledJSON, _ := json.Marshal(normalizeSlotList(input.DisabledSlots))
+	if !enforceTenantQuota(c, ctx, "events") {
+		return
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		serverError(c, "createQuickEvent: random", err)
+		return
+	}
+	adminToken := base64.RawURLEncoding.EncodeToString(buf)
+	id := uuid.NewString()
+	now := time.Now().UTC()
+	expiresAt := now.Add(quickEventTTL)
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO events(id, creator_id, name, date_from, date_to, duration, timezone, disabled_slots, quick_admin_hash, expires_at, tenant_id, created_at, updated_at)
+		VALUES (?,NULL,?,?,?,?,?,?,?,?,?,?,?)
+	`, id, input.Name, input.DateRange["from"], input.DateRange["to"], input.Duration, input.Timezone, string(disabledJSON), hashOpaqueToken(adminToken), expiresAt, requestTenant(c), now, now); err != nil {
+		serverError(c, "createQuickEvent: insert", err)
+		return
+	}
+	metricInc("plannie_quick_events_created_total")
+	statInc("events_created")
+	c.JSON(http.StatusCreated, gin.H{
+		"id":         id,
+		"adminToken": adminToken,
+		"expiresAt":  expiresAt,
+	})
+}
+
+func updateQuickEventHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	id := c.Param("id")
+	var input struct {
+		Name          *string  `json:"name"`
+		DisabledSlots []string `json:"disabledSlots"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+	now := time.Now().UTC()
+	if input.Name != nil {
+		name := strings.TrimSpace(*input.Name)
+		if name == "" || len(name) > 200 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid name"})
+			return
+		}
+		if _, err := db.ExecContext(ctx, `UPDATE events SET name = ?, updated_at = ? WHERE id = ?`, name, now, id); err != nil {
+			serverError(c, "updateQuickEvent: name", err)
+			return
+		}
+	}
+	if input.DisabledSlots != nil {
+		disabledJSON, _ := json.Marshal(input.DisabledSlots)
+		if _, err := db.ExecContext(ctx, `UPDATE events SET disabled_slots = ?, updated_at = ? WHERE id = ?`, string(disabledJSON), now, id); err != nil {
+			serverError(c, "updateQuickEvent: disabled slots", err)
+			return
+		}
+	}
+	ssePublish(id, []byte(`{"type":"event_updated","id":"`+id+`"}`))
+	c.JSON(http.StatusOK, gin.H{"status": "updated"})
+}
+
+func deleteQuickEventHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	id := c.Param("id")
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		serverError(c, "deleteQuickEvent: begin", err)
+		return
+	}
+	defer tx.Rollback()
+	if err := deleteEventRows(ctx, tx, id); err != nil {
+		serverError(c, "deleteQuickEvent: delete", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		serverError(c, "deleteQuickEvent: commit", err)
+		return
+	}
+	deleteArchivedEventHistory(ctx, id)
+	ssePublish(id, []byte(`{"type":"event_deleted","id":"`+id+`"}`))
+	c.JSON(http.StatusOK, gin.H{"message": "Deleted"})
+}
+
+// quickRespondHandler adds a named guest response. Names are unique per poll; editing an
+// existing response needs the guest token handed out here. An optional email lets the
+// response be claimed once an account with that address is verified.
+func quickRespondHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	id := c.Param("id")
+	var input struct {
+		Name         string          `json:"name"`
+		Email        string          `json:"email"`
+		Availability map[string]bool `json:"availability"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+	input.Name = strings.TrimSpace(input.Name)
+	if input.Name == "" || len(input.Name) > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid name"})
+		return
+	}
+	input.Email = strings.ToLower(strings.TrimSpace(input.Email))
+	if input.Email != "" && !validateEmail(input.Email) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email"})
+		return
+	}
+	avail, ok := cleanAvailability(input.Availability)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid availability"})
+		return
+	}
+	if !quickEventLive(c, ctx, id) {
+		return
+	}
+	var taken int
+	_ = db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM event_participants WHERE event_id = ? AND user_id IS NULL AND lower(guest_name) = lower(?)
+	`, id, input.Name).Scan(&taken)
+	if taken > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Name already taken", "code": "name_taken"})
+		return
+	}
+	if input.Email != "" {
+		_ = db.QueryRowContext(ctx, `
+			SELECT COUNT(*) FROM event_participants WHERE event_id = ? AND guest_email = COALESCE(blind_index(?), ?)
+		`, id, input.Email, input.Email).Scan(&taken)
+		if taken > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "Email already used for this event", "code": "email_taken"})
+			return
+		}
+	}
+	now := time.Now().UTC()
+	avail, _ = freezePastSlots(nil, avail, now)
+	availJSON, _ := json.Marshal(avail)
+	pid := uuid.NewString()
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO event_participants(id, event_id, user_id, guest_name, guest_email, availability, draft_availability, draft_disabled_slots, draft_updated_at, join_channel, created_at, updated_at)
+		VALUES (?,?,NULL,?,COALESCE(blind_index(?), ?),seal(?),'{}','[]',NULL,?,?,?)
+	`, pid, id, input.Name, input.Email, input.Email, string(availJSON), joinChannelLink, now, now); err != nil {
+		serverError(c, "quickRespond: insert", err)
+		return
+	}
+	if err := recordAvailabilityChange(ctx, db, id, pid, pid, string(availJSON), "", now); err != nil {
+		logIfTimeout(err, "quickRespond: record history")
+	}
+	if err := adjustAggregate(ctx, db, id, nil, avail); err != nil {
+		logIfTimeout(err, "quickRespond: adjust aggregate")
+	}
+	ssePublish(id, []byte(`{"type":"event_updated","id":"`+id+`"}`))
+	c.JSON(http.StatusCreated, gin.H{"participantId": pid, "guestToken": guestToken(id, pid)})
+}
+
+func quickUpdateResponseHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	id, pid := c.Param("id"), c.Param("participantId")
+	if !guestTokenValid(c, id, pid) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid guest token"})
+		return
+	}
+	var input struct {
+		Availability map[string]bool `json:"availability"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || input.Availability == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+	avail, ok := cleanAvailability(input.Availability)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid availability"})
+		return
+	}
+	if !quickEventLive(c, ctx, id) {
+		return
+	}
+	var prevJSON string
+	err := db.QueryRowContext(ctx, `SELECT unseal(availability) FROM event_participants WHERE id = ? AND event_id = ? AND user_id IS NULL`, pid, id).Scan(&prevJSON)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	} else if err != nil {
+		serverError(c, "quickUpdateResponse: select", err)
+		return
+	}
+	prev := map[string]bool{}
+	_ = json.Unmarshal([]byte(prevJSON), &prev)
+	now := time.Now().UTC()
+	avail, ignored := freezePastSlots(prev, avail, now)
+	availJSON, _ := json.Marshal(avail)
+	if _, err := db.ExecContext(ctx, `UPDATE event_participants SET availability = seal(?), updated_at = ? WHERE id = ?`, string(availJSON), now, pid); err != nil {
+		serverError(c, "quickUpdateResponse: update", err)
+		return
+	}
+	if err := recordAvailabilityChange(ctx, db, id, pid, pid, string(availJSON), "", now); err != nil {
+		logIfTimeout(err, "quickUpdateResponse: record history")
+	}
+	if err := adjustAggregate(ctx, db, id, prev, avail); err != nil {
+		logIfTimeout(err, "quickUpdateResponse: adjust aggregate")
+	}
+	ssePublish(id, []byte(`{"type":"event_updated","id":"`+id+`"}`))
+	resp := gin.H{"status": "updated"}
+	if ignored > 0 {
+		resp["pastSlotsIgnored"] = ignored
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// quickDeleteResponseHandler removes a response; allowed for its guest or the poll admin.
+func quickDeleteResponseHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	id, pid := c.Param("id"), c.Param("participantId")
+	allowed := guestTokenValid(c, id, pid)
+	if !allowed {
+		if tok := c.GetHeader(quickAdminHeader); tok != "" {
+			var n int
+			_ = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM events WHERE id = ? AND quick_admin_hash = ?`, id, hashOpaqueToken(tok)).Scan(&n)
+			allowed = n > 0
+		}
+	}
+	if !allowed {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden"})
+		return
+	}
+	res, err := db.ExecContext(ctx, `DELETE FROM event_participants WHERE id = ? AND event_id = ? AND user_id IS NULL`, pid, id)
+	if err != nil {
+		serverError(c, "quickDeleteResponse: delete", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	}
+	if err := dropAggregate(ctx, db, id); err != nil {
+		logIfTimeout(err, "quickDeleteResponse: drop aggregate")
+	}
+	ssePublish(id, []byte(`{"type":"event_updated","id":"`+id+`"}`))
+	c.JSON(http.StatusOK, gin.H{"message": "Deleted"})
+}
+
+// claimGuestResponses moves guest participations recorded under the user's (now verified)
+// email onto the account. If the user already takes part in an event, the guest
+// availability is merged into their row instead of leaving a duplicate. Organizers are
+// told about each claimed response.
+func claimGuestResponses(ctx context.Context, userID string) error {
+	var username, email string
+	if err := db.QueryRowContext(ctx, `SELECT username, unseal(email) FROM users WHERE id = ?`, userID).Scan(&username, &email); err != nil {
+		return err
+	}
+	type claim struct {
+		rowID, eventID, guestName, availJSON, creatorID, eventName string
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT ep.id, ep.event_id, ep.guest_name, unseal(ep.availability), COALESCE(e.creator_id, ''), e.name
+		FROM event_participants ep JOIN events e ON e.id = ep.event_id
+		WHERE ep.user_id IS NULL AND (ep.guest_email = ? OR ep.guest_email = blind_index(?)) AND e.tenant_id = (SELECT tenant_id FROM users WHERE id = ?)
+	`, strings.ToLower(email), email, userID)
+	if err != nil {
+		return err
+	}
+	var claims []claim
+	for rows.Next() {
+		var cl claim
+		if err := rows.Scan(&cl.rowID, &cl.eventID, &cl.guestName, &cl.availJSON, &cl.creatorID, &cl.eventName); err != nil {
+			rows.Close()
+			return err
+		}
+		claims = append(claims, cl)
+	}
+	rows.Close()
+	if len(claims) == 0 {
+		return nil
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := time.Now().UTC()
+	for _, cl := range claims {
+		var existingID, existingJSON string
+		err := tx.QueryRowContext(ctx, `SELECT id, unseal(availability) FROM event_participants WHERE event_id = ? AND user_id = ?`, cl.eventID, userID).
+			Scan(&existingID, &existingJSON)
+		switch {
+		case err == sql.ErrNoRows:
+			if _, err := tx.ExecContext(ctx, `
+				UPDATE event_participants SET user_id = ?, guest_name = '', guest_email = '', updated_at = ? WHERE id = ?
+			`, userID, now, cl.rowID); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		default:
+			merged := map[string]bool{}
+			_ = json.Unmarshal([]byte(existingJSON), &merged)
+			guestAvail := map[string]bool{}
+			_ = json.Unmarshal([]byte(cl.availJSON), &guestAvail)
+			for k, v := range guestAvail {
+				if v {
+					merged[k] = true
+				}
+			}
+			mergedJSON, _ := json.Marshal(merged)
+			if _, err := tx.ExecContext(ctx, `UPDATE event_participants SET availability = seal(?), updated_at = ? WHERE id = ?`, string(mergedJSON), now, existingID); err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, `DELETE FROM event_participants WHERE id = ?`, cl.rowID); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE availability_history SET user_id = ? WHERE event_id = ? AND user_id = ?`, userID, cl.eventID, cl.rowID); err != nil {
+			return err
+		}
+		if err := dropAggregate(ctx, tx, cl.eventID); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, cl := range claims {
+		relinkArchivedHistory(ctx, `UPDATE availability_history_archive SET user_id = ? WHERE event_id = ? AND user_id = ?`, userID, cl.eventID, cl.rowID)
+		ssePublish(cl.eventID, []byte(`{"type":"event_updated","id":"`+cl.eventID+`"}`))
+		if cl.creatorID == "" || cl.creatorID == userID {
+			continue
+		}
+		var orgEmail, orgLocale string
+		var verified bool
+		if err := db.QueryRowContext(ctx, `SELECT unseal(email), email_verified, locale FROM users WHERE id = ?`, cl.creatorID).Scan(&orgEmail, &verified, &orgLocale); err != nil || !verified || accountDeactivated(ctx, cl.creatorID) {
+			continue
+		}
+		locale := resolveLocale(orgLocale)
+		link := appBaseURL() + "/event/" + cl.eventID
+		subject, _ := localizedEmail(locale, "guest_claimed", cl.guestName, username, cl.eventName, link)
+		_, body := localizedEmail(locale, "guest_claimed", html.EscapeString(cl.guestName), html.EscapeString(username), html.EscapeString(cl.eventName), link)
+		if err := sendEmail(cl.creatorID, orgEmail, subject, body); err != nil {
+			log.Printf("claimGuestResponses: queue notification: %v", err)
+		}
+	}
+	metricAdd("plannie_guest_claims_total", float64(len(claims)))
+	return nil
+}
+
+var (
+	errMergeSameAccount = errors.New("cannot merge an account into itself")
+	errMergeInactive    = errors.New("account not found or already merged")
+	errMergeTenants     = errors.New("accounts belong to different tenants")
+)
+
+// mergeTokenPrefix binds a merge confirmation to the account that asked for it.
+const mergeTokenPrefix = "merge:"
+
+// mergeAccounts moves events, series, participations, invites, friends and history from
+// sourceID onto targetID, then tombstones the source: it keeps its id and username, gets
+// a placeholder email, loses its sessions and can no longer sign in. It returns the
+// events whose participant lists changed.
+func mergeAccounts(ctx context.Context, sourceID, targetID, ip string) ([]string, error) {
+	if sourceID == targetID {
+		return nil, errMergeSameAccount
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var sourceEmail, sourceTenant, targetTenant string
+	if err := tx.QueryRowContext(ctx, `SELECT unseal(email), tenant_id FROM users WHERE id = ? AND merged_into IS NULL`, sourceID).Scan(&sourceEmail, &sourceTenant); err == sql.ErrNoRows {
+		return nil, errMergeInactive
+	} else if err != nil {
+		return nil, err
+	}
+	if err := tx.QueryRowContext(ctx, `SELECT tenant_id FROM users WHERE id = ? AND merged_into IS NULL`, targetID).Scan(&targetTenant); err == sql.ErrNoRows {
+		return nil, errMergeInactive
+	} else if err != nil {
+		return nil, err
+	}
+	if sourceTenant != targetTenant {
+		return nil, errMergeTenants
+	}
+	now := time.Now().UTC()
+	touched := map[string]bool{}
+
+	rows, err := tx.QueryContext(ctx, `SELECT id FROM events WHERE creator_id = ?`, sourceID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		touched[id] = true
+	}
+	rows.Close()
+	for _, q := range []string{
+		`UPDATE events SET creator_id = ? WHERE creator_id = ?`,
+		`UPDATE event_series SET creator_id = ? WHERE creator_id = ?`,
+		`UPDATE event_invites SET inviter_id = ? WHERE inviter_id = ?`,
+		`UPDATE availability_history SET user_id = ? WHERE user_id = ?`,
+		`UPDATE availability_history SET actor_id = ? WHERE actor_id = ?`,
+	} {
+		if _, err := tx.ExecContext(ctx, q, targetID, sourceID); err != nil {
+			return nil, err
+		}
+	}
+
+	// Participations: where both accounts answered, keep the target's row and add the
+	// source's available slots to it.
+	type participation struct{ id, eventID, availJSON string }
+	var parts []participation
+	rows, err = tx.QueryContext(ctx, `SELECT id, event_id, unseal(availability) FROM event_participants WHERE user_id = ?`, sourceID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var p participation
+		if err := rows.Scan(&p.id, &p.eventID, &p.availJSON); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		parts = append(parts, p)
+	}
+	rows.Close()
+	for _, p := range parts {
+		touched[p.eventID] = true
+		var existingID, existingJSON string
+		err := tx.QueryRowContext(ctx, `SELECT id, unseal(availability) FROM event_participants WHERE event_id = ? AND user_id = ?`, p.eventID, targetID).
+			Scan(&existingID, &existingJSON)
+		switch {
+		case err == sql.ErrNoRows:
+			if _, err := tx.ExecContext(ctx, `UPDATE event_participants SET user_id = ?, updated_at = ? WHERE id = ?`, targetID, now, p.id); err != nil {
+				return nil, err
+			}
+		case err != nil:
+			return nil, err
+		default:
+			merged := map[string]bool{}
+			_ = json.Unmarshal([]byte(existingJSON), &merged)
+			sourceAvail := map[string]bool{}
+			_ = json.Unmarshal([]byte(p.availJSON), &sourceAvail)
+			for k, v := range sourceAvail {
+				if v {
+					merged[k] = true
+				}
+			}
+			mergedJSON, _ := json.Marshal(merged)
+			if _, err := tx.ExecContext(ctx, `UPDATE event_participants SET availability = seal(?), updated_at = ? WHERE id = ?`, string(mergedJSON), now, existingID); err != nil {
+				return nil, err
+			}
+			if _, err := tx.ExecContext(ctx, `DELETE FROM event_participants WHERE id = ?`, p.id); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Invites the target already has, or no longer needs, are dropped.
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM event_invites WHERE invitee_id = ? AND (
+			event_id IN (SELECT event_id FROM event_invites WHERE invitee_id = ?)
+			OR event_id IN (SELECT event_id FROM event_participants WHERE user_id = ?)
+		)
+	`, sourceID, targetID, targetID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE event_invites SET invitee_id = ? WHERE invitee_id = ?`, targetID, sourceID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT OR IGNORE INTO event_seen(event_id, user_id, first_seen_at)
+		SELECT event_id, ?, first_seen_at FROM event_seen WHERE user_id = ?
+	`, targetID, sourceID); err != nil {
+		return nil, err
+	}
+
+	// Friendships: a request between the two accounts disappears; otherwise the target
+	// keeps its own request with the same person, upgraded if the source's was accepted.
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM friend_requests WHERE (sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?)
+	`, sourceID, targetID, targetID, sourceID); err != nil {
+		return nil, err
+	}
+	type friendship struct{ id, senderID, receiverID, status string }
+	var friends []friendship
+	rows, err = tx.QueryContext(ctx, `SELECT id, sender_id, receiver_id, status FROM friend_requests WHERE sender_id = ? OR receiver_id = ?`, sourceID, sourceID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var f friendship
+		if err := rows.Scan(&f.id, &f.senderID, &f.receiverID, &f.status); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		friends = append(friends, f)
+	}
+	rows.Close()
+	for _, f := range friends {
+		other := f.receiverID
+		if other == sourceID {
+			other = f.senderID
+		}
+		var existingID, existingStatus string
+		err := tx.QueryRowContext(ctx, `
+			SELECT id, status FROM friend_requests WHERE (sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?)
+		`, targetID, other, other, targetID).Scan(&existingID, &existingStatus)
+		switch {
+		case err == sql.ErrNoRows:
+			if f.senderID == sourceID {
+				f.senderID = targetID
+			} else {
+				f.receiverID = targetID
+			}
+			if _, err := tx.ExecContext(ctx, `UPDATE friend_requests SET sender_id = ?, receiver_id = ?, updated_at = ? WHERE id = ?`, f.senderID, f.receiverID, now, f.id); err != nil {
+				return nil, err
+			}
+			continue
+		case err != nil:
+			return nil, err
+		}
+		if f.status == "accepted" && existingStatus != "accepted" {
+			if _, err := tx.ExecContext(ctx, `UPDATE friend_requests SET status = 'accepted', updated_at = ? WHERE id = ?`, now, existingID); err != nil {
+				return nil, err
+			}
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM friend_requests WHERE id = ?`, f.id); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE user_preferences SET user_id = ? WHERE user_id = ? AND NOT EXISTS (SELECT 1 FROM user_preferences WHERE user_id = ?)
+	`, targetID, sourceID, targetID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE notification_preferences SET user_id = ? WHERE user_id = ? AND NOT EXISTS (SELECT 1 FROM notification_preferences WHERE user_id = ?)
+	`, targetID, sourceID, targetID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE push_devices SET user_id = ? WHERE user_id = ?`, targetID, sourceID); err != nil {
+		return nil, err
+	}
+	// keep the reminder ledger so the merged account isn't reminded twice; rows the
+	// target already has stay behind and are deleted below
+	if _, err := tx.ExecContext(ctx, `UPDATE OR IGNORE email_notifications_sent SET user_id = ? WHERE user_id = ?`, targetID, sourceID); err != nil {
+		return nil, err
+	}
+	// Attendance, shift claims, bookings, waitlist places and confirmations move with the
+	// participation. Where the target already has its own, the target's row wins and the
+	// source's stays behind to be deleted below; a waitlist place for a slot the target
+	// has booked is dropped.
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM event_booking_waitlist WHERE user_id = ?
+			AND EXISTS (SELECT 1 FROM event_bookings b WHERE b.event_id = event_booking_waitlist.event_id AND b.slot = event_booking_waitlist.slot AND b.user_id = ?)
+	`, sourceID, targetID); err != nil {
+		return nil, err
+	}
+	for _, q := range []string{
+		`UPDATE OR IGNORE event_attendance SET user_id = ? WHERE user_id = ?`,
+		`UPDATE event_attendance SET recorded_by = ? WHERE recorded_by = ?`,
+		`UPDATE OR IGNORE event_shift_claims SET user_id = ? WHERE user_id = ?`,
+		`UPDATE OR IGNORE event_bookings SET user_id = ? WHERE user_id = ?`,
+		`UPDATE OR IGNORE event_booking_waitlist SET user_id = ? WHERE user_id = ?`,
+		`UPDATE OR IGNORE event_confirmations SET user_id = ? WHERE user_id = ?`,
+	} {
+		if _, err := tx.ExecContext(ctx, q, targetID, sourceID); err != nil {
+			return nil, err
+		}
+	}
+	tombstoneEmail := "merged+" + sourceID + "@invalid"
+	for _, q := range []string{
+		`DELETE FROM user_preferences WHERE user_id = ?`,
+		`DELETE FROM notification_preferences WHERE user_id = ?`,
+		`DELETE FROM event_seen WHERE user_id = ?`,
+		`DELETE FROM event_watches WHERE ? IN (watcher_id, user_id)`,
+		`DELETE FROM data_exports WHERE user_id = ?`,
+		`DELETE FROM calendar_syncs WHERE user_id = ?`,
+		`DELETE FROM email_notifications_sent WHERE user_id = ?`,
+		`DELETE FROM event_edit_locks WHERE user_id = ?`,
+		`DELETE FROM email_tokens WHERE user_id = ?`,
+		`DELETE FROM recovery_codes WHERE user_id = ?`,
+		`DELETE FROM policy_acceptances WHERE user_id = ?`,
+		`UPDATE refresh_tokens SET revoked = 1 WHERE user_id = ?`,
+		`DELETE FROM caldav_tokens WHERE user_id = ?`,
+		`DELETE FROM event_attendance WHERE user_id = ?`,
+		`DELETE FROM event_shift_claims WHERE user_id = ?`,
+		`DELETE FROM event_booking_waitlist WHERE user_id = ?`,
+		`DELETE FROM event_confirmations WHERE user_id = ?`,
+	} {
+		if _, err := tx.ExecContext(ctx, q, sourceID); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE users SET merged_into = ?, email = ?, email_index = NULL, email_verified = 1, is_admin = 0, updated_at = ? WHERE id = ?
+	`, targetID, tombstoneEmail, now, sourceID); err != nil {
+		return nil, err
+	}
+	if err := recordEmailChange(ctx, tx, sourceID, sourceEmail, tombstoneEmail, ip); err != nil {
+		return nil, err
+	}
+	for id := range touched {
+		if err := dropAggregate(ctx, tx, id); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	relinkArchivedHistory(ctx, `UPDATE availability_history_archive SET user_id = ? WHERE user_id = ?`, targetID, sourceID)
+	relinkArchivedHistory(ctx, `UPDATE availability_history_archive SET actor_id = ? WHERE actor_id = ?`, targetID, sourceID)
+
+	eventIDs := make([]string, 0, len(touched))
+	for id := range touched {
+		eventIDs = append(eventIDs, id)
+		ssePublish(id, []byte(`{"type":"event_updated","id":"`+id+`"}`))
+	}
+	sort.Strings(eventIDs)
+	metricInc("plannie_account_merges_total")
+	return eventIDs, nil
+}
+
+// adminMergeUserHandler merges the account in the path into body.targetId.
+func adminMergeUserHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	var in struct {
+		TargetID string `json:"targetId"`
+	}
+	if err := c.BindJSON(&in); err != nil || in.TargetID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "targetId is required"})
+		return
+	}
+	sourceID := c.Param("id")
+	if !adminUserInScope(c, ctx, sourceID) || !adminUserInScope(c, ctx, in.TargetID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found or already merged"})
+		return
+	}
+	eventIDs, err := mergeAccounts(ctx, sourceID, in.TargetID, clientIP(c))
+	switch {
+	case errors.Is(err, errMergeSameAccount), errors.Is(err, errMergeTenants):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, errMergeInactive):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found or already merged"})
+		return
+	case err != nil:
+		serverError(c, "adminMergeUser: merge", err)
+		return
+	}
+	log.Printf("admin %s merged account %s into %s", ctxUserID(c), sourceID, in.TargetID)
+	c.JSON(http.StatusOK, gin.H{"sourceId": sourceID, "targetId": in.TargetID, "events": eventIDs})
+}
+
+// requestAccountMergeHandler mails a confirmation link to the other account's address.
+// Confirming it merges that account into the caller's, which proves the caller controls both.
+func requestAccountMergeHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	targetID := ctxUserID(c)
+	var in struct {
+		Email string `json:"email"`
+	}
+	if err := c.BindJSON(&in); err != nil || strings.TrimSpace(in.Email) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Email is required"})
+		return
+	}
+	var targetUsername string
+	if err := db.QueryRowContext(ctx, `SELECT username FROM users WHERE id = ?`, targetID).Scan(&targetUsername); err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		serverError(c, "requestMerge: select target", err)
+		return
+	}
+
+	const sent = "If a verified account uses that email, we sent it a confirmation link"
+	var sourceID, sourceUsername, sourceEmail string
+	err := db.QueryRowContext(ctx, `
+		SELECT id, username, unseal(email) FROM users
+		WHERE (email = ? COLLATE NOCASE OR email_index = blind_index(?)) AND email_verified = 1 AND merged_into IS NULL AND tenant_id = ?
+	`, strings.TrimSpace(in.Email), in.Email, requestTenant(c)).Scan(&sourceID, &sourceUsername, &sourceEmail)
+	if err == sql.ErrNoRows || sourceID == targetID {
+		c.JSON(http.StatusOK, gin.H{"message": sent})
+		return
+	} else if err != nil {
+		serverError(c, "requestMerge: select source", err)
+		return
+	}
+	raw, tokenID, err := createEmailToken(sourceID, mergeTokenPrefix+targetID, verifyTTL)
+	if err != nil {
+		serverError(c, "requestMerge: token", err)
+		return
+	}
+	confirmURL := fmt.Sprintf("%s/users/merge/confirm?tid=%s&t=%s", apiBaseURL(), tokenID, raw)
+	locale := userLocale(ctx, sourceID)
+	subject, _ := localizedEmail(locale, "merge_confirm", sourceUsername, targetUsername, confirmURL)
+	_, body := localizedEmail(locale, "merge_confirm", html.EscapeString(sourceUsername), html.EscapeString(targetUsername), confirmURL)
+	go func() {
+		if err := sendEmail(sourceID, sourceEmail, subject, body); err != nil {
+			log.Printf("sendEmail merge: %v", err)
+		}
+	}()
+	c.JSON(http.StatusOK, gin.H{"message": sent})
+}
+
+// confirmAccountMergePageHandler is the link from the merge_confirm email. It only shows
+// a confirmation form: mail scanners prefetch links, and a GET must not merge accounts.
+func confirmAccountMergePageHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	tid, raw := c.Query("tid"), c.Query("t")
+	var kind, thash, sourceName, targetName string
+	var expires time.Time
+	var used int
+	err := db.QueryRowContext(ctx, `
+		SELECT t.kind, t.token_hash, t.expires_at, t.used, s.username, COALESCE(u.username, '')
+		FROM email_tokens t JOIN users s ON s.id = t.user_id
+		LEFT JOIN users u ON u.id = substr(t.kind, ?)
+		WHERE t.id = ? AND t.kind LIKE ?
+	`, len(mergeTokenPrefix)+1, tid, mergeTokenPrefix+"%").Scan(&kind, &thash, &expires, &used, &sourceName, &targetName)
+	if err != nil && err != sql.ErrNoRows {
+		logIfTimeout(err, "confirmMergePage: select token")
+	}
+	if err != nil || raw == "" || used == 1 || time.Now().After(expires) || verifyTokenHash(thash, raw) != nil {
+		c.Data(http.StatusBadRequest, "text/html; charset=utf-8", []byte("<p>This link is invalid or has expired.</p>"))
+		return
+	}
+	page := fmt.Sprintf(`<!doctype html><html><body style="font-family:sans-serif">
+<p>Merge the account <strong>%s</strong> into <strong>%s</strong>? This can't be undone.</p>
+<form method="post">
+<input type="hidden" name="tid" value="%s"><input type="hidden" name="t" value="%s">
+<button type="submit">Merge accounts</button></form>
+</body></html>`, html.EscapeString(sourceName), html.EscapeString(targetName), html.EscapeString(tid), html.EscapeString(raw))
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(page))
+}
+
+// confirmAccountMergeHandler merges the accounts once the confirmation form is submitted.
+// The token's kind names the account that receives the merge.
+func confirmAccountMergeHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	fail := func() { c.Redirect(http.StatusSeeOther, appBaseURL()+"/merged?success=0") }
+	tid, raw := c.PostForm("tid"), c.PostForm("t")
+	if tid == "" || raw == "" {
+		fail()
+		return
+	}
+	var kind string
+	if err := db.QueryRowContext(ctx, `SELECT kind FROM email_tokens WHERE id = ?`, tid).Scan(&kind); err != nil || !strings.HasPrefix(kind, mergeTokenPrefix) {
+		fail()
+		return
+	}
+	sourceID, err := verifyEmailTokenByID(tid, raw, kind)
+	if err != nil {
+		fail()
+		return
+	}
+	if _, err := mergeAccounts(ctx, sourceID, strings.TrimPrefix(kind, mergeTokenPrefix), clientIP(c)); err != nil {
+		logIfTimeout(err, "confirmMerge: merge")
+		fail()
+		return
+	}
+	c.Redirect(http.StatusSeeOther, appBaseURL()+"/merged?success=1")
+}
+
+// accountDeactivated reports whether userID froze their account. Their notifications are muted.
+func accountDeactivated(ctx context.Context, userID string) bool {
+	if userID == "" {
+		return false
+	}
+	var n int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM users WHERE id = ? AND deactivated_at IS NOT NULL`, userID).Scan(&n); err != nil {
+		logIfTimeout(err, "accountDeactivated: select")
+		return false
+	}
+	return n > 0
+}
+
+// sendReactivationEmail mails a fresh reactivation link unless one went out within
+// verifyResendCooldown.
+func sendReactivationEmail(ctx context.Context, userID, username, email, locale string) error {
+	var lastSent time.Time
+	err := db.QueryRowContext(ctx, `
+		SELECT created_at FROM email_tokens WHERE user_id = ? AND kind = 'reactivate' ORDER BY created_at DESC LIMIT 1
+	`, userID).Scan(&lastSent)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if err == nil && time.Since(lastSent) < verifyResendCooldown {
+		return nil
+	}
+	raw, tokenID, err := createEmailToken(userID, "reactivate", reactivateTTL)
+	if err != nil {
+		return err
+	}
+	reactivateURL := fmt.Sprintf("%s/reactivate?tid=%s&t=%s", apiBaseURL(), tokenID, raw)
+	subject, body := localizedEmail(resolveLocale(locale), "deactivated", html.EscapeString(username), reactivateURL)
+	go func() {
+		if err := sendEmail(userID, email, subject, body); err != nil {
+			log.Printf("sendEmail reactivate: %v", err)
+		}
+	}()
+	return nil
+}
+
+// deactivateUserHandler freezes the account: events and responses stay, sessions end,
+// notifications stop, and sign-in is refused until the emailed reactivation link is used.
+func deactivateUserHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	userID := ctxUserID(c)
+	var in struct {
+		Password string `json:"password"`
+	}
+	if err := c.BindJSON(&in); err != nil || in.Password == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Password is required"})
+		return
+	}
+
+	var u struct {
+		Username, Email, Locale, PasswordHash string
+		EmailVerified                         bool
+	}
+	if err := db.QueryRowContext(ctx, `SELECT username, unseal(email), locale, password_hash, email_verified FROM users WHERE id = ?`, userID).
+		Scan(&u.Username, &u.Email, &u.Locale, &u.PasswordHash, &u.EmailVerified); err != nil {
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		serverError(c, "deactivateUser: select", err)
+		return
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(in.Password)); err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid password"})
+		return
+	}
+	if !u.EmailVerified {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Verify your email first so you can reactivate later"})
+		return
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		serverError(c, "deactivateUser: begin", err)
+		return
+	}
+	defer tx.Rollback()
+	now := time.Now().UTC()
+	if _, err := tx.ExecContext(ctx, `UPDATE users SET deactivated_at = ?, updated_at = ? WHERE id = ?`, now, now, userID); err != nil {
+		serverError(c, "deactivateUser: update", err)
+		return
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE refresh_tokens SET revoked = 1 WHERE user_id = ?`, userID); err != nil {
+		serverError(c, "deactivateUser: revoke sessions", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		serverError(c, "deactivateUser: commit", err)
+		return
+	}
+	if err := sendReactivationEmail(ctx, userID, u.Username, u.Email, u.Locale); err != nil {
+		logIfTimeout(err, "deactivateUser: reactivation email")
+	}
+
+	clearRefreshCookie(c)
+	c.JSON(http.StatusOK, gin.H{"message": "Account deactivated", "deactivatedAt": now})
+}
+
+// reactivateAccountHandler is the link from the deactivated email.
+func reactivateAccountHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	tid, raw := c.Query("tid"), c.Query("t")
+	if tid == "" || raw == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing token"})
+		return
+	}
+	userID, err := verifyEmailTokenByID(tid, raw, "reactivate")
+	if err != nil {
+		c.Redirect(http.StatusFound, appBaseURL()+"/reactivated?success=0")
+		return
+	}
+	if _, err := db.ExecContext(ctx, `UPDATE users SET deactivated_at = NULL, updated_at = ? WHERE id = ?`, time.Now().UTC(), userID); err != nil {
+		logIfTimeout(err, "reactivate: update user")
+		c.Redirect(http.StatusFound, appBaseURL()+"/reactivated?success=0")
+		return
+	}
+	c.Redirect(http.StatusFound, appBaseURL()+"/reactivated?success=1")
+}
+
+// Data export (GDPR art. 15/20). Small accounts get the bundle in the response; above
+// exportInlineRows rows GET /users/me/export queues a job that dataExportLoop assembles
+// in the background, and the client polls GET /users/me/export/:exportId until it is
+// ready. Finished exports are kept for dataExportTTL.
+const (
+	exportInlineRows     = 2000
+	dataExportTTL        = 24 * time.Hour
+	dataExportStaleAfter = 15 * time.Minute
+	dataExportJobTimeout = 5 * time.Minute
+)
+
+type exportedEvent struct {
+	ID            string     `json:"id"`
+	Name          string     `json:"name"`
+	DateFrom      string     `json:"dateFrom"`
+	DateTo        string     `json:"dateTo"`
+	Duration      float64    `json:"duration"`
+	Timezone      string     `json:"timezone"`
+	Recurrence    string     `json:"recurrence,omitempty"`
+	Public        bool       `json:"public"`
+	Tags          []string   `json:"tags"`
+	FinalizedSlot string     `json:"finalizedSlot,omitempty"`
+	FinalizedAt   *time.Time `json:"finalizedAt,omitempty"`
+	Participants  int        `json:"participants"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	UpdatedAt     time.Time  `json:"updatedAt"`
+}
+
+type exportedParticipation struct {
+	EventID      string          `json:"eventId"`
+	EventName    string          `json:"eventName"`
+	Role         string          `json:"role"`
+	Availability map[string]bool `json:"availability"`
+	CreatedAt    time.Time       `json:"createdAt"`
+	UpdatedAt    time.Time       `json:"updatedAt"`
+}
+
+type exportedLogin struct {
+	At        time.Time `json:"at"`
+	IP        string    `json:"ip"`
+	Device    string    `json:"device,omitempty"`
+	Location  string    `json:"location,omitempty"`
+	Succeeded bool      `json:"succeeded"`
+}
+
+type dataExportBundle struct {
+	ExportedAt     time.Time               `json:"exportedAt"`
+	Profile        gin.H                   `json:"profile"`
+	Events         []exportedEvent         `json:"events"`
+	Participations []exportedParticipation `json:"participations"`
+	LoginHistory   []exportedLogin         `json:"loginHistory"`
+}
+
+// exportRowCount estimates the size of userID's export.
+func exportRowCount(ctx context.Context, userID string) (int, error) {
+	var n int
+	err := db.QueryRowContext(ctx, `
+		SELECT (SELECT COUNT(*) FROM events WHERE creator_id = ?)
+			+ (SELECT COUNT(*) FROM event_participants WHERE user_id = ?)
+			+ (SELECT COUNT(*) FROM refresh_tokens WHERE user_id = ? AND version = 1)
+			+ (SELECT COUNT(*) FROM login_attempts WHERE user_id = ?)
+	`, userID, userID, userID, userID).Scan(&n)
+	return n, err
+}
+
+func buildDataExport(ctx context.Context, userID string) (*dataExportBundle, error) {
+	b := &dataExportBundle{
+		ExportedAt:     time.Now().UTC(),
+		Events:         []exportedEvent{},
+		Participations: []exportedParticipation{},
+		LoginHistory:   []exportedLogin{},
+	}
+	var username, email, locale string
+	var verified bool
+	var created, updated time.Time
+	if err := db.QueryRowContext(ctx, `SELECT username, unseal(email), email_verified, locale, created_at, updated_at FROM users WHERE id = ?`, userID).
+		Scan(&username, &email, &verified, &locale, &created, &updated); err != nil {
+		return nil, err
+	}
+	b.Profile = gin.H{
+		"id":            userID,
+		"username":      username,
+		"email":         email,
+		"emailVerified": verified,
+		"locale":        resolveLocale(locale),
+		"createdAt":     created,
+		"updatedAt":     updated,
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT e.id, e.name, e.date_from, e.date_to, e.duration, e.timezone, e.recurrence, e.is_public, e.tags,
+			COALESCE(e.finalized_slot, ''), e.finalized_at, e.created_at, e.updated_at,
+			(SELECT COUNT(*) FROM event_participants ep WHERE ep.event_id = e.id)
+		FROM events e WHERE e.creator_id = ? ORDER BY e.created_at
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var ev exportedEvent
+		var tagsJSON string
+		var finalizedAt sql.NullTime
+		if err := rows.Scan(&ev.ID, &ev.Name, &ev.DateFrom, &ev.DateTo, &ev.Duration, &ev.Timezone, &ev.Recurrence, &ev.Public, &tagsJSON,
+			&ev.FinalizedSlot, &finalizedAt, &ev.CreatedAt, &ev.UpdatedAt, &ev.Participants); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ev.Tags = []string{}
+		_ = json.Unmarshal([]byte(tagsJSON), &ev.Tags)
+		if finalizedAt.Valid {
+			ev.FinalizedAt = &finalizedAt.Time
+		}
+		b.Events = append(b.Events, ev)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = db.QueryContext(ctx, `
+		SELECT ep.event_id, COALESCE(e.name, ''), ep.role, unseal(ep.availability), ep.created_at, ep.updated_at
+		FROM event_participants ep LEFT JOIN events e ON e.id = ep.event_id
+		WHERE ep.user_id = ? ORDER BY ep.created_at
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var p exportedParticipation
+		var availJSON string
+		if err := rows.Scan(&p.EventID, &p.EventName, &p.Role, &availJSON, &p.CreatedAt, &p.UpdatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		p.Availability = map[string]bool{}
+		_ = json.Unmarshal([]byte(availJSON), &p.Availability)
+		b.Participations = append(b.Participations, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Each login starts a refresh-token family at version 1; failed attempts are kept for
+	// a day by cleanupLoginAttemptsLoop.
+	rows, err = db.QueryContext(ctx, `
+		SELECT created_at, ip, user_agent, location, 1 FROM refresh_tokens WHERE user_id = ? AND version = 1
+		UNION ALL
+		SELECT created_at, COALESCE(ip, ''), '', '', 0 FROM login_attempts WHERE user_id = ?
+		ORDER BY 1 DESC
+	`, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var l exportedLogin
+		var atRaw, ua string
+		if err := rows.Scan(&atRaw, &l.IP, &ua, &l.Location, &l.Succeeded); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		l.At, _ = parseDBTime(atRaw)
+		if ua != "" {
+			l.Device = describeUserAgent(ua)
+		}
+		b.LoginHistory = append(b.LoginHistory, l)
+	}
+	rows.Close()
+	return b, rows.Err()
+}
+
+// writeDataExport encodes b as one JSON document or as a ZIP with a file per section.
+func writeDataExport(w io.Writer, format string, b *dataExportBundle) error {
+	if format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(b)
+	}
+	zw := zip.NewWriter(w)
+	for _, f := range []struct {
+		name string
+		v    interface{}
+	}{
+		{"profile.json", b.Profile},
+		{"events.json", b.Events},
+		{"participations.json", b.Participations},
+		{"login-history.json", b.LoginHistory},
+	} {
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: f.name, Method: zip.Deflate, Modified: b.ExportedAt})
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(fw)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(f.v); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func dataExportHeaders(c *gin.Context, format string, at time.Time) {
+	name := "plannie-export-" + at.Format("20060102") + "." + format
+	contentType := "application/zip"
+	if format == "json" {
+		contentType = "application/json; charset=utf-8"
+	}
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", `attachment; filename="`+name+`"`)
+	c.Header("Cache-Control", "no-store")
+}
+
+// exportUserDataHandler returns the caller's data as ?format=zip (default) or json. Large
+// accounts get 202 with an export id to poll instead; asking again while a job is pending
+// returns the same one.
+func exportUserDataHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	format := c.DefaultQuery("format", "zip")
+	if format != "zip" && format != "json" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be zip or json"})
+		return
+	}
+	userID := ctxUserID(c)
+	n, err := exportRowCount(ctx, userID)
+	if err != nil {
+		serverError(c, "exportUserData: count", err)
+		return
+	}
+	if n <= exportInlineRows {
+		b, err := buildDataExport(ctx, userID)
+		if err != nil {
+			serverError(c, "exportUserData: build", err)
+			return
+		}
+		metricInc("plannie_data_exports_total", "mode", "inline")
+		dataExportHeaders(c, format, b.ExportedAt)
+		c.Status(http.StatusOK)
+		if err := writeDataExport(c.Writer, format, b); err != nil {
+			log.Printf("exportUserData: write: %v", err)
+		}
+		return
+	}
+
+	var id string
+	err = db.QueryRowContext(ctx, `SELECT id FROM data_exports WHERE user_id = ? AND format = ? AND status IN ('pending', 'running')`, userID, format).Scan(&id)
+	if err == sql.ErrNoRows {
+		id = uuid.NewString()
+		_, err = db.ExecContext(ctx, `INSERT INTO data_exports(id, user_id, format, status, created_at) VALUES (?,?,?,'pending',?)`, id, userID, format, time.Now().UTC())
+		metricInc("plannie_data_exports_total", "mode", "background")
+	}
+	if err != nil {
+		serverError(c, "exportUserData: queue", err)
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"id": id, "status": "pending", "statusUrl": "/users/me/export/" + id})
+}
+
+// getDataExportHandler reports a queued export's status, or downloads it once ready.
+func getDataExportHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	id := c.Param("exportId")
+	var format, status string
+	var data []byte
+	var finished sql.NullTime
+	err := db.QueryRowContext(ctx, `SELECT format, status, data, finished_at FROM data_exports WHERE id = ? AND user_id = ?`, id, ctxUserID(c)).
+		Scan(&format, &status, &data, &finished)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Export not found"})
+		return
+	}
+	if err != nil {
+		serverError(c, "getDataExport: select", err)
+		return
+	}
+	switch status {
+	case "ready":
+		plain, err := openField(string(data))
+		if err != nil {
+			serverError(c, "getDataExport: open", err)
+			return
+		}
+		dataExportHeaders(c, format, finished.Time)
+		c.Data(http.StatusOK, c.Writer.Header().Get("Content-Type"), []byte(plain))
+	case "failed":
+		c.JSON(http.StatusOK, gin.H{"id": id, "status": status, "error": "The export could not be assembled; request a new one"})
+	default:
+		c.JSON(http.StatusAccepted, gin.H{"id": id, "status": status})
+	}
+}
+
+func dataExportLoop(ctx context.Context) error {
+	return runEvery(ctx, 10*time.Second, runDataExports)
+}
+
+// runDataExports drops expired exports and assembles pending ones. A job left running by a
+// crashed instance is picked up again after dataExportStaleAfter.
+func runDataExports(ctx context.Context) {
+	now := time.Now().UTC()
+	if _, err := db.ExecContext(ctx, `DELETE FROM data_exports WHERE created_at < ?`, now.Add(-dataExportTTL)); err != nil {
+		logIfTimeout(err, "dataExports: expire")
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, user_id, format FROM data_exports
+		WHERE status = 'pending' OR (status = 'running' AND started_at < ?)
+		ORDER BY created_at LIMIT 5
+	`, now.Add(-dataExportStaleAfter))
+	if err != nil {
+		logIfTimeout(err, "dataExports: select")
+		return
+	}
+	type job struct{ id, userID, format string }
+	var jobs []job
+	for rows.Next() {
+		var j job
+		if err := rows.Scan(&j.id, &j.userID, &j.format); err == nil {
+			jobs = append(jobs, j)
+		}
+	}
+	rows.Close()
+	for _, j := range jobs {
+		res, err := db.ExecContext(ctx, `
+			UPDATE data_exports SET status = 'running', started_at = ?
+			WHERE id = ? AND (status = 'pending' OR (status = 'running' AND started_at < ?))
+		`, now, j.id, now.Add(-dataExportStaleAfter))
+		if err != nil {
+			logIfTimeout(err, "dataExports: claim")
+			continue
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		status, data := "ready", []byte(nil)
+		jobCtx, cancel := context.WithTimeout(ctx, dataExportJobTimeout)
+		b, err := buildDataExport(jobCtx, j.userID)
+		if err == nil {
+			var buf bytes.Buffer
+			if err = writeDataExport(&buf, j.format, b); err == nil {
+				// The archive holds the user's whole account, so it is sealed at rest like
+				// the fields it was built from.
+				var sealed string
+				sealed, err = sealField(buf.String())
+				data = []byte(sealed)
+			}
+		}
+		cancel()
+		if err != nil {
+			log.Printf("dataExports: %s: %v", j.id, err)
+			status, data = "failed", nil
+		}
+		metricInc("plannie_data_export_jobs_total", "status", status)
+		if _, err := db.ExecContext(ctx, `UPDATE data_exports SET status = ?, data = ?, finished_at = ? WHERE id = ?`, status, data, time.Now().UTC(), j.id); err != nil {
+			logIfTimeout(err, "dataExports: finish")
+		}
+	}
+}
+
+// maxHistoryExportRows caps how many availability_history rows one export reads.
+const maxHistoryExportRows = 5000
+
+type historyPoint struct {
+	At             time.Time `json:"at"`
+	AvailableSlots int       `json:"availableSlots"`
+	Added          int       `json:"added"`
+	Removed        int       `json:"removed"`
+	Proxy          bool      `json:"proxy"`
+}
+
+type eventHistory struct {
+	EventID        string         `json:"eventId"`
+	EventName      string         `json:"eventName"`
+	Timezone       string         `json:"timezone"`
+	Changes        int            `json:"changes"`
+	FirstAt        time.Time      `json:"firstAt"`
+	LastAt         time.Time      `json:"lastAt"`
+	AvailableSlots int            `json:"availableSlots"`
+	Timeline       []historyPoint `json:"timeline"`
+	latest         map[string]bool
+}
+
+// myAvailabilityHistoryHandler replays the caller's availability_history per event: how
+// many slots they offered after each change and what was added or removed. freeHours
+// counts the slots of each event's latest answer by weekday (0 = Sunday) and hour in
+// ?timezone= (default UTC). ?since= (RFC 3339) limits the changes read.
+func myAvailabilityHistoryHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	userID := ctxUserID(c)
+	tz := c.DefaultQuery("timezone", "UTC")
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid timezone"})
+		return
+	}
+	since := time.Time{}
+	if v := c.Query("since"); v != "" {
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "since must be RFC 3339"})
+			return
+		}
+	}
+
+	entries, err := userHistoryEntries(ctx, userID, since.UTC(), maxHistoryExportRows+1)
+	if err != nil {
+		serverError(c, "availabilityHistory: query", err)
+		return
+	}
+
+	byEvent := map[string]*eventHistory{}
+	order := []*eventHistory{}
+	total, truncated := 0, false
+	for _, h := range entries {
+		if total == maxHistoryExportRows {
+			truncated = true
+			break
+		}
+		total++
+		next := map[string]bool{}
+		_ = json.Unmarshal([]byte(h.availJSON), &next)
+		eventID, at := h.eventID, h.at
+		eh, ok := byEvent[eventID]
+		if !ok {
+			eh = &eventHistory{EventID: eventID, EventName: h.eventName, Timezone: h.timezone, FirstAt: at, latest: map[string]bool{}}
+			byEvent[eventID] = eh
+			order = append(order, eh)
+		}
+		p := historyPoint{At: at, Proxy: h.proxy}
+		for k, v := range next {
+			if !v {
+				continue
+			}
+			p.AvailableSlots++
+			if !eh.latest[k] {
+				p.Added++
+			}
+		}
+		for k, v := range eh.latest {
+			if v && !next[k] {
+				p.Removed++
+			}
+		}
+		eh.Changes++
+		eh.LastAt = at
+		eh.AvailableSlots = p.AvailableSlots
+		eh.Timeline = append(eh.Timeline, p)
+		eh.latest = next
+	}
+
+	var freeHours [7][24]int
+	for _, eh := range order {
+		for k, v := range eh.latest {
+			if !v {
+				continue
+			}
+			if t, err := parseSlotKey(k); err == nil {
+				lt := t.In(loc)
+				freeHours[lt.Weekday()][lt.Hour()]++
+			}
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool { return order[i].LastAt.After(order[j].LastAt) })
+	c.JSON(http.StatusOK, gin.H{
+		"timezone":  loc.String(),
+		"changes":   total,
+		"truncated": truncated,
+		"events":    order,
+		"freeHours": freeHours,
+	})
+}
+
+type userHistoryEntry struct {
+	eventID, eventName, timezone, availJSON string
+	proxy                                   bool
+	at                                      time.Time
+}
+
+// userHistoryEntries reads a user's history oldest first from the hot table and the
+// archive, returning at most limit entries.
+func userHistoryEntries(ctx context.Context, userID string, since time.Time, limit int) ([]userHistoryEntry, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT h.event_id, e.name, e.timezone, unseal(h.availability), h.proxy, h.created_at
+		FROM availability_history h JOIN events e ON e.id = h.event_id
+		WHERE h.user_id = ? AND h.created_at >= ?
+		ORDER BY h.created_at ASC
+		LIMIT ?
+	`, userID, since, limit)
+	if err != nil {
+		return nil, err
+	}
+	var out []userHistoryEntry
+	for rows.Next() {
+		var h userHistoryEntry
+		if err := rows.Scan(&h.eventID, &h.eventName, &h.timezone, &h.availJSON, &h.proxy, &h.at); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		out = append(out, h)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = archiveStore().QueryContext(ctx, `
+		SELECT event_id, unseal(availability), proxy, created_at FROM availability_history_archive
+		WHERE user_id = ? AND created_at >= ?
+		ORDER BY created_at ASC
+		LIMIT ?
+	`, userID, since, limit)
+	if err != nil {
+		return nil, err
+	}
+	var archived []userHistoryEntry
+	for rows.Next() {
+		var h userHistoryEntry
+		if err := rows.Scan(&h.eventID, &h.availJSON, &h.proxy, &h.at); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		archived = append(archived, h)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	events := map[string][2]string{}
+	for _, h := range archived {
+		ev, ok := events[h.eventID]
+		if !ok {
+			if err := db.QueryRowContext(ctx, `SELECT name, timezone FROM events WHERE id = ?`, h.eventID).Scan(&ev[0], &ev[1]); err == sql.ErrNoRows {
+				events[h.eventID] = ev
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			events[h.eventID] = ev
+		}
+		if ev[0] == "" {
+			continue // event deleted since
+		}
+		h.eventName, h.timezone = ev[0], ev[1]
+		out = append(out, h)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].at.Before(out[j].at) })
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+// Daily rollups for GET /admin/stats. Counters are kept in memory and folded into
+// daily_stats once a minute and on shutdown, so hot paths never write for them.
+var (
+	statsMu      sync.Mutex
+	statsPending = map[[2]string]int64{}
+	statsPeaks   = map[[2]string]int64{}
+)
+
+// dailyStatMetrics are the series GET /admin/stats returns; *_peak ones are daily maxima.
+var dailyStatMetrics = []string{"signups", "events_created", "responses", "emails_sent", "sse_connections", "sse_peak"}
+
+func statDay(t time.Time) string { return t.UTC().Format("2006-01-02") }
+
+func statInc(metric string) {
+	statsMu.Lock()
+	statsPending[[2]string{statDay(time.Now()), metric}]++
+	statsMu.Unlock()
+}
+
+func statPeak(metric string, v int64) {
+	key := [2]string{statDay(time.Now()), metric}
+	statsMu.Lock()
+	if v > statsPeaks[key] {
+		statsPeaks[key] = v
+	}
+	statsMu.Unlock()
+}
+
+// flushDailyStats writes pending counters; on failure they are put back for the next try.
+func flushDailyStats() {
+	statsMu.Lock()
+	pending, peaks, delivery := statsPending, statsPeaks, emailDeliveryPending
+	statsPending, statsPeaks, emailDeliveryPending = map[[2]string]int64{}, map[[2]string]int64{}, map[[3]string]int64{}
+	statsMu.Unlock()
+	if len(pending) == 0 && len(peaks) == 0 && len(delivery) == 0 {
+		return
+	}
+	err := func() error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		for k, v := range pending {
+			if _, err := tx.Exec(`
+				INSERT INTO daily_stats(day, metric, value) VALUES (?,?,?)
+				ON CONFLICT(day, metric) DO UPDATE SET value = value + excluded.value
+			`, k[0], k[1], v); err != nil {
+				return err
+			}
+		}
+		for k, v := range peaks {
+			if _, err := tx.Exec(`
+				INSERT INTO daily_stats(day, metric, value) VALUES (?,?,?)
+				ON CONFLICT(day, metric) DO UPDATE SET value = MAX(value, excluded.value)
+			`, k[0], k[1], v); err != nil {
+				return err
+			}
+		}
+		for k, v := range delivery {
+			if _, err := tx.Exec(`
+				INSERT INTO email_delivery_stats(day, provider, outcome, value) VALUES (?,?,?,?)
+				ON CONFLICT(day, provider, outcome) DO UPDATE SET value = value + excluded.value
+			`, k[0], k[1], k[2], v); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}()
+	if err != nil {
+		log.Printf("daily stats flush error: %v", err)
+		statsMu.Lock()
+		for k, v := range pending {
+			statsPending[k] += v
+		}
+		for k, v := range peaks {
+			if v > statsPeaks[k] {
+				statsPeaks[k] = v
+			}
+		}
+		for k, v := range delivery {
+			emailDeliveryPending[k] += v
+		}
+		statsMu.Unlock()
+	}
+}
+
+// dailyStatsLoop flushes the in-memory counters every minute and once more on shutdown.
+func dailyStatsLoop(ctx context.Context) error {
+	err := runEvery(ctx, time.Minute, func(context.Context) { flushDailyStats() })
+	flushDailyStats()
+	return err
+}
+
+// adminStatsHandler returns instance totals and one value per day for each rollup metric
+// over the last ?days= days (default 30, max 366), oldest first, with missing days as 0.
+func adminStatsHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	days := 30
+	if v := c.Query("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxGridDays {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "days must be between 1 and 366"})
+			return
+		}
+		days = n
+	}
+	flushDailyStats()
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	from := today.AddDate(0, 0, -(days - 1))
+	index := map[string]int{}
+	labels := make([]string, days)
+	for i := 0; i < days; i++ {
+		labels[i] = statDay(from.AddDate(0, 0, i))
+		index[labels[i]] = i
+	}
+	series := map[string][]int64{}
+	for _, m := range dailyStatMetrics {
+		series[m] = make([]int64, days)
+	}
+	rows, err := db.QueryContext(ctx, `SELECT day, metric, value FROM daily_stats WHERE day >= ? AND day <= ?`, labels[0], labels[days-1])
+	if err != nil {
+		serverError(c, "adminStats: query", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var day, metric string
+		var v int64
+		if err := rows.Scan(&day, &metric, &v); err != nil {
+			serverError(c, "adminStats: scan", err)
+			return
+		}
+		if s, ok := series[metric]; ok {
+			if i, ok := index[day]; ok {
+				s[i] = v
+			}
+		}
+	}
+
+	totals := gin.H{"sseConnections": int(sseSubscriberCount())}
+	for key, q := range map[string]string{
+		"users":          `SELECT COUNT(*) FROM users WHERE merged_into IS NULL`,
+		"events":         `SELECT COUNT(*) FROM events`,
+		"participations": `SELECT COUNT(*) FROM event_participants`,
+	} {
+		var n int
+		if err := db.QueryRowContext(ctx, q).Scan(&n); err != nil {
+			serverError(c, "adminStats: totals", err)
+			return
+		}
+		totals[key] = n
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"days":   labels,
+		"series": series,
+		"totals": totals,
+	})
+}
+
+// Tenancy. TENANT_MODE=subdomain serves tenant <slug> at <slug>.TENANT_BASE_DOMAIN and
+// TENANT_MODE=path at a /t/<slug> prefix, which is stripped before routing. Everything
+// else belongs to the default tenant "", the only one when TENANT_MODE is unset. Users
+// and events carry their tenant; access tokens are only accepted by their own tenant.
+// Usernames and emails stay unique across the whole instance.
+var (
+	tenantMode       string
+	tenantBaseDomain string
+	tenantSlugRe     = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,30}[a-z0-9]$`)
+	reservedSlugs    = map[string]bool{"www": true, "api": true, "app": true, "admin": true}
+)
+
+type tenantCtxKey struct{}
+
+type Tenant struct {
+	ID        string    `json:"id"`
+	Slug      string    `json:"slug"`
+	Name      string    `json:"name"`
+	MaxUsers  int       `json:"maxUsers"`
+	MaxEvents int       `json:"maxEvents"`
+	Users     int       `json:"users"`
+	Events    int       `json:"events"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// tenantHandler resolves the tenant before gin sees the request. Unknown slugs are 404.
+func tenantHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		slug := ""
+		switch tenantMode {
+		case "subdomain":
+			host := strings.ToLower(req.Host)
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			slug = strings.TrimSuffix(host, "."+tenantBaseDomain)
+			if slug == host || strings.Contains(slug, ".") {
+				slug = ""
+			}
+		case "path":
+			if rest, ok := strings.CutPrefix(req.URL.Path, "/t/"); ok {
+				var path string
+				slug, path, _ = strings.Cut(rest, "/")
+				req.URL.Path = "/" + path
+				req.URL.RawPath = ""
+			}
+		}
+		if slug == "" {
+			next.ServeHTTP(w, req)
+			return
+		}
+		var id string
+		if err := db.QueryRowContext(req.Context(), `SELECT id FROM tenants WHERE slug = ?`, slug).Scan(&id); err != nil {
+			if err != sql.ErrNoRows {
+				logIfTimeout(err, "tenant: resolve")
+			}
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error":"Unknown tenant"}`))
+			return
+		}
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), tenantCtxKey{}, id)))
+	})
+}
+
+// requestTenant is the tenant id resolved for the request, "" for the default tenant.
+func requestTenant(c *gin.Context) string {
+	id, _ := c.Request.Context().Value(tenantCtxKey{}).(string)
+	return id
+}
+
+// tenantAPIBaseURL is apiBaseURL as seen by tenantID: on its subdomain or under its /t/<slug>
+// prefix, so links handed out by a tenant resolve back to it.
+func tenantAPIBaseURL(ctx context.Context, tenantID string) (string, error) {
+	base := apiBaseURL()
+	if tenantMode == "" || tenantID == "" {
+		return base, nil
+	}
+	var slug string
+	if err := db.QueryRowContext(ctx, `SELECT slug FROM tenants WHERE id = ?`, tenantID).Scan(&slug); err != nil {
+		return "", err
+	}
+	if tenantMode == "path" {
+		return strings.TrimSuffix(base, "/") + "/t/" + slug, nil
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	u.Host = slug + "." + tenantBaseDomain
+	if port := u.Port(); port != "" {
+		u.Host += ":" + port
+	}
+	return strings.TrimSuffix(u.String(), "/"), nil
+}
+
+// eventTenantMiddleware answers 404 on /events/:id and /quick-events/:id routes for events
+// of another tenant.
+func eventTenantMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		path := c.FullPath()
+		if tenantMode == "" || !(strings.HasPrefix(path, "/events/:id") || strings.HasPrefix(path, "/quick-events/:id")) {
+			c.Next()
+			return
+		}
+		var tenantID string
+		err := db.QueryRowContext(c.Request.Context(), `SELECT tenant_id FROM events WHERE id = ?`, c.Param("id")).Scan(&tenantID)
+		if err == nil && tenantID != requestTenant(c) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Not found"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// enforceTenantQuota writes the 403 response and returns false when the request's tenant
+// has no room for another user or event ("users" or "events"). 0 means unlimited.
+func enforceTenantQuota(c *gin.Context, ctx context.Context, kind string) bool {
+	limit, exceeded, err := tenantQuotaExceeded(ctx, requestTenant(c), kind)
+	if err != nil {
+		serverError(c, "tenantQuota: "+kind, err)
+		return false
+	}
+	if exceeded {
+		c.JSON(http.StatusForbidden, gin.H{"error": "This organization has reached its " + kind + " limit", "code": "tenant_quota", "limit": limit})
+		return false
+	}
+	return true
+}
+
+// tenantQuotaExceeded reports whether tenantID has no room for another user or event, and
+// its limit. Background jobs without a request use it directly.
+func tenantQuotaExceeded(ctx context.Context, tenantID, kind string) (int, bool, error) {
+	if tenantID == "" {
+		return 0, false, nil
+	}
+	var limit, count int
+	var err error
+	switch kind {
+	case "users":
+		err = db.QueryRowContext(ctx, `
+			SELECT t.max_users, (SELECT COUNT(*) FROM users WHERE tenant_id = t.id AND merged_into IS NULL) FROM tenants t WHERE t.id = ?
+		`, tenantID).Scan(&limit, &count)
+	case "events":
+		err = db.QueryRowContext(ctx, `
+			SELECT t.max_events, (SELECT COUNT(*) FROM events WHERE tenant_id = t.id) FROM tenants t WHERE t.id = ?
+		`, tenantID).Scan(&limit, &count)
+	default:
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	if limit > 0 && count >= limit {
+		metricInc("plannie_tenant_quota_exceeded_total", "kind", kind)
+		return limit, true, nil
+	}
+	return limit, false, nil
+}
+
+func loadTenants(ctx context.Context, where string, args ...interface{}) ([]Tenant, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT t.id, t.slug, t.name, t.max_users, t.max_events, t.created_at,
+			(SELECT COUNT(*) FROM users WHERE tenant_id = t.id AND merged_into IS NULL),
+			(SELECT COUNT(*) FROM events WHERE tenant_id = t.id)
+		FROM tenants t `+where+` ORDER BY t.slug`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Tenant{}
+	for rows.Next() {
+		var t Tenant
+		if err := rows.Scan(&t.ID, &t.Slug, &t.Name, &t.MaxUsers, &t.MaxEvents, &t.CreatedAt, &t.Users, &t.Events); err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+	}
+	return out, rows.Err()
+}
+
+func adminListTenantsHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	tenants, err := loadTenants(ctx, "")
+	if err != nil {
+		serverError(c, "adminListTenants: query", err)
+		return
+	}
+	c.JSON(http.StatusOK, tenants)
+}
+
+type tenantInput struct {
+	Slug      string `json:"slug"`
+	Name      string `json:"name"`
+	MaxUsers  int    `json:"maxUsers"`
+	MaxEvents int    `json:"maxEvents"`
+}
+
+func (in tenantInput) validate() string {
+	if strings.TrimSpace(in.Name) == "" || len(in.Name) > 100 {
+		return "Name is required (max 100 characters)"
+	}
+	if in.MaxUsers < 0 || in.MaxEvents < 0 {
+		return "Quotas must be 0 (unlimited) or positive"
+	}
+	return ""
+}
+
+func adminCreateTenantHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	var in tenantInput
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+	in.Slug = strings.ToLower(strings.TrimSpace(in.Slug))
+	if !tenantSlugRe.MatchString(in.Slug) || reservedSlugs[in.Slug] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Slug must be 3-32 lowercase letters, digits or dashes"})
+		return
+	}
+	if msg := in.validate(); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+	now := time.Now().UTC()
+	id := uuid.NewString()
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO tenants(id, slug, name, max_users, max_events, created_at, updated_at) VALUES (?,?,?,?,?,?,?)
+	`, id, in.Slug, strings.TrimSpace(in.Name), in.MaxUsers, in.MaxEvents, now, now); err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			c.JSON(http.StatusConflict, gin.H{"error": "Slug already taken"})
+			return
+		}
+		serverError(c, "adminCreateTenant: insert", err)
+		return
+	}
+	c.JSON(http.StatusCreated, Tenant{ID: id, Slug: in.Slug, Name: strings.TrimSpace(in.Name), MaxUsers: in.MaxUsers, MaxEvents: in.MaxEvents, CreatedAt: now})
+}
+
+// adminUpdateTenantHandler changes a tenant's name and quotas. Lowering a quota below
+// current usage only blocks new signups or events.
+func adminUpdateTenantHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	var in tenantInput
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+	if msg := in.validate(); msg != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": msg})
+		return
+	}
+	res, err := db.ExecContext(ctx, `
+		UPDATE tenants SET name = ?, max_users = ?, max_events = ?, updated_at = ? WHERE id = ?
+	`, strings.TrimSpace(in.Name), in.MaxUsers, in.MaxEvents, time.Now().UTC(), c.Param("id"))
+	if err != nil {
+		serverError(c, "adminUpdateTenant: update", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	}
+	tenants, err := loadTenants(ctx, "WHERE t.id = ?", c.Param("id"))
+	if err != nil || len(tenants) == 0 {
+		serverError(c, "adminUpdateTenant: reload", err)
+		return
+	}
+	c.JSON(http.StatusOK, tenants[0])
+}
+
+// adminCurrentTenantHandler shows the request's tenant with its usage and admins.
+func adminCurrentTenantHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	tenantID := requestTenant(c)
+	t := Tenant{Slug: "", Name: "default"}
+	if tenantID != "" {
+		tenants, err := loadTenants(ctx, "WHERE t.id = ?", tenantID)
+		if err != nil || len(tenants) == 0 {
+			serverError(c, "adminCurrentTenant: load", err)
+			return
+		}
+		t = tenants[0]
+	} else {
+		_ = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM users WHERE tenant_id = '' AND merged_into IS NULL`).Scan(&t.Users)
+		_ = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM events WHERE tenant_id = ''`).Scan(&t.Events)
+	}
+	rows, err := db.QueryContext(ctx, `SELECT id, username FROM users WHERE tenant_id = ? AND is_admin = 1 ORDER BY username`, tenantID)
+	if err != nil {
+		serverError(c, "adminCurrentTenant: admins", err)
+		return
+	}
+	defer rows.Close()
+	admins := []gin.H{}
+	for rows.Next() {
+		var id, username string
+		if err := rows.Scan(&id, &username); err == nil {
+			admins = append(admins, gin.H{"id": id, "username": username})
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"tenant": t, "admins": admins})
+}
+
+// adminSetTenantAdminHandler grants (PUT) or revokes (DELETE) admin rights for a user of
+// the request's tenant. Only instance admins may do this, so a tenant admin can't mint
+// further admins on their own.
+func adminSetTenantAdminHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	targetID := c.Param("userId")
+	if c.Request.Method == http.MethodDelete && targetID == ctxUserID(c) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You can't remove your own admin rights"})
+		return
+	}
+	res, err := db.ExecContext(ctx, `
+		UPDATE users SET is_admin = ?, updated_at = ? WHERE id = ? AND tenant_id = ? AND merged_into IS NULL
+	`, c.Request.Method == http.MethodPut, time.Now().UTC(), targetID, requestTenant(c))
+	if err != nil {
+		serverError(c, "adminSetTenantAdmin: update", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	log.Printf("admin %s set is_admin=%t for %s", ctxUserID(c), c.Request.Method == http.MethodPut, targetID)
+	c.JSON(http.StatusOK, gin.H{"userId": targetID, "admin": c.Request.Method == http.MethodPut})
+}
+
+// Branding is stored per tenant in the branding table. A tenant without a row inherits
+// the default tenant's row, and without that the built-in look is used.
+type Branding struct {
+	ProductName  string `json:"productName"`
+	LogoURL      string `json:"logoUrl"`
+	AccentColor  string `json:"accentColor"`
+	SupportEmail string `json:"supportEmail"`
+}
+
+var (
+	defaultBranding = Branding{ProductName: "Plannie", AccentColor: "#7c3aed"}
+	accentColorRe   = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+)
+
+// loadBranding returns the effective branding for tenantID and whether it was customized.
+func loadBranding(ctx context.Context, tenantID string) (Branding, bool, error) {
+	for _, id := range []string{tenantID, ""} {
+		var b Branding
+		err := db.QueryRowContext(ctx, `
+			SELECT product_name, logo_url, accent_color, support_email FROM branding WHERE tenant_id = ?
+		`, id).Scan(&b.ProductName, &b.LogoURL, &b.AccentColor, &b.SupportEmail)
+		if err == nil {
+			if b.AccentColor == "" {
+				b.AccentColor = defaultBranding.AccentColor
+			}
+			return b, true, nil
+		}
+		if err != sql.ErrNoRows {
+			return defaultBranding, false, err
+		}
+		if id == "" {
+			break
+		}
+	}
+	b := defaultBranding
+	b.SupportEmail = emailReplyTo
+	return b, false, nil
+}
+
+// brandEmailHTML frames a message with the sender account's tenant branding. Mail from
+// instances that never configured branding is left as is.
+func brandEmailHTML(ctx context.Context, userID, body string) string {
+	tenantID := ""
+	if userID != "" {
+		_ = db.QueryRowContext(ctx, `SELECT tenant_id FROM users WHERE id = ?`, userID).Scan(&tenantID)
+	}
+	b, custom, err := loadBranding(ctx, tenantID)
+	if err != nil {
+		logIfTimeout(err, "brandEmail: load")
+	}
+	if !custom {
+		return body
+	}
+	header := `<strong style="font-size:18px;color:` + b.AccentColor + `">` + html.EscapeString(b.ProductName) + `</strong>`
+	if b.LogoURL != "" {
+		header = `<img src="` + html.EscapeString(b.LogoURL) + `" alt="` + html.EscapeString(b.ProductName) + `" style="max-height:40px">`
+	}
+	footer := ""
+	if b.SupportEmail != "" {
+		footer = `<p style="font-size:12px;color:#888">Questions? Contact <a href="mailto:` + html.EscapeString(b.SupportEmail) + `">` + html.EscapeString(b.SupportEmail) + `</a>.</p>`
+	}
+	return `<div style="border-bottom:3px solid ` + b.AccentColor + `;padding-bottom:8px;margin-bottom:16px">` + header + `</div>` + body + footer
+}
+
+func getBrandingHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	b, _, err := loadBranding(ctx, requestTenant(c))
+	if err != nil {
+		serverError(c, "getBranding: load", err)
+		return
+	}
+	publicCache(c, 5*time.Minute, time.Hour, brandingSurrogateKey)
+	c.JSON(http.StatusOK, b)
+}
+
+// adminUpdateBrandingHandler sets the request tenant's branding. Admins of the default
+// tenant set the instance-wide fallback.
+func adminUpdateBrandingHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	var in Branding
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+	in.ProductName = strings.TrimSpace(in.ProductName)
+	in.LogoURL = strings.TrimSpace(in.LogoURL)
+	in.SupportEmail = strings.TrimSpace(in.SupportEmail)
+	if in.ProductName == "" || len(in.ProductName) > 60 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "productName is required (max 60 characters)"})
+		return
+	}
+	if in.LogoURL != "" {
+		u, err := url.Parse(in.LogoURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || len(in.LogoURL) > 500 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "logoUrl must be an absolute http(s) URL"})
+			return
+		}
+	}
+	if in.AccentColor != "" && !accentColorRe.MatchString(in.AccentColor) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "accentColor must look like #RRGGBB"})
+		return
+	}
+	if in.SupportEmail != "" && !validateEmail(in.SupportEmail) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid supportEmail"})
+		return
+	}
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO branding(tenant_id, product_name, logo_url, accent_color, support_email, updated_at) VALUES (?,?,?,?,?,?)
+		ON CONFLICT(tenant_id) DO UPDATE SET product_name = excluded.product_name, logo_url = excluded.logo_url,
+			accent_color = excluded.accent_color, support_email = excluded.support_email, updated_at = excluded.updated_at
+	`, requestTenant(c), in.ProductName, in.LogoURL, in.AccentColor, in.SupportEmail, time.Now().UTC()); err != nil {
+		serverError(c, "updateBranding: upsert", err)
+		return
+	}
+	b, _, err := loadBranding(ctx, requestTenant(c))
+	if err != nil {
+		serverError(c, "updateBranding: reload", err)
+		return
+	}
+	cdnPurge(brandingSurrogateKey)
+	c.JSON(http.StatusOK, b)
+}
+
+// adminResetBrandingHandler drops the request tenant's branding so it inherits again.
+func adminResetBrandingHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	if _, err := db.ExecContext(ctx, `DELETE FROM branding WHERE tenant_id = ?`, requestTenant(c)); err != nil {
+		serverError(c, "resetBranding: delete", err)
+		return
+	}
+	b, _, err := loadBranding(ctx, requestTenant(c))
+	if err != nil {
+		serverError(c, "resetBranding: reload", err)
+		return
+	}
+	cdnPurge(brandingSurrogateKey)
+	c.JSON(http.StatusOK, b)
+}
+
+// Announcements are banners for clients. Those of the default tenant are shown on every
+// tenant, so instance admins can announce maintenance once.
+type Announcement struct {
+	ID        string     `json:"id"`
+	Title     string     `json:"title"`
+	Message   string     `json:"message"`
+	Severity  string     `json:"severity"`
+	StartsAt  time.Time  `json:"startsAt"`
+	EndsAt    *time.Time `json:"endsAt,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+}
+
+var announcementSeverities = map[string]bool{"info": true, "warning": true, "critical": true}
+
+func queryAnnouncements(ctx context.Context, where string, args ...interface{}) ([]Announcement, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, title, message, severity, starts_at, ends_at, created_at, updated_at
+		FROM announcements WHERE `+where+` ORDER BY starts_at DESC, id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []Announcement{}
+	for rows.Next() {
+		var a Announcement
+		var ends sql.NullTime
+		if err := rows.Scan(&a.ID, &a.Title, &a.Message, &a.Severity, &a.StartsAt, &ends, &a.CreatedAt, &a.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if ends.Valid {
+			a.EndsAt = &ends.Time
+		}
+		out = append(out, a)
+	}
+	return out, rows.Err()
+}
+
+// listAnnouncementsHandler returns the announcements active right now.
+func listAnnouncementsHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	now := time.Now().UTC()
+	list, err := queryAnnouncements(ctx, `(tenant_id = '' OR tenant_id = ?) AND starts_at <= ? AND (ends_at IS NULL OR ends_at > ?)`,
+		requestTenant(c), now, now)
+	if err != nil {
+		serverError(c, "listAnnouncements: query", err)
+		return
+	}
+	publicCache(c, time.Minute, time.Minute, announcementsSurrogateKey)
+	c.JSON(http.StatusOK, list)
+}
+
+// adminListAnnouncementsHandler lists the tenant's announcements, including past and scheduled ones.
+func adminListAnnouncementsHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	list, err := queryAnnouncements(ctx, `tenant_id = ?`, requestTenant(c))
+	if err != nil {
+		serverError(c, "adminListAnnouncements: query", err)
+		return
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+// adminSaveAnnouncementHandler creates (POST) or replaces (PUT /:id) an announcement.
+// startsAt defaults to now; without endsAt it stays up until deleted.
+func adminSaveAnnouncementHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	var in struct {
+		Title    string     `json:"title"`
+		Message  string     `json:"message"`
+		Severity string     `json:"severity"`
+		StartsAt *time.Time `json:"startsAt"`
+		EndsAt   *time.Time `json:"endsAt"`
+	}
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+	in.Title = strings.TrimSpace(in.Title)
+	if in.Title == "" || len(in.Title) > 120 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "title is required (max 120 characters)"})
+		return
+	}
+	if len(in.Message) > 2000 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "message is too long (max 2000 characters)"})
+		return
+	}
+	if in.Severity == "" {
+		in.Severity = "info"
+	}
+	if !announcementSeverities[in.Severity] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "severity must be info, warning or critical"})
+		return
+	}
+	now := time.Now().UTC()
+	starts := now
+	if in.StartsAt != nil {
+		starts = in.StartsAt.UTC()
+	}
+	var ends interface{}
+	if in.EndsAt != nil {
+		if !in.EndsAt.After(starts) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "endsAt must be after startsAt"})
+			return
+		}
+		ends = in.EndsAt.UTC()
+	}
+
+	id := c.Param("id")
+	if id == "" {
+		id = uuid.NewString()
+		if _, err := db.ExecContext(ctx, `
+			INSERT INTO announcements(id, tenant_id, title, message, severity, starts_at, ends_at, created_by, created_at, updated_at)
+			VALUES (?,?,?,?,?,?,?,?,?,?)
+		`, id, requestTenant(c), in.Title, in.Message, in.Severity, starts, ends, ctxUserID(c), now, now); err != nil {
+			serverError(c, "saveAnnouncement: insert", err)
+			return
+		}
+	} else {
+		res, err := db.ExecContext(ctx, `
+			UPDATE announcements SET title = ?, message = ?, severity = ?, starts_at = ?, ends_at = ?, updated_at = ?
+			WHERE id = ? AND tenant_id = ?
+		`, in.Title, in.Message, in.Severity, starts, ends, now, id, requestTenant(c))
+		if err != nil {
+			serverError(c, "saveAnnouncement: update", err)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+			return
+		}
+	}
+	list, err := queryAnnouncements(ctx, `id = ?`, id)
+	if err != nil || len(list) == 0 {
+		serverError(c, "saveAnnouncement: reload", err)
+		return
+	}
+	cdnPurge(announcementsSurrogateKey)
+	status := http.StatusOK
+	if c.Request.Method == http.MethodPost {
+		status = http.StatusCreated
+	}
+	c.JSON(status, list[0])
+}
+
+func adminDeleteAnnouncementHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	res, err := db.ExecContext(ctx, `DELETE FROM announcements WHERE id = ? AND tenant_id = ?`, c.Param("id"), requestTenant(c))
+	if err != nil {
+		serverError(c, "deleteAnnouncement: delete", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	}
+	cdnPurge(announcementsSurrogateKey)
+	c.JSON(http.StatusOK, gin.H{"message": "Deleted"})
+}
+
+// A connected calendar is a private ICS feed URL (Google "secret address", Outlook
+// published calendar, webcal:// links, ...). Plannie only ever reads start and end
+// times from it to mark busy slots; titles, locations and attendees are discarded
+// while parsing and never stored or returned. Event UIDs are kept so a recurring series
+// can be followed (see calendar syncs).
+const (
+	calendarFeedTimeout  = 8 * time.Second
+	calendarFeedMaxBytes = 4 << 20
+	calendarCacheTTL     = 10 * time.Minute
+	maxCalendarURLLen    = 1000
+	maxRecurrenceSteps   = 20000
+)
+
+var (
+	calendarCacheMu sync.Mutex
+	calendarCache   = map[string]calendarCacheEntry{}
+)
+
+type calendarCacheEntry struct {
+	busy    []busyEntry
+	fetched time.Time
+}
+
+// calendarClient refuses to dial loopback, private and link-local addresses: feed
+// URLs are user-supplied and must not reach into the deployment's own network.
+var calendarClient = &http.Client{
+	Timeout: calendarFeedTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				ip := net.ParseIP(host)
+				if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() || ip.IsMulticast() {
+					return fmt.Errorf("calendar feed: address %s not allowed", host)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: calendarFeedTimeout,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 3 {
+			return errors.New("calendar feed: too many redirects")
+		}
+		return nil
+	},
+}
+
+// busyEntry is one busy block from a feed. Floating times (no zone, and all-day dates)
+// are kept as wall-clock values in UTC and pinned to the event's timezone when used;
+// recurrences expand in the zone DTSTART was given in.
+type busyEntry struct {
+	start, end time.Time
+	floating   bool
+	rule       *recurrenceRule
+	uid        string
+}
+
+type recurrenceRule struct {
+	freq     string
+	interval int
+	count    int
+	until    time.Time
+	byDay    []time.Weekday
+}
+
+// normalizeCalendarURL accepts http(s) and webcal links and returns the URL to fetch.
+func normalizeCalendarURL(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" || len(raw) > maxCalendarURLLen {
+		return "", errors.New("url is required and must be at most 1000 characters")
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return "", errors.New("url must be absolute")
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "webcal", "webcals":
+		u.Scheme = "https"
+	case "http", "https":
+	default:
+		return "", errors.New("url must use http, https or webcal")
+	}
+	if u.User != nil {
+		return "", errors.New("url must not contain credentials")
+	}
+	return u.String(), nil
+}
+
+// calendarBusy returns the parsed busy entries of a feed, cached per URL.
+func calendarBusy(ctx context.Context, feedURL string) ([]busyEntry, error) {
+	calendarCacheMu.Lock()
+	entry, ok := calendarCache[feedURL]
+	calendarCacheMu.Unlock()
+	if ok && time.Since(entry.fetched) < calendarCacheTTL {
+		return entry.busy, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", feedURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/calendar")
+	resp, err := calendarClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("calendar feed: status %d", resp.StatusCode)
+	}
+	busy, err := parseICSBusy(io.LimitReader(resp.Body, calendarFeedMaxBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	calendarCacheMu.Lock()
+	for k, e := range calendarCache {
+		if time.Since(e.fetched) >= calendarCacheTTL {
+			delete(calendarCache, k)
+		}
+	}
+	calendarCache[feedURL] = calendarCacheEntry{busy: busy, fetched: time.Now()}
+	calendarCacheMu.Unlock()
+	return busy, nil
+}
+
+// parseICSBusy extracts opaque, non-cancelled VEVENTs and VFREEBUSY periods.
+func parseICSBusy(r io.Reader) ([]busyEntry, error) {
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	text := strings.ReplaceAll(string(raw), "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\n ", "")
+	text = strings.ReplaceAll(text, "\n\t", "")
+	if !strings.Contains(text, "BEGIN:VCALENDAR") {
+		return nil, errors.New("not an iCalendar feed")
+	}
+
+	var out []busyEntry
+	var inEvent bool
+	var start, end icsTime
+	var dur time.Duration
+	var skip bool
+	var rule *recurrenceRule
+	var uid string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, "\r")
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		prop, params, _ := strings.Cut(name, ";")
+		switch strings.ToUpper(prop) {
+		case "BEGIN":
+			if strings.EqualFold(value, "VEVENT") {
+				inEvent, skip, rule, uid = true, false, nil, ""
+				start, end, dur = icsTime{}, icsTime{}, 0
+			}
+		case "END":
+			if !strings.EqualFold(value, "VEVENT") || !inEvent {
+				continue
+			}
+			inEvent = false
+			if skip || start.t.IsZero() {
+				continue
+			}
+			e := busyEntry{start: start.t, floating: start.floating, rule: rule, uid: uid}
+			switch {
+			case !end.t.IsZero():
+				e.end = end.t
+			case dur > 0:
+				e.end = start.t.Add(dur)
+			case start.date:
+				e.end = start.t.AddDate(0, 0, 1)
+			}
+			if e.end.After(e.start) {
+				out = append(out, e)
+			}
+		case "UID":
+			if inEvent {
+				uid = strings.TrimSpace(value)
+			}
+		case "DTSTART":
+			if inEvent {
+				start = parseICSTime(params, value)
+			}
+		case "DTEND":
+			if inEvent {
+				end = parseICSTime(params, value)
+			}
+		case "DURATION":
+			if inEvent {
+				dur = parseICSDuration(value)
+			}
+		case "TRANSP":
+			if inEvent && strings.EqualFold(value, "TRANSPARENT") {
+				skip = true
+			}
+		case "STATUS":
+			if inEvent && strings.EqualFold(value, "CANCELLED") {
+				skip = true
+			}
+		case "RRULE":
+			if inEvent {
+				rule = parseRRule(value)
+			}
+		case "FREEBUSY":
+			if strings.Contains(strings.ToUpper(params), "FBTYPE=FREE") {
+				continue
+			}
+			for _, period := range strings.Split(value, ",") {
+				a, b, ok := strings.Cut(period, "/")
+				if !ok {
+					continue
+				}
+				s := parseICSTime("", a)
+				if s.t.IsZero() {
+					continue
+				}
+				e := busyEntry{start: s.t, floating: s.floating}
+				if strings.HasPrefix(b, "P") {
+					e.end = s.t.Add(parseICSDuration(b))
+				} else {
+					e.end = parseICSTime("", b).t
+				}
+				if e.end.After(e.start) {
+					out = append(out, e)
+				}
+			}
+		}
+	}
+	return out, nil
+}
+
+type icsTime struct {
+	t        time.Time
+	floating bool
+	date     bool
+}
+
+func parseICSTime(params, value string) icsTime {
+	value = strings.TrimSpace(value)
+	loc := time.UTC
+	floating := true
+	for _, p := range strings.Split(params, ";") {
+		if k, v, ok := strings.Cut(p, "="); ok && strings.EqualFold(k, "TZID") {
+			if l, err := time.LoadLocation(strings.Trim(v, `"`)); err == nil {
+				loc, floating = l, false
+			}
+		}
+	}
+	if len(value) == 8 {
+		if t, err := time.Parse("20060102", value); err == nil {
+			return icsTime{t: t, floating: true, date: true}
+		}
+		return icsTime{}
+	}
+	if strings.HasSuffix(value, "Z") {
+		if t, err := time.Parse("20060102T150405Z", value); err == nil {
+			return icsTime{t: t}
+		}
+		return icsTime{}
+	}
+	t, err := time.ParseInLocation("20060102T150405", value, loc)
+	if err != nil {
+		return icsTime{}
+	}
+	return icsTime{t: t, floating: floating}
+}
+
+// parseICSDuration handles the RFC 5545 subset feeds use: PnW, PnDTnHnMnS.
+func parseICSDuration(v string) time.Duration {
+	v = strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(v), "+"), "P")
+	var d time.Duration
+	inTime := false
+	num := 0
+	for _, r := range v {
+		switch {
+		case r >= '0' && r <= '9':
+			num = num*10 + int(r-'0')
+		case r == 'T':
+			inTime = true
+		case r == 'W':
+			d += time.Duration(num) * 7 * 24 * time.Hour
+			num = 0
+		case r == 'D':
+			d += time.Duration(num) * 24 * time.Hour
+			num = 0
+		case r == 'H' && inTime:
+			d += time.Duration(num) * time.Hour
+			num = 0
+		case r == 'M' && inTime:
+			d += time.Duration(num) * time.Minute
+			num = 0
+		case r == 'S' && inTime:
+			d += time.Duration(num) * time.Second
+			num = 0
+		default:
+			return 0
+		}
+	}
+	return d
+}
+
+var icsWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+// parseRRule understands FREQ, INTERVAL, COUNT, UNTIL and plain BYDAY; anything else
+// (BYSETPOS, ordinal BYDAY, ...) falls back to the first occurrence only.
+func parseRRule(v string) *recurrenceRule {
+	r := &recurrenceRule{interval: 1}
+	for _, part := range strings.Split(v, ";") {
+		k, val, _ := strings.Cut(part, "=")
+		switch strings.ToUpper(k) {
+		case "FREQ":
+			r.freq = strings.ToUpper(val)
+		case "INTERVAL":
+			if n, err := strconv.Atoi(val); err == nil && n > 0 {
+				r.interval = n
+			}
+		case "COUNT":
+			if n, err := strconv.Atoi(val); err == nil && n > 0 {
+				r.count = n
+			}
+		case "UNTIL":
+			r.until = parseICSTime("", val).t
+		case "BYDAY":
+			for _, d := range strings.Split(val, ",") {
+				wd, ok := icsWeekdays[strings.ToUpper(d)]
+				if !ok {
+					return nil
+				}
+				r.byDay = append(r.byDay, wd)
+			}
+		case "WKST":
+		default:
+			return nil
+		}
+	}
+	switch r.freq {
+	case "DAILY", "WEEKLY", "MONTHLY", "YEARLY":
+		return r
+	}
+	return nil
+}
+
+// occurrences calls fn for every instance of e that starts before windowEnd.
+func (e busyEntry) occurrences(loc *time.Location, windowEnd time.Time, fn func(start, end time.Time)) {
+	start, end := e.start, e.end
+	if e.floating {
+		start = time.Date(start.Year(), start.Month(), start.Day(), start.Hour(), start.Minute(), start.Second(), 0, loc)
+		end = time.Date(end.Year(), end.Month(), end.Day(), end.Hour(), end.Minute(), end.Second(), 0, loc)
+	}
+	length := end.Sub(start)
+	r := e.rule
+	if r == nil {
+		fn(start, end)
+		return
+	}
+	emitted := 0
+	emit := func(s time.Time) bool {
+		if s.After(windowEnd) || (!r.until.IsZero() && s.After(r.until)) || (r.count > 0 && emitted >= r.count) {
+			return false
+		}
+		emitted++
+		fn(s, s.Add(length))
+		return true
+	}
+	if r.freq == "WEEKLY" && len(r.byDay) > 0 {
+		// count whole calendar weeks from the week of DTSTART; DST makes Sub unreliable
+		offset := int(start.Weekday())
+		for i := 0; i < maxRecurrenceSteps; i++ {
+			day := start.AddDate(0, 0, i)
+			if (i+offset)/7%r.interval != 0 {
+				continue
+			}
+			for _, wd := range r.byDay {
+				if day.Weekday() == wd {
+					if !emit(day) {
+						return
+					}
+				}
+			}
+		}
+		return
+	}
+	for i := 0; i < maxRecurrenceSteps; i++ {
+		var s time.Time
+		switch r.freq {
+		case "DAILY":
+			s = start.AddDate(0, 0, i*r.interval)
+		case "WEEKLY":
+			s = start.AddDate(0, 0, 7*i*r.interval)
+		case "MONTHLY":
+			s = start.AddDate(0, i*r.interval, 0)
+			if s.Day() != start.Day() {
+				continue
+			}
+		case "YEARLY":
+			s = start.AddDate(i*r.interval, 0, 0)
+			if s.Day() != start.Day() {
+				continue
+			}
+		}
+		if !emit(s) {
+			return
+		}
+	}
+}
+
+func loadCalendarURL(ctx context.Context, userID string) (string, error) {
+	var feedURL string
+	err := db.QueryRowContext(ctx, `SELECT calendar_url FROM user_preferences WHERE user_id = ?`, userID).Scan(&feedURL)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return feedURL, err
+}
+
+// calendarConflicts marks the event's slots that overlap the user's connected calendar.
+// It returns nil when no calendar is connected or the feed can't be read, so the event
+// still loads without the overlay.
+func calendarConflicts(ctx context.Context, userID string, ev Event) map[string]bool {
+	feedURL, err := loadCalendarURL(ctx, userID)
+	if err != nil {
+		logIfTimeout(err, "calendarConflicts: select")
+		return nil
+	}
+	if feedURL == "" {
+		return nil
+	}
+	busy, err := calendarBusy(ctx, feedURL)
+	if err != nil {
+		log.Printf("calendar feed for %s: %v", userID, err)
+		return nil
+	}
+	grid := eventSlotGrid(ev)
+	conflicts := map[string]bool{}
+	if len(grid) == 0 {
+		return conflicts
+	}
+	loc := eventLocation(ev.Timezone)
+	step := slotStep(ev.Duration)
+	windowStart, windowEnd := grid[0], grid[len(grid)-1].Add(step)
+	for _, b := range busy {
+		b.occurrences(loc, windowEnd, func(s, e time.Time) {
+			if !e.After(windowStart) {
+				return
+			}
+			// grid is sorted: find the first slot ending after s
+			i := sort.Search(len(grid), func(i int) bool { return grid[i].Add(step).After(s) })
+			for ; i < len(grid) && grid[i].Before(e); i++ {
+				conflicts[formatSlotKey(grid[i])] = true
+			}
+		})
+	}
+	return conflicts
+}
+
+func getCalendarHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	feedURL, err := loadCalendarURL(ctx, ctxUserID(c))
+	if err != nil {
+		serverError(c, "getCalendar: select", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"connected": feedURL != "", "url": feedURL})
+}
+
+// connectCalendarHandler stores an ICS feed after checking that it can be fetched and parsed.
+func connectCalendarHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	var input struct {
+		URL string `json:"url"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+	feedURL, err := normalizeCalendarURL(input.URL)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid calendar: " + err.Error()})
+		return
+	}
+	busy, err := calendarBusy(ctx, feedURL)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Calendar feed could not be loaded", "code": "calendar_unreachable"})
+		return
+	}
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO user_preferences(user_id, calendar_url, updated_at) VALUES (?,?,?)
+		ON CONFLICT(user_id) DO UPDATE SET calendar_url = excluded.calendar_url, updated_at = excluded.updated_at
+	`, ctxUserID(c), feedURL, time.Now().UTC()); err != nil {
+		serverError(c, "connectCalendar: upsert", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"connected": true, "url": feedURL, "entries": len(busy)})
+}
+
+func disconnectCalendarHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	if _, err := db.ExecContext(ctx, `UPDATE user_preferences SET calendar_url = '', updated_at = ? WHERE user_id = ?`, time.Now().UTC(), ctxUserID(c)); err != nil {
+		serverError(c, "disconnectCalendar: update", err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// Calendar syncs follow a recurring series from the user's connected calendar (a sprint
+// planning, a weekly sync) and open a Plannie poll for each upcoming occurrence: leadDays
+// before it, calendarSyncLoop creates an event spanning spreadDays on either side of the
+// occurrence, in the same event_series, with the previous poll's participants carried
+// over. Series are picked by UID from GET /users/me/calendar/series, which describes them
+// by pattern and time only since titles are never read.
+const (
+	maxCalendarSyncs        = 10
+	calendarSyncInterval    = time.Hour
+	calendarSeriesHorizon   = 400 * 24 * time.Hour
+	defaultCalendarLeadDays = 7
+	maxCalendarLeadDays     = 30
+	defaultCalendarSpread   = 2
+	maxCalendarSpread       = 7
+)
+
+type calendarSync struct {
+	ID             string     `json:"id"`
+	SeriesUID      string     `json:"seriesUid"`
+	SeriesID       string     `json:"seriesId"`
+	Name           string     `json:"name"`
+	Timezone       string     `json:"timezone"`
+	LeadDays       int        `json:"leadDays"`
+	SpreadDays     int        `json:"spreadDays"`
+	LastOccurrence *time.Time `json:"lastOccurrence,omitempty"`
+	LastEventID    string     `json:"lastEventId,omitempty"`
+	LastError      string     `json:"lastError,omitempty"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	userID         string
+	tenantID       string
+}
+
+// calendarSeriesEntry finds the recurring master of uid in a feed.
+func calendarSeriesEntry(busy []busyEntry, uid string) (busyEntry, bool) {
+	for _, b := range busy {
+		if b.uid == uid && b.rule != nil {
+			return b, true
+		}
+	}
+	return busyEntry{}, false
+}
+
+// nextSeriesOccurrence returns the first instance of b starting after after and no later
+// than until.
+func nextSeriesOccurrence(b busyEntry, loc *time.Location, after, until time.Time) (start, end time.Time, ok bool) {
+	b.occurrences(loc, until, func(s, e time.Time) {
+		if !ok && s.After(after) {
+			start, end, ok = s, e, true
+		}
+	})
+	return start, end, ok
+}
+
+// calendarSeriesHandler lists the recurring series in the caller's connected calendar
+// with their next occurrence in ?timezone= (default UTC).
+func calendarSeriesHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	loc, err := time.LoadLocation(c.DefaultQuery("timezone", "UTC"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid timezone"})
+		return
+	}
+	feedURL, err := loadCalendarURL(ctx, ctxUserID(c))
+	if err != nil {
+		serverError(c, "calendarSeries: select", err)
+		return
+	}
+	if feedURL == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Connect a calendar first", "code": "calendar_not_connected"})
+		return
+	}
+	busy, err := calendarBusy(ctx, feedURL)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Calendar feed could not be loaded", "code": "calendar_unreachable"})
+		return
+	}
+	now := time.Now()
+	seen := map[string]bool{}
+	out := []gin.H{}
+	for _, b := range busy {
+		if b.rule == nil || b.uid == "" || seen[b.uid] {
+			continue
+		}
+		seen[b.uid] = true
+		start, end, ok := nextSeriesOccurrence(b, loc, now, now.Add(calendarSeriesHorizon))
+		if !ok {
+			continue
+		}
+		days := []string{}
+		for _, wd := range b.rule.byDay {
+			days = append(days, weekdayKeys[wd])
+		}
+		out = append(out, gin.H{
+			"uid":             b.uid,
+			"frequency":       strings.ToLower(b.rule.freq),
+			"interval":        b.rule.interval,
+			"weekdays":        days,
+			"nextStart":       start.In(loc),
+			"durationMinutes": int(end.Sub(start).Minutes()),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i]["nextStart"].(time.Time).Before(out[j]["nextStart"].(time.Time)) })
+	c.JSON(http.StatusOK, gin.H{"series": out})
+}
+
+// createCalendarSyncHandler starts following a series: {"seriesUid", "name", "timezone",
+// "leadDays", "spreadDays"}. If the next occurrence is already within leadDays, its poll
+// is created right away.
+func createCalendarSyncHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	var input struct {
+		SeriesUID  string `json:"seriesUid"`
+		Name       string `json:"name"`
+		Timezone   string `json:"timezone"`
+		LeadDays   *int   `json:"leadDays"`
+		SpreadDays *int   `json:"spreadDays"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+	input.Name = strings.TrimSpace(input.Name)
+	if input.SeriesUID == "" || input.Name == "" || utf8.RuneCountInString(input.Name) > 200 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "seriesUid and name (at most 200 characters) are required"})
+		return
+	}
+	if input.Timezone == "" {
+		input.Timezone = "UTC"
+	}
+	if _, err := time.LoadLocation(input.Timezone); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid timezone"})
+		return
+	}
+	lead, spread := defaultCalendarLeadDays, defaultCalendarSpread
+	if input.LeadDays != nil {
+		lead = *input.LeadDays
+	}
+	if input.SpreadDays != nil {
+		spread = *input.SpreadDays
+	}
+	if lead < 1 || lead > maxCalendarLeadDays || spread < 0 || spread > maxCalendarSpread {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("leadDays must be 1-%d and spreadDays 0-%d", maxCalendarLeadDays, maxCalendarSpread)})
+		return
+	}
+
+	userID := ctxUserID(c)
+	feedURL, err := loadCalendarURL(ctx, userID)
+	if err != nil {
+		serverError(c, "createCalendarSync: select calendar", err)
+		return
+	}
+	if feedURL == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Connect a calendar first", "code": "calendar_not_connected"})
+		return
+	}
+	busy, err := calendarBusy(ctx, feedURL)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Calendar feed could not be loaded", "code": "calendar_unreachable"})
+		return
+	}
+	entry, ok := calendarSeriesEntry(busy, input.SeriesUID)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No recurring series with that UID in your calendar"})
+		return
+	}
+	var n int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM calendar_syncs WHERE user_id = ?`, userID).Scan(&n); err != nil {
+		serverError(c, "createCalendarSync: count", err)
+		return
+	}
+	if n >= maxCalendarSyncs {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("At most %d calendar syncs", maxCalendarSyncs)})
+		return
+	}
+
+	intervalDays := 7 * entry.rule.interval
+	switch entry.rule.freq {
+	case "DAILY":
+		intervalDays = entry.rule.interval
+	case "MONTHLY":
+		intervalDays = 30 * entry.rule.interval
+	case "YEARLY":
+		intervalDays = 365 * entry.rule.interval
+	}
+	now := time.Now().UTC()
+	s := &calendarSync{
+		ID:         uuid.NewString(),
+		SeriesUID:  input.SeriesUID,
+		SeriesID:   uuid.NewString(),
+		Name:       input.Name,
+		Timezone:   input.Timezone,
+		LeadDays:   lead,
+		SpreadDays: spread,
+		CreatedAt:  now,
+		userID:     userID,
+		tenantID:   requestTenant(c),
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		serverError(c, "createCalendarSync: begin", err)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO event_series(id, creator_id, name, interval_days, created_at, updated_at) VALUES (?,?,?,?,?,?)
+	`, s.SeriesID, userID, s.Name, min(intervalDays, 366), now, now); err != nil {
+		serverError(c, "createCalendarSync: insert series", err)
+		return
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO calendar_syncs(id, user_id, series_uid, series_id, name, timezone, lead_days, spread_days, tenant_id, created_at, updated_at)
+		VALUES (?,?,?,?,?,?,?,?,?,?,?)
+	`, s.ID, userID, s.SeriesUID, s.SeriesID, s.Name, s.Timezone, lead, spread, s.tenantID, now, now); err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			c.JSON(http.StatusConflict, gin.H{"error": "This series is already synced"})
+			return
+		}
+		serverError(c, "createCalendarSync: insert", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		serverError(c, "createCalendarSync: commit", err)
+		return
+	}
+	metricInc("plannie_calendar_syncs_created_total")
+	if err := runCalendarSync(ctx, s, entry, now); err != nil {
+		log.Printf("calendar sync %s: %v", s.ID, err)
+		s.LastError = "The first poll could not be created; it will be retried"
+	}
+	c.JSON(http.StatusCreated, s)
+}
+
+func listCalendarSyncsHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	syncs, err := loadCalendarSyncs(ctx, `WHERE user_id = ? ORDER BY created_at`, ctxUserID(c))
+	if err != nil {
+		serverError(c, "listCalendarSyncs: select", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"syncs": syncs})
+}
+
+// deleteCalendarSyncHandler stops a sync. Polls it already created stay.
+func deleteCalendarSyncHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	res, err := db.ExecContext(ctx, `DELETE FROM calendar_syncs WHERE id = ? AND user_id = ?`, c.Param("syncId"), ctxUserID(c))
+	if err != nil {
+		serverError(c, "deleteCalendarSync: delete", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Sync not found"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func loadCalendarSyncs(ctx context.Context, where string, args ...interface{}) ([]*calendarSync, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, user_id, series_uid, series_id, name, timezone, lead_days, spread_days, tenant_id, last_occurrence, last_event_id, last_error, created_at
+		FROM calendar_syncs `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := []*calendarSync{}
+	for rows.Next() {
+		s := &calendarSync{}
+		var last sql.NullTime
+		if err := rows.Scan(&s.ID, &s.userID, &s.SeriesUID, &s.SeriesID, &s.Name, &s.Timezone, &s.LeadDays, &s.SpreadDays, &s.tenantID,
+			&last, &s.LastEventID, &s.LastError, &s.CreatedAt); err != nil {
+			return nil, err
+		}
+		if last.Valid {
+			s.LastOccurrence = &last.Time
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+func calendarSyncLoop(ctx context.Context) error {
+	return runEvery(ctx, calendarSyncInterval, func(ctx context.Context) { runCalendarSyncs(ctx, time.Now().UTC()) })
+}
+
+// runCalendarSyncs checks every sync against its owner's feed. Problems are recorded on
+// the sync (lastError) so the owner can see why no poll appeared.
+func runCalendarSyncs(ctx context.Context, now time.Time) {
+	syncs, err := loadCalendarSyncs(ctx, `ORDER BY user_id`)
+	if err != nil {
+		logIfTimeout(err, "calendarSync: select")
+		return
+	}
+	for _, s := range syncs {
+		problem := ""
+		feedURL, err := loadCalendarURL(ctx, s.userID)
+		switch {
+		case err != nil:
+			logIfTimeout(err, "calendarSync: select calendar")
+			continue
+		case feedURL == "":
+			problem = "No calendar is connected"
+		default:
+			busy, err := calendarBusy(ctx, feedURL)
+			if err != nil {
+				problem = "The calendar feed could not be loaded"
+				break
+			}
+			entry, ok := calendarSeriesEntry(busy, s.SeriesUID)
+			if !ok {
+				problem = "The series is no longer in the calendar"
+				break
+			}
+			if err := runCalendarSync(ctx, s, entry, now); errors.Is(err, errCalendarSyncAccountTooNew) {
+				problem = "New accounts are limited for a while, so the poll was not created yet"
+			} else if errors.Is(err, errCalendarSyncTenantQuota) {
+				problem = "Your organization has reached its events limit, so the poll was not created"
+			} else if err != nil {
+				log.Printf("calendar sync %s: %v", s.ID, err)
+				problem = "The poll could not be created"
+			}
+		}
+		if problem != "" && problem != s.LastError {
+			if _, err := db.ExecContext(ctx, `UPDATE calendar_syncs SET last_error = ?, updated_at = ? WHERE id = ?`, problem, now, s.ID); err != nil {
+				logIfTimeout(err, "calendarSync: record error")
+			}
+		}
+	}
+}
+
+// errCalendarSyncAccountTooNew stops a sync whose owner is still within the new-account
+// event allowance, and errCalendarSyncTenantQuota one whose tenant is at its max_events.
+// The occurrence is retried on the next run.
+var (
+	errCalendarSyncAccountTooNew = errors.New("new account event limit reached")
+	errCalendarSyncTenantQuota   = errors.New("tenant event limit reached")
+)
+
+// runCalendarSync creates the poll for the next occurrence of entry once it is within the
+// lead time and has no poll yet. Like createEventHandler it honours the new-account limit
+// and the tenant's event quota.
+func runCalendarSync(ctx context.Context, s *calendarSync, entry busyEntry, now time.Time) error {
+	loc := eventLocation(s.Timezone)
+	after := now
+	if s.LastOccurrence != nil && s.LastOccurrence.After(after) {
+		after = *s.LastOccurrence
+	}
+	start, end, ok := nextSeriesOccurrence(entry, loc, after, now.Add(time.Duration(s.LeadDays)*24*time.Hour))
+	if !ok {
+		return nil
+	}
+	local := start.In(loc)
+	day := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, time.UTC)
+	today := now.In(loc)
+	first := time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, time.UTC)
+	from := day.AddDate(0, 0, -s.SpreadDays)
+	if from.Before(first) {
+		from = first
+	}
+	to := day.AddDate(0, 0, s.SpreadDays)
+	duration := max(30, int(end.Sub(start).Minutes()))
+	limited, err := newAccountLimitExceeded(ctx, s.userID, "events")
+	if err != nil {
+		return err
+	}
+	if limited {
+		return errCalendarSyncAccountTooNew
+	}
+	if _, exceeded, err := tenantQuotaExceeded(ctx, s.tenantID, "events"); err != nil {
+		return err
+	} else if exceeded {
+		return errCalendarSyncTenantQuota
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	eventID := uuid.NewString()
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO events(id, creator_id, name, date_from, date_to, duration, timezone, disabled_slots, series_id, tenant_id, created_at, updated_at)
+		VALUES (?,?,?,?,?,?,?,'[]',?,?,?,?)
+	`, eventID, s.userID, s.Name, from.Format("2006-01-02"), to.Format("2006-01-02"), duration, s.Timezone, s.SeriesID, s.tenantID, now, now); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO event_participants(id, event_id, user_id, availability, draft_availability, draft_disabled_slots, draft_updated_at, role, created_at, updated_at)
+		VALUES (?,?,?,seal('{}'),'{}','[]',NULL,?,?,?)
+	`, uuid.NewString(), eventID, s.userID, roleOwner, now, now); err != nil {
+		return err
+	}
+	prow, err := tx.QueryContext(ctx, `
+		SELECT user_id, role FROM event_participants WHERE event_id = ? AND user_id IS NOT NULL AND user_id <> ?
+	`, s.LastEventID, s.userID)
+	if err != nil {
+		return err
+	}
+	previous := map[string]string{}
+	for prow.Next() {
+		var pid, role string
+		if err := prow.Scan(&pid, &role); err == nil {
+			if role != roleOrganizer {
+				role = roleParticipant
+			}
+			previous[pid] = role
+		}
+	}
+	prow.Close()
+	for pid, role := range previous {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT OR IGNORE INTO event_participants(id, event_id, user_id, availability, draft_availability, draft_disabled_slots, draft_updated_at, role, created_at, updated_at)
+			VALUES (?,?,?,seal('{}'),'{}','[]',NULL,?,?,?)
+		`, uuid.NewString(), eventID, pid, role, now, now); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE calendar_syncs SET last_occurrence = ?, last_event_id = ?, last_error = '', updated_at = ? WHERE id = ?
+	`, start.UTC(), eventID, now, s.ID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE event_series SET updated_at = ? WHERE id = ?`, now, s.SeriesID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	occurrence := start.UTC()
+	s.LastOccurrence, s.LastEventID, s.LastError = &occurrence, eventID, ""
+	statInc("events_created")
+	metricInc("plannie_calendar_sync_polls_total")
+	return nil
+}
+
+// CalDAV exposes each user's finalized events as one read-only calendar collection so
+// desktop and mobile calendar apps can subscribe with authentication. Apps sign in with
+// HTTP Basic using the Plannie username and a CalDAV app password (never the account
+// password, which may sit behind a second factor). Layout:
+//
+//	/caldav/                      root, points at the principal
+//	/caldav/<userId>/             principal and calendar home
+//	/caldav/<userId>/events/      the calendar
+//	/caldav/<userId>/events/<eventId>.ics
+const (
+	caldavTokenPrefix    = "caldav_"
+	maxCalDAVTokensUser  = 10
+	caldavCollectionName = "events"
+)
+
+// caldavBase is the path prefix in front of /caldav, so hrefs survive tenant path routing.
+func caldavBase(c *gin.Context) string {
+	uri := c.Request.RequestURI
+	if i := strings.Index(uri, "/.well-known/"); i >= 0 {
+		return uri[:i]
+	}
+	if i := strings.Index(uri, "/caldav/"); i >= 0 {
+		return uri[:i]
+	}
+	return ""
+}
+
+func caldavWellKnownHandler(c *gin.Context) {
+	c.Redirect(http.StatusMovedPermanently, caldavBase(c)+"/caldav/")
+}
+
+// caldavAuthMiddleware checks Basic credentials against active CalDAV app passwords.
+// OPTIONS stays anonymous: clients probe capabilities before sending credentials.
+func caldavAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodOptions {
+			c.Next()
+			return
+		}
+		username, tok, ok := c.Request.BasicAuth()
+		if !ok || !strings.HasPrefix(tok, caldavTokenPrefix) {
+			caldavUnauthorized(c)
+			return
+		}
+		ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+		defer cancel()
+		var tokenID, userID, owner string
+		err := db.QueryRowContext(ctx, `
+			SELECT t.id, u.id, u.username FROM caldav_tokens t JOIN users u ON u.id = t.user_id
+			WHERE t.token_hash = ? AND t.revoked_at IS NULL AND u.tenant_id = ?
+				AND u.merged_into IS NULL AND u.deactivated_at IS NULL
+		`, hashOpaqueToken(tok), requestTenant(c)).Scan(&tokenID, &userID, &owner)
+		if err == sql.ErrNoRows || (err == nil && !strings.EqualFold(owner, username)) {
+			caldavUnauthorized(c)
+			return
+		} else if err != nil {
+			logIfTimeout(err, "caldavAuth: select token")
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		if _, err := db.ExecContext(ctx, `UPDATE caldav_tokens SET last_used_at = ? WHERE id = ?`, time.Now().UTC(), tokenID); err != nil {
+			logIfTimeout(err, "caldavAuth: touch token")
+		}
+		c.Set("userID", userID)
+		c.Set("username", owner)
+		c.Next()
+	}
+}
+
+func caldavUnauthorized(c *gin.Context) {
+	c.Header("WWW-Authenticate", `Basic realm="Plannie CalDAV", charset="UTF-8"`)
+	c.AbortWithStatus(http.StatusUnauthorized)
+}
+
+// caldavItem is one finalized event as served to calendar clients.
+type caldavItem struct {
+	ID   string
+	ICS  string
+	ETag string
+}
+
+func caldavItems(ctx context.Context, userID string) ([]caldavItem, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT e.id, e.name, e.finalized_slot, e.duration, e.ics_sequence, e.finalized_at, e.updated_at
+		FROM events e
+		WHERE e.finalized_slot IS NOT NULL
+			AND (e.creator_id = ? OR EXISTS (SELECT 1 FROM event_participants ep WHERE ep.event_id = e.id AND ep.user_id = ?))
+		ORDER BY e.finalized_slot
+	`, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []caldavItem
+	for rows.Next() {
+		var id, name, slot string
+		var duration float64
+		var sequence int
+		var finalizedAt sql.NullTime
+		var stamp time.Time
+		if err := rows.Scan(&id, &name, &slot, &duration, &sequence, &finalizedAt, &stamp); err != nil {
+			return nil, err
+		}
+		if finalizedAt.Valid {
+			stamp = finalizedAt.Time
+		}
+		start, err := parseSlotKey(slot)
+		if err != nil {
+			continue
+		}
+		out = append(out, newCalDAVItem(id, id, name, "CONFIRMED", start, time.Duration(duration)*time.Minute, sequence, stamp))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	holds, err := caldavHoldItems(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return append(out, holds...), nil
+}
+
+// caldavHoldItems lists the tentative holds on the organizer's shortlisted slots of events
+// that are still open. Finalizing deletes the losing holds and the winner is replaced by
+// the confirmed entry, so calendar clients drop them on their next sync.
+func caldavHoldItems(ctx context.Context, userID string) ([]caldavItem, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT e.id, e.name, e.duration, s.slot, s.created_at
+		FROM event_shortlist s JOIN events e ON e.id = s.event_id
+		WHERE s.hold = 1 AND e.creator_id = ? AND e.finalized_slot IS NULL
+		ORDER BY s.slot
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []caldavItem
+	for rows.Next() {
+		var id, name, slot string
+		var duration float64
+		var created time.Time
+		if err := rows.Scan(&id, &name, &duration, &slot, &created); err != nil {
+			return nil, err
+		}
+		start, err := parseSlotKey(slot)
+		if err != nil {
+			continue
+		}
+		resource := id + "-hold-" + start.UTC().Format(icsTimeLayout)
+		out = append(out, newCalDAVItem(id, resource, "HOLD: "+name, "TENTATIVE", start, time.Duration(duration)*time.Minute, 0, created))
+	}
+	return out, rows.Err()
+}
+
+// newCalDAVItem renders one VEVENT resource; its UID is the resource name.
+func newCalDAVItem(eventID, resource, summary, status string, start time.Time, d time.Duration, sequence int, stamp time.Time) caldavItem {
+	var b strings.Builder
+	icsFold(&b, "BEGIN:VCALENDAR")
+	icsFold(&b, "VERSION:2.0")
+	icsFold(&b, "PRODID:-//Plannie//CalDAV//EN")
+	icsFold(&b, "CALSCALE:GREGORIAN")
+	icsFold(&b, "BEGIN:VEVENT")
+	icsFold(&b, "UID:"+resource+"@plannie")
+	icsFold(&b, "SEQUENCE:"+strconv.Itoa(sequence))
+	icsFold(&b, "DTSTAMP:"+stamp.UTC().Format(icsTimeLayout))
+	icsFold(&b, "DTSTART:"+start.UTC().Format(icsTimeLayout))
+	icsFold(&b, "DTEND:"+start.Add(d).UTC().Format(icsTimeLayout))
+	icsFold(&b, "SUMMARY:"+icsEscape(summary))
+	icsFold(&b, "URL:"+appBaseURL()+"/event/"+eventID)
+	icsFold(&b, "STATUS:"+status)
+	icsFold(&b, "END:VEVENT")
+	icsFold(&b, "END:VCALENDAR")
+	ics := b.String()
+	return caldavItem{ID: resource, ICS: ics, ETag: `"` + hashOpaqueToken(ics)[:32] + `"`}
+}
+
+// caldavHandler serves the read-only collection: OPTIONS, PROPFIND, REPORT
+// (calendar-query and calendar-multiget) and GET of single resources.
+func caldavHandler(c *gin.Context) {
+	c.Header("DAV", "1, calendar-access")
+	c.Header("Allow", "OPTIONS, GET, HEAD, PROPFIND, REPORT")
+	if c.Request.Method == http.MethodOptions {
+		c.Status(http.StatusOK)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	userID := ctxUserID(c)
+	base := caldavBase(c) + "/caldav/"
+	principal := base + userID + "/"
+	collection := principal + caldavCollectionName + "/"
+
+	parts := strings.Split(strings.Trim(c.Param("path"), "/"), "/")
+	if parts[0] == "" {
+		parts = nil
+	}
+	if len(parts) > 0 && parts[0] != userID {
+		c.Status(http.StatusForbidden)
+		return
+	}
+	if len(parts) > 1 && parts[1] != caldavCollectionName || len(parts) > 3 {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	var resource string
+	if len(parts) == 3 {
+		var ok bool
+		if resource, ok = strings.CutSuffix(parts[2], ".ics"); !ok || resource == "" {
+			c.Status(http.StatusNotFound)
+			return
+		}
+	}
+
+	var items []caldavItem
+	if len(parts) >= 2 {
+		var err error
+		if items, err = caldavItems(ctx, userID); err != nil {
+			logIfTimeout(err, "caldav: items")
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+	}
+	if resource != "" {
+		var found *caldavItem
+		for i := range items {
+			if items[i].ID == resource {
+				found = &items[i]
+			}
+		}
+		if found == nil {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		items = []caldavItem{*found}
+	}
+
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead:
+		if resource == "" {
+			c.Status(http.StatusMethodNotAllowed)
+			return
+		}
+		c.Header("ETag", items[0].ETag)
+		if c.GetHeader("If-None-Match") == items[0].ETag {
+			c.Status(http.StatusNotModified)
+			return
+		}
+		c.Data(http.StatusOK, "text/calendar; charset=utf-8", []byte(items[0].ICS))
+		return
+	case "REPORT":
+		if len(parts) < 2 {
+			c.Status(http.StatusForbidden)
+			return
+		}
+		hrefs, multiget := caldavMultigetHrefs(io.LimitReader(c.Request.Body, 1<<20))
+		var b strings.Builder
+		b.WriteString(caldavMultistatusOpen)
+		if multiget {
+			byHref := map[string]caldavItem{}
+			for _, it := range items {
+				byHref[collection+it.ID+".ics"] = it
+			}
+			for _, h := range hrefs {
+				if it, ok := byHref[h]; ok {
+					caldavWriteItem(&b, collection, it, true)
+				} else {
+					b.WriteString("<D:response><D:href>" + xmlEscape(h) + "</D:href><D:status>HTTP/1.1 404 Not Found</D:status></D:response>")
+				}
+			}
+		} else {
+			for _, it := range items {
+				caldavWriteItem(&b, collection, it, true)
+			}
+		}
+		b.WriteString("</D:multistatus>")
+		c.Data(http.StatusMultiStatus, "application/xml; charset=utf-8", []byte(b.String()))
+		return
+	}
+
+	// PROPFIND: every known property is returned; clients ignore the ones they didn't ask for.
+	depth1 := c.GetHeader("Depth") != "0"
+	var b strings.Builder
+	b.WriteString(caldavMultistatusOpen)
+	switch len(parts) {
+	case 0:
+		caldavWriteProps(&b, base, `<D:resourcetype><D:collection/></D:resourcetype>`+
+			`<D:current-user-principal><D:href>`+xmlEscape(principal)+`</D:href></D:current-user-principal>`)
+	case 1:
+		caldavWriteProps(&b, principal, `<D:resourcetype><D:collection/><D:principal/></D:resourcetype>`+
+			`<D:displayname>`+xmlEscape(c.GetString("username"))+`</D:displayname>`+
+			`<D:current-user-principal><D:href>`+xmlEscape(principal)+`</D:href></D:current-user-principal>`+
+			`<D:principal-URL><D:href>`+xmlEscape(principal)+`</D:href></D:principal-URL>`+
+			`<C:calendar-home-set><D:href>`+xmlEscape(principal)+`</D:href></C:calendar-home-set>`)
+		if depth1 {
+			if items, err := caldavItems(ctx, userID); err == nil {
+				caldavWriteCollection(&b, collection, items)
+			} else {
+				logIfTimeout(err, "caldav: items")
+			}
+		}
+	case 2:
+		caldavWriteCollection(&b, collection, items)
+		if depth1 {
+			for _, it := range items {
+				caldavWriteItem(&b, collection, it, false)
+			}
+		}
+	case 3:
+		caldavWriteItem(&b, collection, items[0], false)
+	}
+	b.WriteString("</D:multistatus>")
+	c.Data(http.StatusMultiStatus, "application/xml; charset=utf-8", []byte(b.String()))
+}
+
+const caldavMultistatusOpen = `<?xml version="1.0" encoding="utf-8"?>` +
+	`<D:multistatus xmlns:D="DAV:" xmlns:C="urn:ietf:params:xml:ns:caldav" xmlns:CS="http://calendarserver.org/ns/">`
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func caldavWriteProps(b *strings.Builder, href, props string) {
+	b.WriteString("<D:response><D:href>" + xmlEscape(href) + "</D:href><D:propstat><D:prop>")
+	b.WriteString(props)
+	b.WriteString("</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat></D:response>")
+}
+
+// caldavWriteCollection describes the calendar. The ctag changes whenever any item does,
+// which is what clients poll to decide whether to re-sync.
+func caldavWriteCollection(b *strings.Builder, href string, items []caldavItem) {
+	etags := make([]string, len(items))
+	for i, it := range items {
+		etags[i] = it.ETag
+	}
+	ctag := hashOpaqueToken(strings.Join(etags, ","))[:32]
+	caldavWriteProps(b, href, `<D:resourcetype><D:collection/><C:calendar/></D:resourcetype>`+
+		`<D:displayname>Plannie</D:displayname>`+
+		`<C:supported-calendar-component-set><C:comp name="VEVENT"/></C:supported-calendar-component-set>`+
+		`<D:supported-report-set>`+
+		`<D:supported-report><D:report><C:calendar-query/></D:report></D:supported-report>`+
+		`<D:supported-report><D:report><C:calendar-multiget/></D:report></D:supported-report>`+
+		`</D:supported-report-set>`+
+		`<D:current-user-privilege-set><D:privilege><D:read/></D:privilege></D:current-user-privilege-set>`+
+		`<CS:getctag>`+ctag+`</CS:getctag>`)
+}
+
+func caldavWriteItem(b *strings.Builder, collection string, it caldavItem, withData bool) {
+	props := `<D:resourcetype/><D:getcontenttype>text/calendar; charset=utf-8; component=VEVENT</D:getcontenttype>` +
+		`<D:getetag>` + xmlEscape(it.ETag) + `</D:getetag>`
+	if withData {
+		props += `<C:calendar-data>` + xmlEscape(it.ICS) + `</C:calendar-data>`
+	}
+	caldavWriteProps(b, collection+it.ID+".ics", props)
+}
+
+// caldavMultigetHrefs reports whether a REPORT body is a calendar-multiget and, if so,
+// the hrefs it asks for. Anything else is answered as a calendar-query over all items.
+func caldavMultigetHrefs(r io.Reader) ([]string, bool) {
+	dec := xml.NewDecoder(r)
+	var hrefs []string
+	multiget, inHref := false, false
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return hrefs, multiget
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if t.Name.Local == "calendar-multiget" {
+				multiget = true
+			}
+			inHref = t.Name.Local == "href"
+		case xml.EndElement:
+			inHref = false
+		case xml.CharData:
+			if inHref {
+				if h, err := url.PathUnescape(strings.TrimSpace(string(t))); err == nil {
+					hrefs = append(hrefs, h)
+				}
+			}
+		}
+	}
+}
+
+func listCalDAVTokensHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, label, created_at, last_used_at, revoked_at FROM caldav_tokens
+		WHERE user_id = ? ORDER BY created_at DESC
+	`, ctxUserID(c))
+	if err != nil {
+		serverError(c, "listCalDAVTokens: query", err)
+		return
+	}
+	defer rows.Close()
+	out := []gin.H{}
+	for rows.Next() {
+		var id, label string
+		var created time.Time
+		var lastUsed, revoked sql.NullTime
+		if err := rows.Scan(&id, &label, &created, &lastUsed, &revoked); err != nil {
+			serverError(c, "listCalDAVTokens: scan", err)
+			return
+		}
+		t := gin.H{"id": id, "label": label, "createdAt": created}
+		if lastUsed.Valid {
+			t["lastUsedAt"] = lastUsed.Time
+		}
+		if revoked.Valid {
+			t["revokedAt"] = revoked.Time
+		}
+		out = append(out, t)
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// createCalDAVTokenHandler issues an app password; like kiosk tokens it is shown once.
+func createCalDAVTokenHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	userID := ctxUserID(c)
+	var input struct {
+		Label string `json:"label"`
+	}
+	_ = c.ShouldBindJSON(&input)
+	input.Label = strings.TrimSpace(input.Label)
+	if len(input.Label) > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Label too long"})
+		return
+	}
+	var active int
+	_ = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM caldav_tokens WHERE user_id = ? AND revoked_at IS NULL`, userID).Scan(&active)
+	if active >= maxCalDAVTokensUser {
+		c.JSON(http.StatusConflict, gin.H{"error": "Too many active CalDAV passwords"})
+		return
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		serverError(c, "createCalDAVToken: random", err)
+		return
+	}
+	tok := caldavTokenPrefix + base64.RawURLEncoding.EncodeToString(buf)
+	id := uuid.NewString()
+	now := time.Now().UTC()
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO caldav_tokens(id, user_id, label, token_hash, created_at) VALUES (?,?,?,?,?)
+	`, id, userID, input.Label, hashOpaqueToken(tok), now); err != nil {
+		serverError(c, "createCalDAVToken: insert", err)
+		return
+	}
+	var username string
+	_ = db.QueryRowContext(ctx, `SELECT username FROM users WHERE id = ?`, userID).Scan(&username)
+	c.JSON(http.StatusCreated, gin.H{
+		"id":        id,
+		"label":     input.Label,
+		"token":     tok,
+		"username":  username,
+		"url":       apiBaseURL() + "/caldav/" + userID + "/" + caldavCollectionName + "/",
+		"createdAt": now,
+	})
+}
+
+func revokeCalDAVTokenHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	res, err := db.ExecContext(ctx, `
+		UPDATE caldav_tokens SET revoked_at = ? WHERE id = ? AND user_id = ? AND revoked_at IS NULL
+	`, time.Now().UTC(), c.Param("tokenId"), ctxUserID(c))
+	if err != nil {
+		serverError(c, "revokeCalDAVToken: update", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Revoked"})
+}
+
+// Archival keeps availability_history (the per-event audit trail) small: once an event's
+// last day is ARCHIVE_AFTER_DAYS in the past (default 180, 0 disables), its history rows
+// move to availability_history_archive. That table lives in the main database unless
+// ARCHIVE_DATABASE_PATH names a separate SQLite file. Archived rows stay readable
+// through the same endpoints, just off the hot indexes.
+const (
+	archiveTableStmt = `CREATE TABLE IF NOT EXISTS availability_history_archive (
+			id TEXT PRIMARY KEY,
+			event_id TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			actor_id TEXT NOT NULL,
+			proxy INTEGER NOT NULL DEFAULT 0,
+			note TEXT NOT NULL DEFAULT '',
+			availability TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			archived_at TIMESTAMP NOT NULL
+		);`
+	archiveEventIndexStmt = `CREATE INDEX IF NOT EXISTS idx_history_archive_event ON availability_history_archive(event_id, created_at);`
+	archiveUserIndexStmt  = `CREATE INDEX IF NOT EXISTS idx_history_archive_user ON availability_history_archive(user_id, created_at);`
+
+	archiveBatchEvents = 50
+	archiveInterval    = time.Hour
+)
+
+var (
+	archiveAfter = 180 * 24 * time.Hour
+	archiveDB    *sql.DB // nil: the archive table lives in db
+)
+
+// archiveStore is the database holding availability_history_archive.
+func archiveStore() *sql.DB {
+	if archiveDB != nil {
+		return archiveDB
+	}
+	return db
+}
+
+func configureArchive(ctx context.Context) error {
+	archiveAfter = time.Duration(getEnvInt("ARCHIVE_AFTER_DAYS", 180)) * 24 * time.Hour
+	path := os.Getenv("ARCHIVE_DATABASE_PATH")
+	if path == "" {
+		return nil
+	}
+	d, err := openDB(path)
+	if err != nil {
+		return err
+	}
+	for _, s := range []string{archiveTableStmt, archiveEventIndexStmt, archiveUserIndexStmt} {
+		if _, err := d.ExecContext(ctx, s); err != nil {
+			d.Close()
+			return err
+		}
+	}
+	archiveDB = d
+	return nil
+}
+
+func archiveHistoryLoop(ctx context.Context) error {
+	return runEvery(ctx, archiveInterval, func(ctx context.Context) {
+		n, err := archiveHistory(ctx, time.Now())
+		if err != nil {
+			log.Printf("archive history error: %v", err)
+		} else if n > 0 {
+			log.Printf("archive history: moved %d rows", n)
+		}
+	})
+}
+
+// archiveHistory moves the history of events that ended before the cutoff, a batch of
+// events per call. Weekly polls have no end date and are never archived. Rows are copied first and deleted from the hot table after, so a
+// crash in between only leaves duplicates that the next run skips. Late edits to an
+// archived event land in the hot table again and are swept up on a later run.
+func archiveHistory(ctx context.Context, now time.Time) (int, error) {
+	cutoff := now.Add(-archiveAfter).UTC().Format("2006-01-02")
+	rows, err := db.QueryContext(ctx, `
+		SELECT e.id FROM events e
+		WHERE e.date_to <> '' AND e.date_to < ? AND EXISTS (SELECT 1 FROM availability_history h WHERE h.event_id = e.id)
+		LIMIT ?
+	`, cutoff, archiveBatchEvents)
+	if err != nil {
+		return 0, err
+	}
+	var eventIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		eventIDs = append(eventIDs, id)
+	}
+	rows.Close()
+
+	moved := 0
+	for _, eventID := range eventIDs {
+		n, err := archiveEventHistory(ctx, eventID, now.UTC())
+		if err != nil {
+			return moved, fmt.Errorf("event %s: %w", eventID, err)
+		}
+		moved += n
+	}
+	return moved, nil
+}
+
+func archiveEventHistory(ctx context.Context, eventID string, now time.Time) (int, error) {
+	type historyRow struct {
+		id, userID, actorID, note, avail string
+		proxy                            bool
+		at                               time.Time
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT id, user_id, actor_id, proxy, note, availability, created_at FROM availability_history WHERE event_id = ?
+	`, eventID)
+	if err != nil {
+		return 0, err
+	}
+	var batch []historyRow
+	for rows.Next() {
+		var r historyRow
+		if err := rows.Scan(&r.id, &r.userID, &r.actorID, &r.proxy, &r.note, &r.avail, &r.at); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		batch = append(batch, r)
+	}
+	rows.Close()
+	if len(batch) == 0 {
+		return 0, nil
+	}
+
+	atx, err := archiveStore().BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	for _, r := range batch {
+		if _, err := atx.ExecContext(ctx, `
+			INSERT OR IGNORE INTO availability_history_archive(id, event_id, user_id, actor_id, proxy, note, availability, created_at, archived_at)
+			VALUES (?,?,?,?,?,?,?,?,?)
+		`, r.id, eventID, r.userID, r.actorID, r.proxy, r.note, r.avail, r.at, now); err != nil {
+			atx.Rollback()
+			return 0, err
+		}
+	}
+	if err := atx.Commit(); err != nil {
+		return 0, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	for _, r := range batch {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM availability_history WHERE id = ?`, r.id); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE events SET archived_at = COALESCE(archived_at, ?) WHERE id = ?`, now, eventID); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return len(batch), tx.Commit()
+}
+
+// relinkArchivedHistory applies an account merge or guest claim to archived rows.
+// The archive may be another database, so this runs after the main transaction and
+// failures are only logged.
+func relinkArchivedHistory(ctx context.Context, query string, args ...interface{}) {
+	if _, err := archiveStore().ExecContext(ctx, query, args...); err != nil {
+		log.Printf("archive relink: %v", err)
+	}
+}
+
+// Event read cache: an in-process LRU of event snapshots for GET /events/:id, so popular
+// public events don't re-read every participant row per view. Every ssePublish (which
+// all event writes go through) drops the entry; the TTL bounds staleness from indirect
+// changes such as a participant renaming their account. EVENT_CACHE_SIZE=0 disables it.
+var (
+	eventCacheSize = 1000
+	eventCacheTTL  = 30 * time.Second
+
+	eventCacheMu    sync.Mutex
+	eventCacheLRU   = list.New()
+	eventCacheIndex = map[string]*list.Element{}
+	eventCacheGen   uint64 // bumped on every invalidation
+)
+
+type eventCacheEntry struct {
+	id      string
+	snap    *eventSnapshot
+	fetched time.Time
+}
+
+// cachedEventSnapshot serves a snapshot from the cache or loads and stores it. A load
+// that raced with an invalidation is returned but not stored.
+func cachedEventSnapshot(ctx context.Context, id string) (*eventSnapshot, error) {
+	if eventCacheSize <= 0 {
+		return loadEventSnapshot(ctx, id)
+	}
+	eventCacheMu.Lock()
+	if el, ok := eventCacheIndex[id]; ok {
+		entry := el.Value.(*eventCacheEntry)
+		if time.Since(entry.fetched) < eventCacheTTL {
+			eventCacheLRU.MoveToFront(el)
+			eventCacheMu.Unlock()
+			metricInc("plannie_event_cache_requests_total", "outcome", "hit")
+			return entry.snap, nil
+		}
+		eventCacheLRU.Remove(el)
+		delete(eventCacheIndex, id)
+	}
+	gen := eventCacheGen
+	eventCacheMu.Unlock()
+	metricInc("plannie_event_cache_requests_total", "outcome", "miss")
+
+	snap, err := loadEventSnapshot(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	eventCacheMu.Lock()
+	defer eventCacheMu.Unlock()
+	if gen != eventCacheGen {
+		return snap, nil
+	}
+	if el, ok := eventCacheIndex[id]; ok {
+		eventCacheLRU.Remove(el)
+	}
+	eventCacheIndex[id] = eventCacheLRU.PushFront(&eventCacheEntry{id: id, snap: snap, fetched: time.Now()})
+	for eventCacheLRU.Len() > eventCacheSize {
+		oldest := eventCacheLRU.Back()
+		eventCacheLRU.Remove(oldest)
+		delete(eventCacheIndex, oldest.Value.(*eventCacheEntry).id)
+		metricInc("plannie_event_cache_evictions_total")
+	}
+	return snap, nil
+}
+
+func eventCacheInvalidate(id string) {
+	eventCacheMu.Lock()
+	eventCacheGen++
+	if el, ok := eventCacheIndex[id]; ok {
+		eventCacheLRU.Remove(el)
+		delete(eventCacheIndex, id)
+	}
+	eventCacheMu.Unlock()
+}
+
+func eventCacheLen() float64 {
+	eventCacheMu.Lock()
+	defer eventCacheMu.Unlock()
+	return float64(eventCacheLRU.Len())
+}
+
+// Per-event availability aggregates: event_slot_counts holds how many participants
+// offered each slot, so heatmaps and suggestions don't re-parse every participant's JSON.
+// An aggregate is built on first read, adjusted slot by slot on availability writes,
+// dropped by writes that reshuffle participants wholesale, and rebuilt once it is older
+// than aggregateMaxAge so any drift from racing writers heals itself.
+const aggregateMaxAge = 15 * time.Minute
+
+// eventAggregate returns raw counts per slot (disabled and past slots included).
+func eventAggregate(ctx context.Context, eventID string) (map[string]int, error) {
+	var builtAt time.Time
+	err := db.QueryRowContext(ctx, `SELECT built_at FROM event_aggregates WHERE event_id = ?`, eventID).Scan(&builtAt)
+	if err == nil && time.Since(builtAt) < aggregateMaxAge {
+		rows, err := db.QueryContext(ctx, `SELECT slot_key, n FROM event_slot_counts WHERE event_id = ? AND n > 0`, eventID)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		counts := map[string]int{}
+		for rows.Next() {
+			var k string
+			var n int
+			if err := rows.Scan(&k, &n); err != nil {
+				return nil, err
+			}
+			counts[k] = n
+		}
+		metricInc("plannie_event_aggregate_reads_total", "outcome", "hit")
+		return counts, rows.Err()
+	} else if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	metricInc("plannie_event_aggregate_reads_total", "outcome", "rebuild")
+	return rebuildEventAggregate(ctx, eventID)
+}
+
+func rebuildEventAggregate(ctx context.Context, eventID string) (map[string]int, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	// write first so the transaction holds the lock before reading participants
+	if err := dropAggregate(ctx, tx, eventID); err != nil {
+		return nil, err
+	}
+	rows, err := tx.QueryContext(ctx, `SELECT unseal(availability) FROM event_participants WHERE event_id = ?`, eventID)
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]int{}
+	for rows.Next() {
+		var availJSON string
+		if err := rows.Scan(&availJSON); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		avail := map[string]bool{}
+		if err := json.Unmarshal([]byte(availJSON), &avail); err != nil {
+			continue
+		}
+		for k, v := range avail {
+			if v {
+				counts[k]++
+			}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for k, n := range counts {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO event_slot_counts(event_id, slot_key, n) VALUES (?,?,?)`, eventID, k, n); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO event_aggregates(event_id, built_at) VALUES (?,?)`, eventID, time.Now().UTC()); err != nil {
+		return nil, err
+	}
+	return counts, tx.Commit()
+}
+
+// adjustAggregate applies one participant's change from prev to next. Events without a
+// built aggregate are left alone; the next read builds it from scratch.
+func adjustAggregate(ctx context.Context, exec sqlExecer, eventID string, prev, next map[string]bool) error {
+	for k, v := range next {
+		if v && !prev[k] {
+			if err := bumpSlotCount(ctx, exec, eventID, k, 1); err != nil {
+				return err
+			}
+		}
+	}
+	for k, v := range prev {
+		if v && !next[k] {
+			if err := bumpSlotCount(ctx, exec, eventID, k, -1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func bumpSlotCount(ctx context.Context, exec sqlExecer, eventID, slot string, delta int) error {
+	_, err := exec.ExecContext(ctx, `
+		INSERT INTO event_slot_counts(event_id, slot_key, n)
+		SELECT ?, ?, ? WHERE EXISTS (SELECT 1 FROM event_aggregates WHERE event_id = ?)
+		ON CONFLICT(event_id, slot_key) DO UPDATE SET n = n + excluded.n
+	`, eventID, slot, delta, eventID)
+	return err
+}
+
+func dropAggregate(ctx context.Context, exec sqlExecer, eventID string) error {
+	if _, err := exec.ExecContext(ctx, `DELETE FROM event_aggregates WHERE event_id = ?`, eventID); err != nil {
+		return err
+	}
+	_, err := exec.ExecContext(ctx, `DELETE FROM event_slot_counts WHERE event_id = ?`, eventID)
+	return err
+}
+
+const (
+	defaultParticipantPage = 50
+	maxParticipantPage     = 200
+)
+
+// eventParticipantsHandler pages through an event's participants in a stable order so
+// clients can lazy-load large grids. ?cursor= is the opaque nextCursor of the previous
+// page; ?fields= projects each participant like it does on GET /events/:id.
+func eventParticipantsHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	id := c.Param("id")
+	limit := defaultParticipantPage
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxParticipantPage {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 200"})
+			return
+		}
+		limit = n
+	}
+	after := ""
+	if v := c.Query("cursor"); v != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		after = string(raw)
+	}
+
+	var passHash sql.NullString
+	var expiresAt sql.NullTime
+	err := db.QueryRowContext(ctx, `SELECT passphrase_hash, expires_at FROM events WHERE id = ?`, id).Scan(&passHash, &expiresAt)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	} else if err != nil {
+		serverError(c, "eventParticipants: select event", err)
+		return
+	}
+	if expiresAt.Valid && expiresAt.Time.Before(time.Now()) {
+		c.JSON(http.StatusGone, gin.H{"error": "Event expired"})
+		return
+	}
+	if !eventAccessAllowed(ctx, c, id, passHash, optionalAuth(c)) {
+		passphraseRequired(c)
+		return
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT ep.id, COALESCE(ep.user_id, ep.id), COALESCE(u.username, ep.guest_name), ep.user_id IS NULL, unseal(ep.availability), ep.role
+		FROM event_participants ep
+		LEFT JOIN users u ON u.id = ep.user_id
+		WHERE ep.event_id = ? AND ep.id > ?
+		ORDER BY ep.id
+		LIMIT ?
+	`, id, after, limit+1)
+	if err != nil {
+		serverError(c, "eventParticipants: query", err)
+		return
+	}
+	defer rows.Close()
+	fields := c.Query("fields")
+	parts := []map[string]interface{}{}
+	var last string
+	hasMore := false
+	for rows.Next() {
+		if len(parts) == limit {
+			hasMore = true
+			break
+		}
+		var rowID, uid, uname, availJSON, role string
+		var guest bool
+		if err := rows.Scan(&rowID, &uid, &uname, &guest, &availJSON, &role); err != nil {
+			serverError(c, "eventParticipants: scan", err)
+			return
+		}
+		avail := map[string]bool{}
+		_ = json.Unmarshal([]byte(availJSON), &avail)
+		part := map[string]interface{}{"id": uid, "name": uname, "availability": avail}
+		setParticipantIdentity(part, uid, uname)
+		if guest {
+			part["guest"] = true
+		} else {
+			part["role"] = role
+		}
+		if fields != "" {
+			part = projectFields(part, fields)
+		}
+		parts = append(parts, part)
+		last = rowID
+	}
+	if err := rows.Err(); err != nil {
+		serverError(c, "eventParticipants: rows", err)
+		return
+	}
+	var next interface{}
+	if hasMore {
+		next = base64.RawURLEncoding.EncodeToString([]byte(last))
+	}
+	c.JSON(http.StatusOK, gin.H{"participants": parts, "nextCursor": next})
+}
+
+// Load shedding: every request holds a slot in a concurrency limiter for its duration.
+// When all slots are busy a request may queue briefly; once the queue is full or its
+// wait exceeds shedQueueTimeout it gets 503 + Retry-After straight away instead of
+// piling onto the single SQLite writer until every caller hits reqTimeout. Reads and
+// writes have separate global ceilings; expensive routes add their own via
+// concurrencyLimit. A ceiling of 0 disables that limiter.
+var (
+	shedReadLimit    = 256
+	shedWriteLimit   = 16
+	shedQueueTimeout = 500 * time.Millisecond
+
+	shedReads  *shedLimiter
+	shedWrites *shedLimiter
+)
+
+type shedLimiter struct {
+	name    string
+	slots   chan struct{}
+	mu      sync.Mutex
+	waiting int
+	maxWait int
+}
+
+func newShedLimiter(name string, limit int) *shedLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &shedLimiter{name: name, slots: make(chan struct{}, limit), maxWait: limit * 2}
+}
+
+// acquire takes a slot, queueing for at most shedQueueTimeout. It reports false when
+// the request should be shed.
+func (l *shedLimiter) acquire(ctx context.Context) bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	l.mu.Lock()
+	if l.waiting >= l.maxWait {
+		l.mu.Unlock()
+		return false
+	}
+	l.waiting++
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		l.waiting--
+		l.mu.Unlock()
+	}()
+	timer := time.NewTimer(shedQueueTimeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (l *shedLimiter) release() { <-l.slots }
+
+func (l *shedLimiter) serve(c *gin.Context) {
+	if !l.acquire(c.Request.Context()) {
+		metricInc("plannie_load_shed_total", "limiter", l.name)
+		retry := int(shedQueueTimeout.Round(time.Second) / time.Second)
+		if retry < 1 {
+			retry = 1
+		}
+		c.Header("Retry-After", strconv.Itoa(retry))
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Server busy, try again shortly", "code": "overloaded"})
+		return
+	}
+	defer l.release()
+	c.Next()
+}
+
+// loadShedding applies the global read/write ceilings. Health checks, metrics and SSE
+// streams are exempt: the first two must answer precisely when the server is busy and
+// streams would otherwise hold a slot for their whole lifetime.
+func loadShedding() gin.HandlerFunc {
+	shedReads = newShedLimiter("read", shedReadLimit)
+	shedWrites = newShedLimiter("write", shedWriteLimit)
+	return func(c *gin.Context) {
+		path := c.FullPath()
+		if path == "/healthz" || path == "/metrics" || strings.HasSuffix(path, "/stream") {
+			c.Next()
+			return
+		}
+		l := shedWrites
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND", "REPORT":
+			l = shedReads
+		}
+		if l == nil {
+			c.Next()
+			return
+		}
+		l.serve(c)
+	}
+}
+
+// concurrencyLimit caps how many requests to one route run at once, on top of the
+// global ceilings. Use it for handlers that do heavy work per call.
+func concurrencyLimit(name string, limit int) gin.HandlerFunc {
+	l := newShedLimiter(name, limit)
+	if l == nil {
+		return func(c *gin.Context) { c.Next() }
+	}
+	return l.serve
+}
+
+// `plannie doctor` checks the deployment configuration without starting the server and
+// prints one line per check with a hint on how to fix it. It exits non-zero when any
+// check fails, so it can gate a deploy.
+type doctorReport struct {
+	failed bool
+}
+
+func (r *doctorReport) ok(check, msg string) { fmt.Printf("[ ok ] %-10s %s\n", check, msg) }
+
+func (r *doctorReport) warn(check, msg, fix string) {
+	fmt.Printf("[warn] %-10s %s\n", check, msg)
+	if fix != "" {
+		fmt.Printf("       %-10s -> %s\n", "", fix)
+	}
+}
+
+func (r *doctorReport) fail(check, msg, fix string) {
+	r.failed = true
+	fmt.Printf("[FAIL] %-10s %s\n", check, msg)
+	if fix != "" {
+		fmt.Printf("       %-10s -> %s\n", "", fix)
+	}
+}
+
+func runDoctor(args []string) int {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	emailTo := fs.String("email-to", os.Getenv("DOCTOR_EMAIL_TO"), "send a test message to this address (a sink mailbox)")
+	timeURL := fs.String("time-url", "https://www.cloudflare.com", "HTTPS endpoint whose Date header is used for the clock skew check")
+	_ = fs.Parse(args)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	r := &doctorReport{}
+	doctorJWT(r)
+	doctorFieldEncryption(r)
+	doctorDatabase(ctx, r)
+	doctorEmail(ctx, r, *emailTo)
+	doctorLogShipping(r)
+	doctorRealtime(ctx, r)
+	doctorCORS(r)
+	doctorTrustedProxies(r)
+	doctorSecurityHeaders(r)
+	doctorCDN(r)
+	doctorPush(r)
+	doctorClock(ctx, r, *timeURL)
+	if r.failed {
+		fmt.Println("\nSome checks failed; fix them before starting the server.")
+		return 1
+	}
+	fmt.Println("\nAll checks passed.")
+	return 0
+}
+
+func doctorJWT(r *doctorReport) {
+	secret := os.Getenv("JWT_SECRET")
+	distinct := map[rune]struct{}{}
+	for _, ch := range secret {
+		distinct[ch] = struct{}{}
+	}
+	switch {
+	case secret == "":
+		r.fail("jwt", "JWT_SECRET is not set; the server refuses to start", "set JWT_SECRET, e.g. to the output of `openssl rand -base64 48`")
+	case len(secret) < 32:
+		r.fail("jwt", fmt.Sprintf("JWT_SECRET is only %d bytes; tokens can be brute-forced offline", len(secret)), "use at least 32 random bytes, e.g. `openssl rand -base64 48`")
+	case len(distinct) < 10:
+		r.warn("jwt", "JWT_SECRET has very few distinct characters and looks hand-made", "generate it with `openssl rand -base64 48`")
+	default:
+		r.ok("jwt", fmt.Sprintf("JWT_SECRET is %d bytes", len(secret)))
+	}
+}
+
+func doctorDatabase(ctx context.Context, r *doctorReport) {
+	if err := checkDatabaseDriver(); err != nil {
+		r.fail("database", err.Error(), "unset DATABASE_DRIVER or set it to sqlite")
+		return
+	}
+	path := os.Getenv("DATABASE_PATH")
+	if path == "" {
+		path = "app.db"
+	}
+	if path == ":memory:" {
+		r.warn("database", "DATABASE_PATH=:memory: keeps everything in RAM; all data is lost on restart", "use a file path outside of tests")
+		return
+	}
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		f, err := os.CreateTemp(filepath.Dir(path), ".plannie-doctor-*")
+		if err != nil {
+			r.fail("database", fmt.Sprintf("%s does not exist and its directory is not writable: %v", path, err), "point DATABASE_PATH at a writable location")
+			return
+		}
+		f.Close()
+		os.Remove(f.Name())
+		r.warn("database", fmt.Sprintf("%s does not exist yet; it will be created and migrated on first start", path), "")
+		return
+	}
+	d, err := openDB(path)
+	if err != nil {
+		r.fail("database", fmt.Sprintf("open %s: %v", path, err), "check DATABASE_PATH")
+		return
+	}
+	defer d.Close()
+	var check string
+	if err := d.QueryRowContext(ctx, `PRAGMA quick_check`).Scan(&check); err != nil || check != "ok" {
+		r.fail("database", fmt.Sprintf("%s failed PRAGMA quick_check: %v %s", path, err, check), "restore from a backup or run sqlite3 .recover")
+		return
+	}
+	tx, err := d.BeginTx(ctx, nil)
+	if err == nil {
+		_, err = tx.ExecContext(ctx, `CREATE TABLE doctor_probe (x INTEGER)`)
+		tx.Rollback()
+	}
+	if err != nil {
+		r.fail("database", fmt.Sprintf("%s is not writable: %v", path, err), "check file and directory permissions, free disk space, and that no other process holds a write lock")
+		return
+	}
+	r.ok("database", fmt.Sprintf("%s is readable and writable", path))
+
+	var current int
+	if err := d.QueryRowContext(ctx, `SELECT COALESCE(MAX(version),0) FROM schema_versions`).Scan(&current); err != nil {
+		r.warn("migrations", "no schema_versions table; the database will be initialised on first start", "")
+		return
+	}
+	switch {
+	case current == schemaVersion:
+		r.ok("migrations", fmt.Sprintf("schema is at version %d", current))
+	case current < schemaVersion:
+		r.warn("migrations", fmt.Sprintf("schema is at version %d; the server will migrate it to %d on start", current, schemaVersion), "take a backup before upgrading")
+	default:
+		r.fail("migrations", fmt.Sprintf("schema is at version %d but this binary only knows %d", current, schemaVersion), "deploy the newer binary or restore a matching backup")
+	}
+
+	var sealed string
+	if err := d.QueryRowContext(ctx, `SELECT email FROM users WHERE email LIKE 'enc1:%' LIMIT 1`).Scan(&sealed); err == nil {
+		if _, err := openField(sealed); err != nil {
+			r.fail("encryption", fmt.Sprintf("%s holds encrypted fields: %v", path, err), "set FIELD_ENCRYPTION_KEY to the key the data was written with")
+		} else {
+			r.ok("encryption", "encrypted fields open with FIELD_ENCRYPTION_KEY")
+		}
+	}
+}
+
+func doctorFieldEncryption(r *doctorReport) {
+	if err := configureFieldEncryption(); err != nil {
+		r.fail("encryption", err.Error(), "generate a key with `openssl rand -base64 32` and keep a copy outside the server")
+		return
+	}
+	if fieldAEAD == nil {
+		r.ok("encryption", "field encryption is off (set FIELD_ENCRYPTION_KEY to encrypt emails and availability)")
+		return
+	}
+	r.ok("encryption", "FIELD_ENCRYPTION_KEY is valid; plaintext rows are encrypted on the next start")
+}
+
+func doctorEmail(ctx context.Context, r *doctorReport, sink string) {
+	if err := configureEmail(); err != nil {
+		r.fail("email", err.Error(), "fix EMAIL_PROVIDER / DKIM_* settings")
+		return
+	}
+	switch emailProvider {
+	case "memory":
+		r.warn("email", "EMAIL_PROVIDER=memory: mail is captured in memory and never delivered", "use smtp or brevo in production")
+	case "smtp":
+		host, port := os.Getenv("SMTP_HOST"), os.Getenv("SMTP_PORT")
+		if host == "" || port == "" || os.Getenv("EMAIL_FROM") == "" {
+			r.fail("email", "SMTP_HOST, SMTP_PORT and EMAIL_FROM are all required for smtp", "")
+			return
+		}
+		if err := doctorSMTPProbe(ctx, host, port); err != nil {
+			r.fail("email", fmt.Sprintf("smtp %s:%s: %v", host, port, err), "check host/port, firewall rules and SMTP_USER/SMTP_PASS")
+			return
+		}
+		r.ok("email", fmt.Sprintf("smtp %s:%s accepted the connection and credentials", host, port))
+	default:
+		if brevoAPIKey == "" || brevoSenderEmail == "" {
+			r.fail("email", "BREVO_API_KEY and BREVO_SENDER_EMAIL are required for brevo", "set them, or set SMTP_HOST / EMAIL_PROVIDER=smtp")
+			return
+		}
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "https://api.brevo.com/v3/account", nil)
+		req.Header.Set("api-key", brevoAPIKey)
+		req.Header.Set("accept", "application/json")
+		resp, err := (&http.Client{Timeout: outboundTimeout}).Do(req)
+		if err != nil {
+			r.fail("email", fmt.Sprintf("brevo unreachable: %v", err), "check outbound HTTPS access")
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			r.fail("email", fmt.Sprintf("brevo rejected the API key (HTTP %d)", resp.StatusCode), "create a new key in the Brevo dashboard")
+			return
+		}
+		r.ok("email", "brevo API key is valid")
+	}
+	if sink == "" {
+		r.warn("email", "no test message sent", "pass -email-to <sink address> to verify delivery end to end")
+		return
+	}
+	m := outgoingEmail{To: sink, Subject: "Plannie doctor test", HTML: "<p>This is a test message from <code>plannie doctor</code>.</p>", Category: "doctor"}
+	var err error
+	switch emailProvider {
+	case "memory":
+		err = captureEmail(m)
+	case "smtp":
+		err = sendEmailSMTP(ctx, m)
+	default:
+		err = sendEmailBrevo(ctx, m)
+	}
+	if err != nil {
+		r.fail("email", fmt.Sprintf("test send to %s failed: %v", sink, err), "check the sender address is allowed by the provider")
+		return
+	}
+	r.ok("email", fmt.Sprintf("test message sent to %s", sink))
+}
+
+// doctorSMTPProbe connects, upgrades to TLS when offered and authenticates, without sending.
+func doctorSMTPProbe(ctx context.Context, host, port string) error {
+	conn, err := (&net.Dialer{Timeout: 10 * time.Second}).DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return err
+	}
+	_ = conn.SetDeadline(time.Now().Add(outboundTimeout))
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if user := os.Getenv("SMTP_USER"); user != "" {
+		if err := client.Auth(smtp.PlainAuth("", user, os.Getenv("SMTP_PASS"), host)); err != nil {
+			return err
+		}
+	}
+	return client.Quit()
+}
+
+func doctorCORS(r *doctorReport) {
+	raw := os.Getenv("CORS_ORIGINS")
+	if raw == "" {
+		r.warn("cors", fmt.Sprintf("CORS_ORIGINS is empty, so only %s (from APP_BASE_URL) may call the API", corsOriginList("")[0]), "set CORS_ORIGINS to the frontend origin(s), e.g. https://plannie.example.com")
+		return
+	}
+	secure := strings.ToLower(os.Getenv("COOKIE_SECURE")) != "false"
+	origins := map[string]bool{}
+	bad := false
+	for _, o := range strings.Split(raw, ",") {
+		o = strings.TrimSpace(o)
+		if o == "" {
+			continue
+		}
+		u, err := url.Parse(o)
+		switch {
+		case o == "*":
+			r.fail("cors", `"*" in CORS_ORIGINS cannot be combined with credentialed requests`, "list the frontend origins explicitly")
+			bad = true
+		case err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "":
+			r.fail("cors", fmt.Sprintf("%q is not an origin", o), "use scheme://host[:port], e.g. https://plannie.example.com")
+			bad = true
+		case u.Path != "" || u.RawQuery != "":
+			r.fail("cors", fmt.Sprintf("%q has a path; browsers send the bare origin so it never matches", o), "drop everything after the host, including a trailing slash")
+			bad = true
+		case u.Scheme == "http" && secure && u.Hostname() != "localhost" && u.Hostname() != "127.0.0.1":
+			r.warn("cors", fmt.Sprintf("%q is plain http while COOKIE_SECURE is on; the refresh cookie will not be sent", o), "serve the frontend over https")
+		}
+		origins[o] = true
+	}
+	if app := os.Getenv("APP_BASE_URL"); app != "" {
+		if u, err := url.Parse(app); err == nil && u.Host != "" && !origins[u.Scheme+"://"+u.Host] {
+			r.warn("cors", fmt.Sprintf("APP_BASE_URL origin %s://%s is not in CORS_ORIGINS; the web app cannot call the API", u.Scheme, u.Host), "add it to CORS_ORIGINS")
+			bad = true
+		}
+	}
+	if !bad {
+		r.ok("cors", fmt.Sprintf("%d allowed origin(s)", len(origins)))
+	}
+}
+
+func doctorClock(ctx context.Context, r *doctorReport, ref string) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, ref, nil)
+	if err != nil {
+		r.warn("clock", fmt.Sprintf("invalid -time-url: %v", err), "")
+		return
+	}
+	start := time.Now()
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		r.warn("clock", fmt.Sprintf("could not reach %s to compare clocks: %v", ref, err), "pass -time-url with a reachable HTTPS endpoint")
+		return
+	}
+	resp.Body.Close()
+	remote, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		r.warn("clock", fmt.Sprintf("%s sent no usable Date header", ref), "pass a different -time-url")
+		return
+	}
+	local := start.Add(time.Since(start) / 2)
+	skew := local.Sub(remote)
+	if skew < 0 {
+		skew = -skew
+	}
+	switch {
+	case skew > 5*time.Minute:
+		r.fail("clock", fmt.Sprintf("local clock is off by %s; token expiry and emailed links will misbehave", skew.Round(time.Second)), "enable NTP (e.g. systemd-timesyncd or chrony)")
+	case skew > 30*time.Second:
+		r.warn("clock", fmt.Sprintf("local clock is off by %s", skew.Round(time.Second)), "enable NTP (e.g. systemd-timesyncd or chrony)")
+	default:
+		r.ok("clock", fmt.Sprintf("skew against %s is %s", ref, skew.Round(time.Millisecond)))
+	}
+}
+
+// `plannie fsck` checks the rows for damage the schema cannot prevent: the foreign keys
+// are declared but not enforced, so deleting a user or event can leave orphans behind,
+// and the JSON columns are plain text. With -repair it fixes what has a safe fix
+// (orphans are deleted, unparsable JSON is reset to its empty value, stale aggregates are
+// dropped) and reports the rest. Take a backup first and preferably stop the server.
+func runFsck(args []string) int {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "delete orphaned rows, reset unparsable JSON and drop stale aggregates")
+	_ = fs.Parse(args)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := configureFieldEncryption(); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	path := os.Getenv("DATABASE_PATH")
+	if path == "" {
+		path = "app.db"
+	}
+	if _, err := os.Stat(path); err != nil {
+		fmt.Printf("%s: %v\n", path, err)
+		return 1
+	}
+	d, err := openDB(path)
+	if err != nil {
+		fmt.Printf("open %s: %v\n", path, err)
+		return 1
+	}
+	defer d.Close()
+	var current int
+	if err := d.QueryRowContext(ctx, `SELECT COALESCE(MAX(version),0) FROM schema_versions`).Scan(&current); err != nil || current != schemaVersion {
+		fmt.Printf("%s is at schema version %d, this binary expects %d; start the matching server once to migrate it\n", path, current, schemaVersion)
+		return 1
+	}
+
+	r := &doctorReport{}
+	fsckOrphans(ctx, r, d, *repair)
+	for _, col := range fsckJSONColumns {
+		fsckJSON(ctx, r, d, col, *repair)
+	}
+	fsckInvariants(ctx, r, d, *repair)
+	fsckTimezones(ctx, r, d)
+	if r.failed {
+		if *repair {
+			fmt.Println("\nSome problems need fixing by hand.")
+		} else {
+			fmt.Println("\nProblems found; run `plannie fsck -repair` to fix what can be fixed automatically.")
+		}
+		return 1
+	}
+	fmt.Println("\nNo problems left.")
+	return 0
+}
+
+// fsckOrphans deletes rows whose parent is gone. Deleting an orphaned event orphans its
+// own children, so repair runs PRAGMA foreign_key_check until it comes back clean.
+func fsckOrphans(ctx context.Context, r *doctorReport, d *sql.DB, repair bool) {
+	deleted := map[string]int{}
+	for pass := 0; pass < 5; pass++ {
+		rows, err := d.QueryContext(ctx, `PRAGMA foreign_key_check`)
+		if err != nil {
+			r.fail("orphans", fmt.Sprintf("foreign_key_check: %v", err), "")
+			return
+		}
+		type orphan struct {
+			table  string
+			rowid  int64
+			parent string
+		}
+		var found []orphan
+		for rows.Next() {
+			var o orphan
+			var fkid int
+			if err := rows.Scan(&o.table, &o.rowid, &o.parent, &fkid); err != nil {
+				rows.Close()
+				r.fail("orphans", fmt.Sprintf("foreign_key_check: %v", err), "")
+				return
+			}
+			found = append(found, o)
+		}
+		rows.Close()
+		if len(found) == 0 {
+			break
+		}
+		if !repair {
+			counts := map[string]int{}
+			for _, o := range found {
+				counts[o.table+" rows point to a missing "+o.parent+" row"]++
+			}
+			for _, what := range sortedKeys(counts) {
+				r.fail("orphans", fmt.Sprintf("%d %s", counts[what], what), "")
+			}
+			return
+		}
+		tx, err := d.BeginTx(ctx, nil)
+		if err != nil {
+			r.fail("orphans", err.Error(), "")
+			return
+		}
+		for _, o := range found {
+			if _, err := tx.ExecContext(ctx, `DELETE FROM "`+o.table+`" WHERE rowid = ?`, o.rowid); err != nil {
+				tx.Rollback()
+				r.fail("orphans", fmt.Sprintf("delete from %s: %v", o.table, err), "")
+				return
+			}
+			deleted[o.table]++
+		}
+		if err := tx.Commit(); err != nil {
+			r.fail("orphans", err.Error(), "")
+			return
+		}
+	}
+	if len(deleted) == 0 {
+		r.ok("orphans", "every row's user and event exist")
+		return
+	}
+	for _, table := range sortedKeys(deleted) {
+		r.warn("orphans", fmt.Sprintf("deleted %d orphaned %s rows", deleted[table], table), "")
+	}
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// fsckJSONColumn is a JSON column; empty is "{}" for slot maps and "[]" for string lists.
+type fsckJSONColumn struct {
+	table, column, empty string
+	sealed               bool
+}
+
+var fsckJSONColumns = []fsckJSONColumn{
+	{"event_participants", "availability", "{}", true},
+	{"event_participants", "draft_availability", "{}", true},
+	{"event_participants", "draft_disabled_slots", "[]", false},
+	{"availability_history", "availability", "{}", true},
+	{"events", "disabled_slots", "[]", false},
+	{"events", "tags", "[]", false},
+}
+
+func (col fsckJSONColumn) valid(raw string) bool {
+	if col.empty == "{}" {
+		var slots map[string]bool
+		return json.Unmarshal([]byte(raw), &slots) == nil
+	}
+	var list []string
+	return json.Unmarshal([]byte(raw), &list) == nil
+}
+
+// fsckJSON decodes every value in Go rather than with json_valid so that a field that
+// fails to decrypt is reported instead of aborting the scan.
+func fsckJSON(ctx context.Context, r *doctorReport, d *sql.DB, col fsckJSONColumn, repair bool) {
+	name := col.table + "." + col.column
+	rows, err := d.QueryContext(ctx, `SELECT rowid, "`+col.column+`" FROM "`+col.table+`"`)
+	if err != nil {
+		r.fail("json", fmt.Sprintf("%s: %v", name, err), "")
+		return
+	}
+	var bad []int64
+	var sealedErrs int
+	for rows.Next() {
+		var rowid int64
+		var raw string
+		if err := rows.Scan(&rowid, &raw); err != nil {
+			rows.Close()
+			r.fail("json", fmt.Sprintf("%s: %v", name, err), "")
+			return
+		}
+		if col.sealed && strings.HasPrefix(raw, sealedPrefix) {
+			plain, err := openField(raw)
+			if err != nil {
+				sealedErrs++
+				continue
+			}
+			raw = plain
+		}
+		if !col.valid(raw) {
+			bad = append(bad, rowid)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		r.fail("json", fmt.Sprintf("%s: %v", name, err), "")
+		return
+	}
+	if sealedErrs > 0 {
+		r.fail("json", fmt.Sprintf("%s: %d encrypted values do not open", name, sealedErrs), "set FIELD_ENCRYPTION_KEY to the key the data was written with")
+	}
+	switch {
+	case len(bad) == 0:
+		if sealedErrs == 0 {
+			r.ok("json", name+" parses")
+		}
+	case !repair:
+		r.fail("json", fmt.Sprintf("%s: %d values are not valid JSON", name, len(bad)), "")
+	default:
+		for _, rowid := range bad {
+			if _, err := d.ExecContext(ctx, `UPDATE "`+col.table+`" SET "`+col.column+`" = ? WHERE rowid = ?`, col.empty, rowid); err != nil {
+				r.fail("json", fmt.Sprintf("%s: reset: %v", name, err), "")
+				return
+			}
+		}
+		r.warn("json", fmt.Sprintf("%s: reset %d unparsable values to %s", name, len(bad), col.empty), "")
+	}
+}
+
+// fsckInvariantChecks count rows breaking a rule the handlers rely on. repair is empty
+// where only a person can tell what the right value is.
+var fsckInvariantChecks = []struct {
+	check, what, count, repair, fix string
+}{
+	{"events", "events end before they start",
+		`SELECT COUNT(*) FROM events WHERE date_from > date_to`, "",
+		"correct date_from/date_to or delete the events"},
+	{"events", "events have a non-positive slot duration",
+		`SELECT COUNT(*) FROM events WHERE duration <= 0`, "",
+		"set duration to the intended slot length in hours"},
+	{"events", "finalized events have no finalized_at",
+		`SELECT COUNT(*) FROM events WHERE finalized_slot IS NOT NULL AND finalized_at IS NULL`,
+		`UPDATE events SET finalized_at = updated_at WHERE finalized_slot IS NOT NULL AND finalized_at IS NULL`, ""},
+	{"events", "events belong to a missing series",
+		`SELECT COUNT(*) FROM events WHERE series_id IS NOT NULL AND series_id NOT IN (SELECT id FROM event_series)`,
+		`UPDATE events SET series_id = NULL WHERE series_id IS NOT NULL AND series_id NOT IN (SELECT id FROM event_series)`, ""},
+	{"users", "accounts are merged into themselves or a missing account",
+		`SELECT COUNT(*) FROM users u WHERE u.merged_into IS NOT NULL AND (u.merged_into = u.id OR u.merged_into NOT IN (SELECT id FROM users))`, "",
+		"point merged_into at the surviving account"},
+	{"guests", "guest rows have no name",
+		`SELECT COUNT(*) FROM event_participants WHERE user_id IS NULL AND guest_name = ''`,
+		`UPDATE event_participants SET guest_name = 'Guest' WHERE user_id IS NULL AND guest_name = ''`, ""},
+	{"aggregates", "aggregates are stale or negative",
+		`SELECT COUNT(*) FROM event_aggregates a WHERE a.event_id NOT IN (SELECT id FROM events)
+			OR EXISTS (SELECT 1 FROM event_slot_counts c WHERE c.event_id = a.event_id AND c.n < 0)`,
+		`DELETE FROM event_aggregates WHERE event_id NOT IN (SELECT id FROM events)
+			OR event_id IN (SELECT event_id FROM event_slot_counts WHERE n < 0)`, ""},
+	{"aggregates", "slot counts have no aggregate",
+		`SELECT COUNT(*) FROM event_slot_counts WHERE event_id NOT IN (SELECT event_id FROM event_aggregates)`,
+		`DELETE FROM event_slot_counts WHERE event_id NOT IN (SELECT event_id FROM event_aggregates)`, ""},
+}
+
+func fsckInvariants(ctx context.Context, r *doctorReport, d *sql.DB, repair bool) {
+	for _, c := range fsckInvariantChecks {
+		var n int
+		if err := d.QueryRowContext(ctx, c.count).Scan(&n); err != nil {
+			r.fail(c.check, fmt.Sprintf("%s: %v", c.what, err), "")
+			continue
+		}
+		switch {
+		case n == 0:
+			r.ok(c.check, "0 "+c.what)
+		case repair && c.repair != "":
+			if _, err := d.ExecContext(ctx, c.repair); err != nil {
+				r.fail(c.check, fmt.Sprintf("%d %s; repair failed: %v", n, c.what, err), "")
+				continue
+			}
+			r.warn(c.check, fmt.Sprintf("fixed: %d %s", n, c.what), "")
+		default:
+			r.fail(c.check, fmt.Sprintf("%d %s", n, c.what), c.fix)
+		}
+	}
+}
+
+func fsckTimezones(ctx context.Context, r *doctorReport, d *sql.DB) {
+	rows, err := d.QueryContext(ctx, `SELECT DISTINCT timezone FROM events`)
+	if err != nil {
+		r.fail("events", fmt.Sprintf("timezones: %v", err), "")
+		return
+	}
+	defer rows.Close()
+	var unknown []string
+	for rows.Next() {
+		var tz string
+		if err := rows.Scan(&tz); err != nil {
+			r.fail("events", fmt.Sprintf("timezones: %v", err), "")
+			return
+		}
+		if _, err := time.LoadLocation(tz); err != nil {
+			unknown = append(unknown, strconv.Quote(tz))
+		}
+	}
+	if len(unknown) > 0 {
+		r.fail("events", "events use unknown time zones: "+strings.Join(unknown, ", "), "set timezone to an IANA name such as Europe/Prague")
+		return
+	}
+	r.ok("events", "every event time zone is known")
+}
+
+// Runtime settings can change without a restart, so tightening rate limits or adding a
+// CORS origin doesn't drop every open SSE stream. Values come from the environment
+// (.env is re-read on reload, but variables set in the process environment at startup
+// stay authoritative) and are overridden by rows in runtime_settings, which instance
+// admins edit through /admin/settings. SIGHUP or POST /admin/settings/reload re-applies
+// both sources.
+type runtimeSettings struct {
+	CORSOrigins          string  `json:"CORS_ORIGINS"`
+	RateLimitScale       float64 `json:"RATE_LIMIT_SCALE"`
+	RegistrationHoneypot bool    `json:"REGISTRATION_HONEYPOT"`
+	EmailMXCheck         bool    `json:"EMAIL_MX_CHECK"`
+	IPBanThreshold       int     `json:"IP_BAN_THRESHOLD"`
+}
+
+var runtimeSettingKeys = []string{"CORS_ORIGINS", "RATE_LIMIT_SCALE", "REGISTRATION_HONEYPOT", "EMAIL_MX_CHECK", "IP_BAN_THRESHOLD"}
+
+var (
+	settingsMu      sync.RWMutex
+	settings        = runtimeSettings{RateLimitScale: 1, RegistrationHoneypot: true}
+	settingsSources = map[string]string{}
+	corsHandler     = cors.New(buildCORS(""))
+	corsOrigins     = map[string]bool{}
+	publicCORS      = cors.New(buildPublicCORS())
+	pinnedEnv       = map[string]bool{} // runtime setting keys present in the process environment at startup
+)
+
+func currentSettings() runtimeSettings {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return settings
+}
+
+// set parses one setting into s. Environment values keep their historical leniency
+// (REGISTRATION_HONEYPOT is only off for "false"); admin edits are validated up front
+// by the same parser, so a bad value is rejected instead of half-applied.
+func (s *runtimeSettings) set(key, value string) error {
+	value = strings.TrimSpace(value)
+	switch key {
+	case "CORS_ORIGINS":
+		for _, o := range strings.Split(value, ",") {
+			o = strings.TrimSpace(o)
+			if o == "" {
+				continue
+			}
+			if o == "*" {
+				return errors.New(`"*" cannot be combined with credentialed requests; list the origins`)
+			}
+			if u, err := url.Parse(o); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" {
+				return fmt.Errorf("%q is not an origin (scheme://host[:port])", o)
+			}
+		}
+		s.CORSOrigins = value
+	case "RATE_LIMIT_SCALE":
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || f < 0 || f > 100 {
+			return errors.New("must be a number between 0 and 100")
+		}
+		s.RateLimitScale = f
+	case "REGISTRATION_HONEYPOT":
+		s.RegistrationHoneypot = strings.ToLower(value) != "false"
+	case "EMAIL_MX_CHECK":
+		s.EmailMXCheck = strings.ToLower(value) == "true"
+	case "IP_BAN_THRESHOLD":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return errors.New("must be a non-negative integer")
+		}
+		s.IPBanThreshold = n
+	default:
+		return fmt.Errorf("unknown setting %s", key)
+	}
+	return nil
+}
+
+func knownSetting(key string) bool {
+	for _, k := range runtimeSettingKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+func loadRuntimeSettings(ctx context.Context) (runtimeSettings, map[string]string, error) {
+	s := runtimeSettings{RateLimitScale: 1, RegistrationHoneypot: true}
+	sources := map[string]string{}
+	for _, key := range runtimeSettingKeys {
+		sources[key] = "default"
+		if v := os.Getenv(key); v != "" {
+			if err := s.set(key, v); err != nil {
+				log.Printf("settings: ignoring %s from environment: %v", key, err)
+				continue
+			}
+			sources[key] = "env"
+		}
+	}
+	rows, err := db.QueryContext(ctx, `SELECT key, value FROM runtime_settings`)
+	if err != nil {
+		return s, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return s, nil, err
+		}
+		if err := s.set(key, value); err != nil {
+			log.Printf("settings: ignoring stored %s: %v", key, err)
+			continue
+		}
+		sources[key] = "db"
+	}
+	return s, sources, rows.Err()
+}
+
+// reloadSettings re-reads .env and runtime_settings and swaps the live settings.
+// Rate limiters are rebuilt so a new scale applies to clients already seen.
+func reloadSettings(ctx context.Context) error {
+	if vals, err := godotenv.Read(); err == nil {
+		for _, key := range runtimeSettingKeys {
+			if pinnedEnv[key] {
+				continue
+			}
+			if v, ok := vals[key]; ok {
+				os.Setenv(key, v)
+			} else {
+				os.Unsetenv(key)
+			}
+		}
+	}
+	s, sources, err := loadRuntimeSettings(ctx)
+	if err != nil {
+		return err
+	}
+	cfg := buildCORS(s.CORSOrigins)
+	handler, public := cors.New(cfg), cors.New(buildPublicCORS())
+	allowed := map[string]bool{}
+	for _, o := range cfg.AllowOrigins {
+		allowed[o] = true
+	}
+	settingsMu.Lock()
+	scaleChanged := s.RateLimitScale != settings.RateLimitScale
+	settings = s
+	settingsSources = sources
+	corsHandler, corsOrigins, publicCORS = handler, allowed, public
+	settingsMu.Unlock()
+	if scaleChanged {
+		muVisitors.Lock()
+		visitors = map[string]*visitor{}
+		muVisitors.Unlock()
+	}
+	log.Printf("settings: loaded (CORS_ORIGINS=%s RATE_LIMIT_SCALE=%s)", sources["CORS_ORIGINS"], sources["RATE_LIMIT_SCALE"])
+	return nil
+}
+
+// reloadableCORS delegates to the CORS handler built from the current settings. Public
+// endpoints get the relaxed policy, except for the app's own origins, which keep the
+// credentialed one so authenticated fetches from the frontend still work.
+func reloadableCORS() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		settingsMu.RLock()
+		h := corsHandler
+		if publicCORSPath(c.Request.URL.Path) {
+			c.Writer.Header().Add("Vary", "Origin")
+			if !corsOrigins[c.GetHeader("Origin")] {
+				h = publicCORS
+			}
+		}
+		settingsMu.RUnlock()
+		h(c)
+	}
+}
+
+func settingsResponse() gin.H {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	sources := make(map[string]string, len(settingsSources))
+	for k, v := range settingsSources {
+		sources[k] = v
+	}
+	return gin.H{"settings": settings, "sources": sources}
+}
+
+func adminSettingsHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, settingsResponse())
+}
+
+// adminSetSettingHandler stores (PUT) or clears (DELETE, falling back to the
+// environment) a settings override and applies it immediately.
+func adminSetSettingHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	key := strings.ToUpper(c.Param("key"))
+	if !knownSetting(key) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown setting"})
+		return
+	}
+	if c.Request.Method == http.MethodDelete {
+		if _, err := db.ExecContext(ctx, `DELETE FROM runtime_settings WHERE key = ?`, key); err != nil {
+			serverError(c, "adminSetSetting: delete", err)
+			return
+		}
+	} else {
+		var in struct {
+			Value *string `json:"value"`
+		}
+		if err := c.ShouldBindJSON(&in); err != nil || in.Value == nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "value is required"})
+			return
+		}
+		probe := currentSettings()
+		if err := probe.set(key, *in.Value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": key + ": " + err.Error()})
+			return
+		}
+		if _, err := db.ExecContext(ctx, `
+			INSERT INTO runtime_settings (key, value, updated_by, updated_at) VALUES (?, ?, ?, ?)
+			ON CONFLICT(key) DO UPDATE SET value = excluded.value, updated_by = excluded.updated_by, updated_at = excluded.updated_at
+		`, key, strings.TrimSpace(*in.Value), ctxUserID(c), time.Now().UTC()); err != nil {
+			serverError(c, "adminSetSetting: upsert", err)
+			return
+		}
+	}
+	if err := reloadSettings(ctx); err != nil {
+		serverError(c, "adminSetSetting: reload", err)
+		return
+	}
+	log.Printf("settings: %s %s by %s", key, strings.ToLower(c.Request.Method), ctxUserID(c))
+	c.JSON(http.StatusOK, settingsResponse())
+}
+
+func adminReloadSettingsHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+	if err := reloadSettings(ctx); err != nil {
+		serverError(c, "adminReloadSettings", err)
+		return
+	}
+	c.JSON(http.StatusOK, settingsResponse())
+}
+
+// lifecycle owns the server's long-running components. Each component's run function
+// gets a context that is cancelled on shutdown and must return promptly after that;
+// a component returning an error starts a shutdown of everything else. Shutdown runs
+// OnStop hooks newest first (draining HTTP before anything else), cancels the run
+// contexts, waits for the components, and finally runs OnClose hooks newest first to
+// release shared resources such as the database, all within one deadline.
+type lifecycle struct {
+	ctx    context.Context // cancelled on shutdown or when a component fails
+	cancel context.CancelFunc
+	group  *errgroup.Group
+
+	mu      sync.Mutex
+	running map[string]struct{}
+	stops   []lifecycleHook
+	closes  []lifecycleHook
+}
+
+type lifecycleHook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+func newLifecycle() *lifecycle {
+	ctx, cancel := context.WithCancel(context.Background())
+	group, gctx := errgroup.WithContext(ctx)
+	return &lifecycle{ctx: gctx, cancel: cancel, group: group, running: map[string]struct{}{}}
+}
+
+// Go starts a component.
+func (l *lifecycle) Go(name string, run func(ctx context.Context) error) {
+	l.mu.Lock()
+	l.running[name] = struct{}{}
+	l.mu.Unlock()
+	l.group.Go(func() error {
+		defer func() {
+			l.mu.Lock()
+			delete(l.running, name)
+			l.mu.Unlock()
+		}()
+		if err := run(l.ctx); err != nil {
+			log.Printf("lifecycle: %s stopped: %v", name, err)
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		return nil
+	})
+}
+
+// OnStop registers a hook that runs before component contexts are cancelled.
+func (l *lifecycle) OnStop(name string, fn func(ctx context.Context) error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stops = append(l.stops, lifecycleHook{name, fn})
+}
+
+// OnClose registers a hook that runs after every component has returned.
+func (l *lifecycle) OnClose(name string, fn func() error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closes = append(l.closes, lifecycleHook{name, func(context.Context) error { return fn() }})
+}
+
+// Failed is closed when a component returned an error.
+func (l *lifecycle) Failed() <-chan struct{} { return l.ctx.Done() }
+
+func (l *lifecycle) Shutdown(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	l.mu.Lock()
+	stops := append([]lifecycleHook(nil), l.stops...)
+	closes := append([]lifecycleHook(nil), l.closes...)
+	l.mu.Unlock()
+
+	for i := len(stops) - 1; i >= 0; i-- {
+		if err := stops[i].fn(ctx); err != nil {
+			log.Printf("lifecycle: stop %s: %v", stops[i].name, err)
+		}
+	}
+	l.cancel()
+	done := make(chan error, 1)
+	go func() { done <- l.group.Wait() }()
+	var runErr error
+	select {
+	case runErr = <-done:
+	case <-ctx.Done():
+		l.mu.Lock()
+		names := make([]string, 0, len(l.running))
+		for n := range l.running {
+			names = append(names, n)
+		}
+		l.mu.Unlock()
+		sort.Strings(names)
+		log.Printf("lifecycle: gave up waiting for %s after %s", strings.Join(names, ", "), timeout)
+		runErr = fmt.Errorf("components still running after %s: %s", timeout, strings.Join(names, ", "))
+	}
+	for i := len(closes) - 1; i >= 0; i-- {
+		if err := closes[i].fn(ctx); err != nil {
+			log.Printf("lifecycle: close %s: %v", closes[i].name, err)
+		}
+	}
+	return runErr
+}
+
+// runEvery calls fn every interval until ctx is cancelled.
+func runEvery(ctx context.Context, interval time.Duration, fn func(ctx context.Context)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			fn(ctx)
+		}
+	}
+}
+
+// SQLite metrics: file, free-list and WAL sizes plus connection pool pressure, so a
+// database outgrowing its disk or a writer queue building up shows on the dashboard
+// before requests start timing out. Contention shows as plannie_sqlite_errors_total
+// (code busy/locked), counted wherever handlers report DB errors. Page cache hit rates
+// live behind sqlite3_db_status, which the pure-Go driver does not expose through
+// database/sql, so they are not reported.
+var dbFilePath string
+
+func registerSQLiteMetrics() {
+	pragma := func(name string) float64 {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		var n int64
+		if err := db.QueryRowContext(ctx, `PRAGMA `+name).Scan(&n); err != nil {
+			return 0
+		}
+		return float64(n)
+	}
+	registerGauge("plannie_sqlite_db_size_bytes", func() float64 { return pragma("page_count") * pragma("page_size") })
+	registerGauge("plannie_sqlite_freelist_bytes", func() float64 { return pragma("freelist_count") * pragma("page_size") })
+	registerGauge("plannie_sqlite_wal_size_bytes", func() float64 {
+		if dbFilePath == "" || dbFilePath == ":memory:" {
+			return 0
+		}
+		fi, err := os.Stat(dbFilePath + "-wal")
+		if err != nil {
+			return 0
+		}
+		return float64(fi.Size())
+	})
+	registerGauge("plannie_db_connections_open", func() float64 { return float64(db.Stats().OpenConnections) })
+	registerGauge("plannie_db_connections_in_use", func() float64 { return float64(db.Stats().InUse) })
+	registerGauge("plannie_db_connection_waits", func() float64 { return float64(db.Stats().WaitCount) })
+	registerGauge("plannie_db_connection_wait_seconds", func() float64 { return db.Stats().WaitDuration.Seconds() })
+}
+
+// countSQLiteContention counts SQLITE_BUSY / SQLITE_LOCKED failures.
+func countSQLiteContention(err error) {
+	var se *sqlite.Error
+	if !errors.As(err, &se) {
+		return
+	}
+	switch se.Code() & 0xff {
+	case sqlite3.SQLITE_BUSY:
+		metricInc("plannie_sqlite_errors_total", "code", "busy")
+	case sqlite3.SQLITE_LOCKED:
+		metricInc("plannie_sqlite_errors_total", "code", "locked")
+	}
+}
+
+// Database maintenance runs once a day inside MAINTENANCE_WINDOW (UTC, "HH:MM-HH:MM",
+// default 03:00-05:00, "off" to disable): it truncates the WAL with a checkpoint and
+// then returns free pages to the filesystem with incremental vacuum in small steps, so
+// writers are never blocked for long. A database created before incremental
+// auto-vacuum was enabled is converted with one full VACUUM in its first window.
+var (
+	maintenanceWindow     = "03:00-05:00"
+	maintenanceVacuumStep = 2000 // pages per incremental_vacuum call
+)
+
+// parseMaintenanceWindow returns the window bounds as minutes after midnight UTC.
+func parseMaintenanceWindow(v string) (int, int, error) {
+	from, to, ok := strings.Cut(v, "-")
+	if !ok {
+		return 0, 0, errors.New(`expected "HH:MM-HH:MM"`)
+	}
+	var bounds [2]int
+	for i, part := range []string{from, to} {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return 0, 0, fmt.Errorf("bad time %q", part)
+		}
+		bounds[i] = t.Hour()*60 + t.Minute()
+	}
+	if bounds[0] == bounds[1] {
+		return 0, 0, errors.New("window is empty")
+	}
+	return bounds[0], bounds[1], nil
+}
+
+// inMaintenanceWindow reports whether now falls inside the window, which may wrap midnight.
+func inMaintenanceWindow(now time.Time, from, to int) bool {
+	m := now.UTC().Hour()*60 + now.UTC().Minute()
+	if from < to {
+		return m >= from && m < to
+	}
+	return m >= from || m < to
+}
+
+func maintenanceLoop(ctx context.Context) error {
+	from, to, err := parseMaintenanceWindow(maintenanceWindow)
+	if err != nil {
+		return err
+	}
+	lastRun := ""
+	return runEvery(ctx, 5*time.Minute, func(ctx context.Context) {
+		now := time.Now().UTC()
+		if !inMaintenanceWindow(now, from, to) || lastRun == now.Format("2006-01-02") {
+			return
+		}
+		lastRun = now.Format("2006-01-02")
+		runMaintenance(ctx, func() bool { return inMaintenanceWindow(time.Now(), from, to) })
+	})
+}
+
+// runMaintenance vacuums while inWindow holds, then checkpoints the WAL.
+func runMaintenance(ctx context.Context, inWindow func() bool) {
+	start := time.Now()
+	log.Printf("maintenance: starting")
+	vacuumDatabase(ctx, inWindow)
+	checkpointWAL(ctx)
+	log.Printf("maintenance: done in %s", time.Since(start).Round(time.Millisecond))
+}
+
+// checkpointWAL copies the WAL into the database and truncates it; it runs after the
+// vacuum so the pages the vacuum wrote are folded in too.
+func checkpointWAL(ctx context.Context) {
+	var busy, walPages, moved int
+	if err := db.QueryRowContext(ctx, `PRAGMA wal_checkpoint(TRUNCATE)`).Scan(&busy, &walPages, &moved); err != nil {
+		log.Printf("maintenance: checkpoint error: %v", err)
+	} else if busy != 0 {
+		log.Printf("maintenance: checkpoint blocked by readers, %d of %d WAL pages copied", moved, walPages)
+	} else {
+		log.Printf("maintenance: WAL checkpointed and truncated")
+		metricInc("plannie_maintenance_runs_total", "step", "checkpoint")
+	}
+}
+
+// vacuumDatabase releases free pages while inWindow holds.
+func vacuumDatabase(ctx context.Context, inWindow func() bool) {
+	var mode int
+	if err := db.QueryRowContext(ctx, `PRAGMA auto_vacuum`).Scan(&mode); err != nil {
+		log.Printf("maintenance: auto_vacuum error: %v", err)
+		return
+	}
+	if mode != 2 {
+		log.Printf("maintenance: converting to incremental auto-vacuum with a full VACUUM")
+		if _, err := db.ExecContext(ctx, `VACUUM`); err != nil {
+			log.Printf("maintenance: vacuum error: %v", err)
+			return
+		}
+		metricInc("plannie_maintenance_runs_total", "step", "vacuum")
+		log.Printf("maintenance: VACUUM done")
+		return
+	}
+
+	var free int
+	if err := db.QueryRowContext(ctx, `PRAGMA freelist_count`).Scan(&free); err != nil {
+		log.Printf("maintenance: freelist error: %v", err)
+		return
+	}
+	total, freed := free, 0
+	for free > 0 && inWindow() && ctx.Err() == nil {
+		// The pragma frees one page per result row, so it has to be stepped to completion.
+		rows, err := db.QueryContext(ctx, fmt.Sprintf(`PRAGMA incremental_vacuum(%d)`, maintenanceVacuumStep))
+		if err == nil {
+			for rows.Next() {
+			}
+			rows.Close()
+			err = rows.Err()
+		}
+		if err != nil {
+			log.Printf("maintenance: incremental vacuum error: %v", err)
+			break
+		}
+		left := free
+		if err := db.QueryRowContext(ctx, `PRAGMA freelist_count`).Scan(&left); err != nil || left >= free {
+			break
+		}
+		freed += free - left
+		free = left
+		log.Printf("maintenance: vacuum freed %d/%d pages", freed, total)
+		select {
+		case <-ctx.Done():
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	if freed > 0 {
+		metricInc("plannie_maintenance_runs_total", "step", "incremental_vacuum")
+	}
+	if free > 0 {
+		log.Printf("maintenance: stopped with %d free pages left", free)
+	}
+}
+
+const (
+	defaultQRSize = 512
+	minQRSize     = 128
+	maxQRSize     = 2048
+)
+
+// eventQRHandler renders the event's share link as a PNG QR code of ?size= pixels for
+// flyers and projectors. The link carries no secret (a passphrase is still asked for when
+// it is opened), so the image needs no auth and can be embedded with a plain <img>.
+func eventQRHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	size := defaultQRSize
+	if v := c.Query("size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < minQRSize || n > maxQRSize {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("size must be between %d and %d", minQRSize, maxQRSize)})
+			return
+		}
+		size = n
+	}
+	id := c.Param("id")
+	var exists int
+	if err := db.QueryRowContext(ctx, `SELECT 1 FROM events WHERE id = ?`, id).Scan(&exists); err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	} else if err != nil {
+		serverError(c, "eventQR: select event", err)
+		return
+	}
+	png, err := qrcode.Encode(appBaseURL()+"/event/"+id, qrcode.Medium, size)
+	if err != nil {
+		serverError(c, "eventQR: encode", err)
+		return
+	}
+	if validSignedRequest(c) {
+		c.Header("Cache-Control", signedCacheControl(c, 24*time.Hour))
+		setSurrogateKeys(c, eventSurrogateKey(id))
+	} else {
+		publicCache(c, 24*time.Hour, 7*24*time.Hour, eventSurrogateKey(id))
+	}
+	c.Data(http.StatusOK, "image/png", png)
+}
+
+// Short links give every event a code that is easy to read aloud, like /e/AB3XK9. Codes
+// use an alphabet without look-alike characters and are matched case-insensitively. Any
+// participant can ask for the event's generated code; organizers can add vanity codes on
+// top, and old codes keep resolving so printed links never break.
+const (
+	shortCodeAlphabet = "23456789ABCDEFGHJKMNPQRSTUVWXYZ"
+	shortCodeLength   = 6
+	maxVanityPerEvent = 5
+	shortCodeAttempts = 8
+)
+
+var vanityCodeRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9-]{2,30}[A-Za-z0-9]$`)
+
+func randomShortCode(length int) (string, error) {
+	buf := make([]byte, length)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	for i, b := range buf {
+		buf[i] = shortCodeAlphabet[int(b)%len(shortCodeAlphabet)]
+	}
+	return string(buf), nil
+}
+
+func shortLinkURL(code string) string {
+	return apiBaseURL() + "/e/" + code
+}
+
+// createShortLinkHandler returns the event's generated short code, creating it on first
+// use. With {"code": "..."} an organizer adds a vanity code instead.
+func createShortLinkHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	eventID := c.Param("id")
+	userID := ctxUserID(c)
+	var input struct {
+		Code string `json:"code"`
+	}
+	_ = c.ShouldBindJSON(&input)
+	input.Code = strings.TrimSpace(input.Code)
+
+	if input.Code != "" {
+		if !vanityCodeRe.MatchString(input.Code) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Code must be 4-32 letters, digits or dashes"})
+			return
+		}
+		if !eventManagerOnly(c, ctx, eventID, "createShortLink") {
+			return
+		}
+		var vanity int
+		_ = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM event_short_links WHERE event_id = ? AND vanity = 1`, eventID).Scan(&vanity)
+		if vanity >= maxVanityPerEvent {
+			c.JSON(http.StatusConflict, gin.H{"error": "Too many custom short links"})
+			return
+		}
+		res, err := db.ExecContext(ctx, `
+			INSERT INTO event_short_links(code, event_id, vanity, created_by, created_at) VALUES (?,?,1,?,?)
+			ON CONFLICT(code) DO NOTHING
+		`, input.Code, eventID, userID, time.Now().UTC())
+		if err != nil {
+			serverError(c, "createShortLink: insert vanity", err)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "Code already taken"})
+			return
+		}
+		c.JSON(http.StatusCreated, gin.H{"code": input.Code, "url": shortLinkURL(input.Code), "vanity": true})
+		return
+	}
+
+	var allowed bool
+	if err := db.QueryRowContext(ctx, `
+		SELECT EXISTS(SELECT 1 FROM events WHERE id = ? AND creator_id = ?)
+			OR EXISTS(SELECT 1 FROM event_participants WHERE event_id = ? AND user_id = ?)
+	`, eventID, userID, eventID, userID).Scan(&allowed); err != nil {
+		serverError(c, "createShortLink: check access", err)
+		return
+	}
+	if !allowed {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	}
+	var code string
+	err := db.QueryRowContext(ctx, `SELECT code FROM event_short_links WHERE event_id = ? AND vanity = 0`, eventID).Scan(&code)
+	if err == nil {
+		c.JSON(http.StatusOK, gin.H{"code": code, "url": shortLinkURL(code), "vanity": false})
+		return
+	} else if err != sql.ErrNoRows {
+		serverError(c, "createShortLink: select", err)
+		return
+	}
+	// 31^6 codes make collisions rare; a few retries (and a longer code if the space ever
+	// gets crowded) keep them from surfacing as errors.
+	for attempt := 0; attempt < shortCodeAttempts; attempt++ {
+		code, err = randomShortCode(shortCodeLength + attempt/4)
+		if err != nil {
+			serverError(c, "createShortLink: random", err)
+			return
+		}
+		res, err := db.ExecContext(ctx, `
+			INSERT INTO event_short_links(code, event_id, vanity, created_by, created_at)
+			SELECT ?, ?, 0, ?, ? WHERE NOT EXISTS (SELECT 1 FROM event_short_links WHERE event_id = ? AND vanity = 0)
+			ON CONFLICT(code) DO NOTHING
+		`, code, eventID, userID, time.Now().UTC(), eventID)
+		if err != nil {
+			serverError(c, "createShortLink: insert", err)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 1 {
+			metricInc("plannie_short_link_attempts_total", "outcome", "created")
+			c.JSON(http.StatusCreated, gin.H{"code": code, "url": shortLinkURL(code), "vanity": false})
+			return
+		}
+		metricInc("plannie_short_link_attempts_total", "outcome", "collision")
+		// a concurrent request may have created the event's code meanwhile
+		if err := db.QueryRowContext(ctx, `SELECT code FROM event_short_links WHERE event_id = ? AND vanity = 0`, eventID).Scan(&code); err == nil {
+			c.JSON(http.StatusOK, gin.H{"code": code, "url": shortLinkURL(code), "vanity": false})
+			return
+		}
+	}
+	serverError(c, "createShortLink: no free code", errors.New("too many collisions"))
+}
+
+func deleteShortLinkHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	eventID := c.Param("id")
+	if !eventManagerOnly(c, ctx, eventID, "deleteShortLink") {
+		return
+	}
+	res, err := db.ExecContext(ctx, `DELETE FROM event_short_links WHERE code = ? AND event_id = ? AND vanity = 1`, c.Param("code"), eventID)
+	if err != nil {
+		serverError(c, "deleteShortLink: delete", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Deleted"})
+}
+
+// lookupShortLink resolves code to an event of tenantID; another tenant's codes are not found.
+func lookupShortLink(ctx context.Context, tenantID, code string) (string, error) {
+	var eventID string
+	err := db.QueryRowContext(ctx, `
+		SELECT l.event_id FROM event_short_links l JOIN events e ON e.id = l.event_id WHERE l.code = ? AND e.tenant_id = ?
+	`, code, tenantID).Scan(&eventID)
+	return eventID, err
+}
+
+// resolveShortLinkHandler lets the web app turn a code into an event ID.
+func resolveShortLinkHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	eventID, err := lookupShortLink(ctx, requestTenant(c), c.Param("code"))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	} else if err != nil {
+		serverError(c, "resolveShortLink: select", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"eventId": eventID, "url": appBaseURL() + "/event/" + eventID})
+}
+
+func shortLinkRedirectHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	eventID, err := lookupShortLink(ctx, requestTenant(c), c.Param("code"))
+	if err == sql.ErrNoRows {
+		c.Redirect(http.StatusFound, appBaseURL()+"/")
+		return
+	} else if err != nil {
+		serverError(c, "shortLinkRedirect: select", err)
+		return
+	}
+	c.Redirect(http.StatusFound, appBaseURL()+"/event/"+eventID)
+}
+
+// Reminder emails carry one-click respond links so participants can answer without signing
+// in. A link is an HMAC over the participant row, the choice and an expiry, so nothing is
+// stored. Choices are "day:YYYY-MM-DD" (every open slot that day) or "none".
+const (
+	respondLinkTTL   = 14 * 24 * time.Hour
+	maxRespondDays   = 7
+	reminderCooldown = 12 * time.Hour
+	respondNone      = "none"
+)
+
+var respondLinkLabels = map[string][2]string{
+	"en": {"I'm free all of %s", "I can't make any of these"},
+	"de": {"Ich habe am %s den ganzen Tag Zeit", "Keiner dieser Termine passt mir"},
+}
+
+func respondToken(participantID, choice string, exp int64) string {
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte("respond:" + participantID + ":" + choice + ":" + strconv.FormatInt(exp, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func respondURL(participantID, choice string, exp int64) string {
+	q := url.Values{}
+	q.Set("p", participantID)
+	q.Set("r", choice)
+	q.Set("x", strconv.FormatInt(exp, 10))
+	q.Set("t", respondToken(participantID, choice, exp))
+	return apiBaseURL() + "/respond?" + q.Encode()
+}
+
+// respondLink returns the participant and choice of a valid, unexpired respond link.
+func respondLink(c *gin.Context) (participantID, choice string, ok bool) {
+	participantID, choice = c.Query("p"), c.Query("r")
+	exp, err := strconv.ParseInt(c.Query("x"), 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return "", "", false
+	}
+	if !hmac.Equal([]byte(c.Query("t")), []byte(respondToken(participantID, choice, exp))) {
+		return "", "", false
+	}
+	return participantID, choice, true
+}
+
+// formatLocalDay formats a day for link labels, e.g. "Saturday, November 7" or "Samstag, 7. November".
+func formatLocalDay(t time.Time, locale string) string {
+	if resolveLocale(locale) == "de" {
+		return fmt.Sprintf("%s, %d. %s", germanWeekdays[t.Weekday()], t.Day(), germanMonths[t.Month()-1])
+	}
+	return t.Format("Monday, January 2")
+}
+
+// openSlotsByDay groups the event's future, enabled slots by local date ("2006-01-02"),
+// or by weekday key ("mon") for weekly polls. days lists them in order.
+func openSlotsByDay(ev Event, now time.Time) (days []string, slots map[string][]string) {
+	disabled := []string{}
+	_ = json.Unmarshal([]byte(ev.DisabledSlots), &disabled)
+	off := map[string]bool{}
+	for _, k := range disabled {
+		off[k] = true
+	}
+	slots = map[string][]string{}
+	for _, s := range eventGridSlots(ev, now) {
+		key, t := s.key, s.start
+		if off[key] || t.Before(now) {
+			continue
+		}
+		day := t.Format("2006-01-02")
+		if ev.Recurrence == recurrenceWeekly {
+			day, _, _ = strings.Cut(key, "-")
+		}
+		if _, ok := slots[day]; !ok {
+			days = append(days, day)
+		}
+		slots[day] = append(slots[day], key)
+	}
+	return days, slots
+}
+
+// formatRespondDay labels a respond-link day from openSlotsByDay: a date, or the weekday
+// key of a weekly poll.
+func formatRespondDay(day string, loc *time.Location, locale string) string {
+	for i, name := range weekdayKeys {
+		if name != day {
+			continue
+		}
+		if resolveLocale(locale) == "de" {
+			return germanWeekdays[i]
+		}
+		return time.Weekday(i).String()
+	}
+	d, _ := time.ParseInLocation("2006-01-02", day, loc)
+	return formatLocalDay(d, locale)
+}
+
+// respondLinksHTML renders the one-click choices for one participant.
+func respondLinksHTML(participantID, locale string, days []string, loc *time.Location, exp int64) string {
+	labels, ok := respondLinkLabels[locale]
+	if !ok {
+		labels = respondLinkLabels["en"]
+	}
+	var b strings.Builder
+	b.WriteString("<ul>")
+	for i, day := range days {
+		if i == maxRespondDays {
+			break
+		}
+		label := fmt.Sprintf(labels[0], formatRespondDay(day, loc, locale))
+		fmt.Fprintf(&b, `<li><a href="%s">%s</a></li>`, html.EscapeString(respondURL(participantID, "day:"+day, exp)), html.EscapeString(label))
+	}
+	fmt.Fprintf(&b, `<li><a href="%s">%s</a></li>`, html.EscapeString(respondURL(participantID, respondNone, exp)), html.EscapeString(labels[1]))
+	b.WriteString("</ul>")
+	return b.String()
+}
+
+// remindHandler emails participants who haven't answered yet (organizers only). Each email
+// carries one-click respond links. An event can be reminded once per reminderCooldown.
+func remindHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	eventID := c.Param("id")
+	if !eventManagerOnly(c, ctx, eventID, "remind") {
+		return
+	}
+	ev := Event{ID: eventID}
+	var organizer string
+	var finalized sql.NullString
+	var remindedAt sql.NullTime
+	err := db.QueryRowContext(ctx, `
+		SELECT e.name, e.date_from, e.date_to, e.duration, e.timezone, e.disabled_slots, e.recurrence, e.finalized_slot, e.reminded_at, u.username
+		FROM events e JOIN users u ON u.id = e.creator_id WHERE e.id = ?
+	`, eventID).Scan(&ev.Name, &ev.DateFrom, &ev.DateTo, &ev.Duration, &ev.Timezone, &ev.DisabledSlots, &ev.Recurrence, &finalized, &remindedAt, &organizer)
+	if err != nil {
+		serverError(c, "remind: select event", err)
+		return
+	}
+	if finalized.Valid {
+		c.JSON(http.StatusConflict, gin.H{"error": "Event is already finalized"})
+		return
+	}
+	now := time.Now().UTC()
+	if remindedAt.Valid && now.Sub(remindedAt.Time) < reminderCooldown {
+		retry := remindedAt.Time.Add(reminderCooldown).Sub(now)
+		c.Header("Retry-After", strconv.Itoa(int(retry.Seconds())+1))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "A reminder was sent recently", "retryAt": remindedAt.Time.Add(reminderCooldown)})
+		return
+	}
+	days, _ := openSlotsByDay(ev, now)
+	if len(days) == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "No open slots left"})
+		return
+	}
+
+	type recipient struct{ participantID, userID, email, locale string }
+	rows, err := db.QueryContext(ctx, `
+		SELECT ep.id, u.id, unseal(u.email), u.locale
+		FROM event_participants ep JOIN users u ON u.id = ep.user_id
+		WHERE ep.event_id = ? AND ep.availability = '{}' AND ep.unavailable_at IS NULL AND u.id <> ?
+			AND u.email_verified = 1 AND u.deactivated_at IS NULL
+	`, eventID, ctxUserID(c))
+	if err != nil {
+		serverError(c, "remind: select participants", err)
+		return
+	}
+	var recipients []recipient
+	for rows.Next() {
+		var r recipient
+		if err := rows.Scan(&r.participantID, &r.userID, &r.email, &r.locale); err != nil {
+			rows.Close()
+			serverError(c, "remind: scan participant", err)
+			return
+		}
+		recipients = append(recipients, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		serverError(c, "remind: participants", err)
+		return
+	}
+	if _, err := db.ExecContext(ctx, `UPDATE events SET reminded_at = ? WHERE id = ?`, now, eventID); err != nil {
+		serverError(c, "remind: update event", err)
+		return
+	}
+
+	loc := eventLocation(ev.Timezone)
+	link := appBaseURL() + "/event/" + eventID
+	exp := now.Add(respondLinkTTL).Unix()
+	sent := 0
+	for _, r := range recipients {
+		locale := resolveLocale(r.locale)
+		links := respondLinksHTML(r.participantID, locale, days, loc, exp)
+		subject, _ := localizedEmail(locale, "reminder", organizer, ev.Name, link, "")
+		_, body := localizedEmail(locale, "reminder", html.EscapeString(organizer), html.EscapeString(ev.Name), link, links)
+		if err := sendNonEssentialEmail(ctx, emailCategoryReminders, r.userID, r.email, subject, body); err != nil {
+			log.Printf("remind: queue for %s: %v", r.userID, err)
+			continue
+		}
+		sent++
+	}
+	c.JSON(http.StatusOK, gin.H{"sent": sent})
+}
+
+// respondPageHandler asks for confirmation instead of recording on GET, because mail
+// scanners prefetch links.
+func respondPageHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	participantID, choice, ok := respondLink(c)
+	if !ok {
+		c.Data(http.StatusBadRequest, "text/html; charset=utf-8", []byte("<p>This link is invalid or has expired.</p>"))
+		return
+	}
+	var eventName, tz string
+	err := db.QueryRowContext(ctx, `
+		SELECT e.name, e.timezone FROM event_participants ep JOIN events e ON e.id = ep.event_id WHERE ep.id = ?
+	`, participantID).Scan(&eventName, &tz)
+	if err == sql.ErrNoRows {
+		c.Data(http.StatusNotFound, "text/html; charset=utf-8", []byte("<p>This event no longer exists.</p>"))
+		return
+	} else if err != nil {
+		serverError(c, "respondPage: select event", err)
+		return
+	}
+	label := respondLinkLabels["en"][1]
+	if day, found := strings.CutPrefix(choice, "day:"); found {
+		label = fmt.Sprintf(respondLinkLabels["en"][0], formatRespondDay(day, eventLocation(tz), "en"))
+	}
+	page := fmt.Sprintf(`<!doctype html><html><body style="font-family:sans-serif">
+<p>Answer for <strong>%s</strong>: %s</p>
+<form method="post"><button type="submit" autofocus>Save my answer</button></form>
+</body></html>`, html.EscapeString(eventName), html.EscapeString(label))
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(page))
+}
+
+// respondHandler records a coarse answer from a respond link. A day adds every open slot of
+// that day to the participant's availability; "none" clears future slots and marks the
+// participant as unavailable so reminders stop.
+func respondHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	participantID, choice, ok := respondLink(c)
+	if !ok {
+		c.Data(http.StatusBadRequest, "text/html; charset=utf-8", []byte("<p>This link is invalid or has expired.</p>"))
+		return
+	}
+	var ev Event
+	var userID sql.NullString
+	var prevJSON string
+	var finalized sql.NullString
+	err := db.QueryRowContext(ctx, `
+		SELECT e.id, e.name, e.date_from, e.date_to, e.duration, e.timezone, e.disabled_slots, e.recurrence, e.finalized_slot, ep.user_id, unseal(ep.availability)
+		FROM event_participants ep JOIN events e ON e.id = ep.event_id WHERE ep.id = ?
+	`, participantID).Scan(&ev.ID, &ev.Name, &ev.DateFrom, &ev.DateTo, &ev.Duration, &ev.Timezone, &ev.DisabledSlots, &ev.Recurrence, &finalized, &userID, &prevJSON)
+	if err == sql.ErrNoRows {
+		c.Data(http.StatusNotFound, "text/html; charset=utf-8", []byte("<p>This event no longer exists.</p>"))
+		return
+	} else if err != nil {
+		serverError(c, "respond: select participant", err)
+		return
+	}
+	if !userID.Valid {
+		c.Data(http.StatusBadRequest, "text/html; charset=utf-8", []byte("<p>This link is invalid or has expired.</p>"))
+		return
+	}
+	if finalized.Valid {
+		c.Data(http.StatusConflict, "text/html; charset=utf-8", []byte("<p>This event is already scheduled.</p>"))
+		return
+	}
+
+	prev := map[string]bool{}
+	_ = json.Unmarshal([]byte(prevJSON), &prev)
+	now := time.Now().UTC()
+	next := map[string]bool{}
+	var unavailableAt interface{}
+	if day, found := strings.CutPrefix(choice, "day:"); found {
+		_, slots := openSlotsByDay(ev, now)
+		if len(slots[day]) == 0 {
+			c.Data(http.StatusConflict, "text/html; charset=utf-8", []byte("<p>That day has no open slots left.</p>"))
+			return
+		}
+		for k, v := range prev {
+			next[k] = v
+		}
+		for _, k := range slots[day] {
+			next[k] = true
+		}
+		metricInc("plannie_respond_links_total", "choice", "day")
+	} else if choice == respondNone {
+		unavailableAt = now
+		metricInc("plannie_respond_links_total", "choice", respondNone)
+	} else {
+		c.Data(http.StatusBadRequest, "text/html; charset=utf-8", []byte("<p>This link is invalid or has expired.</p>"))
+		return
+	}
+	avail, _ := freezePastSlots(prev, next, now)
+	availJSON, _ := json.Marshal(avail)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		serverError(c, "respond: begin", err)
+		return
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE event_participants SET availability = seal(?), unavailable_at = ?, updated_at = ?, draft_availability = '{}', draft_disabled_slots = '[]', draft_updated_at = NULL WHERE id = ?
+	`, string(availJSON), unavailableAt, now, participantID); err != nil {
+		tx.Rollback()
+		serverError(c, "respond: update", err)
+		return
+	}
+	if err := recordAvailabilityChange(ctx, tx, ev.ID, userID.String, userID.String, string(availJSON), "", now); err != nil {
+		tx.Rollback()
+		serverError(c, "respond: record history", err)
+		return
+	}
+	if err := adjustAggregate(ctx, tx, ev.ID, prev, avail); err != nil {
+		tx.Rollback()
+		serverError(c, "respond: adjust aggregate", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		serverError(c, "respond: commit", err)
+		return
+	}
+
+	ssePublish(ev.ID, []byte(`{"type":"event_updated","id":"`+ev.ID+`"}`))
+	checkResponseMilestones(ctx, ev.ID)
+	page := fmt.Sprintf(`<p>Thanks, your answer for <strong>%s</strong> was saved.</p><p><a href="%s">Fine-tune your availability</a></p>`,
+		html.EscapeString(ev.Name), html.EscapeString(appBaseURL()+"/event/"+ev.ID))
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(page))
+}
+
+// Auto-finalize: events with auto_finalize set pick their top-ranked slot on their own once
+// every participant has answered or the response deadline passes, and then run the normal
+// finalization side effects.
+const autoFinalizeInterval = time.Minute
+
+// parseResponseDeadline accepts an RFC 3339 time in the future; "" clears the deadline.
+func parseResponseDeadline(raw string) (sql.NullTime, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return sql.NullTime{}, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, raw)
+	if err != nil {
+		return sql.NullTime{}, errors.New("Invalid response deadline")
+	}
+	if t.Before(time.Now()) {
+		return sql.NullTime{}, errors.New("Response deadline is in the past")
+	}
+	return sql.NullTime{Time: t.UTC(), Valid: true}, nil
+}
+
+// topRankedSlot returns the slot eventSuggestionsHandler ranks first by default: the most
+// participants available, earliest first, skipping slots that have already started as the
+// suggestions do. ok is false when no open slot has any answers.
+func topRankedSlot(ctx context.Context, ev Event) (key string, ok bool, err error) {
+	counts, _, err := tallyAvailability(ctx, ev.ID, ev.DisabledSlots)
+	if err != nil {
+		return "", false, err
+	}
+	best := 0
+	var first time.Time
+	now := time.Now()
+	for _, s := range eventGridSlots(ev, now) {
+		if s.start.Before(now) {
+			continue
+		}
+		if n := counts[s.key]; n > best || (n == best && n > 0 && s.start.Before(first)) {
+			key, best, first = s.key, n, s.start
+		}
+	}
+	return key, best > 0, nil
+}
+
+// autoFinalizeEvent finalizes an event with auto_finalize set. reason is "all_responded"
+// or "deadline". An event without any usable answers has the option switched off so the
+// deadline sweep doesn't retry it forever.
+func autoFinalizeEvent(ctx context.Context, eventID, reason string) {
+	ev := Event{ID: eventID}
+	var auto bool
+	var finalized sql.NullString
+	err := db.QueryRowContext(ctx, `
+		SELECT name, date_from, date_to, duration, timezone, disabled_slots, recurrence, auto_finalize, finalized_slot FROM events WHERE id = ?
+	`, eventID).Scan(&ev.Name, &ev.DateFrom, &ev.DateTo, &ev.Duration, &ev.Timezone, &ev.DisabledSlots, &ev.Recurrence, &auto, &finalized)
+	if err != nil {
+		logIfTimeout(err, "autoFinalize: select event")
+		return
+	}
+	if !auto || finalized.Valid {
+		return
+	}
+	key, ok, err := topRankedSlot(ctx, ev)
+	if err != nil {
+		logIfTimeout(err, "autoFinalize: rank")
+		return
+	}
+	if !ok {
+		if reason == "deadline" {
+			if _, err := db.ExecContext(ctx, `UPDATE events SET auto_finalize = 0 WHERE id = ?`, eventID); err != nil {
+				logIfTimeout(err, "autoFinalize: disable")
+			}
+			metricInc("plannie_auto_finalize_total", "reason", reason, "outcome", "no_answers")
+			log.Printf("autoFinalize: %s has no answers at its deadline, option switched off", eventID)
+			ssePublish(eventID, []byte(`{"type":"event_updated","id":"`+eventID+`"}`))
+		}
+		return
+	}
+	if ev.Recurrence == recurrenceWeekly {
+		// as in finalizeEventHandler, the weekly key starts at its next occurrence
+		t, err := nextWeeklyOccurrence(key, eventLocation(ev.Timezone), time.Now())
+		if err != nil {
+			log.Printf("autoFinalize: %s: %v", eventID, err)
+			return
+		}
+		key = formatSlotKey(t)
+	}
+	done, err := finalizeEvent(ctx, eventID, key, time.Now().UTC(), true)
+	if err != nil {
+		logIfTimeout(err, "autoFinalize: finalize")
+		return
+	}
+	if done {
+		metricInc("plannie_auto_finalize_total", "reason", reason, "outcome", "finalized")
+	}
+}
+
+// autoFinalizeLoop finalizes events whose response deadline has passed.
+func autoFinalizeLoop(ctx context.Context) error {
+	return runEvery(ctx, autoFinalizeInterval, func(ctx context.Context) {
+		rows, err := db.QueryContext(ctx, `
+			SELECT id FROM events WHERE auto_finalize = 1 AND finalized_slot IS NULL AND response_deadline IS NOT NULL AND response_deadline <= ?
+		`, time.Now().UTC())
+		if err != nil {
+			log.Printf("auto finalize: select events: %v", err)
+			return
+		}
+		var ids []string
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err == nil {
+				ids = append(ids, id)
+			}
+		}
+		rows.Close()
+		for _, id := range ids {
+			autoFinalizeEvent(ctx, id, "deadline")
+		}
 	})
 }
 
-func logoutHandler(c *gin.Context) {
+// The shortlist is the organizer's 1-3 candidate slots. With calendarHolds each one also
+// appears as a tentative "HOLD: <event>" entry in the organizer's CalDAV calendar until the
+// event is finalized.
+const maxShortlistSlots = 3
+
+func eventShortlist(ctx context.Context, eventID string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `SELECT slot FROM event_shortlist WHERE event_id = ? ORDER BY slot`, eventID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var slot string
+		if err := rows.Scan(&slot); err != nil {
+			return nil, err
+		}
+		out = append(out, slot)
+	}
+	return out, rows.Err()
+}
+
+// updateShortlistHandler replaces the shortlist: {"slots": [...], "calendarHolds": true}.
+// An empty list clears it and removes the holds.
+func updateShortlistHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	eventID := c.Param("id")
+	var input struct {
+		Slots         []string `json:"slots"`
+		CalendarHolds bool     `json:"calendarHolds"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	if len(input.Slots) > maxShortlistSlots {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d slots", maxShortlistSlots)})
+		return
+	}
+	if !eventManagerOnly(c, ctx, eventID, "updateShortlist") {
+		return
+	}
+	ev := Event{ID: eventID}
+	var finalized sql.NullString
+	err := db.QueryRowContext(ctx, `SELECT date_from, date_to, duration, timezone, disabled_slots, recurrence, finalized_slot FROM events WHERE id = ?`, eventID).
+		Scan(&ev.DateFrom, &ev.DateTo, &ev.Duration, &ev.Timezone, &ev.DisabledSlots, &ev.Recurrence, &finalized)
+	if err != nil {
+		serverError(c, "updateShortlist: select event", err)
+		return
+	}
+	if finalized.Valid {
+		c.JSON(http.StatusConflict, gin.H{"error": "Event is already finalized"})
+		return
+	}
+	now := time.Now().UTC()
+	days, open := openSlotsByDay(ev, now)
+	valid := map[string]bool{}
+	for _, day := range days {
+		for _, k := range open[day] {
+			valid[k] = true
+		}
+	}
+	keys := []string{}
+	seen := map[string]bool{}
+	for _, raw := range input.Slots {
+		if !validSlotKeySyntax(raw) || !valid[normalizeSlotKey(raw)] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid slot: " + raw})
+			return
+		}
+		if k := normalizeSlotKey(raw); !seen[k] {
+			seen[k] = true
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		serverError(c, "updateShortlist: begin", err)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `DELETE FROM event_shortlist WHERE event_id = ?`, eventID); err != nil {
+		serverError(c, "updateShortlist: clear", err)
+		return
+	}
+	for _, k := range keys {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO event_shortlist(event_id, slot, hold, created_at) VALUES (?,?,?,?)`, eventID, k, input.CalendarHolds, now); err != nil {
+			serverError(c, "updateShortlist: insert", err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		serverError(c, "updateShortlist: commit", err)
+		return
+	}
+	ssePublish(eventID, []byte(`{"type":"event_updated","id":"`+eventID+`"}`))
+
+	resp := gin.H{"slots": keys, "calendarHolds": input.CalendarHolds && len(keys) > 0}
+	if input.CalendarHolds && len(keys) > 0 {
+		var tokens int
+		_ = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM caldav_tokens WHERE user_id = ? AND revoked_at IS NULL`, ctxUserID(c)).Scan(&tokens)
+		resp["calendarConnected"] = tokens > 0
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// Attendance: once a finalized event has ended, the organizer can record who attended,
+// came late or didn't show. The organizer of any event sees each participant's record
+// across past events, to judge whether a future slot will reach quorum.
+var attendanceStatuses = map[string]bool{"attended": true, "late": true, "absent": true}
+
+type attendanceStats struct {
+	Events   int     `json:"events"`
+	Attended int     `json:"attended"`
+	Late     int     `json:"late"`
+	Absent   int     `json:"absent"`
+	Rate     float64 `json:"rate"` // share of recorded events attended, late or not
+}
+
+// getAttendanceHandler lists the event's registered participants with their attendance
+// here (when recorded) and their history on other events (organizers only).
+func getAttendanceHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	eventID := c.Param("id")
+	if !eventManagerOnly(c, ctx, eventID, "getAttendance") {
+		return
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT u.id, u.username, COALESCE(a.status, ''),
+			(SELECT COUNT(*) FROM event_attendance h WHERE h.user_id = u.id AND h.event_id <> ? AND h.status = 'attended'),
+			(SELECT COUNT(*) FROM event_attendance h WHERE h.user_id = u.id AND h.event_id <> ? AND h.status = 'late'),
+			(SELECT COUNT(*) FROM event_attendance h WHERE h.user_id = u.id AND h.event_id <> ? AND h.status = 'absent')
+		FROM event_participants ep
+		JOIN users u ON u.id = ep.user_id
+		LEFT JOIN event_attendance a ON a.event_id = ep.event_id AND a.user_id = u.id
+		WHERE ep.event_id = ?
+		ORDER BY u.username
+	`, eventID, eventID, eventID, eventID)
+	if err != nil {
+		serverError(c, "getAttendance: query", err)
+		return
+	}
+	defer rows.Close()
+	out := []gin.H{}
+	for rows.Next() {
+		var uid, username, status string
+		var st attendanceStats
+		if err := rows.Scan(&uid, &username, &status, &st.Attended, &st.Late, &st.Absent); err != nil {
+			serverError(c, "getAttendance: scan", err)
+			return
+		}
+		st.Events = st.Attended + st.Late + st.Absent
+		if st.Events > 0 {
+			st.Rate = float64(st.Attended+st.Late) / float64(st.Events)
+		}
+		entry := gin.H{"userId": uid, "username": username, "history": st}
+		if status != "" {
+			entry["status"] = status
+		}
+		out = append(out, entry)
+	}
+	if err := rows.Err(); err != nil {
+		serverError(c, "getAttendance: rows", err)
+		return
+	}
+	c.JSON(http.StatusOK, out)
+}
+
+// updateAttendanceHandler records attendance after the finalized slot has ended:
+// {"attendance": {"<userId>": "attended" | "late" | "absent" | ""}}. "" clears an entry.
+func updateAttendanceHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	eventID := c.Param("id")
+	var input struct {
+		Attendance map[string]string `json:"attendance"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || len(input.Attendance) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	for _, status := range input.Attendance {
+		if status != "" && !attendanceStatuses[status] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Status must be attended, late or absent"})
+			return
+		}
+	}
+	if !eventManagerOnly(c, ctx, eventID, "updateAttendance") {
+		return
+	}
+	var slot sql.NullString
+	var duration float64
+	if err := db.QueryRowContext(ctx, `SELECT finalized_slot, duration FROM events WHERE id = ?`, eventID).Scan(&slot, &duration); err != nil {
+		serverError(c, "updateAttendance: select event", err)
+		return
+	}
+	start, err := parseSlotKey(slot.String)
+	if !slot.Valid || err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Event is not finalized"})
+		return
+	}
+	if time.Now().Before(start.Add(time.Duration(duration) * time.Minute)) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Event has not ended yet"})
+		return
+	}
+
+	now := time.Now().UTC()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		serverError(c, "updateAttendance: begin", err)
+		return
+	}
+	defer tx.Rollback()
+	for uid, status := range input.Attendance {
+		var member int
+		if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM event_participants WHERE event_id = ? AND user_id = ?`, eventID, uid).Scan(&member); err != nil {
+			serverError(c, "updateAttendance: select participant", err)
+			return
+		}
+		if member == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Not a participant: " + uid})
+			return
+		}
+		if status == "" {
+			_, err = tx.ExecContext(ctx, `DELETE FROM event_attendance WHERE event_id = ? AND user_id = ?`, eventID, uid)
+		} else {
+			_, err = tx.ExecContext(ctx, `
+				INSERT INTO event_attendance(event_id, user_id, status, recorded_by, recorded_at) VALUES (?,?,?,?,?)
+				ON CONFLICT(event_id, user_id) DO UPDATE SET status = excluded.status, recorded_by = excluded.recorded_by, recorded_at = excluded.recorded_at
+			`, eventID, uid, status, ctxUserID(c), now)
+		}
+		if err != nil {
+			serverError(c, "updateAttendance: write", err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		serverError(c, "updateAttendance: commit", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"updated": len(input.Attendance)})
+}
+
+// Guest mode: with guest_mode set, anyone who can open a regular event answers it with a
+// name instead of an account, like on a quick poll. The response is a participant row
+// without user_id, and later edits need the guest token handed out on creation.
+
+// guestModeOpen reports whether the event takes guest responses, writing the error
+// response otherwise.
+func guestModeOpen(c *gin.Context, ctx context.Context, id string) bool {
+	var guestMode bool
+	var passHash, finalized sql.NullString
+	var expiresAt sql.NullTime
+	err := db.QueryRowContext(ctx, `
+		SELECT guest_mode, passphrase_hash, finalized_slot, expires_at FROM events WHERE id = ?
+	`, id).Scan(&guestMode, &passHash, &finalized, &expiresAt)
+	if err == sql.ErrNoRows || (err == nil && expiresAt.Valid) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return false
+	} else if err != nil {
+		serverError(c, "guestMode: select", err)
+		return false
+	}
+	if !eventAccessAllowed(ctx, c, id, passHash, "") {
+		passphraseRequired(c)
+		return false
+	}
+	if !guestMode {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Guest responses are not enabled for this event"})
+		return false
+	}
+	if finalized.Valid {
+		c.JSON(http.StatusConflict, gin.H{"error": "Event is finalized"})
+		return false
+	}
+	return true
+}
+
+// guestRespondHandler adds a named guest response to an event in guest mode. As with quick
+// polls, an optional email lets the guest claim the response with an account later.
+func guestRespondHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	id := c.Param("id")
+	var input struct {
+		Name         string          `json:"name"`
+		Email        string          `json:"email"`
+		Availability map[string]bool `json:"availability"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
+	}
+	input.Name = strings.TrimSpace(input.Name)
+	if input.Name == "" || len(input.Name) > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid name"})
+		return
+	}
+	input.Email = strings.ToLower(strings.TrimSpace(input.Email))
+	if input.Email != "" && !validateEmail(input.Email) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email"})
+		return
+	}
+	avail, ok := cleanAvailability(input.Availability)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid availability"})
+		return
+	}
+	if !guestModeOpen(c, ctx, id) {
+		return
+	}
+	var taken int
+	_ = db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM event_participants WHERE event_id = ? AND user_id IS NULL AND lower(guest_name) = lower(?)
+	`, id, input.Name).Scan(&taken)
+	if taken > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Name already taken", "code": "name_taken"})
+		return
+	}
+	if input.Email != "" {
+		_ = db.QueryRowContext(ctx, `
+			SELECT COUNT(*) FROM event_participants WHERE event_id = ? AND guest_email = COALESCE(blind_index(?), ?)
+		`, id, input.Email, input.Email).Scan(&taken)
+		if taken > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "Email already used for this event", "code": "email_taken"})
+			return
+		}
+	}
+	now := time.Now().UTC()
+	avail, _ = freezePastSlots(nil, avail, now)
+	availJSON, _ := json.Marshal(avail)
+	pid := uuid.NewString()
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO event_participants(id, event_id, user_id, guest_name, guest_email, availability, draft_availability, draft_disabled_slots, draft_updated_at, join_channel, created_at, updated_at)
+		VALUES (?,?,NULL,?,COALESCE(blind_index(?), ?),seal(?),'{}','[]',NULL,?,?,?)
+	`, pid, id, input.Name, input.Email, input.Email, string(availJSON), joinChannelLink, now, now); err != nil {
+		serverError(c, "guestRespond: insert", err)
+		return
+	}
+	if err := recordAvailabilityChange(ctx, db, id, pid, pid, string(availJSON), "", now); err != nil {
+		logIfTimeout(err, "guestRespond: record history")
+	}
+	if err := adjustAggregate(ctx, db, id, nil, avail); err != nil {
+		logIfTimeout(err, "guestRespond: adjust aggregate")
+	}
+	metricInc("plannie_guest_responses_total")
+	ssePublish(id, []byte(`{"type":"event_updated","id":"`+id+`"}`))
+	checkResponseMilestones(ctx, id)
+	c.JSON(http.StatusCreated, gin.H{"participantId": pid, "guestToken": guestToken(id, pid)})
+}
+
+// guestUpdateResponseHandler replaces a guest's availability; needs their guest token.
+func guestUpdateResponseHandler(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
 	defer cancel()
 
+	id, pid := c.Param("id"), c.Param("participantId")
+	if !guestTokenValid(c, id, pid) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid guest token"})
+		return
+	}
 	var input struct {
-		RefreshToken string `json:"refresh_token"`
+		Availability map[string]bool `json:"availability"`
 	}
-	_ = c.BindJSON(&input)
-	if input.RefreshToken == "" {
-		if cookie, err := c.Cookie(refreshCookieName); err == nil {
-			input.RefreshToken = cookie
-		}
+	if err := c.ShouldBindJSON(&input); err != nil || input.Availability == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+		return
 	}
-	clearRefreshCookie(c)
-
-	if input.RefreshToken == "" {
-		c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+	avail, ok := cleanAvailability(input.Availability)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid availability"})
 		return
 	}
-
-	parsed, err := jwt.ParseWithClaims(input.RefreshToken, &jwt.RegisteredClaims{}, func(t *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
-	if err != nil || !parsed.Valid {
-		c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+	if !guestModeOpen(c, ctx, id) {
 		return
 	}
-	claims, _ := parsed.Claims.(*jwt.RegisteredClaims)
-	if claims == nil || claims.ID == "" {
-		c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+	var prevJSON string
+	err := db.QueryRowContext(ctx, `SELECT unseal(availability) FROM event_participants WHERE id = ? AND event_id = ? AND user_id IS NULL`, pid, id).Scan(&prevJSON)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	} else if err != nil {
+		serverError(c, "guestUpdateResponse: select", err)
 		return
 	}
-
-	if _, err := db.ExecContext(ctx, `UPDATE refresh_tokens SET revoked = 1 WHERE id = ?`, claims.ID); err != nil {
-		logIfTimeout(err, "logout: revoke")
+	prev := map[string]bool{}
+	_ = json.Unmarshal([]byte(prevJSON), &prev)
+	now := time.Now().UTC()
+	avail, ignored := freezePastSlots(prev, avail, now)
+	availJSON, _ := json.Marshal(avail)
+	if _, err := db.ExecContext(ctx, `UPDATE event_participants SET availability = seal(?), updated_at = ? WHERE id = ?`, string(availJSON), now, pid); err != nil {
+		serverError(c, "guestUpdateResponse: update", err)
+		return
+	}
+	if err := recordAvailabilityChange(ctx, db, id, pid, pid, string(availJSON), "", now); err != nil {
+		logIfTimeout(err, "guestUpdateResponse: record history")
 	}
+	if err := adjustAggregate(ctx, db, id, prev, avail); err != nil {
+		logIfTimeout(err, "guestUpdateResponse: adjust aggregate")
+	}
+	ssePublish(id, []byte(`{"type":"event_updated","id":"`+id+`"}`))
+	checkResponseMilestones(ctx, id)
+	resp := gin.H{"status": "updated"}
+	if ignored > 0 {
+		resp["pastSlotsIgnored"] = ignored
+	}
+	c.JSON(http.StatusOK, resp)
+}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Logged out"})
+// Shifts: the organizer gives slots a capacity, turning them into shifts that
+// participants claim (volunteer scheduling). The capacity check and the insert are a
+// single statement, so concurrent claims can't overbook a shift.
+const maxShiftCapacity = 1000
+
+// eventMemberOnly allows the owner and registered participants of the event. It
+// reports whether the requester may manage it (owner or organizer).
+func eventMemberOnly(c *gin.Context, ctx context.Context, eventID, where string) (manager, ok bool) {
+	role, err := eventRole(ctx, eventID, ctxUserID(c))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return false, false
+	} else if err != nil {
+		serverError(c, where+": role", err)
+		return false, false
+	}
+	if role == "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Not a participant of this event"})
+		return false, false
+	}
+	return canManageEvent(role), true
 }
 
-func currentUserHandler(c *gin.Context) {
+// getShiftsHandler lists the event's shifts with their fill level; organizers also get
+// the roster of each shift.
+func getShiftsHandler(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
 	defer cancel()
 
+	eventID := c.Param("id")
+	manager, ok := eventMemberOnly(c, ctx, eventID, "getShifts")
+	if !ok {
+		return
+	}
 	userID := ctxUserID(c)
-	var u User
-	if err := db.QueryRowContext(ctx, `SELECT id, username, email, email_verified, created_at, updated_at FROM users WHERE id = ?`, userID).
-		Scan(&u.ID, &u.Username, &u.Email, &u.EmailVerified, &u.CreatedAt, &u.UpdatedAt); err != nil {
-		if err == sql.ErrNoRows {
-			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+	rows, err := db.QueryContext(ctx, `
+		SELECT s.slot, s.capacity, c.user_id, COALESCE(u.username, ''), c.claimed_at
+		FROM event_shifts s
+		LEFT JOIN event_shift_claims c ON c.event_id = s.event_id AND c.slot = s.slot
+		LEFT JOIN users u ON u.id = c.user_id
+		WHERE s.event_id = ?
+		ORDER BY s.slot, c.claimed_at
+	`, eventID)
+	if err != nil {
+		serverError(c, "getShifts: query", err)
+		return
+	}
+	defer rows.Close()
+	out := []gin.H{}
+	var cur gin.H
+	for rows.Next() {
+		var slot string
+		var capacity int
+		var uid sql.NullString
+		var username string
+		var claimedAt sql.NullTime
+		if err := rows.Scan(&slot, &capacity, &uid, &username, &claimedAt); err != nil {
+			serverError(c, "getShifts: scan", err)
 			return
 		}
-		serverError(c, "currentUser: select", err)
+		if cur == nil || cur["slot"] != slot {
+			cur = gin.H{"slot": slot, "capacity": capacity, "claimed": 0, "mine": false}
+			if manager {
+				cur["roster"] = []gin.H{}
+			}
+			out = append(out, cur)
+		}
+		if !uid.Valid {
+			continue
+		}
+		cur["claimed"] = cur["claimed"].(int) + 1
+		if uid.String == userID {
+			cur["mine"] = true
+		}
+		if manager {
+			cur["roster"] = append(cur["roster"].([]gin.H), gin.H{"userId": uid.String, "username": username, "claimedAt": claimedAt.Time})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		serverError(c, "getShifts: rows", err)
 		return
 	}
-
-	c.JSON(http.StatusOK, gin.H{
-		"id":                 u.ID,
-		"username":           u.Username,
-		"email":              u.Email,
-		"emailVerified":      u.EmailVerified,
-		"createdAt":          u.CreatedAt,
-		"updatedAt":          u.UpdatedAt,
-		"verificationExpiry": u.CreatedAt.Add(verifyTTL),
-	})
+	c.JSON(http.StatusOK, out)
 }
 
-func updateUserHandler(c *gin.Context) {
+// updateShiftsHandler sets shift capacities: {"shifts": {"<slot>": capacity}}. A capacity
+// of 0 turns the slot back into a plain slot. Capacities can't drop below the number of
+// claims already made.
+func updateShiftsHandler(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
 	defer cancel()
 
-	userID := ctxUserID(c)
+	eventID := c.Param("id")
 	var input struct {
-		Username    string `json:"username"`
-		OldPassword string `json:"oldPassword"`
-		NewPassword string `json:"newPassword"`
-		Email       string `json:"email"`
+		Shifts map[string]int `json:"shifts"`
 	}
-	if err := c.BindJSON(&input); err != nil {
+	if err := c.ShouldBindJSON(&input); err != nil || len(input.Shifts) == 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
 		return
 	}
-
-	tx, err := db.BeginTx(ctx, nil)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+	if !eventManagerOnly(c, ctx, eventID, "updateShifts") {
 		return
 	}
-	defer tx.Rollback()
-
-	var current User
-	if err := tx.QueryRowContext(ctx, `SELECT id, username, password_hash, email FROM users WHERE id = ?`, userID).
-		Scan(&current.ID, &current.Username, &current.PasswordHash, &current.Email); err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+	ev := Event{ID: eventID}
+	err := db.QueryRowContext(ctx, `SELECT date_from, date_to, duration, timezone, disabled_slots, recurrence FROM events WHERE id = ?`, eventID).
+		Scan(&ev.DateFrom, &ev.DateTo, &ev.Duration, &ev.Timezone, &ev.DisabledSlots, &ev.Recurrence)
+	if err != nil {
+		serverError(c, "updateShifts: select event", err)
 		return
 	}
-
-	updatedUsername := current.Username
-	if input.Username != "" && input.Username != current.Username {
-		if !validateUsername(input.Username) {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid username"})
-			return
-		}
-		var count int
-		if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM users WHERE username = ? AND id <> ?`, input.Username, userID).Scan(&count); err != nil {
-			serverError(c, "updateUser: username count", err)
+	valid := map[string]bool{}
+	for _, s := range eventGridSlots(ev, time.Now()) {
+		valid[s.key] = true
+	}
+	shifts := map[string]int{}
+	for raw, capacity := range input.Shifts {
+		if !validSlotKeySyntax(raw) || !valid[normalizeSlotKey(raw)] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid slot: " + raw})
 			return
 		}
-		if count > 0 {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Username taken"})
+		if capacity < 0 || capacity > maxShiftCapacity {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Capacity must be between 0 and %d", maxShiftCapacity)})
 			return
 		}
-		updatedUsername = input.Username
+		shifts[normalizeSlotKey(raw)] = capacity
 	}
 
-	updatedEmail := current.Email
-	if input.Email != "" && input.Email != current.Email {
-		if !validateEmail(input.Email) {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email"})
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		serverError(c, "updateShifts: begin", err)
+		return
+	}
+	defer tx.Rollback()
+	for slot, capacity := range shifts {
+		var claimed int
+		if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM event_shift_claims WHERE event_id = ? AND slot = ?`, eventID, slot).Scan(&claimed); err != nil {
+			serverError(c, "updateShifts: count claims", err)
 			return
 		}
-		var count int
-		if err := tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM users WHERE email = ? AND id <> ?`, input.Email, userID).Scan(&count); err != nil {
-			serverError(c, "updateUser: email count", err)
+		if capacity < claimed {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Shift %s already has %d claims", slot, claimed), "slot": slot, "claimed": claimed})
 			return
 		}
-		if count > 0 {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Email taken"})
+		if capacity == 0 {
+			_, err = tx.ExecContext(ctx, `DELETE FROM event_shifts WHERE event_id = ? AND slot = ?`, eventID, slot)
+		} else {
+			_, err = tx.ExecContext(ctx, `
+				INSERT INTO event_shifts(event_id, slot, capacity) VALUES (?,?,?)
+				ON CONFLICT(event_id, slot) DO UPDATE SET capacity = excluded.capacity
+			`, eventID, slot, capacity)
+		}
+		if err != nil {
+			serverError(c, "updateShifts: write", err)
 			return
 		}
-		updatedEmail = input.Email
 	}
+	if err := tx.Commit(); err != nil {
+		serverError(c, "updateShifts: commit", err)
+		return
+	}
+	ssePublish(eventID, []byte(`{"type":"event_updated","id":"`+eventID+`"}`))
+	c.JSON(http.StatusOK, gin.H{"updated": len(shifts)})
+}
 
-	updatedHash := current.PasswordHash
-	changedPassword := false
-	if input.NewPassword != "" {
-		if !validatePassword(input.NewPassword) {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Weak password"})
+// claimShiftHandler takes a place on a shift. Claiming a shift twice is a no-op.
+func claimShiftHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	eventID := c.Param("id")
+	if !validSlotKeySyntax(c.Param("slot")) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid slot"})
+		return
+	}
+	slot := normalizeSlotKey(c.Param("slot"))
+	if _, ok := eventMemberOnly(c, ctx, eventID, "claimShift"); !ok {
+		return
+	}
+	if slotIsPast(slot, time.Now()) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Shift has already started"})
+		return
+	}
+	userID := ctxUserID(c)
+	res, err := db.ExecContext(ctx, `
+		INSERT OR IGNORE INTO event_shift_claims(event_id, slot, user_id, claimed_at)
+		SELECT s.event_id, s.slot, ?, ? FROM event_shifts s
+		WHERE s.event_id = ? AND s.slot = ?
+			AND s.capacity > (SELECT COUNT(*) FROM event_shift_claims WHERE event_id = s.event_id AND slot = s.slot)
+	`, userID, time.Now().UTC(), eventID, slot)
+	if err != nil {
+		serverError(c, "claimShift: insert", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		var capacity, claimed, mine int
+		err := db.QueryRowContext(ctx, `
+			SELECT s.capacity,
+				(SELECT COUNT(*) FROM event_shift_claims WHERE event_id = s.event_id AND slot = s.slot),
+				(SELECT COUNT(*) FROM event_shift_claims WHERE event_id = s.event_id AND slot = s.slot AND user_id = ?)
+			FROM event_shifts s WHERE s.event_id = ? AND s.slot = ?
+		`, userID, eventID, slot).Scan(&capacity, &claimed, &mine)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Not a shift"})
 			return
-		}
-		if err := bcrypt.CompareHashAndPassword([]byte(current.PasswordHash), []byte(input.OldPassword)); err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Current password incorrect"})
+		} else if err != nil {
+			serverError(c, "claimShift: select shift", err)
 			return
 		}
-		h, err := bcrypt.GenerateFromPassword([]byte(input.NewPassword), 12)
-		if err != nil {
-			serverError(c, "updateUser: hash new password", err)
+		if mine == 0 {
+			metricInc("plannie_shift_claims_total", "outcome", "full")
+			c.JSON(http.StatusConflict, gin.H{"error": "Shift is full", "code": "shift_full", "capacity": capacity})
 			return
 		}
-		updatedHash = string(h)
-		changedPassword = true
+		c.JSON(http.StatusOK, gin.H{"slot": slot, "claimed": claimed, "capacity": capacity})
+		return
 	}
+	metricInc("plannie_shift_claims_total", "outcome", "claimed")
+	ssePublish(eventID, []byte(`{"type":"event_updated","id":"`+eventID+`"}`))
+	var capacity, claimed int
+	_ = db.QueryRowContext(ctx, `
+		SELECT capacity, (SELECT COUNT(*) FROM event_shift_claims WHERE event_id = ? AND slot = ?) FROM event_shifts WHERE event_id = ? AND slot = ?
+	`, eventID, slot, eventID, slot).Scan(&capacity, &claimed)
+	c.JSON(http.StatusCreated, gin.H{"slot": slot, "claimed": claimed, "capacity": capacity})
+}
 
-	now := time.Now().UTC()
-	if _, err := tx.ExecContext(ctx, `
-		UPDATE users SET username = ?, email = ?, password_hash = ?, updated_at = ? WHERE id = ?
-	`, updatedUsername, updatedEmail, updatedHash, now, userID); err != nil {
-		serverError(c, "updateUser: update user", err)
+// releaseShiftHandler gives up the requester's place on a shift.
+func releaseShiftHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	eventID := c.Param("id")
+	if !validSlotKeySyntax(c.Param("slot")) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid slot"})
+		return
+	}
+	res, err := db.ExecContext(ctx, `DELETE FROM event_shift_claims WHERE event_id = ? AND slot = ? AND user_id = ?`, eventID, normalizeSlotKey(c.Param("slot")), ctxUserID(c))
+	if err != nil {
+		serverError(c, "releaseShift: delete", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No claim on this shift"})
 		return
 	}
+	ssePublish(eventID, []byte(`{"type":"event_updated","id":"`+eventID+`"}`))
+	c.JSON(http.StatusOK, gin.H{"message": "Released"})
+}
 
-	if input.Email != "" && input.Email != current.Email {
-		if _, err := tx.ExecContext(ctx, `UPDATE users SET email_verified = 0 WHERE id = ?`, userID); err != nil {
-			serverError(c, "updateUser: set unverified", err)
-			return
+// Resource booking: with booking_mode set, each slot is a bookable resource (a room, a
+// piece of equipment) held by at most one participant. The primary key on event_bookings
+// rejects the second of two concurrent bookings; whoever loses can join the slot's
+// waitlist and is promoted, first come first served, when the booking is cancelled.
+
+// bookableSlot validates a slot of an event in booking mode, writing the error response
+// otherwise.
+func bookableSlot(c *gin.Context, ctx context.Context, eventID, raw string) (string, bool) {
+	ev := Event{ID: eventID}
+	var bookingMode bool
+	err := db.QueryRowContext(ctx, `SELECT date_from, date_to, duration, timezone, disabled_slots, recurrence, booking_mode FROM events WHERE id = ?`, eventID).
+		Scan(&ev.DateFrom, &ev.DateTo, &ev.Duration, &ev.Timezone, &ev.DisabledSlots, &ev.Recurrence, &bookingMode)
+	if err != nil {
+		serverError(c, "bookableSlot: select event", err)
+		return "", false
+	}
+	if !bookingMode {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Booking is not enabled for this event"})
+		return "", false
+	}
+	if !validSlotKeySyntax(raw) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid slot"})
+		return "", false
+	}
+	days, open := openSlotsByDay(ev, time.Now())
+	for _, day := range days {
+		for _, k := range open[day] {
+			if k == normalizeSlotKey(raw) {
+				return k, true
+			}
 		}
-		if err := tx.Commit(); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": "Slot is not bookable"})
+	return "", false
+}
+
+// getBookingsHandler lists booked slots with their holder and waitlist.
+func getBookingsHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	eventID := c.Param("id")
+	if _, ok := eventMemberOnly(c, ctx, eventID, "getBookings"); !ok {
+		return
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT b.slot, 0, b.user_id, COALESCE(u.username, ''), b.booked_at FROM event_bookings b
+		LEFT JOIN users u ON u.id = b.user_id WHERE b.event_id = ?
+		UNION ALL
+		SELECT w.slot, 1, w.user_id, COALESCE(u.username, ''), w.queued_at FROM event_booking_waitlist w
+		LEFT JOIN users u ON u.id = w.user_id WHERE w.event_id = ?
+		ORDER BY 1, 2, 5
+	`, eventID, eventID)
+	if err != nil {
+		serverError(c, "getBookings: query", err)
+		return
+	}
+	defer rows.Close()
+	out := []gin.H{}
+	bySlot := map[string]gin.H{}
+	for rows.Next() {
+		var slot, uid, username string
+		var waiting bool
+		var at time.Time
+		if err := rows.Scan(&slot, &waiting, &uid, &username, &at); err != nil {
+			serverError(c, "getBookings: scan", err)
 			return
 		}
-		raw, tokenID, err := createEmailToken(userID, "verify", verifyTTL)
-		if err == nil {
-			apiURL := apiBaseURL()
-			verifyURL := fmt.Sprintf("%s/verify-email?tid=%s&t=%s", apiURL, tokenID, raw)
-			html := fmt.Sprintf(`<p>Please verify your new email by clicking <a href="%s">this link</a>. The link expires in 24 hours.</p>`, verifyURL)
-			go func() {
-				if err := sendEmailBrevo(updatedEmail, "Verify your email", html); err != nil {
-					log.Printf("sendEmailBrevo verify-change: %v", err)
-				}
-			}()
+		entry, ok := bySlot[slot]
+		if !ok {
+			entry = gin.H{"slot": slot, "waitlist": []gin.H{}}
+			bySlot[slot] = entry
+			out = append(out, entry)
 		}
-		c.JSON(http.StatusOK, gin.H{"username": updatedUsername})
+		if waiting {
+			entry["waitlist"] = append(entry["waitlist"].([]gin.H), gin.H{"userId": uid, "username": username, "queuedAt": at})
+		} else {
+			entry["bookedBy"] = gin.H{"userId": uid, "username": username, "bookedAt": at}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		serverError(c, "getBookings: rows", err)
 		return
 	}
+	c.JSON(http.StatusOK, out)
+}
 
-	if changedPassword {
-		if _, err := tx.ExecContext(ctx, `UPDATE refresh_tokens SET revoked = 1 WHERE user_id = ?`, userID); err != nil {
-			serverError(c, "updateUser: revoke refresh", err)
-			return
-		}
-	}
+// bookSlotHandler books a slot. A taken slot answers 409, or with {"waitlist": true}
+// queues the requester instead.
+func bookSlotHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
 
-	if err := tx.Commit(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+	eventID := c.Param("id")
+	var input struct {
+		Waitlist bool `json:"waitlist"`
+	}
+	_ = c.ShouldBindJSON(&input)
+	if _, ok := eventMemberOnly(c, ctx, eventID, "bookSlot"); !ok {
 		return
 	}
-
-	c.JSON(http.StatusOK, gin.H{"username": updatedUsername})
+	slot, ok := bookableSlot(c, ctx, eventID, c.Param("slot"))
+	if !ok {
+		return
+	}
+	userID := ctxUserID(c)
+	now := time.Now().UTC()
+	res, err := db.ExecContext(ctx, `
+		INSERT OR IGNORE INTO event_bookings(event_id, slot, user_id, booked_at) VALUES (?,?,?,?)
+	`, eventID, slot, userID, now)
+	if err != nil {
+		serverError(c, "bookSlot: insert", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		metricInc("plannie_bookings_total", "outcome", "booked")
+		ssePublish(eventID, []byte(`{"type":"event_updated","id":"`+eventID+`"}`))
+		c.JSON(http.StatusCreated, gin.H{"slot": slot, "status": "booked"})
+		return
+	}
+	var holder string
+	if err := db.QueryRowContext(ctx, `SELECT user_id FROM event_bookings WHERE event_id = ? AND slot = ?`, eventID, slot).Scan(&holder); err != nil {
+		serverError(c, "bookSlot: select holder", err)
+		return
+	}
+	if holder == userID {
+		c.JSON(http.StatusOK, gin.H{"slot": slot, "status": "booked"})
+		return
+	}
+	if !input.Waitlist {
+		metricInc("plannie_bookings_total", "outcome", "conflict")
+		c.JSON(http.StatusConflict, gin.H{"error": "Slot is already booked", "code": "slot_taken"})
+		return
+	}
+	if _, err := db.ExecContext(ctx, `
+		INSERT OR IGNORE INTO event_booking_waitlist(event_id, slot, user_id, queued_at) VALUES (?,?,?,?)
+	`, eventID, slot, userID, now); err != nil {
+		serverError(c, "bookSlot: waitlist", err)
+		return
+	}
+	var position int
+	_ = db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM event_booking_waitlist
+		WHERE event_id = ? AND slot = ? AND queued_at <= (SELECT queued_at FROM event_booking_waitlist WHERE event_id = ? AND slot = ? AND user_id = ?)
+	`, eventID, slot, eventID, slot, userID).Scan(&position)
+	metricInc("plannie_bookings_total", "outcome", "waitlisted")
+	ssePublish(eventID, []byte(`{"type":"event_updated","id":"`+eventID+`"}`))
+	c.JSON(http.StatusAccepted, gin.H{"slot": slot, "status": "waitlisted", "position": position})
 }
 
-func deleteUserHandler(c *gin.Context) {
+// cancelBookingHandler drops the requester's booking or waitlist place. Organizers can
+// cancel someone else's with ?userId=. A cancelled booking passes to the head of the
+// waitlist, who is told by email.
+func cancelBookingHandler(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
 	defer cancel()
 
-	userID := ctxUserID(c)
-	var in struct {
-		Password string `json:"password"`
+	eventID := c.Param("id")
+	if !validSlotKeySyntax(c.Param("slot")) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid slot"})
+		return
 	}
-	if err := c.BindJSON(&in); err != nil || in.Password == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Password is required"})
+	slot := normalizeSlotKey(c.Param("slot"))
+	manager, ok := eventMemberOnly(c, ctx, eventID, "cancelBooking")
+	if !ok {
 		return
 	}
-
-	var hash string
-	if err := db.QueryRowContext(ctx, `SELECT password_hash FROM users WHERE id = ?`, userID).Scan(&hash); err != nil {
-		if err == sql.ErrNoRows {
-			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+	targetID := ctxUserID(c)
+	if other := c.Query("userId"); other != "" && other != targetID {
+		if !manager {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only organizers can manage this event"})
 			return
 		}
-		serverError(c, "deleteUser: select", err)
-		return
+		targetID = other
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(in.Password)); err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid password"})
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		serverError(c, "cancelBooking: begin", err)
 		return
 	}
-
-	tx, err := db.BeginTx(ctx, nil)
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, `DELETE FROM event_booking_waitlist WHERE event_id = ? AND slot = ? AND user_id = ?`, eventID, slot, targetID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		serverError(c, "cancelBooking: delete waitlist", err)
 		return
 	}
-
-	if _, err := tx.ExecContext(ctx, `DELETE FROM users WHERE id = ?`, userID); err != nil {
-		tx.Rollback()
-		serverError(c, "deleteUser: delete user", err)
+	left, _ := res.RowsAffected()
+	res, err = tx.ExecContext(ctx, `DELETE FROM event_bookings WHERE event_id = ? AND slot = ? AND user_id = ?`, eventID, slot, targetID)
+	if err != nil {
+		serverError(c, "cancelBooking: delete booking", err)
 		return
 	}
-
+	released, _ := res.RowsAffected()
+	if left == 0 && released == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No booking on this slot"})
+		return
+	}
+	promoted := ""
+	if released > 0 {
+		if promoted, err = promoteBookingWaitlist(ctx, tx, eventID, slot); err != nil {
+			serverError(c, "cancelBooking: promote", err)
+			return
+		}
+	}
 	if err := tx.Commit(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		serverError(c, "cancelBooking: commit", err)
 		return
 	}
+	ssePublish(eventID, []byte(`{"type":"event_updated","id":"`+eventID+`"}`))
+	resp := gin.H{"message": "Cancelled"}
+	if promoted != "" {
+		metricInc("plannie_bookings_total", "outcome", "promoted")
+		notifyBookingPromoted(ctx, eventID, slot, promoted)
+		resp["promotedUserId"] = promoted
+	}
+	c.JSON(http.StatusOK, resp)
+}
 
-	clearRefreshCookie(c)
-	c.JSON(http.StatusOK, gin.H{"message": "Account deleted"})
+// promoteBookingWaitlist hands a freed slot to the head of its waitlist and returns who got
+// it, or "" when nobody was waiting.
+func promoteBookingWaitlist(ctx context.Context, tx *sql.Tx, eventID, slot string) (string, error) {
+	var promoted string
+	err := tx.QueryRowContext(ctx, `
+		SELECT user_id FROM event_booking_waitlist WHERE event_id = ? AND slot = ? ORDER BY queued_at LIMIT 1
+	`, eventID, slot).Scan(&promoted)
+	if err == sql.ErrNoRows {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO event_bookings(event_id, slot, user_id, booked_at) VALUES (?,?,?,?)`, eventID, slot, promoted, time.Now().UTC()); err != nil {
+		return "", err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM event_booking_waitlist WHERE event_id = ? AND slot = ? AND user_id = ?`, eventID, slot, promoted); err != nil {
+		return "", err
+	}
+	return promoted, nil
 }
 
-func resendVerifyEmailHandler(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
-	defer cancel()
+// participantRelease is what a departing participant's holds on one event freed up, kept
+// for the notifications sent once the transaction has committed.
+type participantRelease struct {
+	eventID  string
+	promoted map[string]string // booking slot -> user moved up from the waitlist
+	seat     bool              // held a pending or confirmed seat in the confirmation phase
+}
 
-	userID := ctxUserID(c)
-	var u struct {
-		Email         string
-		Username      string
-		EmailVerified bool
-		CreatedAt     time.Time
+// releaseParticipant drops userID's shift claims, confirmation, bookings and waitlist
+// places on eventID, for a participant who leaves, is removed or is erased. Each released
+// booking passes to the head of its waitlist as with cancelBookingHandler. Call notify
+// after tx commits.
+func releaseParticipant(ctx context.Context, tx *sql.Tx, eventID, userID string) (participantRelease, error) {
+	out := participantRelease{eventID: eventID, promoted: map[string]string{}}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM event_shift_claims WHERE event_id = ? AND user_id = ?`, eventID, userID); err != nil {
+		return out, err
 	}
-	if err := db.QueryRowContext(ctx, `SELECT email, username, email_verified, created_at FROM users WHERE id = ?`, userID).
-		Scan(&u.Email, &u.Username, &u.EmailVerified, &u.CreatedAt); err != nil {
-		if err == sql.ErrNoRows {
-			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
-			return
+	res, err := tx.ExecContext(ctx, `
+		DELETE FROM event_confirmations WHERE event_id = ? AND user_id = ? AND status IN ('pending', 'confirmed')
+	`, eventID, userID)
+	if err != nil {
+		return out, err
+	}
+	n, _ := res.RowsAffected()
+	out.seat = n > 0
+	if _, err := tx.ExecContext(ctx, `DELETE FROM event_confirmations WHERE event_id = ? AND user_id = ?`, eventID, userID); err != nil {
+		return out, err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM event_booking_waitlist WHERE event_id = ? AND user_id = ?`, eventID, userID); err != nil {
+		return out, err
+	}
+	rows, err := tx.QueryContext(ctx, `SELECT slot FROM event_bookings WHERE event_id = ? AND user_id = ?`, eventID, userID)
+	if err != nil {
+		return out, err
+	}
+	var slots []string
+	for rows.Next() {
+		var slot string
+		if err := rows.Scan(&slot); err != nil {
+			rows.Close()
+			return out, err
+		}
+		slots = append(slots, slot)
+	}
+	rows.Close()
+	if _, err := tx.ExecContext(ctx, `DELETE FROM event_bookings WHERE event_id = ? AND user_id = ?`, eventID, userID); err != nil {
+		return out, err
+	}
+	for _, slot := range slots {
+		promoted, err := promoteBookingWaitlist(ctx, tx, eventID, slot)
+		if err != nil {
+			return out, err
+		}
+		if promoted != "" {
+			out.promoted[slot] = promoted
 		}
-		serverError(c, "resendVerify: select", err)
-		return
 	}
+	return out, nil
+}
 
-	if u.EmailVerified {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Email already verified"})
+// notify tells everyone who moved up into a released place. A freed confirmation seat
+// goes to the confirmation waitlist like a decline does, while the phase is open and
+// confirm_promote is set; after the deadline closeConfirmation fills it.
+func (r participantRelease) notify(ctx context.Context) {
+	for slot, userID := range r.promoted {
+		metricInc("plannie_bookings_total", "outcome", "promoted")
+		notifyBookingPromoted(ctx, r.eventID, slot, userID)
+	}
+	if !r.seat {
 		return
 	}
-	if time.Since(u.CreatedAt) > verifyTTL {
-		_, _ = db.ExecContext(ctx, `DELETE FROM users WHERE id = ?`, userID)
-		c.JSON(http.StatusGone, gin.H{"error": "Verification window expired. Please register again."})
+	var deadline, closed sql.NullTime
+	var capacity int
+	var promote bool
+	if err := db.QueryRowContext(ctx, `
+		SELECT confirm_deadline, confirm_capacity, confirm_promote, confirm_closed_at FROM events WHERE id = ?
+	`, r.eventID).Scan(&deadline, &capacity, &promote, &closed); err != nil {
+		logIfTimeout(err, "participantRelease: select confirmation")
 		return
 	}
+	if promote && capacity > 0 && !closed.Valid && deadline.Valid && time.Now().Before(deadline.Time) {
+		fillConfirmationSeats(ctx, r.eventID, false)
+	}
+}
 
-	var lastSent time.Time
+// notifyBookingPromoted emails a participant who moved up from the waitlist.
+func notifyBookingPromoted(ctx context.Context, eventID, slot, userID string) {
+	var name, tz, email, locale string
+	var verified bool
 	err := db.QueryRowContext(ctx, `
-		SELECT created_at FROM email_tokens
-		WHERE user_id = ? AND kind = 'verify'
-		ORDER BY created_at DESC
-		LIMIT 1
-	`, userID).Scan(&lastSent)
-	if err != nil && err != sql.ErrNoRows {
-		serverError(c, "resendVerify: last token", err)
+		SELECT e.name, e.timezone, unseal(u.email), u.email_verified, u.locale FROM events e, users u WHERE e.id = ? AND u.id = ?
+	`, eventID, userID).Scan(&name, &tz, &email, &verified, &locale)
+	if err != nil {
+		logIfTimeout(err, "bookingPromoted: select")
 		return
 	}
-	if err == nil {
-		elapsed := time.Since(lastSent)
-		if elapsed < verifyResendCooldown {
-			remain := verifyResendCooldown - elapsed
-			c.JSON(http.StatusTooManyRequests, gin.H{
-				"error":            "Please wait before resending verification email",
-				"retry_after_s":    int(remain.Seconds()) + 1,
-				"cooldown_minutes": int(verifyResendCooldown.Minutes()),
-			})
-			return
-		}
+	if !verified || accountDeactivated(ctx, userID) {
+		return
 	}
-
-	raw, tokenID, err := createEmailToken(userID, "verify", verifyTTL)
+	t, err := parseSlotKey(slot)
 	if err != nil {
-		serverError(c, "resendVerify: token", err)
-		return
+		// a weekly poll's slot, booked from its next occurrence on
+		t, err = nextWeeklyOccurrence(slot, eventLocation(tz), time.Now())
 	}
-	apiURL := apiBaseURL()
-	verifyURL := fmt.Sprintf("%s/verify-email?tid=%s&t=%s", apiURL, tokenID, raw)
-	html := fmt.Sprintf(`<p>Hello %s,</p><p>Please verify your email by clicking <a href="%s">this link</a>. The link expires in 24 hours.</p>`, u.Username, verifyURL)
-	go func() {
-		if err := sendEmailBrevo(u.Email, "Verify your account", html); err != nil {
-			log.Printf("sendEmailBrevo resend: %v", err)
-		}
-	}()
-	c.JSON(http.StatusOK, gin.H{"message": "Verification email sent"})
-}
-
-func sseHandler(c *gin.Context) {
-	flusher, ok := c.Writer.(http.Flusher)
-	if !ok {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Streaming unsupported"})
+	if err != nil {
 		return
 	}
+	locale = resolveLocale(locale)
+	when, link := formatLocalTime(t.In(eventLocation(tz)), locale), appBaseURL()+"/event/"+eventID
+	subject, _ := localizedEmail(locale, "booking_promoted", name, when, link)
+	_, body := localizedEmail(locale, "booking_promoted", html.EscapeString(name), when, link)
+	if err := sendEmail(userID, email, subject, body); err != nil {
+		log.Printf("bookingPromoted: queue email: %v", err)
+	}
+}
 
-	eventID := c.Param("id")
-
-	c.Header("Content-Type", "text/event-stream")
-	c.Header("Cache-Control", "no-cache")
-	c.Header("Connection", "keep-alive")
-
-	sub := sseSubscribe(eventID)
-	defer sseUnsubscribe(eventID, sub)
-
-	fmt.Fprintf(c.Writer, "event: ping\ndata: ok\n\n")
-	flusher.Flush()
-
-	ping := time.NewTicker(ssePingEvery)
-	defer ping.Stop()
-
-	notify := c.Writer.CloseNotify()
-	ctx := c.Request.Context()
+// Two-phase scheduling: once an event is finalized the organizer can open a confirmation
+// phase in which participants confirm or decline the chosen slot by confirm_deadline.
+// With a capacity, seats go to participants who marked the slot available first and the
+// rest wait in line. With confirm_promote set, declines and non-confirmers at the
+// deadline free their seats for the next in line, who get confirmGracePeriod to answer.
+// The organizer is alerted about everyone who let the deadline pass.
+const (
+	confirmLoopInterval = time.Minute
+	confirmGracePeriod  = 24 * time.Hour
+)
 
-	for {
-		select {
-		case <-notify:
-			return
-		case <-ctx.Done():
-			return
-		case <-ping.C:
-			fmt.Fprintf(c.Writer, "event: ping\ndata: ok\n\n")
-			flusher.Flush()
-		case msg, ok := <-sub.ch:
-			if !ok {
-				return
-			}
-			fmt.Fprintf(c.Writer, "data: %s\n\n", msg)
-			flusher.Flush()
-		}
+// resetConfirmation drops a confirmation phase when the finalized slot changes.
+func resetConfirmation(ctx context.Context, eventID string) {
+	if _, err := db.ExecContext(ctx, `DELETE FROM event_confirmations WHERE event_id = ?`, eventID); err != nil {
+		logIfTimeout(err, "confirmation: reset rows")
+	}
+	if _, err := db.ExecContext(ctx, `UPDATE events SET confirm_deadline = NULL, confirm_closed_at = NULL WHERE id = ?`, eventID); err != nil {
+		logIfTimeout(err, "confirmation: reset event")
 	}
 }
 
-func createEventHandler(c *gin.Context) {
+// startConfirmationHandler opens (or restarts) the confirmation phase:
+// {"deadline": RFC3339, "capacity": 0 for unlimited, "promoteWaitlist": bool}.
+func startConfirmationHandler(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
 	defer cancel()
 
-	userID := ctxUserID(c)
-	var input map[string]interface{}
-	if err := c.BindJSON(&input); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+	eventID := c.Param("id")
+	var input struct {
+		Deadline        string `json:"deadline"`
+		Capacity        int    `json:"capacity"`
+		PromoteWaitlist bool   `json:"promoteWaitlist"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || input.Capacity < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
 		return
 	}
-
-	id, _ := input["id"].(string)
-	if id == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing event id"})
+	deadline, err := parseResponseDeadline(input.Deadline)
+	if err != nil || !deadline.Valid {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A future deadline is required"})
 		return
 	}
-
-	name, _ := input["name"].(string)
-	drRaw, _ := input["dateRange"].(map[string]interface{})
-	from, _ := drRaw["from"].(string)
-	to, _ := drRaw["to"].(string)
-	dur, _ := input["duration"].(float64)
-	tz, _ := input["timezone"].(string)
-	if name == "" || from == "" || to == "" || dur <= 0 || tz == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing fields"})
+	if !eventManagerOnly(c, ctx, eventID, "startConfirmation") {
 		return
 	}
-
-	partsRaw, _ := input["participants"].([]interface{})
-	disabledRaw, _ := input["disabledSlots"].([]interface{})
-	disabledJSON, err := json.Marshal(disabledRaw)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+	var slot sql.NullString
+	if err := db.QueryRowContext(ctx, `SELECT finalized_slot FROM events WHERE id = ?`, eventID).Scan(&slot); err != nil {
+		serverError(c, "startConfirmation: select event", err)
+		return
+	}
+	start, err := parseSlotKey(slot.String)
+	if !slot.Valid || err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Event is not finalized"})
+		return
+	}
+	if !deadline.Time.Before(start) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Deadline must be before the event starts"})
 		return
 	}
 
-	availability := map[string]bool{}
-	availJSON, err := json.Marshal(availability)
+	rows, err := db.QueryContext(ctx, `
+		SELECT ep.user_id, unseal(ep.availability) FROM event_participants ep JOIN events e ON e.id = ep.event_id
+		WHERE ep.event_id = ? AND ep.user_id IS NOT NULL AND ep.user_id <> COALESCE(e.creator_id, '')
+		ORDER BY ep.created_at
+	`, eventID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		serverError(c, "startConfirmation: participants", err)
+		return
+	}
+	var available, others []string
+	for rows.Next() {
+		var uid, availJSON string
+		if err := rows.Scan(&uid, &availJSON); err != nil {
+			rows.Close()
+			serverError(c, "startConfirmation: scan", err)
+			return
+		}
+		avail := map[string]bool{}
+		_ = json.Unmarshal([]byte(availJSON), &avail)
+		if avail[slot.String] {
+			available = append(available, uid)
+		} else {
+			others = append(others, uid)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		serverError(c, "startConfirmation: rows", err)
 		return
 	}
+	ordered := append(available, others...)
 
+	now := time.Now().UTC()
 	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		serverError(c, "startConfirmation: begin", err)
 		return
 	}
-	now := time.Now().UTC()
-
-	if _, err := tx.ExecContext(ctx, `
-		INSERT INTO events(id, creator_id, name, date_from, date_to, duration, timezone, disabled_slots, created_at, updated_at)
-		VALUES (?,?,?,?,?,?,?,?,?,?)
-	`, id, userID, name, from, to, dur, tz, string(disabledJSON), now, now); err != nil {
-		tx.Rollback()
-		logIfTimeout(err, "createEvent: insert event")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create event"})
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, `DELETE FROM event_confirmations WHERE event_id = ?`, eventID); err != nil {
+		serverError(c, "startConfirmation: clear", err)
 		return
 	}
-
+	var pending []string
+	for i, uid := range ordered {
+		status := "pending"
+		if input.Capacity > 0 && i >= input.Capacity {
+			status = "waitlisted"
+		} else {
+			pending = append(pending, uid)
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO event_confirmations(event_id, user_id, status, position, updated_at) VALUES (?,?,?,?,?)
+		`, eventID, uid, status, i, now); err != nil {
+			serverError(c, "startConfirmation: insert", err)
+			return
+		}
+	}
 	if _, err := tx.ExecContext(ctx, `
-		INSERT INTO event_participants(id, event_id, user_id, availability, draft_availability, draft_disabled_slots, draft_updated_at, created_at, updated_at)
-		VALUES (?,?,?,?,?,?,NULL,?,?)
-	`, uuid.NewString(), id, userID, string(availJSON), "{}", "[]", now, now); err != nil {
-		tx.Rollback()
-		logIfTimeout(err, "createEvent: insert self participant")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not add participant"})
+		UPDATE events SET confirm_deadline = ?, confirm_capacity = ?, confirm_promote = ?, confirm_closed_at = NULL WHERE id = ?
+	`, deadline.Time, input.Capacity, input.PromoteWaitlist, eventID); err != nil {
+		serverError(c, "startConfirmation: update event", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		serverError(c, "startConfirmation: commit", err)
 		return
 	}
+	notifyConfirmation(ctx, eventID, pending, "confirm_request")
+	ssePublish(eventID, []byte(`{"type":"event_updated","id":"`+eventID+`"}`))
+	c.JSON(http.StatusOK, gin.H{"pending": len(pending), "waitlisted": len(ordered) - len(pending), "deadline": deadline.Time})
+}
 
-	for _, p := range partsRaw {
-		if m, ok := p.(map[string]interface{}); ok {
-			pid, _ := m["id"].(string)
-			if pid != "" && pid != userID {
-				if _, err := tx.ExecContext(ctx, `
-					INSERT OR IGNORE INTO event_participants(id, event_id, user_id, availability, draft_availability, draft_disabled_slots, draft_updated_at, created_at, updated_at)
-					VALUES (?,?,?,?,?,?,NULL,?,?)
-				`, uuid.NewString(), id, pid, "{}", "{}", "[]", now, now); err != nil {
-					tx.Rollback()
-					logIfTimeout(err, "createEvent: insert other participant")
-					c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not add participant"})
-					return
-				}
-			}
+// getConfirmationHandler shows the confirmation phase to the event's members.
+func getConfirmationHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	eventID := c.Param("id")
+	if _, ok := eventMemberOnly(c, ctx, eventID, "getConfirmation"); !ok {
+		return
+	}
+	var deadline, closedAt sql.NullTime
+	var capacity int
+	var promote bool
+	if err := db.QueryRowContext(ctx, `
+		SELECT confirm_deadline, confirm_capacity, confirm_promote, confirm_closed_at FROM events WHERE id = ?
+	`, eventID).Scan(&deadline, &capacity, &promote, &closedAt); err != nil {
+		serverError(c, "getConfirmation: select event", err)
+		return
+	}
+	if !deadline.Valid {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No confirmation phase"})
+		return
+	}
+	rows, err := db.QueryContext(ctx, `
+		SELECT ec.user_id, COALESCE(u.username, ''), ec.status, ec.updated_at FROM event_confirmations ec
+		LEFT JOIN users u ON u.id = ec.user_id
+		WHERE ec.event_id = ? ORDER BY ec.position
+	`, eventID)
+	if err != nil {
+		serverError(c, "getConfirmation: query", err)
+		return
+	}
+	defer rows.Close()
+	list := []gin.H{}
+	for rows.Next() {
+		var uid, username, status string
+		var updatedAt time.Time
+		if err := rows.Scan(&uid, &username, &status, &updatedAt); err != nil {
+			serverError(c, "getConfirmation: scan", err)
+			return
 		}
+		list = append(list, gin.H{"userId": uid, "username": username, "status": status, "updatedAt": updatedAt})
 	}
-
-	if err := tx.Commit(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+	if err := rows.Err(); err != nil {
+		serverError(c, "getConfirmation: rows", err)
 		return
 	}
-
-	ssePublish(id, []byte(`{"type":"event_updated","id":"`+id+`"}`))
-
-	c.JSON(http.StatusCreated, gin.H{
-		"id":            id,
-		"creatorId":     userID,
-		"name":          name,
-		"dateRange":     gin.H{"from": from, "to": to},
-		"duration":      dur,
-		"timezone":      tz,
-		"participants":  []interface{}{map[string]interface{}{"id": userID, "name": ""}},
-		"disabledSlots": disabledRaw,
-	})
+	resp := gin.H{"deadline": deadline.Time, "capacity": capacity, "promoteWaitlist": promote, "participants": list}
+	if closedAt.Valid {
+		resp["closedAt"] = closedAt.Time
+	}
+	c.JSON(http.StatusOK, resp)
 }
 
-func getEventHandler(c *gin.Context) {
+// confirmAttendanceHandler records {"attending": bool} for the requester before the
+// deadline. A decline may pass the seat to the waitlist; coming back after that needs a
+// free seat.
+func confirmAttendanceHandler(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
 	defer cancel()
 
-	id := c.Param("id")
-	requesterID := optionalAuth(c)
-
-	var ev Event
+	eventID := c.Param("id")
+	userID := ctxUserID(c)
+	var input struct {
+		Attending *bool `json:"attending"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil || input.Attending == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+	var status string
+	var deadline sql.NullTime
+	var capacity int
+	var promote bool
 	err := db.QueryRowContext(ctx, `
-		SELECT id, creator_id, name, date_from, date_to, duration, timezone, disabled_slots
-		FROM events WHERE id = ?
-	`, id).Scan(&ev.ID, &ev.CreatorID, &ev.Name, &ev.DateFrom, &ev.DateTo, &ev.Duration, &ev.Timezone, &ev.DisabledSlots)
+		SELECT ec.status, e.confirm_deadline, e.confirm_capacity, e.confirm_promote
+		FROM event_confirmations ec JOIN events e ON e.id = ec.event_id
+		WHERE ec.event_id = ? AND ec.user_id = ?
+	`, eventID, userID).Scan(&status, &deadline, &capacity, &promote)
 	if err == sql.ErrNoRows {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		c.JSON(http.StatusNotFound, gin.H{"error": "No confirmation requested"})
 		return
 	} else if err != nil {
-		logIfTimeout(err, "getEvent: select")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		serverError(c, "confirmAttendance: select", err)
 		return
 	}
+	if !deadline.Valid || time.Now().After(deadline.Time) {
+		c.JSON(http.StatusConflict, gin.H{"error": "The confirmation deadline has passed"})
+		return
+	}
+	if status == "waitlisted" {
+		c.JSON(http.StatusConflict, gin.H{"error": "You are on the waitlist", "code": "waitlisted"})
+		return
+	}
+	next := "declined"
+	if *input.Attending {
+		next = "confirmed"
+	}
+	// Coming back from a decline only works while a seat is free; the check and the update
+	// are one statement so a concurrent promotion can't overfill the event.
+	res, err := db.ExecContext(ctx, `
+		UPDATE event_confirmations SET status = ?, updated_at = ?
+		WHERE event_id = ? AND user_id = ? AND (
+			? <> 'confirmed' OR status <> 'declined' OR ? = 0
+			OR (SELECT COUNT(*) FROM event_confirmations WHERE event_id = ? AND status IN ('pending', 'confirmed')) < ?
+		)
+	`, next, time.Now().UTC(), eventID, userID, next, capacity, eventID, capacity)
+	if err != nil {
+		serverError(c, "confirmAttendance: update", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Your place went to the waitlist", "code": "no_seat"})
+		return
+	}
+	metricInc("plannie_confirmations_total", "status", next)
+	if next == "declined" && promote && capacity > 0 {
+		fillConfirmationSeats(ctx, eventID, false)
+	}
+	ssePublish(eventID, []byte(`{"type":"event_updated","id":"`+eventID+`"}`))
+	c.JSON(http.StatusOK, gin.H{"status": next})
+}
 
-	parts := []map[string]interface{}{}
-	var draftAvail map[string]bool
-	var draftDisabled []string
-	var draftUpdatedAt *time.Time
-
+// fillConfirmationSeats promotes waitlisted participants into free seats and asks them to
+// confirm. After the deadline (extend) the phase gets confirmGracePeriod more so they can
+// answer. It returns how many were promoted.
+func fillConfirmationSeats(ctx context.Context, eventID string, extend bool) int {
+	now := time.Now().UTC()
 	rows, err := db.QueryContext(ctx, `
-		SELECT ep.user_id, u.username, ep.availability, ep.draft_availability, ep.draft_disabled_slots, ep.draft_updated_at
-		FROM event_participants ep
-		JOIN users u ON u.id = ep.user_id
-		WHERE ep.event_id = ?
-	`, id)
+		SELECT user_id FROM event_confirmations
+		WHERE event_id = ? AND status = 'waitlisted'
+		ORDER BY position
+		LIMIT MAX(0, (SELECT confirm_capacity FROM events WHERE id = ?)
+			- (SELECT COUNT(*) FROM event_confirmations WHERE event_id = ? AND status IN ('pending', 'confirmed')))
+	`, eventID, eventID, eventID)
 	if err != nil {
-		logIfTimeout(err, "getEvent: query participants")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
-		return
+		logIfTimeout(err, "confirmation: select waitlist")
+		return 0
 	}
-	defer rows.Close()
+	var ids []string
 	for rows.Next() {
-		var uid, uname, availJSON, draftAvailJSON, draftDisabledJSON string
-		var draftAt sql.NullTime
-		if err := rows.Scan(&uid, &uname, &availJSON, &draftAvailJSON, &draftDisabledJSON, &draftAt); err == nil {
-			partAvail := map[string]bool{}
-			if err := json.Unmarshal([]byte(availJSON), &partAvail); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
-				return
-			}
-			parts = append(parts, map[string]interface{}{
-				"id":           uid,
-				"name":         uname,
-				"availability": partAvail,
-			})
-			if requesterID != "" && uid == requesterID {
-				_ = json.Unmarshal([]byte(draftAvailJSON), &draftAvail)
-				_ = json.Unmarshal([]byte(draftDisabledJSON), &draftDisabled)
-				if draftAt.Valid {
-					t := draftAt.Time
-					draftUpdatedAt = &t
-				}
-			}
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
 		}
 	}
-	if err := rows.Err(); err != nil {
-		logIfTimeout(err, "getEvent: rows err")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+	rows.Close()
+	var promoted []string
+	for _, id := range ids {
+		res, err := db.ExecContext(ctx, `
+			UPDATE event_confirmations SET status = 'pending', updated_at = ? WHERE event_id = ? AND user_id = ? AND status = 'waitlisted'
+		`, now, eventID, id)
+		if err != nil {
+			logIfTimeout(err, "confirmation: promote")
+			continue
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			promoted = append(promoted, id)
+		}
+	}
+	if len(promoted) == 0 {
+		return 0
+	}
+	if extend {
+		if _, err := db.ExecContext(ctx, `UPDATE events SET confirm_deadline = ? WHERE id = ?`, now.Add(confirmGracePeriod), eventID); err != nil {
+			logIfTimeout(err, "confirmation: extend deadline")
+		}
+	}
+	metricAdd("plannie_confirmation_promotions_total", float64(len(promoted)))
+	notifyConfirmation(ctx, eventID, promoted, "confirm_promoted")
+	return len(promoted)
+}
+
+// notifyConfirmation emails participants asking them to confirm (confirm_request or
+// confirm_promoted).
+func notifyConfirmation(ctx context.Context, eventID string, userIDs []string, key string) {
+	if len(userIDs) == 0 {
 		return
 	}
-	disabled := []string{}
-	if err := json.Unmarshal([]byte(ev.DisabledSlots), &disabled); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+	var name, tz string
+	var slot sql.NullString
+	var deadline sql.NullTime
+	if err := db.QueryRowContext(ctx, `SELECT name, timezone, finalized_slot, confirm_deadline FROM events WHERE id = ?`, eventID).
+		Scan(&name, &tz, &slot, &deadline); err != nil {
+		logIfTimeout(err, "confirmation: select event")
 		return
 	}
-
-	resp := gin.H{
-		"id":            ev.ID,
-		"creatorId":     ev.CreatorID,
-		"name":          ev.Name,
-		"dateRange":     gin.H{"from": ev.DateFrom, "to": ev.DateTo},
-		"duration":      ev.Duration,
-		"timezone":      ev.Timezone,
-		"participants":  parts,
-		"disabledSlots": disabled,
+	start, err := parseSlotKey(slot.String)
+	if err != nil || !deadline.Valid {
+		return
 	}
-	if requesterID != "" && (len(draftAvail) > 0 || len(draftDisabled) > 0) {
-		resp["draft"] = gin.H{
-			"availability":  draftAvail,
-			"disabledSlots": draftDisabled,
-			"updatedAt": func() *time.Time {
-				if draftUpdatedAt != nil {
-					return draftUpdatedAt
-				}
-				return nil
-			}(),
+	loc, link := eventLocation(tz), appBaseURL()+"/event/"+eventID
+	for _, uid := range userIDs {
+		var email, locale string
+		var verified bool
+		if err := db.QueryRowContext(ctx, `SELECT unseal(email), email_verified, locale FROM users WHERE id = ?`, uid).Scan(&email, &verified, &locale); err != nil {
+			logIfTimeout(err, "confirmation: select user")
+			continue
+		}
+		if !verified || accountDeactivated(ctx, uid) {
+			continue
+		}
+		locale = resolveLocale(locale)
+		when, until := formatLocalTime(start.In(loc), locale), formatLocalTime(deadline.Time.In(loc), locale)
+		subject, _ := localizedEmail(locale, key, name, when, until, link)
+		_, body := localizedEmail(locale, key, html.EscapeString(name), when, until, link)
+		if err := sendEmail(uid, email, subject, body); err != nil {
+			log.Printf("confirmation: queue email: %v", err)
 		}
 	}
-
-	c.JSON(http.StatusOK, resp)
 }
 
-func updateEventHandler(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
-	defer cancel()
-
-	id := c.Param("id")
-	userID := ctxUserID(c)
-
-	var input EventUpdate
-	if err := c.ShouldBindJSON(&input); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
+// closeConfirmation handles a passed deadline: pending participants expire, the organizer
+// is alerted, and with promotion on their seats go to the waitlist. The phase closes once
+// nobody is left to ask.
+func closeConfirmation(ctx context.Context, eventID string) {
+	now := time.Now().UTC()
+	rows, err := db.QueryContext(ctx, `
+		SELECT COALESCE(u.username, '') FROM event_confirmations ec LEFT JOIN users u ON u.id = ec.user_id
+		WHERE ec.event_id = ? AND ec.status = 'pending' ORDER BY ec.position
+	`, eventID)
+	if err != nil {
+		logIfTimeout(err, "confirmation: select pending")
 		return
 	}
-	if input.ID == "" || input.Name == "" || input.DateRange == nil || input.DateRange["from"] == "" || input.DateRange["to"] == "" || input.Duration <= 0 || input.Timezone == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing required fields"})
+	var missing []string
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err == nil {
+			missing = append(missing, username)
+		}
+	}
+	rows.Close()
+	if _, err := db.ExecContext(ctx, `
+		UPDATE event_confirmations SET status = 'expired', updated_at = ? WHERE event_id = ? AND status = 'pending'
+	`, now, eventID); err != nil {
+		logIfTimeout(err, "confirmation: expire")
+		return
+	}
+	if len(missing) > 0 {
+		metricAdd("plannie_confirmations_expired_total", float64(len(missing)))
+		alertMissingConfirmations(ctx, eventID, missing)
+	}
+	var promote bool
+	_ = db.QueryRowContext(ctx, `SELECT confirm_promote FROM events WHERE id = ?`, eventID).Scan(&promote)
+	if promote && fillConfirmationSeats(ctx, eventID, true) > 0 {
+		ssePublish(eventID, []byte(`{"type":"event_updated","id":"`+eventID+`"}`))
 		return
 	}
+	if _, err := db.ExecContext(ctx, `UPDATE events SET confirm_closed_at = ? WHERE id = ?`, now, eventID); err != nil {
+		logIfTimeout(err, "confirmation: close")
+	}
+	ssePublish(eventID, []byte(`{"type":"event_updated","id":"`+eventID+`"}`))
+}
 
-	var creatorID string
-	err := db.QueryRowContext(ctx, `SELECT creator_id FROM events WHERE id = ?`, id).Scan(&creatorID)
-	if err == sql.ErrNoRows {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+// alertMissingConfirmations emails the organizer the participants who didn't confirm.
+func alertMissingConfirmations(ctx context.Context, eventID string, usernames []string) {
+	var creatorID, name, email, locale string
+	var verified bool
+	err := db.QueryRowContext(ctx, `
+		SELECT u.id, e.name, unseal(u.email), u.email_verified, u.locale FROM events e JOIN users u ON u.id = e.creator_id WHERE e.id = ?
+	`, eventID).Scan(&creatorID, &name, &email, &verified, &locale)
+	if err != nil {
+		logIfTimeout(err, "confirmation: select creator")
 		return
-	} else if err != nil {
-		logIfTimeout(err, "updateEvent: select creator")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+	}
+	if !verified {
 		return
 	}
+	var list strings.Builder
+	list.WriteString("<ul>")
+	for _, u := range usernames {
+		list.WriteString("<li>" + html.EscapeString(u) + "</li>")
+	}
+	list.WriteString("</ul>")
+	locale = resolveLocale(locale)
+	link := appBaseURL() + "/event/" + eventID
+	subject, _ := localizedEmail(locale, "confirm_missing", name, len(usernames), "", link)
+	_, body := localizedEmail(locale, "confirm_missing", html.EscapeString(name), len(usernames), list.String(), link)
+	if err := sendNonEssentialEmail(ctx, emailCategoryProgress, creatorID, email, subject, body); err != nil {
+		log.Printf("confirmation: queue alert: %v", err)
+	}
+}
 
-	isCreator := creatorID == userID
-	if isCreator {
-		disabledJSON, err := json.Marshal(input.DisabledSlots)
+// confirmationDeadlineLoop closes confirmation phases whose deadline has passed.
+func confirmationDeadlineLoop(ctx context.Context) error {
+	return runEvery(ctx, confirmLoopInterval, func(ctx context.Context) {
+		rows, err := db.QueryContext(ctx, `
+			SELECT id FROM events WHERE confirm_deadline IS NOT NULL AND confirm_deadline <= ? AND confirm_closed_at IS NULL AND finalized_slot IS NOT NULL
+		`, time.Now().UTC())
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+			log.Printf("confirmation deadlines: select events: %v", err)
 			return
 		}
-		tx, err := db.BeginTx(ctx, nil)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
-			return
+		var ids []string
+		for rows.Next() {
+			var id string
+			if err := rows.Scan(&id); err == nil {
+				ids = append(ids, id)
+			}
 		}
-		now := time.Now().UTC()
+		rows.Close()
+		for _, id := range ids {
+			closeConfirmation(ctx, id)
+		}
+	})
+}
 
-		if _, err := tx.ExecContext(ctx, `
-			UPDATE events SET name = ?, date_from = ?, date_to = ?, duration = ?, timezone = ?, disabled_slots = ?, updated_at = ?
-			WHERE id = ?
-		`, input.Name, input.DateRange["from"], input.DateRange["to"], input.Duration, input.Timezone, string(disabledJSON), now, id); err != nil {
-			tx.Rollback()
-			logIfTimeout(err, "updateEvent: update event")
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+// Security log shipping. With LOG_SHIP_URL set, audit events (admin actions, availability
+// edits) and auth failures (bad logins, lockouts, IP bans, rejected tokens) are shipped to
+// a central log store:
+//
+//	syslog+udp://host:514, syslog+tcp://host:601   RFC 5424 lines carrying the event as JSON
+//	http(s)://...                                   bulk POST; LOG_SHIP_FORMAT picks the body:
+//	                                                "json" (an array, default), "hec" (Splunk
+//	                                                HTTP Event Collector) or "loki" (push API)
+//
+// LOG_SHIP_TOKEN is sent as a bearer token ("Splunk <token>" for hec). Events wait in a
+// bounded buffer (LOG_SHIP_BUFFER, default 10000) and leave in batches. A failing sink is
+// retried with backoff while the buffer fills; once it is full new events are dropped and
+// counted, so a slow collector never slows down requests.
+type securityEvent struct {
+	Time   time.Time              `json:"time"`
+	Kind   string                 `json:"kind"`
+	Actor  string                 `json:"actor,omitempty"`
+	IP     string                 `json:"ip,omitempty"`
+	Fields map[string]interface{} `json:"fields,omitempty"`
+}
+
+var (
+	logShipURL       *url.URL
+	logShipFormat    = "json"
+	logShipToken     string
+	logShipQueue     chan securityEvent
+	logShipBatchSize = 500
+	logShipInterval  = 2 * time.Second
+	logShipMaxDelay  = time.Minute
+)
+
+func configureLogShipping() error {
+	raw := strings.TrimSpace(os.Getenv("LOG_SHIP_URL"))
+	if raw == "" {
+		logShipURL, logShipQueue = nil, nil
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("LOG_SHIP_URL: invalid URL %q", raw)
+	}
+	switch u.Scheme {
+	case "syslog+udp", "syslog+tcp", "http", "https":
+	default:
+		return fmt.Errorf("LOG_SHIP_URL: unsupported scheme %q (syslog+udp, syslog+tcp, http, https)", u.Scheme)
+	}
+	if f := strings.ToLower(os.Getenv("LOG_SHIP_FORMAT")); f != "" {
+		switch f {
+		case "json", "hec", "loki":
+			logShipFormat = f
+		default:
+			return fmt.Errorf("unknown LOG_SHIP_FORMAT %q", f)
+		}
+	}
+	size := getEnvInt("LOG_SHIP_BUFFER", 10000)
+	if size <= 0 {
+		return errors.New("LOG_SHIP_BUFFER must be positive")
+	}
+	logShipURL = u
+	logShipToken = os.Getenv("LOG_SHIP_TOKEN")
+	logShipQueue = make(chan securityEvent, size)
+	return nil
+}
+
+// shipSecurityEvent queues an event for the log sink without ever blocking.
+func shipSecurityEvent(kind, actor, ip string, fields map[string]interface{}) {
+	if logShipQueue == nil {
+		return
+	}
+	select {
+	case logShipQueue <- securityEvent{Time: time.Now().UTC(), Kind: kind, Actor: actor, IP: ip, Fields: fields}:
+	default:
+		metricInc("plannie_log_ship_dropped_total", "reason", "buffer_full")
+	}
+}
+
+// auditAdminActions ships every state-changing admin request with its outcome.
+func auditAdminActions() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		if c.Request.Method == http.MethodGet {
 			return
 		}
+		shipSecurityEvent("admin_action", ctxUserID(c), clientIP(c), map[string]interface{}{
+			"method": c.Request.Method,
+			"route":  c.FullPath(),
+			"path":   c.Request.URL.Path,
+			"status": c.Writer.Status(),
+		})
+	}
+}
 
-		if len(input.Participants) > 0 {
-			if _, err := tx.ExecContext(ctx, `DELETE FROM event_participants WHERE event_id = ?`, id); err != nil {
-				tx.Rollback()
-				logIfTimeout(err, "updateEvent: delete participants")
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
-				return
+// logShipLoop sends batches until shutdown, then makes one last attempt at what is left.
+func logShipLoop(ctx context.Context) error {
+	ticker := time.NewTicker(logShipInterval)
+	defer ticker.Stop()
+	var batch []securityEvent
+	delay := time.Second
+	var retryAt time.Time
+	flush := func(ctx context.Context) {
+		if len(batch) == 0 || time.Now().Before(retryAt) {
+			return
+		}
+		if err := sendSecurityEvents(ctx, batch); err != nil {
+			metricInc("plannie_log_ship_errors_total")
+			log.Printf("log shipping: %d events not sent, retrying in %s: %v", len(batch), delay, err)
+			retryAt = time.Now().Add(delay)
+			if delay *= 2; delay > logShipMaxDelay {
+				delay = logShipMaxDelay
 			}
-			for _, p := range input.Participants {
-				pid, _ := p["id"].(string)
-				if pid == "" {
-					continue
-				}
-				avail := map[string]bool{}
-				if raw, ok := p["availability"].(map[string]interface{}); ok {
-					for k, v := range raw {
-						if b, ok := v.(bool); ok && b {
-							avail[k] = true
-						}
-					}
-				}
-				availJSON, err := json.Marshal(avail)
-				if err != nil {
-					tx.Rollback()
-					c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
-					return
-				}
-				if _, err := tx.ExecContext(ctx, `
-					INSERT INTO event_participants(id, event_id, user_id, availability, draft_availability, draft_disabled_slots, draft_updated_at, created_at, updated_at)
-					VALUES (?,?,?,?,?,?,NULL,?,?)
-				`, uuid.NewString(), id, pid, string(availJSON), "{}", "[]", now, now); err != nil {
-					tx.Rollback()
-					logIfTimeout(err, "updateEvent: insert participants")
-					c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
-					return
+			return
+		}
+		metricAdd("plannie_log_ship_sent_total", float64(len(batch)))
+		batch, delay, retryAt = nil, time.Second, time.Time{}
+	}
+	for {
+		// Once a full batch is waiting (for a retry, say), take no more events: the buffer
+		// absorbs them and overflows into drops.
+		var in chan securityEvent
+		if len(batch) < logShipBatchSize {
+			in = logShipQueue
+		}
+		select {
+		case <-ctx.Done():
+			for len(logShipQueue) > 0 {
+				batch = append(batch, <-logShipQueue)
+			}
+			if len(batch) > 0 {
+				sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				retryAt = time.Time{}
+				flush(sctx)
+				cancel()
+				if len(batch) > 0 {
+					log.Printf("log shipping: %d events not sent at shutdown", len(batch))
 				}
 			}
+			return nil
+		case ev := <-in:
+			batch = append(batch, ev)
+			if len(batch) >= logShipBatchSize {
+				flush(ctx)
+			}
+		case <-ticker.C:
+			flush(ctx)
+		}
+	}
+}
+
+func sendSecurityEvents(ctx context.Context, events []securityEvent) error {
+	if strings.HasPrefix(logShipURL.Scheme, "syslog+") {
+		return sendSecurityEventsSyslog(ctx, events)
+	}
+	var body []byte
+	var err error
+	switch logShipFormat {
+	case "hec":
+		var buf bytes.Buffer
+		for _, ev := range events {
+			b, _ := json.Marshal(map[string]interface{}{
+				"time":       float64(ev.Time.UnixNano()) / 1e9,
+				"source":     "plannie",
+				"sourcetype": "plannie:security",
+				"event":      ev,
+			})
+			buf.Write(b)
+			buf.WriteByte('\n')
+		}
+		body = buf.Bytes()
+	case "loki":
+		streams := map[string][][2]string{}
+		var kinds []string
+		for _, ev := range events {
+			line, _ := json.Marshal(ev)
+			if _, ok := streams[ev.Kind]; !ok {
+				kinds = append(kinds, ev.Kind)
+			}
+			streams[ev.Kind] = append(streams[ev.Kind], [2]string{strconv.FormatInt(ev.Time.UnixNano(), 10), string(line)})
+		}
+		var push []map[string]interface{}
+		for _, k := range kinds {
+			push = append(push, map[string]interface{}{"stream": map[string]string{"app": "plannie", "kind": k}, "values": streams[k]})
+		}
+		body, err = json.Marshal(map[string]interface{}{"streams": push})
+	default:
+		body, err = json.Marshal(events)
+	}
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, logShipURL.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if logShipToken != "" {
+		if logShipFormat == "hec" {
+			req.Header.Set("Authorization", "Splunk "+logShipToken)
+		} else {
+			req.Header.Set("Authorization", "Bearer "+logShipToken)
 		}
+	}
+	resp, err := outboundClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("sink answered %s", resp.Status)
+	}
+	return nil
+}
 
-		if err := tx.Commit(); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
-			return
+// sendSecurityEventsSyslog writes RFC 5424 messages (facility authpriv) over one
+// connection, newline-framed on TCP.
+func sendSecurityEventsSyslog(ctx context.Context, events []securityEvent) error {
+	network := strings.TrimPrefix(logShipURL.Scheme, "syslog+")
+	conn, err := (&net.Dialer{Timeout: 5 * time.Second}).DialContext(ctx, network, logShipURL.Host)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_ = conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	host, _ := os.Hostname()
+	if host == "" {
+		host = "-"
+	}
+	for _, ev := range events {
+		severity := 5 // notice
+		if ev.Kind == "auth_failure" || ev.Kind == "account_locked" || ev.Kind == "ip_banned" {
+			severity = 4 // warning
+		}
+		msg, _ := json.Marshal(ev)
+		line := fmt.Sprintf("<%d>1 %s %s plannie - %s - %s\n", 10*8+severity, ev.Time.Format(time.RFC3339Nano), host, ev.Kind, msg)
+		if _, err := io.WriteString(conn, line); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		ssePublish(id, []byte(`{"type":"event_updated","id":"`+id+`"}`))
-		c.JSON(http.StatusOK, gin.H{"status": "updated"})
+func doctorLogShipping(r *doctorReport) {
+	if err := configureLogShipping(); err != nil {
+		r.fail("log shipping", err.Error(), "fix LOG_SHIP_URL / LOG_SHIP_FORMAT / LOG_SHIP_BUFFER")
 		return
 	}
-
-	var count int
-	_ = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM event_participants WHERE event_id = ? AND user_id = ?`, id, userID).Scan(&count)
-	if count == 0 {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Forbidden: Not a participant"})
+	if logShipURL == nil {
+		r.ok("log shipping", "off (set LOG_SHIP_URL to ship audit events and auth failures to a SIEM)")
 		return
 	}
+	r.ok("log shipping", fmt.Sprintf("shipping to %s://%s (format %s)", logShipURL.Scheme, logShipURL.Host, logShipFormat))
+}
 
-	var incomingAvail map[string]bool
-	for _, p := range input.Participants {
-		if pid, ok := p["id"].(string); ok && pid == userID {
-			if raw, ok := p["availability"].(map[string]interface{}); ok {
-				incomingAvail = map[string]bool{}
-				for k, v := range raw {
-					if b, ok := v.(bool); ok && b {
-						incomingAvail[k] = true
-					}
-				}
-			}
-			break
-		}
+// Realtime fan-out. ssePublish reaches the streams of this process only; with
+// REALTIME_BACKEND=redis every publish also goes out over Redis pub/sub (REDIS_URL,
+// redis:// or rediss://, channel REDIS_CHANNEL, default "plannie:sse") so replicas behind a
+// load balancer deliver it to their own subscribers and drop the event from their caches.
+// Messages carry the sender's instance ID so it skips its own echo. Publishing never
+// blocks a request: messages wait in a bounded buffer and are dropped (and counted) while
+// Redis is unreachable; clients refetch on reconnect and cached events expire after
+// EVENT_CACHE_TTL_SECONDS anyway. The in-memory hub stays the default.
+type realtimeMessage struct {
+	Origin    string `json:"o"`
+	EventID   string `json:"e"`
+	Payload   string `json:"p"`
+	Ephemeral bool   `json:"x,omitempty"`
+}
+
+var (
+	realtimeBackend  = "memory"
+	realtimeOut      chan []byte
+	realtimeInstance = uuid.NewString()
+	redisURL         *url.URL
+	redisChannel     = "plannie:sse"
+	redisMaxBackoff  = 30 * time.Second
+)
+
+func configureRealtime() error {
+	realtimeBackend, realtimeOut, redisURL = strings.ToLower(os.Getenv("REALTIME_BACKEND")), nil, nil
+	switch realtimeBackend {
+	case "", "memory":
+		realtimeBackend = "memory"
+		return nil
+	case "redis":
+	default:
+		return fmt.Errorf("unknown REALTIME_BACKEND %q (memory, redis)", realtimeBackend)
 	}
-	if incomingAvail == nil {
-		c.JSON(http.StatusOK, gin.H{"status": "no changes"})
-		return
+	raw := os.Getenv("REDIS_URL")
+	if raw == "" {
+		raw = "redis://localhost:6379"
 	}
-	availJSON, err := json.Marshal(incomingAvail)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
-		return
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Host == "" {
+		return fmt.Errorf("REDIS_URL: invalid URL %q", raw)
 	}
-	now := time.Now().UTC()
-	if _, err := db.ExecContext(ctx, `
-		UPDATE event_participants SET availability = ?, updated_at = ?, draft_availability = '{}', draft_disabled_slots = '[]', draft_updated_at = NULL WHERE event_id = ? AND user_id = ?
-	`, string(availJSON), now, id, userID); err != nil {
-		logIfTimeout(err, "updateEvent: update availability")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+	if v := os.Getenv("REDIS_CHANNEL"); v != "" {
+		redisChannel = v
+	}
+	size := getEnvInt("REALTIME_BUFFER", 1000)
+	if size <= 0 {
+		return errors.New("REALTIME_BUFFER must be positive")
+	}
+	redisURL = u
+	realtimeOut = make(chan []byte, size)
+	return nil
+}
+
+// realtimeForward queues a publish for the other replicas. Ephemeral messages go to the
+// receivers' preview channel instead of being treated as a change.
+func realtimeForward(eventID string, payload []byte, ephemeral bool) {
+	if realtimeOut == nil {
 		return
 	}
+	msg, _ := json.Marshal(realtimeMessage{Origin: realtimeInstance, EventID: eventID, Payload: string(payload), Ephemeral: ephemeral})
+	select {
+	case realtimeOut <- msg:
+	default:
+		metricInc("plannie_realtime_dropped_total")
+	}
+}
 
-	ssePublish(id, []byte(`{"type":"event_updated","id":"`+id+`"}`))
-	c.JSON(http.StatusOK, gin.H{"status": "updated"})
+// realtimeLoop keeps a publishing and a subscribed Redis connection until shutdown.
+func realtimeLoop(ctx context.Context) error {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		redisReconnect(ctx, "publish", redisPublishLoop)
+	}()
+	go func() {
+		defer wg.Done()
+		redisReconnect(ctx, "subscribe", redisSubscribeLoop)
+	}()
+	wg.Wait()
+	return nil
 }
 
-func deleteEventHandler(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
-	defer cancel()
+// redisReconnect reruns run with exponential backoff until ctx ends.
+func redisReconnect(ctx context.Context, name string, run func(ctx context.Context) error) {
+	delay := time.Second
+	for {
+		started := time.Now()
+		err := run(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) > time.Minute {
+			delay = time.Second
+		}
+		metricInc("plannie_realtime_reconnects_total", "conn", name)
+		log.Printf("realtime: redis %s connection lost, retrying in %s: %v", name, delay, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > redisMaxBackoff {
+			delay = redisMaxBackoff
+		}
+	}
+}
 
-	id := c.Param("id")
-	userID := ctxUserID(c)
+func redisPublishLoop(ctx context.Context) error {
+	rc, err := dialRedis(ctx)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg := <-realtimeOut:
+			if _, err := rc.do("PUBLISH", redisChannel, string(msg)); err != nil {
+				metricInc("plannie_realtime_dropped_total")
+				return err
+			}
+			metricInc("plannie_realtime_published_total")
+		}
+	}
+}
 
-	var creatorID string
-	err := db.QueryRowContext(ctx, `SELECT creator_id FROM events WHERE id = ?`, id).Scan(&creatorID)
-	if err == sql.ErrNoRows {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
-		return
-	} else if err != nil {
-		logIfTimeout(err, "deleteEvent: select creator")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
-		return
+func redisSubscribeLoop(ctx context.Context) error {
+	rc, err := dialRedis(ctx)
+	if err != nil {
+		return err
 	}
-	if creatorID != userID {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Only creator can delete"})
-		return
+	defer rc.Close()
+	if _, err := rc.do("SUBSCRIBE", redisChannel); err != nil {
+		return err
 	}
-	if _, err := db.ExecContext(ctx, `DELETE FROM events WHERE id = ?`, id); err != nil {
-		logIfTimeout(err, "deleteEvent: delete")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
-		return
+	// Closing the connection is the only way to interrupt the blocking read below.
+	stop := context.AfterFunc(ctx, func() { rc.Close() })
+	defer stop()
+	for {
+		reply, err := rc.read()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 3 || parts[0] != "message" {
+			continue
+		}
+		data, _ := parts[2].(string)
+		var m realtimeMessage
+		if json.Unmarshal([]byte(data), &m) != nil || m.Origin == realtimeInstance || m.EventID == "" {
+			continue
+		}
+		metricInc("plannie_realtime_received_total")
+		if m.Ephemeral {
+			sseDeliverPreview(m.EventID, []byte(m.Payload))
+			continue
+		}
+		sseDeliver(m.EventID, []byte(m.Payload))
 	}
-
-	ssePublish(id, []byte(`{"type":"event_deleted","id":"`+id+`"}`))
-	c.JSON(http.StatusOK, gin.H{"message": "Deleted"})
 }
 
-func updateEventDraftHandler(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
-	defer cancel()
-
-	eventID := c.Param("id")
-	userID := ctxUserID(c)
+// redisConn is a minimal RESP2 client: enough for AUTH, PING, PUBLISH and SUBSCRIBE.
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
 
-	var creatorID string
-	err := db.QueryRowContext(ctx, `SELECT creator_id FROM events WHERE id = ?`, eventID).Scan(&creatorID)
-	if err == sql.ErrNoRows {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
-		return
-	} else if err != nil {
-		serverError(c, "updateDraft: select event", err)
-		return
+func dialRedis(ctx context.Context) (*redisConn, error) {
+	d := &net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}
+	var conn net.Conn
+	var err error
+	if redisURL.Scheme == "rediss" {
+		conn, err = (&tls.Dialer{NetDialer: d, Config: &tls.Config{ServerName: redisURL.Hostname(), MinVersion: tls.VersionTLS12}}).DialContext(ctx, "tcp", redisURL.Host)
+	} else {
+		conn, err = d.DialContext(ctx, "tcp", redisURL.Host)
 	}
-
-	var exists int
-	_ = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM event_participants WHERE event_id = ? AND user_id = ?`, eventID, userID).Scan(&exists)
-	if exists == 0 {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Not a participant"})
-		return
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{Conn: conn, r: bufio.NewReader(conn)}
+	if redisURL.User != nil {
+		if pass, ok := redisURL.User.Password(); ok {
+			args := []string{"AUTH", pass}
+			if user := redisURL.User.Username(); user != "" {
+				args = []string{"AUTH", user, pass}
+			}
+			if _, err := rc.do(args...); err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("auth: %w", err)
+			}
+		}
 	}
+	return rc, nil
+}
 
-	var input struct {
-		Availability  map[string]bool `json:"availability"`
-		DisabledSlots []string        `json:"disabledSlots"`
+// do sends a command and reads its reply within a few seconds.
+func (rc *redisConn) do(args ...string) (interface{}, error) {
+	_ = rc.SetDeadline(time.Now().Add(5 * time.Second))
+	defer rc.SetDeadline(time.Time{})
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
 	}
-	if err := c.BindJSON(&input); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON"})
-		return
+	if _, err := io.WriteString(rc.Conn, b.String()); err != nil {
+		return nil, err
 	}
+	return rc.read()
+}
 
-	availJSON, err := json.Marshal(input.Availability)
+// read parses one reply; error replies come back as errors.
+func (rc *redisConn) read() (interface{}, error) {
+	line, err := rc.r.ReadString('\n')
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid availability"})
-		return
+		return nil, err
 	}
-	disabledJSON := "[]"
-	if userID == creatorID {
-		if input.DisabledSlots == nil {
-			input.DisabledSlots = []string{}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, errors.New("redis: " + line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
 		}
-		if b, err := json.Marshal(input.DisabledSlots); err == nil {
-			disabledJSON = string(b)
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rc.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		out := make([]interface{}, n)
+		for i := range out {
+			if out[i], err = rc.read(); err != nil {
+				return nil, err
+			}
 		}
+		return out, nil
 	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
 
-	now := time.Now().UTC()
-	if _, err := db.ExecContext(ctx, `
-		UPDATE event_participants
-		SET draft_availability = ?, draft_disabled_slots = ?, draft_updated_at = ?
-		WHERE event_id = ? AND user_id = ?
-	`, string(availJSON), disabledJSON, now, eventID, userID); err != nil {
-		serverError(c, "updateDraft: update", err)
+func doctorRealtime(ctx context.Context, r *doctorReport) {
+	if err := configureRealtime(); err != nil {
+		r.fail("realtime", err.Error(), "set REALTIME_BACKEND to memory or redis, REDIS_URL to redis://host:port and REALTIME_BUFFER to a positive size")
 		return
 	}
-
-	c.JSON(http.StatusOK, gin.H{"status": "draft saved"})
+	if redisURL == nil {
+		r.ok("realtime", "in-memory hub (fine for a single instance; set REALTIME_BACKEND=redis for replicas)")
+		return
+	}
+	rc, err := dialRedis(ctx)
+	if err == nil {
+		_, err = rc.do("PING")
+		rc.Close()
+	}
+	if err != nil {
+		r.fail("realtime", fmt.Sprintf("redis at %s: %v", redisURL.Host, err), "check REDIS_URL and that Redis is reachable")
+		return
+	}
+	r.ok("realtime", fmt.Sprintf("redis at %s answers, channel %q", redisURL.Host, redisChannel))
 }
 
-func deleteEventDraftHandler(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
-	defer cancel()
-
-	eventID := c.Param("id")
-	userID := ctxUserID(c)
+// IP allow and deny lists. Rules are CIDRs attached to a route group: "global" covers every
+// request, "admin" the /admin API and "metrics" the /metrics endpoint. A request is
+// refused when its address matches a deny rule of the group, or when the group has allow
+// rules and none of them match. Global rules are checked for every request, group rules
+// on top of them. The address is the client IP after trusted-proxy resolution, so set
+// TRUSTED_PROXIES when the server sits behind a load balancer; otherwise any peer can
+// pick its own address with X-Forwarded-For.
+const (
+	ipRuleGroupGlobal  = "global"
+	ipRuleGroupAdmin   = "admin"
+	ipRuleGroupMetrics = "metrics"
+)
 
-	if _, err := db.ExecContext(ctx, `
-		UPDATE event_participants
-		SET draft_availability = '{}', draft_disabled_slots = '[]', draft_updated_at = NULL
-		WHERE event_id = ? AND user_id = ?
-	`, eventID, userID); err != nil {
-		serverError(c, "deleteDraft: update", err)
-		return
-	}
-	c.JSON(http.StatusOK, gin.H{"status": "draft cleared"})
+var ipRuleGroups = []string{ipRuleGroupGlobal, ipRuleGroupAdmin, ipRuleGroupMetrics}
+
+type ipRule struct {
+	ID        string    `json:"id"`
+	Group     string    `json:"group"`
+	Action    string    `json:"action"`
+	CIDR      string    `json:"cidr"`
+	Note      string    `json:"note"`
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+	network   *net.IPNet
 }
 
-func inviteHandler(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
-	defer cancel()
+var (
+	ipRulesMu sync.RWMutex
+	ipRules   = map[string][]ipRule{}
+)
 
-	id := c.Param("id")
-	creatorID := ctxUserID(c)
-	var body struct {
-		Username string `json:"username"`
+// trustedProxies is TRUSTED_PROXIES: nil keeps gin's default of trusting every peer,
+// "none" trusts no proxy and uses the socket address.
+var trustedProxies []string
+
+func configureTrustedProxies() error {
+	raw := strings.TrimSpace(os.Getenv("TRUSTED_PROXIES"))
+	trustedProxies = nil
+	switch raw {
+	case "":
+		return nil
+	case "none":
+		trustedProxies = []string{}
+		return nil
 	}
-	if err := c.BindJSON(&body); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
-		return
+	for _, p := range strings.Split(raw, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if _, err := parseIPRuleCIDR(p); err != nil {
+			return fmt.Errorf("TRUSTED_PROXIES: %q is not an IP or CIDR", p)
+		}
+		trustedProxies = append(trustedProxies, p)
 	}
+	return nil
+}
 
-	var evCreator string
-	if err := db.QueryRowContext(ctx, `SELECT creator_id FROM events WHERE id = ?`, id).Scan(&evCreator); err != nil {
-		if err == sql.ErrNoRows {
-			c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
-			return
+// parseIPRuleCIDR accepts a CIDR or a bare address, which becomes a /32 or /128.
+func parseIPRuleCIDR(raw string) (*net.IPNet, error) {
+	if !strings.Contains(raw, "/") {
+		ip := net.ParseIP(raw)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", raw)
 		}
-		logIfTimeout(err, "invite: select creator")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
-		return
-	}
-	if evCreator != creatorID {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Only creator can invite"})
-		return
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
 	}
+	_, network, err := net.ParseCIDR(raw)
+	return network, err
+}
 
-	var targetID string
-	var emailVerified int
-	err := db.QueryRowContext(ctx, `SELECT id, email_verified FROM users WHERE username = ?`, body.Username).Scan(&targetID, &emailVerified)
-	if err == sql.ErrNoRows {
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
-		return
-	} else if err != nil {
-		logIfTimeout(err, "invite: select user")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
-		return
+func loadIPRules(ctx context.Context) error {
+	rows, err := db.QueryContext(ctx, `SELECT id, route_group, action, cidr, note, created_by, created_at FROM ip_rules ORDER BY created_at, id`)
+	if err != nil {
+		return err
 	}
-
-	if emailVerified == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "User must verify their email first"})
-		return
+	defer rows.Close()
+	loaded := map[string][]ipRule{}
+	for rows.Next() {
+		var rule ipRule
+		if err := rows.Scan(&rule.ID, &rule.Group, &rule.Action, &rule.CIDR, &rule.Note, &rule.CreatedBy, &rule.CreatedAt); err != nil {
+			return err
+		}
+		if rule.network, err = parseIPRuleCIDR(rule.CIDR); err != nil {
+			log.Printf("ip rules: ignoring %s: %v", rule.ID, err)
+			continue
+		}
+		loaded[rule.Group] = append(loaded[rule.Group], rule)
 	}
-
-	if targetID == creatorID {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot invite yourself"})
-		return
+	if err := rows.Err(); err != nil {
+		return err
 	}
+	ipRulesMu.Lock()
+	ipRules = loaded
+	ipRulesMu.Unlock()
+	return nil
+}
 
-	var exists int
-	_ = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM event_participants WHERE event_id = ? AND user_id = ?`, id, targetID).Scan(&exists)
-	if exists > 0 {
-		c.JSON(http.StatusConflict, gin.H{"error": "User already in event"})
-		return
+// ipAllowedByRules applies the deny-then-allow evaluation to one group's rules.
+func ipAllowedByRules(rules []ipRule, ip net.IP) bool {
+	hasAllow, allowed := false, false
+	for _, rule := range rules {
+		match := ip != nil && rule.network.Contains(ip)
+		if rule.Action == "deny" && match {
+			return false
+		}
+		if rule.Action == "allow" {
+			hasAllow = true
+			allowed = allowed || match
+		}
 	}
+	return !hasAllow || allowed
+}
 
-	// Check if there's already a pending invite
-	var inviteExists int
-	_ = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM event_invites WHERE event_id = ? AND invitee_id = ? AND status = 'pending'`, id, targetID).Scan(&inviteExists)
-	if inviteExists > 0 {
-		c.JSON(http.StatusConflict, gin.H{"error": "Invite already sent"})
-		return
+func ipRulesMiddleware(group string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ip := net.ParseIP(clientIP(c))
+		ipRulesMu.RLock()
+		ok := ipAllowedByRules(ipRules[group], ip)
+		ipRulesMu.RUnlock()
+		if !ok {
+			metricInc("plannie_ip_rule_blocks_total", "group", group)
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Access from this address is not allowed"})
+			return
+		}
+		c.Next()
 	}
+}
 
-	tx, err := db.BeginTx(ctx, nil)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
-		return
-	}
-	now := time.Now().UTC()
-	inviteID := uuid.NewString()
-	if _, err := tx.ExecContext(ctx, `
-		INSERT INTO event_invites(id, event_id, inviter_id, invitee_id, status, created_at, updated_at)
-		VALUES (?,?,?,?,'pending',?,?)
-	`, inviteID, id, creatorID, targetID, now, now); err != nil {
-		tx.Rollback()
-		logIfTimeout(err, "invite: insert invite")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
-		return
-	}
-	if err := tx.Commit(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
-		return
+func adminListIPRulesHandler(c *gin.Context) {
+	ipRulesMu.RLock()
+	out := []ipRule{}
+	for _, g := range ipRuleGroups {
+		out = append(out, ipRules[g]...)
 	}
-
-	c.JSON(http.StatusOK, gin.H{"message": "Invite sent"})
+	ipRulesMu.RUnlock()
+	c.JSON(http.StatusOK, gin.H{"groups": ipRuleGroups, "rules": out, "clientIp": clientIP(c)})
 }
 
-func joinHandler(c *gin.Context) {
+// adminCreateIPRuleHandler adds {"group":"admin","action":"allow","cidr":"10.0.0.0/8","note":"VPN"}.
+// A rule that would block the calling admin from the admin API is refused.
+func adminCreateIPRuleHandler(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
 	defer cancel()
 
-	id := c.Param("id")
-	userID := ctxUserID(c)
-
-	var exists int
-	err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM events WHERE id = ?`, id).Scan(&exists)
-	if err != nil {
-		logIfTimeout(err, "join: select event")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+	var input struct {
+		Group  string `json:"group"`
+		Action string `json:"action"`
+		CIDR   string `json:"cidr"`
+		Note   string `json:"note"`
+	}
+	if err := c.BindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
 		return
 	}
-	if exists == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+	knownGroup := false
+	for _, g := range ipRuleGroups {
+		knownGroup = knownGroup || g == input.Group
+	}
+	if !knownGroup {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown group"})
 		return
 	}
-	_ = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM event_participants WHERE event_id = ? AND user_id = ?`, id, userID).Scan(&exists)
-	if exists > 0 {
-		c.JSON(http.StatusOK, gin.H{"message": "Already joined"})
+	if input.Action != "allow" && input.Action != "deny" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Action must be allow or deny"})
 		return
 	}
-
-	tx, err := db.BeginTx(ctx, nil)
+	network, err := parseIPRuleCIDR(strings.TrimSpace(input.CIDR))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid CIDR"})
 		return
 	}
-	now := time.Now().UTC()
-	if _, err := tx.ExecContext(ctx, `INSERT INTO event_participants(id, event_id, user_id, availability, draft_availability, draft_disabled_slots, draft_updated_at, created_at, updated_at)
-		VALUES (?,?,?,?,?,?,NULL,?,?)`, uuid.NewString(), id, userID, "{}", "{}", "[]", now, now); err != nil {
-		tx.Rollback()
-		logIfTimeout(err, "join: insert participant")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+	note := strings.TrimSpace(input.Note)
+	if utf8.RuneCountInString(note) > 200 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Note too long"})
 		return
 	}
-	if err := tx.Commit(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
-		return
+	rule := ipRule{
+		ID:        uuid.NewString(),
+		Group:     input.Group,
+		Action:    input.Action,
+		CIDR:      network.String(),
+		Note:      note,
+		CreatedBy: ctxUserID(c),
+		CreatedAt: time.Now().UTC(),
+		network:   network,
 	}
 
-	ssePublish(id, []byte(`{"type":"event_updated","id":"`+id+`"}`))
-	c.JSON(http.StatusOK, gin.H{"message": "Joined"})
-}
-
-func leaveHandler(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
-	defer cancel()
+	if rule.Group == ipRuleGroupGlobal || rule.Group == ipRuleGroupAdmin {
+		ip := net.ParseIP(clientIP(c))
+		ipRulesMu.RLock()
+		after := append(append([]ipRule{}, ipRules[rule.Group]...), rule)
+		other := ipRules[ipRuleGroupAdmin]
+		if rule.Group == ipRuleGroupAdmin {
+			other = ipRules[ipRuleGroupGlobal]
+		}
+		lockedOut := !ipAllowedByRules(after, ip) || !ipAllowedByRules(other, ip)
+		ipRulesMu.RUnlock()
+		if lockedOut {
+			c.JSON(http.StatusConflict, gin.H{"error": "This rule would block your own address from the admin API", "clientIp": clientIP(c)})
+			return
+		}
+	}
 
-	id := c.Param("id")
-	userID := ctxUserID(c)
-	res, err := db.ExecContext(ctx, `DELETE FROM event_participants WHERE event_id = ? AND user_id = ?`, id, userID)
+	res, err := db.ExecContext(ctx, `
+		INSERT OR IGNORE INTO ip_rules(id, route_group, action, cidr, note, created_by, created_at) VALUES (?,?,?,?,?,?,?)
+	`, rule.ID, rule.Group, rule.Action, rule.CIDR, rule.Note, rule.CreatedBy, rule.CreatedAt)
 	if err != nil {
-		logIfTimeout(err, "leave: delete")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		serverError(c, "createIPRule: insert", err)
 		return
 	}
-	affected, _ := res.RowsAffected()
-	if affected == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Not in event"})
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Rule already exists"})
 		return
 	}
-
-	ssePublish(id, []byte(`{"type":"event_updated","id":"`+id+`"}`))
-	c.JSON(http.StatusOK, gin.H{"message": "Left event"})
+	if err := loadIPRules(ctx); err != nil {
+		serverError(c, "createIPRule: reload", err)
+		return
+	}
+	shipSecurityEvent("ip_rule_added", rule.CreatedBy, clientIP(c), map[string]interface{}{"group": rule.Group, "action": rule.Action, "cidr": rule.CIDR})
+	c.JSON(http.StatusCreated, rule)
 }
 
-func myEventsHandler(c *gin.Context) {
+func adminDeleteIPRuleHandler(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
 	defer cancel()
 
-	userID := ctxUserID(c)
-	rows, err := db.QueryContext(ctx, `
-		SELECT e.id, e.creator_id, e.name, e.date_from, e.date_to, e.duration, e.timezone, e.disabled_slots,
-			CASE WHEN e.creator_id = ? THEN 1 ELSE 0 END as is_owner
-		FROM events e
-		LEFT JOIN event_participants ep ON ep.event_id = e.id AND ep.user_id = ?
-		WHERE e.creator_id = ? OR ep.user_id = ?
-	`, userID, userID, userID, userID)
+	res, err := db.ExecContext(ctx, `DELETE FROM ip_rules WHERE id = ?`, c.Param("id"))
 	if err != nil {
-		logIfTimeout(err, "myEvents: query")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		serverError(c, "deleteIPRule: delete", err)
 		return
 	}
-	defer rows.Close()
-	out := []map[string]interface{}{}
-	for rows.Next() {
-		var ev Event
-		var isOwner int
-		if err := rows.Scan(&ev.ID, &ev.CreatorID, &ev.Name, &ev.DateFrom, &ev.DateTo, &ev.Duration, &ev.Timezone, &ev.DisabledSlots, &isOwner); err == nil {
-			disabled := []string{}
-			if err := json.Unmarshal([]byte(ev.DisabledSlots), &disabled); err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
-				return
-			}
-			out = append(out, map[string]interface{}{
-				"id":            ev.ID,
-				"creatorId":     ev.CreatorID,
-				"name":          ev.Name,
-				"dateRange":     gin.H{"from": ev.DateFrom, "to": ev.DateTo},
-				"duration":      ev.Duration,
-				"timezone":      ev.Timezone,
-				"disabledSlots": disabled,
-				"isOwner":       isOwner == 1,
-			})
-		}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
 	}
-	if err := rows.Err(); err != nil {
-		logIfTimeout(err, "myEvents: rows err")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+	if err := loadIPRules(ctx); err != nil {
+		serverError(c, "deleteIPRule: reload", err)
 		return
 	}
-	c.JSON(http.StatusOK, out)
+	shipSecurityEvent("ip_rule_removed", ctxUserID(c), clientIP(c), map[string]interface{}{"id": c.Param("id")})
+	c.JSON(http.StatusOK, gin.H{"message": "Rule removed"})
 }
 
-func verifyEmailHandler(c *gin.Context) {
-	tid := c.Query("tid")
-	raw := c.Query("t")
-	if tid == "" || raw == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing token"})
+func doctorTrustedProxies(r *doctorReport) {
+	if err := configureTrustedProxies(); err != nil {
+		r.fail("trusted proxies", err.Error(), "list proxy addresses or CIDRs, comma separated, or set TRUSTED_PROXIES=none")
 		return
 	}
-	userID, err := verifyEmailTokenByID(tid, raw, "verify")
-	if err != nil {
-		appURL := os.Getenv("APP_BASE_URL")
-		if appURL == "" {
-			appURL = "http://localhost:3000"
-		}
-		c.Redirect(http.StatusFound, fmt.Sprintf("%s/verified?success=0", appURL))
+	switch {
+	case trustedProxies == nil:
+		r.warn("trusted proxies", "TRUSTED_PROXIES is unset, so X-Forwarded-For is believed from any peer and IP bans and allow lists can be bypassed", "set it to your load balancer's addresses, or to none when clients connect directly")
+	case len(trustedProxies) == 0:
+		r.ok("trusted proxies", "no proxies trusted; client IPs come from the connection")
+	default:
+		r.ok("trusted proxies", fmt.Sprintf("X-Forwarded-For is trusted from %s", strings.Join(trustedProxies, ", ")))
+	}
+}
+
+func doctorSecurityHeaders(r *doctorReport) {
+	if err := configureSecurityHeaders(); err != nil {
+		r.fail("security headers", err.Error(), "fix the value or unset it to use the default")
 		return
 	}
-	if _, err := db.Exec(`UPDATE users SET email_verified = 1, updated_at = ? WHERE id = ?`, time.Now().UTC(), userID); err != nil {
-		logIfTimeout(err, "verifyEmail: update user")
+	csp := securityHeaderValues["Content-Security-Policy"]
+	switch {
+	case os.Getenv("CONTENT_SECURITY_POLICY") != "" && !strings.Contains(csp, "frame-ancestors"):
+		r.warn("security headers", "CONTENT_SECURITY_POLICY has no frame-ancestors directive, so any site can frame responses", "add frame-ancestors 'none' or list the embedding origins")
+	case strings.Contains(csp, "frame-ancestors *") || strings.Contains(csp, "frame-ancestors https:"):
+		r.warn("security headers", "frame-ancestors lets any site frame responses", "list the embedding origins in CSP_FRAME_ANCESTORS")
+	default:
+		r.ok("security headers", "Content-Security-Policy: "+csp)
 	}
-	appURL := os.Getenv("APP_BASE_URL")
-	if appURL == "" {
-		appURL = "http://localhost:3000"
+}
+
+// Signed URLs let a member hand a read-only resource such as the free/busy feed or the QR
+// code to a calendar app or a CDN without sharing a session or event access token. The
+// signature is an HMAC over the path, the query and the expiry. Expiries are rounded up to
+// signedURLBucket so repeated requests yield the same URL and caches keep hitting. A
+// signed URL cannot be revoked before it expires, which is why lifetimes are capped.
+const (
+	signedURLBucket     = time.Hour
+	defaultSignedURLTTL = 7 * 24 * time.Hour
+	maxSignedURLTTL     = 90 * 24 * time.Hour
+)
+
+// signedResources maps a resource name to its path under /events/:id and the query
+// parameters a signer may pin.
+var signedResources = map[string]struct {
+	suffix string
+	params []string
+}{
+	"freebusy": {"/freebusy.ics", []string{"min"}},
+	"qr":       {"/qr.png", []string{"size"}},
+}
+
+// urlSignature signs path plus the query without its sig parameter; url.Values.Encode
+// sorts keys, so parameter order doesn't matter.
+func urlSignature(path string, query url.Values) string {
+	q := url.Values{}
+	for k, v := range query {
+		if k != "sig" {
+			q[k] = v
+		}
 	}
-	c.Redirect(http.StatusFound, fmt.Sprintf("%s/verified?success=1", appURL))
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte("signed-url:" + path + "?" + q.Encode()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
 }
 
-func forgotPasswordHandler(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
-	defer cancel()
-	var in struct {
-		EmailOrUsername string `json:"email"`
+// signedURL returns an absolute URL under base for path that is valid for at least ttl.
+// Only path is signed, so the tenant prefix in base doesn't affect the signature.
+func signedURL(base, path string, query url.Values, ttl time.Duration) (string, time.Time) {
+	exp := time.Now().Add(ttl).Truncate(signedURLBucket).Add(signedURLBucket).UTC()
+	q := url.Values{}
+	for k, v := range query {
+		q[k] = v
 	}
-	_ = c.BindJSON(&in)
-	var userID, email string
-	err := db.QueryRowContext(ctx, `SELECT id, email FROM users WHERE email = ? OR username = ?`, in.EmailOrUsername, in.EmailOrUsername).
-		Scan(&userID, &email)
-	if err == sql.ErrNoRows {
-		c.JSON(http.StatusOK, gin.H{"message": "If an account exists, we sent a reset link"})
-		return
-	} else if err != nil {
-		serverError(c, "forgotPassword: select user", err)
-		return
+	q.Set("exp", strconv.FormatInt(exp.Unix(), 10))
+	q.Set("sig", urlSignature(path, q))
+	return base + path + "?" + q.Encode(), exp
+}
+
+// validSignedRequest reports whether the request carries an unexpired signature for its
+// exact path and query.
+func validSignedRequest(c *gin.Context) bool {
+	sig := c.Query("sig")
+	exp, err := strconv.ParseInt(c.Query("exp"), 10, 64)
+	if sig == "" || err != nil || time.Now().Unix() >= exp {
+		return false
 	}
-	raw, tokenID, err := createEmailToken(userID, "reset", resetCodeTTL)
-	if err == nil {
-		appURL := os.Getenv("APP_BASE_URL")
-		if appURL == "" {
-			appURL = "http://localhost:3000"
-		}
-		resetURL := fmt.Sprintf("%s/reset-password?tid=%s&t=%s", appURL, tokenID, raw)
-		html := fmt.Sprintf(`<p>To reset your password, click <a href="%s">this link</a>. The link expires in %d minutes.</p>`, resetURL, int(resetCodeTTL.Minutes()))
-		go func() {
-			if err := sendEmailBrevo(email, "Reset your password", html); err != nil {
-				log.Printf("sendEmailBrevo reset: %v", err)
-			}
-		}()
+	return hmac.Equal([]byte(sig), []byte(urlSignature(c.Request.URL.Path, c.Request.URL.Query())))
+}
+
+// signedCacheControl lets shared caches keep a signed response for up to max, never past
+// the signature's expiry.
+func signedCacheControl(c *gin.Context, max time.Duration) string {
+	exp, _ := strconv.ParseInt(c.Query("exp"), 10, 64)
+	left := time.Until(time.Unix(exp, 0))
+	if left > max {
+		left = max
 	}
-	c.JSON(http.StatusOK, gin.H{"message": "If an account exists, we sent a reset link"})
+	return fmt.Sprintf("public, max-age=%d", int(left.Seconds()))
 }
 
-func resetPasswordHandler(c *gin.Context) {
+// createSignedURLHandler signs a resource of the event for any member:
+// {"resource":"freebusy","ttlHours":168,"params":{"min":"3"}}.
+func createSignedURLHandler(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
 	defer cancel()
-	var in struct {
-		TokenID            string `json:"tokenId"`
-		Token              string `json:"token"`
-		NewPassword        string `json:"newPassword"`
-		ConfirmNewPassword string `json:"confirmNewPassword"`
+
+	id := c.Param("id")
+	var input struct {
+		Resource string            `json:"resource"`
+		TTLHours int               `json:"ttlHours"`
+		Params   map[string]string `json:"params"`
 	}
-	if err := c.BindJSON(&in); err != nil {
+	if err := c.BindJSON(&input); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
 		return
 	}
-	if in.TokenID == "" || in.Token == "" || in.NewPassword == "" || in.ConfirmNewPassword == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing fields"})
+	res, ok := signedResources[input.Resource]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown resource"})
 		return
 	}
-	if in.NewPassword != in.ConfirmNewPassword {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Passwords do not match"})
+	ttl := defaultSignedURLTTL
+	if input.TTLHours != 0 {
+		ttl = time.Duration(input.TTLHours) * time.Hour
+	}
+	if ttl <= 0 || ttl > maxSignedURLTTL {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("ttlHours must be between 1 and %d", int(maxSignedURLTTL.Hours()))})
 		return
 	}
-	if !validatePassword(in.NewPassword) {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Weak password"})
+	query := url.Values{}
+	for k, v := range input.Params {
+		allowed := false
+		for _, p := range res.params {
+			allowed = allowed || p == k
+		}
+		if !allowed {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported parameter " + k})
+			return
+		}
+		query.Set(k, v)
+	}
+	if _, ok := eventMemberOnly(c, ctx, id, "createSignedURL"); !ok {
 		return
 	}
-	userID, err := verifyEmailTokenByID(in.TokenID, in.Token, "reset")
+	base, err := tenantAPIBaseURL(ctx, requestTenant(c))
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired token"})
+		serverError(c, "createSignedURL: tenant", err)
 		return
 	}
-	h, err := bcrypt.GenerateFromPassword([]byte(in.NewPassword), 12)
-	if err != nil {
-		serverError(c, "resetPassword: hash", err)
+	signed, exp := signedURL(base, "/events/"+id+res.suffix, query, ttl)
+	metricInc("plannie_signed_urls_total", "resource", input.Resource)
+	c.JSON(http.StatusOK, gin.H{"url": signed, "expiresAt": exp})
+}
+
+// CDN caching. Public responses carry s-maxage for shared caches and surrogate keys
+// (Surrogate-Key for Fastly and most others, Cache-Tag for Cloudflare) so one purge drops
+// everything about an event. When CDN_PURGE_URL is set, keys touched by changes are
+// collected and purged in one batch every cdnPurgeInterval:
+//
+//	CDN_PURGE_URL     endpoint to call, e.g. https://api.fastly.com/service/ID/purge
+//	CDN_PURGE_FORMAT  webhook (default, POST {"keys":[...]}), fastly (POST with a
+//	                  Surrogate-Key header) or cloudflare (POST {"tags":[...]})
+//	CDN_PURGE_TOKEN   sent as Fastly-Key for fastly and as a bearer token otherwise
+const (
+	cdnPurgeInterval          = 5 * time.Second
+	publicEventsSurrogateKey  = "public-events"
+	brandingSurrogateKey      = "branding"
+	announcementsSurrogateKey = "announcements"
+)
+
+var (
+	cdnPurgeURL    string
+	cdnPurgeFormat string
+	cdnPurgeToken  string
+	cdnPurgeMu     sync.Mutex
+	cdnPurgeKeys   = map[string]bool{}
+)
+
+func configureCDN() error {
+	cdnPurgeURL = strings.TrimSpace(os.Getenv("CDN_PURGE_URL"))
+	cdnPurgeToken = os.Getenv("CDN_PURGE_TOKEN")
+	cdnPurgeFormat = strings.ToLower(strings.TrimSpace(os.Getenv("CDN_PURGE_FORMAT")))
+	if cdnPurgeFormat == "" {
+		cdnPurgeFormat = "webhook"
+	}
+	switch cdnPurgeFormat {
+	case "webhook", "fastly", "cloudflare":
+	default:
+		return fmt.Errorf("CDN_PURGE_FORMAT: unknown format %q (webhook, fastly or cloudflare)", cdnPurgeFormat)
+	}
+	if cdnPurgeURL == "" {
+		return nil
+	}
+	if u, err := url.Parse(cdnPurgeURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("CDN_PURGE_URL: %q is not an http(s) URL", cdnPurgeURL)
+	}
+	return nil
+}
+
+func eventSurrogateKey(id string) string { return "event-" + id }
+
+// publicCache marks a response as cacheable by browsers for maxAge and by shared caches
+// for sMaxAge, tagged with keys for purging.
+func publicCache(c *gin.Context, maxAge, sMaxAge time.Duration, keys ...string) {
+	c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d, s-maxage=%d", int(maxAge.Seconds()), int(sMaxAge.Seconds())))
+	setSurrogateKeys(c, keys...)
+}
+
+func setSurrogateKeys(c *gin.Context, keys ...string) {
+	if len(keys) == 0 {
 		return
 	}
-	if _, err := db.ExecContext(ctx, `UPDATE users SET password_hash = ?, updated_at = ? WHERE id = ?`, string(h), time.Now().UTC(), userID); err != nil {
-		serverError(c, "resetPassword: update", err)
+	c.Header("Surrogate-Key", strings.Join(keys, " "))
+	c.Header("Cache-Tag", strings.Join(keys, ","))
+}
+
+// cdnPurge queues keys for the next purge batch. It never blocks and is a no-op without
+// CDN_PURGE_URL.
+func cdnPurge(keys ...string) {
+	if cdnPurgeURL == "" {
 		return
 	}
-	if _, err := db.ExecContext(ctx, `UPDATE refresh_tokens SET revoked = 1 WHERE user_id = ?`, userID); err != nil {
-		logIfTimeout(err, "resetPassword: revoke")
+	cdnPurgeMu.Lock()
+	for _, k := range keys {
+		cdnPurgeKeys[k] = true
 	}
-	c.JSON(http.StatusOK, gin.H{"message": "Password updated"})
+	cdnPurgeMu.Unlock()
 }
 
-func sendFriendRequestHandler(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
-	defer cancel()
+func cdnPurgeLoop(ctx context.Context) error {
+	return runEvery(ctx, cdnPurgeInterval, func(ctx context.Context) {
+		cdnPurgeMu.Lock()
+		keys := make([]string, 0, len(cdnPurgeKeys))
+		for k := range cdnPurgeKeys {
+			keys = append(keys, k)
+		}
+		cdnPurgeKeys = map[string]bool{}
+		cdnPurgeMu.Unlock()
+		if len(keys) == 0 {
+			return
+		}
+		sort.Strings(keys)
+		if err := sendCDNPurge(ctx, keys); err != nil {
+			// Put the keys back; the next tick retries them with whatever arrived meanwhile.
+			log.Printf("cdn: purge of %d keys failed: %v", len(keys), err)
+			metricInc("plannie_cdn_purge_failures_total")
+			cdnPurge(keys...)
+			return
+		}
+		metricAdd("plannie_cdn_purged_keys_total", float64(len(keys)))
+	})
+}
 
-	userID := ctxUserID(c)
-	var body struct {
-		Username string `json:"username"`
+func sendCDNPurge(ctx context.Context, keys []string) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	var body []byte
+	switch cdnPurgeFormat {
+	case "cloudflare":
+		body, _ = json.Marshal(map[string][]string{"tags": keys})
+	case "webhook":
+		body, _ = json.Marshal(map[string][]string{"keys": keys})
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cdnPurgeURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if cdnPurgeFormat == "fastly" {
+		req.Header.Set("Surrogate-Key", strings.Join(keys, " "))
+		if cdnPurgeToken != "" {
+			req.Header.Set("Fastly-Key", cdnPurgeToken)
+		}
+	} else if cdnPurgeToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cdnPurgeToken)
 	}
-	if err := c.BindJSON(&body); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
-		return
+	resp, err := outboundClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
 	}
+	return nil
+}
 
-	var targetID string
-	var emailVerified int
-	err := db.QueryRowContext(ctx, `SELECT id, email_verified FROM users WHERE username = ?`, body.Username).Scan(&targetID, &emailVerified)
-	if err == sql.ErrNoRows {
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
-		return
-	} else if err != nil {
-		logIfTimeout(err, "sendFriendRequest: select user")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+func doctorCDN(r *doctorReport) {
+	if err := configureCDN(); err != nil {
+		r.fail("cdn", err.Error(), "fix the value or unset CDN_PURGE_URL to disable purging")
 		return
 	}
-
-	if emailVerified == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "User must verify their email first"})
+	if cdnPurgeURL == "" {
+		r.ok("cdn", "no purge endpoint; cached public responses expire on their own")
 		return
 	}
+	r.ok("cdn", fmt.Sprintf("purging %s keys via %s", cdnPurgeFormat, cdnPurgeURL))
+}
 
-	if targetID == userID {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot send friend request to yourself"})
-		return
+// Mobile push. The apps register their FCM or APNs device token; invites and reminders
+// (pushCategories) then go to every device of the user next to the email, after the
+// deactivation and snooze checks. Email unsubscribes don't apply; removing the device does.
+// Tokens the provider rejects as unregistered are pruned. Each provider is enabled by its
+// credentials:
+//
+//	FCM_CREDENTIALS_FILE  Firebase service account JSON (HTTP v1 API)
+//	APNS_KEY_FILE         .p8 token signing key; needs APNS_KEY_ID, APNS_TEAM_ID and
+//	                      APNS_TOPIC (the app's bundle ID)
+//	APNS_ENV              production (default) or sandbox
+const (
+	pushPlatformFCM     = "fcm"
+	pushPlatformAPNs    = "apns"
+	pushQueueSize       = 1000
+	maxPushDevices      = 20
+	maxPushTokenLen     = 4096
+	maxPushBodyLen      = 180
+	fcmScope            = "https://www.googleapis.com/auth/firebase.messaging"
+	apnsJWTRefreshAfter = 50 * time.Minute
+)
+
+var pushCategories = map[string]bool{emailCategoryInvites: true, emailCategoryReminders: true}
+
+type pushMessage struct {
+	UserID string
+	Title  string
+	Body   string
+	URL    string
+}
+
+type fcmServiceAccount struct {
+	ProjectID   string `json:"project_id"`
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+	key         *rsa.PrivateKey
+}
+
+var (
+	pushQueue = make(chan pushMessage, pushQueueSize)
+
+	fcmAccount *fcmServiceAccount
+	apnsKey    *ecdsa.PrivateKey
+	apnsKeyID  string
+	apnsTeamID string
+	apnsTopic  string
+	apnsHost   string
+
+	pushAuthMu    sync.Mutex
+	fcmToken      string
+	fcmTokenUntil time.Time
+	apnsJWT       string
+	apnsJWTAt     time.Time
+
+	errPushTokenInvalid = errors.New("device token is no longer valid")
+	htmlTagRe           = regexp.MustCompile(`<[^>]*>`)
+	htmlHrefRe          = regexp.MustCompile(`href="([^"]+)"`)
+)
+
+// apnsClient is separate from outboundClient because APNs only speaks HTTP/2, which a
+// custom Transport doesn't negotiate unless asked to.
+var apnsClient = &http.Client{
+	Timeout: outboundTimeout,
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 15 * time.Second,
+		MaxIdleConns:          20,
+		IdleConnTimeout:       90 * time.Second,
+	},
+}
+
+func pushEnabled() bool {
+	return fcmAccount != nil || apnsKey != nil
+}
+
+func configurePush() error {
+	fcmAccount, apnsKey = nil, nil
+	if path := strings.TrimSpace(os.Getenv("FCM_CREDENTIALS_FILE")); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("FCM_CREDENTIALS_FILE: %w", err)
+		}
+		var acc fcmServiceAccount
+		if err := json.Unmarshal(b, &acc); err != nil {
+			return fmt.Errorf("FCM_CREDENTIALS_FILE: %w", err)
+		}
+		if acc.ProjectID == "" || acc.ClientEmail == "" || acc.PrivateKey == "" {
+			return errors.New("FCM_CREDENTIALS_FILE: project_id, client_email and private_key are required")
+		}
+		if acc.TokenURI == "" {
+			acc.TokenURI = "https://oauth2.googleapis.com/token"
+		}
+		if acc.key, err = jwt.ParseRSAPrivateKeyFromPEM([]byte(acc.PrivateKey)); err != nil {
+			return fmt.Errorf("FCM_CREDENTIALS_FILE: private_key: %w", err)
+		}
+		fcmAccount = &acc
+	}
+	if path := strings.TrimSpace(os.Getenv("APNS_KEY_FILE")); path != "" {
+		apnsKeyID = strings.TrimSpace(os.Getenv("APNS_KEY_ID"))
+		apnsTeamID = strings.TrimSpace(os.Getenv("APNS_TEAM_ID"))
+		apnsTopic = strings.TrimSpace(os.Getenv("APNS_TOPIC"))
+		if apnsKeyID == "" || apnsTeamID == "" || apnsTopic == "" {
+			return errors.New("APNS_KEY_ID, APNS_TEAM_ID and APNS_TOPIC are required with APNS_KEY_FILE")
+		}
+		switch os.Getenv("APNS_ENV") {
+		case "", "production":
+			apnsHost = "https://api.push.apple.com"
+		case "sandbox":
+			apnsHost = "https://api.sandbox.push.apple.com"
+		default:
+			return fmt.Errorf("APNS_ENV must be production or sandbox, got %q", os.Getenv("APNS_ENV"))
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("APNS_KEY_FILE: %w", err)
+		}
+		key, err := jwt.ParseECPrivateKeyFromPEM(b)
+		if err != nil {
+			return fmt.Errorf("APNS_KEY_FILE: %w", err)
+		}
+		apnsKey = key
 	}
+	return nil
+}
 
-	// Check if already friends or request exists
-	var exists int
-	err = db.QueryRowContext(ctx, `
-		SELECT COUNT(*) FROM friend_requests
-		WHERE (sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?)
-	`, userID, targetID, targetID, userID).Scan(&exists)
-	if err != nil {
-		logIfTimeout(err, "sendFriendRequest: check existing")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+// queuePush hands a notification to pushLoop without blocking the caller; when the queue
+// is full the push is dropped, the email still goes out.
+func queuePush(userID, subject, htmlBody string) {
+	if !pushEnabled() || userID == "" {
 		return
 	}
-	if exists > 0 {
-		c.JSON(http.StatusConflict, gin.H{"error": "Friend request already exists"})
-		return
+	msg := pushMessage{UserID: userID, Title: subject, Body: pushText(htmlBody)}
+	if m := htmlHrefRe.FindStringSubmatch(htmlBody); m != nil {
+		msg.URL = html.UnescapeString(m[1])
 	}
+	select {
+	case pushQueue <- msg:
+	default:
+		metricInc("plannie_push_dropped_total")
+	}
+}
 
-	now := time.Now().UTC()
-	requestID := uuid.NewString()
-	if _, err := db.ExecContext(ctx, `
-		INSERT INTO friend_requests(id, sender_id, receiver_id, status, created_at, updated_at)
-		VALUES (?,?,?,'pending',?,?)
-	`, requestID, userID, targetID, now, now); err != nil {
-		logIfTimeout(err, "sendFriendRequest: insert")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
-		return
+// pushText flattens an email body into a short plain-text notification body.
+func pushText(htmlBody string) string {
+	text := strings.Join(strings.Fields(html.UnescapeString(htmlTagRe.ReplaceAllString(htmlBody, " "))), " ")
+	if utf8.RuneCountInString(text) > maxPushBodyLen {
+		text = string([]rune(text)[:maxPushBodyLen-1]) + "…"
 	}
+	return text
+}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Friend request sent"})
+func pushLoop(ctx context.Context) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg := <-pushQueue:
+			sendPush(ctx, msg)
+		}
+	}
 }
 
-func getFriendsHandler(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+// sendPush delivers msg to each registered device of the user on a configured platform
+// and prunes devices the provider reports as gone.
+func sendPush(ctx context.Context, msg pushMessage) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
 	defer cancel()
 
-	userID := ctxUserID(c)
-	rows, err := db.QueryContext(ctx, `
-		SELECT u.id, u.username
-		FROM users u
-		INNER JOIN friend_requests fr ON (
-			(fr.sender_id = ? AND fr.receiver_id = u.id) OR
-			(fr.sender_id = u.id AND fr.receiver_id = ?)
-		)
-		WHERE fr.status = 'accepted'
-		ORDER BY u.username
-	`, userID, userID)
+	type device struct{ id, platform, token string }
+	rows, err := db.QueryContext(ctx, `SELECT id, platform, token FROM push_devices WHERE user_id = ?`, msg.UserID)
 	if err != nil {
-		logIfTimeout(err, "getFriends: query")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		logIfTimeout(err, "push: select devices")
 		return
 	}
-	defer rows.Close()
-
-	friends := []map[string]interface{}{}
+	var devices []device
 	for rows.Next() {
-		var id, username string
-		if err := rows.Scan(&id, &username); err != nil {
-			continue
+		var d device
+		if err := rows.Scan(&d.id, &d.platform, &d.token); err == nil {
+			devices = append(devices, d)
 		}
-		friends = append(friends, map[string]interface{}{
-			"id":       id,
-			"username": username,
-		})
 	}
-	if err := rows.Err(); err != nil {
-		logIfTimeout(err, "getFriends: rows err")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
-		return
+	rows.Close()
+	for _, d := range devices {
+		var err error
+		switch {
+		case d.platform == pushPlatformFCM && fcmAccount != nil:
+			err = sendFCM(ctx, d.token, msg)
+		case d.platform == pushPlatformAPNs && apnsKey != nil:
+			err = sendAPNs(ctx, d.token, msg)
+		default:
+			continue
+		}
+		switch {
+		case errors.Is(err, errPushTokenInvalid):
+			metricInc("plannie_push_sent_total", "platform", d.platform, "outcome", "invalid")
+			if _, err := db.ExecContext(ctx, `DELETE FROM push_devices WHERE id = ?`, d.id); err != nil {
+				logIfTimeout(err, "push: prune device")
+				continue
+			}
+			metricInc("plannie_push_pruned_total", "platform", d.platform)
+		case err != nil:
+			metricInc("plannie_push_sent_total", "platform", d.platform, "outcome", "failed")
+			log.Printf("push: %s: %v", d.platform, err)
+		default:
+			metricInc("plannie_push_sent_total", "platform", d.platform, "outcome", "sent")
+		}
 	}
-
-	c.JSON(http.StatusOK, friends)
 }
 
-func getFriendRequestsHandler(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
-	defer cancel()
-
-	userID := ctxUserID(c)
-	rows, err := db.QueryContext(ctx, `
-		SELECT fr.id, u.id, u.username, fr.created_at
-		FROM friend_requests fr
-		INNER JOIN users u ON u.id = fr.sender_id
-		WHERE fr.receiver_id = ? AND fr.status = 'pending'
-		ORDER BY fr.created_at DESC
-	`, userID)
+// fcmAccessToken exchanges a signed service account assertion for an OAuth access token,
+// cached until shortly before it expires.
+func fcmAccessToken(ctx context.Context) (string, error) {
+	pushAuthMu.Lock()
+	defer pushAuthMu.Unlock()
+	if fcmToken != "" && time.Now().Before(fcmTokenUntil) {
+		return fcmToken, nil
+	}
+	now := time.Now()
+	assertion, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":   fcmAccount.ClientEmail,
+		"scope": fcmScope,
+		"aud":   fcmAccount.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}).SignedString(fcmAccount.key)
 	if err != nil {
-		logIfTimeout(err, "getFriendRequests: query")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
-		return
+		return "", err
 	}
-	defer rows.Close()
-
-	requests := []map[string]interface{}{}
-	for rows.Next() {
-		var reqID, senderID, username string
-		var createdAt time.Time
-		if err := rows.Scan(&reqID, &senderID, &username, &createdAt); err != nil {
-			continue
+	form := url.Values{"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"}, "assertion": {assertion}}.Encode()
+	resp, err := outboundDo(ctx, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, fcmAccount.TokenURI, strings.NewReader(form))
+		if err != nil {
+			return nil, err
 		}
-		requests = append(requests, map[string]interface{}{
-			"id":        reqID,
-			"senderId":  senderID,
-			"username":  username,
-			"createdAt": createdAt,
-		})
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req, nil
+	})
+	if err != nil {
+		return "", err
 	}
-	if err := rows.Err(); err != nil {
-		logIfTimeout(err, "getFriendRequests: rows err")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
-		return
+	defer resp.Body.Close()
+	var out struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
 	}
-
-	c.JSON(http.StatusOK, requests)
+	if resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		return "", fmt.Errorf("token exchange: status %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&out); err != nil {
+		return "", fmt.Errorf("token exchange: %w", err)
+	}
+	fcmToken = out.AccessToken
+	fcmTokenUntil = now.Add(time.Duration(out.ExpiresIn)*time.Second - time.Minute)
+	return fcmToken, nil
 }
 
-func acceptFriendRequestHandler(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
-	defer cancel()
-
-	userID := ctxUserID(c)
-	requestID := c.Param("id")
-
-	var senderID string
-	err := db.QueryRowContext(ctx, `
-		SELECT sender_id FROM friend_requests
-		WHERE id = ? AND receiver_id = ? AND status = 'pending'
-	`, requestID, userID).Scan(&senderID)
-	if err == sql.ErrNoRows {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Friend request not found"})
-		return
-	} else if err != nil {
-		logIfTimeout(err, "acceptFriendRequest: select")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
-		return
+func sendFCM(ctx context.Context, token string, msg pushMessage) error {
+	access, err := fcmAccessToken(ctx)
+	if err != nil {
+		return err
 	}
-
-	now := time.Now().UTC()
-	if _, err := db.ExecContext(ctx, `
-		UPDATE friend_requests
-		SET status = 'accepted', updated_at = ?
-		WHERE id = ?
-	`, now, requestID); err != nil {
-		logIfTimeout(err, "acceptFriendRequest: update")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
-		return
+	data := map[string]string{}
+	if msg.URL != "" {
+		data["url"] = msg.URL
 	}
-
-	c.JSON(http.StatusOK, gin.H{"message": "Friend request accepted"})
+	payload, err := json.Marshal(gin.H{"message": gin.H{
+		"token":        token,
+		"notification": gin.H{"title": msg.Title, "body": msg.Body},
+		"data":         data,
+	}})
+	if err != nil {
+		return err
+	}
+	endpoint := "https://fcm.googleapis.com/v1/projects/" + url.PathEscape(fcmAccount.ProjectID) + "/messages:send"
+	resp, err := outboundDo(ctx, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+access)
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return nil
+	case resp.StatusCode == http.StatusNotFound && bytes.Contains(body, []byte("UNREGISTERED")),
+		resp.StatusCode == http.StatusBadRequest && bytes.Contains(body, []byte("registration token")):
+		return errPushTokenInvalid
+	case resp.StatusCode == http.StatusUnauthorized:
+		pushAuthMu.Lock()
+		fcmToken = ""
+		pushAuthMu.Unlock()
+	}
+	return fmt.Errorf("status %d", resp.StatusCode)
 }
 
-func declineFriendRequestHandler(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
-	defer cancel()
-
-	userID := ctxUserID(c)
-	requestID := c.Param("id")
+// apnsProviderToken returns the ES256 provider token APNs expects, re-signed before
+// Apple's one hour limit.
+func apnsProviderToken() (string, error) {
+	pushAuthMu.Lock()
+	defer pushAuthMu.Unlock()
+	if apnsJWT != "" && time.Since(apnsJWTAt) < apnsJWTRefreshAfter {
+		return apnsJWT, nil
+	}
+	now := time.Now()
+	t := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{"iss": apnsTeamID, "iat": now.Unix()})
+	t.Header["kid"] = apnsKeyID
+	signed, err := t.SignedString(apnsKey)
+	if err != nil {
+		return "", err
+	}
+	apnsJWT, apnsJWTAt = signed, now
+	return signed, nil
+}
 
-	var exists int
-	err := db.QueryRowContext(ctx, `
-		SELECT COUNT(*) FROM friend_requests
-		WHERE id = ? AND receiver_id = ? AND status = 'pending'
-	`, requestID, userID).Scan(&exists)
+func sendAPNs(ctx context.Context, token string, msg pushMessage) error {
+	auth, err := apnsProviderToken()
 	if err != nil {
-		logIfTimeout(err, "declineFriendRequest: select")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
-		return
+		return err
 	}
-	if exists == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Friend request not found"})
-		return
+	aps := gin.H{"alert": gin.H{"title": msg.Title, "body": msg.Body}, "sound": "default"}
+	body := gin.H{"aps": aps}
+	if msg.URL != "" {
+		body["url"] = msg.URL
 	}
-
-	now := time.Now().UTC()
-	if _, err := db.ExecContext(ctx, `
-		UPDATE friend_requests
-		SET status = 'declined', updated_at = ?
-		WHERE id = ?
-	`, now, requestID); err != nil {
-		logIfTimeout(err, "declineFriendRequest: update")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
-		return
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, apnsHost+"/3/device/"+url.PathEscape(token), bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "bearer "+auth)
+	req.Header.Set("apns-topic", apnsTopic)
+	req.Header.Set("apns-push-type", "alert")
+	resp, err := apnsClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var out struct {
+		Reason string `json:"reason"`
+	}
+	_ = json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&out)
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return nil
+	case resp.StatusCode == http.StatusGone,
+		resp.StatusCode == http.StatusBadRequest && (out.Reason == "BadDeviceToken" || out.Reason == "DeviceTokenNotForTopic"):
+		return errPushTokenInvalid
+	case resp.StatusCode == http.StatusForbidden && out.Reason == "ExpiredProviderToken":
+		pushAuthMu.Lock()
+		apnsJWT = ""
+		pushAuthMu.Unlock()
 	}
-
-	c.JSON(http.StatusOK, gin.H{"message": "Friend request declined"})
+	return fmt.Errorf("status %d %s", resp.StatusCode, out.Reason)
 }
 
-func removeFriendHandler(c *gin.Context) {
+// registerPushDeviceHandler stores {"platform":"fcm"|"apns","token":"..."} for the caller.
+// A token already registered elsewhere moves to the caller, since it identifies the app
+// install now signed in. Only the maxPushDevices most recently seen devices are kept.
+func registerPushDeviceHandler(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
 	defer cancel()
 
+	var input struct {
+		Platform string `json:"platform"`
+		Token    string `json:"token"`
+	}
+	if err := c.BindJSON(&input); err != nil {
+		return
+	}
+	input.Token = strings.TrimSpace(input.Token)
+	if input.Platform != pushPlatformFCM && input.Platform != pushPlatformAPNs {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "platform must be fcm or apns"})
+		return
+	}
+	if input.Token == "" || len(input.Token) > maxPushTokenLen || strings.ContainsAny(input.Token, " \t\r\n/") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid device token"})
+		return
+	}
 	userID := ctxUserID(c)
-	friendID := c.Param("id")
-
-	if friendID == userID {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Cannot remove yourself"})
+	now := time.Now().UTC()
+	if _, err := db.ExecContext(ctx, `
+		INSERT INTO push_devices(id, user_id, platform, token, created_at, last_seen_at) VALUES (?,?,?,?,?,?)
+		ON CONFLICT(token) DO UPDATE SET user_id = excluded.user_id, platform = excluded.platform, last_seen_at = excluded.last_seen_at
+	`, uuid.NewString(), userID, input.Platform, input.Token, now, now); err != nil {
+		serverError(c, "registerPushDevice: upsert", err)
 		return
 	}
-
-	// Delete both directions of the friendship
 	if _, err := db.ExecContext(ctx, `
-		DELETE FROM friend_requests
-		WHERE status = 'accepted' AND (
-			(sender_id = ? AND receiver_id = ?) OR
-			(sender_id = ? AND receiver_id = ?)
+		DELETE FROM push_devices WHERE user_id = ? AND id NOT IN (
+			SELECT id FROM push_devices WHERE user_id = ? ORDER BY last_seen_at DESC LIMIT ?
 		)
-	`, userID, friendID, friendID, userID); err != nil {
-		logIfTimeout(err, "removeFriend: delete")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+	`, userID, userID, maxPushDevices); err != nil {
+		logIfTimeout(err, "registerPushDevice: trim")
+	}
+	var id string
+	if err := db.QueryRowContext(ctx, `SELECT id FROM push_devices WHERE token = ?`, input.Token).Scan(&id); err != nil {
+		serverError(c, "registerPushDevice: select", err)
 		return
 	}
-
-	c.JSON(http.StatusOK, gin.H{"message": "Friend removed"})
+	metricInc("plannie_push_devices_registered_total", "platform", input.Platform)
+	c.JSON(http.StatusCreated, gin.H{"id": id, "platform": input.Platform, "pushEnabled": pushEnabled()})
 }
 
-func getEventInvitesHandler(c *gin.Context) {
+func listPushDevicesHandler(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
 	defer cancel()
 
-	userID := ctxUserID(c)
 	rows, err := db.QueryContext(ctx, `
-		SELECT ei.id, ei.event_id, e.name, e.date_from, e.date_to, e.duration, e.timezone, e.disabled_slots,
-		       u.id as inviter_id, u.username as inviter_username, ei.created_at
-		FROM event_invites ei
-		INNER JOIN events e ON e.id = ei.event_id
-		INNER JOIN users u ON u.id = ei.inviter_id
-		WHERE ei.invitee_id = ? AND ei.status = 'pending'
-		ORDER BY ei.created_at DESC
-	`, userID)
+		SELECT id, platform, token, created_at, last_seen_at FROM push_devices WHERE user_id = ? ORDER BY last_seen_at DESC
+	`, ctxUserID(c))
 	if err != nil {
-		logIfTimeout(err, "getEventInvites: query")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+		serverError(c, "listPushDevices: select", err)
 		return
 	}
 	defer rows.Close()
-
-	invites := []map[string]interface{}{}
+	devices := []gin.H{}
 	for rows.Next() {
-		var inviteID, eventID, name, dateFrom, dateTo, timezone, disabledSlots, inviterID, inviterUsername string
-		var duration float64
-		var createdAt time.Time
-		if err := rows.Scan(&inviteID, &eventID, &name, &dateFrom, &dateTo, &duration, &timezone, &disabledSlots, &inviterID, &inviterUsername, &createdAt); err != nil {
-			continue
+		var id, platform, token string
+		var created, seen time.Time
+		if err := rows.Scan(&id, &platform, &token, &created, &seen); err != nil {
+			serverError(c, "listPushDevices: scan", err)
+			return
 		}
-		disabled := []string{}
-		if disabledSlots != "" {
-			_ = json.Unmarshal([]byte(disabledSlots), &disabled)
+		if len(token) > 8 {
+			token = "…" + token[len(token)-8:]
 		}
-		invites = append(invites, map[string]interface{}{
-			"id":              inviteID,
-			"eventId":         eventID,
-			"name":            name,
-			"dateRange":       gin.H{"from": dateFrom, "to": dateTo},
-			"duration":        duration,
-			"timezone":        timezone,
-			"disabledSlots":   disabled,
-			"inviterId":       inviterID,
-			"inviterUsername": inviterUsername,
-			"createdAt":       createdAt,
-		})
-	}
-	if err := rows.Err(); err != nil {
-		logIfTimeout(err, "getEventInvites: rows err")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
-		return
+		devices = append(devices, gin.H{"id": id, "platform": platform, "token": token, "createdAt": created, "lastSeenAt": seen})
 	}
-
-	c.JSON(http.StatusOK, invites)
+	c.JSON(http.StatusOK, gin.H{"devices": devices})
 }
 
-func acceptEventInviteHandler(c *gin.Context) {
+func deletePushDeviceHandler(c *gin.Context) {
 	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
 	defer cancel()
 
-	eventID := c.Param("id")
-	userID := ctxUserID(c)
-
-	// Check if invite exists and is pending
-	var inviteID string
-	err := db.QueryRowContext(ctx, `
-		SELECT id FROM event_invites
-		WHERE event_id = ? AND invitee_id = ? AND status = 'pending'
-	`, eventID, userID).Scan(&inviteID)
-	if err == sql.ErrNoRows {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Invite not found"})
+	res, err := db.ExecContext(ctx, `DELETE FROM push_devices WHERE id = ? AND user_id = ?`, c.Param("deviceId"), ctxUserID(c))
+	if err != nil {
+		serverError(c, "deletePushDevice: delete", err)
 		return
-	} else if err != nil {
-		logIfTimeout(err, "acceptEventInvite: select")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
 		return
 	}
+	c.Status(http.StatusNoContent)
+}
 
-	// Check if already a participant
-	var exists int
-	_ = db.QueryRowContext(ctx, `SELECT COUNT(*) FROM event_participants WHERE event_id = ? AND user_id = ?`, eventID, userID).Scan(&exists)
-	if exists > 0 {
-		// Already a participant, just mark invite as accepted
-		now := time.Now().UTC()
-		if _, err := db.ExecContext(ctx, `UPDATE event_invites SET status = 'accepted', updated_at = ? WHERE id = ?`, now, inviteID); err != nil {
-			logIfTimeout(err, "acceptEventInvite: update invite")
-		}
-		c.JSON(http.StatusOK, gin.H{"message": "Already a participant"})
+func doctorPush(r *doctorReport) {
+	if err := configurePush(); err != nil {
+		r.fail("push", err.Error(), "fix the credentials or unset FCM_CREDENTIALS_FILE / APNS_KEY_FILE")
 		return
 	}
-
-	tx, err := db.BeginTx(ctx, nil)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+	var enabled []string
+	if fcmAccount != nil {
+		enabled = append(enabled, "fcm (project "+fcmAccount.ProjectID+")")
+	}
+	if apnsKey != nil {
+		enabled = append(enabled, "apns ("+apnsTopic+" via "+apnsHost+")")
+	}
+	if len(enabled) == 0 {
+		r.ok("push", "no providers configured; notifications go by email only")
 		return
 	}
-	now := time.Now().UTC()
+	r.ok("push", strings.Join(enabled, ", "))
+}
 
-	// Add as participant
-	availability := map[string]bool{}
-	availJSON, _ := json.Marshal(availability)
-	if _, err := tx.ExecContext(ctx, `
-		INSERT INTO event_participants(id, event_id, user_id, availability, draft_availability, draft_disabled_slots, draft_updated_at, created_at, updated_at)
-		VALUES (?,?,?,?,?,?,NULL,?,?)
-	`, uuid.NewString(), eventID, userID, string(availJSON), "{}", "[]", now, now); err != nil {
-		tx.Rollback()
-		logIfTimeout(err, "acceptEventInvite: insert participant")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
-		return
+// authGroup is the router group behind authnMiddleware. It records each route it
+// registers so the OpenAPI document can mark which operations need a bearer token.
+type authGroup struct {
+	*gin.RouterGroup
+}
+
+// authRoutes holds "METHOD /path" for every route registered through an authGroup.
+var authRoutes = map[string]bool{}
+
+func (g authGroup) record(method, relativePath string) {
+	authRoutes[method+" "+strings.TrimSuffix(g.BasePath(), "/")+relativePath] = true
+}
+
+func (g authGroup) Group(relativePath string, handlers ...gin.HandlerFunc) authGroup {
+	return authGroup{g.RouterGroup.Group(relativePath, handlers...)}
+}
+
+func (g authGroup) GET(relativePath string, handlers ...gin.HandlerFunc) gin.IRoutes {
+	g.record(http.MethodGet, relativePath)
+	return g.RouterGroup.GET(relativePath, handlers...)
+}
+
+func (g authGroup) POST(relativePath string, handlers ...gin.HandlerFunc) gin.IRoutes {
+	g.record(http.MethodPost, relativePath)
+	return g.RouterGroup.POST(relativePath, handlers...)
+}
+
+func (g authGroup) PUT(relativePath string, handlers ...gin.HandlerFunc) gin.IRoutes {
+	g.record(http.MethodPut, relativePath)
+	return g.RouterGroup.PUT(relativePath, handlers...)
+}
+
+func (g authGroup) PATCH(relativePath string, handlers ...gin.HandlerFunc) gin.IRoutes {
+	g.record(http.MethodPatch, relativePath)
+	return g.RouterGroup.PATCH(relativePath, handlers...)
+}
+
+func (g authGroup) DELETE(relativePath string, handlers ...gin.HandlerFunc) gin.IRoutes {
+	g.record(http.MethodDelete, relativePath)
+	return g.RouterGroup.DELETE(relativePath, handlers...)
+}
+
+// API request and response bodies. Handlers that bind JSON decode into these types; the
+// response types describe the gin.H the handlers write, for the OpenAPI document.
+
+type apiError struct {
+	Error string `json:"error"`
+	// Code is a machine-readable reason, set where clients need to branch on it.
+	Code string `json:"code,omitempty"`
+}
+
+type apiMessage struct {
+	Message string `json:"message"`
+}
+
+type registerRequest struct {
+	Username        string `json:"username"`
+	Email           string `json:"email"`
+	Password        string `json:"password"`
+	RecaptchaToken  string `json:"recaptchaToken,omitempty"`
+	RecaptchaAction string `json:"recaptchaAction,omitempty"`
+	// Website is a honeypot; browsers leave it empty.
+	Website string `json:"website,omitempty"`
+	// AcceptedPolicies maps policy kind to the version the user agreed to.
+	AcceptedPolicies map[string]int `json:"acceptedPolicies,omitempty"`
+	Locale           string         `json:"locale,omitempty"`
+}
+
+type registerResponse struct {
+	ID            string   `json:"id"`
+	Username      string   `json:"username"`
+	RecoveryCodes []string `json:"recoveryCodes,omitempty"`
+}
+
+type loginRequest struct {
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	RememberMe bool   `json:"rememberMe,omitempty"`
+}
+
+type loginResponse struct {
+	Token               string    `json:"token"`
+	RefreshToken        string    `json:"refresh_token"`
+	Username            string    `json:"username"`
+	EmailVerified       bool      `json:"email_verified"`
+	VerificationExpires time.Time `json:"verificationExpires"`
+}
+
+// refreshRequest is optional on /refresh and /logout when the refresh cookie is sent.
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+type refreshResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	Username     string `json:"username"`
+}
+
+type userResponse struct {
+	ID                 string    `json:"id"`
+	Username           string    `json:"username"`
+	Email              string    `json:"email"`
+	EmailVerified      bool      `json:"emailVerified"`
+	Locale             string    `json:"locale"`
+	CreatedAt          time.Time `json:"createdAt"`
+	UpdatedAt          time.Time `json:"updatedAt"`
+	VerificationExpiry time.Time `json:"verificationExpiry"`
+}
+
+type updateUserRequest struct {
+	Username    string `json:"username,omitempty"`
+	OldPassword string `json:"oldPassword,omitempty"`
+	NewPassword string `json:"newPassword,omitempty"`
+	Email       string `json:"email,omitempty"`
+	Locale      string `json:"locale,omitempty"`
+}
+
+type dateRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// createEventRequest is EventUpdate plus the fields that are fixed at creation.
+type createEventRequest struct {
+	EventUpdate
+	Recurrence string `json:"recurrence,omitempty"`
+}
+
+type participantView struct {
+	ID           string          `json:"id"`
+	Name         string          `json:"name"`
+	Availability map[string]bool `json:"availability"`
+	Role         string          `json:"role,omitempty"`
+	Guest        bool            `json:"guest,omitempty"`
+	// Color (#rrggbb) and Initials are assigned by the server; see setParticipantIdentity.
+	Color    string `json:"color"`
+	Initials string `json:"initials"`
+}
+
+type eventDraftView struct {
+	Availability  map[string]bool `json:"availability"`
+	DisabledSlots []string        `json:"disabledSlots"`
+	UpdatedAt     *time.Time      `json:"updatedAt"`
+}
+
+// eventResponse is the body of GET /events/:id (see eventView); ?fields= trims it.
+type eventResponse struct {
+	ID               string            `json:"id"`
+	CreatorID        string            `json:"creatorId"`
+	Name             string            `json:"name"`
+	DateRange        dateRange         `json:"dateRange"`
+	Duration         float64           `json:"duration"`
+	Timezone         string            `json:"timezone"`
+	Recurrence       string            `json:"recurrence"`
+	Participants     []participantView `json:"participants"`
+	ParticipantCount int               `json:"participantCount"`
+	DisabledSlots    []string          `json:"disabledSlots"`
+	Public           bool              `json:"public"`
+	Tags             []string          `json:"tags"`
+	Protected        bool              `json:"protected"`
+	AutoFinalize     bool              `json:"autoFinalize"`
+	GuestMode        bool              `json:"guestMode"`
+	BookingMode      bool              `json:"bookingMode"`
+	SeriesID         string            `json:"seriesId,omitempty"`
+	FinalizedSlot    string            `json:"finalizedSlot,omitempty"`
+	FinalizedAt      *time.Time        `json:"finalizedAt,omitempty"`
+	Quick            bool              `json:"quick,omitempty"`
+	ExpiresAt        *time.Time        `json:"expiresAt,omitempty"`
+	HolidayRegion    string            `json:"holidayRegion,omitempty"`
+	Shortlist        []string          `json:"shortlist,omitempty"`
+	ResponseDeadline *time.Time        `json:"responseDeadline,omitempty"`
+	Draft            *eventDraftView   `json:"draft,omitempty"`
+	EditLock         *eventEditLock    `json:"editLock,omitempty"`
+}
+
+type myEventItem struct {
+	ID            string    `json:"id"`
+	CreatorID     string    `json:"creatorId"`
+	Name          string    `json:"name"`
+	DateRange     dateRange `json:"dateRange"`
+	Duration      float64   `json:"duration"`
+	Timezone      string    `json:"timezone"`
+	DisabledSlots []string  `json:"disabledSlots"`
+	IsOwner       bool      `json:"isOwner"`
+	Role          string    `json:"role"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+}
+
+type friendView struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+}
+
+type friendRequestInput struct {
+	Username string `json:"username"`
+}
+
+// apiOperation documents one route. Routes without an entry are still listed, with a
+// summary derived from the handler name and untyped bodies.
+type apiOperation struct {
+	Summary  string
+	Request  interface{}
+	Response interface{}
+	// ContentType is the success media type when it isn't JSON. With a Response as well,
+	// both are listed (e.g. the zip export and its ?format=json variant).
+	ContentType string
+	// Status is the success status; 200 when zero.
+	Status int
+}
+
+var apiOperations = map[string]apiOperation{
+	"GET /metrics":       {Summary: "Prometheus metrics"},
+	"GET /openapi.json":  {Summary: "This OpenAPI document"},
+	"GET /docs":          {Summary: "Swagger UI for this document (OPENAPI_DOCS_UI=true)", ContentType: "text/html"},
+	"GET /dev/emails":    {Summary: "Captured mail in development, newest first"},
+	"DELETE /dev/emails": {Summary: "Clear captured mail in development"},
+
+	"POST /register":                 {Summary: "Create an account", Request: registerRequest{}, Response: registerResponse{}, Status: http.StatusCreated},
+	"POST /login":                    {Summary: "Sign in and receive an access and refresh token", Request: loginRequest{}, Response: loginResponse{}},
+	"POST /refresh":                  {Summary: "Rotate the refresh token", Request: refreshRequest{}, Response: refreshResponse{}},
+	"POST /logout":                   {Summary: "Revoke the refresh token", Request: refreshRequest{}, Response: apiMessage{}},
+	"POST /account/recover":          {Summary: "Start account recovery with a recovery code"},
+	"POST /account/recover/complete": {Summary: "Set a new password (and optionally email) with a recovery session"},
+	"GET /verify-email":              {Summary: "Email verification link"},
+	"POST /verify-email/resend":      {Summary: "Resend the verification email"},
+	"POST /forgot-password":          {Summary: "Email a password reset link"},
+	"POST /reset-password":           {Summary: "Set a new password with a reset token"},
+	"GET /users/merge/confirm":       {Summary: "Account merge confirmation page", ContentType: "text/html"},
+	"POST /users/merge/confirm":      {Summary: "Confirm an account merge"},
+	"GET /reactivate":                {Summary: "Reactivate a deactivated account"},
+	"GET /unsubscribe":               {Summary: "Unsubscribe confirmation page", ContentType: "text/html"},
+	"POST /unsubscribe":              {Summary: "Unsubscribe from an email category (also RFC 8058 one-click)"},
+	"POST /webhooks/email/:provider": {Summary: "Delivery reports from a mail provider"},
+
+	"GET /policies":         {Summary: "Current version of every published policy"},
+	"GET /policies/:kind":   {Summary: "One policy document; ?version= selects an older one"},
+	"POST /policies/accept": {Summary: "Accept policy versions"},
+
+	"GET /users/me":                           {Summary: "Current user", Response: userResponse{}},
+	"PUT /users/me":                           {Summary: "Update username, email, password or locale", Request: updateUserRequest{}},
+	"DELETE /users/me":                        {Summary: "Delete the account"},
+	"POST /users/me/deactivate":               {Summary: "Deactivate the account until the emailed reactivation link is used"},
+	"GET /users/me/email-suppressions":        {Summary: "Email categories and which are unsubscribed"},
+	"PUT /users/me/email-suppressions":        {Summary: "Subscribe to or unsubscribe from an email category"},
+	"GET /users/me/notification-preferences":  {Summary: "Notification preferences"},
+	"PUT /users/me/notification-preferences":  {Summary: "Update notification preferences"},
+	"POST /users/me/snooze":                   {Summary: "Mute non-essential notifications until ?until="},
+	"DELETE /users/me/snooze":                 {Summary: "End a notification snooze"},
+	"GET /users/me/push-devices":              {Summary: "Registered push devices"},
+	"POST /users/me/push-devices":             {Summary: "Register a push device"},
+	"DELETE /users/me/push-devices/:deviceId": {Summary: "Remove a push device"},
+	"GET /users/me/export":                    {Summary: "Export all personal data (GDPR) as a zip archive (default) or JSON with ?format=json; large accounts get 202 with an export id", Response: dataExportBundle{}, ContentType: "application/zip"},
+	"GET /users/me/export/:exportId":          {Summary: "Status of a queued export, or the export once ready", Response: dataExportBundle{}, ContentType: "application/zip"},
+	"GET /users/me/working-hours":             {Summary: "Working hours"},
+	"PUT /users/me/working-hours":             {Summary: "Update working hours"},
+	"GET /users/me/availability-history":      {Summary: "The caller's availability changes per event"},
+	"GET /users/me/calendar":                  {Summary: "Connected calendar feed"},
+	"PUT /users/me/calendar":                  {Summary: "Connect an ICS calendar feed"},
+	"DELETE /users/me/calendar":               {Summary: "Disconnect the calendar feed"},
+	"GET /users/me/calendar/series":           {Summary: "Recurring series in the connected calendar"},
+	"GET /users/me/caldav-tokens":             {Summary: "CalDAV app passwords"},
+	"POST /users/me/caldav-tokens":            {Summary: "Create a CalDAV app password (shown once)", Status: http.StatusCreated},
+	"DELETE /users/me/caldav-tokens/:tokenId": {Summary: "Revoke a CalDAV app password"},
+	"GET /users/me/sessions":                  {Summary: "Active sessions"},
+	"DELETE /users/me/sessions/:id":           {Summary: "Sign out a session"},
+	"GET /users/me/recovery-codes":            {Summary: "Number of unused recovery codes"},
+	"POST /users/me/recovery-codes":           {Summary: "Regenerate recovery codes"},
+	"POST /users/me/merge":                    {Summary: "Email a merge confirmation to another account"},
+	"GET /my-events":                          {Summary: "Events the user owns or takes part in", Response: []myEventItem{}},
+	"GET /events/invites":                     {Summary: "Pending event invites"},
+
+	"POST /events":                         {Summary: "Create an event", Request: createEventRequest{}, Status: http.StatusCreated},
+	"POST /events/preview":                 {Summary: "Slot grid an event with these settings would get"},
+	"GET /events/:id":                      {Summary: "Get an event with its participants", Response: eventResponse{}},
+	"PUT /events/:id":                      {Summary: "Update an event", Request: EventUpdate{}},
+	"DELETE /events/:id":                   {Summary: "Delete an event (owner only)"},
+	"GET /events/:id/stream":               {Summary: "Server-sent events with the event's changes", ContentType: "text/event-stream"},
+	"POST /events/:id/preview":             {Summary: "Broadcast the caller's slot hover or selection"},
+	"GET /events/:id/kiosk":                {Summary: "Anonymous heatmap for kiosk screens"},
+	"GET /events/:id/kiosk/stream":         {Summary: "Server-sent events for kiosk screens", ContentType: "text/event-stream"},
+	"GET /events/:id/participants":         {Summary: "Page through an event's participants"},
+	"GET /events/:id/suggestions":          {Summary: "Slots ranked by availability"},
+	"POST /events/:id/access":              {Summary: "Exchange an event passphrase for an access token"},
+	"PUT /events/:id/draft":                {Summary: "Save an availability draft"},
+	"DELETE /events/:id/draft":             {Summary: "Discard the availability draft"},
+	"PATCH /events/:id/availability":       {Summary: "Add or remove slots from the caller's availability"},
+	"POST /events/:id/availability/undo":   {Summary: "Undo the caller's last availability change"},
+	"GET /events/:id/availability-changes": {Summary: "Audit trail of availability edits"},
+	"GET /events/:id/snapshot":             {Summary: "Who had answered what as of ?at="},
+	"GET /events/:id/overlay":              {Summary: "Project the caller's availability from another event onto this one"},
+	"POST /events/:id/seen":                {Summary: "Mark the event as seen"},
+	"GET /events/:id/lock":                 {Summary: "Current edit lock"},
+	"POST /events/:id/lock":                {Summary: "Take or renew the edit lock"},
+	"DELETE /events/:id/lock":              {Summary: "Release the edit lock"},
+
+	"POST /events/:id/invite":                           {Summary: "Invite a user by username"},
+	"POST /events/:id/invite/accept":                    {Summary: "Accept an event invite"},
+	"POST /events/:id/invite/decline":                   {Summary: "Decline an event invite"},
+	"POST /events/:id/join":                             {Summary: "Join an event"},
+	"POST /events/join-by-code":                         {Summary: "Join an event with an invite link code"},
+	"POST /events/:id/invite-link":                      {Summary: "Create an invite link"},
+	"GET /events/:id/invite-links":                      {Summary: "Usable invite links"},
+	"DELETE /events/:id/invite-links/:linkId":           {Summary: "Revoke an invite link"},
+	"POST /events/:id/leave":                            {Summary: "Leave an event"},
+	"POST /events/:id/participants/import":              {Summary: "Import participants from CSV (organizers only)"},
+	"PUT /events/:id/participants/:userId/availability": {Summary: "Enter availability for a participant (organizers only)"},
+	"PUT /events/:id/participants/:userId/role":         {Summary: "Promote or demote an organizer (owner only)"},
+	"GET /events/:id/receipts":                          {Summary: "Seen and responded state of invitees (organizers only)"},
+	"GET /events/:id/stats":                             {Summary: "Response rates per join channel (organizers only)"},
+	"GET /events/:id/watches":                           {Summary: "Participants the caller watches"},
+	"PUT /events/:id/watches/:userId":                   {Summary: "Watch a participant"},
+	"DELETE /events/:id/watches/:userId":                {Summary: "Stop watching a participant"},
+	"GET /events/:id/kiosk-tokens":                      {Summary: "Kiosk tokens"},
+	"POST /events/:id/kiosk-tokens":                     {Summary: "Create a kiosk token (shown once)", Status: http.StatusCreated},
+	"DELETE /events/:id/kiosk-tokens/:tokenId":          {Summary: "Revoke a kiosk token"},
+
+	"GET /events/:id/reminders":    {Summary: "Reminder schedule"},
+	"PUT /events/:id/reminders":    {Summary: "Set the reminder schedule (organizers only)"},
+	"DELETE /events/:id/reminders": {Summary: "Reset the reminder schedule (organizers only)"},
+	"PUT /events/:id/reminders/me": {Summary: "Mute or unmute the event's reminders for the caller"},
+	"POST /events/:id/remind":      {Summary: "Remind participants who haven't answered (organizers only)"},
+	"GET /respond":                 {Summary: "Respond link confirmation page", ContentType: "text/html"},
+	"POST /respond":                {Summary: "Record an answer from a respond link"},
+
+	"POST /events/:id/finalize":   {Summary: "Finalize a slot and send calendar invitations (organizers only)"},
+	"DELETE /events/:id/finalize": {Summary: "Reopen a finalized event (organizers only)"},
+	"PUT /events/:id/shortlist":   {Summary: "Replace the shortlist (organizers only)"},
+	"POST /events/:id/next":       {Summary: "Create the next instance of the event's series (organizers only)", Status: http.StatusCreated},
+	"GET /series/:id":             {Summary: "A series with its instances"},
+
+	"GET /events/:id/freebusy.ics":         {Summary: "Free/busy feed of the event's common slots", ContentType: "text/calendar"},
+	"GET /events/:id/qr.png":               {Summary: "QR code of the event's share link", ContentType: "image/png"},
+	"POST /events/:id/signed-urls":         {Summary: "Sign a read-only event resource URL"},
+	"POST /events/:id/short-links":         {Summary: "Get the event's short code, or add a vanity code (organizers only)"},
+	"DELETE /events/:id/short-links/:code": {Summary: "Delete a vanity code (organizers only)"},
+	"GET /short-links/:code":               {Summary: "Resolve a short code to an event"},
+	"GET /e/:code":                         {Summary: "Redirect a short code to the event page"},
+
+	"POST /events/:id/guest":                            {Summary: "Add a guest response"},
+	"PUT /events/:id/guest/:participantId":              {Summary: "Update a guest response (guest token)"},
+	"POST /quick-events":                                {Summary: "Create a quick poll without an account", Status: http.StatusCreated},
+	"PUT /quick-events/:id":                             {Summary: "Update a quick poll (admin token)"},
+	"DELETE /quick-events/:id":                          {Summary: "Delete a quick poll (admin token)"},
+	"POST /quick-events/:id/responses":                  {Summary: "Add a quick poll response", Status: http.StatusCreated},
+	"PUT /quick-events/:id/responses/:participantId":    {Summary: "Update a quick poll response (guest token)"},
+	"DELETE /quick-events/:id/responses/:participantId": {Summary: "Delete a quick poll response (guest or admin token)"},
+
+	"GET /events/:id/shifts":                {Summary: "Shifts with their fill level"},
+	"PUT /events/:id/shifts":                {Summary: "Set shift capacities (organizers only)"},
+	"POST /events/:id/shifts/:slot/claim":   {Summary: "Claim a place on a shift"},
+	"DELETE /events/:id/shifts/:slot/claim": {Summary: "Give up a place on a shift"},
+	"GET /events/:id/bookings":              {Summary: "Booked slots with their waitlists"},
+	"POST /events/:id/bookings/:slot":       {Summary: "Book a slot, or join its waitlist"},
+	"DELETE /events/:id/bookings/:slot":     {Summary: "Cancel a booking or waitlist place"},
+	"GET /events/:id/confirmation":          {Summary: "Confirmation phase"},
+	"POST /events/:id/confirmation":         {Summary: "Open the confirmation phase (organizers only)"},
+	"POST /events/:id/confirm":              {Summary: "Confirm or decline attendance"},
+	"GET /events/:id/attendance":            {Summary: "Attendance (organizers only)"},
+	"PUT /events/:id/attendance":            {Summary: "Record attendance (organizers only)"},
+
+	"GET /events/sync-from-calendar":            {Summary: "Calendar series followed into polls"},
+	"POST /events/sync-from-calendar":           {Summary: "Follow a calendar series into polls", Status: http.StatusCreated},
+	"DELETE /events/sync-from-calendar/:syncId": {Summary: "Stop following a calendar series"},
+	"GET /.well-known/caldav":                   {Summary: "CalDAV discovery"},
+	"GET /public-events":                        {Summary: "Public event directory"},
+	"GET /branding":                             {Summary: "Tenant branding"},
+	"GET /announcements":                        {Summary: "Active announcements"},
+
+	"GET /friends":              {Summary: "List friends", Response: []friendView{}},
+	"POST /friends/request":     {Summary: "Send a friend request", Request: friendRequestInput{}},
+	"GET /friends/requests":     {Summary: "Pending friend requests"},
+	"POST /friends/accept/:id":  {Summary: "Accept a friend request"},
+	"POST /friends/decline/:id": {Summary: "Decline a friend request"},
+	"DELETE /friends/:id":       {Summary: "Remove a friend"},
+
+	"GET /admin/users/lookup":             {Summary: "Find accounts by current or past email"},
+	"GET /admin/users/:id/email-history":  {Summary: "An account's email history"},
+	"POST /admin/users/:id/merge":         {Summary: "Merge an account into another"},
+	"GET /admin/tenant":                   {Summary: "Current tenant", Response: Tenant{}},
+	"PUT /admin/tenant/admins/:userId":    {Summary: "Grant tenant admin rights (instance admins only)"},
+	"DELETE /admin/tenant/admins/:userId": {Summary: "Revoke tenant admin rights (instance admins only)"},
+	"PUT /admin/branding":                 {Summary: "Update tenant branding", Request: Branding{}, Response: Branding{}},
+	"DELETE /admin/branding":              {Summary: "Reset tenant branding"},
+	"GET /admin/announcements":            {Summary: "All announcements of the tenant"},
+	"POST /admin/announcements":           {Summary: "Create an announcement", Status: http.StatusCreated},
+	"PUT /admin/announcements/:id":        {Summary: "Replace an announcement"},
+	"DELETE /admin/announcements/:id":     {Summary: "Delete an announcement"},
+	"GET /admin/security/attempts":        {Summary: "Failed login summary"},
+	"DELETE /admin/security/bans/:ip":     {Summary: "Lift an IP ban"},
+	"GET /admin/security/ip-rules":        {Summary: "IP allow and deny rules"},
+	"POST /admin/security/ip-rules":       {Summary: "Add an IP rule", Status: http.StatusCreated},
+	"DELETE /admin/security/ip-rules/:id": {Summary: "Delete an IP rule"},
+	"POST /admin/policies":                {Summary: "Publish a policy version", Status: http.StatusCreated},
+	"GET /admin/email/queue":              {Summary: "Email queue depth and deferred messages"},
+	"GET /admin/email/deliverability":     {Summary: "Delivery outcomes per provider"},
+	"GET /admin/stats":                    {Summary: "Instance totals and daily metrics"},
+	"GET /admin/settings":                 {Summary: "Effective settings"},
+	"PUT /admin/settings/:key":            {Summary: "Override a setting"},
+	"DELETE /admin/settings/:key":         {Summary: "Clear a setting override"},
+	"POST /admin/settings/reload":         {Summary: "Reload settings"},
+	"GET /admin/tenants":                  {Summary: "List tenants", Response: []Tenant{}},
+	"POST /admin/tenants":                 {Summary: "Create a tenant", Request: tenantInput{}, Response: Tenant{}, Status: http.StatusCreated},
+	"PUT /admin/tenants/:id":              {Summary: "Update a tenant", Request: tenantInput{}, Response: Tenant{}},
+}
+
+var (
+	openAPIJSON []byte
+	openAPIETag string
+	timeType    = reflect.TypeOf(time.Time{})
+	// openAPIMethods are the methods OpenAPI 3.0 can describe; CalDAV verbs are left out.
+	openAPIMethods = map[string]bool{"GET": true, "POST": true, "PUT": true, "PATCH": true, "DELETE": true}
+)
+
+// openAPISchemas collects named component schemas while operations are described.
+type openAPISchemas map[string]interface{}
+
+func (s openAPISchemas) schemaFor(t reflect.Type) gin.H {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return s.schemaFor(t.Elem())
+	case reflect.Struct:
+		if t == timeType {
+			return gin.H{"type": "string", "format": "date-time"}
+		}
+		if t.Name() == "" {
+			return s.objectSchema(t)
+		}
+		name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+		if _, ok := s[name]; !ok {
+			s[name] = gin.H{} // placeholder so self-referencing types terminate
+			s[name] = s.objectSchema(t)
+		}
+		return gin.H{"$ref": "#/components/schemas/" + name}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return gin.H{"type": "string", "format": "byte"}
+		}
+		return gin.H{"type": "array", "items": s.schemaFor(t.Elem())}
+	case reflect.Map:
+		return gin.H{"type": "object", "additionalProperties": s.schemaFor(t.Elem())}
+	case reflect.String:
+		return gin.H{"type": "string"}
+	case reflect.Bool:
+		return gin.H{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return gin.H{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return gin.H{"type": "number"}
 	}
+	return gin.H{}
+}
 
-	// Update invite status
-	if _, err := tx.ExecContext(ctx, `UPDATE event_invites SET status = 'accepted', updated_at = ? WHERE id = ?`, now, inviteID); err != nil {
-		tx.Rollback()
-		logIfTimeout(err, "acceptEventInvite: update invite")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
-		return
+// objectSchema follows encoding/json: exported fields by their json name, embedded
+// structs flattened, and every field without omitempty listed as required.
+func (s openAPISchemas) objectSchema(t reflect.Type) gin.H {
+	props := gin.H{}
+	var required []string
+	var walk func(t reflect.Type)
+	walk = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+			if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+				walk(f.Type)
+				continue
+			}
+			if !f.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			schema := s.schemaFor(f.Type)
+			if f.Type.Kind() == reflect.Ptr {
+				if _, isRef := schema["$ref"]; !isRef {
+					schema["nullable"] = true
+				}
+			}
+			props[name] = schema
+			if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Ptr {
+				required = append(required, name)
+			}
+		}
 	}
+	walk(t)
+	out := gin.H{"type": "object", "properties": props}
+	if len(required) > 0 {
+		sort.Strings(required)
+		out["required"] = required
+	}
+	return out
+}
 
-	if err := tx.Commit(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
-		return
+var routeParamRe = regexp.MustCompile(`[:*]([A-Za-z0-9_]+)`)
+
+// operationName turns "main.createEventHandler" into "createEvent"; closures have no
+// usable name and fall back to the method and path.
+func operationName(handler, method, path string) string {
+	name := handler[strings.LastIndex(handler, ".")+1:]
+	if strings.HasPrefix(name, "func") || name == "" {
+		name = strings.ToLower(method)
+		for _, part := range strings.FieldsFunc(path, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) {
+			name += strings.ToUpper(part[:1]) + part[1:]
+		}
+		return name
 	}
+	return strings.TrimSuffix(name, "Handler")
+}
 
-	ssePublish(eventID, []byte(`{"type":"event_updated","id":"`+eventID+`"}`))
-	c.JSON(http.StatusOK, gin.H{"message": "Invite accepted"})
+// summaryFromName turns "createEvent" into "Create event".
+func summaryFromName(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		switch {
+		case i == 0:
+			b.WriteRune(unicode.ToUpper(r))
+		case unicode.IsUpper(r):
+			b.WriteByte(' ')
+			b.WriteRune(unicode.ToLower(r))
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
 }
 
-func declineEventInviteHandler(c *gin.Context) {
-	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
-	defer cancel()
+// buildOpenAPIDocument renders the OpenAPI 3 document for the registered routes once at
+// startup; apiOperations adds summaries and typed bodies where they are known.
+func buildOpenAPIDocument(routes gin.RoutesInfo) error {
+	schemas := openAPISchemas{}
+	errorRef := schemas.schemaFor(reflect.TypeOf(apiError{}))
+	paths := map[string]gin.H{}
+	usedIDs := map[string]bool{}
+	for _, rt := range routes {
+		if !openAPIMethods[rt.Method] {
+			continue
+		}
+		key := rt.Method + " " + rt.Path
+		doc := apiOperations[key]
 
-	eventID := c.Param("id")
-	userID := ctxUserID(c)
+		opID := operationName(rt.Handler, rt.Method, rt.Path)
+		if usedIDs[opID] {
+			opID += strings.ToUpper(rt.Method[:1]) + strings.ToLower(rt.Method[1:])
+		}
+		usedIDs[opID] = true
+		summary := doc.Summary
+		if summary == "" {
+			summary = summaryFromName(opID)
+		}
+		tag := strings.SplitN(strings.TrimPrefix(rt.Path, "/"), "/", 2)[0]
 
-	var inviteID string
-	err := db.QueryRowContext(ctx, `
-		SELECT id FROM event_invites
-		WHERE event_id = ? AND invitee_id = ? AND status = 'pending'
-	`, eventID, userID).Scan(&inviteID)
-	if err == sql.ErrNoRows {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Invite not found"})
-		return
-	} else if err != nil {
-		logIfTimeout(err, "declineEventInvite: select")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
-		return
+		op := gin.H{"operationId": opID, "summary": summary, "tags": []string{tag}}
+		var params []gin.H
+		for _, m := range routeParamRe.FindAllStringSubmatch(rt.Path, -1) {
+			params = append(params, gin.H{"name": m[1], "in": "path", "required": true, "schema": gin.H{"type": "string"}})
+		}
+		if len(params) > 0 {
+			op["parameters"] = params
+		}
+		if doc.Request != nil {
+			op["requestBody"] = gin.H{"required": true, "content": gin.H{
+				"application/json": gin.H{"schema": schemas.schemaFor(reflect.TypeOf(doc.Request))},
+			}}
+		}
+		status := doc.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		success := gin.H{"description": http.StatusText(status)}
+		content := gin.H{}
+		if doc.ContentType != "" {
+			content[doc.ContentType] = gin.H{"schema": gin.H{"type": "string", "format": "binary"}}
+		}
+		if doc.Response != nil {
+			content["application/json"] = gin.H{"schema": schemas.schemaFor(reflect.TypeOf(doc.Response))}
+		}
+		if len(content) > 0 {
+			success["content"] = content
+		}
+		op["responses"] = gin.H{
+			strconv.Itoa(status): success,
+			"default":            gin.H{"description": "Error", "content": gin.H{"application/json": gin.H{"schema": errorRef}}},
+		}
+		if authRoutes[key] {
+			op["security"] = []gin.H{{"bearerAuth": []string{}}}
+		}
+
+		p := routeParamRe.ReplaceAllString(rt.Path, "{$1}")
+		if paths[p] == nil {
+			paths[p] = gin.H{}
+		}
+		paths[p][strings.ToLower(rt.Method)] = op
 	}
 
-	now := time.Now().UTC()
-	if _, err := db.ExecContext(ctx, `UPDATE event_invites SET status = 'declined', updated_at = ? WHERE id = ?`, now, inviteID); err != nil {
-		logIfTimeout(err, "declineEventInvite: update")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Server error"})
+	b, err := json.Marshal(gin.H{
+		"openapi": "3.0.3",
+		"info": gin.H{
+			"title":       "Plannie API",
+			"version":     strconv.Itoa(schemaVersion),
+			"description": "Generated from the server's routes. Slot keys are RFC 3339 timestamps and durations are in minutes.",
+		},
+		"paths": paths,
+		"components": gin.H{
+			"schemas":         schemas,
+			"securitySchemes": gin.H{"bearerAuth": gin.H{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(b)
+	openAPIJSON, openAPIETag = b, `"`+hex.EncodeToString(sum[:8])+`"`
+	return nil
+}
+
+func openAPIHandler(c *gin.Context) {
+	c.Header("ETag", openAPIETag)
+	c.Header("Cache-Control", "public, max-age=300")
+	if c.GetHeader("If-None-Match") == openAPIETag {
+		c.Status(http.StatusNotModified)
 		return
 	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", openAPIJSON)
+}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Invite declined"})
+const swaggerUIVersion = "5.17.14"
+
+const swaggerUIScript = `window.ui = SwaggerUIBundle({url: "openapi.json", dom_id: "#swagger-ui"});`
+
+// swaggerUIHandler serves Swagger UI from unpkg for /openapi.json. It is off unless
+// OPENAPI_DOCS_UI=true, and relaxes the CSP for this page only: the pinned assets and the
+// hash of the one inline script.
+func swaggerUIHandler(c *gin.Context) {
+	sum := sha256.Sum256([]byte(swaggerUIScript))
+	assets := "https://unpkg.com/swagger-ui-dist@" + swaggerUIVersion + "/"
+	c.Header("Content-Security-Policy", "default-src 'self'; script-src "+assets+" 'sha256-"+base64.StdEncoding.EncodeToString(sum[:])+"'; style-src "+assets+"; img-src 'self' data:; frame-ancestors 'none';")
+	c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(`<!doctype html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Plannie API</title>
+<link rel="stylesheet" href="`+assets+`swagger-ui.css">
+</head>
+<body>
+<div id="swagger-ui"></div>
+<script src="`+assets+`swagger-ui-bundle.js"></script>
+<script>`+swaggerUIScript+`</script>
+</body>
+</html>
+`))
 }
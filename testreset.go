@@ -0,0 +1,115 @@
+//go:build testreset
+
+package main
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Built with -tags testreset, the server exposes POST /test/reset, which empties every
+// table and in-process cache so an integration suite can start each case from a clean
+// instance without restarting it. Pair it with DATABASE_PATH=:memory:. Never ship a
+// binary built with this tag: the endpoint is unauthenticated.
+func init() {
+	extraRoutes = append(extraRoutes, func(r *gin.Engine) {
+		log.Println("test: POST /test/reset is enabled (built with -tags testreset)")
+		r.POST("/test/reset", testResetHandler)
+	})
+}
+
+func testResetHandler(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), reqTimeout)
+	defer cancel()
+
+	tables, err := truncateAll(ctx, db)
+	if err != nil {
+		serverError(c, "testReset: truncate", err)
+		return
+	}
+	if archiveDB != nil {
+		if _, err := truncateAll(ctx, archiveDB); err != nil {
+			serverError(c, "testReset: truncate archive", err)
+			return
+		}
+	}
+
+	muVisitors.Lock()
+	visitors = map[string]*visitor{}
+	muVisitors.Unlock()
+	ipBansMu.Lock()
+	ipBans = map[string]time.Time{}
+	ipBansMu.Unlock()
+	ipRulesMu.Lock()
+	ipRules = map[string][]ipRule{}
+	ipRulesMu.Unlock()
+	devMailboxMu.Lock()
+	devMailbox = nil
+	devMailboxMu.Unlock()
+	emailQueueMu.Lock()
+	emailQueue = nil
+	emailUserSends = map[string][]time.Time{}
+	emailQueueMu.Unlock()
+	statsMu.Lock()
+	statsPending = map[[2]string]int64{}
+	statsPeaks = map[[2]string]int64{}
+	emailDeliveryPending = map[[3]string]int64{}
+	emailLastSent, emailLastFailure = time.Time{}, time.Time{}
+	statsMu.Unlock()
+	calendarCacheMu.Lock()
+	calendarCache = map[string]calendarCacheEntry{}
+	calendarCacheMu.Unlock()
+	eventCacheMu.Lock()
+	eventCacheLRU.Init()
+	eventCacheIndex = map[string]*list.Element{}
+	eventCacheGen++
+	eventCacheMu.Unlock()
+
+	if err := loadPolicyVersions(ctx); err != nil {
+		serverError(c, "testReset: policies", err)
+		return
+	}
+	if err := reloadSettings(ctx); err != nil {
+		serverError(c, "testReset: settings", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"tables": tables})
+}
+
+// truncateAll deletes every row except the migration history in one transaction.
+func truncateAll(ctx context.Context, d *sql.DB) (int, error) {
+	rows, err := d.QueryContext(ctx, `SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' AND name != 'schema_versions'`)
+	if err != nil {
+		return 0, err
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	tx, err := d.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	for _, name := range names {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM "`+name+`"`); err != nil {
+			return 0, err
+		}
+	}
+	return len(names), tx.Commit()
+}